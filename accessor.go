@@ -1,10 +1,13 @@
 package dagstore
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/filecoin-project/dagstore/mount"
 	"github.com/filecoin-project/dagstore/shard"
@@ -14,6 +17,14 @@ import (
 	carv2 "github.com/ipld/go-car/v2"
 	"github.com/ipld/go-car/v2/blockstore"
 	"github.com/ipld/go-car/v2/index"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	_ "github.com/ipld/go-ipld-prime/codec/dagcbor" // register the dag-cbor codec for traversals.
+	_ "github.com/ipld/go-ipld-prime/codec/raw"     // register the raw codec for traversals.
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
 
 	"golang.org/x/exp/mmap"
 )
@@ -26,6 +37,28 @@ type ReadBlockstore interface {
 	GetSize(context.Context, cid.Cid) (int, error)
 	AllKeysChan(ctx context.Context) (<-chan cid.Cid, error)
 	HashOnRead(enabled bool)
+
+	// View implements blockstore.Viewer, handing the block data to the
+	// callback without allocating a new block. The slice must not be retained.
+	View(ctx context.Context, c cid.Cid, callback func([]byte) error) error
+}
+
+// BatchGetter is implemented by the ReadBlockstores returned by the DAG store
+// that read batches of blocks at once.
+type BatchGetter interface {
+	// GetMany returns the blocks identified by cids, in the same order, with
+	// nil for the blocks not found. Reads are issued in the order in which the
+	// blocks appear in the CAR, e.g. to serve batches of graphsync requests
+	// with mostly sequential I/O.
+	GetMany(ctx context.Context, cids []cid.Cid) ([]blocks.Block, error)
+}
+
+// KeyIterable is implemented by the ReadBlockstores returned by the DAG store
+// that enumerate their keys through a KeyIterator.
+type KeyIterable interface {
+	// Iterator returns a pull-based iterator over the keys of the blockstore,
+	// like AllKeysChan but without a goroutine and channel per iteration.
+	Iterator() (*KeyIterator, error)
 }
 
 // ShardAccessor provides various means to access the data contained
@@ -40,6 +73,38 @@ type ShardAccessor struct {
 	// and an mmap-backed accessor was requested (e.g. Blockstore).
 	lk    sync.Mutex
 	mmapr *mmap.ReaderAt
+
+	// restrict, if non-nil, restricts the blocks exposed by the accessor, as
+	// requested through AcquireOpts.
+	restrict restriction
+
+	// onBlockAccess, if non-nil, is called on every block read, as requested
+	// through AcquireOpts.
+	onBlockAccess BlockAccessFunc
+
+	// caller is the caller the blocks read are accounted to, as requested
+	// through AcquireOpts.
+	caller string
+
+	// refID is the id of the shard reference held by this accessor, when
+	// refcount accounting is enabled.
+	refID uint64
+
+	// replica is set if the accessor reads from a replica of the shard, in
+	// which case it holds no reference to the local shard.
+	replica bool
+
+	closed  bool        // guarded by lk; set once the shard reference is released.
+	expired bool        // guarded by lk; set if the accessor was closed by its lease.
+	lease   *time.Timer // guarded by lk; fires when the lease expires, if any.
+	// freed is set once the mmap and the mount reader are closed; guarded by
+	// lk. It lags closed when the lease expires, as readers may still be
+	// reading them until the accessor is closed by its owner.
+	freed bool
+
+	// readers guards the reads of iterators from the mmap and the mount
+	// reader, which free waits for before closing them.
+	readers readGuard
 }
 
 func NewShardAccessor(data mount.Reader, idx index.Index, s *Shard) (*ShardAccessor, error) {
@@ -54,11 +119,50 @@ func (sa *ShardAccessor) Shard() shard.Key {
 	return sa.shard.key
 }
 
+// Replica returns whether the accessor reads from a replica of the shard,
+// because the local shard was errored or recovering when it was acquired
+// (see Config.ReplicaResolver).
+func (sa *ShardAccessor) Replica() bool {
+	return sa.replica
+}
+
+// CAR returns a reader of the raw CAR data of the shard, along with its size,
+// e.g. to export the shard as a file. It's not available through accessors
+// restricted with AcquireOpts, and must not be used after the accessor is
+// closed.
+func (sa *ShardAccessor) CAR() (io.ReaderAt, int64, error) {
+	sa.lk.Lock()
+	defer sa.lk.Unlock()
+
+	if err := sa.checkOpen(); err != nil {
+		return nil, 0, err
+	}
+	if sa.restrict != nil {
+		return nil, 0, fmt.Errorf("%s: CAR data is not available through restricted accessors", sa.shard.key.String())
+	}
+	size, err := sa.data.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to determine size of CAR data: %w", err)
+	}
+	return sa.data, size, nil
+}
+
 func (sa *ShardAccessor) Blockstore() (ReadBlockstore, error) {
-	var r io.ReaderAt = sa.data
+	// hide the other methods of the reader, as the blockstore reads the CAR
+	// version from the current offset of readers that are io.Readers, which
+	// would break every blockstore but the first.
+	var r io.ReaderAt = struct{ io.ReaderAt }{sa.data}
 
 	sa.lk.Lock()
-	if f, ok := sa.data.(*os.File); ok {
+	if err := sa.checkOpen(); err != nil {
+		sa.lk.Unlock()
+		return nil, err
+	}
+	if sa.mmapr != nil {
+		// blockstores of the same accessor share its mapping, which is closed
+		// along with the accessor.
+		r = sa.mmapr
+	} else if f, ok := sa.data.(*os.File); ok {
 		if mmapr, err := mmap.Open(f.Name()); err != nil {
 			log.Warnf("failed to mmap reader of type %T: %s; using reader as-is", sa.data, err)
 		} else {
@@ -71,23 +175,274 @@ func (sa *ShardAccessor) Blockstore() (ReadBlockstore, error) {
 	sa.lk.Unlock()
 
 	bs, err := blockstore.NewReadOnly(r, sa.idx, carv2.ZeroLengthSectionAsEOF(true))
-	return bs, err
+	if err != nil {
+		return nil, err
+	}
+	// index offsets are relative to the CARv1 data payload.
+	cr, err := carv2.NewReader(r, carv2.ZeroLengthSectionAsEOF(true))
+	if err != nil {
+		return nil, err
+	}
+	dr, err := cr.DataReader()
+	if err != nil {
+		return nil, err
+	}
+	vbs := &viewBlockstore{ReadOnly: bs, backing: dr, idx: sa.idx, readers: &sa.readers}
+	if sa.shard.d.config.IndexedGetSize {
+		vbs.offsets = sa.shard.sectionOffsets(sa.idx)
+	}
+	var ret ReadBlockstore = vbs
+	if c := sa.shard.d.blockCache; c != nil {
+		ret = &cachedBlockstore{ReadBlockstore: ret, cache: c, prefix: sa.shard.key.String() + "/"}
+	}
+	ret = sa.statsOf(ret)
+	if sa.restrict != nil {
+		ret = &restrictedBlockstore{ReadBlockstore: ret, allowed: sa.restrict}
+	}
+	return ret, nil
+}
+
+// statsOf wraps bs to account the blocks it serves to the shard and to the
+// caller of the accessor.
+func (sa *ShardAccessor) statsOf(bs ReadBlockstore) *statsBlockstore {
+	return &statsBlockstore{ReadBlockstore: bs, shard: sa.shard, onAccess: sa.onBlockAccess, caller: sa.caller}
+}
+
+// LinkSystem returns a go-ipld-prime LinkSystem that loads blocks from this
+// shard's blockstore, so that traversal and selector code can consume the
+// shard directly. It is read-only; storing blocks through it fails. It shares
+// the accessor's mapping of the shard, and must not be used after the accessor
+// is closed.
+func (sa *ShardAccessor) LinkSystem() (ipld.LinkSystem, error) {
+	bs, err := sa.Blockstore()
+	if err != nil {
+		return ipld.LinkSystem{}, fmt.Errorf("failed to open blockstore for link system: %w", err)
+	}
+	return newLinkSystem(bs, nil), nil
+}
+
+// newLinkSystem creates a read-only LinkSystem backed by a blockstore. If
+// visit is non-nil, it's called with every block that's loaded, and a non-nil
+// error aborts the load.
+func newLinkSystem(bs ReadBlockstore, visit func(blk blocks.Block) error) ipld.LinkSystem {
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.TrustedStorage = true
+	lsys.StorageReadOpener = func(lctx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		cl, ok := lnk.(cidlink.Link)
+		if !ok {
+			return nil, fmt.Errorf("unsupported link type %T", lnk)
+		}
+		blk, err := bs.Get(lctx.Ctx, cl.Cid)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get block %s: %w", cl.Cid, err)
+		}
+		if visit != nil {
+			if err := visit(blk); err != nil {
+				return nil, err
+			}
+		}
+		return bytes.NewReader(blk.RawData()), nil
+	}
+	lsys.StorageWriteOpener = func(ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+		return nil, nil, ErrReadOnlyLinkSystem
+	}
+	return lsys
+}
+
+// Traverse walks the DAG rooted at root within this shard, following the
+// supplied IPLD selector. Blocks are looked up through the shard index, and
+// visit is called once for every block that is loaded during the traversal,
+// in traversal order; blocks reachable through several paths are visited every
+// time they are loaded. This enables partial retrievals (e.g. a subpath of a
+// UnixFS tree) without having to construct an external traverser.
+//
+// A non-nil error returned by visit aborts the traversal, and is propagated
+// to the caller. Links to blocks that are not present in the shard will make
+// the traversal fail.
+func (sa *ShardAccessor) Traverse(ctx context.Context, root cid.Cid, sel ipld.Node, visit func(blk blocks.Block) error) error {
+	return sa.traverse(ctx, root, sel, visit, false)
+}
+
+// traverse implements Traverse. If once is set, links are followed only the
+// first time they're seen, so that shared subtrees are walked once.
+func (sa *ShardAccessor) traverse(ctx context.Context, root cid.Cid, sel ipld.Node, visit func(blk blocks.Block) error, once bool) error {
+	compiled, err := selector.CompileSelector(sel)
+	if err != nil {
+		return fmt.Errorf("failed to compile selector: %w", err)
+	}
+
+	bs, err := sa.Blockstore()
+	if err != nil {
+		return fmt.Errorf("failed to open blockstore for traversal: %w", err)
+	}
+	lsys := newLinkSystem(bs, visit)
+
+	chooser := dagpb.AddSupportToChooser(basicnode.Chooser)
+	rootLnk := cidlink.Link{Cid: root}
+	lctx := ipld.LinkContext{Ctx: ctx}
+	proto, err := chooser(rootLnk, lctx)
+	if err != nil {
+		return fmt.Errorf("failed to choose prototype for root %s: %w", root, err)
+	}
+	nd, err := lsys.Load(lctx, rootLnk, proto)
+	if err != nil {
+		return fmt.Errorf("failed to load root %s: %w", root, err)
+	}
+
+	progress := traversal.Progress{
+		Cfg: &traversal.Config{
+			Ctx:                            ctx,
+			LinkSystem:                     lsys,
+			LinkTargetNodePrototypeChooser: chooser,
+			LinkVisitOnlyOnce:              once,
+		},
+	}
+	err = progress.WalkAdv(nd, compiled, func(traversal.Progress, ipld.Node, traversal.VisitReason) error {
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("traversal of shard %s failed: %w", sa.shard.key, err)
+	}
+	return nil
 }
 
 // Close terminates this shard accessor, releasing any resources associated
-// with it, and decrementing internal refcounts.
+// with it, and decrementing internal refcounts. It returns ErrLeaseExpired if
+// the accessor was already released because its lease expired, in which case
+// it still frees its resources, which the expiry leaves to the owner.
 func (sa *ShardAccessor) Close() error {
-	if err := sa.data.Close(); err != nil {
-		log.Warnf("failed to close mount when closing shard accessor: %s", err)
+	var caller string
+	if sa.shard.d.config.RefcountAccounting {
+		caller = callerProvenance()
+	}
+	// releases go through the completion channel, so that they're processed
+	// even while the DAG store is paused.
+	_, err := sa.close(sa.shard.d.completionCh, caller, false)
+	return err
+}
+
+// Extend renews the lease of the accessor, so that it expires d from now. It
+// fails with ErrLeaseExpired if the lease already expired, in which case the
+// accessor can no longer be used.
+func (sa *ShardAccessor) Extend(d time.Duration) error {
+	sa.lk.Lock()
+	defer sa.lk.Unlock()
+
+	if err := sa.checkOpen(); err != nil {
+		return err
+	}
+	if sa.lease == nil {
+		return fmt.Errorf("%s: accessor has no lease", sa.shard.key.String())
+	}
+	if !sa.lease.Stop() {
+		// the lease fired, and the accessor is about to be released.
+		return fmt.Errorf("%s: %w", sa.shard.key.String(), ErrLeaseExpired)
 	}
+	sa.lease.Reset(d)
+	return nil
+}
+
+// startLease arms the lease of the accessor, which force-releases it if it's
+// not closed or extended within d.
+func (sa *ShardAccessor) startLease(d time.Duration) {
 	sa.lk.Lock()
+	defer sa.lk.Unlock()
+
+	sa.lease = time.AfterFunc(d, func() {
+		released, err := sa.expire()
+		if released {
+			log.Warnw("accessor lease expired; force-released shard", "shard", sa.shard.key, "error", err)
+		}
+	})
+}
+
+// checkOpen returns an error if the accessor was closed. It must be called
+// with the lock held.
+func (sa *ShardAccessor) checkOpen() error {
+	switch {
+	case sa.expired:
+		return fmt.Errorf("%s: %w", sa.shard.key.String(), ErrLeaseExpired)
+	case sa.closed:
+		return fmt.Errorf("%s: accessor closed", sa.shard.key.String())
+	}
+	return nil
+}
+
+// release releases an accessor that was never delivered to its owner on
+// behalf of the DAG store, unless it was already closed, in which case it
+// returns false.
+func (sa *ShardAccessor) release(chs []chan *task) (bool, error) {
+	return sa.close(chs, "", true)
+}
+
+// expire releases the shard reference held by the accessor when its lease
+// expires, unless it was already closed, in which case it returns false. The
+// accessor is invalidated, but its resources are left to Close, as readers
+// may still be reading them; unmapping them under their feet would crash.
+func (sa *ShardAccessor) expire() (bool, error) {
+	sa.lk.Lock()
+	if sa.closed {
+		sa.lk.Unlock()
+		return false, nil
+	}
+	sa.closed, sa.expired = true, true
+	sa.lk.Unlock()
+
+	return true, sa.releaseRef(sa.shard.d.completionCh, "")
+}
+
+// close closes the resources of the accessor, and releases the shard
+// reference it holds by queuing a release task on the supplied channels. If
+// once is set, it does nothing and returns false if the accessor was already
+// closed. If the lease of the accessor expired, it only frees the resources.
+func (sa *ShardAccessor) close(chs []chan *task, caller string, once bool) (bool, error) {
+	sa.lk.Lock()
+	switch {
+	case sa.expired:
+		sa.free()
+		sa.lk.Unlock()
+		if once {
+			return false, nil
+		}
+		return false, fmt.Errorf("%s: %w", sa.shard.key.String(), ErrLeaseExpired)
+	case sa.closed && once:
+		sa.lk.Unlock()
+		return false, nil
+	}
+	sa.closed = true
+	if sa.lease != nil {
+		sa.lease.Stop()
+	}
+	sa.free()
+	sa.lk.Unlock()
+
+	return true, sa.releaseRef(chs, caller)
+}
+
+// free closes the mmap and the mount reader of the accessor, if not done
+// already. It must be called with the lock held.
+func (sa *ShardAccessor) free() {
+	if sa.freed {
+		return
+	}
+	sa.freed = true
+	sa.readers.close()
 	if sa.mmapr != nil {
 		if err := sa.mmapr.Close(); err != nil {
 			log.Warnf("failed to close mmap when closing shard accessor: %s", err)
 		}
 	}
-	sa.lk.Unlock()
+	if err := sa.data.Close(); err != nil {
+		log.Warnf("failed to close mount when closing shard accessor: %s", err)
+	}
+}
 
-	tsk := &task{op: OpShardRelease, shard: sa.shard}
-	return sa.shard.d.queueTask(tsk, sa.shard.d.externalCh)
+// releaseRef releases the shard reference held by the accessor by queuing a
+// release task on the supplied channels.
+func (sa *ShardAccessor) releaseRef(chs []chan *task, caller string) error {
+	if sa.replica {
+		return nil
+	}
+	tsk := &task{op: OpShardRelease, shard: sa.shard, ref: sa.refID, caller: caller}
+	return sa.shard.d.queueTask(tsk, chs)
 }
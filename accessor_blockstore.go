@@ -0,0 +1,809 @@
+package dagstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	format "github.com/ipfs/go-ipld-format"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/blockstore"
+	"github.com/ipld/go-car/v2/index"
+	"github.com/multiformats/go-multihash"
+
+	"github.com/filecoin-project/dagstore/blockcache"
+)
+
+// sectionBufPool pools the buffers used to read CAR sections in
+// viewBlockstore.View, so that serving a block does not allocate.
+var sectionBufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 4<<10)
+		return &b
+	},
+}
+
+// viewBlockstore wraps the CARv2 read-only blockstore, adding support for
+// zero-allocation reads through the blockstore.Viewer interface.
+type viewBlockstore struct {
+	*blockstore.ReadOnly
+
+	backing io.ReaderAt
+	idx     index.Index
+
+	// readers, if non-nil, guards the reads of iterators from backing
+	// against the accessor being freed.
+	readers *readGuard
+
+	// offsets, if non-nil, enables GetSize from the offsets of the index; see
+	// Config.IndexedGetSize.
+	offsets *sectionOffsets
+
+	// hashOnRead is set if the data of blocks is verified against their CID
+	// upon reads; accessed atomically.
+	hashOnRead int32
+}
+
+var (
+	_ ReadBlockstore = (*viewBlockstore)(nil)
+	_ BatchGetter    = (*viewBlockstore)(nil)
+	_ KeyIterable    = (*viewBlockstore)(nil)
+)
+
+// HashOnRead enables or disables the verification of the data of blocks
+// against their CID upon reads, failing reads of corrupted blocks with
+// ErrHashMismatch.
+func (v *viewBlockstore) HashOnRead(enabled bool) {
+	var flag int32
+	if enabled {
+		flag = 1
+	}
+	atomic.StoreInt32(&v.hashOnRead, flag)
+}
+
+// verify checks the data of a block against its CID, if HashOnRead is
+// enabled.
+func (v *viewBlockstore) verify(c cid.Cid, data []byte) error {
+	if atomic.LoadInt32(&v.hashOnRead) == 0 {
+		return nil
+	}
+	actual, err := c.Prefix().Sum(data)
+	if err != nil {
+		return fmt.Errorf("failed to hash block %s: %w", c, err)
+	}
+	if !actual.Equals(c) {
+		return bstore.ErrHashMismatch
+	}
+	return nil
+}
+
+func (v *viewBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	blk, err := v.ReadOnly.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if c.Prefix().MhType != multihash.IDENTITY {
+		if err := v.verify(c, blk.RawData()); err != nil {
+			return nil, err
+		}
+	}
+	return blk, nil
+}
+
+// View calls the callback with the data of the block identified by c. The
+// byte slice is only valid for the duration of the callback; callers must not
+// retain nor mutate it, as it's recycled for subsequent reads.
+//
+// The callback is only called if the block is found; otherwise an
+// ipld-format ErrNotFound error is returned. Errors returned by the callback
+// are propagated to the caller.
+func (v *viewBlockstore) View(ctx context.Context, c cid.Cid, callback func([]byte) error) error {
+	// identity CIDs carry their data inline.
+	if c.Prefix().MhType == multihash.IDENTITY {
+		dmh, err := multihash.Decode(c.Hash())
+		if err != nil {
+			return err
+		}
+		return callback(dmh.Digest)
+	}
+
+	bufp := sectionBufPool.Get().(*[]byte)
+	defer sectionBufPool.Put(bufp)
+
+	var (
+		data  []byte
+		fnErr error
+	)
+	err := v.idx.GetAll(c, func(offset uint64) bool {
+		var section []byte
+		section, fnErr = v.readSection(int64(offset), bufp)
+		if fnErr != nil {
+			return false
+		}
+		n, readCid, err := cid.CidFromBytes(section)
+		if err != nil {
+			fnErr = fmt.Errorf("failed to read CID of section at offset %d: %w", offset, err)
+			return false
+		}
+		if bytes.Equal(readCid.Hash(), c.Hash()) {
+			data = section[n:]
+		}
+		return false
+	})
+	switch {
+	case errors.Is(err, index.ErrNotFound):
+		return format.ErrNotFound{Cid: c}
+	case err != nil:
+		return err
+	case fnErr != nil:
+		return fnErr
+	case data == nil:
+		return format.ErrNotFound{Cid: c}
+	}
+	if err := v.verify(c, data); err != nil {
+		return err
+	}
+	return callback(data)
+}
+
+// GetSize returns the size of the block identified by c. With
+// Config.IndexedGetSize, the size is derived from the distance to the offset
+// of the next section in the index, without reading the CAR; otherwise, and
+// for the last section of the CAR, which may be followed by padding, the
+// section is read.
+func (v *viewBlockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	if v.offsets == nil {
+		return v.ReadOnly.GetSize(ctx, c)
+	}
+	if c.Prefix().MhType == multihash.IDENTITY {
+		dmh, err := multihash.Decode(c.Hash())
+		if err != nil {
+			return 0, err
+		}
+		return len(dmh.Digest), nil
+	}
+
+	offsets, err := v.offsets.get()
+	if err != nil {
+		return v.ReadOnly.GetSize(ctx, c)
+	}
+	var offset uint64
+	err = v.idx.GetAll(c, func(o uint64) bool {
+		offset = o
+		return false
+	})
+	switch {
+	case errors.Is(err, index.ErrNotFound):
+		return 0, format.ErrNotFound{Cid: c}
+	case err != nil:
+		return 0, err
+	}
+
+	i := sort.Search(len(offsets), func(i int) bool { return offsets[i] > offset })
+	if i == len(offsets) {
+		return v.ReadOnly.GetSize(ctx, c)
+	}
+	l, ok := sectionLength(offsets[i] - offset)
+	if !ok || l < uint64(c.ByteLen()) {
+		return v.ReadOnly.GetSize(ctx, c)
+	}
+	return int(l) - c.ByteLen(), nil
+}
+
+// sectionOffsets holds the sorted offsets of all sections in an index, which
+// are loaded upon first use, and shared by the blockstores of all accessors
+// served with that index.
+type sectionOffsets struct {
+	idx     index.Index
+	once    sync.Once
+	offsets []uint64
+	err     error
+}
+
+// sectionOffsets returns the section offsets of idx, reusing those of the
+// last index the shard was served with if it's the same one.
+func (s *Shard) sectionOffsets(idx index.Index) *sectionOffsets {
+	s.offsetsLk.Lock()
+	defer s.offsetsLk.Unlock()
+
+	if so := s.offsets; so != nil && sameIndex(so.idx, idx) {
+		return so
+	}
+	s.offsets = &sectionOffsets{idx: idx}
+	return s.offsets
+}
+
+// sameIndex returns whether a and b are the same index instance. Indices may
+// be of map types, which can't be compared with ==.
+func sameIndex(a, b index.Index) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if !va.IsValid() || !vb.IsValid() || va.Type() != vb.Type() {
+		return false
+	}
+	switch va.Kind() {
+	case reflect.Ptr, reflect.Map:
+		return va.Pointer() == vb.Pointer()
+	}
+	return false
+}
+
+// get returns the offsets of all sections in the index, sorted.
+func (so *sectionOffsets) get() ([]uint64, error) {
+	so.once.Do(func() {
+		iterable, ok := so.idx.(index.IterableIndex)
+		if !ok {
+			so.err = errors.New("index for shard is not iterable")
+			return
+		}
+		err := iterable.ForEach(func(_ multihash.Multihash, offset uint64) error {
+			so.offsets = append(so.offsets, offset)
+			return nil
+		})
+		if err != nil {
+			so.offsets, so.err = nil, err
+			return
+		}
+		sort.Slice(so.offsets, func(i, j int) bool { return so.offsets[i] < so.offsets[j] })
+	})
+	return so.offsets, so.err
+}
+
+// sectionLength returns the length of a section spanning total bytes,
+// including its varint length prefix.
+func sectionLength(total uint64) (uint64, bool) {
+	var buf [binary.MaxVarintLen64]byte
+	for n := uint64(1); n <= binary.MaxVarintLen64 && n < total; n++ {
+		if l := total - n; uint64(binary.PutUvarint(buf[:], l)) == n {
+			return l, true
+		}
+	}
+	return 0, false
+}
+
+// GetMany returns the blocks identified by cids, in the same order, reading
+// them in the order in which they appear in the CAR, so that batches of
+// random reads turn into mostly sequential I/O. The blocks not in the shard
+// are returned as nil.
+func (v *viewBlockstore) GetMany(ctx context.Context, cids []cid.Cid) ([]blocks.Block, error) {
+	type read struct {
+		i      int
+		offset uint64
+	}
+	ret := make([]blocks.Block, len(cids))
+	reads := make([]read, 0, len(cids))
+	for i, c := range cids {
+		if c.Prefix().MhType == multihash.IDENTITY {
+			dmh, err := multihash.Decode(c.Hash())
+			if err != nil {
+				return nil, err
+			}
+			if ret[i], err = blocks.NewBlockWithCid(dmh.Digest, c); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		err := v.idx.GetAll(c, func(offset uint64) bool {
+			reads = append(reads, read{i: i, offset: offset})
+			return false
+		})
+		if err != nil && !errors.Is(err, index.ErrNotFound) {
+			return nil, err
+		}
+	}
+	sort.Slice(reads, func(i, j int) bool { return reads[i].offset < reads[j].offset })
+
+	bufp := sectionBufPool.Get().(*[]byte)
+	defer sectionBufPool.Put(bufp)
+	for _, r := range reads {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		section, err := v.readSection(int64(r.offset), bufp)
+		if err != nil {
+			return nil, err
+		}
+		c := cids[r.i]
+		n, readCid, err := cid.CidFromBytes(section)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CID of section at offset %d: %w", r.offset, err)
+		}
+		if !bytes.Equal(readCid.Hash(), c.Hash()) {
+			continue
+		}
+		if err := v.verify(c, section[n:]); err != nil {
+			return nil, err
+		}
+		// the section buffer is recycled, so the block gets a copy.
+		blk, err := blocks.NewBlockWithCid(append([]byte(nil), section[n:]...), c)
+		if err != nil {
+			return nil, err
+		}
+		ret[r.i] = blk
+	}
+	return ret, nil
+}
+
+// readSection reads the CAR section (CID and block data) starting at offset,
+// into the supplied buffer, growing it if necessary.
+func (v *viewBlockstore) readSection(offset int64, bufp *[]byte) ([]byte, error) {
+	var lbuf [binary.MaxVarintLen64]byte
+	n, err := v.backing.ReadAt(lbuf[:], offset)
+	if err != nil && !(errors.Is(err, io.EOF) && n > 0) {
+		return nil, fmt.Errorf("failed to read section length at offset %d: %w", offset, err)
+	}
+	l, vn := binary.Uvarint(lbuf[:n])
+	if vn <= 0 {
+		return nil, fmt.Errorf("invalid section length at offset %d", offset)
+	}
+	if l == 0 {
+		// zero-length sections are treated as EOF.
+		return nil, io.EOF
+	}
+	if l > carv2.DefaultMaxAllowedSectionSize {
+		return nil, fmt.Errorf("section at offset %d exceeds maximum allowed size: %d", offset, l)
+	}
+
+	buf := *bufp
+	if uint64(cap(buf)) < l {
+		buf = make([]byte, l)
+		*bufp = buf
+	}
+	buf = buf[:l]
+	if rn, err := v.backing.ReadAt(buf, offset+int64(vn)); rn < len(buf) {
+		return nil, fmt.Errorf("failed to read section at offset %d: %w", offset, err)
+	}
+	return buf, nil
+}
+
+// AllKeysChan streams the CIDs of the blocks in the shard, reading them from
+// the index and the section headers rather than scanning the CAR. See
+// KeyIterator.
+func (v *viewBlockstore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	it, err := v.Iterator()
+	if err != nil {
+		return nil, err
+	}
+	return it.chanOf(ctx), nil
+}
+
+// Iterator returns an iterator over the CIDs of the blocks in the shard.
+func (v *viewBlockstore) Iterator() (*KeyIterator, error) {
+	iterable, ok := v.idx.(index.IterableIndex)
+	if !ok {
+		return nil, errors.New("index for shard is not iterable")
+	}
+	var offsets []uint64
+	err := iterable.ForEach(func(_ multihash.Multihash, offset uint64) error {
+		offsets = append(offsets, offset)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to iterate over index: %w", err)
+	}
+	// visit the sections in the order in which they appear in the CAR.
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	return &KeyIterator{v: v, offsets: offsets}, nil
+}
+
+// KeyIterator is a pull-based iterator over the CIDs of the blocks in a
+// shard, obtained through ReadBlockstore.Iterator. Keys are enumerated from
+// the shard index, in the order in which the blocks appear in the CAR; only
+// the CID at the head of each section is read, never the block data. Like the
+// index, it omits identity CIDs if the index doesn't record them.
+//
+// A KeyIterator is not safe for concurrent use.
+type KeyIterator struct {
+	v       *viewBlockstore
+	offsets []uint64
+	allowed restriction
+	buf     []byte
+
+	// chain, if non-nil, holds the iterators of the blockstores of a shard
+	// group, which are drained in turn; seen holds the CIDs already returned.
+	chain []*KeyIterator
+	seen  map[string]struct{}
+}
+
+// Next returns the next CID, or io.EOF once all CIDs have been returned.
+func (it *KeyIterator) Next() (cid.Cid, error) {
+	if it.chain != nil {
+		return it.nextChained()
+	}
+	for len(it.offsets) > 0 {
+		offset := it.offsets[0]
+		it.offsets = it.offsets[1:]
+
+		c, err := it.guardedReadCid(int64(offset))
+		if err != nil {
+			it.offsets = nil
+			return cid.Undef, err
+		}
+		if it.allowed != nil {
+			if _, ok := it.allowed[string(c.Hash())]; !ok {
+				continue
+			}
+		}
+		return c, nil
+	}
+	return cid.Undef, io.EOF
+}
+
+// guardedReadCid calls readCid, unless the accessor of the blockstore was
+// freed, in which case the backing reader may be unmapped already.
+func (it *KeyIterator) guardedReadCid(offset int64) (cid.Cid, error) {
+	if g := it.v.readers; g != nil {
+		if !g.enter() {
+			return cid.Undef, errAccessorFreed
+		}
+		defer g.exit()
+	}
+	return it.readCid(offset)
+}
+
+// readCid reads the CID at the head of the section starting at offset,
+// reading a short prefix first, which fits all but inline (identity) CIDs.
+func (it *KeyIterator) readCid(offset int64) (cid.Cid, error) {
+	const prefix = 128
+
+	var lbuf [binary.MaxVarintLen64]byte
+	n, err := it.v.backing.ReadAt(lbuf[:], offset)
+	if err != nil && !(errors.Is(err, io.EOF) && n > 0) {
+		return cid.Undef, fmt.Errorf("failed to read section length at offset %d: %w", offset, err)
+	}
+	l, vn := binary.Uvarint(lbuf[:n])
+	if vn <= 0 || l == 0 {
+		return cid.Undef, fmt.Errorf("invalid section length at offset %d", offset)
+	}
+
+	for size := uint64(prefix); ; size = l {
+		if size > l {
+			size = l
+		}
+		if uint64(cap(it.buf)) < size {
+			it.buf = make([]byte, size)
+		}
+		buf := it.buf[:size]
+		if rn, err := it.v.backing.ReadAt(buf, offset+int64(vn)); rn < len(buf) {
+			return cid.Undef, fmt.Errorf("failed to read CID at offset %d: %w", offset, err)
+		}
+		_, c, err := cid.CidFromBytes(buf)
+		if err == nil {
+			return c, nil
+		}
+		if size == l {
+			return cid.Undef, fmt.Errorf("failed to read CID of section at offset %d: %w", offset, err)
+		}
+	}
+}
+
+// chanOf streams the remaining CIDs of the iterator to a channel, which is
+// closed once they have all been sent, or the context is cancelled.
+func (it *KeyIterator) chanOf(ctx context.Context) <-chan cid.Cid {
+	out := make(chan cid.Cid)
+	go func() {
+		defer close(out)
+		for ctx.Err() == nil {
+			c, err := it.Next()
+			if err != nil {
+				if err != io.EOF && err != errAccessorFreed {
+					log.Warnw("failed to enumerate shard keys", "error", err)
+				}
+				return
+			}
+			select {
+			case out <- c:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// errAccessorFreed is returned by iterators whose accessor was closed.
+var errAccessorFreed = errors.New("shard accessor closed")
+
+// readGuard lets readers of the resources of an accessor hold them open until
+// they're done, and fails them once the accessor is freed.
+type readGuard struct {
+	lk     sync.RWMutex
+	closed bool // guarded by lk.
+}
+
+// enter returns false if the guard was closed; otherwise, exit must be called
+// once done reading.
+func (g *readGuard) enter() bool {
+	g.lk.RLock()
+	if g.closed {
+		g.lk.RUnlock()
+		return false
+	}
+	return true
+}
+
+func (g *readGuard) exit() {
+	g.lk.RUnlock()
+}
+
+// close waits for readers to exit, and fails subsequent enters.
+func (g *readGuard) close() {
+	g.lk.Lock()
+	g.closed = true
+	g.lk.Unlock()
+}
+
+// restriction is the set of blocks (keyed by multihash) that a restricted
+// accessor exposes.
+type restriction map[string]struct{}
+
+// newRestriction computes the restriction requested in the acquire options,
+// validating it against the shard index. It returns nil if no restriction was
+// requested.
+func newRestriction(idx index.Index, opts AcquireOpts) (restriction, error) {
+	if opts.ByteRange == nil && len(opts.CIDs) == 0 {
+		return nil, nil
+	}
+
+	var inRange restriction
+	if br := opts.ByteRange; br != nil {
+		iter, ok := idx.(index.IterableIndex)
+		if !ok {
+			return nil, errors.New("byte range restriction requires an iterable index")
+		}
+		inRange = make(restriction)
+		err := iter.ForEach(func(mh multihash.Multihash, offset uint64) error {
+			if offset >= br.Offset && offset-br.Offset < br.Length {
+				inRange[string(mh)] = struct{}{}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate over index: %w", err)
+		}
+		if len(opts.CIDs) == 0 {
+			return inRange, nil
+		}
+	}
+
+	ret := make(restriction, len(opts.CIDs))
+	for _, c := range opts.CIDs {
+		var found bool
+		err := idx.GetAll(c, func(uint64) bool {
+			found = true
+			return false
+		})
+		if err != nil && !errors.Is(err, index.ErrNotFound) {
+			return nil, fmt.Errorf("failed to look up %s in index: %w", c, err)
+		}
+		if !found {
+			return nil, fmt.Errorf("%s: %w", c, ErrBlockNotInShard)
+		}
+		if inRange != nil {
+			if _, ok := inRange[string(c.Hash())]; !ok {
+				continue
+			}
+		}
+		ret[string(c.Hash())] = struct{}{}
+	}
+	return ret, nil
+}
+
+// restrictedBlockstore is a ReadBlockstore that only exposes the blocks
+// within a restriction; all other blocks are reported as not found.
+type restrictedBlockstore struct {
+	ReadBlockstore
+	allowed restriction
+}
+
+var (
+	_ ReadBlockstore = (*restrictedBlockstore)(nil)
+	_ BatchGetter    = (*restrictedBlockstore)(nil)
+	_ KeyIterable    = (*restrictedBlockstore)(nil)
+)
+
+func (r *restrictedBlockstore) allows(c cid.Cid) bool {
+	_, ok := r.allowed[string(c.Hash())]
+	return ok
+}
+
+func (r *restrictedBlockstore) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	if !r.allows(c) {
+		return false, nil
+	}
+	return r.ReadBlockstore.Has(ctx, c)
+}
+
+func (r *restrictedBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	if !r.allows(c) {
+		return nil, format.ErrNotFound{Cid: c}
+	}
+	return r.ReadBlockstore.Get(ctx, c)
+}
+
+func (r *restrictedBlockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	if !r.allows(c) {
+		return 0, format.ErrNotFound{Cid: c}
+	}
+	return r.ReadBlockstore.GetSize(ctx, c)
+}
+
+func (r *restrictedBlockstore) GetMany(ctx context.Context, cids []cid.Cid) ([]blocks.Block, error) {
+	allowed := make([]cid.Cid, 0, len(cids))
+	for _, c := range cids {
+		if r.allows(c) {
+			allowed = append(allowed, c)
+		}
+	}
+	blks, err := getMany(ctx, r.ReadBlockstore, allowed)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]blocks.Block, len(cids))
+	for i, c := range cids {
+		if r.allows(c) {
+			ret[i], blks = blks[0], blks[1:]
+		}
+	}
+	return ret, nil
+}
+
+func (r *restrictedBlockstore) View(ctx context.Context, c cid.Cid, callback func([]byte) error) error {
+	if !r.allows(c) {
+		return format.ErrNotFound{Cid: c}
+	}
+	return r.ReadBlockstore.View(ctx, c, callback)
+}
+
+func (r *restrictedBlockstore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	it, err := r.Iterator()
+	if err != nil {
+		return nil, err
+	}
+	return it.chanOf(ctx), nil
+}
+
+func (r *restrictedBlockstore) Iterator() (*KeyIterator, error) {
+	it, err := iteratorOf(r.ReadBlockstore)
+	if err != nil {
+		return nil, err
+	}
+	it.allowed = r.allowed
+	return it, nil
+}
+
+// cachedBlockstore is a ReadBlockstore that serves blocks from a block cache
+// shared across accessors, populating it upon misses. Cache entries are scoped
+// to the shard, so that blocks of other shards are never exposed.
+type cachedBlockstore struct {
+	ReadBlockstore
+	cache  blockcache.Cache
+	prefix string
+}
+
+var (
+	_ ReadBlockstore = (*cachedBlockstore)(nil)
+	_ BatchGetter    = (*cachedBlockstore)(nil)
+	_ KeyIterable    = (*cachedBlockstore)(nil)
+)
+
+func (b *cachedBlockstore) key(c cid.Cid) string {
+	return b.prefix + string(c.Hash())
+}
+
+func (b *cachedBlockstore) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	if _, ok := b.cache.Get(b.key(c)); ok {
+		return true, nil
+	}
+	return b.ReadBlockstore.Has(ctx, c)
+}
+
+func (b *cachedBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	if data, ok := b.cache.Get(b.key(c)); ok {
+		return blocks.NewBlockWithCid(data, c)
+	}
+	blk, err := b.ReadBlockstore.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	// the block owns its data, which is immutable.
+	b.cache.Add(b.key(c), blk.RawData())
+	return blk, nil
+}
+
+func (b *cachedBlockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	if data, ok := b.cache.Get(b.key(c)); ok {
+		return len(data), nil
+	}
+	return b.ReadBlockstore.GetSize(ctx, c)
+}
+
+func (b *cachedBlockstore) GetMany(ctx context.Context, cids []cid.Cid) ([]blocks.Block, error) {
+	ret := make([]blocks.Block, len(cids))
+	var (
+		misses []cid.Cid
+		at     []int // positions of the misses in cids.
+	)
+	for i, c := range cids {
+		if data, ok := b.cache.Get(b.key(c)); ok {
+			blk, err := blocks.NewBlockWithCid(data, c)
+			if err != nil {
+				return nil, err
+			}
+			ret[i] = blk
+			continue
+		}
+		misses = append(misses, c)
+		at = append(at, i)
+	}
+	if len(misses) == 0 {
+		return ret, nil
+	}
+	blks, err := getMany(ctx, b.ReadBlockstore, misses)
+	if err != nil {
+		return nil, err
+	}
+	for j, blk := range blks {
+		if blk != nil {
+			b.cache.Add(b.key(misses[j]), blk.RawData())
+		}
+		ret[at[j]] = blk
+	}
+	return ret, nil
+}
+
+func (b *cachedBlockstore) View(ctx context.Context, c cid.Cid, callback func([]byte) error) error {
+	if data, ok := b.cache.Get(b.key(c)); ok {
+		return callback(data)
+	}
+	return b.ReadBlockstore.View(ctx, c, func(data []byte) error {
+		// the data is recycled after the callback returns, so cache a copy.
+		b.cache.Add(b.key(c), append([]byte(nil), data...))
+		return callback(data)
+	})
+}
+
+// Iterator returns an iterator over the CIDs of the blocks of the underlying
+// blockstore.
+func (b *cachedBlockstore) Iterator() (*KeyIterator, error) {
+	return iteratorOf(b.ReadBlockstore)
+}
+
+// getMany reads a batch of blocks from bs, at once if it implements
+// BatchGetter, or one by one otherwise. Blocks not found are returned as nil.
+func getMany(ctx context.Context, bs ReadBlockstore, cids []cid.Cid) ([]blocks.Block, error) {
+	if bg, ok := bs.(BatchGetter); ok {
+		return bg.GetMany(ctx, cids)
+	}
+	ret := make([]blocks.Block, len(cids))
+	for i, c := range cids {
+		blk, err := bs.Get(ctx, c)
+		switch {
+		case format.IsNotFound(err):
+		case err != nil:
+			return nil, err
+		default:
+			ret[i] = blk
+		}
+	}
+	return ret, nil
+}
+
+// iteratorOf returns an iterator over the keys of bs, which must implement
+// KeyIterable.
+func iteratorOf(bs ReadBlockstore) (*KeyIterator, error) {
+	ki, ok := bs.(KeyIterable)
+	if !ok {
+		return nil, fmt.Errorf("blockstore of type %T doesn't support key iteration", bs)
+	}
+	return ki.Iterator()
+}
@@ -0,0 +1,204 @@
+package dagstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+)
+
+// WriteCAR streams the shard to w as a CARv1, e.g. to serve it over HTTP
+// without going through an intermediate blockstore. Blocks written are
+// accounted like blocks read through the blockstore of the accessor.
+//
+// Without roots, the CARv1 payload of the shard is written as is, with the
+// roots of the shard, and sections in their order in the shard. Restricted
+// accessors only write the blocks they expose, and the roots among them.
+//
+// With roots, the CARv1 is rooted at them, and holds the blocks of the DAGs
+// under each root, in traversal order, each written once. Unlike Traverse,
+// shared subtrees are walked once, so that the cost of DAGs with many
+// repeated subtrees is linear in their size. Traversals follow the shard
+// index, and fail if a block isn't present in the shard, or isn't exposed by
+// a restricted accessor.
+func (sa *ShardAccessor) WriteCAR(w io.Writer, roots ...cid.Cid) error {
+	sa.lk.Lock()
+	err := sa.checkOpen()
+	sa.lk.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if len(roots) > 0 {
+		return sa.writeTraversalCAR(w, roots)
+	}
+
+	r, err := carv2.NewReader(sa.data)
+	if err != nil {
+		return fmt.Errorf("failed to read CAR data: %w", err)
+	}
+	dr, err := r.DataReader()
+	if err != nil {
+		return fmt.Errorf("failed to read CAR payload: %w", err)
+	}
+	// blocks are read from the payload rather than through a blockstore, and
+	// only accounted by the stats wrapper.
+	stats := sa.statsOf(nil)
+	if sa.restrict == nil {
+		// copy the payload as it's read, so that it's written as is.
+		ew := &errWriter{w: w}
+		br, err := carv2.NewBlockReader(io.TeeReader(dr, ew), carv2.ZeroLengthSectionAsEOF(true))
+		if err == nil {
+			err = sa.forEachBlock(br, stats, func(blocks.Block) error { return nil })
+		}
+		if ew.err != nil {
+			return fmt.Errorf("failed to write CAR payload: %w", ew.err)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read CAR payload: %w", err)
+		}
+		return nil
+	}
+
+	br, err := carv2.NewBlockReader(dr, carv2.ZeroLengthSectionAsEOF(true))
+	if err != nil {
+		return fmt.Errorf("failed to read CAR payload: %w", err)
+	}
+	exposed := make([]cid.Cid, 0, len(br.Roots))
+	for _, root := range br.Roots {
+		if _, ok := sa.restrict[string(root.Hash())]; ok {
+			exposed = append(exposed, root)
+		}
+	}
+	if err := writeCARHeader(w, exposed); err != nil {
+		return err
+	}
+	return sa.forEachBlock(br, stats, func(blk blocks.Block) error {
+		return writeCARSection(w, blk)
+	})
+}
+
+// forEachBlock calls fn with every block read from br that the accessor
+// exposes, accounting it to stats.
+func (sa *ShardAccessor) forEachBlock(br *carv2.BlockReader, stats *statsBlockstore, fn func(blocks.Block) error) error {
+	for {
+		start := time.Now()
+		blk, err := br.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read block from CAR payload: %w", err)
+		}
+		if sa.restrict != nil {
+			if _, ok := sa.restrict[string(blk.Cid().Hash())]; !ok {
+				continue
+			}
+		}
+		stats.served(blk.Cid(), len(blk.RawData()), start)
+		if err := fn(blk); err != nil {
+			return err
+		}
+	}
+}
+
+// errWriter is an io.Writer that records the first error of the writer it
+// wraps, so that it can be told apart from read errors of an io.TeeReader.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) Write(p []byte) (int, error) {
+	n, err := ew.w.Write(p)
+	if err != nil && ew.err == nil {
+		ew.err = err
+	}
+	return n, err
+}
+
+// writeTraversalCAR writes a CARv1 rooted at roots, with the blocks of the
+// DAGs under them.
+func (sa *ShardAccessor) writeTraversalCAR(w io.Writer, roots []cid.Cid) error {
+	if err := writeCARHeader(w, roots); err != nil {
+		return err
+	}
+	seen := cid.NewSet()
+	visit := func(blk blocks.Block) error {
+		if !seen.Visit(blk.Cid()) {
+			return nil
+		}
+		return writeCARSection(w, blk)
+	}
+	for _, root := range roots {
+		err := sa.traverse(context.Background(), root, selectorparse.CommonSelector_ExploreAllRecursively, visit, true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCARHeader writes a CARv1 header with the given roots.
+func writeCARHeader(w io.Writer, roots []cid.Cid) error {
+	nd, err := qp.BuildMap(basicnode.Prototype.Map, 2, func(ma ipld.MapAssembler) {
+		qp.MapEntry(ma, "roots", qp.List(int64(len(roots)), func(la ipld.ListAssembler) {
+			for _, r := range roots {
+				qp.ListEntry(la, qp.Link(cidlink.Link{Cid: r}))
+			}
+		}))
+		qp.MapEntry(ma, "version", qp.Int(1))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to build CAR header: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := dagcbor.Encode(nd, &buf); err != nil {
+		return fmt.Errorf("failed to encode CAR header: %w", err)
+	}
+	if err := writeLd(w, buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write CAR header: %w", err)
+	}
+	return nil
+}
+
+// writeCARSection writes a block as a CARv1 section.
+func writeCARSection(w io.Writer, blk blocks.Block) error {
+	if err := writeLd(w, blk.Cid().Bytes(), blk.RawData()); err != nil {
+		return fmt.Errorf("failed to write block %s: %w", blk.Cid(), err)
+	}
+	return nil
+}
+
+// writeLd writes the concatenation of data, prefixed by its length as a
+// varint.
+func writeLd(w io.Writer, data ...[]byte) error {
+	var size uint64
+	for _, d := range data {
+		size += uint64(len(d))
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, size)
+	if _, err := w.Write(buf[:n]); err != nil {
+		return err
+	}
+	for _, d := range data {
+		if _, err := w.Write(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
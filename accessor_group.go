@@ -0,0 +1,279 @@
+package dagstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/ipld/go-ipld-prime"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// ShardGroupAccessor provides access to the data of several shards through a
+// single handle, as returned by AcquireShards. It serves retrievals spanning
+// several shards, e.g. a deal split across several pieces.
+type ShardGroupAccessor struct {
+	accessors []*ShardAccessor
+}
+
+// AcquireShards acquires the shards with the supplied keys with the supplied
+// options, concurrently, and returns an accessor over all of them. Duplicate
+// keys are acquired once. If any shard fails to be acquired, the shards that
+// were acquired are released, and the first error is returned.
+func (d *DAGStore) AcquireShards(ctx context.Context, keys []shard.Key, opts AcquireOpts) (*ShardGroupAccessor, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no shards to acquire")
+	}
+	uniq := make([]shard.Key, 0, len(keys))
+	seen := make(map[shard.Key]struct{}, len(keys))
+	for _, k := range keys {
+		if _, ok := seen[k]; !ok {
+			seen[k] = struct{}{}
+			uniq = append(uniq, k)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg        sync.WaitGroup
+		errOnce   sync.Once
+		firstErr  error
+		accessors = make([]*ShardAccessor, len(uniq))
+	)
+	for i, k := range uniq {
+		wg.Add(1)
+		go func(i int, k shard.Key) {
+			defer wg.Done()
+			sa, err := d.AcquireShardSync(ctx, k, opts)
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel() // no point in acquiring the other shards.
+				})
+				return
+			}
+			accessors[i] = sa
+		}(i, k)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		for _, sa := range accessors {
+			if sa != nil {
+				_ = sa.Close()
+			}
+		}
+		return nil, firstErr
+	}
+	return &ShardGroupAccessor{accessors: accessors}, nil
+}
+
+// Shards returns the keys of the shards in the group, in the order in which
+// they're looked up.
+func (g *ShardGroupAccessor) Shards() []shard.Key {
+	keys := make([]shard.Key, len(g.accessors))
+	for i, sa := range g.accessors {
+		keys[i] = sa.Shard()
+	}
+	return keys
+}
+
+// Accessors returns the accessors of the individual shards in the group. They
+// must not be closed; they're closed along with the group.
+func (g *ShardGroupAccessor) Accessors() []*ShardAccessor {
+	return append([]*ShardAccessor(nil), g.accessors...)
+}
+
+// Blockstore returns a blockstore that unions the blockstores of the shards
+// in the group. Blocks are looked up in the shards in order, and served from
+// the first shard that contains them; its keys are those of all shards,
+// without duplicates.
+func (g *ShardGroupAccessor) Blockstore() (ReadBlockstore, error) {
+	bss := make([]ReadBlockstore, 0, len(g.accessors))
+	for _, sa := range g.accessors {
+		bs, err := sa.Blockstore()
+		if err != nil {
+			return nil, err
+		}
+		bss = append(bss, bs)
+	}
+	return &unionBlockstore{bss: bss}, nil
+}
+
+// LinkSystem returns a read-only go-ipld-prime LinkSystem that loads blocks
+// from the union of the shards in the group (see Blockstore), so that
+// traversals can cross shard boundaries.
+func (g *ShardGroupAccessor) LinkSystem() (ipld.LinkSystem, error) {
+	bs, err := g.Blockstore()
+	if err != nil {
+		return ipld.LinkSystem{}, fmt.Errorf("failed to open blockstore for link system: %w", err)
+	}
+	return newLinkSystem(bs, nil), nil
+}
+
+// Extend renews the leases of all accessors in the group, like
+// ShardAccessor.Extend. It returns the first error, after attempting to
+// extend every lease.
+func (g *ShardGroupAccessor) Extend(d time.Duration) error {
+	var firstErr error
+	for _, sa := range g.accessors {
+		if err := sa.Extend(d); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Close closes all accessors in the group, releasing their shards. It returns
+// the first error, after attempting to close every accessor.
+func (g *ShardGroupAccessor) Close() error {
+	var firstErr error
+	for _, sa := range g.accessors {
+		if err := sa.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// unionBlockstore is a ReadBlockstore over several blockstores, serving
+// blocks from the first one that contains them.
+type unionBlockstore struct {
+	bss []ReadBlockstore
+}
+
+var (
+	_ ReadBlockstore = (*unionBlockstore)(nil)
+	_ BatchGetter    = (*unionBlockstore)(nil)
+	_ KeyIterable    = (*unionBlockstore)(nil)
+)
+
+func (u *unionBlockstore) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	for _, bs := range u.bss {
+		has, err := bs.Has(ctx, c)
+		if err != nil || has {
+			return has, err
+		}
+	}
+	return false, nil
+}
+
+func (u *unionBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	for _, bs := range u.bss {
+		blk, err := bs.Get(ctx, c)
+		if !format.IsNotFound(err) {
+			return blk, err
+		}
+	}
+	return nil, format.ErrNotFound{Cid: c}
+}
+
+func (u *unionBlockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	for _, bs := range u.bss {
+		size, err := bs.GetSize(ctx, c)
+		if !format.IsNotFound(err) {
+			return size, err
+		}
+	}
+	return 0, format.ErrNotFound{Cid: c}
+}
+
+func (u *unionBlockstore) GetMany(ctx context.Context, cids []cid.Cid) ([]blocks.Block, error) {
+	ret := make([]blocks.Block, len(cids))
+	missing, at := cids, make([]int, len(cids))
+	for i := range at {
+		at[i] = i
+	}
+	for _, bs := range u.bss {
+		if len(missing) == 0 {
+			break
+		}
+		blks, err := getMany(ctx, bs, missing)
+		if err != nil {
+			return nil, err
+		}
+		var (
+			nextMissing []cid.Cid
+			nextAt      []int
+		)
+		for j, blk := range blks {
+			if blk != nil {
+				ret[at[j]] = blk
+				continue
+			}
+			nextMissing = append(nextMissing, missing[j])
+			nextAt = append(nextAt, at[j])
+		}
+		missing, at = nextMissing, nextAt
+	}
+	return ret, nil
+}
+
+func (u *unionBlockstore) View(ctx context.Context, c cid.Cid, callback func([]byte) error) error {
+	for _, bs := range u.bss {
+		// errors returned by the callback are propagated as-is.
+		if err := bs.View(ctx, c, callback); !format.IsNotFound(err) {
+			return err
+		}
+	}
+	return format.ErrNotFound{Cid: c}
+}
+
+func (u *unionBlockstore) HashOnRead(enabled bool) {
+	for _, bs := range u.bss {
+		bs.HashOnRead(enabled)
+	}
+}
+
+func (u *unionBlockstore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	it, err := u.Iterator()
+	if err != nil {
+		return nil, err
+	}
+	return it.chanOf(ctx), nil
+}
+
+// Iterator returns an iterator over the CIDs of the blocks of all
+// blockstores, in turn, skipping CIDs already returned.
+func (u *unionBlockstore) Iterator() (*KeyIterator, error) {
+	chain := make([]*KeyIterator, 0, len(u.bss))
+	for _, bs := range u.bss {
+		it, err := iteratorOf(bs)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, it)
+	}
+	return &KeyIterator{chain: chain, seen: make(map[string]struct{})}, nil
+}
+
+// nextChained implements KeyIterator.Next for iterators over several
+// blockstores.
+func (it *KeyIterator) nextChained() (cid.Cid, error) {
+	for len(it.chain) > 0 {
+		c, err := it.chain[0].Next()
+		if err == io.EOF {
+			it.chain = it.chain[1:]
+			continue
+		}
+		if err != nil {
+			it.chain = nil
+			return cid.Undef, err
+		}
+		if _, ok := it.seen[c.KeyString()]; ok {
+			continue
+		}
+		it.seen[c.KeyString()] = struct{}{}
+		return c, nil
+	}
+	return cid.Undef, io.EOF
+}
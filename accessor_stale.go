@@ -0,0 +1,61 @@
+package dagstore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/filecoin-project/dagstore/mount"
+)
+
+// staleReader fails the shard of an accessor when reads from its mount fail
+// with mount.ErrStale, so that it's recovered on its next acquire, instead of
+// accessors hitting the stale mount over and over.
+type staleReader struct {
+	mount.Reader
+
+	d    *DAGStore
+	s    *Shard
+	once sync.Once
+}
+
+// watchStale wraps the reader of an accessor of shard s to detect when its
+// mount goes stale. Files are returned as is, so that they can be mmapped.
+func (d *DAGStore) watchStale(s *Shard, r mount.Reader) mount.Reader {
+	if _, ok := r.(*os.File); ok {
+		return r
+	}
+	return &staleReader{Reader: r, d: d, s: s}
+}
+
+func (r *staleReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	return n, r.check(err)
+}
+
+func (r *staleReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.Reader.ReadAt(p, off)
+	return n, r.check(err)
+}
+
+func (r *staleReader) Seek(offset int64, whence int) (int64, error) {
+	n, err := r.Reader.Seek(offset, whence)
+	return n, r.check(err)
+}
+
+// check fails the shard the first time a read fails with mount.ErrStale. The
+// fail task is queued in the background, so that reads, which hold references
+// to the shard, never wait for the event loop.
+func (r *staleReader) check(err error) error {
+	if err == nil || !errors.Is(err, mount.ErrStale) {
+		return err
+	}
+	r.once.Do(func() {
+		ferr := r.d.redact(fmt.Errorf("mount went stale: %w", err))
+		log.Warnw("mount went stale; failing shard for recovery", "shard", r.s.key, "error", ferr)
+		tsk := &task{op: OpShardFail, shard: r.s, err: ferr}
+		go func() { _ = r.d.queueTask(tsk, r.d.completionCh) }()
+	})
+	return fmt.Errorf("%s: shard marked for recovery: %w", r.s.key.String(), err)
+}
@@ -1,7 +1,10 @@
 package dagstore
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -9,13 +12,28 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/shard"
 	"github.com/filecoin-project/dagstore/testdata"
 	"github.com/filecoin-project/dagstore/throttle"
 	"github.com/ipld/go-car/v2"
 	"github.com/ipld/go-car/v2/index"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
 	"github.com/stretchr/testify/require"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/multiformats/go-multihash"
 )
 
 // TestMmap works on linux and darwin. It tests that for the given mount, if
@@ -123,6 +141,33 @@ func TestMmap(t *testing.T) {
 
 }
 
+// TestMmapReuse verifies that an accessor maps its file once, however many of
+// its methods open a blockstore, and that the mapping is released on close.
+func TestMmapReuse(t *testing.T) {
+	sa := createAccessor(t, &mount.FileMount{Path: testdata.RootPathCarV2})
+
+	_, err := sa.Blockstore()
+	require.NoError(t, err)
+	mmapr := sa.mmapr
+	require.NotNil(t, mmapr)
+
+	// traversals, e.g. of WriteCAR, reuse the mapping.
+	for i := 0; i < 2; i++ {
+		require.NoError(t, sa.WriteCAR(io.Discard, testdata.RootCID))
+		require.Same(t, mmapr, sa.mmapr)
+	}
+
+	// and so do link systems.
+	for i := 0; i < 2; i++ {
+		_, err := sa.LinkSystem()
+		require.NoError(t, err)
+		require.Same(t, mmapr, sa.mmapr)
+	}
+
+	require.NoError(t, sa.Close())
+	checkMmapped(t, false, filepath.Base(testdata.RootPathCarV2))
+}
+
 // checkMmapped uses platform-specific logic to verify if the expected file
 // has been mmapped.
 func checkMmapped(t *testing.T, expect bool, name string) {
@@ -157,11 +202,332 @@ func checkMmapped(t *testing.T, expect bool, name string) {
 	pred(t, strings.Contains(string(out), name))
 }
 
+func TestTraverse(t *testing.T) {
+	ctx := context.Background()
+	mnt := &mount.FSMount{FS: testdata.FS, Path: testdata.FSPathCarV2}
+	up, err := mount.Upgrade(mnt, throttle.Noop(), t.TempDir(), "foo", "")
+	require.NoError(t, err)
+
+	sa := createAccessor(t, up)
+	defer sa.Close()
+
+	// traverse the top levels of the DAG; every visited block is in the shard,
+	// and the root is visited first.
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	sel := ssb.ExploreRecursive(selector.RecursionLimitDepth(2), ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+
+	bs, err := sa.Blockstore()
+	require.NoError(t, err)
+
+	var visited []cid.Cid
+	err = sa.Traverse(ctx, testdata.RootCID, sel, func(blk blocks.Block) error {
+		visited = append(visited, blk.Cid())
+		return nil
+	})
+	require.NoError(t, err)
+	require.Greater(t, len(visited), 1)
+	require.Equal(t, testdata.RootCID, visited[0])
+	for _, c := range visited {
+		has, err := bs.Has(ctx, c)
+		require.NoError(t, err)
+		require.True(t, has)
+	}
+
+	// matching only the root visits just the root block.
+	visited = visited[:0]
+	err = sa.Traverse(ctx, testdata.RootCID, selectorparse.CommonSelector_MatchPoint, func(blk blocks.Block) error {
+		visited = append(visited, blk.Cid())
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{testdata.RootCID}, visited)
+
+	// errors returned by the visitor abort the traversal.
+	errStop := errors.New("stop")
+	err = sa.Traverse(ctx, testdata.RootCID, selectorparse.CommonSelector_ExploreAllRecursively, func(blk blocks.Block) error {
+		return errStop
+	})
+	require.ErrorIs(t, err, errStop)
+}
+
+func TestLinkSystem(t *testing.T) {
+	ctx := context.Background()
+	mnt := &mount.FSMount{FS: testdata.FS, Path: testdata.FSPathCarV2}
+	up, err := mount.Upgrade(mnt, throttle.Noop(), t.TempDir(), "foo", "")
+	require.NoError(t, err)
+
+	sa := createAccessor(t, up)
+	defer sa.Close()
+
+	lsys, err := sa.LinkSystem()
+	require.NoError(t, err)
+
+	// the root can be loaded, and the DAG walked, through the link system.
+	chooser := dagpb.AddSupportToChooser(basicnode.Chooser)
+	rootLnk := cidlink.Link{Cid: testdata.RootCID}
+	proto, err := chooser(rootLnk, ipld.LinkContext{Ctx: ctx})
+	require.NoError(t, err)
+	nd, err := lsys.Load(ipld.LinkContext{Ctx: ctx}, rootLnk, proto)
+	require.NoError(t, err)
+
+	var loaded int
+	loader := lsys.StorageReadOpener
+	lsys.StorageReadOpener = func(lctx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		loaded++
+		return loader(lctx, lnk)
+	}
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	sel := ssb.ExploreRecursive(selector.RecursionLimitDepth(2), ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+	compiled, err := selector.CompileSelector(sel)
+	require.NoError(t, err)
+	progress := traversal.Progress{
+		Cfg: &traversal.Config{
+			Ctx:                            ctx,
+			LinkSystem:                     lsys,
+			LinkTargetNodePrototypeChooser: chooser,
+		},
+	}
+	err = progress.WalkAdv(nd, compiled, func(traversal.Progress, ipld.Node, traversal.VisitReason) error {
+		return nil
+	})
+	require.NoError(t, err)
+
+	var visited int
+	err = sa.Traverse(ctx, testdata.RootCID, sel, func(blk blocks.Block) error {
+		visited++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Greater(t, loaded, 1)
+	require.Equal(t, visited, loaded+1) // Traverse also visits the root.
+
+	// the link system is read-only.
+	_, err = lsys.Store(ipld.LinkContext{Ctx: ctx}, cidlink.LinkPrototype{Prefix: testdata.RootCID.Prefix()}, nd)
+	require.ErrorIs(t, err, ErrReadOnlyLinkSystem)
+}
+
+func TestBlockstoreView(t *testing.T) {
+	ctx := context.Background()
+	sa := createAccessor(t, &mount.BytesMount{Bytes: testdata.CarV2})
+	defer sa.Close()
+
+	bs, err := sa.Blockstore()
+	require.NoError(t, err)
+
+	ch, err := bs.AllKeysChan(ctx)
+	require.NoError(t, err)
+
+	var n int
+	for c := range ch {
+		blk, err := bs.Get(ctx, c)
+		require.NoError(t, err)
+
+		var viewed bool
+		err = bs.View(ctx, c, func(b []byte) error {
+			viewed = true
+			require.Equal(t, blk.RawData(), b)
+			return nil
+		})
+		require.NoError(t, err)
+		require.True(t, viewed)
+		n++
+	}
+	require.NotZero(t, n)
+
+	// errors from the callback are propagated.
+	errStop := errors.New("stop")
+	err = bs.View(ctx, testdata.RootCID, func([]byte) error { return errStop })
+	require.ErrorIs(t, err, errStop)
+
+	// unknown blocks are not found, and the callback is not called.
+	unknown, err := cid.Parse("bafykbzaceaeqhm77anl5mv2wjkmh4ofyf6s6eww3ujfmhtsfab65vi3rlccaq")
+	require.NoError(t, err)
+	err = bs.View(ctx, unknown, func([]byte) error {
+		t.Fatal("callback should not be called")
+		return nil
+	})
+	require.True(t, format.IsNotFound(err))
+}
+
+func TestBlockstoreIterator(t *testing.T) {
+	ctx := context.Background()
+	sa := createAccessor(t, &mount.BytesMount{Bytes: testdata.CarV2})
+	defer sa.Close()
+
+	bs, err := sa.Blockstore()
+	require.NoError(t, err)
+
+	// keys are enumerated in the order in which the blocks appear in the CAR,
+	// with their original CIDs, except for identity CIDs, which the index
+	// doesn't record.
+	br, err := car.NewBlockReader(bytes.NewReader(testdata.CarV2))
+	require.NoError(t, err)
+	var expected []cid.Cid
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if blk.Cid().Prefix().MhType != multihash.IDENTITY {
+			expected = append(expected, blk.Cid())
+		}
+	}
+
+	it, err := bs.(KeyIterable).Iterator()
+	require.NoError(t, err)
+	var keys []cid.Cid
+	for {
+		c, err := it.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		keys = append(keys, c)
+	}
+	require.Equal(t, expected, keys)
+
+	// AllKeysChan is backed by the iterator.
+	ch, err := bs.AllKeysChan(ctx)
+	require.NoError(t, err)
+	var streamed []cid.Cid
+	for c := range ch {
+		streamed = append(streamed, c)
+	}
+	require.Equal(t, expected, streamed)
+
+	// restricted blockstores only enumerate the blocks they expose.
+	restricted := &restrictedBlockstore{ReadBlockstore: bs, allowed: restriction{string(testdata.RootCID.Hash()): {}}}
+	it, err = restricted.Iterator()
+	require.NoError(t, err)
+	c, err := it.Next()
+	require.NoError(t, err)
+	require.Equal(t, testdata.RootCID, c)
+	_, err = it.Next()
+	require.Equal(t, io.EOF, err)
+
+	// iterators fail once the accessor is closed, rather than reading from
+	// its released mapping.
+	it, err = bs.(KeyIterable).Iterator()
+	require.NoError(t, err)
+	require.NoError(t, sa.Close())
+	_, err = it.Next()
+	require.ErrorIs(t, err, errAccessorFreed)
+}
+
+func TestCAR(t *testing.T) {
+	sa := createAccessor(t, &mount.BytesMount{Bytes: testdata.CarV2})
+
+	r, size, err := sa.CAR()
+	require.NoError(t, err)
+	require.EqualValues(t, len(testdata.CarV2), size)
+	buf := make([]byte, size)
+	_, err = r.ReadAt(buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, testdata.CarV2, buf)
+
+	// the CAR data of restricted accessors isn't available.
+	sa.restrict = restriction{string(testdata.RootCID.Hash()): {}}
+	_, _, err = sa.CAR()
+	require.Error(t, err)
+
+	require.NoError(t, sa.Close())
+	_, _, err = sa.CAR()
+	require.Error(t, err)
+}
+
+func TestWriteCAR(t *testing.T) {
+	ctx := context.Background()
+	sa := createAccessor(t, &mount.BytesMount{Bytes: testdata.CarV2})
+	defer sa.Close()
+
+	r, err := car.NewReader(bytes.NewReader(testdata.CarV2))
+	require.NoError(t, err)
+	dr, err := r.DataReader()
+	require.NoError(t, err)
+	payload, err := io.ReadAll(dr)
+	require.NoError(t, err)
+
+	// readCAR reads back the roots and the blocks of a CARv1.
+	readCAR := func(data []byte) ([]cid.Cid, []cid.Cid) {
+		br, err := car.NewBlockReader(bytes.NewReader(data))
+		require.NoError(t, err)
+		require.EqualValues(t, 1, br.Version)
+		var cids []cid.Cid
+		for {
+			blk, err := br.Next()
+			if err == io.EOF {
+				return br.Roots, cids
+			}
+			require.NoError(t, err)
+			cids = append(cids, blk.Cid())
+		}
+	}
+
+	// blocks written are reported like blocks read through the blockstore.
+	var accessed []cid.Cid
+	sa.onBlockAccess = func(_ shard.Key, c cid.Cid, _ int, _ time.Duration) {
+		accessed = append(accessed, c)
+	}
+
+	// without roots, the payload is written as is.
+	var buf bytes.Buffer
+	require.NoError(t, sa.WriteCAR(&buf))
+	require.Equal(t, payload, buf.Bytes())
+	roots, payloadCIDs := readCAR(payload)
+	require.Equal(t, payloadCIDs, accessed)
+
+	// with roots, the DAG under them is written in traversal order, each
+	// block once.
+	buf.Reset()
+	require.NoError(t, sa.WriteCAR(&buf, testdata.RootCID, testdata.RootCID))
+	roots, cids := readCAR(buf.Bytes())
+	require.Equal(t, []cid.Cid{testdata.RootCID, testdata.RootCID}, roots)
+	require.Greater(t, len(cids), 1)
+	require.Equal(t, testdata.RootCID, cids[0])
+	bs, err := sa.Blockstore()
+	require.NoError(t, err)
+	seen := cid.NewSet()
+	for _, c := range cids {
+		require.True(t, seen.Visit(c))
+		has, err := bs.Has(ctx, c)
+		require.NoError(t, err)
+		require.True(t, has)
+	}
+
+	// restricted accessors only write the blocks they expose.
+	sa.restrict = restriction{string(testdata.RootCID.Hash()): {}}
+	buf.Reset()
+	require.NoError(t, sa.WriteCAR(&buf))
+	roots, cids = readCAR(buf.Bytes())
+	expectedRoots, err := r.Roots()
+	require.NoError(t, err)
+	require.Equal(t, expectedRoots, roots)
+	require.Equal(t, []cid.Cid{testdata.RootCID}, cids)
+
+	// and only the roots among them, reporting the blocks written.
+	nonRoot := payloadCIDs[len(payloadCIDs)-1]
+	require.NotEqual(t, testdata.RootCID, nonRoot)
+	sa.restrict = restriction{string(nonRoot.Hash()): {}}
+	accessed = nil
+	buf.Reset()
+	require.NoError(t, sa.WriteCAR(&buf))
+	roots, cids = readCAR(buf.Bytes())
+	require.Empty(t, roots)
+	require.Equal(t, []cid.Cid{nonRoot}, cids)
+	require.Equal(t, []cid.Cid{nonRoot}, accessed)
+
+	require.Error(t, sa.WriteCAR(io.Discard, testdata.RootCID))
+
+	require.NoError(t, sa.Close())
+	require.Error(t, sa.WriteCAR(io.Discard))
+}
+
 func createAccessor(t *testing.T, mnt mount.Mount) *ShardAccessor {
 	dummyShard := &Shard{
 		d: &DAGStore{
-			ctx:        context.Background(),
-			externalCh: make(chan *task, 64),
+			ctx:          context.Background(),
+			completionCh: []chan *task{make(chan *task, 64)},
 		},
 	}
 
@@ -0,0 +1,131 @@
+package blockcache
+
+// arc implements the Adaptive Replacement Cache policy, weighted by block
+// size. t1 holds blocks seen once recently, and t2 blocks seen at least twice;
+// b1 and b2 are the ghost entries evicted from them. The target size of t1, p,
+// adapts to hits on ghost entries.
+type arc struct {
+	counters
+	max int64
+	p   int64
+
+	t1, t2, b1, b2 *queue
+}
+
+var _ Cache = (*arc)(nil)
+
+func newARC(max int64) *arc {
+	return &arc{max: max, t1: newQueue(), t2: newQueue(), b1: newQueue(), b2: newQueue()}
+}
+
+func (c *arc) Get(key string) ([]byte, bool) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if ent, ok := c.t1.remove(key); ok {
+		c.t2.pushFront(ent)
+		c.record(true)
+		return ent.data, true
+	}
+	if ent, ok := c.t2.get(key); ok {
+		c.t2.moveToFront(key)
+		c.record(true)
+		return ent.data, true
+	}
+	c.record(false)
+	return nil, false
+}
+
+func (c *arc) Add(key string, data []byte) {
+	size := int64(len(data))
+	if size > c.max {
+		return
+	}
+
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if _, ok := c.t1.get(key); ok {
+		return
+	}
+	if _, ok := c.t2.get(key); ok {
+		return
+	}
+
+	ent := &entry{key: key, data: data, size: size}
+	switch {
+	case c.b1.idx[key] != nil:
+		// recency is paying off; grow the target of t1.
+		delta := size
+		if c.b1.bytes > 0 && c.b2.bytes > c.b1.bytes {
+			delta = size * (c.b2.bytes / c.b1.bytes)
+		}
+		c.p = min64(c.max, c.p+delta)
+		c.b1.remove(key)
+		c.evict(size, false)
+		c.t2.pushFront(ent)
+
+	case c.b2.idx[key] != nil:
+		// frequency is paying off; shrink the target of t1.
+		delta := size
+		if c.b2.bytes > 0 && c.b1.bytes > c.b2.bytes {
+			delta = size * (c.b1.bytes / c.b2.bytes)
+		}
+		c.p = max64(0, c.p-delta)
+		c.b2.remove(key)
+		c.evict(size, true)
+		c.t2.pushFront(ent)
+
+	default:
+		c.evict(size, false)
+		c.t1.pushFront(ent)
+	}
+
+	// bound the ghost lists.
+	for c.t1.bytes+c.b1.bytes > c.max && c.b1.len() > 0 {
+		c.b1.popBack()
+	}
+	for c.t1.bytes+c.t2.bytes+c.b1.bytes+c.b2.bytes > 2*c.max && c.b2.len() > 0 {
+		c.b2.popBack()
+	}
+}
+
+// evict evicts resident blocks into the ghost lists until there's room for a
+// block of the given size.
+func (c *arc) evict(size int64, inB2 bool) {
+	for c.t1.bytes+c.t2.bytes+size > c.max {
+		if c.t1.len() > 0 && (c.t1.bytes > c.p || (inB2 && c.t1.bytes == c.p) || c.t2.len() == 0) {
+			ent, _ := c.t1.popBack()
+			c.b1.pushFront(&entry{key: ent.key, size: ent.size})
+		} else {
+			ent, _ := c.t2.popBack()
+			c.b2.pushFront(&entry{key: ent.key, size: ent.size})
+		}
+	}
+}
+
+func (c *arc) Stats() Stats {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	return Stats{
+		Hits:    c.hits,
+		Misses:  c.misses,
+		Entries: c.t1.len() + c.t2.len(),
+		Bytes:   c.t1.bytes + c.t2.bytes,
+	}
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
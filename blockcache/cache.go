@@ -0,0 +1,151 @@
+package blockcache
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+)
+
+// Policy is a cache replacement policy.
+type Policy int
+
+const (
+	// PolicyARC is the Adaptive Replacement Cache policy, which balances
+	// recency and frequency adaptively, based on the workload.
+	PolicyARC Policy = iota
+
+	// Policy2Q is the 2Q policy, which admits blocks into the frequently
+	// used set only once they're requested again after being evicted from a
+	// probationary FIFO, making it resistant to scans.
+	Policy2Q
+)
+
+func (p Policy) String() string {
+	return [...]string{
+		"PolicyARC",
+		"Policy2Q"}[p]
+}
+
+// Cache is an in-memory block cache, keyed by multihash. Implementations are
+// safe for concurrent use.
+type Cache interface {
+	// Get returns the data of the block with the given multihash, if cached.
+	// The returned slice must not be mutated.
+	Get(mh string) ([]byte, bool)
+
+	// Add caches the data of the block with the given multihash. The cache
+	// takes ownership of the slice, which must not be mutated afterwards.
+	// Blocks larger than the capacity of the cache are not cached.
+	Add(mh string, data []byte)
+
+	// Stats returns statistics about the cache.
+	Stats() Stats
+}
+
+// Stats are statistics about a Cache.
+type Stats struct {
+	// Hits and Misses are the number of lookups that found and didn't find
+	// the requested block, respectively.
+	Hits, Misses uint64
+	// Entries is the number of cached blocks.
+	Entries int
+	// Bytes is the size of the cached blocks.
+	Bytes int64
+}
+
+// New creates a cache holding up to maxBytes of block data, with the given
+// replacement policy.
+func New(maxBytes int64, policy Policy) (Cache, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("invalid cache size: %d", maxBytes)
+	}
+	switch policy {
+	case PolicyARC:
+		return newARC(maxBytes), nil
+	case Policy2Q:
+		return new2Q(maxBytes), nil
+	default:
+		return nil, fmt.Errorf("unknown cache policy: %d", policy)
+	}
+}
+
+// entry is a cache entry. Ghost entries retain the size of the evicted block,
+// but not its data.
+type entry struct {
+	key  string
+	data []byte
+	size int64
+}
+
+// queue is a list of entries ordered from most to least recently inserted or
+// used, indexed by key, and tracking the total size of its entries.
+type queue struct {
+	l     *list.List
+	idx   map[string]*list.Element
+	bytes int64
+}
+
+func newQueue() *queue {
+	return &queue{l: list.New(), idx: make(map[string]*list.Element)}
+}
+
+func (q *queue) get(key string) (*entry, bool) {
+	e, ok := q.idx[key]
+	if !ok {
+		return nil, false
+	}
+	return e.Value.(*entry), true
+}
+
+// pushFront inserts an entry at the front of the queue.
+func (q *queue) pushFront(ent *entry) {
+	q.idx[ent.key] = q.l.PushFront(ent)
+	q.bytes += ent.size
+}
+
+// moveToFront marks an entry as the most recently used.
+func (q *queue) moveToFront(key string) {
+	if e, ok := q.idx[key]; ok {
+		q.l.MoveToFront(e)
+	}
+}
+
+// remove removes an entry from the queue, returning it.
+func (q *queue) remove(key string) (*entry, bool) {
+	e, ok := q.idx[key]
+	if !ok {
+		return nil, false
+	}
+	q.l.Remove(e)
+	delete(q.idx, key)
+	ent := e.Value.(*entry)
+	q.bytes -= ent.size
+	return ent, true
+}
+
+// popBack removes the least recently inserted or used entry, returning it.
+func (q *queue) popBack() (*entry, bool) {
+	e := q.l.Back()
+	if e == nil {
+		return nil, false
+	}
+	return q.remove(e.Value.(*entry).key)
+}
+
+func (q *queue) len() int {
+	return q.l.Len()
+}
+
+// counters holds the lock of a cache, and the hit and miss counters it guards.
+type counters struct {
+	lk           sync.Mutex
+	hits, misses uint64
+}
+
+func (c *counters) record(hit bool) {
+	if hit {
+		c.hits++
+	} else {
+		c.misses++
+	}
+}
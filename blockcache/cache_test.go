@@ -0,0 +1,95 @@
+package blockcache
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var policies = []Policy{PolicyARC, Policy2Q}
+
+func TestCacheBasic(t *testing.T) {
+	for _, p := range policies {
+		t.Run(p.String(), func(t *testing.T) {
+			c, err := New(1000, p)
+			require.NoError(t, err)
+
+			_, ok := c.Get("a")
+			require.False(t, ok)
+
+			c.Add("a", []byte("hello"))
+			data, ok := c.Get("a")
+			require.True(t, ok)
+			require.Equal(t, []byte("hello"), data)
+
+			// blocks larger than the cache are not cached.
+			c.Add("big", make([]byte, 1001))
+			_, ok = c.Get("big")
+			require.False(t, ok)
+
+			stats := c.Stats()
+			require.EqualValues(t, 1, stats.Hits)
+			require.EqualValues(t, 2, stats.Misses)
+			require.Equal(t, 1, stats.Entries)
+			require.EqualValues(t, 5, stats.Bytes)
+		})
+	}
+
+	_, err := New(0, PolicyARC)
+	require.Error(t, err)
+	_, err = New(1000, Policy(42))
+	require.Error(t, err)
+}
+
+func TestCacheBounded(t *testing.T) {
+	for _, p := range policies {
+		t.Run(p.String(), func(t *testing.T) {
+			c, err := New(1000, p)
+			require.NoError(t, err)
+
+			for i := 0; i < 100; i++ {
+				c.Add(fmt.Sprintf("k%d", i), make([]byte, 10+i%90))
+				require.LessOrEqual(t, c.Stats().Bytes, int64(1000))
+			}
+		})
+	}
+}
+
+func TestCacheScanResistant(t *testing.T) {
+	for _, p := range policies {
+		t.Run(p.String(), func(t *testing.T) {
+			// room for 10 blocks.
+			c, err := New(1000, p)
+			require.NoError(t, err)
+
+			access := func(k string) {
+				if _, ok := c.Get(k); !ok {
+					c.Add(k, make([]byte, 100))
+				}
+			}
+
+			// the hot blocks are requested repeatedly, among other blocks.
+			hot := []string{"h0", "h1", "h2"}
+			for round := 0; round < 5; round++ {
+				for _, k := range hot {
+					access(k)
+				}
+				for i := 0; i < 4; i++ {
+					access(fmt.Sprintf("cold-%d-%d", round, i))
+				}
+			}
+
+			// a scan of single-use blocks, which would flush an LRU cache,
+			// doesn't evict them.
+			for i := 0; i < 30; i++ {
+				access(fmt.Sprintf("scan-%d", i))
+			}
+
+			for _, k := range hot {
+				_, ok := c.Get(k)
+				require.True(t, ok, k)
+			}
+		})
+	}
+}
@@ -0,0 +1,4 @@
+// Package blockcache provides in-memory block caches bounded by size in bytes,
+// with ARC and 2Q replacement policies, for sharing hot blocks across shard
+// accessors.
+package blockcache
@@ -0,0 +1,108 @@
+package blockcache
+
+const (
+	// twoQInRatio is the share of the capacity reserved for the probationary
+	// FIFO of blocks seen once.
+	twoQInRatio = 0.25
+	// twoQOutRatio is the size of the ghost FIFO, relative to the capacity,
+	// as the sum of the sizes of the blocks it remembers.
+	twoQOutRatio = 0.5
+)
+
+// twoQ implements the full 2Q policy, weighted by block size. New blocks are
+// admitted into the a1in FIFO; when evicted from it, they are remembered in
+// the a1out ghost FIFO, and promoted to the am LRU if requested again.
+type twoQ struct {
+	counters
+	max    int64
+	maxIn  int64
+	maxOut int64
+	a1in   *queue
+	a1out  *queue
+	am     *queue
+}
+
+var _ Cache = (*twoQ)(nil)
+
+func new2Q(max int64) *twoQ {
+	return &twoQ{
+		max:    max,
+		maxIn:  int64(float64(max) * twoQInRatio),
+		maxOut: int64(float64(max) * twoQOutRatio),
+		a1in:   newQueue(),
+		a1out:  newQueue(),
+		am:     newQueue(),
+	}
+}
+
+func (c *twoQ) Get(key string) ([]byte, bool) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if ent, ok := c.am.get(key); ok {
+		c.am.moveToFront(key)
+		c.record(true)
+		return ent.data, true
+	}
+	// hits on the probationary FIFO don't alter its order.
+	if ent, ok := c.a1in.get(key); ok {
+		c.record(true)
+		return ent.data, true
+	}
+	c.record(false)
+	return nil, false
+}
+
+func (c *twoQ) Add(key string, data []byte) {
+	size := int64(len(data))
+	if size > c.max {
+		return
+	}
+
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if _, ok := c.am.get(key); ok {
+		return
+	}
+	if _, ok := c.a1in.get(key); ok {
+		return
+	}
+
+	ent := &entry{key: key, data: data, size: size}
+	if _, ok := c.a1out.remove(key); ok {
+		c.evict(size)
+		c.am.pushFront(ent)
+		return
+	}
+	c.evict(size)
+	c.a1in.pushFront(ent)
+}
+
+// evict evicts resident blocks until there's room for a block of the given
+// size. Blocks evicted from a1in are remembered in a1out.
+func (c *twoQ) evict(size int64) {
+	for c.a1in.bytes+c.am.bytes+size > c.max {
+		if c.a1in.len() > 0 && (c.a1in.bytes > c.maxIn || c.am.len() == 0) {
+			ent, _ := c.a1in.popBack()
+			c.a1out.pushFront(&entry{key: ent.key, size: ent.size})
+			for c.a1out.bytes > c.maxOut && c.a1out.len() > 0 {
+				c.a1out.popBack()
+			}
+		} else {
+			c.am.popBack()
+		}
+	}
+}
+
+func (c *twoQ) Stats() Stats {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	return Stats{
+		Hits:    c.hits,
+		Misses:  c.misses,
+		Entries: c.a1in.len() + c.am.len(),
+		Bytes:   c.a1in.bytes + c.am.bytes,
+	}
+}
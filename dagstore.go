@@ -6,17 +6,21 @@ import (
 	"fmt"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/ipfs/go-cid"
 	mh "github.com/multiformats/go-multihash"
 
 	carindex "github.com/ipld/go-car/v2/index"
 
 	ds "github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/namespace"
-	"github.com/ipfs/go-datastore/query"
 	dssync "github.com/ipfs/go-datastore/sync"
 	logging "github.com/ipfs/go-log/v2"
 
+	"github.com/filecoin-project/dagstore/blockcache"
+	"github.com/filecoin-project/dagstore/directio"
 	"github.com/filecoin-project/dagstore/index"
 	"github.com/filecoin-project/dagstore/mount"
 	"github.com/filecoin-project/dagstore/shard"
@@ -26,6 +30,22 @@ import (
 var (
 	// StoreNamespace is the namespace under which shard state will be persisted.
 	StoreNamespace = ds.NewKey("dagstore")
+
+	// HistoryNamespace is the namespace under which shard journals will be
+	// persisted.
+	HistoryNamespace = ds.NewKey("dagstore-history")
+
+	// InvertedNamespace is the namespace under which the default inverted
+	// index is persisted.
+	InvertedNamespace = ds.NewKey("dagstore-inverted")
+
+	// LockNamespace is the namespace under which the instance lease of the
+	// DAG store will be stored (see Config.InstanceLockTTL).
+	LockNamespace = ds.NewKey("dagstore-lock")
+
+	// TracesNamespace is the namespace under which recent traces will be
+	// persisted (see Config.PersistRecentTraces).
+	TracesNamespace = ds.NewKey("dagstore-traces")
 )
 
 // RecoverOnStartPolicy specifies the recovery policy for failed
@@ -63,51 +83,276 @@ var (
 	// ErrShardInUse is returned when the user attempts to destroy a shard that
 	// is in use.
 	ErrShardInUse = errors.New("shard in use")
+
+	// ErrBlockNotInShard is returned when acquiring a shard restricted to a
+	// set of CIDs, and some of them are not present in the shard.
+	ErrBlockNotInShard = errors.New("block not in shard")
+
+	// ErrReadOnlyLinkSystem is returned when storing a block through the
+	// LinkSystem of a shard accessor.
+	ErrReadOnlyLinkSystem = errors.New("shard link system is read-only")
+
+	// ErrLazyInitQueueFull is returned when the first acquire of a shard
+	// registered with lazy initialization finds the initialization queue full.
+	ErrLazyInitQueueFull = errors.New("lazy initialization queue full")
+
+	// ErrMountDegraded is returned when acquiring a shard whose mount is
+	// degraded, with Config.DegradedMountPolicy set to DegradedMountFailFast.
+	ErrMountDegraded = errors.New("mount degraded")
+
+	// ErrShardTombstoned is returned when operating on a shard that is being
+	// destroyed.
+	ErrShardTombstoned = errors.New("shard is being destroyed")
+
+	// ErrLeaseExpired is returned when using a shard accessor whose lease
+	// expired, after it was force-released.
+	ErrLeaseExpired = errors.New("accessor lease expired")
+
+	// ErrShardWriterClosed is returned when using a ShardWriter after it was
+	// committed or discarded.
+	ErrShardWriterClosed = errors.New("shard writer closed")
+
+	// ErrOpVetoed is returned when an operation hook vetoed an operation.
+	ErrOpVetoed = errors.New("operation vetoed")
+
+	// ErrPaused is returned when registering a shard while the DAG store is
+	// paused.
+	ErrPaused = errors.New("dagstore paused")
+
+	// ErrReadOnly is returned when registering, destroying or recovering a
+	// shard while the DAG store is in read-only mode.
+	ErrReadOnly = errors.New("dagstore is read-only")
+
+	// ErrRefcountViolation is notified through the failure channel when
+	// refcount accounting detects an inconsistency.
+	ErrRefcountViolation = errors.New("refcount invariant violated")
+
+	// ErrAcquireQueueFull is returned when acquiring a shard that isn't
+	// active yet, and that already has Config.MaxQueuedAcquires acquirers
+	// waiting for it.
+	ErrAcquireQueueFull = errors.New("acquire queue full")
+
+	// ErrAcquireQueueTimeout is returned when an acquirer has waited for a
+	// shard to become active for longer than Config.MaxAcquireQueueWait.
+	ErrAcquireQueueTimeout = errors.New("acquire queue wait timed out")
+
+	// ErrChecksumMismatch is the error that shards fail with when the data
+	// fetched from their mount doesn't match the expected checksum.
+	ErrChecksumMismatch = mount.ErrChecksumMismatch
+
+	// ErrNamespaceQuotaExceeded is returned when registering or fetching a
+	// shard would exceed the quota of its namespace.
+	ErrNamespaceQuotaExceeded = errors.New("namespace quota exceeded")
+
+	// ErrInvalidDetachedIndex is returned when registering a shard with a
+	// detached index that can't be decoded, and is the error that shards fail
+	// with when their detached index doesn't match their CAR.
+	ErrInvalidDetachedIndex = errors.New("invalid detached index")
+
+	// ErrShardArchived is returned when acquiring a shard that has been
+	// archived; it must be restored with DAGStore.UnarchiveShard first.
+	ErrShardArchived = errors.New("shard is archived")
+
+	// ErrNoArchive is returned when archiving or unarchiving a shard without
+	// a Config.Archive.
+	ErrNoArchive = errors.New("no archive configured")
+
+	// ErrLocked is returned when starting a DAG store whose lease is held by
+	// another instance (see Config.InstanceLockTTL).
+	ErrLocked = errors.New("dagstore locked by another instance")
+
+	// ErrLockLost is returned when modifying a DAG store whose lease has been
+	// taken over by another instance.
+	ErrLockLost = errors.New("dagstore instance lock lost")
+
+	// ErrBackpressure is returned when submitting a task while a limit on
+	// pending tasks is reached, with Config.Backpressure set to
+	// BackpressureReject.
+	ErrBackpressure = errors.New("too many pending tasks")
+
+	// ErrInitTimeout is the error shards fail with when their initialization
+	// takes longer than Config.InitTimeout.
+	ErrInitTimeout = errors.New("shard initialization timed out")
+
+	// ErrInitCancelled is the error shards fail with when their
+	// initialization is cancelled through CancelInit.
+	ErrInitCancelled = errors.New("shard initialization cancelled")
+
+	// ErrNotInitializing is returned by CancelInit when the shard is not
+	// being initialized.
+	ErrNotInitializing = errors.New("shard is not initializing")
+
+	// ErrIndexSweeping is returned when registering a shard whose orphaned
+	// index is being removed by SweepIndices; the registration can be retried
+	// once the sweep is done.
+	ErrIndexSweeping = errors.New("orphaned index of shard is being swept")
 )
 
 // DAGStore is the central object of the DAG store.
 type DAGStore struct {
+	// dispatchCounters are accessed atomically, and kept first for 64-bit
+	// alignment.
+	dispatchCounters dispatchCounters
+
 	lk      sync.RWMutex
 	mounts  *mount.Registry
 	shards  map[shard.Key]*Shard
+	nsCount map[string]int // shards per namespace; guarded by lk.
 	config  Config
 	indices index.FullIndexRepo
 	store   ds.Datastore
+	history ds.Datastore // shard journals; only with Config.HistorySize.
+
+	// lockStore holds the instance lease; only with Config.InstanceLockTTL.
+	lockStore ds.Datastore
+	// fenced is set to 1 once another instance takes the lease over; accessed
+	// atomically.
+	fenced int32
 
 	// TopLevelIndex is the top level (cid -> []shards) index that maps a cid to all the shards that is present in.
 	TopLevelIndex index.Inverted
 
 	// Channels owned by us.
 	//
+	// The event loop is sharded into Config.EventLoops workers; task channels
+	// have one entry per worker, and tasks are routed to the worker that owns
+	// their shard (see queueTask).
+	//
 	// externalCh receives external tasks.
-	externalCh chan *task
+	externalCh []chan *task
 	// internalCh receives internal tasks to the event loop.
-	internalCh chan *task
+	internalCh []chan *task
 	// completionCh receives tasks queued up as a result of async completions.
-	completionCh chan *task
+	completionCh []chan *task
 	// dispatchResultsCh is a buffered channel for dispatching results back to
-	// the application. Serviced by a dispatcher goroutine.
+	// the application. Serviced by a pool of dispatcher goroutines.
 	// Note: This pattern decouples the event loop from the application, so a
 	// failure to consume immediately won't block the event loop.
 	dispatchResultsCh chan *dispatch
-	// dispatchFailuresCh is a buffered channel for dispatching shard failures
-	// back to the application. Serviced by a dispatcher goroutine.
-	// See note in dispatchResultsCh for background.
-	dispatchFailuresCh chan *dispatch
+	// failures buffers shard failures for dispatching back to the
+	// application, without blocking the event loop. Serviced by a dispatcher
+	// goroutine; nil if there's no failure channel.
+	failures *notifySink
+	// destroys buffers notifications of destroyed shards likewise; nil if
+	// there's no destroy channel.
+	destroys *notifySink
 	// gcCh is where requests for GC are sent.
-	gcCh chan chan *GCResult
+	gcCh chan *gcRequest
+	// pauseCh is where requests to pause or resume the event loop are sent.
+	pauseCh chan *pauseRequest
+	// reconfigCh is where configuration changes requested through
+	// Reconfigure are sent.
+	reconfigCh chan *reconfigRequest
+	// tierCh is where staged moves of transients across tiers are sent to be
+	// committed.
+	tierCh chan *tierMove
+	// loopPauseCh and haltCh have one entry per worker, where the coordinator
+	// relays pause requests, and halts workers for GC, respectively.
+	loopPauseCh []chan *pauseRequest
+	haltCh      []chan *haltRequest
 
 	// Channels not owned by us.
 	//
-	// traceCh is where traces on shard operations will be sent, if non-nil.
-	traceCh chan<- Trace
+	// traceChSink buffers traces for Config.TraceCh, if set, wrapping it as a
+	// ChannelTraceSink. Unlike traceSinks, it isn't replaced by Reconfigure.
+	traceChSink *traceSink
+	// traceSinks buffer traces for Config.TraceSinks; guarded by traceLk, as
+	// Reconfigure can replace them.
+	traceSinks []*traceSink
 	// failureCh is where shard failures will be notified, if non-nil.
 	failureCh chan<- ShardResult
+	// destroyCh is where destroyed shards will be notified, if non-nil.
+	destroyCh chan<- ShardDestroyed
 
 	// Throttling.
 	//
-	throttleReaadyFetch throttle.Throttler
-	throttleIndex       throttle.Throttler
+	throttleReaadyFetch *throttle.Adjustable
+	throttleIndex       *throttle.Adjustable
+	lazyInits           *lazyInitQueue // only with Config.MaxConcurrentLazyInit.
+
+	// sharedTransients deduplicates transients across shards backed by the
+	// same object; nil unless Config.DeduplicateTransients is set.
+	sharedTransients *mount.SharedTransients
+
+	// blockCache caches hot blocks across shard accessors; nil unless
+	// Config.BlockCacheSize is set.
+	blockCache blockcache.Cache
+
+	// health tracks the health of mounts.
+	health *mountHealth
+
+	// writing maps the keys of shards being written through a ShardWriter to
+	// the path of the CAR being written; guarded by lk.
+	writing map[shard.Key]string
+
+	// txnKeys holds the keys of shards being registered by a transaction;
+	// guarded by lk.
+	txnKeys map[shard.Key]struct{}
+
+	// cloning holds the keys of shards being cloned into, whose index is
+	// added before they're registered; guarded by lk.
+	cloning map[shard.Key]struct{}
+
+	// sweeping holds the keys of the orphaned indices being removed by
+	// SweepIndices, which can't be registered meanwhile; guarded by lk.
+	sweeping map[shard.Key]struct{}
+
+	// tierQueue queues the moves of transients across tiers for the tier
+	// worker; nil if tiering is disabled.
+	tierQueue chan tierJob
+
+	// Pausing.
+	//
+	// paused is true while the DAG store is paused; guarded by lk.
+	paused bool
+	// loopPaused is each worker's view of paused; every entry is only
+	// accessed by its worker.
+	loopPaused []bool
+
+	// watchdog tracks the progress of the event loop workers.
+	watchdog *watchdog
+
+	// traceSeq is the sequence number of the last emitted trace; guarded by
+	// traceLk, which is held while the trace is sent, so that traces are
+	// delivered in sequence.
+	traceLk  sync.Mutex
+	traceSeq uint64
+
+	// pending counts the tasks queued for the event loop by operation, and
+	// pendingByShard by shard and operation, created on first use; guarded by
+	// pendingLk.
+	pendingLk      sync.Mutex
+	pending        map[OpType]int
+	pendingByShard map[shard.Key]map[OpType]int
+
+	// admission tracks the tasks admitted against Config.MaxPendingTasks and
+	// Config.MaxPendingTasksPerOp.
+	admission admission
+
+	// inits holds the initializations in flight, so that they can be
+	// cancelled; guarded by initsLk.
+	initsLk sync.Mutex
+	inits   map[shard.Key]*initRun
+
+	// jobs are the maintenance jobs, by name.
+	jobs map[JobName]*job
+
+	// blooms holds the bloom filter of the shards in the inverted index, if
+	// Config.BloomFalsePositiveRate is set.
+	blooms *blooms
+
+	// gcStats accumulates the outcome of GC runs; guarded by gcStatsLk.
+	gcStatsLk sync.Mutex
+	gcStats   GCStats
+
+	// recentTraces keeps the most recent traces; nil unless
+	// Config.RecentTracesSize is set. tracesStore persists them.
+	recentTraces *traceRing
+	tracesStore  ds.Datastore
+
+	// lastRefID is the id of the last reference taken, when refcount
+	// accounting is enabled; accessed atomically.
+	lastRefID uint64
 
 	// Lifecycle.
 	//
@@ -129,6 +374,26 @@ type task struct {
 	op    OpType
 	shard *Shard
 	err   error
+
+	// for OpShardRelease with Config.RefcountAccounting: the reference being
+	// released, and the call site releasing it.
+	ref    uint64
+	caller string
+
+	// admitted is set if the task was admitted against the limits on pending
+	// tasks, and must be released once processed.
+	admitted bool
+
+	// for OpShardUnarchive: the index and transient restored from the archive.
+	restore *archiveRestore
+
+	// for OpShardMakeAvailable and OpShardFail: set if the task completes an
+	// initialization goroutine.
+	initDone bool
+
+	// for OpShardDestroy: set if a transaction vetted the destroy and
+	// persisted the tombstone, in which case it can't be refused anymore.
+	committed bool
 }
 
 // ShardResult encapsulates a result from an asynchronous operation.
@@ -143,34 +408,144 @@ type Config struct {
 	// be created for remote mounts.
 	TransientsDir string
 
+	// TransientsLayout is the layout of transients under TransientsDir and
+	// HotTransientsDir. Defaults to shard.LayoutFlat; shard.LayoutSharded
+	// fans them out across subdirectories, which scales to many more shards.
+	// Transients stored with a different layout are migrated on start.
+	TransientsLayout shard.Layout
+
+	// HotTransientsDir, if set, enables tiered transients. Transients are
+	// created in TransientsDir (the warm tier, e.g. on HDD), and promoted to
+	// HotTransientsDir (the hot tier, e.g. on NVMe) when their shard is
+	// acquired, as long as the hot tier has capacity for them. GC demotes the
+	// hot transients of idle shards to the warm tier, instead of deleting them.
+	// Transients are copied across tiers in the background; shards keep using
+	// their transient in its current tier until the copy is complete.
+	HotTransientsDir string
+
+	// HotTransientsCapacity is the maximum number of bytes taken up by
+	// transients in the hot tier. Required if HotTransientsDir is set.
+	HotTransientsCapacity int64
+
+	// WrittenShardsDir is the directory where the CARs of shards ingested
+	// through ShardWriter are stored. Those shards are registered with a
+	// mount.FileMount, which must be registered in MountRegistry. It's
+	// required to use NewShardWriter.
+	WrittenShardsDir string
+
 	// IndexRepo is the full index repo to use.
 	IndexRepo index.FullIndexRepo
 
+	// TopLevelIndex is the inverted index to use. Defaults to an in-memory
+	// inverted index, or one persisted in Datastore if PersistInvertedIndex
+	// is set.
 	TopLevelIndex index.Inverted
 
+	// PersistInvertedIndex persists the default inverted index in Datastore,
+	// under InvertedNamespace, so that it survives restarts. Datastore must
+	// support batching. Available shards missing from it, e.g. shards
+	// registered before it was enabled, are added back on start from their
+	// full indices.
+	PersistInvertedIndex bool
+
 	// Datastore is the datastore where shard state will be persisted.
 	Datastore ds.Datastore
 
+	// DatastoreNamespace is the key prefix under which shard state is
+	// persisted in Datastore, so that several DAG stores can share it.
+	// Defaults to StoreNamespace.
+	DatastoreNamespace ds.Key
+
 	// MountRegistry contains the set of recognized mount types.
 	MountRegistry *mount.Registry
 
 	// TraceCh is a channel where the caller desires to be notified of every
-	// shard operation. Publishing to this channel blocks the event loop, so the
-	// caller must ensure the channel is serviced appropriately.
-	//
-	// Note: Not actively consuming from this channel will make the event
-	// loop block.
+	// shard operation. It's fed like a ChannelTraceSink in TraceSinks, with
+	// the default buffer size and drop policy, so publishing to it never
+	// blocks the event loop: traces are dropped while the buffer is full, and
+	// counted in Stats.DroppedTraces.
 	TraceCh chan<- Trace
 
+	// TraceSinks are sinks to be notified of every shard operation, like
+	// TraceCh. Unlike TraceCh, each sink is fed from its own buffer, and
+	// traces are dropped according to its drop policy when it falls behind,
+	// so that a slow sink never blocks the event loop.
+	TraceSinks []TraceSinkOpts
+
+	// RecentTracesSize, if positive, is the number of most recent traces
+	// kept in memory, to be queried through DAGStore.RecentTraces.
+	RecentTracesSize int
+
+	// PersistRecentTraces persists the recent traces to the datastore, under
+	// TracesNamespace, when the DAG store is closed, and restores them on
+	// start. Requires RecentTracesSize.
+	PersistRecentTraces bool
+
 	// FailureCh is a channel to be notified every time that a shard moves to
 	// ShardStateErrored. A nil value will send no failure notifications.
 	// Failure events can be used to evaluate the error and call
 	// DAGStore.RecoverShard if deemed recoverable.
 	//
-	// Note: Not actively consuming from this channel will make the event
-	// loop block.
+	// Note: Notifications are buffered up to FailureBufferSize while this
+	// channel isn't consumed; beyond it, the oldest ones are dropped. See
+	// DAGStore.FailureStats.
 	FailureCh chan<- ShardResult
 
+	// FailureBufferSize is the maximum number of failure notifications
+	// buffered while the application isn't consuming FailureCh. Defaults to
+	// DefaultFailureBufferSize.
+	FailureBufferSize int
+
+	// DestroyCh is a channel to be notified every time that a shard is
+	// destroyed, e.g. so that external indices of the content of shards can
+	// drop it without polling. A nil value will send no notifications.
+	//
+	// Like FailureCh, notifications are buffered up to DestroyBufferSize while
+	// this channel isn't consumed; beyond it, the oldest ones are dropped. See
+	// DAGStore.DestroyStats.
+	DestroyCh chan<- ShardDestroyed
+
+	// DestroyBufferSize is the maximum number of destroy notifications
+	// buffered while the application isn't consuming DestroyCh. Defaults to
+	// DefaultDestroyBufferSize.
+	DestroyBufferSize int
+
+	// ErrorHistorySize is the number of most recent failures recorded per
+	// shard, and persisted along with it, so that they can be inspected
+	// through ShardInfo.Failures. Defaults to DefaultErrorHistorySize.
+	ErrorHistorySize int
+
+	// EventLoops is the number of event loop workers that process shard
+	// operations. Shards are assigned to workers by hashing their keys, so
+	// that operations on a shard are processed in order, while operations on
+	// different shards can proceed in parallel. GC still runs with
+	// exclusivity, halting all workers. 0 or 1 (default) runs a single event
+	// loop.
+	EventLoops int
+
+	// IndexWorkers, if greater than 1, is the number of workers that scan
+	// the sections of large CARs in parallel when generating their indices,
+	// cutting initialization time on multi-core machines. CARs embedding an
+	// index, and those smaller than a couple of chunks of 64MiB, are indexed
+	// sequentially.
+	IndexWorkers int
+
+	// IndexMemoryBudget, if positive, bounds the memory used to generate the
+	// index of a CAR, besides the index itself: records beyond the budget are
+	// sorted and spilled to temporary files in TransientsDir, and merged
+	// externally (see index.BoundedBuilder). Indices are then generated
+	// sequentially, regardless of IndexWorkers. Budgets below
+	// index.MinBuildBudget are raised to it. 0 (default) disables the bound.
+	IndexMemoryBudget int64
+
+	// IndexedGetSize makes the blockstores of shard accessors derive the size
+	// of blocks from the offsets of the index, without reading the CAR. The
+	// index must record every section of the CAR, which those generated by the
+	// DAG store do, but indices embedded in CARv2 files may omit identity
+	// CIDs; and blocks must be looked up by the CIDs they're stored under, or
+	// CIDs of the same length.
+	IndexedGetSize bool
+
 	// MaxConcurrentIndex is the maximum indexing jobs that can
 	// run concurrently. 0 (default) disables throttling.
 	MaxConcurrentIndex int
@@ -180,9 +555,309 @@ type Config struct {
 	// immediate fetch. 0 (default) disables throttling.
 	MaxConcurrentReadyFetches int
 
+	// MaxConcurrentLazyInit is the maximum number of initializations
+	// triggered by acquiring shards registered with lazy initialization that
+	// can run concurrently. Excess initializations are queued in arrival
+	// order. This cap is independent from MaxConcurrentIndex, and does not
+	// apply to explicit registrations and recoveries, so that a flood of
+	// acquires on lazy shards doesn't starve operator-driven work.
+	// 0 (default) disables throttling.
+	MaxConcurrentLazyInit int
+
+	// MaxQueuedLazyInit is the maximum number of lazy initializations that
+	// can wait for a slot when MaxConcurrentLazyInit is set. First acquires of
+	// lazy shards beyond it fail with ErrLazyInitQueueFull, leaving the shard
+	// uninitialized so that it can be acquired later. The position of a shard
+	// in the queue is reported in ShardInfo. 0 (default) is unlimited.
+	MaxQueuedLazyInit int
+
+	// MaxConcurrentAcquiresPerShard is the maximum number of acquirers of a
+	// single shard that can be opening it (fetching from its mount and loading
+	// its index) concurrently. Excess acquirers are dispatched in FIFO order
+	// as earlier ones finish opening, so that a burst of acquires doesn't
+	// overwhelm the mount with simultaneous reader opens. Acquirers that are
+	// waiting hold a reference to the shard. 0 (default) disables the cap.
+	MaxConcurrentAcquiresPerShard int
+
+	// MaxCallersPerShard is the maximum number of callers (see
+	// AcquireOpts.Caller) whose statistics are tracked per shard. Once
+	// reached, the caller that acquired the shard least recently is dropped
+	// to make room. Defaults to DefaultMaxCallersPerShard.
+	MaxCallersPerShard int
+
+	// IndexCacheSize, if positive, enables a cache of up to this many parsed
+	// indices, so that acquirers of hot shards reuse them instead of loading
+	// them from the IndexRepo on every acquire.
+	IndexCacheSize int
+
+	// BlockCacheSize, if positive, enables an in-memory cache of blocks read
+	// through the blockstores of shard accessors, holding up to this many
+	// bytes of block data. The cache is shared across all accessors, so that
+	// repeated reads of hot blocks (e.g. manifests and directory roots) don't
+	// hit the index and the disk every time.
+	BlockCacheSize int64
+
+	// BlockCachePolicy is the replacement policy of the block cache.
+	BlockCachePolicy blockcache.Policy
+
+	// ExpirySweepInterval is the interval at which shards registered with a
+	// TTL, or with an expiry supplied by ExpiryProvider, are checked for
+	// expiry, and destroyed (or archived) once past it. Shards with
+	// active references are destroyed on the first sweep after they are
+	// released. Defaults to DefaultExpirySweepInterval.
+	ExpirySweepInterval time.Duration
+
+	// ExpiryProvider, if non-nil, supplies the expiry times of shards, e.g.
+	// from the deals they back, overriding their TTLs. It's queried for every
+	// shard on every expiry sweep.
+	ExpiryProvider ExpiryProvider
+
+	// ExpiryGracePeriod is the time that shards are kept past their expiry
+	// before the expiry sweeper acts on them.
+	ExpiryGracePeriod time.Duration
+
+	// ExpiryAction is what the expiry sweeper does with expired shards.
+	// Defaults to ExpiryDestroy.
+	ExpiryAction ExpiryAction
+
+	// MaxQueuedAcquires is the maximum number of acquirers that can wait for
+	// a shard to become active (e.g. while it's initializing or recovering).
+	// Acquires beyond it fail immediately with ErrAcquireQueueFull, so that
+	// callers can shed load. 0 (default) is unlimited.
+	MaxQueuedAcquires int
+
+	// MaxPendingTasks is the maximum number of tasks submitted through
+	// RegisterShard, AcquireShard, DestroyShard and RecoverShard that can be
+	// pending processing by the event loop. Once reached, further calls
+	// block or fail according to Backpressure. 0 (default) is unlimited,
+	// in which case callers only block once the task queue is full.
+	MaxPendingTasks int
+
+	// MaxPendingTasksPerOp is like MaxPendingTasks, but limits the tasks of
+	// each operation (OpShardRegister, OpShardAcquire, OpShardDestroy and
+	// OpShardRecover), so that e.g. a burst of registrations doesn't hold up
+	// acquires. Operations without an entry are unlimited.
+	MaxPendingTasksPerOp map[OpType]int
+
+	// Backpressure is what calls do when MaxPendingTasks or
+	// MaxPendingTasksPerOp is reached. Defaults to BackpressureBlock.
+	Backpressure BackpressurePolicy
+
+	// MaxAcquireQueueWait is the maximum time an acquirer can wait for a
+	// shard to become active. Acquirers that wait for longer fail with
+	// ErrAcquireQueueTimeout. 0 (default) waits indefinitely, subject to the
+	// acquire context.
+	MaxAcquireQueueWait time.Duration
+
+	// HistorySize is the number of most recent state transitions journaled
+	// per shard, and persisted to the datastore, so that they can be
+	// inspected with ShardHistory after the fact (e.g. to find out why a shard
+	// errored). 0 (default) disables the journal.
+	HistorySize int
+
+	// ShardGroup, if set, assigns shards to application-defined groups, which
+	// reports such as LocalityReport aggregate by.
+	ShardGroup ShardGroupFunc
+
+	// RefcountAccounting enables a debug mode that tracks every shard
+	// reference with the call site that acquired it, and validates refcount
+	// invariants at every state transition. Violations (e.g. double releases)
+	// are logged and notified through FailureCh wrapping
+	// ErrRefcountViolation, instead of silently corrupting the refcount.
+	// Outstanding references can be inspected with ShardRefs.
+	RefcountAccounting bool
+
+	// NamespaceQuotas sets per-namespace limits on the number of shards and
+	// on the bytes taken up by their transients, keyed by namespace (see
+	// shard.KeyInNamespace). Namespaces without an entry are unlimited.
+	NamespaceQuotas map[string]NamespaceQuota
+
 	// RecoverOnStart specifies whether failed shards should be recovered
 	// on start.
 	RecoverOnStart RecoverOnStartPolicy
+
+	// RestoreConcurrency is the number of goroutines that hydrate persisted
+	// shards on start, i.e. that deserialize them, instantiate their mounts
+	// (calling the ConfigureFuncs of the mount registry concurrently), and
+	// check their transients. Defaults to DefaultRestoreConcurrency.
+	RestoreConcurrency int
+
+	// MountHealthCheckInterval, if positive, is the interval at which mounts
+	// are probed for health (see DAGStore.CheckMountHealth). 0 (default)
+	// disables periodic probes.
+	MountHealthCheckInterval time.Duration
+
+	// MountHealthSampleSize is the number of mounts of each type and endpoint
+	// probed on every health check. Defaults to DefaultMountHealthSampleSize.
+	MountHealthSampleSize int
+
+	// DegradedMountPolicy specifies how acquires that need to fetch from a
+	// degraded mount are handled. Defaults to DegradedMountIgnore.
+	// DegradedMountQueue requires MountHealthCheckInterval to be set, so that
+	// parked acquires resume once the mount heals.
+	DegradedMountPolicy DegradedMountPolicy
+
+	// AcquireRetryPolicies are the policies that failed fetches of the data of
+	// shards being acquired are retried with, by mount scheme, before the
+	// acquires fail, e.g. to ride out blips of network file systems. Fetches
+	// from mounts of schemes without a policy aren't retried.
+	AcquireRetryPolicies map[string]AcquireRetryPolicy
+
+	// RecoverAllPacing is the maximum random delay before each recovery
+	// issued by DAGStore.RecoverAll. Defaults to DefaultRecoverAllPacing; set
+	// it to a negative value to disable pacing.
+	RecoverAllPacing time.Duration
+
+	// DeduplicateTransients makes shards whose mounts refer to the same
+	// object (same mount type and URL) share a single refcounted transient,
+	// instead of fetching a copy per shard.
+	DeduplicateTransients bool
+
+	// CompressTransients stores transients zstd-compressed, trading CPU for
+	// disk space in the transients directory. Compressed transients still
+	// support random access. It can be overridden per shard through
+	// RegisterOpts.Compression.
+	CompressTransients bool
+
+	// ErrorRedactor, if non-nil, is applied to shard errors before they are
+	// persisted, traced, logged, or sent to result and failure channels.
+	// RedactURLs is a suitable implementation for mounts whose errors may
+	// contain credentials or presigned URLs.
+	ErrorRedactor ErrorRedactor
+
+	// OpHooks are called by the event loop around every shard operation, in
+	// order. They can veto acquires, recoveries and destroys. See OpHook.
+	OpHooks []OpHook
+
+	// GCRecencyHalfLife is the time after which the acquire count of a shard
+	// counts half as much when GCToTarget ranks shards for eviction. Defaults
+	// to DefaultGCRecencyHalfLife.
+	GCRecencyHalfLife time.Duration
+
+	// FetchProgressInterval, if positive, enables OpShardFetchProgress traces,
+	// reporting the progress of the fetches of transients at most once per
+	// interval, and once more when a fetch completes. Zero disables them.
+	FetchProgressInterval time.Duration
+
+	// ReadOnly opens the DAG store in read-only mode, e.g. for replicas that
+	// serve retrievals from storage shared with a single writer node that
+	// manages the shards. Registrations, destroys and recoveries are rejected
+	// with ErrReadOnly, while acquires work as usual. The shard state is never
+	// written to the datastore, interrupted operations are not resumed on
+	// start, expired shards are not destroyed, errored shards are not
+	// recovered on acquire, and GC leaves the transients alone. Shards that
+	// the writer registers later are picked up by DAGStore.Refresh.
+	ReadOnly bool
+
+	// MaxShardSize, MaxShardBlocks and MaxBlockSize, if positive, limit the
+	// size of the CAR of a shard in bytes, its number of blocks, and the size
+	// of any single block in bytes, respectively. They are enforced when the
+	// shard is initialized, before it's indexed, so that abusive inputs fail
+	// the shard with a ShardLimitError instead of producing huge indices.
+	// Block limits require a scan of the section headers of the CAR.
+	MaxShardSize   int64
+	MaxShardBlocks int64
+	MaxBlockSize   int64
+
+	// DispatchWorkers is the number of goroutines delivering the results of
+	// operations to the application, so that a waiter slow to receive its
+	// result doesn't hold up the others. Defaults to DefaultDispatchWorkers.
+	DispatchWorkers int
+
+	// DispatchQueueSize is the number of results that can be queued up for
+	// delivery before their producers (including the event loop) block.
+	// Defaults to DefaultDispatchQueueSize. See DAGStore.DispatchStats.
+	DispatchQueueSize int
+
+	// WatchdogTimeout, if positive, enables the event loop watchdog, which
+	// reports an event loop worker as stalled (see DAGStore.Health) and logs
+	// a dump of all goroutines when it has had tasks queued without
+	// processing any for this long. A common cause is a FailureCh that isn't
+	// being consumed.
+	WatchdogTimeout time.Duration
+
+	// Archive is the cold storage that shards are archived to, and restored
+	// from, by DAGStore.ArchiveShard and DAGStore.UnarchiveShard. Archiving
+	// is unavailable if nil.
+	Archive Archive
+
+	// InstanceLockTTL, if positive, makes the DAG store take a lease on its
+	// datastore namespace on Start, so that a second instance accidentally
+	// pointed at the same datastore refuses to start with ErrLocked instead
+	// of silently corrupting the shard state. The lease is renewed every
+	// third of the TTL, and released on Close; the lease of an instance that
+	// crashed expires after the TTL. Read-only instances don't take a lease.
+	InstanceLockTTL time.Duration
+
+	// InstanceID identifies this instance in its lease. Defaults to an
+	// identifier derived from the hostname and the process ID.
+	InstanceID string
+
+	// TakeOverLock makes Start take the lease over from another instance
+	// that holds it. The other instance is fenced on its next renewal: it
+	// stops persisting shard state, and rejects modifications with
+	// ErrLockLost.
+	TakeOverLock bool
+
+	// ReplicaResolver, if set, locates replicas of shards elsewhere, which
+	// acquires of errored or recovering shards transparently fall back to,
+	// instead of failing or waiting. Acquiring an errored shard from its
+	// replica also queues its recovery in the background, unless the DAG
+	// store is read-only. See ShardAccessor.Replica.
+	ReplicaResolver ReplicaResolver
+
+	// MaxPassthroughLatency is the highest random access latency declared by
+	// a mount (see mount.Info.AccessLatency) for it to be read directly,
+	// instead of being copied to a transient. Defaults to
+	// mount.DefaultMaxPassthroughLatency.
+	MaxPassthroughLatency time.Duration
+
+	// OnShardIdle, if set, is called when the last active reference to a
+	// shard is released. It's called by the event loop, with the shard
+	// locked, so it must return quickly and must not call back into the DAG
+	// store.
+	OnShardIdle ShardIdleFunc
+
+	// IdleReclaimTimeout, if positive, reclaims the transient of a shard once
+	// it has been idle for this long, on the event loop of the shard,
+	// instead of waiting for a global GC. The transient is kept if the shard
+	// is acquired again in the meantime.
+	IdleReclaimTimeout time.Duration
+
+	// InitTimeout, if positive, bounds the time it takes to initialize or
+	// recover a shard, i.e. to fetch its data and index it. Shards taking
+	// longer fail with ErrInitTimeout. Initializations can also be cancelled
+	// through DAGStore.CancelInit.
+	InitTimeout time.Duration
+
+	// BloomFalsePositiveRate, if positive, enables a bloom filter of the
+	// multihashes of all shards with this false positive rate, which must be
+	// lower than 1. The filter is consulted by ShardsContainingMultihash and
+	// ShardsContainingCid before the inverted index, so that multihashes in
+	// no shard are turned down without looking them up. It's built along with
+	// the inverted index, rebuilt in the background when it runs out of room,
+	// and persisted on close if IndexRepo is an index.BloomRepo; otherwise,
+	// it's rebuilt from the full indices on start.
+	// Multihashes added to TopLevelIndex other than by the DAG store aren't
+	// covered by the filters, so it must only be populated by the DAG store.
+	BloomFalsePositiveRate float64
+
+	// Jobs configures the maintenance jobs run periodically by the DAG store,
+	// e.g. JobGC or JobVerifyIndices. Jobs not in the map, or not enabled,
+	// only run through RunJob. Their status is reported by Stats.
+	Jobs map[JobName]JobConfig
+
+	// DirectIO writes transients, and full indices if IndexRepo is an
+	// index.DirectIORepo, with direct IO where the platform and filesystem
+	// support it (see package directio), so that fetching and indexing shards
+	// doesn't evict the pages serving retrievals on busy nodes. Written data
+	// is flushed to storage every DirectIOSyncInterval bytes. Elsewhere,
+	// writes are buffered, and flushed the same way.
+	DirectIO bool
+
+	// DirectIOSyncInterval is the number of bytes written with DirectIO
+	// between flushes to storage. Defaults to directio.DefaultSyncInterval.
+	DirectIOSyncInterval int64
 }
 
 // NewDAGStore constructs a new DAG store with the supplied configuration.
@@ -193,19 +868,51 @@ func NewDAGStore(cfg Config) (*DAGStore, error) {
 	if cfg.TransientsDir == "" {
 		return nil, fmt.Errorf("missing scratch area root path")
 	}
+	if cfg.BloomFalsePositiveRate >= 1 {
+		return nil, fmt.Errorf("bloom filter false positive rate must be lower than 1")
+	}
+	if cfg.DegradedMountPolicy == DegradedMountQueue && cfg.MountHealthCheckInterval <= 0 {
+		return nil, fmt.Errorf("queueing acquires of degraded mounts requires periodic mount health checks")
+	}
 	if err := ensureDir(cfg.TransientsDir); err != nil {
 		return nil, fmt.Errorf("failed to create scratch root dir: %w", err)
 	}
+	if cfg.HotTransientsDir != "" {
+		if cfg.HotTransientsCapacity <= 0 {
+			return nil, fmt.Errorf("missing hot transients capacity")
+		}
+		if err := ensureDir(cfg.HotTransientsDir); err != nil {
+			return nil, fmt.Errorf("failed to create hot transients dir: %w", err)
+		}
+	}
+
+	if cfg.WrittenShardsDir != "" {
+		if err := ensureDir(cfg.WrittenShardsDir); err != nil {
+			return nil, fmt.Errorf("failed to create written shards dir: %w", err)
+		}
+	}
 
 	// instantiate the index repo.
 	if cfg.IndexRepo == nil {
 		log.Info("using in-memory index store")
 		cfg.IndexRepo = index.NewMemoryRepo()
 	}
+	if cfg.IndexCacheSize > 0 {
+		cfg.IndexRepo = index.NewCachedRepo(cfg.IndexRepo, cfg.IndexCacheSize)
+	}
 
 	if cfg.TopLevelIndex == nil {
-		log.Info("using in-memory inverted index")
-		cfg.TopLevelIndex = index.NewInverted(dssync.MutexWrap(ds.NewMapDatastore()))
+		if cfg.PersistInvertedIndex {
+			bds, ok := cfg.Datastore.(ds.Batching)
+			if !ok {
+				return nil, fmt.Errorf("persisting the inverted index requires a batching datastore")
+			}
+			log.Info("using inverted index persisted in the datastore")
+			cfg.TopLevelIndex = index.NewInverted(namespace.Wrap(bds, InvertedNamespace))
+		} else {
+			log.Info("using in-memory inverted index")
+			cfg.TopLevelIndex = index.NewInverted(dssync.MutexWrap(ds.NewMapDatastore()))
+		}
 	}
 
 	// handle the datastore.
@@ -215,12 +922,66 @@ func NewDAGStore(cfg Config) (*DAGStore, error) {
 	}
 
 	// namespace all store operations.
-	cfg.Datastore = namespace.Wrap(cfg.Datastore, StoreNamespace)
+	history := namespace.Wrap(cfg.Datastore, HistoryNamespace)
+	lockStore := namespace.Wrap(cfg.Datastore, LockNamespace)
+	tracesStore := namespace.Wrap(cfg.Datastore, TracesNamespace)
+	if cfg.DatastoreNamespace == (ds.Key{}) {
+		cfg.DatastoreNamespace = StoreNamespace
+	}
+	cfg.Datastore = namespace.Wrap(cfg.Datastore, cfg.DatastoreNamespace)
+
+	if cfg.ExpirySweepInterval <= 0 {
+		cfg.ExpirySweepInterval = DefaultExpirySweepInterval
+	}
+
+	if cfg.MountHealthSampleSize <= 0 {
+		cfg.MountHealthSampleSize = DefaultMountHealthSampleSize
+	}
+
+	if cfg.RecoverAllPacing == 0 {
+		cfg.RecoverAllPacing = DefaultRecoverAllPacing
+	}
+
+	if cfg.DispatchWorkers <= 0 {
+		cfg.DispatchWorkers = DefaultDispatchWorkers
+	}
+	if cfg.DispatchQueueSize <= 0 {
+		cfg.DispatchQueueSize = DefaultDispatchQueueSize
+	}
+	if cfg.GCRecencyHalfLife <= 0 {
+		cfg.GCRecencyHalfLife = DefaultGCRecencyHalfLife
+	}
+
+	if cfg.InstanceID == "" {
+		cfg.InstanceID = newInstanceID()
+	}
+
+	if cfg.FailureBufferSize <= 0 {
+		cfg.FailureBufferSize = DefaultFailureBufferSize
+	}
+	if cfg.DestroyBufferSize <= 0 {
+		cfg.DestroyBufferSize = DefaultDestroyBufferSize
+	}
+
+	if cfg.RestoreConcurrency <= 0 {
+		cfg.RestoreConcurrency = DefaultRestoreConcurrency
+	}
+
+	if cfg.ErrorHistorySize <= 0 {
+		cfg.ErrorHistorySize = DefaultErrorHistorySize
+	}
+	if cfg.MaxCallersPerShard <= 0 {
+		cfg.MaxCallersPerShard = DefaultMaxCallersPerShard
+	}
 
 	if cfg.MountRegistry == nil {
 		cfg.MountRegistry = mount.NewRegistry()
 	}
 
+	if dr, ok := cfg.IndexRepo.(index.DirectIORepo); ok && cfg.DirectIO {
+		dr.SetDirectIO(directIOOptions(cfg))
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	dagst := &DAGStore{
 		mounts:              cfg.MountRegistry,
@@ -228,26 +989,88 @@ func NewDAGStore(cfg Config) (*DAGStore, error) {
 		indices:             cfg.IndexRepo,
 		TopLevelIndex:       cfg.TopLevelIndex,
 		shards:              make(map[shard.Key]*Shard),
+		writing:             make(map[shard.Key]string),
+		txnKeys:             make(map[shard.Key]struct{}),
+		cloning:             make(map[shard.Key]struct{}),
+		sweeping:            make(map[shard.Key]struct{}),
+		inits:               make(map[shard.Key]*initRun),
+		blooms:              newBlooms(cfg.BloomFalsePositiveRate),
+		health:              newMountHealth(),
 		store:               cfg.Datastore,
-		externalCh:          make(chan *task, 128),     // len=128, concurrent external tasks that can be queued up before exercising backpressure.
-		internalCh:          make(chan *task, 1),       // len=1, because eventloop will only ever stage another internal event.
-		completionCh:        make(chan *task, 64),      // len=64, hitting this limit will just make async tasks wait.
-		dispatchResultsCh:   make(chan *dispatch, 128), // len=128, same as externalCh.
-		gcCh:                make(chan chan *GCResult, 8),
-		traceCh:             cfg.TraceCh,
+		history:             history,
+		lockStore:           lockStore,
+		tracesStore:         tracesStore,
+		dispatchResultsCh:   make(chan *dispatch, cfg.DispatchQueueSize),
+		gcCh:                make(chan *gcRequest, 8),
+		pauseCh:             make(chan *pauseRequest),
+		reconfigCh:          make(chan *reconfigRequest),
+		tierCh:              make(chan *tierMove),
 		failureCh:           cfg.FailureCh,
-		throttleIndex:       throttle.Noop(),
-		throttleReaadyFetch: throttle.Noop(),
+		destroyCh:           cfg.DestroyCh,
+		throttleIndex:       throttle.NewAdjustable(cfg.MaxConcurrentIndex),
+		throttleReaadyFetch: throttle.NewAdjustable(cfg.MaxConcurrentReadyFetches),
 		ctx:                 ctx,
 		cancelFn:            cancel,
 	}
 
-	if max := cfg.MaxConcurrentIndex; max > 0 {
-		dagst.throttleIndex = throttle.Fixed(max)
+	loops := cfg.EventLoops
+	if loops <= 0 {
+		loops = 1
+	}
+	for i := 0; i < loops; i++ {
+		dagst.externalCh = append(dagst.externalCh, make(chan *task, 128))    // len=128, concurrent external tasks that can be queued up before exercising backpressure.
+		dagst.internalCh = append(dagst.internalCh, make(chan *task, 1))      // len=1, because eventloop will only ever stage another internal event.
+		dagst.completionCh = append(dagst.completionCh, make(chan *task, 64)) // len=64, hitting this limit will just make async tasks wait.
+		dagst.loopPauseCh = append(dagst.loopPauseCh, make(chan *pauseRequest))
+		dagst.haltCh = append(dagst.haltCh, make(chan *haltRequest))
+	}
+	dagst.loopPaused = make([]bool, loops)
+	dagst.watchdog = newWatchdog(loops)
+
+	dagst.admission.setLimits(cfg.MaxPendingTasks, cfg.MaxPendingTasksPerOp, cfg.Backpressure)
+
+	for _, opts := range cfg.TraceSinks {
+		dagst.traceSinks = append(dagst.traceSinks, newTraceSink(opts))
+	}
+	if cfg.TraceCh != nil {
+		dagst.traceChSink = newTraceSink(TraceSinkOpts{Sink: ChannelTraceSink(cfg.TraceCh)})
+	}
+
+	if cfg.RecentTracesSize > 0 {
+		dagst.recentTraces = newTraceRing(cfg.RecentTracesSize)
 	}
 
-	if max := cfg.MaxConcurrentReadyFetches; max > 0 {
-		dagst.throttleReaadyFetch = throttle.Fixed(max)
+	if cfg.FailureCh != nil {
+		dagst.failures = newNotifySink("failure", cfg.FailureBufferSize)
+	}
+	if cfg.DestroyCh != nil {
+		dagst.destroys = newNotifySink("destroy", cfg.DestroyBufferSize)
+	}
+
+	if cfg.MaxConcurrentLazyInit > 0 {
+		dagst.lazyInits = newLazyInitQueue(cfg.MaxQueuedLazyInit)
+	}
+
+	if cfg.HotTransientsDir != "" {
+		dagst.tierQueue = make(chan tierJob, tierQueueSize)
+	}
+
+	if cfg.BlockCacheSize > 0 {
+		c, err := blockcache.New(cfg.BlockCacheSize, cfg.BlockCachePolicy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create block cache: %w", err)
+		}
+		dagst.blockCache = c
+	}
+
+	jobs, err := dagst.newJobs(cfg.Jobs)
+	if err != nil {
+		return nil, err
+	}
+	dagst.jobs = jobs
+
+	if cfg.DeduplicateTransients {
+		dagst.sharedTransients = mount.NewSharedTransients(cfg.TransientsDir)
 	}
 
 	return dagst, nil
@@ -255,13 +1078,31 @@ func NewDAGStore(cfg Config) (*DAGStore, error) {
 
 // Start starts a DAG store.
 func (d *DAGStore) Start(ctx context.Context) error {
+	if d.config.InstanceLockTTL > 0 && !d.config.ReadOnly {
+		if err := d.acquireLock(ctx); err != nil {
+			return err
+		}
+	}
+
 	if err := d.restoreState(); err != nil {
 		// TODO add a lenient mode.
 		return fmt.Errorf("failed to restore dagstore state: %w", err)
 	}
 
-	if err := d.clearOrphaned(); err != nil {
-		log.Warnf("failed to clear orphaned files on startup: %s", err)
+	if d.recentTraces != nil && d.config.PersistRecentTraces {
+		if err := d.restoreRecentTraces(ctx); err != nil {
+			log.Warnf("failed to restore recent traces: %s", err)
+		}
+	}
+
+	// in read-only mode, the files may belong to shards registered by the
+	// writer node since we restored the state; leave them alone.
+	if !d.config.ReadOnly {
+		d.migrateTransients()
+
+		if err := d.clearOrphaned(); err != nil {
+			log.Warnf("failed to clear orphaned files on startup: %s", err)
+		}
 	}
 
 	// Reset in-progress states.
@@ -270,7 +1111,7 @@ func (d *DAGStore) Start(ctx context.Context) error {
 	// ops after we spawn the control goroutine. Otherwise, having more shards
 	// in this state than the externalCh buffer size would exceed the channel
 	// buffer, and we'd block forever.
-	var toRegister, toRecover []*Shard
+	var toRegister, toRecover, toDestroy []*Shard
 	for _, s := range d.shards {
 		switch s.state {
 		case ShardStateErrored:
@@ -291,6 +1132,18 @@ func (d *DAGStore) Start(ctx context.Context) error {
 		case ShardStateAvailable:
 			// Noop: An available shard whose index has disappeared across restarts
 			// will fail on the first acquisition.
+		case ShardStateTombstoned:
+			// resume destroys interrupted by the shutdown; there are no
+			// active references left.
+			toDestroy = append(toDestroy, s)
+		case ShardStateArchived:
+			// Noop: archived shards stay archived until they're unarchived.
+		case ShardStateNew:
+			// registrations persisted before their initialization started,
+			// e.g. by a transaction; lazy shards wait for their first acquire.
+			if !s.lazy {
+				toRegister = append(toRegister, s)
+			}
 		case ShardStateInitializing:
 			// handle shards that were initializing when we shut down.
 			// if we already have the index for the shard, there's nothing else to do.
@@ -304,20 +1157,120 @@ func (d *DAGStore) Start(ctx context.Context) error {
 		}
 	}
 
-	// spawn the control goroutine.
+	// in read-only mode, interrupted operations are left to the writer node.
+	if d.config.ReadOnly {
+		toRegister, toRecover, toDestroy = nil, nil, nil
+	}
+
+	// backfill the inverted index with available shards missing from it,
+	// e.g. if it was not persisted before.
+	if m, ok := d.TopLevelIndex.(index.ShardMembership); ok {
+		var toBackfill []shard.Key
+		for _, s := range d.shards {
+			if s.state == ShardStateAvailable && !s.skipTopLevel {
+				toBackfill = append(toBackfill, s.key)
+			}
+		}
+		d.wg.Add(1)
+		go d.backfillInverted(m, toBackfill)
+	}
+
+	// load the bloom filter, and cover the shards that may be in the inverted
+	// index with it; they're uncovered until then.
+	if d.blooms.enabled() {
+		var toLoad []shard.Key
+		for _, s := range d.shards {
+			if !s.skipTopLevel {
+				toLoad = append(toLoad, s.key)
+			}
+		}
+		d.blooms.loading(toLoad)
+		d.wg.Add(1)
+		go d.loadBloom()
+	}
+
+	// spawn the control goroutines, and the coordinator that runs GC and
+	// relays pause requests across them.
+	for i := range d.externalCh {
+		d.wg.Add(1)
+		go d.control(i)
+	}
 	d.wg.Add(1)
-	go d.control()
+	go d.coordinate()
+
+	// spawn the sweeper that destroys expired shards.
+	if !d.config.ReadOnly {
+		d.wg.Add(1)
+		go d.sweepExpired()
+	}
+
+	// spawn the renewer of the instance lease, if enabled.
+	if d.config.InstanceLockTTL > 0 && !d.config.ReadOnly {
+		d.wg.Add(1)
+		go d.holdLock()
+	}
+
+	// spawn the watchdog of the event loop, if enabled.
+	if d.config.WatchdogTimeout > 0 {
+		d.wg.Add(1)
+		go d.watch()
+	}
+
+	// spawn the writers of trace sinks.
+	for _, sink := range d.traceSinks {
+		d.wg.Add(1)
+		go d.traceWriter(sink)
+	}
+	if d.traceChSink != nil {
+		d.wg.Add(1)
+		go d.traceWriter(d.traceChSink)
+	}
 
-	// spawn the dispatcher goroutine for responses, responsible for pumping
+	// spawn the worker that moves transients across tiers, if enabled.
+	if d.tierQueue != nil {
+		d.wg.Add(1)
+		go d.tierWorker()
+	}
+
+	// spawn the prober that checks the health of mounts, if enabled.
+	if d.config.MountHealthCheckInterval > 0 {
+		d.wg.Add(1)
+		go d.probeMounts()
+	}
+
+	// spawn the workers that initialize lazy shards, if throttled.
+	if d.lazyInits != nil {
+		for i := 0; i < d.config.MaxConcurrentLazyInit; i++ {
+			d.wg.Add(1)
+			go d.lazyInitWorker()
+		}
+	}
+
+	// spawn the dispatcher goroutines for responses, responsible for pumping
 	// async results back to the caller.
-	d.wg.Add(1)
-	go d.dispatcher(d.dispatchResultsCh)
+	for i := 0; i < d.config.DispatchWorkers; i++ {
+		d.wg.Add(1)
+		go d.dispatcher(d.dispatchResultsCh)
+	}
 
 	// application has provided a failure channel; spawn the dispatcher.
-	if d.failureCh != nil {
-		d.dispatchFailuresCh = make(chan *dispatch, 128) // len=128, same as externalCh.
+	if d.failures != nil {
 		d.wg.Add(1)
-		go d.dispatcher(d.dispatchFailuresCh)
+		go d.failureDispatcher()
+	}
+
+	// likewise for the destroy channel.
+	if d.destroys != nil {
+		d.wg.Add(1)
+		go d.destroyDispatcher()
+	}
+
+	// spawn the schedulers of the enabled maintenance jobs.
+	for _, j := range d.jobs {
+		if j.cfg.Enabled {
+			d.wg.Add(1)
+			go d.scheduleJob(j)
+		}
 	}
 
 	// release the queued registrations before we return.
@@ -330,6 +1283,11 @@ func (d *DAGStore) Start(ctx context.Context) error {
 		_ = d.queueTask(&task{op: OpShardRecover, shard: s, waiter: &waiter{ctx: ctx}}, d.externalCh)
 	}
 
+	// finish destroying tombstoned shards before we return.
+	for _, s := range toDestroy {
+		_ = d.queueTask(&task{op: OpShardDestroyFinalize, shard: s}, d.externalCh)
+	}
+
 	return nil
 }
 
@@ -348,13 +1306,16 @@ func (d *DAGStore) GetIterableIndex(key shard.Key) (carindex.IterableIndex, erro
 }
 
 func (d *DAGStore) ShardsContainingMultihash(ctx context.Context, h mh.Multihash) ([]shard.Key, error) {
+	if d.blooms.miss(h) {
+		return nil, bloomMissError(h)
+	}
 	return d.TopLevelIndex.GetShardsForMultihash(ctx, h)
 }
 
 type RegisterOpts struct {
 	// ExistingTransient can be supplied when registering a shard to indicate
 	// that there's already an existing local transient copy that can be used
-	// for indexing.
+	// for indexing. It must be an uncompressed CAR file.
 	ExistingTransient string
 
 	// LazyInitialization defers shard indexing to the first access instead of
@@ -365,48 +1326,195 @@ type RegisterOpts struct {
 	// has acknowledged the inclusion of the shard, without waiting for any
 	// indexing to happen.
 	LazyInitialization bool
+
+	// Checksum, if non-nil, is the expected multihash of the shard's CAR.
+	// Transients are verified against it after being fetched, and the shard
+	// fails with ErrChecksumMismatch if they don't match. It overrides the
+	// checksum reported by the mount's Stat, if any.
+	Checksum mh.Multihash
+
+	// TTL, if positive, is the lifetime of the shard, after which it's
+	// destroyed by the expiry sweeper (see Config.ExpirySweepInterval). It
+	// suits shards with natural lifetimes, such as deal-backed shards.
+	TTL time.Duration
+
+	// Compression overrides Config.CompressTransients for the transients of
+	// this shard.
+	Compression TransientCompression
+
+	// DetachedIndex, if non-nil, is a pre-computed CARv2 index of the shard's
+	// CAR, serialized with its codec as written by go-car's index.WriteTo
+	// (e.g. a detached index produced by `car index`). Initialization uses it
+	// instead of generating an index, once it's validated against the CAR.
+	// The index isn't persisted: if the DAG store restarts before the shard
+	// is initialized, or the shard is recovered, the index is generated.
+	DetachedIndex []byte
+
+	// DetachedIndexPath is like DetachedIndex, reading the index from the
+	// file at the given path during registration.
+	DetachedIndexPath string
+
+	// SkipTopLevelIndex keeps the multihashes of the shard out of the
+	// top-level index, so that the shard isn't discoverable by multihash
+	// (e.g. for shards of private deals). The flag is persisted, and respected
+	// when the shard is re-initialized or recovered.
+	SkipTopLevelIndex bool
+
+	// Labels are arbitrary key-value pairs attached to the shard, e.g. to
+	// record the deal it belongs to. They're opaque to the DAG store.
+	Labels map[string]string
 }
 
+// TransientCompression specifies whether the transients of a shard are
+// stored compressed.
+type TransientCompression int
+
+const (
+	// TransientCompressionDefault follows Config.CompressTransients.
+	TransientCompressionDefault TransientCompression = iota
+	// TransientCompressionEnabled stores transients compressed.
+	TransientCompressionEnabled
+	// TransientCompressionDisabled stores transients uncompressed.
+	TransientCompressionDisabled
+)
+
 // RegisterShard initiates the registration of a new shard.
 //
 // This method returns an error synchronously if preliminary validation fails.
 // Otherwise, it queues the shard for registration. The caller should monitor
 // supplied channel for a result.
+//
+// Registering a key that's already registered fails with ErrShardExists, or
+// with a *ShardConflictError if the existing shard has a different mount URL.
+// Keys that fail shard.Key.Validate are rejected with shard.ErrInvalidKey.
+// Keys reserved by a ShardWriter are rejected with a *ShardConflictError.
 func (d *DAGStore) RegisterShard(ctx context.Context, key shard.Key, mnt mount.Mount, out chan ShardResult, opts RegisterOpts) error {
+	return d.registerShard(ctx, key, mnt, out, opts, nil)
+}
+
+// registerShard implements RegisterShard. written is the index of a shard
+// committed by the ShardWriter holding the reservation of the key, which is
+// then exempt from it; the index is added by the initialization of the shard,
+// once registered. It's nil for any other registration.
+func (d *DAGStore) registerShard(ctx context.Context, key shard.Key, mnt mount.Mount, out chan ShardResult, opts RegisterOpts, written carindex.IterableIndex) (err error) {
+	if err := key.Validate(); err != nil {
+		return fmt.Errorf("%s: %w", key.String(), err)
+	}
+	if err := d.checkWritable(key); err != nil {
+		return err
+	}
+
+	admitted, err := d.admit(ctx, key, OpShardRegister)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil && admitted {
+			d.releaseAdmission(OpShardRegister)
+		}
+	}()
+
 	d.lk.Lock()
-	if _, ok := d.shards[key]; ok {
+	if d.paused {
+		d.lk.Unlock()
+		return fmt.Errorf("%s: %w", key.String(), ErrPaused)
+	}
+	if s, ok := d.shards[key]; ok {
+		d.lk.Unlock()
+		return d.shardExistsError(s, mnt)
+	}
+	if _, ok := d.txnKeys[key]; ok {
 		d.lk.Unlock()
 		return fmt.Errorf("%s: %w", key.String(), ErrShardExists)
 	}
+	if _, ok := d.sweeping[key]; ok {
+		d.lk.Unlock()
+		return fmt.Errorf("%s: %w", key.String(), ErrIndexSweeping)
+	}
+	if path, ok := d.writing[key]; ok && written == nil {
+		d.lk.Unlock()
+		return d.writingConflictError(key, path, mnt)
+	}
+	if err := d.checkShardQuota(key, 0); err != nil {
+		d.lk.Unlock()
+		return err
+	}
 
-	// wrap the original mount in an upgrader.
-	upgraded, err := mount.Upgrade(mnt, d.throttleReaadyFetch, d.config.TransientsDir, key.String(), opts.ExistingTransient)
+	s, err := d.newShard(key, mnt, opts)
 	if err != nil {
 		d.lk.Unlock()
 		return err
 	}
+	if written != nil {
+		s.detachedIndex = written
+	}
 
 	w := &waiter{outCh: out, ctx: ctx}
 
 	// add the shard to the shard catalogue, and drop the lock.
-	s := &Shard{
-		d:     d,
-		key:   key,
-		state: ShardStateNew,
-		mount: upgraded,
-		lazy:  opts.LazyInitialization,
-	}
-	d.shards[key] = s
+	d.addShard(s)
 	d.lk.Unlock()
 
-	tsk := &task{op: OpShardRegister, shard: s, waiter: w}
+	tsk := &task{op: OpShardRegister, shard: s, waiter: w, admitted: admitted}
 	return d.queueTask(tsk, d.externalCh)
 }
 
+// newShard creates a new shard, wrapping its mount with the middlewares of its
+// scheme, and in an upgrader.
+func (d *DAGStore) newShard(key shard.Key, mnt mount.Mount, opts RegisterOpts) (*Shard, error) {
+	detached, err := loadDetachedIndex(opts)
+	if err != nil {
+		return nil, err
+	}
+	compress := d.config.CompressTransients
+	switch opts.Compression {
+	case TransientCompressionEnabled:
+		compress = true
+	case TransientCompressionDisabled:
+		compress = false
+	}
+	// existing transients provided by the user are plain CAR files.
+	upgraded, err := d.upgrade(d.mounts.Apply(mnt), key, opts.ExistingTransient, compress, false)
+	if err != nil {
+		return nil, err
+	}
+	upgraded.SetChecksum(opts.Checksum)
+
+	s := &Shard{
+		d:             d,
+		key:           key,
+		state:         ShardStateNew,
+		mount:         upgraded,
+		lazy:          opts.LazyInitialization,
+		registeredAt:  time.Now(),
+		skipTopLevel:  opts.SkipTopLevelIndex,
+		regOpts:       registrationOpts(opts),
+		detachedIndex: detached,
+	}
+	if opts.TTL > 0 {
+		s.expiresAt = s.registeredAt.Add(opts.TTL)
+	}
+	return s, nil
+}
+
 type DestroyOpts struct {
+	// DrainTimeout, if positive, makes the destroy of a shard with active
+	// references wait for them to be released for up to this duration. The
+	// shard is tombstoned in the meantime, rejecting new acquires, and is
+	// destroyed once its references drain or the timeout expires, whichever
+	// comes first. Otherwise, destroying a shard with active references fails.
+	DrainTimeout time.Duration
 }
 
-func (d *DAGStore) DestroyShard(ctx context.Context, key shard.Key, out chan ShardResult, _ DestroyOpts) error {
+// DestroyShard destroys a shard, deleting its transient and its index. The
+// destroy is two-phase: the shard is first tombstoned, and then destroyed once
+// it has no active references (see DestroyOpts.DrainTimeout). Tombstones are
+// persisted, so that a destroy interrupted by a restart is resumed on start.
+func (d *DAGStore) DestroyShard(ctx context.Context, key shard.Key, out chan ShardResult, opts DestroyOpts) error {
+	if err := d.checkWritable(key); err != nil {
+		return err
+	}
+
 	d.lk.Lock()
 	s, ok := d.shards[key]
 	if !ok {
@@ -415,11 +1523,53 @@ func (d *DAGStore) DestroyShard(ctx context.Context, key shard.Key, out chan Sha
 	}
 	d.lk.Unlock()
 
-	tsk := &task{op: OpShardDestroy, shard: s, waiter: &waiter{ctx: ctx, outCh: out}}
-	return d.queueTask(tsk, d.externalCh)
+	admitted, err := d.admit(ctx, key, OpShardDestroy)
+	if err != nil {
+		return err
+	}
+	tsk := &task{op: OpShardDestroy, shard: s, waiter: &waiter{ctx: ctx, outCh: out, destroyOpts: opts}, admitted: admitted}
+	return d.queueAdmitted(tsk)
 }
 
 type AcquireOpts struct {
+	// ByteRange, if non-nil, restricts the accessor to the blocks whose
+	// sections start within the given byte range of the CAR data payload.
+	// Offsets are relative to the start of the CARv1 payload, as recorded in
+	// the shard index.
+	ByteRange *ByteRange
+
+	// CIDs, if non-empty, restricts the accessor to the given blocks. All of
+	// them must be present in the shard index, or the acquire will fail with
+	// ErrBlockNotInShard.
+	//
+	// If both ByteRange and CIDs are set, the accessor is restricted to the
+	// blocks that satisfy both.
+	CIDs []cid.Cid
+
+	// Lease, if positive, is the time the accessor may be held for. If it's
+	// not closed within the lease, or the lease isn't renewed through
+	// ShardAccessor.Extend, the shard is force-released and the accessor is
+	// invalidated, so that leaked accessors don't pin the shard forever.
+	Lease time.Duration
+
+	// OnBlockAccess, if non-nil, is called whenever a block is read through
+	// the blockstores of the accessor, e.g. to implement retrieval billing or
+	// analytics of hot content. It's called synchronously, so it must be
+	// fast.
+	OnBlockAccess BlockAccessFunc
+
+	// Caller, if non-empty, identifies the party the shard is acquired on
+	// behalf of, e.g. a peer ID, a deal ID or the name of an API token, so
+	// that operators can attribute load to retrieval clients. It's recorded
+	// in the OpShardAcquire trace, and the acquire and the bytes served are
+	// accounted to the caller in ShardInfo.Callers.
+	Caller string
+}
+
+// ByteRange is a range of bytes starting at Offset, spanning Length bytes.
+type ByteRange struct {
+	Offset uint64
+	Length uint64
 }
 
 // AcquireShard acquires access to the specified shard, and returns a
@@ -432,7 +1582,7 @@ type AcquireOpts struct {
 // This method returns an error synchronously if preliminary validation fails.
 // Otherwise, it queues the shard for acquisition. The caller should monitor
 // supplied channel for a result.
-func (d *DAGStore) AcquireShard(ctx context.Context, key shard.Key, out chan ShardResult, _ AcquireOpts) error {
+func (d *DAGStore) AcquireShard(ctx context.Context, key shard.Key, out chan ShardResult, opts AcquireOpts) error {
 	d.lk.Lock()
 	s, ok := d.shards[key]
 	if !ok {
@@ -441,8 +1591,16 @@ func (d *DAGStore) AcquireShard(ctx context.Context, key shard.Key, out chan Sha
 	}
 	d.lk.Unlock()
 
-	tsk := &task{op: OpShardAcquire, shard: s, waiter: &waiter{ctx: ctx, outCh: out}}
-	return d.queueTask(tsk, d.externalCh)
+	w := &waiter{ctx: ctx, outCh: out, acquireOpts: opts}
+	if d.config.RefcountAccounting {
+		w.provenance = callerProvenance()
+	}
+	admitted, err := d.admit(ctx, key, OpShardAcquire)
+	if err != nil {
+		return err
+	}
+	tsk := &task{op: OpShardAcquire, shard: s, waiter: w, admitted: admitted}
+	return d.queueAdmitted(tsk)
 }
 
 type RecoverOpts struct {
@@ -462,6 +1620,10 @@ type RecoverOpts struct {
 // TODO add an operation identifier to ShardResult -- starts to look like
 //  a Trace event?
 func (d *DAGStore) RecoverShard(ctx context.Context, key shard.Key, out chan ShardResult, _ RecoverOpts) error {
+	if err := d.checkWritable(key); err != nil {
+		return err
+	}
+
 	d.lk.Lock()
 	s, ok := d.shards[key]
 	if !ok {
@@ -470,20 +1632,83 @@ func (d *DAGStore) RecoverShard(ctx context.Context, key shard.Key, out chan Sha
 	}
 	d.lk.Unlock()
 
-	tsk := &task{op: OpShardRecover, shard: s, waiter: &waiter{ctx: ctx, outCh: out}}
-	return d.queueTask(tsk, d.externalCh)
+	admitted, err := d.admit(ctx, key, OpShardRecover)
+	if err != nil {
+		return err
+	}
+	tsk := &task{op: OpShardRecover, shard: s, waiter: &waiter{ctx: ctx, outCh: out}, admitted: admitted}
+	return d.queueAdmitted(tsk)
 }
 
+// Trace is a notification of a shard operation processed by the event loop.
+//
+// Seq and ShardSeq allow consumers to order traces and to detect gaps (e.g.
+// dropped traces when relaying them over buffered or networked channels).
+// Both start at 1 and are reset when the DAG store is restarted.
 type Trace struct {
 	Key   shard.Key
 	Op    OpType
 	After ShardInfo
+
+	// Seq is a sequence number, monotonically increasing across all traces
+	// emitted by this DAG store.
+	Seq uint64
+	// ShardSeq is a sequence number, monotonically increasing across all
+	// traces emitted for this shard.
+	ShardSeq uint64
+
+	// Progress is the progress of the fetch of the shard's transient, set on
+	// OpShardFetchProgress traces only.
+	Progress *FetchProgress
+
+	// Caller is the caller of the acquire, set on OpShardAcquire traces of
+	// acquires that carry one (see AcquireOpts.Caller).
+	Caller string
 }
 
 type ShardInfo struct {
 	ShardState
 	Error error
 	refs  uint32
+
+	// Tier is the tier of the shard's transient.
+	Tier TransientTier
+
+	// RegisteredAt is the time when the shard was registered. It's zero for
+	// shards registered by versions that didn't record it.
+	RegisteredAt time.Time
+	// ExpiresAt is the time after which the shard will be destroyed, or zero
+	// if it doesn't expire.
+	ExpiresAt time.Time
+
+	// InitQueuePosition is the 1-based position of the shard in the lazy
+	// initialization queue, or 0 if it's not queued.
+	InitQueuePosition int
+
+	// AcquireCount is the number of times the shard was acquired.
+	AcquireCount uint64
+	// LastAcquiredAt is the time when the shard was last acquired, or zero if
+	// it was never acquired.
+	LastAcquiredAt time.Time
+	// BytesServed is the number of block bytes read through the blockstores
+	// of the shard's accessors.
+	BytesServed uint64
+
+	// Failures are the most recent failures of the shard, oldest first, up to
+	// Config.ErrorHistorySize. They're kept across recoveries.
+	Failures []ShardFailure
+
+	// Callers are the statistics of the callers that acquired the shard (see
+	// AcquireOpts.Caller), up to Config.MaxCallersPerShard. They're not
+	// persisted, so they're reset when the DAG store is restarted.
+	Callers map[string]CallerStats
+
+	// RegisterOpts are the options the shard was registered with, which are
+	// persisted, so that callers can tell how a shard was registered after a
+	// restart. DetachedIndex is always nil, as the index isn't persisted. For
+	// shards registered by versions that didn't persist them, only
+	// LazyInitialization, SkipTopLevelIndex and TTL are known.
+	RegisterOpts RegisterOpts
 }
 
 // GetShardInfo returns the current state of shard with key k.
@@ -498,11 +1723,37 @@ func (d *DAGStore) GetShardInfo(k shard.Key) (ShardInfo, error) {
 	}
 
 	s.lk.RLock()
-	info := ShardInfo{ShardState: s.state, Error: s.err, refs: s.refs}
+	info := d.shardInfo(s)
 	s.lk.RUnlock()
 	return info, nil
 }
 
+// shardInfo returns the current state of a shard. It must be called with the
+// shard lock held.
+func (d *DAGStore) shardInfo(s *Shard) ShardInfo {
+	info := ShardInfo{
+		ShardState:   s.state,
+		Error:        s.err,
+		Tier:         d.transientTier(s),
+		refs:         s.refs,
+		RegisteredAt: s.registeredAt,
+		ExpiresAt:    s.expiresAt,
+
+		AcquireCount:   s.acquireCount,
+		LastAcquiredAt: s.lastAcquiredAt,
+		BytesServed:    atomic.LoadUint64(&s.bytesServed),
+		Callers:        s.callers.snapshot(),
+		RegisterOpts:   registrationOpts(s.regOpts),
+	}
+	if len(s.failures) > 0 {
+		info.Failures = append([]ShardFailure(nil), s.failures...)
+	}
+	if d.lazyInits != nil {
+		info.InitQueuePosition = d.lazyInits.position(s)
+	}
+	return info
+}
+
 type AllShardsInfo map[shard.Key]ShardInfo
 
 // AllShardsInfo returns the current state of all registered shards, as well as
@@ -514,27 +1765,59 @@ func (d *DAGStore) AllShardsInfo() AllShardsInfo {
 	ret := make(AllShardsInfo, len(d.shards))
 	for k, s := range d.shards {
 		s.lk.RLock()
-		info := ShardInfo{ShardState: s.state, Error: s.err, refs: s.refs}
+		info := d.shardInfo(s)
 		s.lk.RUnlock()
 		ret[k] = info
 	}
 	return ret
 }
 
+// BlockCacheStats returns statistics about the block cache, or zero values if
+// the block cache is disabled.
+func (d *DAGStore) BlockCacheStats() blockcache.Stats {
+	if d.blockCache == nil {
+		return blockcache.Stats{}
+	}
+	return d.blockCache.Stats()
+}
+
+// IndexCacheStats returns statistics about the index cache, or zero values if
+// the index cache is disabled.
+func (d *DAGStore) IndexCacheStats() index.CacheStats {
+	c, ok := d.indices.(*index.CachedIndexRepo)
+	if !ok {
+		return index.CacheStats{}
+	}
+	return c.CacheStats()
+}
+
 // GC performs DAG store garbage collection by reclaiming transient files of
 // shards that are currently available but inactive, or errored.
 //
 // GC runs with exclusivity from the event loop.
 func (d *DAGStore) GC(ctx context.Context) (*GCResult, error) {
-	ch := make(chan *GCResult)
+	return d.requestGC(ctx, &gcRequest{})
+}
+
+// GCDryRun reports which transients GC would reclaim, the reasons why other
+// transients would be kept, and the bytes that would be freed, without
+// deleting anything.
+//
+// Like GC, it runs with exclusivity from the event loop.
+func (d *DAGStore) GCDryRun(ctx context.Context) (*GCResult, error) {
+	return d.requestGC(ctx, &gcRequest{dryRun: true})
+}
+
+func (d *DAGStore) requestGC(ctx context.Context, req *gcRequest) (*GCResult, error) {
+	req.resCh = make(chan *GCResult)
 	select {
-	case d.gcCh <- ch:
+	case d.gcCh <- req:
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	}
 
 	select {
-	case res := <-ch:
+	case res := <-req.resCh:
 		return res, nil
 	case <-ctx.Done():
 		return nil, ctx.Err()
@@ -545,38 +1828,60 @@ func (d *DAGStore) Close() error {
 	d.cancelFn()
 	d.wg.Wait()
 	_ = d.store.Sync(context.TODO(), ds.Key{})
+	d.persistBloom()
+	if d.recentTraces != nil && d.config.PersistRecentTraces && !d.config.ReadOnly {
+		if err := d.persistRecentTraces(context.TODO()); err != nil {
+			log.Warnf("failed to persist recent traces: %s", err)
+		}
+	}
+	if d.config.InstanceLockTTL > 0 && !d.config.ReadOnly {
+		d.releaseLock()
+	}
 	return nil
 }
 
-func (d *DAGStore) queueTask(tsk *task, ch chan<- *task) error {
+// queueTask queues a task on the channel of the worker that owns its shard.
+func (d *DAGStore) queueTask(tsk *task, chs []chan *task) error {
+	ch := chs[0]
+	if len(chs) > 1 {
+		ch = chs[loopOf(tsk.shard.key, len(chs))]
+	}
+	// account for the task before sending it, so that it's never dequeued
+	// before being accounted.
+	d.opQueued(tsk.shard.key, tsk.op)
 	select {
 	case <-d.ctx.Done():
+		d.opDequeued(tsk.shard.key, tsk.op)
 		return fmt.Errorf("dag store closed")
 	case ch <- tsk:
 		return nil
 	}
 }
 
-func (d *DAGStore) restoreState() error {
-	results, err := d.store.Query(d.ctx, query.Query{})
+// upgrade wraps a mount in an upgrader for the shard with the given key.
+func (d *DAGStore) upgrade(mnt mount.Mount, key shard.Key, initial string, compress, initialCompressed bool) (*mount.Upgrader, error) {
+	rootdir := d.config.TransientsLayout.Dir(d.config.TransientsDir, key)
+	upgraded, err := mount.UpgradeWithOpts(mnt, d.throttleReaadyFetch, rootdir, key.String(), initial, mount.UpgradeOpts{
+		Shared:                d.sharedTransients,
+		MaxPassthroughLatency: d.config.MaxPassthroughLatency,
+		DirectIO:              directIOOptions(d.config),
+		Compress:              compress,
+		InitialCompressed:     initialCompressed,
+	})
 	if err != nil {
-		return fmt.Errorf("failed to recover dagstore state from store: %w", err)
+		return nil, err
 	}
-	for {
-		res, ok := results.NextSync()
-		if !ok {
-			return nil
-		}
-		s := &Shard{d: d}
-		if err := s.UnmarshalJSON(res.Value); err != nil {
-			log.Warnf("failed to recover state of shard %s: %s; skipping", shard.KeyFromString(res.Key), err)
-			continue
-		}
+	upgraded.SetProgress(d.fetchProgress(key))
+	return upgraded, nil
+}
 
-		log.Debugw("restored shard state on dagstore startup", "shard", s.key, "shard state", s.state, "shard error", s.err,
-			"shard lazy", s.lazy)
-		d.shards[s.key] = s
+// directIOOptions returns the options of direct IO writes, or nil if
+// Config.DirectIO isn't set.
+func directIOOptions(cfg Config) *directio.Options {
+	if !cfg.DirectIO {
+		return nil
 	}
+	return &directio.Options{SyncInterval: cfg.DirectIOSyncInterval}
 }
 
 // ensureDir checks whether the specified path is a directory, and if not it
@@ -597,7 +1902,7 @@ func ensureDir(path string) error {
 // failShard queues a shard failure (does not fail it immediately). It is
 // suitable for usage both outside and inside the event loop, depending on the
 // channel passed.
-func (d *DAGStore) failShard(s *Shard, ch chan *task, format string, args ...interface{}) error {
-	err := fmt.Errorf(format, args...)
+func (d *DAGStore) failShard(s *Shard, ch []chan *task, format string, args ...interface{}) error {
+	err := d.redact(fmt.Errorf(format, args...))
 	return d.queueTask(&task{op: OpShardFail, shard: s, err: err}, ch)
 }
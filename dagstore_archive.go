@@ -0,0 +1,294 @@
+package dagstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	carindex "github.com/ipld/go-car/v2/index"
+
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// Archive is cold storage that shards are archived to (see
+// DAGStore.ArchiveShard), such as an object store bucket with an archival
+// storage class. Objects are named after the keys of their shards.
+type Archive interface {
+	// Put stores the object with the given name, replacing it if it exists,
+	// with the data read from r.
+	Put(ctx context.Context, name string, r io.Reader) error
+
+	// Get returns a reader of the object with the given name.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+}
+
+// DirArchive is an Archive that stores objects as files in a directory, e.g.
+// on a volume backed by cold storage.
+type DirArchive struct {
+	Dir string
+}
+
+var _ Archive = (*DirArchive)(nil)
+
+func (a *DirArchive) Put(_ context.Context, name string, r io.Reader) error {
+	if err := os.MkdirAll(a.Dir, 0755); err != nil {
+		return err
+	}
+	// write into a temporary file first, so that a failed put never leaves a
+	// truncated object behind.
+	f, err := os.CreateTemp(a.Dir, ".put-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), a.path(name))
+}
+
+func (a *DirArchive) Get(_ context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(a.path(name))
+}
+
+func (a *DirArchive) path(name string) string {
+	return filepath.Join(a.Dir, url.PathEscape(name))
+}
+
+// archiveCAR and archiveIndex return the names of the objects holding the
+// data and the index of a shard in the archive.
+func archiveCAR(key shard.Key) string   { return key.String() + ".car" }
+func archiveIndex(key shard.Key) string { return key.String() + ".idx" }
+
+// ArchiveShard uploads the data and the index of an available shard to
+// Config.Archive, and transitions it to ShardStateArchived, deleting its
+// transient and index. Archived shards can't be acquired until they're
+// restored with UnarchiveShard.
+//
+// The data is uploaded while the shard remains available, but the archive
+// fails if the shard is being served by the time the upload completes.
+// Archived objects outlive the shard: they're left in place when the shard
+// is unarchived or destroyed.
+func (d *DAGStore) ArchiveShard(ctx context.Context, key shard.Key) error {
+	s, err := d.archivableShard(key)
+	if err != nil {
+		return err
+	}
+
+	s.lk.RLock()
+	state := s.state
+	s.lk.RUnlock()
+	if state != ShardStateAvailable && state != ShardStateServing {
+		return fmt.Errorf("refused to archive shard in state other than available; current state: %s", state)
+	}
+
+	// upload the data.
+	rd, err := s.mount.Fetch(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch shard data: %w", d.redact(err))
+	}
+	err = d.config.Archive.Put(ctx, archiveCAR(key), rd)
+	_ = rd.Close()
+	if err != nil {
+		return fmt.Errorf("failed to archive shard data: %w", err)
+	}
+
+	// upload the index.
+	idx, err := d.indices.GetFullIndex(key)
+	if err != nil {
+		return fmt.Errorf("failed to get shard index: %w", err)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := carindex.WriteTo(idx, pw)
+		_ = pw.CloseWithError(err)
+	}()
+	err = d.config.Archive.Put(ctx, archiveIndex(key), pr)
+	_ = pr.Close()
+	if err != nil {
+		return fmt.Errorf("failed to archive shard index: %w", err)
+	}
+
+	log.Infow("archived shard; transitioning", "shard", key)
+	return d.queueAndWait(ctx, &task{op: OpShardArchive, shard: s})
+}
+
+// UnarchiveShard restores an archived shard from Config.Archive, making it
+// available again. Its index is restored from the archive, and so is its
+// transient, unless its mount is fully capable and doesn't need one.
+func (d *DAGStore) UnarchiveShard(ctx context.Context, key shard.Key) error {
+	s, err := d.archivableShard(key)
+	if err != nil {
+		return err
+	}
+
+	s.lk.RLock()
+	state := s.state
+	s.lk.RUnlock()
+	if state != ShardStateArchived {
+		return fmt.Errorf("refused to unarchive shard in state other than archived; current state: %s", state)
+	}
+
+	// restore the index.
+	rc, err := d.config.Archive.Get(ctx, archiveIndex(key))
+	if err != nil {
+		return fmt.Errorf("failed to get archived shard index: %w", err)
+	}
+	idx, err := carindex.ReadFrom(rc)
+	_ = rc.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read archived shard index: %w", err)
+	}
+	r := &archiveRestore{idx: idx}
+
+	// stage the restore of the transient; it's committed by the event loop,
+	// along with the index.
+	if !s.mount.Passthrough() {
+		rc, err := d.config.Archive.Get(ctx, archiveCAR(key))
+		if err != nil {
+			return fmt.Errorf("failed to get archived shard data: %w", err)
+		}
+		r.transient, err = s.mount.StageRestoreTransient(rc)
+		_ = rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Infow("restored archived shard; transitioning", "shard", key)
+	out := make(chan ShardResult, 1)
+	tsk := &task{op: OpShardUnarchive, shard: s, restore: r, waiter: &waiter{ctx: ctx, outCh: out}}
+	if err := d.queueTask(tsk, d.externalCh); err != nil {
+		r.abort()
+		return err
+	}
+	select {
+	case res := <-out:
+		return res.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// archiveRestore holds what UnarchiveShard restored from the archive, for the
+// event loop to put in place.
+type archiveRestore struct {
+	idx carindex.Index
+	// transient is the staged restore of the transient; nil if the mount
+	// doesn't need one.
+	transient *mount.TransientRestore
+}
+
+// abort discards the staged transient, if any.
+func (r *archiveRestore) abort() {
+	if r.transient != nil {
+		r.transient.Abort()
+	}
+}
+
+// archivableShard returns the shard with the given key, if the DAG store can
+// archive shards.
+func (d *DAGStore) archivableShard(key shard.Key) (*Shard, error) {
+	if err := d.checkWritable(key); err != nil {
+		return nil, err
+	}
+	if d.config.Archive == nil {
+		return nil, ErrNoArchive
+	}
+	d.lk.RLock()
+	s, ok := d.shards[key]
+	d.lk.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", key.String(), ErrShardUnknown)
+	}
+	return s, nil
+}
+
+// queueAndWait queues an external task, and waits for its result.
+func (d *DAGStore) queueAndWait(ctx context.Context, tsk *task) error {
+	out := make(chan ShardResult, 1)
+	tsk.waiter = &waiter{ctx: ctx, outCh: out}
+	if err := d.queueTask(tsk, d.externalCh); err != nil {
+		return err
+	}
+	select {
+	case res := <-out:
+		return res.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// archiveShard transitions an available shard to ShardStateArchived once its
+// data and index are archived, deleting them. It must be called from the
+// event loop.
+func (d *DAGStore) archiveShard(s *Shard, w *waiter) {
+	if s.state != ShardStateAvailable {
+		err := fmt.Errorf("refused to archive shard in state other than available; current state: %s", s.state)
+		d.dispatchResult(&ShardResult{Key: s.key, Error: err}, w)
+		return
+	}
+
+	s.state = ShardStateArchived
+	if err := s.mount.DeleteTransient(); err != nil {
+		log.Warnw("archive: failed to delete transient", "shard", s.key, "error", err)
+	}
+	// archived shards are no longer discoverable.
+	d.removeFromInverted(s)
+	d.dropBloom(s.key)
+	if _, err := d.indices.DropFullIndex(s.key); err != nil {
+		log.Warnw("archive: failed to drop index for shard", "shard", s.key, "error", err)
+	}
+	atomic.StoreUint64(&s.indexedBlocks, 0)
+	d.dispatchResult(&ShardResult{Key: s.key}, w)
+}
+
+// unarchiveShard transitions an archived shard back to ShardStateAvailable,
+// putting the index and transient restored from the archive in place. If
+// either fails, the shard is left archived as it was. It must be called from
+// the event loop.
+func (d *DAGStore) unarchiveShard(s *Shard, w *waiter, r *archiveRestore) {
+	fail := func(err error) {
+		r.abort()
+		d.dispatchResult(&ShardResult{Key: s.key, Error: err}, w)
+	}
+
+	if s.state != ShardStateArchived {
+		fail(fmt.Errorf("refused to unarchive shard in state other than archived; current state: %s", s.state))
+		return
+	}
+	if err := d.indices.AddFullIndex(s.key, r.idx); err != nil {
+		fail(fmt.Errorf("failed to restore shard index: %w", err))
+		return
+	}
+	if r.transient != nil {
+		if err := r.transient.Commit(); err != nil {
+			if _, derr := d.indices.DropFullIndex(s.key); derr != nil {
+				log.Warnw("unarchive: failed to roll back index for shard", "shard", s.key, "error", derr)
+			}
+			fail(fmt.Errorf("failed to restore shard transient: %w", err))
+			return
+		}
+	}
+	atomic.StoreUint64(&s.indexedBlocks, countIndexed(r.idx))
+
+	// make the shard discoverable again.
+	if iterableIdx, ok := r.idx.(carindex.IterableIndex); ok && !s.skipTopLevel {
+		if err := d.addToInverted(d.ctx, s.key, iterableIdx); err != nil {
+			log.Errorw("unarchive: failed to add shard multihashes to the inverted index", "shard", s.key, "error", err)
+		}
+	}
+
+	s.state = ShardStateAvailable
+	d.dispatchResult(&ShardResult{Key: s.key}, w)
+}
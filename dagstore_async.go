@@ -2,10 +2,11 @@ package dagstore
 
 import (
 	"context"
+	"fmt"
+	"sync/atomic"
 
 	"github.com/filecoin-project/dagstore/index"
 
-	"github.com/ipld/go-car/v2"
 	carindex "github.com/ipld/go-car/v2/index"
 	"github.com/multiformats/go-multihash"
 
@@ -22,13 +23,46 @@ import (
 func (d *DAGStore) acquireAsync(ctx context.Context, w *waiter, s *Shard, mnt mount.Mount) {
 	k := s.key
 
-	reader, err := mnt.Fetch(ctx)
+	// let the event loop dispatch the next acquirer once we're done opening
+	// the shard, successfully or not.
+	if w.slot {
+		defer func() {
+			_ = d.queueTask(&task{op: OpShardAcquireDone, shard: s}, d.completionCh)
+		}()
+	}
+
+	// promote warm transients in the background, so that subsequent acquires
+	// read from the hot tier.
+	d.promoteTransient(s)
+
+	// fail fast or wait if the mount is degraded, as configured.
+	if err := d.checkMountHealth(ctx, s); err != nil {
+		log.Warnw("acquire: mount degraded", "shard", s.key, "error", err)
+
+		// release the shard to decrement the refcount that's incremented before `acquireAsync` is called.
+		_ = d.queueTask(&task{op: OpShardRelease, shard: s, ref: w.refID}, d.completionCh)
+		d.dispatchResult(&ShardResult{Key: k, Error: err}, w)
+		return
+	}
+
+	// refuse to fetch a new transient beyond the quota of the namespace; the
+	// shard itself is healthy.
+	if err := d.checkTransientQuota(ctx, s); err != nil {
+		log.Warnw("acquire: namespace quota exceeded", "shard", s.key, "error", err)
+
+		// release the shard to decrement the refcount that's incremented before `acquireAsync` is called.
+		_ = d.queueTask(&task{op: OpShardRelease, shard: s, ref: w.refID}, d.completionCh)
+		d.dispatchResult(&ShardResult{Key: k, Error: err}, w)
+		return
+	}
+
+	reader, err := d.fetchWithRetry(ctx, s, mnt)
 
 	if err := ctx.Err(); err != nil {
 		log.Warnw("context cancelled while fetching shard; releasing", "shard", s.key, "error", err)
 
 		// release the shard to decrement the refcount that's incremented before `acquireAsync` is called.
-		_ = d.queueTask(&task{op: OpShardRelease, shard: s}, d.completionCh)
+		_ = d.queueTask(&task{op: OpShardRelease, shard: s, ref: w.refID}, d.completionCh)
 
 		// send the shard error to the caller for correctness
 		// since the context is cancelled, the result will be discarded.
@@ -37,10 +71,10 @@ func (d *DAGStore) acquireAsync(ctx context.Context, w *waiter, s *Shard, mnt mo
 	}
 
 	if err != nil {
-		log.Warnw("acquire: failed to fetch from mount upgrader", "shard", s.key, "error", err)
+		log.Warnw("acquire: failed to fetch from mount upgrader", "shard", s.key, "error", d.redact(err))
 
 		// release the shard to decrement the refcount that's incremented before `acquireAsync` is called.
-		_ = d.queueTask(&task{op: OpShardRelease, shard: s}, d.completionCh)
+		_ = d.queueTask(&task{op: OpShardRelease, shard: s, ref: w.refID}, d.completionCh)
 
 		// fail the shard
 		_ = d.failShard(s, d.completionCh, "failed to acquire reader of mount so we can return the accessor: %w", err)
@@ -59,7 +93,7 @@ func (d *DAGStore) acquireAsync(ctx context.Context, w *waiter, s *Shard, mnt mo
 		log.Warnw("context cancelled while indexing shard; releasing", "shard", s.key, "error", err)
 
 		// release the shard to decrement the refcount that's incremented before `acquireAsync` is called.
-		_ = d.queueTask(&task{op: OpShardRelease, shard: s}, d.completionCh)
+		_ = d.queueTask(&task{op: OpShardRelease, shard: s, ref: w.refID}, d.completionCh)
 
 		// send the shard error to the caller for correctness
 		// since the context is cancelled, the result will be discarded.
@@ -68,13 +102,13 @@ func (d *DAGStore) acquireAsync(ctx context.Context, w *waiter, s *Shard, mnt mo
 	}
 
 	if err != nil {
-		log.Warnw("acquire: failed to get index for shard", "shard", s.key, "error", err)
+		log.Warnw("acquire: failed to get index for shard", "shard", s.key, "error", d.redact(err))
 		if err := reader.Close(); err != nil {
 			log.Errorf("failed to close mount reader: %s", err)
 		}
 
 		// release the shard to decrement the refcount that's incremented before `acquireAsync` is called.
-		_ = d.queueTask(&task{op: OpShardRelease, shard: s}, d.completionCh)
+		_ = d.queueTask(&task{op: OpShardRelease, shard: s, ref: w.refID}, d.completionCh)
 
 		// fail the shard
 		_ = d.failShard(s, d.completionCh, "failed to recover index for shard %s: %w", k, err)
@@ -84,10 +118,33 @@ func (d *DAGStore) acquireAsync(ctx context.Context, w *waiter, s *Shard, mnt mo
 		return
 	}
 
+	// restrict the accessor, if requested.
+	restrict, err := newRestriction(idx, w.acquireOpts)
+	if err != nil {
+		log.Warnw("acquire: failed to restrict accessor", "shard", s.key, "error", err)
+		if err := reader.Close(); err != nil {
+			log.Errorf("failed to close mount reader: %s", err)
+		}
+
+		// release the shard to decrement the refcount that's incremented before `acquireAsync` is called.
+		_ = d.queueTask(&task{op: OpShardRelease, shard: s, ref: w.refID}, d.completionCh)
+
+		// send the error to the caller; the shard itself is healthy.
+		d.dispatchResult(&ShardResult{Key: k, Error: err}, w)
+		return
+	}
+
 	log.Debugw("acquire: successful; returning accessor", "shard", s.key)
 
 	// build the accessor.
-	sa, err := NewShardAccessor(reader, idx, s)
+	sa, err := NewShardAccessor(d.watchStale(s, reader), idx, s)
+	sa.restrict = restrict
+	sa.onBlockAccess = w.acquireOpts.OnBlockAccess
+	sa.caller = w.acquireOpts.Caller
+	sa.refID = w.refID
+	if lease := w.acquireOpts.Lease; lease > 0 {
+		sa.startLease(lease)
+	}
 
 	// send the shard accessor to the caller, adding a notifyDead function that
 	// will be called to release the shard if we were unable to deliver
@@ -95,8 +152,9 @@ func (d *DAGStore) acquireAsync(ctx context.Context, w *waiter, s *Shard, mnt mo
 	w.notifyDead = func() {
 		log.Warnw("context cancelled while delivering accessor; releasing", "shard", s.key)
 
-		// release the shard to decrement the refcount that's incremented before `acquireAsync` is called.
-		_ = d.queueTask(&task{op: OpShardRelease, shard: s}, d.completionCh)
+		// release the accessor to decrement the refcount that's incremented
+		// before `acquireAsync` is called, unless its lease already did.
+		_, _ = sa.release(d.completionCh)
 	}
 
 	d.dispatchResult(&ShardResult{Key: k, Accessor: sa, Error: err}, w)
@@ -105,50 +163,89 @@ func (d *DAGStore) acquireAsync(ctx context.Context, w *waiter, s *Shard, mnt mo
 // initializeShard initializes a shard asynchronously by fetching its data and
 // performing indexing.
 func (d *DAGStore) initializeShard(ctx context.Context, s *Shard, mnt mount.Mount) {
+	run := d.startInit(ctx, s)
+	defer d.endInit(s, run)
+	ctx = run.ctx
+
+	// fail with a timeout or cancellation error if the initialization was
+	// interrupted.
+	fail := func(format string, err error) {
+		err = d.redact(fmt.Errorf(format, d.initError(run, err)))
+		_ = d.queueTask(&task{op: OpShardFail, shard: s, err: err, initDone: true}, d.completionCh)
+	}
+
+	if err := d.checkTransientQuota(ctx, s); err != nil {
+		fail("failed to initialize shard: %w", err)
+		return
+	}
+	if err := d.checkMountSize(ctx, mnt); err != nil {
+		fail("failed to initialize shard: %w", err)
+		return
+	}
+
 	reader, err := mnt.Fetch(ctx)
 	if err != nil {
-		log.Warnw("initialize: failed to fetch from mount upgrader", "shard", s.key, "error", err)
+		log.Warnw("initialize: failed to fetch from mount upgrader", "shard", s.key, "error", d.redact(err))
 
-		_ = d.failShard(s, d.completionCh, "failed to acquire reader of mount on initialization: %w", err)
+		fail("failed to acquire reader of mount on initialization: %w", err)
 		return
 	}
 	defer reader.Close()
+	reader = &ctxReader{Reader: reader, ctx: ctx}
 
 	log.Debugw("initialize: successfully fetched from mount upgrader", "shard", s.key)
 
-	// works for both CARv1 and CARv2.
+	if err := d.checkShardLimits(reader); err != nil {
+		fail("failed to initialize shard: %w", err)
+		return
+	}
+
 	var idx carindex.Index
-	err = d.throttleIndex.Do(ctx, func(_ context.Context) error {
-		var err error
-		idx, err = car.ReadOrGenerateIndex(reader, car.ZeroLengthSectionAsEOF(true), car.StoreIdentityCIDs(true))
-		if err == nil {
-			log.Debugw("initialize: finished generating index for shard", "shard", s.key)
-		} else {
-			log.Warnw("initialize: failed to generate index for shard", "shard", s.key, "error", err)
+	if s.detachedIndex != nil {
+		// a detached index was supplied at registration; no need to generate one.
+		if err := validateDetachedIndex(reader, s.detachedIndex); err != nil {
+			log.Warnw("initialize: rejected detached index for shard", "shard", s.key, "error", d.redact(err))
+			fail("failed to validate detached index: %w", err)
+			return
+		}
+		idx = s.detachedIndex
+	} else {
+		// works for both CARv1 and CARv2.
+		err = d.throttleIndex.Do(ctx, func(_ context.Context) error {
+			var err error
+			idx, err = d.generateIndex(reader)
+			if err == nil {
+				log.Debugw("initialize: finished generating index for shard", "shard", s.key)
+			} else {
+				log.Warnw("initialize: failed to generate index for shard", "shard", s.key, "error", d.redact(err))
+			}
+			return err
+		})
+		if err != nil {
+			fail("failed to read/generate CAR Index: %w", err)
+			return
 		}
-		return err
-	})
-	if err != nil {
-		_ = d.failShard(s, d.completionCh, "failed to read/generate CAR Index: %w", err)
-		return
 	}
 	if err := d.indices.AddFullIndex(s.key, idx); err != nil {
-		_ = d.failShard(s, d.completionCh, "failed to add index for shard: %w", err)
+		fail("failed to add index for shard: %w", err)
 		return
 	}
+	atomic.StoreUint64(&s.indexedBlocks, countIndexed(idx))
 
-	// add all cids in the shard to the inverted (cid -> []Shard Keys) index.
+	// add all cids in the shard to the inverted (cid -> []Shard Keys) index,
+	// unless the shard is kept out of it.
 	iterableIdx, ok := idx.(carindex.IterableIndex)
-	if ok {
-		mhIter := &mhIdx{iterableIdx: iterableIdx}
-		if err := d.TopLevelIndex.AddMultihashesForShard(ctx, mhIter, s.key); err != nil {
+	if s.skipTopLevel {
+		log.Debugw("initialize: shard is kept out of the inverted index", "shard", s.key)
+	} else if ok {
+		if err := d.addToInverted(ctx, s.key, iterableIdx); err != nil {
 			log.Errorw("failed to add shard multihashes to the inverted index", "shard", s.key, "error", err)
 		}
 	} else {
 		log.Errorw("shard index is not iterable", "shard", s.key)
 	}
 
-	_ = d.queueTask(&task{op: OpShardMakeAvailable, shard: s}, d.completionCh)
+	_ = d.queueTask(&task{op: OpShardMakeAvailable, shard: s, initDone: true}, d.completionCh)
 }
 
 // Convenience struct for converting from CAR index.IterableIndex to the
@@ -0,0 +1,193 @@
+package dagstore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// BackpressurePolicy is what RegisterShard, AcquireShard, DestroyShard and
+// RecoverShard do when a limit on pending tasks is reached (see
+// Config.MaxPendingTasks and Config.MaxPendingTasksPerOp).
+type BackpressurePolicy int
+
+const (
+	// BackpressureBlock blocks the caller until the task can be admitted, or
+	// the context of the call is done.
+	BackpressureBlock BackpressurePolicy = iota
+	// BackpressureReject fails the call immediately with ErrBackpressure.
+	BackpressureReject
+)
+
+func (p BackpressurePolicy) String() string {
+	return [...]string{
+		"BackpressureBlock",
+		"BackpressureReject"}[p]
+}
+
+// BackpressureStats is the occupancy of the limits on pending tasks.
+type BackpressureStats struct {
+	// Admitted is the number of tasks of each operation admitted through
+	// RegisterShard, AcquireShard, DestroyShard and RecoverShard, that the
+	// event loop hasn't processed yet. It's only tracked when limits are
+	// configured.
+	Admitted map[OpType]int
+	// Waiting is the number of callers blocked waiting for admission.
+	Waiting int
+	// Rejected is the number of calls that failed with ErrBackpressure since
+	// the DAG store started.
+	Rejected uint64
+}
+
+// admission tracks the tasks admitted against the limits on pending tasks.
+type admission struct {
+	lk sync.Mutex
+	// limits, from Config.MaxPendingTasks, Config.MaxPendingTasksPerOp and
+	// Config.Backpressure; they can be changed by Reconfigure.
+	max      int
+	maxPerOp map[OpType]int
+	policy   BackpressurePolicy
+
+	admitted map[OpType]int
+	total    int
+	waiting  int
+	rejected uint64
+	// freed is closed and replaced whenever an admitted task is released, or
+	// the limits change, to wake up blocked callers.
+	freed chan struct{}
+}
+
+// setLimits sets the limits on pending tasks, waking up blocked callers so
+// that they're evaluated against the new limits.
+func (a *admission) setLimits(max int, maxPerOp map[OpType]int, policy BackpressurePolicy) {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+
+	a.max, a.policy = max, policy
+	a.maxPerOp = make(map[OpType]int, len(maxPerOp))
+	for op, n := range maxPerOp {
+		a.maxPerOp[op] = n
+	}
+	a.wake()
+}
+
+// limited returns whether limits on pending tasks are configured. It must be
+// called with the lock held.
+func (a *admission) limited() bool {
+	return a.max > 0 || len(a.maxPerOp) > 0
+}
+
+// admissible returns whether a task of the given operation fits within the
+// limits on pending tasks. It must be called with the lock held.
+func (a *admission) admissible(op OpType) bool {
+	if a.max > 0 && a.total >= a.max {
+		return false
+	}
+	if max := a.maxPerOp[op]; max > 0 && a.admitted[op] >= max {
+		return false
+	}
+	return true
+}
+
+// wake wakes up blocked callers. It must be called with the lock held.
+func (a *admission) wake() {
+	if a.freed != nil {
+		close(a.freed)
+		a.freed = nil
+	}
+}
+
+// admit admits a task of the given operation on the shard with the given key
+// against the limits on pending tasks, blocking or failing with
+// ErrBackpressure according to Config.Backpressure if they're reached. It
+// returns whether the task was accounted, in which case it must be released
+// through releaseAdmission once processed, or if it's not queued.
+func (d *DAGStore) admit(ctx context.Context, key shard.Key, op OpType) (bool, error) {
+	a := &d.admission
+	a.lk.Lock()
+	for a.limited() && !a.admissible(op) {
+		if a.policy == BackpressureReject {
+			a.rejected++
+			a.lk.Unlock()
+			return false, fmt.Errorf("%s: %s: %w", key.String(), op, ErrBackpressure)
+		}
+		if a.freed == nil {
+			a.freed = make(chan struct{})
+		}
+		freed := a.freed
+		a.waiting++
+		a.lk.Unlock()
+
+		var err error
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-d.ctx.Done():
+			err = fmt.Errorf("dag store closed")
+		}
+
+		a.lk.Lock()
+		a.waiting--
+		if err != nil {
+			a.lk.Unlock()
+			return false, fmt.Errorf("%s: waiting for admission of %s: %w", key.String(), op, err)
+		}
+	}
+	if !a.limited() {
+		// tasks are only accounted while limits are configured.
+		a.lk.Unlock()
+		return false, nil
+	}
+	if a.admitted == nil {
+		a.admitted = make(map[OpType]int)
+	}
+	a.admitted[op]++
+	a.total++
+	a.lk.Unlock()
+	return true, nil
+}
+
+// releaseAdmission releases an admitted task of the given operation, waking
+// up blocked callers.
+func (d *DAGStore) releaseAdmission(op OpType) {
+	a := &d.admission
+	a.lk.Lock()
+	defer a.lk.Unlock()
+
+	if a.admitted[op]--; a.admitted[op] <= 0 {
+		delete(a.admitted, op)
+	}
+	a.total--
+	a.wake()
+}
+
+// queueAdmitted queues a task submitted by the application, releasing its
+// admission if it can't be queued.
+func (d *DAGStore) queueAdmitted(tsk *task) error {
+	err := d.queueTask(tsk, d.externalCh)
+	if err != nil && tsk.admitted {
+		d.releaseAdmission(tsk.op)
+	}
+	return err
+}
+
+func (d *DAGStore) backpressureStats() BackpressureStats {
+	a := &d.admission
+	a.lk.Lock()
+	defer a.lk.Unlock()
+
+	ret := BackpressureStats{
+		Waiting:  a.waiting,
+		Rejected: a.rejected,
+	}
+	if len(a.admitted) > 0 {
+		ret.Admitted = make(map[OpType]int, len(a.admitted))
+		for op, n := range a.admitted {
+			ret.Admitted[op] = n
+		}
+	}
+	return ret
+}
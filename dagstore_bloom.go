@@ -0,0 +1,399 @@
+package dagstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	ds "github.com/ipfs/go-datastore"
+	carindex "github.com/ipld/go-car/v2/index"
+	mh "github.com/multiformats/go-multihash"
+
+	"github.com/filecoin-project/dagstore/index"
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// bloomMinCapacity is the minimum number of multihashes the bloom filter is
+// sized for, so that a DAG store starting with few shards doesn't rebuild it
+// as soon as more are added.
+var bloomMinCapacity uint64 = 1 << 16
+
+// bloomHeadroom is the factor by which the bloom filter is oversized relative
+// to the multihashes of the shards when it's rebuilt, so that shards can be
+// added to it before it needs rebuilding again.
+const bloomHeadroom = 2
+
+// blooms holds a bloom filter of the multihashes of the shards in the
+// inverted index. Lookups can only be turned down by the filter if every shard
+// that may be in the inverted index is covered by it.
+type blooms struct {
+	fpRate float64 // from Config.BloomFalsePositiveRate; zero if disabled.
+
+	lk sync.RWMutex
+	// filter holds the multihashes of the covered shards; nil until it's
+	// loaded or built on start. The multihashes of the shards dropped since
+	// they were added are left behind, as false positives, until the filter
+	// is rebuilt.
+	filter  *index.Bloom
+	covered map[shard.Key]struct{}
+	// adding counts the additions of shards to the inverted index in flight.
+	adding map[shard.Key]int
+	// uncovered holds the shards that may be in the inverted index without
+	// being covered by the filter: shards whose addition failed, shards the
+	// filter had no room for, and shards that are being loaded on start.
+	uncovered map[shard.Key]struct{}
+	// rebuilding is set while the filter is being rebuilt.
+	rebuilding bool
+}
+
+func newBlooms(fpRate float64) *blooms {
+	return &blooms{
+		fpRate:    fpRate,
+		covered:   make(map[shard.Key]struct{}),
+		adding:    make(map[shard.Key]int),
+		uncovered: make(map[shard.Key]struct{}),
+	}
+}
+
+func (b *blooms) enabled() bool {
+	return b.fpRate > 0
+}
+
+// miss returns whether no shard in the inverted index contains the given
+// multihash, according to the filter. It returns false if the filter is
+// disabled, or doesn't cover every shard.
+func (b *blooms) miss(h mh.Multihash) bool {
+	if !b.enabled() {
+		return false
+	}
+
+	b.lk.RLock()
+	defer b.lk.RUnlock()
+
+	if b.filter == nil || len(b.adding) > 0 || len(b.uncovered) > 0 {
+		return false
+	}
+	return !b.filter.Has(h)
+}
+
+// startAdd records that the shard with the given key is being added to the
+// inverted index. It must be followed by endAdd.
+func (b *blooms) startAdd(key shard.Key) {
+	b.lk.Lock()
+	b.adding[key]++
+	b.lk.Unlock()
+}
+
+// endAdd records the end of an addition of a shard to the inverted index, and
+// adds its multihashes to the filter, or records it as uncovered if idx is
+// nil because the addition failed. It returns true if the filter has no room
+// left for the shard, and the caller must rebuild it.
+func (b *blooms) endAdd(key shard.Key, idx carindex.IterableIndex) bool {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	if b.adding[key]--; b.adding[key] <= 0 {
+		delete(b.adding, key)
+	}
+	if idx != nil && b.add(key, idx) {
+		return false
+	}
+	// the shard may be partially in the inverted index.
+	delete(b.covered, key)
+	b.uncovered[key] = struct{}{}
+	return idx != nil && b.filter != nil && b.startRebuild()
+}
+
+// cover adds the multihashes of an uncovered shard to the filter, unless it
+// was dropped or is being added in the meantime. It returns true if the filter
+// has no room left for the shard, and the caller must rebuild it.
+func (b *blooms) cover(key shard.Key, idx carindex.IterableIndex) bool {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	// shards uncovered while the filter is loaded on start are covered once
+	// it's loaded.
+	if _, ok := b.uncovered[key]; !ok || b.adding[key] > 0 || b.filter == nil {
+		return false
+	}
+	return !b.add(key, idx) && b.startRebuild()
+}
+
+// add adds the multihashes of a shard to the filter, if it has room for them.
+// It must be called with lk held.
+func (b *blooms) add(key shard.Key, idx carindex.IterableIndex) bool {
+	if b.filter == nil || b.filter.Count()+countIndexed(idx) > b.filter.Capacity() {
+		return false
+	}
+	err := idx.ForEach(func(h mh.Multihash, _ uint64) error {
+		b.filter.Add(h)
+		return nil
+	})
+	if err != nil {
+		return false
+	}
+	b.covered[key] = struct{}{}
+	delete(b.uncovered, key)
+	return true
+}
+
+// startRebuild records that the filter is being rebuilt, and returns false if
+// it already was. It must be called with lk held.
+func (b *blooms) startRebuild() bool {
+	if b.rebuilding {
+		return false
+	}
+	b.rebuilding = true
+	return true
+}
+
+// loading marks the supplied shards as uncovered until they're covered by the
+// filter loaded or built on start.
+func (b *blooms) loading(keys []shard.Key) {
+	b.lk.Lock()
+	for _, k := range keys {
+		b.uncovered[k] = struct{}{}
+	}
+	b.lk.Unlock()
+}
+
+// keys returns the keys of the shards that may be in the inverted index.
+func (b *blooms) keys() []shard.Key {
+	b.lk.RLock()
+	defer b.lk.RUnlock()
+
+	keys := make([]shard.Key, 0, len(b.covered)+len(b.uncovered))
+	for k := range b.covered {
+		keys = append(keys, k)
+	}
+	for k := range b.uncovered {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// install replaces the filter with one loaded or rebuilt on start, holding the
+// multihashes of the supplied shards. Shards added to the previous filter in
+// the meantime become uncovered. It returns the uncovered shards that are
+// not being added, which the caller must cover.
+func (b *blooms) install(f *index.Bloom, keys []shard.Key) []shard.Key {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	for k := range b.covered {
+		b.uncovered[k] = struct{}{}
+	}
+	b.filter, b.covered, b.rebuilding = f, make(map[shard.Key]struct{}), false
+	for _, k := range keys {
+		// skip the shards dropped in the meantime, and those being added,
+		// which the filter may not hold the latest multihashes of.
+		if _, ok := b.uncovered[k]; ok && b.adding[k] == 0 {
+			b.covered[k] = struct{}{}
+			delete(b.uncovered, k)
+		}
+	}
+	var pending []shard.Key
+	for k := range b.uncovered {
+		if b.adding[k] == 0 {
+			pending = append(pending, k)
+		}
+	}
+	return pending
+}
+
+// persist persists the filter, and the keys of the shards it covers, unless
+// there's no filter yet.
+func (b *blooms) persist(br index.BloomRepo) error {
+	b.lk.RLock()
+	defer b.lk.RUnlock()
+
+	if b.filter == nil {
+		return nil
+	}
+	keys := make([]shard.Key, 0, len(b.covered))
+	for k := range b.covered {
+		keys = append(keys, k)
+	}
+	return br.PutBloom(b.filter, keys)
+}
+
+// drop forgets about a shard leaving the inverted index. Its multihashes are
+// left in the filter until it's rebuilt.
+func (b *blooms) drop(key shard.Key) {
+	b.lk.Lock()
+	delete(b.covered, key)
+	delete(b.uncovered, key)
+	b.lk.Unlock()
+}
+
+// bloomMissError is the error lookups turned down by the filters fail with,
+// which matches that of the default inverted index.
+func bloomMissError(h mh.Multihash) error {
+	return fmt.Errorf("failed to lookup index for mh %s, err: %w", h, ds.ErrNotFound)
+}
+
+// addToInverted adds the multihashes of the shard with the given key to the
+// inverted index, and to the bloom filter if enabled.
+func (d *DAGStore) addToInverted(ctx context.Context, key shard.Key, idx carindex.IterableIndex) error {
+	mhIter := &mhIdx{iterableIdx: idx}
+	if !d.blooms.enabled() {
+		return d.TopLevelIndex.AddMultihashesForShard(ctx, mhIter, key)
+	}
+
+	d.blooms.startAdd(key)
+	if err := d.TopLevelIndex.AddMultihashesForShard(ctx, mhIter, key); err != nil {
+		d.blooms.endAdd(key, nil)
+		return err
+	}
+	if d.blooms.endAdd(key, idx) {
+		d.goRebuildBloom()
+	}
+	return nil
+}
+
+// dropBloom removes a destroyed or archived shard from the bloom filter.
+func (d *DAGStore) dropBloom(key shard.Key) {
+	if d.blooms.enabled() {
+		d.blooms.drop(key)
+	}
+}
+
+// loadBloom loads the bloom filter persisted on the last clean shutdown, and
+// covers the supplied shards, which were marked as uncovered, if it doesn't
+// already. If there's no filter to load, it's rebuilt from the full indices of
+// the shards. Shards that fail to load stay uncovered, so that lookups always
+// consult the inverted index.
+func (d *DAGStore) loadBloom() {
+	defer d.wg.Done()
+
+	if br, ok := d.indices.(index.BloomRepo); ok {
+		f, keys, err := br.GetBloom()
+		if err == nil {
+			// the persisted filter goes stale as soon as shards are destroyed
+			// and added again; drop it, so that it isn't loaded again after
+			// a crash. It's persisted again on close.
+			if !d.config.ReadOnly {
+				if err := br.DropBloom(); err != nil {
+					log.Warnw("failed to drop persisted bloom filter", "error", err)
+				}
+			}
+			pending := d.blooms.install(f, keys)
+			d.coverBloom(pending)
+			return
+		}
+		if !errors.Is(err, index.ErrNotFound) {
+			log.Warnw("failed to load bloom filter; rebuilding it", "error", err)
+		}
+	}
+	d.rebuildBloom()
+}
+
+// goRebuildBloom rebuilds the bloom filter in the background.
+func (d *DAGStore) goRebuildBloom() {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.rebuildBloom()
+	}()
+}
+
+// rebuildBloom rebuilds the bloom filter from the full indices of the shards
+// that may be in the inverted index, with room for more, and covers those
+// added in the meantime. The previous filter serves lookups until it's done.
+func (d *DAGStore) rebuildBloom() {
+	keys := d.blooms.keys()
+	var n uint64
+	d.lk.RLock()
+	for _, k := range keys {
+		if s, ok := d.shards[k]; ok {
+			n += atomic.LoadUint64(&s.indexedBlocks)
+		}
+	}
+	d.lk.RUnlock()
+
+	for {
+		f := index.NewBloom(bloomCapacity(n), d.blooms.fpRate)
+		var built []shard.Key
+		for _, k := range keys {
+			if d.ctx.Err() != nil {
+				return
+			}
+			// shards without a full index were never added to the inverted
+			// index.
+			if istat, err := d.indices.StatFullIndex(k); err == nil && !istat.Exists {
+				built = append(built, k)
+				continue
+			}
+			idx, err := d.GetIterableIndex(k)
+			if err != nil {
+				log.Warnw("failed to add shard to bloom filter", "shard", k, "error", err)
+				continue
+			}
+			err = idx.ForEach(func(h mh.Multihash, _ uint64) error {
+				f.Add(h)
+				return nil
+			})
+			if err != nil {
+				log.Warnw("failed to add shard to bloom filter", "shard", k, "error", err)
+				continue
+			}
+			built = append(built, k)
+		}
+		// the number of blocks recorded for the shards may be stale.
+		if f.Count() > f.Capacity() {
+			n = f.Count()
+			continue
+		}
+
+		log.Infow("rebuilt bloom filter", "shards", len(built), "multihashes", f.Count())
+		pending := d.blooms.install(f, built)
+		d.coverBloom(pending)
+		return
+	}
+}
+
+// bloomCapacity returns the capacity to size the bloom filter with for n
+// multihashes.
+func bloomCapacity(n uint64) uint64 {
+	if n *= bloomHeadroom; n < bloomMinCapacity {
+		return bloomMinCapacity
+	}
+	return n
+}
+
+// coverBloom adds the supplied uncovered shards to the bloom filter, from
+// their full indices, rebuilding it if it runs out of room.
+func (d *DAGStore) coverBloom(keys []shard.Key) {
+	for _, k := range keys {
+		if d.ctx.Err() != nil {
+			return
+		}
+		if istat, err := d.indices.StatFullIndex(k); err == nil && !istat.Exists {
+			d.blooms.drop(k)
+			continue
+		}
+		idx, err := d.GetIterableIndex(k)
+		if err != nil {
+			log.Warnw("failed to add shard to bloom filter", "shard", k, "error", err)
+			continue
+		}
+		if d.blooms.cover(k, idx) {
+			d.rebuildBloom()
+			return
+		}
+	}
+}
+
+// persistBloom persists the bloom filter on close, if the index repo supports
+// it.
+func (d *DAGStore) persistBloom() {
+	br, ok := d.indices.(index.BloomRepo)
+	if !ok || !d.blooms.enabled() || d.config.ReadOnly {
+		return
+	}
+	if err := d.blooms.persist(br); err != nil {
+		log.Warnw("failed to persist bloom filter", "error", err)
+	}
+}
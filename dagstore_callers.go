@@ -0,0 +1,90 @@
+package dagstore
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultMaxCallersPerShard is the default value of Config.MaxCallersPerShard.
+var DefaultMaxCallersPerShard = 64
+
+// CallerStats are statistics about the acquires of a shard on behalf of a
+// caller, as identified by AcquireOpts.Caller.
+type CallerStats struct {
+	// Acquires is the number of times the shard was acquired by the caller.
+	Acquires uint64
+	// LastAcquiredAt is the time when the caller last acquired the shard.
+	LastAcquiredAt time.Time
+	// BytesServed is the number of block bytes read through the blockstores
+	// of the caller's accessors.
+	BytesServed uint64
+}
+
+// callerStats tracks the statistics of the callers of a shard. Acquires are
+// recorded from the event loop, and bytes served from the accessors, so it's
+// guarded by its own lock. The zero value is ready to use.
+type callerStats struct {
+	lk sync.Mutex
+	m  map[string]*CallerStats
+}
+
+// recordAcquire records an acquire by the caller. If max callers are
+// tracked already, the caller that acquired the shard least recently is
+// dropped to make room.
+func (c *callerStats) recordAcquire(caller string, now time.Time, max int) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	cs, ok := c.m[caller]
+	if !ok {
+		if c.m == nil {
+			c.m = make(map[string]*CallerStats)
+		}
+		if len(c.m) >= max {
+			c.evictOldest()
+		}
+		cs = new(CallerStats)
+		c.m[caller] = cs
+	}
+	cs.Acquires++
+	cs.LastAcquiredAt = now
+}
+
+// evictOldest drops the caller that acquired the shard least recently. It
+// must be called with the lock held.
+func (c *callerStats) evictOldest() {
+	var oldest string
+	var at time.Time
+	for caller, cs := range c.m {
+		if at.IsZero() || cs.LastAcquiredAt.Before(at) {
+			oldest, at = caller, cs.LastAcquiredAt
+		}
+	}
+	delete(c.m, oldest)
+}
+
+// recordServed accounts bytes served to the caller. Bytes served to callers
+// that are no longer tracked are dropped.
+func (c *callerStats) recordServed(caller string, size int) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if cs, ok := c.m[caller]; ok {
+		cs.BytesServed += uint64(size)
+	}
+}
+
+// snapshot returns a copy of the statistics, or nil if no caller is tracked.
+func (c *callerStats) snapshot() map[string]CallerStats {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if len(c.m) == 0 {
+		return nil
+	}
+	ret := make(map[string]CallerStats, len(c.m))
+	for caller, cs := range c.m {
+		ret[caller] = *cs
+	}
+	return ret
+}
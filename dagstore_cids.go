@@ -0,0 +1,79 @@
+package dagstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	carindex "github.com/ipld/go-car/v2/index"
+	"github.com/multiformats/go-multihash"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// ShardCids streams the CIDs of all blocks in a shard, read from its full
+// index without touching the shard data, e.g. for auditing or re-advertising
+// the shard to indexers. The channel is closed once all CIDs have been sent,
+// or the context is cancelled.
+//
+// Indices record multihashes only, so CIDs are returned as CIDv1 with the raw
+// codec. Identity CIDs, whose data is inlined in the CID, aren't indexed and
+// are therefore not listed.
+func (d *DAGStore) ShardCids(ctx context.Context, key shard.Key) (<-chan cid.Cid, error) {
+	d.lk.RLock()
+	_, ok := d.shards[key]
+	d.lk.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", key.String(), ErrShardUnknown)
+	}
+
+	idx, err := d.indices.GetFullIndex(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get index for shard %s: %w", key, err)
+	}
+	return streamCids(ctx, idx, nil)
+}
+
+// Cids is like DAGStore.ShardCids, but only streams the CIDs of the blocks
+// exposed by the accessor, if it's restricted.
+func (sa *ShardAccessor) Cids(ctx context.Context) (<-chan cid.Cid, error) {
+	sa.lk.Lock()
+	err := sa.checkOpen()
+	sa.lk.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return streamCids(ctx, sa.idx, sa.restrict)
+}
+
+// streamCids streams the CIDs of the blocks in an index, optionally limited
+// to those allowed by a restriction.
+func streamCids(ctx context.Context, idx carindex.Index, allowed restriction) (<-chan cid.Cid, error) {
+	iterable, ok := idx.(carindex.IterableIndex)
+	if !ok {
+		return nil, errors.New("index for shard is not iterable")
+	}
+
+	out := make(chan cid.Cid)
+	go func() {
+		defer close(out)
+		_ = iterable.ForEach(func(mh multihash.Multihash, _ uint64) error {
+			if allowed != nil {
+				if _, ok := allowed[string(mh)]; !ok {
+					return nil
+				}
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			select {
+			case out <- cid.NewCidV1(cid.Raw, mh):
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+	return out, nil
+}
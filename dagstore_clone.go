@@ -0,0 +1,143 @@
+package dagstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	carindex "github.com/ipld/go-car/v2/index"
+
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+type CloneOpts struct {
+	// CopyTransient copies the data of the source shard into a transient for
+	// the clone, so that the clone doesn't need to fetch it from its mount
+	// until the transient is reclaimed. It has no effect if the destination
+	// mount is fully capable, as such mounts don't use transients.
+	CopyTransient bool
+}
+
+// CloneShard registers a new shard under dstKey, backed by dstMount, reusing
+// the index of the shard under srcKey instead of re-indexing. This is useful
+// to replicate a shard to a second storage backend; dstMount must hold the
+// same data as the source shard.
+//
+// This method returns an error synchronously if preliminary validation fails.
+// Otherwise, the source shard is acquired for the duration of the clone, and
+// the result of the clone is sent to the supplied channel once the clone has
+// been registered.
+func (d *DAGStore) CloneShard(ctx context.Context, srcKey, dstKey shard.Key, dstMount mount.Mount, out chan ShardResult, opts CloneOpts) error {
+	if err := d.checkWritable(dstKey); err != nil {
+		return err
+	}
+	d.lk.Lock()
+	_, srcOk := d.shards[srcKey]
+	_, dstOk := d.shards[dstKey]
+	_, sweeping := d.sweeping[dstKey]
+	if srcOk && !dstOk && !sweeping {
+		d.cloning[dstKey] = struct{}{}
+	}
+	d.lk.Unlock()
+
+	if !srcOk {
+		return fmt.Errorf("%s: %w", srcKey.String(), ErrShardUnknown)
+	}
+	if dstOk {
+		return fmt.Errorf("%s: %w", dstKey.String(), ErrShardExists)
+	}
+	if sweeping {
+		return fmt.Errorf("%s: %w", dstKey.String(), ErrIndexSweeping)
+	}
+
+	go func() {
+		err := d.cloneShard(ctx, srcKey, dstKey, dstMount, out, opts)
+		d.lk.Lock()
+		delete(d.cloning, dstKey)
+		d.lk.Unlock()
+		if err != nil {
+			d.dispatchResult(&ShardResult{Key: dstKey, Error: err}, &waiter{ctx: ctx, outCh: out})
+		}
+	}()
+	return nil
+}
+
+// cloneShard performs the clone, registering the clone with out as the
+// registration channel. Errors before registration are returned.
+func (d *DAGStore) cloneShard(ctx context.Context, srcKey, dstKey shard.Key, dstMount mount.Mount, out chan ShardResult, opts CloneOpts) error {
+	// acquire the source shard, so that its index is available, and its data
+	// isn't reclaimed while we copy it.
+	ch := make(chan ShardResult, 1)
+	if err := d.AcquireShard(ctx, srcKey, ch, AcquireOpts{}); err != nil {
+		return fmt.Errorf("failed to acquire source shard: %w", err)
+	}
+	var res ShardResult
+	select {
+	case res = <-ch:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if res.Error != nil {
+		return fmt.Errorf("failed to acquire source shard: %w", res.Error)
+	}
+	sa := res.Accessor
+	defer sa.Close()
+
+	// copy the index.
+	if err := d.indices.AddFullIndex(dstKey, sa.idx); err != nil {
+		return fmt.Errorf("failed to copy index: %w", err)
+	}
+	// clones of shards kept out of the inverted index are kept out too.
+	skipTopLevel := sa.shard.skipTopLevel
+	if iterableIdx, ok := sa.idx.(carindex.IterableIndex); ok {
+		if !skipTopLevel {
+			if err := d.addToInverted(ctx, dstKey, iterableIdx); err != nil {
+				log.Errorw("failed to add shard multihashes to the inverted index", "shard", dstKey, "error", err)
+			}
+		}
+	} else {
+		log.Errorw("shard index is not iterable", "shard", dstKey)
+	}
+
+	var transient string
+	if info := dstMount.Info(); opts.CopyTransient && !(info.AccessSeek && info.AccessRandom) {
+		var err error
+		if transient, err = d.copyTransient(sa); err != nil {
+			_, _ = d.indices.DropFullIndex(dstKey)
+			return fmt.Errorf("failed to copy transient: %w", err)
+		}
+	}
+
+	// the index is present, so registration won't re-index the shard.
+	err := d.RegisterShard(ctx, dstKey, dstMount, out, RegisterOpts{ExistingTransient: transient, SkipTopLevelIndex: skipTopLevel})
+	if err != nil {
+		_, _ = d.indices.DropFullIndex(dstKey)
+		if transient != "" {
+			_ = os.Remove(transient)
+		}
+		return err
+	}
+	return nil
+}
+
+// copyTransient copies the data of a shard into a new file in the transients
+// directory, returning its path.
+func (d *DAGStore) copyTransient(sa *ShardAccessor) (string, error) {
+	f, err := os.CreateTemp(d.config.TransientsDir, "transient-clone-*.car")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := sa.data.Seek(0, io.SeekStart); err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	if _, err := io.Copy(f, sa.data); err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,61 @@
+package dagstore
+
+import (
+	"fmt"
+
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// ShardConflictError is the error RegisterShard returns when a shard with the
+// same key, but a different mount, is already registered, e.g. when keys are
+// derived from data that two pieces have in common. It unwraps to
+// ErrShardExists; use errors.As to extract it.
+type ShardConflictError struct {
+	// Key is the key of the shards.
+	Key shard.Key
+	// ExistingURL is the mount URL of the registered shard.
+	ExistingURL string
+	// URL is the mount URL of the shard that failed to register.
+	URL string
+}
+
+func (e *ShardConflictError) Error() string {
+	return fmt.Sprintf("%s: %s with mount %s; refusing to register mount %s", e.Key.String(), ErrShardExists, e.ExistingURL, e.URL)
+}
+
+func (e *ShardConflictError) Unwrap() error {
+	return ErrShardExists
+}
+
+// shardExistsError returns the error to fail the registration of the given
+// mount with, given the shard already registered with the same key: a
+// ShardConflictError if their mount URLs differ, or a plain ErrShardExists
+// otherwise, or if either mount can't be represented as a URL.
+func (d *DAGStore) shardExistsError(s *Shard, mnt mount.Mount) error {
+	existing, err := d.mounts.Represent(s.mount)
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.key.String(), ErrShardExists)
+	}
+	u, err := d.mounts.Represent(mnt)
+	if err != nil || u.String() == existing.String() {
+		return fmt.Errorf("%s: %w", s.key.String(), ErrShardExists)
+	}
+	log.Warnw("shard key conflict", "shard", s.key, "existing_url", existing, "url", u)
+	return d.redact(&ShardConflictError{Key: s.key, ExistingURL: existing.String(), URL: u.String()})
+}
+
+// writingConflictError returns the error to fail the registration of the
+// given mount with, given that the key is reserved by a ShardWriter writing
+// the CAR at path.
+func (d *DAGStore) writingConflictError(key shard.Key, path string, mnt mount.Mount) error {
+	e := &ShardConflictError{Key: key}
+	if existing, err := d.mounts.Represent(&mount.FileMount{Path: path}); err == nil {
+		e.ExistingURL = existing.String()
+	}
+	if u, err := d.mounts.Represent(mnt); err == nil {
+		e.URL = u.String()
+	}
+	log.Warnw("shard key conflict with a shard being written", "shard", key, "url", e.URL)
+	return d.redact(e)
+}
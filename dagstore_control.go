@@ -2,7 +2,11 @@ package dagstore
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync/atomic"
+
+	"github.com/filecoin-project/dagstore/mount"
 
 	"github.com/ipfs/go-datastore"
 )
@@ -18,6 +22,14 @@ const (
 	OpShardFail
 	OpShardRelease
 	OpShardRecover
+	OpShardAcquireExpire
+	OpShardAcquireDone
+	OpShardDestroyFinalize
+	OpShardFetchProgress
+	OpShardExpire
+	OpShardArchive
+	OpShardUnarchive
+	OpShardReclaim
 )
 
 func (o OpType) String() string {
@@ -29,22 +41,24 @@ func (o OpType) String() string {
 		"OpShardAcquire",
 		"OpShardFail",
 		"OpShardRelease",
-		"OpShardRecover"}[o]
+		"OpShardRecover",
+		"OpShardAcquireExpire",
+		"OpShardAcquireDone",
+		"OpShardDestroyFinalize",
+		"OpShardFetchProgress",
+		"OpShardExpire",
+		"OpShardArchive",
+		"OpShardUnarchive",
+		"OpShardReclaim"}[o]
 }
 
-// control runs the DAG store's event loop.
-func (d *DAGStore) control() {
+// control runs the i-th worker of the DAG store's event loop.
+func (d *DAGStore) control(i int) {
 	defer d.wg.Done()
 
-	// wFailure is a synthetic failure waiter that uses the DAGStore's
-	// global context and the failure channel. Only safe to actually use if
-	// d.failureCh != nil. wFailure is used to dispatch failure
-	// notifications to the application.
-	var wFailure = &waiter{ctx: d.ctx, outCh: d.failureCh}
-
 	for {
-		// consume the next task or GC request; if we're shutting down, this method will error.
-		tsk, gc, err := d.consumeNext()
+		// consume the next task; if we're shutting down, this method will error.
+		tsk, err := d.consumeNext(i)
 		if err != nil {
 			if err == context.Canceled {
 				log.Infow("dagstore closed")
@@ -54,17 +68,23 @@ func (d *DAGStore) control() {
 			return
 		}
 
-		if gc != nil {
-			// this was a GC request.
-			d.gc(gc)
-			continue
+		d.opDequeued(tsk.shard.key, tsk.op)
+		if tsk.admitted {
+			d.releaseAdmission(tsk.op)
 		}
-
 		s := tsk.shard
 		log.Debugw("processing task", "op", tsk.op, "shard", tsk.shard.key, "error", tsk.err)
 
 		s.lk.Lock()
 		prevState := s.state
+		var destroyed *ShardDestroyed // set if the shard was destroyed by this task.
+
+		// give hooks a chance to veto the operation, unless it was committed
+		// already.
+		var vetoErr error
+		if !tsk.committed {
+			vetoErr = d.beforeOp(s, tsk)
+		}
 
 		switch tsk.op {
 		case OpShardRegister:
@@ -91,23 +111,54 @@ func (d *DAGStore) control() {
 			_ = d.queueTask(&task{op: OpShardInitialize, shard: s, waiter: tsk.waiter}, d.internalCh)
 
 		case OpShardInitialize:
+			if s.state == ShardStateTombstoned {
+				// destroyed while queued for initialization.
+				if d.throttledLazyInit(s) {
+					d.lazyInits.unreserve()
+				}
+				break
+			}
 			s.state = ShardStateInitializing
 
 			// if we already have the index for this shard, there's nothing to do here.
 			if istat, err := d.indices.StatFullIndex(s.key); err == nil && istat.Exists {
 				log.Debugw("already have an index for shard being initialized, nothing to do", "shard", s.key)
+				if d.throttledLazyInit(s) {
+					d.lazyInits.unreserve()
+				}
 				_ = d.queueTask(&task{op: OpShardMakeAvailable, shard: s}, d.internalCh)
 				break
 			}
 
+			// initializations of lazy shards are triggered by acquires; if
+			// they're throttled, the acquire reserved a place for the shard in
+			// the lazy initialization queue, and a worker initializes it once
+			// pushed.
+			if d.throttledLazyInit(s) {
+				d.lazyInits.push(s)
+				break
+			}
+
+			s.initRunning = true
 			go d.initializeShard(tsk.ctx, s, s.mount)
 
 		case OpShardMakeAvailable:
 			// can arrive here after initializing a new shard,
 			// or when recovering from a failure.
+			if tsk.initDone {
+				s.initRunning = false
+			}
+			if s.state == ShardStateTombstoned {
+				// destroyed while initializing; waiters were failed.
+				if s.destroyDeferred {
+					destroyed = d.finalizeDestroy(s)
+				}
+				break
+			}
 
 			s.state = ShardStateAvailable
 			s.err = nil // nillify past errors
+			s.detachedIndex = nil
 
 			// notify the registration waiter, if there is one.
 			if s.wRegister != nil {
@@ -125,25 +176,49 @@ func (d *DAGStore) control() {
 
 			// trigger queued acquisition waiters.
 			for _, w := range s.wAcquire {
-				s.state = ShardStateServing
-
-				// optimistically increment the refcount to acquire the shard. The go-routine will send an `OpShardRelease` message
-				// to the event loop if it fails to acquire the shard.
-				s.refs++
-				go d.acquireAsync(w.ctx, w, s, s.mount)
+				w.stopExpiry()
+				d.dispatchAcquirer(s, w)
 			}
 			s.wAcquire = s.wAcquire[:0]
 
 		case OpShardAcquire:
 			log.Debugw("got request to acquire shard", "shard", s.key, "current shard state", s.state)
-			w := &waiter{ctx: tsk.ctx, outCh: tsk.outCh}
+			w := &waiter{ctx: tsk.ctx, outCh: tsk.outCh, acquireOpts: tsk.acquireOpts, provenance: tsk.provenance, noReplica: tsk.noReplica}
+
+			if vetoErr != nil {
+				d.dispatchResult(&ShardResult{Key: s.key, Error: vetoErr}, w)
+				break
+			}
+
+			// if the shard is being destroyed, reject the acquire.
+			if s.state == ShardStateTombstoned {
+				err := fmt.Errorf("%s: %w", s.key.String(), ErrShardTombstoned)
+				d.dispatchResult(&ShardResult{Key: s.key, Error: err}, w)
+				break
+			}
+
+			// archived shards must be unarchived before they're acquired.
+			if s.state == ShardStateArchived {
+				err := fmt.Errorf("%s: %w", s.key.String(), ErrShardArchived)
+				d.dispatchResult(&ShardResult{Key: s.key, Error: err}, w)
+				break
+			}
+
+			// serve the acquire from a replica while the shard is errored or
+			// recovering, if we have a replica resolver.
+			if (s.state == ShardStateErrored || s.state == ShardStateRecovering) && d.config.ReplicaResolver != nil && !w.noReplica {
+				d.acquireReplica(s, w)
+				break
+			}
 
 			// if the shard is errored, fail the acquire immediately.
 			if s.state == ShardStateErrored {
-				if s.recoverOnNextAcquire {
+				if s.recoverOnNextAcquire && !d.config.ReadOnly {
 					// we are errored, but recovery was requested on the next acquire
 					// we park the acquirer and trigger a recover.
-					s.wAcquire = append(s.wAcquire, w)
+					if !d.queueAcquirer(s, w) {
+						break
+					}
 					s.recoverOnNextAcquire = false
 					// we use the global context instead of the acquire context
 					// to avoid the first context cancellation interrupting the
@@ -159,9 +234,20 @@ func (d *DAGStore) control() {
 			}
 
 			if s.state != ShardStateAvailable && s.state != ShardStateServing {
+				// if this is the first acquire of a lazy shard, reserve its
+				// place in the initialization queue first, as it may be full.
+				if s.state == ShardStateNew && !d.queueLazyInit(s, w) {
+					break
+				}
+
 				log.Debugw("shard isn't active yet, will queue acquire channel", "shard", s.key)
 				// shard state isn't active yet; make this acquirer wait.
-				s.wAcquire = append(s.wAcquire, w)
+				if !d.queueAcquirer(s, w) {
+					if s.state == ShardStateNew && d.throttledLazyInit(s) {
+						d.lazyInits.unreserve()
+					}
+					break
+				}
 
 				// if the shard was registered with lazy init, and this is the
 				// first acquire, queue the initialization.
@@ -179,33 +265,32 @@ func (d *DAGStore) control() {
 				break
 			}
 
-			// mark as serving.
-			s.state = ShardStateServing
-
-			// optimistically increment the refcount to acquire the shard.
-			// The goroutine will send an `OpShardRelease` task
-			// to the event loop if it fails to acquire the shard.
-			s.refs++
-			go d.acquireAsync(tsk.ctx, w, s, s.mount)
+			d.dispatchAcquirer(s, w)
 
 		case OpShardRelease:
-			if (s.state != ShardStateServing && s.state != ShardStateErrored) || s.refs <= 0 {
-				log.Warn("ignored illegal request to release shard")
-				break
-			}
-
-			// decrement refcount.
-			s.refs--
-
-			// reset state back to available, if we were the last
-			// active acquirer.
-			if s.refs == 0 {
-				s.state = ShardStateAvailable
-			}
+			destroyed = d.releaseShard(s, tsk)
 
 		case OpShardFail:
+			if tsk.initDone {
+				s.initRunning = false
+			}
+			if s.state == ShardStateTombstoned {
+				// destroyed while initializing; waiters were failed.
+				if s.destroyDeferred {
+					destroyed = d.finalizeDestroy(s)
+				}
+				break
+			}
+			d.recordFailure(s, tsk.err)
 			s.state = ShardStateErrored
 			s.err = tsk.err
+			s.detachedIndex = nil
+
+			// recover shards whose mount went stale on their next acquire,
+			// e.g. once the network filesystem they're on is back.
+			if errors.Is(tsk.err, mount.ErrStale) {
+				s.recoverOnNextAcquire = true
+			}
 
 			// notify the registration waiter, if there is one.
 			if s.wRegister != nil {
@@ -230,6 +315,9 @@ func (d *DAGStore) control() {
 			// fail waiting acquirers.
 			// can't block the event loop, so launch a goroutine per acquirer.
 			if len(s.wAcquire) > 0 {
+				for _, w := range s.wAcquire {
+					w.stopExpiry()
+				}
 				err := fmt.Errorf("failed to acquire shard: %w", tsk.err)
 				res := &ShardResult{Key: s.key, Error: err}
 				d.dispatchResult(res, s.wAcquire...)
@@ -250,12 +338,23 @@ func (d *DAGStore) control() {
 			// state with zero refcount.
 
 			// Notify the application of the failure, if they provided a channel.
-			if ch := d.failureCh; ch != nil {
-				res := &ShardResult{Key: s.key, Error: s.err}
-				d.dispatchFailuresCh <- &dispatch{res: res, w: wFailure}
-			}
+			d.notifyFailure(&ShardResult{Key: s.key, Error: s.err})
 
 		case OpShardRecover:
+			if vetoErr != nil {
+				d.dispatchResult(&ShardResult{Key: s.key, Error: vetoErr}, tsk.waiter)
+
+				// fail the acquirers parked waiting for the recovery, if any.
+				if s.state == ShardStateErrored && len(s.wAcquire) > 0 {
+					for _, w := range s.wAcquire {
+						w.stopExpiry()
+					}
+					d.dispatchResult(&ShardResult{Key: s.key, Error: vetoErr}, s.wAcquire...)
+					s.wAcquire = s.wAcquire[:0]
+				}
+				break
+			}
+
 			if s.state != ShardStateErrored {
 				err := fmt.Errorf("refused to recover shard in state other than errored; current state: %d", s.state)
 				res := &ShardResult{Key: s.key, Error: err}
@@ -287,80 +386,192 @@ func (d *DAGStore) control() {
 			}
 
 			// fetch again and reindex.
+			s.initRunning = true
 			go d.initializeShard(tsk.ctx, s, s.mount)
 
 		case OpShardDestroy:
-			if s.state == ShardStateServing || s.refs > 0 {
-				err := fmt.Errorf("failed to destroy shard; active references: %d", s.refs)
-				res := &ShardResult{Key: s.key, Error: err}
-				d.dispatchResult(res, tsk.waiter)
+			if vetoErr != nil {
+				d.dispatchResult(&ShardResult{Key: s.key, Error: vetoErr}, tsk.waiter)
+				break
+			}
+			if tsk.committed {
+				s.txnTombstone = false
+			}
+			if !d.tombstoneShard(s, tsk.waiter, tsk.committed) {
+				break
+			}
+
+			// destroy right away if there are no active references; otherwise
+			// the last release or the deadline will.
+			if s.refs == 0 {
+				destroyed = d.finalizeDestroy(s)
+			}
+
+		case OpShardArchive:
+			d.archiveShard(s, tsk.waiter)
+
+		case OpShardUnarchive:
+			d.unarchiveShard(s, tsk.waiter, tsk.restore)
+
+		case OpShardReclaim:
+			d.reclaimIdle(s)
+
+		case OpShardDestroyFinalize:
+			// the shard may have been destroyed in the meantime, when its
+			// references drained.
+			if s.destroyed || s.state != ShardStateTombstoned {
 				break
 			}
+			destroyed = d.finalizeDestroy(s)
 
-			d.lk.Lock()
-			delete(d.shards, s.key)
+		case OpShardAcquireExpire:
+			// the acquirer may have been served or failed in the meantime, in
+			// which case there's nothing to do.
+			d.expireAcquirer(s, tsk.waiter)
 
-			// Perform on-disk delete after the switch statement. This is only in-memory delete.
-			d.lk.Unlock()
-			res := &ShardResult{Key: s.key, Error: nil}
-			d.dispatchResult(res, tsk.waiter)
-			// TODO are we guaranteed that there are no queued items for this shard?
+		case OpShardAcquireDone:
+			// an acquirer is done opening the shard; dispatch the next ones.
+			destroyed = d.acquireDone(s)
 
 		default:
 			panic(fmt.Sprintf("unrecognized shard operation: %d", tsk.op))
 
 		}
 
-		// persist the current shard state. If Op is OpShardDestroy then delete directly from DB.
-		if tsk.op == OpShardDestroy {
+		d.checkRefInvariants(s, tsk.op)
+		d.recordTransition(s, tsk.op, prevState, tsk.err)
+		d.afterOp(s, tsk, vetoErr)
+
+		// persist the current shard state. If the shard was destroyed, then
+		// delete it directly from DB; tasks still in flight for destroyed
+		// shards must not resurrect them. In read-only mode, the writer node
+		// owns the persisted state, and so does the instance that took the
+		// lease over from a fenced one.
+		switch {
+		case d.config.ReadOnly, d.isFenced():
+		case destroyed != nil:
 			if err := d.store.Delete(d.ctx, datastore.NewKey(s.key.String())); err != nil {
 				log.Errorw("DestroyShard: failed to delete shard from database", "shard", s.key, "error", err)
 			}
-		} else {
+			d.dropHistory(s)
+		case !s.destroyed && tsk.op != OpShardAcquireExpire && tsk.op != OpShardAcquireDone: // these don't alter the shard state.
 			if err := s.persist(d.ctx, d.config.Datastore); err != nil { // TODO maybe fail shard?
 				log.Warnw("failed to persist shard", "shard", s.key, "error", err)
 			}
 		}
 
-		// send a notification if the user provided a notification channel.
-		if d.traceCh != nil {
+		// send a notification if the user provided a notification channel or
+		// trace sinks, or if recent traces are kept.
+		if d.tracing() {
 			log.Debugw("will write trace to the trace channel", "shard", s.key)
+			d.traceLk.Lock()
+			d.traceSeq++
+			s.traceSeq++
 			n := Trace{
 				Key: s.key,
 				Op:  tsk.op,
 				After: ShardInfo{
 					ShardState: s.state,
 					Error:      s.err,
+					Tier:       d.transientTier(s),
 					refs:       s.refs,
 				},
+				Seq:      d.traceSeq,
+				ShardSeq: s.traceSeq,
+			}
+			if tsk.op == OpShardAcquire && tsk.waiter != nil {
+				n.Caller = tsk.acquireOpts.Caller
 			}
-			d.traceCh <- n
+			d.emitTrace(n)
+			d.traceLk.Unlock()
 			log.Debugw("finished writing trace to the trace channel", "shard", s.key)
 		}
 
 		log.Debugw("finished processing task", "op", tsk.op, "shard", tsk.shard.key, "prev_state", prevState, "curr_state", s.state, "error", tsk.err)
 
 		s.lk.Unlock()
+
+		// remove the destroyed shard from the catalogue only now, as the
+		// catalogue lock is taken before shard locks.
+		if destroyed != nil {
+			d.removeDestroyed(s, *destroyed)
+		}
+		atomic.AddUint64(&d.watchdog.processed[i], 1)
 	}
 }
 
-func (d *DAGStore) consumeNext() (tsk *task, gc chan *GCResult, error error) {
-	select {
-	case tsk = <-d.internalCh: // drain internal first; these are tasks emitted from the event loop.
-		return tsk, nil, nil
-	case <-d.ctx.Done():
-		return nil, nil, d.ctx.Err() // TODO drain and process before returning?
-	default:
+func (d *DAGStore) consumeNext(i int) (tsk *task, error error) {
+	for {
+		select {
+		case tsk = <-d.internalCh[i]: // drain internal first; these are tasks emitted from the event loop.
+			return tsk, nil
+		case <-d.ctx.Done():
+			return nil, d.ctx.Err() // TODO drain and process before returning?
+		default:
+		}
+
+		// while paused, external tasks are not dispatched; they queue up in
+		// externalCh until we resume.
+		externalCh := d.externalCh[i]
+		if d.loopPaused[i] {
+			externalCh = nil
+		}
+
+		select {
+		case tsk = <-externalCh:
+			return tsk, nil
+		case tsk = <-d.completionCh[i]:
+			return tsk, nil
+		case req := <-d.loopPauseCh[i]:
+			d.loopPaused[i] = req.pause
+			close(req.done)
+		case req := <-d.haltCh[i]:
+			// GC is running; hold still until it's done.
+			close(req.halted)
+			select {
+			case <-req.resume:
+			case <-d.ctx.Done():
+				return nil, d.ctx.Err()
+			}
+		case <-d.ctx.Done():
+			return nil, d.ctx.Err() // TODO drain and process before returning?
+		}
+	}
+}
+
+// releaseShard releases the reference of a release task, returning the
+// outcome of the destroy of a tombstoned shard whose references drained, if
+// any. It must be called from the event loop.
+func (d *DAGStore) releaseShard(s *Shard, tsk *task) *ShardDestroyed {
+	if (s.state != ShardStateServing && s.state != ShardStateErrored && s.state != ShardStateTombstoned) || s.refs <= 0 {
+		log.Warn("ignored illegal request to release shard")
+		if d.config.RefcountAccounting {
+			d.refViolation(s, "release of reference %d from %s with no active references; state: %s", tsk.ref, tsk.caller, s.state)
+		}
+		return nil
+	}
+	if !d.refReleased(s, tsk) {
+		return nil
+	}
+
+	// decrement refcount.
+	s.refs--
+
+	// destroy a tombstoned shard once its references drain.
+	if s.state == ShardStateTombstoned {
+		if s.refs == 0 && !s.destroyed {
+			return d.finalizeDestroy(s)
+		}
+		return nil
 	}
 
-	select {
-	case tsk = <-d.externalCh:
-		return tsk, nil, nil
-	case tsk = <-d.completionCh:
-		return tsk, nil, nil
-	case gc := <-d.gcCh:
-		return nil, gc, nil
-	case <-d.ctx.Done():
-		return nil, nil, d.ctx.Err() // TODO drain and process before returning?
+	// reset state back to available, if we were the last
+	// active acquirer, unless the shard failed while referenced, in
+	// which case it stays errored (and is recovered on its next
+	// acquire if its mount went stale).
+	if s.refs == 0 && s.state != ShardStateErrored {
+		s.state = ShardStateAvailable
+		d.shardIdle(s)
 	}
+	return nil
 }
@@ -0,0 +1,179 @@
+package dagstore
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// DefaultDestroyBufferSize is the default value of Config.DestroyBufferSize.
+var DefaultDestroyBufferSize = 128
+
+// ShardDestroyed is the notification sent to Config.DestroyCh when a shard is
+// destroyed.
+type ShardDestroyed struct {
+	Key shard.Key
+	// FreedBytes is the number of bytes freed by removing the transient and
+	// the index of the shard. Shared transients don't count, as they're only
+	// removed when all shards sharing them are destroyed.
+	FreedBytes uint64
+	// TransientRemoved is true if the shard had a transient, and it was
+	// removed or, if shared, released.
+	TransientRemoved bool
+	// IndexRemoved is true if the full index of the shard was removed.
+	IndexRemoved bool
+	// Forced is true if the shard was destroyed with active references, once
+	// DestroyOpts.DrainTimeout elapsed.
+	Forced bool
+}
+
+// tombstoneShard runs the first phase of a destroy, marking the shard as
+// tombstoned and failing its pending waiters. It returns false if the destroy
+// must be refused; committed destroys, whose tombstone was persisted by a
+// transaction, aren't refused because of active references, which are given
+// DestroyOpts.DrainTimeout to drain instead. It must be called from the event
+// loop.
+func (d *DAGStore) tombstoneShard(s *Shard, w *waiter, committed bool) bool {
+	switch {
+	case s.state == ShardStateTombstoned:
+		err := fmt.Errorf("%s: %w", s.key.String(), ErrShardTombstoned)
+		d.dispatchResult(&ShardResult{Key: s.key, Error: err}, w)
+		return false
+	case s.refs > 0 && w.destroyOpts.DrainTimeout <= 0 && !committed:
+		err := fmt.Errorf("failed to destroy shard; active references: %d", s.refs)
+		d.dispatchResult(&ShardResult{Key: s.key, Error: err}, w)
+		return false
+	}
+
+	s.state = ShardStateTombstoned
+	s.wDestroy = w
+
+	// fail the operations waiting on the shard.
+	err := fmt.Errorf("%s: %w", s.key.String(), ErrShardTombstoned)
+	for _, ww := range []*waiter{s.wRegister, s.wRecover} {
+		if ww != nil {
+			d.dispatchResult(&ShardResult{Key: s.key, Error: err}, ww)
+		}
+	}
+	s.wRegister, s.wRecover = nil, nil
+	for _, ww := range s.wAcquire {
+		ww.stopExpiry()
+	}
+	if len(s.wAcquire) > 0 {
+		d.dispatchResult(&ShardResult{Key: s.key, Error: err}, s.wAcquire...)
+		s.wAcquire = s.wAcquire[:0]
+	}
+	if d.lazyInits != nil {
+		d.lazyInits.remove(s)
+	}
+
+	// wait for the active references to drain, up to the deadline.
+	if s.refs > 0 {
+		log.Infow("shard tombstoned; waiting for active references to drain", "shard", s.key, "refs", s.refs, "timeout", w.destroyOpts.DrainTimeout)
+		s.destroyDeadline = time.AfterFunc(w.destroyOpts.DrainTimeout, func() {
+			_ = d.queueTask(&task{op: OpShardDestroyFinalize, shard: s}, d.completionCh)
+		})
+	}
+	return true
+}
+
+// finalizeDestroy runs the second phase of a destroy, deleting the data and
+// the index of a tombstoned shard. It returns the destroy notification, to be
+// passed to removeDestroyed once the shard lock is released, or nil if the
+// shard is still being initialized; the destroy is then finalized once the
+// initialization completes, so that it doesn't add the index back. It must be
+// called from the event loop.
+func (d *DAGStore) finalizeDestroy(s *Shard) *ShardDestroyed {
+	if s.destroyDeadline != nil {
+		s.destroyDeadline.Stop()
+	}
+	s.stopIdleTimer()
+	if s.initRunning {
+		log.Debugw("destroy: waiting for in-flight initialization of shard", "shard", s.key)
+		s.destroyDeferred = true
+		return nil
+	}
+	s.destroyDeferred = false
+	if s.refs > 0 {
+		log.Warnw("destroy deadline passed; destroying shard with active references", "shard", s.key, "refs", s.refs)
+	}
+
+	n := ShardDestroyed{Key: s.key, Forced: s.refs > 0}
+	if path := s.mount.TransientPath(); path != "" {
+		// shared transients stay on disk until all shards sharing them are
+		// gone, so they don't free space yet.
+		var size int64
+		if !s.mount.Shared() {
+			if fi, err := os.Stat(path); err == nil {
+				size = fi.Size()
+			}
+		}
+		if err := s.mount.DeleteTransient(); err != nil {
+			log.Warnw("destroy: failed to delete transient", "shard", s.key, "error", err)
+		} else if s.mount.TransientPath() == "" { // transients we don't own are left alone.
+			n.TransientRemoved = true
+			n.FreedBytes += uint64(size)
+		}
+	}
+	d.removeFromInverted(s)
+	stat, _ := d.indices.StatFullIndex(s.key)
+	if dropped, err := d.indices.DropFullIndex(s.key); err != nil {
+		log.Warnw("destroy: failed to drop index for shard", "shard", s.key, "error", err)
+	} else if dropped {
+		n.IndexRemoved = true
+		n.FreedBytes += stat.Size
+	}
+	d.dropBloom(s.key)
+	s.destroyed = true
+	return &n
+}
+
+// removeDestroyed removes a shard destroyed by finalizeDestroy from the
+// catalogue, and notifies the destroy waiter and the application. It must be
+// called from the event loop, without the shard lock held.
+func (d *DAGStore) removeDestroyed(s *Shard, n ShardDestroyed) {
+	d.lk.Lock()
+	d.removeShard(s)
+	d.lk.Unlock()
+
+	if s.wDestroy != nil {
+		d.dispatchResult(&ShardResult{Key: s.key}, s.wDestroy)
+		s.wDestroy = nil
+	}
+	d.notifyDestroy(n)
+}
+
+// notifyDestroy notifies the application of a destroyed shard, if it provided
+// a destroy channel. It never blocks.
+func (d *DAGStore) notifyDestroy(n ShardDestroyed) {
+	if d.destroys == nil {
+		return
+	}
+	d.destroys.push(n.Key, n)
+}
+
+// destroyDispatcher delivers buffered destroy notifications to the
+// application in order, until the DAG store is closed.
+func (d *DAGStore) destroyDispatcher() {
+	defer d.wg.Done()
+
+	d.destroys.dispatch(d.ctx, func(v interface{}) bool {
+		select {
+		case d.destroyCh <- v.(ShardDestroyed):
+			return true
+		case <-d.ctx.Done():
+			return false
+		}
+	})
+}
+
+// DestroyStats returns statistics about the notifications of destroyed
+// shards, or zero values if no destroy channel was provided.
+func (d *DAGStore) DestroyStats() NotifyStats {
+	if d.destroys == nil {
+		return NotifyStats{}
+	}
+	return d.destroys.stats()
+}
@@ -0,0 +1,131 @@
+package dagstore
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ipfs/go-cid"
+	carv2 "github.com/ipld/go-car/v2"
+	carindex "github.com/ipld/go-car/v2/index"
+	"github.com/multiformats/go-multihash"
+
+	"github.com/filecoin-project/dagstore/mount"
+)
+
+// loadDetachedIndex decodes the detached index supplied in the registration
+// options, if any. It returns nil if no index was supplied.
+func loadDetachedIndex(opts RegisterOpts) (carindex.IterableIndex, error) {
+	var r io.Reader
+	switch {
+	case opts.DetachedIndex != nil && opts.DetachedIndexPath != "":
+		return nil, fmt.Errorf("%w: both DetachedIndex and DetachedIndexPath supplied", ErrInvalidDetachedIndex)
+	case opts.DetachedIndex != nil:
+		r = bytes.NewReader(opts.DetachedIndex)
+	case opts.DetachedIndexPath != "":
+		f, err := os.Open(opts.DetachedIndexPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open detached index: %w", err)
+		}
+		defer f.Close()
+		r = f
+	default:
+		return nil, nil
+	}
+
+	idx, err := carindex.ReadFrom(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decode: %s", ErrInvalidDetachedIndex, err)
+	}
+	iterable, ok := idx.(carindex.IterableIndex)
+	if !ok {
+		return nil, fmt.Errorf("%w: index of codec %s is not iterable", ErrInvalidDetachedIndex, idx.Codec())
+	}
+	return iterable, nil
+}
+
+// validateDetachedIndex checks a detached index against the fetched CAR of a
+// shard before it's accepted in lieu of generating one. The index must point
+// within the data payload, its lowest offset must be the first section of the
+// payload and hold the indexed block, and it must resolve every root in the
+// CAR header. Blocks past the first section aren't read, so that validation
+// stays much cheaper than indexing.
+func validateDetachedIndex(reader mount.Reader, idx carindex.IterableIndex) error {
+	size, err := reader.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("failed to get shard size: %w", err)
+	}
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind reader: %w", err)
+	}
+	cr, err := carv2.NewReader(reader)
+	if err != nil {
+		return fmt.Errorf("failed to read CAR header: %w", err)
+	}
+	dr, err := cr.DataReader()
+	if err != nil {
+		return fmt.Errorf("failed to read CAR data payload: %w", err)
+	}
+	dataSize := size - int64(cr.Header.DataOffset)
+	if cr.Version == 2 {
+		dataSize = int64(cr.Header.DataSize)
+	}
+
+	// the first section follows the CARv1 header.
+	l, n, err := readUvarintAt(dr, 0)
+	if err != nil {
+		return fmt.Errorf("failed to read CARv1 header length: %w", err)
+	}
+	first := uint64(n) + l
+
+	var (
+		entries int
+		minOff  uint64
+		minHash multihash.Multihash
+	)
+	err = idx.ForEach(func(mh multihash.Multihash, offset uint64) error {
+		if offset >= uint64(dataSize) {
+			return fmt.Errorf("%w: offset %d out of data payload of %d bytes", ErrInvalidDetachedIndex, offset, dataSize)
+		}
+		if entries == 0 || offset < minOff {
+			minOff, minHash = offset, mh
+		}
+		entries++
+		return nil
+	})
+	switch {
+	case err != nil:
+		return err
+	case entries == 0:
+		return fmt.Errorf("%w: index is empty", ErrInvalidDetachedIndex)
+	case minOff != first:
+		return fmt.Errorf("%w: first indexed offset %d isn't the first section at %d", ErrInvalidDetachedIndex, minOff, first)
+	}
+
+	// the first section must hold the block indexed at its offset.
+	_, n, err = readUvarintAt(dr, int64(first))
+	if err != nil {
+		return fmt.Errorf("failed to read first section length: %w", err)
+	}
+	var buf [128]byte
+	read, _ := dr.ReadAt(buf[:], int64(first)+int64(n))
+	_, c, err := cid.CidFromBytes(buf[:read])
+	if err != nil {
+		return fmt.Errorf("failed to read CID of first section: %w", err)
+	}
+	if !bytes.Equal(c.Hash(), minHash) {
+		return fmt.Errorf("%w: first section holds %s, not the indexed block", ErrInvalidDetachedIndex, c)
+	}
+
+	roots, err := cr.Roots()
+	if err != nil {
+		return fmt.Errorf("failed to read CAR roots: %w", err)
+	}
+	for _, root := range roots {
+		if _, err := carindex.GetFirst(idx, root); err != nil {
+			return fmt.Errorf("%w: root %s not indexed: %s", ErrInvalidDetachedIndex, root, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package dagstore
+
+import (
+	"errors"
+	"time"
+)
+
+// DefaultErrorHistorySize is the default value of Config.ErrorHistorySize.
+var DefaultErrorHistorySize = 8
+
+// ShardFailure records a failure of a shard (OpShardFail), so that operators
+// can tell whether a shard keeps failing for the same reasons over time, e.g.
+// because of its mount rather than its index.
+type ShardFailure struct {
+	// Op is the operation that was in progress when the shard failed, i.e.
+	// OpShardInitialize, OpShardRecover, or OpShardAcquire.
+	Op OpType `json:"op"`
+	// At is the time of the failure.
+	At time.Time `json:"at"`
+	// Chain holds the messages of the error chain of the failure, obtained by
+	// unwrapping the error, outermost first. Messages are redacted with
+	// Config.ErrorRedactor, if set.
+	Chain []string `json:"chain"`
+}
+
+// recordFailure appends a failure to the error history of the shard, evicting
+// the oldest one if Config.ErrorHistorySize is exceeded. It must be called from
+// the event loop, before the shard transitions to errored.
+func (d *DAGStore) recordFailure(s *Shard, err error) {
+	f := ShardFailure{Op: failedOp(s.state), At: time.Now()}
+	for ; err != nil; err = errors.Unwrap(err) {
+		// links beneath a redacted error carry the original message, so redact
+		// each of them.
+		f.Chain = append(f.Chain, d.redact(err).Error())
+	}
+	s.failures = append(s.failures, f)
+	if over := len(s.failures) - d.config.ErrorHistorySize; over > 0 {
+		s.failures = append(s.failures[:0:0], s.failures[over:]...)
+	}
+}
+
+// failedOp returns the operation that was in progress when a shard in the
+// given state failed.
+func failedOp(state ShardState) OpType {
+	switch state {
+	case ShardStateNew, ShardStateInitializing:
+		return OpShardInitialize
+	case ShardStateRecovering:
+		return OpShardRecover
+	default:
+		return OpShardAcquire
+	}
+}
@@ -0,0 +1,154 @@
+package dagstore
+
+import (
+	"context"
+	"time"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// DefaultExpirySweepInterval is the default value of
+// Config.ExpirySweepInterval.
+var DefaultExpirySweepInterval = time.Minute
+
+// ExpiryProvider supplies the expiry times of shards to the expiry sweeper,
+// so that applications can declare when shards expire (e.g. when the storage
+// deals they back end) instead of destroying them explicitly.
+type ExpiryProvider interface {
+	// ShardExpiry returns the time after which the shard expires, or the zero
+	// time if it doesn't expire, in which case its TTL applies, if any.
+	ShardExpiry(ctx context.Context, key shard.Key) (time.Time, error)
+}
+
+// ExpiryProviderFunc adapts a function to the ExpiryProvider interface.
+type ExpiryProviderFunc func(ctx context.Context, key shard.Key) (time.Time, error)
+
+func (f ExpiryProviderFunc) ShardExpiry(ctx context.Context, key shard.Key) (time.Time, error) {
+	return f(ctx, key)
+}
+
+// ExpiryAction is what the expiry sweeper does with expired shards.
+type ExpiryAction int
+
+const (
+	// ExpiryDestroy destroys expired shards.
+	ExpiryDestroy ExpiryAction = iota
+
+	// ExpiryArchive archives expired shards: they stay registered and
+	// indexed, but their transients are reclaimed, so that they only take up
+	// local space again if they're acquired.
+	ExpiryArchive
+)
+
+// SweepExpired queues the destruction of all shards past their expiry and
+// grace period (see Config.ExpiryGracePeriod), or archives them if
+// Config.ExpiryAction is ExpiryArchive, and returns their keys. An
+// OpShardExpire trace is emitted for each of them. Shards with active
+// references fail to be destroyed or archived, and are retried on the next
+// sweep. In read-only mode, it's a no-op.
+func (d *DAGStore) SweepExpired() []shard.Key {
+	if d.config.ReadOnly {
+		return nil
+	}
+
+	now := time.Now()
+
+	d.lk.RLock()
+	candidates := make(map[shard.Key]time.Time, len(d.shards))
+	for k, s := range d.shards {
+		candidates[k] = s.expiresAt
+	}
+	d.lk.RUnlock()
+
+	var expired []shard.Key
+	for k, expiresAt := range candidates {
+		if p := d.config.ExpiryProvider; p != nil {
+			at, err := p.ShardExpiry(d.ctx, k)
+			if err != nil {
+				log.Warnw("failed to get shard expiry", "shard", k, "error", err)
+				continue
+			}
+			if !at.IsZero() {
+				expiresAt = at
+			}
+		}
+		if !expiresAt.IsZero() && now.After(expiresAt.Add(d.config.ExpiryGracePeriod)) {
+			expired = append(expired, k)
+		}
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+
+	if d.config.ExpiryAction == ExpiryArchive {
+		return d.archiveExpired(expired)
+	}
+
+	var queued []shard.Key
+	for _, k := range expired {
+		log.Infow("destroying expired shard", "shard", k)
+		d.traceOutOfLoop(Trace{Key: k, Op: OpShardExpire})
+		if err := d.DestroyShard(d.ctx, k, nil, DestroyOpts{}); err != nil {
+			log.Warnw("failed to queue destruction of expired shard", "shard", k, "error", err)
+			continue
+		}
+		queued = append(queued, k)
+	}
+	return queued
+}
+
+// archiveExpired reclaims the transients of expired shards, and returns the
+// keys of the shards archived. Shards that have no transient are already
+// archived, and are skipped.
+func (d *DAGStore) archiveExpired(expired []shard.Key) []shard.Key {
+	toArchive := make(map[shard.Key]struct{}, len(expired))
+	d.lk.RLock()
+	for _, k := range expired {
+		if s, ok := d.shards[k]; ok && s.mount.TransientPath() != "" {
+			toArchive[k] = struct{}{}
+		}
+	}
+	d.lk.RUnlock()
+	if len(toArchive) == 0 {
+		return nil
+	}
+
+	res, err := d.requestGC(d.ctx, &gcRequest{filter: func(k shard.Key) bool {
+		_, ok := toArchive[k]
+		return ok
+	}})
+	if err != nil {
+		log.Warnw("failed to archive expired shards", "error", err)
+		return nil
+	}
+
+	var archived []shard.Key
+	for k, err := range res.Shards {
+		if err != nil {
+			log.Warnw("failed to archive expired shard", "shard", k, "error", err)
+			continue
+		}
+		log.Infow("archived expired shard", "shard", k)
+		d.traceOutOfLoop(Trace{Key: k, Op: OpShardExpire})
+		archived = append(archived, k)
+	}
+	return archived
+}
+
+// sweepExpired periodically destroys or archives expired shards, until the DAG store is
+// closed.
+func (d *DAGStore) sweepExpired() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(d.config.ExpirySweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.SweepExpired()
+		case <-d.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package dagstore
+
+import (
+	"context"
+	"sync"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// DefaultFailureBufferSize is the default value of Config.FailureBufferSize.
+var DefaultFailureBufferSize = 128
+
+// NotifyStats are statistics about the notifications sent to the application
+// through a notification channel, e.g. Config.FailureCh or Config.DestroyCh.
+type NotifyStats struct {
+	// Pending is the number of notifications buffered, waiting for the
+	// application to consume them.
+	Pending int
+	// Delivered is the number of notifications delivered to the application.
+	Delivered uint64
+	// Dropped is the number of notifications discarded because the buffer was
+	// full.
+	Dropped uint64
+}
+
+// notifySink buffers notifications for delivery to the application, so that
+// a stalled consumer never blocks the event loop. When the buffer is full, the
+// oldest notification is dropped in favour of the newest, so that recent
+// events are always delivered. It backs Config.FailureCh and
+// Config.DestroyCh.
+type notifySink struct {
+	kind      string // kind of notifications, for logging.
+	lk        sync.Mutex
+	pending   []notification
+	max       int
+	delivered uint64
+	dropped   uint64
+
+	signal chan struct{} // signals the dispatcher that notifications were pushed.
+}
+
+// notification is a notification buffered by a notifySink.
+type notification struct {
+	key shard.Key
+	v   interface{}
+}
+
+func newNotifySink(kind string, max int) *notifySink {
+	return &notifySink{kind: kind, max: max, signal: make(chan struct{}, 1)}
+}
+
+// push buffers a notification without blocking, dropping the oldest one if
+// the buffer is full.
+func (f *notifySink) push(key shard.Key, v interface{}) {
+	f.lk.Lock()
+	if len(f.pending) >= f.max {
+		dropped := f.pending[0]
+		f.pending[0] = notification{}
+		f.pending = f.pending[1:]
+		f.dropped++
+		log.Warnw("notification buffer full; dropped oldest notification", "kind", f.kind, "shard", dropped.key, "dropped", f.dropped)
+	}
+	f.pending = append(f.pending, notification{key: key, v: v})
+	f.lk.Unlock()
+
+	select {
+	case f.signal <- struct{}{}:
+	default:
+	}
+}
+
+// pop removes the oldest buffered notification, or returns nil if the buffer
+// is empty.
+func (f *notifySink) pop() interface{} {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	if len(f.pending) == 0 {
+		return nil
+	}
+	n := f.pending[0]
+	f.pending[0] = notification{}
+	f.pending = f.pending[1:]
+	return n.v
+}
+
+func (f *notifySink) markDelivered() {
+	f.lk.Lock()
+	f.delivered++
+	f.lk.Unlock()
+}
+
+func (f *notifySink) stats() NotifyStats {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	return NotifyStats{
+		Pending:   len(f.pending),
+		Delivered: f.delivered,
+		Dropped:   f.dropped,
+	}
+}
+
+// dispatch delivers the notifications buffered in the sink to the application
+// in order, by calling send, until the DAG store is closed. send returns false
+// if the DAG store was closed before the notification was delivered.
+func (f *notifySink) dispatch(ctx context.Context, send func(v interface{}) bool) {
+	for {
+		v := f.pop()
+		if v == nil {
+			select {
+			case <-f.signal:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		if !send(v) {
+			return
+		}
+		f.markDelivered()
+	}
+}
+
+// notifyFailure notifies the application of a shard failure, if it provided a
+// failure channel. It never blocks.
+func (d *DAGStore) notifyFailure(res *ShardResult) {
+	if d.failures == nil {
+		return
+	}
+	d.failures.push(res.Key, res)
+}
+
+// failureDispatcher delivers buffered failure notifications to the
+// application in order, until the DAG store is closed.
+func (d *DAGStore) failureDispatcher() {
+	defer d.wg.Done()
+
+	d.failures.dispatch(d.ctx, func(v interface{}) bool {
+		select {
+		case d.failureCh <- *v.(*ShardResult):
+			return true
+		case <-d.ctx.Done():
+			return false
+		}
+	})
+}
+
+// FailureStats returns statistics about the notifications of shard failures,
+// or zero values if no failure channel was provided.
+func (d *DAGStore) FailureStats() NotifyStats {
+	if d.failures == nil {
+		return NotifyStats{}
+	}
+	return d.failures.stats()
+}
@@ -1,19 +1,105 @@
 package dagstore
 
 import (
+	"errors"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/filecoin-project/dagstore/shard"
 )
 
+// GCSkipReason explains why GC did not (or would not) reclaim the transient
+// of a shard.
+type GCSkipReason int
+
+const (
+	// GCNotSkipped indicates that the transient of the shard is reclaimable.
+	GCNotSkipped GCSkipReason = iota
+
+	// GCSkipActiveRefs indicates that the shard has active acquirers.
+	GCSkipActiveRefs
+
+	// GCSkipFetchInProgress indicates that the shard is being initialized or
+	// recovered, or that it has acquirers waiting for it to become available.
+	GCSkipFetchInProgress
+
+	// GCSkipNotInitialized indicates that the shard has been registered but
+	// has not been initialized yet.
+	GCSkipNotInitialized
+
+	// GCSkipWithinTarget indicates that the transient is reclaimable, but
+	// was kept because GCToTarget met its target by evicting colder shards.
+	GCSkipWithinTarget
+
+	// GCSkipReadOnly indicates that the DAG store is read-only, and leaves the
+	// transients to the writer node that owns them (see Config.ReadOnly).
+	GCSkipReadOnly
+)
+
+func (r GCSkipReason) String() string {
+	return [...]string{
+		"GCNotSkipped",
+		"GCSkipActiveRefs",
+		"GCSkipFetchInProgress",
+		"GCSkipNotInitialized",
+		"GCSkipWithinTarget",
+		"GCSkipReadOnly"}[r]
+}
+
+// GCShardReport describes the outcome of GC for a single shard.
+type GCShardReport struct {
+	// Reclaimable indicates whether the transient of the shard can be
+	// reclaimed. If false, SkipReason explains why not.
+	Reclaimable bool
+	SkipReason  GCSkipReason
+
+	// Errored indicates that the shard was in the errored state.
+	Errored bool
+
+	// TransientSize is the size in bytes of the transient of the shard, or 0 if
+	// the shard had no transient.
+	TransientSize int64
+
+	// Demote indicates that the reclaimable transient lives in the hot tier,
+	// and is (or would be) demoted to the warm tier in the background instead
+	// of being deleted.
+	Demote bool
+}
+
 // GCResult is the result of performing a GC operation. It holds the results
 // from deleting unused transients.
 type GCResult struct {
 	// Shards includes an entry for every shard whose transient was reclaimed.
-	// Nil error values indicate success.
+	// Nil error values indicate success. It is empty on dry runs.
 	Shards map[shard.Key]error
+
+	// Report includes an entry for every shard known to the DAG store,
+	// describing whether its transient was (or would be, on a dry run)
+	// reclaimed, and why not if it wasn't.
+	Report map[shard.Key]GCShardReport
+
+	// DryRun is true if this result was produced by a dry run, in which case
+	// no transients were deleted.
+	DryRun bool
+
+	// Reclaimed is the number of shards whose transient was (or would be)
+	// reclaimed successfully.
+	Reclaimed int
+
+	// Failed is the number of shards whose transient reclaim failed.
+	Failed int
+
+	// ReclaimedBytes is the total number of bytes that were (or would be)
+	// freed.
+	ReclaimedBytes int64
+
+	// Demoted is the number of shards whose transient was (or would be)
+	// scheduled to be demoted from the hot tier to the warm tier; demotions
+	// complete in the background, and are skipped for shards acquired in the
+	// meantime. Demoted transients are not counted as reclaimed.
+	Demoted int
 }
 
 // ShardFailures returns the number of shards whose transient reclaim failed.
@@ -27,52 +113,143 @@ func (e *GCResult) ShardFailures() int {
 	return failures
 }
 
+// gcRequest is a request to perform GC, sent to the event loop.
+type gcRequest struct {
+	dryRun bool
+	// filter, if non-nil, restricts GC to the shards it returns true for.
+	filter func(shard.Key) bool
+	// bounded restricts GC to the coldest shards that need to be evicted for
+	// transients to take up at most target bytes.
+	bounded bool
+	target  int64
+	resCh   chan *GCResult
+}
+
 // gc performs DAGStore GC. Refer to DAGStore#GC for more information.
 //
 // The event loops gives it exclusive execution rights, so while GC is running,
 // no other events are being processed.
-func (d *DAGStore) gc(resCh chan *GCResult) {
+func (d *DAGStore) gc(req *gcRequest) {
 	res := &GCResult{
 		Shards: make(map[shard.Key]error),
+		Report: make(map[shard.Key]GCShardReport),
+		DryRun: req.dryRun,
 	}
 
 	// determine which shards can be reclaimed.
 	d.lk.RLock()
 	var reclaim []*Shard
+	scores := make(map[shard.Key]float64)
+	now := time.Now()
 	for _, s := range d.shards {
+		if req.filter != nil && !req.filter(s.key) {
+			continue
+		}
 		s.lk.RLock()
-		if nAcq := len(s.wAcquire); (s.state == ShardStateAvailable || s.state == ShardStateErrored) && nAcq == 0 {
-			reclaim = append(reclaim, s)
+		report := d.gcReport(s)
+		report.Demote = report.Reclaimable && d.transientTier(s) == TierHot
+		if req.bounded {
+			scores[s.key] = evictionScore(s, now, d.config.GCRecencyHalfLife)
 		}
 		s.lk.RUnlock()
+
+		res.Report[s.key] = report
+		if report.Reclaimable {
+			reclaim = append(reclaim, s)
+		}
 	}
 	d.lk.RUnlock()
 
+	if req.bounded {
+		reclaim = selectEvictions(reclaim, scores, res.Report, req.target)
+	}
+
+	if req.dryRun {
+		for _, s := range reclaim {
+			if res.Report[s.key].Demote {
+				res.Demoted++
+				continue
+			}
+			res.Reclaimed++
+			res.ReclaimedBytes += res.Report[s.key].TransientSize
+		}
+		select {
+		case req.resCh <- res:
+		case <-d.ctx.Done():
+		}
+		return
+	}
+
 	// attempt to delete transients of reclaimed shards.
 	for _, s := range reclaim {
 		// only read lock: we're not modifying state, and the mount has its own lock.
 		s.lk.RLock()
-		err := s.mount.DeleteTransient()
-		if err != nil {
-			log.Warnw("failed to delete transient", "shard", s.key, "error", err)
+		var err error
+		switch {
+		case res.Report[s.key].Demote:
+			// the transient is copied in the background, so as not to stall
+			// the event loops for the duration of the copy.
+			if d.queueTierJob(tierJob{s: s, to: TierWarm}) {
+				res.Demoted++
+			} else {
+				err = errors.New("failed to schedule demotion of transient: tier queue is full")
+				res.Failed++
+			}
+		default:
+			if err = s.mount.DeleteTransient(); err != nil {
+				log.Warnw("failed to delete transient", "shard", s.key, "error", err)
+				res.Failed++
+			} else {
+				res.Reclaimed++
+				res.ReclaimedBytes += res.Report[s.key].TransientSize
+			}
 		}
 
 		// record the error so we can return it.
 		res.Shards[s.key] = err
 
-		// flush the shard state to the datastore.
-		if err := s.persist(d.ctx, d.config.Datastore); err != nil {
-			log.Warnw("failed to persist shard", "shard", s.key, "error", err)
+		// flush the shard state to the datastore, unless the writer node owns
+		// it.
+		if !d.config.ReadOnly && !d.isFenced() {
+			if err := s.persist(d.ctx, d.config.Datastore); err != nil {
+				log.Warnw("failed to persist shard", "shard", s.key, "error", err)
+			}
 		}
 		s.lk.RUnlock()
 	}
+	d.recordGC(res)
 
 	select {
-	case resCh <- res:
+	case req.resCh <- res:
 	case <-d.ctx.Done():
 	}
 }
 
+// gcReport determines whether the transient of a shard is reclaimable. It
+// must be called with the shard lock held.
+func (d *DAGStore) gcReport(s *Shard) GCShardReport {
+	report := GCShardReport{Errored: s.state == ShardStateErrored}
+	switch {
+	case s.state == ShardStateServing || s.refs > 0:
+		report.SkipReason = GCSkipActiveRefs
+	case len(s.wAcquire) > 0 || s.state == ShardStateInitializing || s.state == ShardStateRecovering:
+		report.SkipReason = GCSkipFetchInProgress
+	case s.state == ShardStateNew:
+		report.SkipReason = GCSkipNotInitialized
+	case d.config.ReadOnly:
+		report.SkipReason = GCSkipReadOnly
+	case s.state == ShardStateAvailable || s.state == ShardStateErrored:
+		report.Reclaimable = true
+	}
+
+	if path := s.mount.TransientPath(); path != "" {
+		if fi, err := os.Stat(path); err == nil {
+			report.TransientSize = fi.Size()
+		}
+	}
+	return report
+}
+
 // clearOrphaned removes files that are not referenced by any mount.
 //
 // This is only safe to be called from the constructor, before we have
@@ -85,20 +262,28 @@ func (d *DAGStore) clearOrphaned() error {
 		referenced[t] = struct{}{}
 	}
 
-	// Walk the transients dir and delete unreferenced files.
-	err := filepath.WalkDir(d.config.TransientsDir, func(path string, d fs.DirEntry, err error) error {
-		if d.IsDir() {
-			return nil
-		}
-		if _, ok := referenced[path]; !ok {
-			if err := os.Remove(path); err != nil {
-				log.Warnw("failed to delete orphaned file", "path", path, "error", err)
-			} else {
-				log.Infow("deleted orphaned file", "path", path)
+	// Walk the transients dirs and delete unreferenced files.
+	dirs := []string{d.config.TransientsDir}
+	if d.tieringEnabled() {
+		dirs = append(dirs, d.config.HotTransientsDir)
+	}
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if d.IsDir() {
+				return nil
 			}
+			if _, ok := referenced[path]; !ok {
+				if err := os.Remove(path); err != nil {
+					log.Warnw("failed to delete orphaned file", "path", path, "error", err)
+				} else {
+					log.Infow("deleted orphaned file", "path", path)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
 		}
-		return nil
-	})
-
-	return err
+	}
+	return nil
 }
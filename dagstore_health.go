@@ -0,0 +1,257 @@
+package dagstore
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/dagstore/mount"
+)
+
+// DefaultMountHealthSampleSize is the default value of
+// Config.MountHealthSampleSize.
+var DefaultMountHealthSampleSize = 3
+
+// DegradedMountPolicy specifies how acquires of shards whose mount is degraded
+// are handled.
+type DegradedMountPolicy int
+
+const (
+	// DegradedMountIgnore acquires shards regardless of the health of their
+	// mount.
+	DegradedMountIgnore DegradedMountPolicy = iota
+
+	// DegradedMountFailFast fails acquires that need to fetch from a
+	// degraded mount with ErrMountDegraded, instead of waiting for the fetch
+	// to fail.
+	DegradedMountFailFast
+
+	// DegradedMountQueue parks acquires that need to fetch from a degraded
+	// mount until it's healthy again, or their context is cancelled. It
+	// requires Config.MountHealthCheckInterval, as only probes find that the
+	// mount healed.
+	DegradedMountQueue
+)
+
+// MountHealth is the health of the mounts of a type and endpoint, as seen by
+// the last probe.
+type MountHealth struct {
+	// Degraded is true if all probed mounts failed.
+	Degraded bool
+	// Shards is the number of shards backed by mounts of this type and
+	// endpoint.
+	Shards int
+	// Probed and Failed are the number of mounts probed, and the number of
+	// those that failed.
+	Probed int
+	Failed int
+	// LastError is the last error of a failed probe, if any.
+	LastError error
+	// LastChecked is the time of the last probe.
+	LastChecked time.Time
+}
+
+// mountHealth tracks the health of mounts, keyed by mount group (see
+// DAGStore.mountGroup).
+type mountHealth struct {
+	lk     sync.RWMutex
+	groups map[string]MountHealth
+	// healed is closed and replaced whenever a degraded group recovers, to
+	// wake up parked acquirers.
+	healed chan struct{}
+}
+
+func newMountHealth() *mountHealth {
+	return &mountHealth{groups: make(map[string]MountHealth), healed: make(chan struct{})}
+}
+
+func (h *mountHealth) degraded(group string) bool {
+	h.lk.RLock()
+	defer h.lk.RUnlock()
+
+	return h.groups[group].Degraded
+}
+
+// update replaces the health of all groups.
+func (h *mountHealth) update(groups map[string]MountHealth) {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	var healed bool
+	for group, prev := range h.groups {
+		if cur := groups[group]; prev.Degraded && !cur.Degraded {
+			log.Infow("mount no longer degraded", "mount", group)
+			healed = true
+		}
+	}
+	for group, cur := range groups {
+		if cur.Degraded && !h.groups[group].Degraded {
+			log.Warnw("mount degraded", "mount", group, "error", cur.LastError)
+		}
+	}
+	h.groups = groups
+	if healed {
+		close(h.healed)
+		h.healed = make(chan struct{})
+	}
+}
+
+// waitHealthy blocks until the group is no longer degraded, or the context is
+// cancelled.
+func (h *mountHealth) waitHealthy(ctx context.Context, group string) error {
+	for {
+		h.lk.RLock()
+		degraded, healed := h.groups[group].Degraded, h.healed
+		h.lk.RUnlock()
+
+		if !degraded {
+			return nil
+		}
+		select {
+		case <-healed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// mountGroup returns the type and endpoint of the mount of a shard, which
+// mounts are grouped by for health checks, e.g. "http://host:port".
+func (d *DAGStore) mountGroup(s *Shard) string {
+	u, err := d.mounts.Represent(s.mount)
+	if err != nil {
+		return fmt.Sprintf("%T", mount.Unwrap(s.mount.Underlying()))
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// CheckMountHealth probes a random sample of Config.MountHealthSampleSize
+// mounts of each type and endpoint by calling Stat on them, and marks a group
+// of mounts degraded if all probes fail. It's called periodically if
+// Config.MountHealthCheckInterval is set.
+func (d *DAGStore) CheckMountHealth(ctx context.Context) map[string]MountHealth {
+	d.lk.RLock()
+	byGroup := make(map[string][]*Shard)
+	for _, s := range d.shards {
+		g := d.mountGroup(s)
+		byGroup[g] = append(byGroup[g], s)
+	}
+	d.lk.RUnlock()
+
+	var (
+		wg  sync.WaitGroup
+		lk  sync.Mutex
+		ret = make(map[string]MountHealth, len(byGroup))
+	)
+	for g, shards := range byGroup {
+		g, shards := g, shards
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h := d.probeMountGroup(ctx, g, shards)
+			lk.Lock()
+			ret[g] = h
+			lk.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	d.health.update(ret)
+	return ret
+}
+
+// probeMountGroup probes a random sample of Config.MountHealthSampleSize of
+// the mounts of the supplied shards, which belong to the same group, by
+// calling Stat on them concurrently. The order of shards may be shuffled.
+func (d *DAGStore) probeMountGroup(ctx context.Context, g string, shards []*Shard) MountHealth {
+	sample := shards
+	if n := d.config.MountHealthSampleSize; len(sample) > n {
+		rand.Shuffle(len(sample), func(i, j int) { sample[i], sample[j] = sample[j], sample[i] })
+		sample = sample[:n]
+	}
+
+	var (
+		wg sync.WaitGroup
+		lk sync.Mutex
+		h  = MountHealth{Shards: len(shards), Probed: len(sample)}
+	)
+	for _, s := range sample {
+		s := s
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, err := s.mount.Underlying().Stat(ctx)
+
+			lk.Lock()
+			defer lk.Unlock()
+			if err != nil {
+				log.Debugw("mount health probe failed", "mount", g, "shard", s.key, "error", err)
+				h.Failed++
+				h.LastError = err
+			}
+		}()
+	}
+	wg.Wait()
+
+	h.Degraded = h.Probed > 0 && h.Failed == h.Probed
+	h.LastChecked = time.Now()
+	return h
+}
+
+// MountHealth returns the health of mounts by type and endpoint, as seen by
+// the last call to CheckMountHealth.
+func (d *DAGStore) MountHealth() map[string]MountHealth {
+	d.health.lk.RLock()
+	defer d.health.lk.RUnlock()
+
+	ret := make(map[string]MountHealth, len(d.health.groups))
+	for g, h := range d.health.groups {
+		ret[g] = h
+	}
+	return ret
+}
+
+// checkMountHealth applies Config.DegradedMountPolicy to an acquirer about to
+// fetch from the mount of a shard. Acquirers served from a local transient
+// don't need the mount, and proceed regardless.
+func (d *DAGStore) checkMountHealth(ctx context.Context, s *Shard) error {
+	if d.config.DegradedMountPolicy == DegradedMountIgnore {
+		return nil
+	}
+	if !s.mount.Passthrough() && s.mount.TransientPath() != "" {
+		return nil
+	}
+
+	g := d.mountGroup(s)
+	if !d.health.degraded(g) {
+		return nil
+	}
+	if d.config.DegradedMountPolicy == DegradedMountFailFast {
+		return fmt.Errorf("%s: %w: %s", s.key.String(), ErrMountDegraded, g)
+	}
+	log.Debugw("mount degraded; parking acquirer until it's healthy", "shard", s.key, "mount", g)
+	return d.health.waitHealthy(ctx, g)
+}
+
+// probeMounts periodically checks the health of mounts, until the DAG store
+// is closed.
+func (d *DAGStore) probeMounts() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(d.config.MountHealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(d.ctx, d.config.MountHealthCheckInterval)
+			d.CheckMountHealth(ctx)
+			cancel()
+		case <-d.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package dagstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// ShardEvent is an entry in the journal of a shard, recording a state
+// transition.
+type ShardEvent struct {
+	// Op is the operation that caused the transition.
+	Op OpType `json:"op"`
+	// PrevState is the state of the shard before the operation.
+	PrevState ShardState `json:"prev"`
+	// NewState is the state of the shard after the operation.
+	NewState ShardState `json:"new"`
+	// Error is the error that caused the transition, if any.
+	Error string `json:"err,omitempty"`
+	// Time is the time at which the transition occurred.
+	Time time.Time `json:"t"`
+}
+
+// recordTransition appends an event to the journal of the shard if the
+// operation changed its state or carried an error, trimming the journal to
+// Config.HistorySize entries and persisting it. It must be called from the
+// event loop.
+func (d *DAGStore) recordTransition(s *Shard, op OpType, prev ShardState, err error) {
+	if d.config.HistorySize <= 0 || d.config.ReadOnly || op == OpShardDestroy {
+		return
+	}
+	if prev == s.state && err == nil {
+		return
+	}
+
+	evt := ShardEvent{Op: op, PrevState: prev, NewState: s.state, Time: time.Now()}
+	if err != nil {
+		evt.Error = err.Error()
+	}
+	s.history = append(s.history, evt)
+	if excess := len(s.history) - d.config.HistorySize; excess > 0 {
+		s.history = append(s.history[:0:0], s.history[excess:]...)
+	}
+
+	bz, err := json.Marshal(s.history)
+	if err != nil {
+		log.Warnw("failed to serialize shard history", "shard", s.key, "error", err)
+		return
+	}
+	if err := d.history.Put(d.ctx, ds.NewKey(s.key.String()), bz); err != nil {
+		log.Warnw("failed to persist shard history", "shard", s.key, "error", err)
+	}
+}
+
+// restoreHistory loads the persisted journal of a shard being restored.
+func (d *DAGStore) restoreHistory(s *Shard) {
+	if d.config.HistorySize <= 0 {
+		return
+	}
+	bz, err := d.history.Get(d.ctx, ds.NewKey(s.key.String()))
+	if err != nil {
+		if err != ds.ErrNotFound {
+			log.Warnw("failed to load shard history", "shard", s.key, "error", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(bz, &s.history); err != nil {
+		log.Warnw("failed to deserialize shard history", "shard", s.key, "error", err)
+		s.history = nil
+		return
+	}
+	if excess := len(s.history) - d.config.HistorySize; excess > 0 {
+		s.history = s.history[excess:]
+	}
+}
+
+// dropHistory deletes the persisted journal of a destroyed shard.
+func (d *DAGStore) dropHistory(s *Shard) {
+	if err := d.history.Delete(d.ctx, ds.NewKey(s.key.String())); err != nil {
+		log.Warnw("failed to delete shard history", "shard", s.key, "error", err)
+	}
+}
+
+// ShardHistory returns the most recent state transitions of a shard, oldest
+// first, as journaled when Config.HistorySize is set. The journal survives
+// restarts, so it can be used to find out why a shard errored after the fact.
+func (d *DAGStore) ShardHistory(key shard.Key) ([]ShardEvent, error) {
+	if d.config.HistorySize <= 0 {
+		return nil, fmt.Errorf("shard history is not enabled")
+	}
+
+	d.lk.RLock()
+	s, ok := d.shards[key]
+	d.lk.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", key.String(), ErrShardUnknown)
+	}
+
+	s.lk.RLock()
+	defer s.lk.RUnlock()
+	return append([]ShardEvent(nil), s.history...), nil
+}
@@ -0,0 +1,99 @@
+package dagstore
+
+import (
+	"fmt"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// OpHook lets applications implement custom policies around shard operations,
+// such as vetoing destroys, annotating metrics, or alerting on repeated
+// failures, without forking the event loop.
+//
+// Hooks are called synchronously by the event loop, with the shard locked, so
+// they must return quickly and must not call back into the DAG store.
+type OpHook interface {
+	// BeforeOp is called before the event loop processes an operation, with
+	// a snapshot of the shard. Returning an error vetoes acquires, recoveries
+	// and destroys: the operation is skipped, and its caller receives an error
+	// wrapping ErrOpVetoed. Errors returned for other operations, which drive
+	// the internal state machine, are logged and ignored.
+	BeforeOp(op OpType, key shard.Key, before ShardInfo) error
+
+	// AfterOp is called after the event loop processed an operation, with a
+	// snapshot of the shard. err is the veto, if the operation was vetoed, or
+	// otherwise the error carried by the operation (e.g. the cause of an
+	// OpShardFail).
+	AfterOp(op OpType, key shard.Key, after ShardInfo, err error)
+}
+
+// OpHookFuncs is an OpHook implemented by functions. Nil functions are
+// skipped.
+type OpHookFuncs struct {
+	Before func(op OpType, key shard.Key, before ShardInfo) error
+	After  func(op OpType, key shard.Key, after ShardInfo, err error)
+}
+
+var _ OpHook = OpHookFuncs{}
+
+func (f OpHookFuncs) BeforeOp(op OpType, key shard.Key, before ShardInfo) error {
+	if f.Before == nil {
+		return nil
+	}
+	return f.Before(op, key, before)
+}
+
+func (f OpHookFuncs) AfterOp(op OpType, key shard.Key, after ShardInfo, err error) {
+	if f.After != nil {
+		f.After(op, key, after, err)
+	}
+}
+
+// vetoable returns whether hooks can veto an operation.
+func vetoable(op OpType) bool {
+	switch op {
+	case OpShardAcquire, OpShardRecover, OpShardDestroy:
+		return true
+	default:
+		return false
+	}
+}
+
+// beforeOp runs the BeforeOp hooks for a task, stopping at the first veto. It
+// returns the error to fail the operation with, if it was vetoed. It must be
+// called with the shard lock held.
+func (d *DAGStore) beforeOp(s *Shard, tsk *task) error {
+	if len(d.config.OpHooks) == 0 {
+		return nil
+	}
+	info := d.shardInfo(s)
+	for _, h := range d.config.OpHooks {
+		err := h.BeforeOp(tsk.op, s.key, info)
+		if err == nil {
+			continue
+		}
+		if !vetoable(tsk.op) {
+			log.Warnw("ignored veto of operation", "op", tsk.op, "shard", s.key, "error", err)
+			continue
+		}
+		log.Infow("operation vetoed", "op", tsk.op, "shard", s.key, "error", err)
+		return fmt.Errorf("%s: %w: %s", s.key.String(), ErrOpVetoed, err)
+	}
+	return nil
+}
+
+// afterOp runs the AfterOp hooks for a task. It must be called with the shard
+// lock held.
+func (d *DAGStore) afterOp(s *Shard, tsk *task, vetoErr error) {
+	if len(d.config.OpHooks) == 0 {
+		return
+	}
+	err := vetoErr
+	if err == nil {
+		err = tsk.err
+	}
+	info := d.shardInfo(s)
+	for _, h := range d.config.OpHooks {
+		h.AfterOp(tsk.op, s.key, info, err)
+	}
+}
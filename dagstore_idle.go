@@ -0,0 +1,70 @@
+package dagstore
+
+import (
+	"time"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// ShardIdleFunc is called when the last active reference to a shard is
+// released (see Config.OnShardIdle).
+type ShardIdleFunc func(key shard.Key)
+
+// shardIdle runs when the refcount of a shard drops to zero: it calls
+// Config.OnShardIdle, and arms the idle reclamation timer, if enabled. It must
+// be called from the event loop.
+func (d *DAGStore) shardIdle(s *Shard) {
+	if fn := d.config.OnShardIdle; fn != nil {
+		fn(s.key)
+	}
+
+	timeout := d.config.IdleReclaimTimeout
+	if timeout <= 0 || d.config.ReadOnly {
+		return
+	}
+	s.stopIdleTimer()
+	var t *time.Timer
+	t = time.AfterFunc(timeout, func() {
+		s.lk.RLock()
+		idle := s.idleTimer == t && s.refs == 0
+		s.lk.RUnlock()
+		if !idle {
+			return // acquired again since.
+		}
+		_ = d.queueTask(&task{op: OpShardReclaim, shard: s}, d.externalCh)
+	})
+	s.idleTimer = t
+}
+
+// reclaimIdle reclaims the transient of a shard that has been idle for
+// Config.IdleReclaimTimeout, demoting it instead if it's in the hot tier. It
+// must be called from the event loop, with the shard lock held, and leaves the
+// shard alone if it was acquired or changed state in the meantime.
+func (d *DAGStore) reclaimIdle(s *Shard) {
+	if s.destroyed || s.idleTimer == nil || !d.gcReport(s).Reclaimable {
+		return
+	}
+	s.idleTimer = nil
+	switch {
+	case d.transientTier(s) == TierHot:
+		if !d.queueTierJob(tierJob{s: s, to: TierWarm}) {
+			log.Warnw("idle reclaim: failed to schedule demotion of transient: tier queue is full", "shard", s.key)
+		}
+	case s.mount.TransientPath() == "":
+	default:
+		if err := s.mount.DeleteTransient(); err != nil {
+			log.Warnw("idle reclaim: failed to reclaim transient of idle shard", "shard", s.key, "error", err)
+			return
+		}
+		log.Debugw("idle reclaim: reclaimed transient of idle shard", "shard", s.key)
+	}
+}
+
+// stopIdleTimer disarms the idle reclamation timer of the shard, if any. It
+// must be called with the shard lock held.
+func (s *Shard) stopIdleTimer() {
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+		s.idleTimer = nil
+	}
+}
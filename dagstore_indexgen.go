@@ -0,0 +1,323 @@
+package dagstore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2"
+	carindex "github.com/ipld/go-car/v2/index"
+
+	"github.com/filecoin-project/dagstore/index"
+	"github.com/filecoin-project/dagstore/mount"
+)
+
+// indexChunkSize is the minimum size of the chunks of a CAR data payload that
+// are scanned in parallel when generating indices (see Config.IndexWorkers).
+// CARs smaller than two chunks are indexed sequentially.
+var indexChunkSize = int64(64 << 20)
+
+// boundaryWindow is the number of bytes at the start of a chunk that are
+// searched for the first section of the chunk. Chunks whose first section
+// isn't found in the window are scanned sequentially while merging.
+const boundaryWindow = 256 << 10
+
+// maxCIDLength bounds the length of the CIDs read from section heads, so that
+// garbage read while searching for sections doesn't cause huge allocations.
+const maxCIDLength = 4096
+
+// generateIndex reads the index of a CAR, or generates it if the CAR doesn't
+// embed one. With Config.IndexWorkers, the sections of large CARs are scanned
+// by parallel workers; with Config.IndexMemoryBudget, the index is built
+// within the budget.
+func (d *DAGStore) generateIndex(reader mount.Reader) (carindex.Index, error) {
+	opts := []car.Option{car.ZeroLengthSectionAsEOF(true), car.StoreIdentityCIDs(true)}
+	bounded := d.config.IndexMemoryBudget > 0
+	if d.config.IndexWorkers <= 1 && !bounded {
+		return car.ReadOrGenerateIndex(reader, opts...)
+	}
+
+	pos, err := reader.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get reader position: %w", err)
+	}
+	size, err := reader.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get shard size: %w", err)
+	}
+	if _, err := reader.Seek(pos, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to rewind reader: %w", err)
+	}
+	cr, err := car.NewReader(reader, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CAR header: %w", err)
+	}
+	dataSize := size - int64(cr.Header.DataOffset)
+	if cr.Version == 2 {
+		if cr.Header.HasIndex() {
+			// read the embedded index.
+			return car.ReadOrGenerateIndex(reader, opts...)
+		}
+		dataSize = int64(cr.Header.DataSize)
+	}
+	if dataSize < 2*indexChunkSize && !bounded {
+		return car.ReadOrGenerateIndex(reader, opts...)
+	}
+
+	dr, err := cr.DataReader()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CAR data payload: %w", err)
+	}
+	if bounded {
+		return buildIndexBounded(dr, dataSize, d.config.IndexMemoryBudget, d.config.TransientsDir)
+	}
+	records, err := scanSectionsParallel(dr, dataSize, d.config.IndexWorkers)
+	if err != nil {
+		return nil, err
+	}
+	idx := carindex.NewMultihashSorted()
+	if err := idx.Load(records); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// buildIndexBounded generates the index of a CARv1 data payload of the given
+// size by walking its sections sequentially, building it within the memory
+// budget.
+func buildIndexBounded(r io.ReaderAt, size, budget int64, tmpdir string) (carindex.Index, error) {
+	b := index.NewBoundedBuilder(budget, tmpdir)
+	defer b.Close() //nolint:errcheck
+
+	// skip the CARv1 header.
+	l, n, err := readUvarintAt(r, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CARv1 header length: %w", err)
+	}
+	for off := int64(n) + int64(l); ; {
+		c, next, err := readSection(r, off, size)
+		if err != nil {
+			return nil, err
+		}
+		if next < 0 {
+			break
+		}
+		if err := b.Add(c, uint64(off)); err != nil {
+			return nil, fmt.Errorf("failed to add record at offset %d: %w", off, err)
+		}
+		off = next
+	}
+	if s := b.Spilled(); s > 0 {
+		log.Debugw("index generation exceeded memory budget; merged spilled records", "budget", budget, "runs", s)
+	}
+	return b.Build()
+}
+
+// chainScan is the result of walking a chain of sections of a chunk of a
+// CAR data payload.
+type chainScan struct {
+	records []carindex.Record // in offset order.
+	stop    int64             // offset of the first section past the chunk, or the size of the payload at EOF.
+}
+
+// scanSectionsParallel returns the records of all the sections of a CARv1
+// data payload of the given size, scanning it in parallel chunks.
+//
+// Sections can only be located by walking the chain of sections from the
+// start of the payload, so every worker but the first speculatively starts at
+// the first position of its chunk that looks like a section. The chains are
+// then merged sequentially: the true chain, coming from the previous chunk,
+// is walked until it reaches a section found by the worker of the next chunk,
+// whose records are then taken as they are. If the worker started from a
+// false boundary, its chain never meets the true chain, and the chunk ends up
+// walked sequentially, so the result is always correct.
+func scanSectionsParallel(r io.ReaderAt, size int64, workers int) ([]carindex.Record, error) {
+	// skip the CARv1 header.
+	l, n, err := readUvarintAt(r, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CARv1 header length: %w", err)
+	}
+	first := int64(n) + int64(l)
+
+	chunks := int(size / indexChunkSize)
+	if chunks > workers {
+		chunks = workers
+	}
+	ends := make([]int64, chunks)
+	for i := range ends {
+		ends[i] = size / int64(chunks) * int64(i+1)
+	}
+	ends[chunks-1] = size
+
+	scans := make([]chainScan, chunks)
+	errs := make([]error, chunks)
+	var wg sync.WaitGroup
+	for i := 0; i < chunks; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i == 0 {
+				scans[i], errs[i] = scanChain(r, first, ends[i], size)
+				return
+			}
+			start, ok := findBoundary(r, ends[i-1], ends[i], size)
+			if !ok {
+				return
+			}
+			// a chain from a false boundary is likely to run into garbage;
+			// discard it, and let the merge walk the chunk.
+			if scan, err := scanChain(r, start, ends[i], size); err == nil {
+				scans[i] = scan
+			}
+		}(i)
+	}
+	wg.Wait()
+	if errs[0] != nil {
+		return nil, errs[0]
+	}
+
+	records := scans[0].records
+	pos := scans[0].stop
+	for i := 1; i < chunks && pos < size; i++ {
+		scan := scans[i]
+		for pos < size {
+			if j := sort.Search(len(scan.records), func(j int) bool { return int64(scan.records[j].Offset) >= pos }); j < len(scan.records) && int64(scan.records[j].Offset) == pos {
+				records = append(records, scan.records[j:]...)
+				pos = scan.stop
+				break
+			}
+			if pos >= ends[i] {
+				break
+			}
+			c, next, err := readSection(r, pos, size)
+			if err != nil {
+				return nil, err
+			}
+			if next < 0 {
+				pos = size
+				break
+			}
+			records = append(records, carindex.Record{Cid: c, Offset: uint64(pos)})
+			pos = next
+		}
+	}
+	return records, nil
+}
+
+// scanChain walks the chain of sections starting at off, up to the first one
+// starting at or past end.
+func scanChain(r io.ReaderAt, off, end, size int64) (chainScan, error) {
+	var scan chainScan
+	for off < end {
+		c, next, err := readSection(r, off, size)
+		if err != nil {
+			return scan, err
+		}
+		if next < 0 {
+			off = size
+			break
+		}
+		scan.records = append(scan.records, carindex.Record{Cid: c, Offset: uint64(off)})
+		off = next
+	}
+	scan.stop = off
+	return scan, nil
+}
+
+// readSection reads the head of the section at off, returning its CID and the
+// offset of the next section. It returns a negative offset at the end of the
+// payload, including at zero-length sections, which are treated as EOF, as
+// when indexing sequentially.
+func readSection(r io.ReaderAt, off, size int64) (cid.Cid, int64, error) {
+	if off >= size {
+		return cid.Undef, -1, nil
+	}
+	var buf [binary.MaxVarintLen64 + 128]byte
+	read, err := r.ReadAt(buf[:], off)
+	if read == 0 {
+		return cid.Undef, 0, fmt.Errorf("failed to read section at offset %d: %w", off, err)
+	}
+	l, n := binary.Uvarint(buf[:read])
+	switch {
+	case n <= 0:
+		return cid.Undef, 0, fmt.Errorf("invalid section length at offset %d", off)
+	case l == 0:
+		return cid.Undef, -1, nil
+	case off+int64(n)+int64(l) > size:
+		return cid.Undef, 0, fmt.Errorf("section at offset %d overflows the payload", off)
+	}
+	next := off + int64(n) + int64(l)
+
+	cn, c, err := cid.CidFromBytes(buf[n:read])
+	if err != nil && uint64(read-n) < l {
+		// the CID may be longer than the buffer, e.g. an identity CID.
+		if l > maxCIDLength {
+			l = maxCIDLength
+		}
+		section := make([]byte, l)
+		if _, err := r.ReadAt(section, off+int64(n)); err != nil {
+			return cid.Undef, 0, fmt.Errorf("failed to read section at offset %d: %w", off, err)
+		}
+		cn, c, err = cid.CidFromBytes(section)
+	}
+	if err != nil {
+		return cid.Undef, 0, fmt.Errorf("invalid CID at offset %d: %w", off, err)
+	}
+	if uint64(cn) > l {
+		return cid.Undef, 0, fmt.Errorf("CID at offset %d overflows its section", off)
+	}
+	return c, next, nil
+}
+
+// findBoundary returns the first position in the window at the start of a
+// chunk that looks like the start of a section, followed by another one. The
+// window is searched in memory.
+func findBoundary(r io.ReaderAt, start, end, size int64) (int64, bool) {
+	limit := start + boundaryWindow
+	if limit > end {
+		limit = end
+	}
+	buf := make([]byte, limit-start+2*(binary.MaxVarintLen64+128))
+	read, _ := r.ReadAt(buf, start)
+	buf = buf[:read]
+
+	for i := 0; int64(i) < limit-start && i < len(buf); i++ {
+		l, ok := sectionHeadAt(buf[i:])
+		off := start + int64(i)
+		if !ok || off+l > size {
+			continue
+		}
+		next := i + int(l)
+		if next == int(size-start) {
+			return off, true // the last section.
+		}
+		if next < len(buf) {
+			if _, ok := sectionHeadAt(buf[next:]); ok {
+				return off, true
+			}
+			continue
+		}
+		if _, _, err := readSection(r, off+l, size); err == nil {
+			return off, true
+		}
+	}
+	return 0, false
+}
+
+// sectionHeadAt returns the total length of the section at the start of b,
+// including its length prefix, if b starts with a plausible section head: a
+// non-zero length, followed by a CID that fits in it.
+func sectionHeadAt(b []byte) (int64, bool) {
+	l, n := binary.Uvarint(b)
+	if n <= 0 || l == 0 {
+		return 0, false
+	}
+	cn, _, err := cid.CidFromBytes(b[n:])
+	if err != nil || uint64(cn) > l {
+		return 0, false
+	}
+	return int64(n) + int64(l), true
+}
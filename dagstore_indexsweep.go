@@ -0,0 +1,214 @@
+package dagstore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/filecoin-project/dagstore/index"
+	"github.com/filecoin-project/dagstore/shard"
+
+	carindex "github.com/ipld/go-car/v2/index"
+)
+
+// IndexSweepOpts are options for SweepIndices.
+type IndexSweepOpts struct {
+	// QuarantineDir, if non-empty, is a directory where orphaned indices are
+	// moved to, as <key>.full.idx files, instead of being deleted, so that
+	// they can be inspected or restored.
+	QuarantineDir string
+
+	// DryRun reports the orphaned indices and the bytes that would be freed,
+	// without removing them, nor compacting the index repo.
+	DryRun bool
+}
+
+// IndexSweepResult is the result of SweepIndices.
+type IndexSweepResult struct {
+	// Orphans includes an entry for every orphaned index found. Nil error
+	// values indicate that the index was (or would be, on a dry run) removed
+	// successfully.
+	Orphans map[shard.Key]error
+
+	// DryRun is true if this result was produced by a dry run.
+	DryRun bool
+
+	// ReclaimedBytes is the total number of bytes that were (or would be)
+	// freed, including CompactedBytes. Indices shared with other shards by a
+	// deduplicating repo are not counted.
+	ReclaimedBytes uint64
+
+	// CompactedBytes is the number of bytes freed by compacting the index
+	// repo, if it's an index.Compactor.
+	CompactedBytes uint64
+}
+
+// SweepIndices removes orphaned indices from the index repo, i.e. indices
+// with no corresponding registered shard, as left behind by failed destroys
+// or by tampering with the repo, and then compacts the repo if it's an
+// index.Compactor. Orphaned indices are deleted, or moved to
+// IndexSweepOpts.QuarantineDir.
+//
+// Indices of shards being written, cloned, or registered by a transaction
+// are not orphaned. Registering a shard whose orphaned index is being
+// removed fails with ErrIndexSweeping. Sweeps other than dry runs fail with ErrReadOnly in
+// read-only mode, and with ErrLockLost if the DAG store lost its instance
+// lease.
+func (d *DAGStore) SweepIndices(ctx context.Context, opts IndexSweepOpts) (*IndexSweepResult, error) {
+	if !opts.DryRun {
+		if d.config.ReadOnly {
+			return nil, ErrReadOnly
+		}
+		if d.isFenced() {
+			return nil, ErrLockLost
+		}
+		if opts.QuarantineDir != "" {
+			if err := os.MkdirAll(opts.QuarantineDir, 0755); err != nil {
+				return nil, fmt.Errorf("failed to create quarantine directory: %w", err)
+			}
+		}
+	}
+
+	// collect the keys first, as not all repos support dropping indices
+	// while iterating over them.
+	var keys []shard.Key
+	err := d.indices.ForEach(func(k shard.Key) (bool, error) {
+		keys = append(keys, k)
+		return ctx.Err() == nil, nil
+	})
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list indices: %w", err)
+	}
+
+	res := &IndexSweepResult{Orphans: make(map[shard.Key]error), DryRun: opts.DryRun}
+	for _, k := range keys {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		d.sweepIndex(k, opts, res)
+	}
+
+	if !opts.DryRun {
+		if c, ok := d.indices.(index.Compactor); ok {
+			n, err := c.Compact(ctx)
+			res.CompactedBytes = n
+			res.ReclaimedBytes += n
+			if err != nil {
+				return res, fmt.Errorf("failed to compact index repo: %w", err)
+			}
+		}
+	}
+
+	log.Infow("swept orphaned indices", "orphans", len(res.Orphans), "reclaimed_bytes", res.ReclaimedBytes, "dry_run", res.DryRun)
+	return res, nil
+}
+
+// sweepIndex removes the index of the shard with the given key if it's
+// orphaned, recording the outcome in res. The key is reserved while the
+// index is quarantined and dropped, so that the shard can't be registered
+// meanwhile, without holding the lock during the removal.
+func (d *DAGStore) sweepIndex(k shard.Key, opts IndexSweepOpts, res *IndexSweepResult) {
+	d.lk.Lock()
+	_, sweeping := d.sweeping[k]
+	orphaned := !sweeping && d.indexOrphaned(k)
+	if orphaned && !opts.DryRun {
+		d.sweeping[k] = struct{}{}
+	}
+	d.lk.Unlock()
+
+	if !orphaned {
+		return
+	}
+	if !opts.DryRun {
+		defer func() {
+			d.lk.Lock()
+			delete(d.sweeping, k)
+			d.lk.Unlock()
+		}()
+	}
+
+	st, err := d.indices.StatFullIndex(k)
+	if err != nil || !st.Exists {
+		// dropped in the meantime.
+		return
+	}
+	size := st.Size
+	if d.indexShared(k) {
+		size = 0
+	}
+
+	if opts.DryRun {
+		res.Orphans[k] = nil
+		res.ReclaimedBytes += size
+		return
+	}
+
+	if opts.QuarantineDir != "" {
+		err = d.quarantineIndex(k, opts.QuarantineDir)
+	}
+	if err == nil {
+		_, err = d.indices.DropFullIndex(k)
+	}
+	if err != nil {
+		log.Warnw("failed to remove orphaned index", "shard", k, "error", err)
+		res.Orphans[k] = err
+		return
+	}
+	log.Infow("removed orphaned index", "shard", k, "bytes", st.Size, "quarantined", opts.QuarantineDir != "")
+	res.Orphans[k] = nil
+	res.ReclaimedBytes += size
+}
+
+// indexOrphaned returns whether the index of the shard with the given key is
+// orphaned. It must be called with the lock held.
+func (d *DAGStore) indexOrphaned(k shard.Key) bool {
+	if _, ok := d.shards[k]; ok {
+		return false
+	}
+	_, writing := d.writing[k]
+	_, inTxn := d.txnKeys[k]
+	_, cloning := d.cloning[k]
+	return !writing && !inTxn && !cloning
+}
+
+// indexShared returns whether the index of the shard with the given key is
+// shared with other shards by a deduplicating repo, in which case dropping
+// it frees no space.
+func (d *DAGStore) indexShared(k shard.Key) bool {
+	var repo index.FullIndexRepo = d.indices
+	if c, ok := repo.(*index.CachedIndexRepo); ok {
+		repo = c.FullIndexRepo
+	}
+	dedup, ok := repo.(*index.DedupFSIndexRepo)
+	if !ok {
+		return false
+	}
+	refs, err := dedup.Refs(k)
+	return err == nil && refs > 1
+}
+
+// quarantineIndex writes the index of the shard with the given key into dir.
+func (d *DAGStore) quarantineIndex(k shard.Key, dir string) error {
+	idx, err := d.indices.GetFullIndex(k)
+	if err != nil {
+		return fmt.Errorf("failed to get index: %w", err)
+	}
+	path := filepath.Join(dir, k.String()+".full.idx")
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create quarantined index: %w", err)
+	}
+	_, err = carindex.WriteTo(idx, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return fmt.Errorf("failed to write quarantined index: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package dagstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// initRun is an initialization (or recovery) of a shard in flight.
+type initRun struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	// cancelled is set to 1 by CancelInit; accessed atomically.
+	cancelled int32
+}
+
+// CancelInit cancels the initialization or recovery of the shard with the
+// given key in flight, e.g. a fetch from a mount that's hanging. The shard
+// fails with ErrInitCancelled, and can be recovered later through
+// RecoverShard. The partial transient of an interrupted fetch is removed.
+//
+// It fails with ErrShardUnknown if the shard isn't registered, and with
+// ErrNotInitializing if it isn't being initialized or recovered.
+func (d *DAGStore) CancelInit(key shard.Key) error {
+	d.lk.RLock()
+	_, ok := d.shards[key]
+	d.lk.RUnlock()
+	if !ok {
+		return fmt.Errorf("%s: %w", key.String(), ErrShardUnknown)
+	}
+
+	d.initsLk.Lock()
+	run, ok := d.inits[key]
+	d.initsLk.Unlock()
+	if !ok {
+		return fmt.Errorf("%s: %w", key.String(), ErrNotInitializing)
+	}
+
+	log.Infow("cancelling shard initialization", "shard", key)
+	atomic.StoreInt32(&run.cancelled, 1)
+	run.cancel()
+	return nil
+}
+
+// startInit tracks an initialization of shard s, bounding it by
+// Config.InitTimeout. The returned run must be ended through endInit.
+func (d *DAGStore) startInit(ctx context.Context, s *Shard) *initRun {
+	run := new(initRun)
+	if timeout := d.config.InitTimeout; timeout > 0 {
+		run.ctx, run.cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		run.ctx, run.cancel = context.WithCancel(ctx)
+	}
+
+	d.initsLk.Lock()
+	d.inits[s.key] = run
+	d.initsLk.Unlock()
+	return run
+}
+
+// endInit stops tracking an initialization of shard s.
+func (d *DAGStore) endInit(s *Shard, run *initRun) {
+	run.cancel()
+
+	d.initsLk.Lock()
+	if d.inits[s.key] == run {
+		delete(d.inits, s.key)
+	}
+	d.initsLk.Unlock()
+}
+
+// initError returns the error to fail an initialization with: ErrInitCancelled
+// or ErrInitTimeout if it was interrupted for either reason, or err otherwise.
+func (d *DAGStore) initError(run *initRun, err error) error {
+	switch {
+	case atomic.LoadInt32(&run.cancelled) == 1:
+		return fmt.Errorf("%w: %s", ErrInitCancelled, err)
+	case errors.Is(run.ctx.Err(), context.DeadlineExceeded):
+		return fmt.Errorf("%w after %s: %s", ErrInitTimeout, d.config.InitTimeout, err)
+	default:
+		return err
+	}
+}
+
+// ctxReader is a mount reader that stops reading once its context is done,
+// so that indexing can be interrupted.
+type ctxReader struct {
+	mount.Reader
+	ctx context.Context
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.Reader.Read(p)
+}
+
+func (r *ctxReader) ReadAt(p []byte, off int64) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.Reader.ReadAt(p, off)
+}
@@ -0,0 +1,100 @@
+package dagstore
+
+import (
+	"context"
+	"errors"
+
+	"github.com/ipfs/go-cid"
+	carindex "github.com/ipld/go-car/v2/index"
+
+	"github.com/filecoin-project/dagstore/index"
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// ShardsContainingCid returns the keys of the shards containing the block
+// with the supplied CID. Blocks are looked up by multihash, so CIDs differing
+// only in version or codec resolve to the same shards.
+func (d *DAGStore) ShardsContainingCid(ctx context.Context, c cid.Cid) ([]shard.Key, error) {
+	if d.blooms.miss(c.Hash()) {
+		return nil, bloomMissError(c.Hash())
+	}
+	keys, err := d.TopLevelIndex.GetShardsForMultihash(ctx, c.Hash())
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[shard.Key]struct{}, len(keys))
+	ret := keys[:0]
+	for _, k := range keys {
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = struct{}{}
+		ret = append(ret, k)
+	}
+	return ret, nil
+}
+
+// backfillInverted adds the multihashes of the supplied shards to the
+// inverted index if they're missing from it, loading them from the full
+// indices of the shards instead of re-reading their data.
+func (d *DAGStore) backfillInverted(m index.ShardMembership, keys []shard.Key) {
+	defer d.wg.Done()
+
+	var added int
+	for _, k := range keys {
+		if d.ctx.Err() != nil {
+			return
+		}
+		if has, err := m.HasShard(d.ctx, k); err != nil || has {
+			if err != nil {
+				log.Warnw("backfill: failed to check inverted index for shard", "shard", k, "error", err)
+			}
+			continue
+		}
+
+		idx, err := d.indices.GetFullIndex(k)
+		if err != nil {
+			log.Warnw("backfill: failed to load index of shard", "shard", k, "error", err)
+			continue
+		}
+		iterableIdx, ok := idx.(carindex.IterableIndex)
+		if !ok {
+			log.Warnw("backfill: shard index is not iterable", "shard", k)
+			continue
+		}
+		if err := d.addToInverted(d.ctx, k, iterableIdx); err != nil {
+			log.Warnw("backfill: failed to add shard multihashes to the inverted index", "shard", k, "error", err)
+			continue
+		}
+		added++
+	}
+	if added > 0 {
+		log.Infow("backfilled inverted index", "shards", added)
+	}
+}
+
+// removeFromInverted removes the multihashes of a destroyed or archived shard
+// from the inverted index, if it supports it, so that lookups no longer return
+// the shard. It must be called before the full index of the shard is dropped.
+func (d *DAGStore) removeFromInverted(s *Shard) {
+	r, ok := d.TopLevelIndex.(index.ShardRemover)
+	if !ok || s.skipTopLevel || d.config.ReadOnly {
+		return
+	}
+	idx, err := d.indices.GetFullIndex(s.key)
+	if err != nil {
+		if !errors.Is(err, index.ErrNotFound) {
+			log.Warnw("failed to load index of shard to remove from the inverted index", "shard", s.key, "error", err)
+		}
+		return
+	}
+	iterableIdx, ok := idx.(carindex.IterableIndex)
+	if !ok {
+		log.Warnw("shard index is not iterable", "shard", s.key)
+		return
+	}
+	if err := r.RemoveMultihashesForShard(d.ctx, &mhIdx{iterableIdx: iterableIdx}, s.key); err != nil {
+		log.Warnw("failed to remove shard multihashes from the inverted index", "shard", s.key, "error", err)
+	}
+}
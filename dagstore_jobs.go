@@ -0,0 +1,296 @@
+package dagstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// JobName identifies a maintenance job run periodically by the DAG store (see
+// Config.Jobs).
+type JobName string
+
+const (
+	// JobGC runs GC.
+	JobGC JobName = "gc"
+	// JobVerifyIndices verifies the full indices of a random sample of
+	// available shards against their data, like VerifyIndex, without
+	// repairing them. It fails if any index doesn't match.
+	JobVerifyIndices JobName = "verify-indices"
+	// JobValidateTransients validates the transients of a random sample of
+	// available shards against the size and checksum of their mounts,
+	// removing those that fail validation, so that they're refetched on the
+	// next acquire. It fails if any transient was removed.
+	JobValidateTransients JobName = "validate-transients"
+	// JobMountHealth checks the health of mounts, like CheckMountHealth.
+	JobMountHealth JobName = "mount-health"
+)
+
+var (
+	// DefaultJobIntervals are the default intervals of the maintenance jobs
+	// (see JobConfig.Interval).
+	DefaultJobIntervals = map[JobName]time.Duration{
+		JobGC:                 time.Hour,
+		JobVerifyIndices:      24 * time.Hour,
+		JobValidateTransients: 6 * time.Hour,
+		JobMountHealth:        time.Minute,
+	}
+
+	// DefaultJobSampleSize is the default value of JobConfig.SampleSize.
+	DefaultJobSampleSize = 10
+)
+
+// JobConfig configures a maintenance job.
+type JobConfig struct {
+	// Enabled runs the job periodically. Disabled jobs can still be run
+	// through RunJob.
+	Enabled bool
+	// Interval is the time between the end of a run and the start of the
+	// next one. Defaults to the job's entry in DefaultJobIntervals.
+	Interval time.Duration
+	// Jitter, if positive, adds a random delay of up to Jitter to every
+	// interval, so that the jobs of several DAG stores don't run in
+	// lockstep.
+	Jitter time.Duration
+	// SampleSize is the number of shards sampled by each run of
+	// JobVerifyIndices and JobValidateTransients. Defaults to
+	// DefaultJobSampleSize.
+	SampleSize int
+}
+
+// JobStatus is the status of a maintenance job.
+type JobStatus struct {
+	// Enabled is whether the job runs periodically.
+	Enabled bool
+	// Interval is the configured interval of the job.
+	Interval time.Duration
+	// Running is whether the job is running.
+	Running bool
+	// Runs and Failures are the number of runs of the job since the DAG
+	// store started, including those triggered through RunJob, and the
+	// number of those that failed.
+	Runs, Failures uint64
+	// LastRun is the time the last run started, or zero if it never ran.
+	LastRun time.Time
+	// LastDuration is the duration of the last run.
+	LastDuration time.Duration
+	// LastError is the error of the last run, or empty if it succeeded.
+	LastError string
+	// NextRun is the time of the next scheduled run, or zero if the job
+	// isn't enabled.
+	NextRun time.Time
+}
+
+// job is a maintenance job.
+type job struct {
+	name JobName
+	cfg  JobConfig // with defaults applied.
+	run  func(ctx context.Context, cfg JobConfig) error
+
+	// runLk serializes the runs of the job.
+	runLk sync.Mutex
+
+	lk     sync.Mutex
+	status JobStatus // guarded by lk.
+}
+
+// newJobs creates the maintenance jobs, configured by cfg, which must only
+// hold known jobs.
+func (d *DAGStore) newJobs(cfg map[JobName]JobConfig) (map[JobName]*job, error) {
+	runs := map[JobName]func(context.Context, JobConfig) error{
+		JobGC:                 d.gcJob,
+		JobVerifyIndices:      d.verifyIndicesJob,
+		JobValidateTransients: d.validateTransientsJob,
+		JobMountHealth:        d.mountHealthJob,
+	}
+	for name := range cfg {
+		if _, ok := runs[name]; !ok {
+			return nil, fmt.Errorf("unknown maintenance job: %s", name)
+		}
+	}
+
+	jobs := make(map[JobName]*job, len(runs))
+	for name, run := range runs {
+		c := cfg[name]
+		if c.Interval <= 0 {
+			c.Interval = DefaultJobIntervals[name]
+		}
+		if c.SampleSize <= 0 {
+			c.SampleSize = DefaultJobSampleSize
+		}
+		jobs[name] = &job{
+			name:   name,
+			cfg:    c,
+			run:    run,
+			status: JobStatus{Enabled: c.Enabled, Interval: c.Interval},
+		}
+	}
+	return jobs, nil
+}
+
+// RunJob runs the maintenance job with the given name now, regardless of
+// whether it's enabled, and returns its error. It waits for a run of the job
+// in flight, if any, to complete first. The run is recorded in the status of
+// the job (see Stats).
+func (d *DAGStore) RunJob(ctx context.Context, name JobName) error {
+	j, ok := d.jobs[name]
+	if !ok {
+		return fmt.Errorf("unknown maintenance job: %s", name)
+	}
+	return d.runJob(ctx, j)
+}
+
+// jobStatuses returns the status of all maintenance jobs.
+func (d *DAGStore) jobStatuses() map[JobName]JobStatus {
+	ret := make(map[JobName]JobStatus, len(d.jobs))
+	for name, j := range d.jobs {
+		j.lk.Lock()
+		ret[name] = j.status
+		j.lk.Unlock()
+	}
+	return ret
+}
+
+// scheduleJob runs an enabled job periodically, until the DAG store is
+// closed.
+func (d *DAGStore) scheduleJob(j *job) {
+	defer d.wg.Done()
+
+	for {
+		delay := j.cfg.Interval
+		if j.cfg.Jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(j.cfg.Jitter)))
+		}
+		j.lk.Lock()
+		j.status.NextRun = time.Now().Add(delay)
+		j.lk.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+			_ = d.runJob(d.ctx, j)
+		case <-d.ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// runJob runs a job, recording its outcome.
+func (d *DAGStore) runJob(ctx context.Context, j *job) error {
+	j.runLk.Lock()
+	defer j.runLk.Unlock()
+
+	start := time.Now()
+	j.lk.Lock()
+	j.status.Running = true
+	j.lk.Unlock()
+
+	log.Debugw("running maintenance job", "job", j.name)
+	err := d.redact(j.run(ctx, j.cfg))
+	if err != nil {
+		log.Warnw("maintenance job failed", "job", j.name, "error", err)
+	}
+
+	j.lk.Lock()
+	j.status.Running = false
+	j.status.Runs++
+	j.status.LastRun = start
+	j.status.LastDuration = time.Since(start)
+	j.status.LastError = ""
+	if err != nil {
+		j.status.Failures++
+		j.status.LastError = err.Error()
+	}
+	j.lk.Unlock()
+	return err
+}
+
+func (d *DAGStore) gcJob(ctx context.Context, _ JobConfig) error {
+	res, err := d.GC(ctx)
+	if err != nil {
+		return err
+	}
+	log.Infow("maintenance GC done", "reclaimed", res.Reclaimed)
+	return nil
+}
+
+func (d *DAGStore) verifyIndicesJob(ctx context.Context, cfg JobConfig) error {
+	var mismatched int
+	sample := d.sampleShards(cfg.SampleSize, func(s *Shard) bool { return true })
+	for _, k := range sample {
+		res, err := d.VerifyIndex(ctx, k, VerifyIndexOpts{})
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case errors.Is(err, ErrShardUnknown):
+			// destroyed in the meantime.
+		case err != nil:
+			log.Warnw("maintenance: failed to verify index of shard", "shard", k, "error", err)
+		case !res.OK():
+			log.Warnw("maintenance: index of shard doesn't match its data", "shard", k, "missing", res.Missing, "unexpected", res.Unexpected, "stored_missing", res.StoredMissing)
+			mismatched++
+		}
+	}
+	if mismatched > 0 {
+		return fmt.Errorf("%d of %d sampled indices don't match their data", mismatched, len(sample))
+	}
+	return nil
+}
+
+func (d *DAGStore) validateTransientsJob(ctx context.Context, cfg JobConfig) error {
+	var invalid int
+	sample := d.sampleShards(cfg.SampleSize, func(s *Shard) bool {
+		return !s.mount.Passthrough() && s.mount.TransientPath() != ""
+	})
+	for _, k := range sample {
+		d.lk.RLock()
+		s, ok := d.shards[k]
+		d.lk.RUnlock()
+		if !ok {
+			continue
+		}
+		if err := s.mount.ValidateTransient(ctx); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			invalid++
+		}
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d of %d sampled transients failed validation and were removed", invalid, len(sample))
+	}
+	return nil
+}
+
+func (d *DAGStore) mountHealthJob(ctx context.Context, _ JobConfig) error {
+	d.CheckMountHealth(ctx)
+	return nil
+}
+
+// sampleShards returns the keys of a random sample of up to n available
+// shards for which filter returns true.
+func (d *DAGStore) sampleShards(n int, filter func(s *Shard) bool) []shard.Key {
+	d.lk.RLock()
+	var keys []shard.Key
+	for k, s := range d.shards {
+		s.lk.RLock()
+		state := s.state
+		s.lk.RUnlock()
+		if state == ShardStateAvailable && filter(s) {
+			keys = append(keys, k)
+		}
+	}
+	d.lk.RUnlock()
+
+	rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
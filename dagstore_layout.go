@@ -0,0 +1,51 @@
+package dagstore
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// migrateTransients moves transients stored with a layout other than
+// Config.TransientsLayout into it, e.g. after switching from the flat layout
+// to the sharded one. Transients outside the transients dirs, such as
+// existing transients supplied on registration, and shared transients are
+// left in place. Failures are logged, and the transients are kept where they
+// are, as they remain usable.
+//
+// This is only safe to be called on start, before we have queued tasks.
+func (d *DAGStore) migrateTransients() {
+	var roots []string
+	if d.tieringEnabled() {
+		roots = append(roots, filepath.Clean(d.config.HotTransientsDir))
+	}
+	roots = append(roots, filepath.Clean(d.config.TransientsDir))
+
+	var migrated int
+	for _, s := range d.shards {
+		path := s.mount.TransientPath()
+		if path == "" || s.mount.Shared() {
+			continue
+		}
+		for _, root := range roots {
+			if !strings.HasPrefix(path, root+string(filepath.Separator)) {
+				continue
+			}
+			dir := d.config.TransientsLayout.Dir(root, s.key)
+			if filepath.Dir(path) == dir {
+				break
+			}
+			if _, err := s.mount.MoveTransient(dir); err != nil {
+				log.Warnw("failed to migrate transient to layout", "shard", s.key, "path", path, "layout", d.config.TransientsLayout, "error", err)
+				break
+			}
+			if err := s.persist(d.ctx, d.config.Datastore); err != nil {
+				log.Warnw("failed to persist shard after migrating transient", "shard", s.key, "error", err)
+			}
+			migrated++
+			break
+		}
+	}
+	if migrated > 0 {
+		log.Infow("migrated transients to layout", "transients", migrated, "layout", d.config.TransientsLayout)
+	}
+}
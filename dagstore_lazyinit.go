@@ -0,0 +1,172 @@
+package dagstore
+
+import (
+	"fmt"
+	"sync"
+)
+
+// lazyInitQueue is a bounded FIFO of shards registered with lazy
+// initialization that are waiting to be initialized, after their first
+// acquire. A fixed number of workers pop shards from it, so that a flood of
+// first acquires neither spawns a goroutine per shard, nor initializes them in
+// arbitrary order.
+//
+// The first acquire of a shard reserves its place in the queue, so that it
+// can be rejected if the queue is full; the event loop pushes the shard once
+// it has moved it to ShardStateInitializing, which is the only transition
+// that hands it over to the workers.
+type lazyInitQueue struct {
+	lk       sync.Mutex
+	pending  []*Shard
+	index    map[*Shard]int // position of queued shards, counted from the first push.
+	popped   int            // number of shards popped from the head so far.
+	reserved int            // number of places reserved for shards to be pushed.
+	max      int            // maximum number of pending shards; 0 is unlimited.
+
+	signal chan struct{} // signals workers that shards were pushed.
+}
+
+func newLazyInitQueue(max int) *lazyInitQueue {
+	return &lazyInitQueue{max: max, index: make(map[*Shard]int), signal: make(chan struct{}, 1)}
+}
+
+// reserve reserves a place in the queue, and returns false if the queue is
+// full.
+func (q *lazyInitQueue) reserve() bool {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	if q.max > 0 && len(q.pending)+q.reserved >= q.max {
+		return false
+	}
+	q.reserved++
+	return true
+}
+
+// unreserve releases a place reserved for a shard that won't be pushed.
+func (q *lazyInitQueue) unreserve() {
+	q.lk.Lock()
+	q.reserved--
+	q.lk.Unlock()
+}
+
+// push appends a shard to the queue, taking up a place reserved for it.
+func (q *lazyInitQueue) push(s *Shard) {
+	q.lk.Lock()
+	q.reserved--
+	q.index[s] = q.popped + len(q.pending)
+	q.pending = append(q.pending, s)
+	q.lk.Unlock()
+
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+}
+
+// pop removes the shard at the head of the queue, or returns nil if the queue
+// is empty.
+func (q *lazyInitQueue) pop() *Shard {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	if len(q.pending) == 0 {
+		return nil
+	}
+	s := q.pending[0]
+	q.pending[0] = nil
+	q.pending = q.pending[1:]
+	delete(q.index, s)
+	q.popped++
+	return s
+}
+
+// remove removes a shard from the queue, if present. Unlike the other
+// operations, it takes time linear in the number of shards behind it, which
+// is fine as shards rarely leave the queue other than from its head.
+func (q *lazyInitQueue) remove(s *Shard) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	i, ok := q.index[s]
+	if !ok {
+		return
+	}
+	delete(q.index, s)
+	i -= q.popped
+	q.pending = append(q.pending[:i], q.pending[i+1:]...)
+	for _, behind := range q.pending[i:] {
+		q.index[behind]--
+	}
+}
+
+// position returns the 1-based position of a shard in the queue, or 0 if it's
+// not queued.
+func (q *lazyInitQueue) position(s *Shard) int {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	i, ok := q.index[s]
+	if !ok {
+		return 0
+	}
+	return i - q.popped + 1
+}
+
+// queueLazyInit reserves a place in the initialization queue for a lazy shard
+// upon its first acquire, failing the acquirer with ErrLazyInitQueueFull and
+// returning false if the queue is full. If lazy initializations aren't
+// throttled, they are not queued. It must be called from the event loop.
+func (d *DAGStore) queueLazyInit(s *Shard, w *waiter) bool {
+	if d.lazyInits == nil || !s.lazy {
+		return true
+	}
+	if !d.lazyInits.reserve() {
+		log.Debugw("lazy initialization queue full; rejecting acquirer", "shard", s.key)
+		err := fmt.Errorf("%s: %w", s.key.String(), ErrLazyInitQueueFull)
+		d.dispatchResult(&ShardResult{Key: s.key, Error: err}, w)
+		return false
+	}
+	return true
+}
+
+// throttledLazyInit returns whether the initialization of the shard goes
+// through the lazy initialization queue.
+func (d *DAGStore) throttledLazyInit(s *Shard) bool {
+	return s.lazy && d.lazyInits != nil
+}
+
+// lazyInitWorker initializes queued lazy shards in FIFO order, until the DAG
+// store is closed.
+func (d *DAGStore) lazyInitWorker() {
+	defer d.wg.Done()
+
+	for d.ctx.Err() == nil {
+		s := d.lazyInits.pop()
+		if s == nil {
+			select {
+			case <-d.lazyInits.signal:
+				continue
+			case <-d.ctx.Done():
+				return
+			}
+		}
+
+		// skip shards that were destroyed or failed while queued. Shards are
+		// only pushed once the event loop moved them to initializing.
+		d.lk.RLock()
+		registered := d.shards[s.key] == s
+		d.lk.RUnlock()
+		s.lk.Lock()
+		initializing := s.state == ShardStateInitializing
+		if registered && initializing {
+			s.initRunning = true
+		}
+		s.lk.Unlock()
+		if !registered || !initializing {
+			continue
+		}
+
+		d.initializeShard(d.ctx, s, s.mount)
+	}
+}
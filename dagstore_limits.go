@@ -0,0 +1,191 @@
+package dagstore
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	carv2 "github.com/ipld/go-car/v2"
+
+	"github.com/filecoin-project/dagstore/mount"
+)
+
+// ShardLimit identifies a limit on the CAR of a shard, enforced when the shard
+// is initialized. See Config.MaxShardSize, Config.MaxShardBlocks and
+// Config.MaxBlockSize.
+type ShardLimit int
+
+const (
+	// LimitShardSize is the limit on the size of the CAR, in bytes.
+	LimitShardSize ShardLimit = iota
+
+	// LimitShardBlocks is the limit on the number of blocks in the CAR.
+	LimitShardBlocks
+
+	// LimitBlockSize is the limit on the size of a single block, in bytes.
+	LimitBlockSize
+)
+
+func (l ShardLimit) String() string {
+	return [...]string{
+		"LimitShardSize",
+		"LimitShardBlocks",
+		"LimitBlockSize"}[l]
+}
+
+// ShardLimitError is the error that shards fail with when their CAR exceeds a
+// limit at initialization. Use errors.As to extract it from the shard error.
+type ShardLimitError struct {
+	// Limit is the limit that was exceeded.
+	Limit ShardLimit
+	// Max is the configured value of the limit.
+	Max int64
+	// Actual is the value that exceeded it. For LimitShardBlocks, it's the
+	// number of blocks scanned when the limit was hit, i.e. Max+1.
+	Actual int64
+	// Offset is the offset of the offending block within the CAR data
+	// payload, for LimitBlockSize.
+	Offset int64
+}
+
+func (e *ShardLimitError) Error() string {
+	switch e.Limit {
+	case LimitShardSize:
+		return fmt.Sprintf("shard size %d exceeds limit of %d bytes", e.Actual, e.Max)
+	case LimitShardBlocks:
+		return fmt.Sprintf("shard has more than %d blocks", e.Max)
+	default:
+		return fmt.Sprintf("block at offset %d has size %d, exceeding limit of %d bytes", e.Offset, e.Actual, e.Max)
+	}
+}
+
+// limitsEnabled returns whether any shard limit is configured.
+func (d *DAGStore) limitsEnabled() bool {
+	return d.config.MaxShardSize > 0 || d.config.MaxShardBlocks > 0 || d.config.MaxBlockSize > 0
+}
+
+// checkMountSize fails fast if the mount reports a size over
+// Config.MaxShardSize, before its data is fetched.
+func (d *DAGStore) checkMountSize(ctx context.Context, mnt mount.Mount) error {
+	if d.config.MaxShardSize <= 0 {
+		return nil
+	}
+	stat, err := mnt.Stat(ctx)
+	if err != nil || stat.Size <= d.config.MaxShardSize {
+		// the size is checked again once fetched.
+		return nil
+	}
+	return &ShardLimitError{Limit: LimitShardSize, Max: d.config.MaxShardSize, Actual: stat.Size}
+}
+
+// checkShardLimits checks the fetched CAR of a shard against the configured
+// limits, before it's indexed. Block limits are checked by scanning the
+// section headers of the data payload, without reading the blocks. The
+// position of the reader is left untouched.
+func (d *DAGStore) checkShardLimits(reader mount.Reader) error {
+	if !d.limitsEnabled() {
+		return nil
+	}
+
+	pos, err := reader.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("failed to get reader position: %w", err)
+	}
+	size, err := reader.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("failed to get shard size: %w", err)
+	}
+	if _, err := reader.Seek(pos, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind reader: %w", err)
+	}
+	if limit := d.config.MaxShardSize; limit > 0 && size > limit {
+		return &ShardLimitError{Limit: LimitShardSize, Max: limit, Actual: size}
+	}
+	if d.config.MaxShardBlocks <= 0 && d.config.MaxBlockSize <= 0 {
+		return nil
+	}
+
+	cr, err := carv2.NewReader(reader)
+	if err != nil {
+		return fmt.Errorf("failed to read CAR header: %w", err)
+	}
+	dr, err := cr.DataReader()
+	if err != nil {
+		return fmt.Errorf("failed to read CAR data payload: %w", err)
+	}
+	dataSize := size - int64(cr.Header.DataOffset)
+	if cr.Version == 2 {
+		dataSize = int64(cr.Header.DataSize)
+	}
+	return d.scanSections(dr, dataSize)
+}
+
+// scanSections walks the sections of a CARv1 data payload, checking the block
+// count and sizes.
+func (d *DAGStore) scanSections(r io.ReaderAt, size int64) error {
+	// skip the CARv1 header.
+	l, n, err := readUvarintAt(r, 0)
+	if err != nil {
+		return fmt.Errorf("failed to read CARv1 header length: %w", err)
+	}
+	off := int64(n) + int64(l)
+
+	var blocks int64
+	for off < size {
+		l, n, err := readUvarintAt(r, off)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read section length at offset %d: %w", off, err)
+		}
+		if l == 0 {
+			// zero-length sections are treated as EOF, as when indexing.
+			break
+		}
+
+		blocks++
+		if limit := d.config.MaxShardBlocks; limit > 0 && blocks > limit {
+			return &ShardLimitError{Limit: LimitShardBlocks, Max: limit, Actual: blocks}
+		}
+		if limit := d.config.MaxBlockSize; limit > 0 && int64(l) > limit {
+			if bs := blockSizeAt(r, off+int64(n), l); bs > limit {
+				return &ShardLimitError{Limit: LimitBlockSize, Max: limit, Actual: bs, Offset: off}
+			}
+		}
+		off += int64(n) + int64(l)
+	}
+	return nil
+}
+
+// readUvarintAt reads a varint at offset off, returning its value and length.
+func readUvarintAt(r io.ReaderAt, off int64) (uint64, int, error) {
+	var buf [binary.MaxVarintLen64]byte
+	n, err := r.ReadAt(buf[:], off)
+	if n == 0 {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, 0, err
+	}
+	v, vn := binary.Uvarint(buf[:n])
+	if vn <= 0 {
+		return 0, 0, fmt.Errorf("invalid varint")
+	}
+	return v, vn, nil
+}
+
+// blockSizeAt returns the size of the block data of the section of length l
+// starting at off, i.e. l minus the length of the CID. If the CID can't be
+// parsed from a short prefix, the whole section is counted.
+func blockSizeAt(r io.ReaderAt, off int64, l uint64) int64 {
+	var buf [128]byte
+	n, _ := r.ReadAt(buf[:], off)
+	if cn, _, err := cid.CidFromBytes(buf[:n]); err == nil && uint64(cn) <= l {
+		return int64(l) - int64(cn)
+	}
+	return int64(l)
+}
@@ -0,0 +1,131 @@
+package dagstore
+
+import (
+	"context"
+	"os"
+
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// ShardGroupFunc maps a shard to the group it belongs to, for the purposes of
+// aggregating reports. Groups are application-defined, e.g. a client, a
+// storage tier, or a sector.
+type ShardGroupFunc func(key shard.Key) string
+
+// LocalityStats summarizes data locality for a set of shards.
+type LocalityStats struct {
+	// Shards is the total number of shards in the set.
+	Shards int
+	// LocalTransient is the number of shards with a local transient copy.
+	LocalTransient int
+	// LocalMount is the number of shards without a local transient copy,
+	// but whose mount is local (e.g. filesystem mounts).
+	LocalMount int
+	// RemoteOnly is the number of shards whose data is only available
+	// remotely, and would need to be fetched upon acquire.
+	RemoteOnly int
+	// LocalBytes is the total size of the local transient copies. Transients
+	// shared by several shards are only counted once.
+	LocalBytes int64
+
+	seen map[string]struct{} // transient paths already accounted for.
+}
+
+// LocalityReport summarizes, per group and per mount scheme, where the data
+// of the shards known to the DAG store lives.
+type LocalityReport struct {
+	// Total aggregates all shards.
+	Total LocalityStats
+	// ByGroup aggregates shards by the group determined by
+	// Config.ShardGroup. If no ShardGroup function is configured, all shards
+	// are in the "" group.
+	ByGroup map[string]*LocalityStats
+	// ByScheme aggregates shards by the scheme of their mount, as registered
+	// in the mount registry.
+	ByScheme map[string]*LocalityStats
+}
+
+// LocalityReport returns a report on the locality of the data of all shards
+// known to the DAG store. It inspects the transients directory, but doesn't
+// interact with mounts, so it's cheap to call periodically.
+func (d *DAGStore) LocalityReport(ctx context.Context) (*LocalityReport, error) {
+	report := &LocalityReport{
+		ByGroup:  make(map[string]*LocalityStats),
+		ByScheme: make(map[string]*LocalityStats),
+	}
+
+	d.lk.RLock()
+	shards := make([]*Shard, 0, len(d.shards))
+	for _, s := range d.shards {
+		shards = append(shards, s)
+	}
+	d.lk.RUnlock()
+
+	for _, s := range shards {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// the mount and key are immutable, so no need to hold the shard lock.
+		var group string
+		if d.config.ShardGroup != nil {
+			group = d.config.ShardGroup(s.key)
+		}
+
+		var scheme string
+		if u, err := d.mounts.Represent(s.mount); err == nil {
+			scheme = u.Scheme
+		} else {
+			log.Warnw("failed to represent mount for locality report", "shard", s.key, "error", err)
+		}
+
+		path := s.mount.TransientPath()
+		var size int64
+		if path != "" {
+			if fi, err := os.Stat(path); err == nil {
+				size = fi.Size()
+			} else {
+				path = ""
+			}
+		}
+		remote := s.mount.Underlying().Info().Kind == mount.KindRemote
+
+		for _, stats := range []*LocalityStats{
+			&report.Total,
+			statsFor(report.ByGroup, group),
+			statsFor(report.ByScheme, scheme),
+		} {
+			stats.add(path, size, remote)
+		}
+	}
+	return report, nil
+}
+
+func statsFor(m map[string]*LocalityStats, k string) *LocalityStats {
+	stats, ok := m[k]
+	if !ok {
+		stats = &LocalityStats{}
+		m[k] = stats
+	}
+	return stats
+}
+
+func (l *LocalityStats) add(transient string, size int64, remote bool) {
+	l.Shards++
+	switch {
+	case transient != "":
+		l.LocalTransient++
+		if l.seen == nil {
+			l.seen = make(map[string]struct{})
+		}
+		if _, ok := l.seen[transient]; !ok {
+			l.seen[transient] = struct{}{}
+			l.LocalBytes += size
+		}
+	case remote:
+		l.RemoteOnly++
+	default:
+		l.LocalMount++
+	}
+}
@@ -0,0 +1,143 @@
+package dagstore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// instanceLease is the lease on a DAG store, persisted in the datastore by
+// the instance that holds it (see Config.InstanceLockTTL).
+type instanceLease struct {
+	Owner         string    `json:"owner"`
+	Expires       time.Time `json:"expires"`
+	TransientsDir string    `json:"transients_dir"`
+}
+
+// newInstanceID returns an identifier for this DAG store instance, unique
+// across hosts and restarts.
+func newInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b[:]))
+}
+
+// lockKey is the key of the lease of this DAG store in the lock store. Stores
+// under different namespaces of a datastore are leased separately.
+func (d *DAGStore) lockKey() ds.Key {
+	return d.config.DatastoreNamespace
+}
+
+func (d *DAGStore) getLease(ctx context.Context) (*instanceLease, error) {
+	b, err := d.lockStore.Get(ctx, d.lockKey())
+	if errors.Is(err, ds.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get instance lease: %w", err)
+	}
+	var l instanceLease
+	if err := json.Unmarshal(b, &l); err != nil {
+		return nil, fmt.Errorf("failed to decode instance lease: %w", err)
+	}
+	return &l, nil
+}
+
+func (d *DAGStore) putLease(ctx context.Context) error {
+	b, err := json.Marshal(&instanceLease{
+		Owner:         d.config.InstanceID,
+		Expires:       time.Now().Add(d.config.InstanceLockTTL),
+		TransientsDir: d.config.TransientsDir,
+	})
+	if err != nil {
+		return err
+	}
+	if err := d.lockStore.Put(ctx, d.lockKey(), b); err != nil {
+		return fmt.Errorf("failed to put instance lease: %w", err)
+	}
+	return d.lockStore.Sync(ctx, d.lockKey())
+}
+
+// acquireLock takes the lease on the DAG store, unless another instance holds
+// a lease that hasn't expired, in which case it returns ErrLocked, or takes
+// the lease over with Config.TakeOverLock.
+func (d *DAGStore) acquireLock(ctx context.Context) error {
+	l, err := d.getLease(ctx)
+	if err != nil {
+		return err
+	}
+	if l != nil && l.Owner != d.config.InstanceID && time.Now().Before(l.Expires) {
+		if !d.config.TakeOverLock {
+			return fmt.Errorf("%w: held by instance %s until %s", ErrLocked, l.Owner, l.Expires)
+		}
+		log.Warnw("taking over the lock of another dagstore instance", "instance", l.Owner, "expires", l.Expires, "transients_dir", l.TransientsDir)
+	}
+	return d.putLease(ctx)
+}
+
+// holdLock renews the lease on the DAG store every third of its TTL. If the
+// lease has been taken over by another instance, this instance is fenced: it
+// stops writing shard state, and rejects operations that would modify the DAG
+// store with ErrLockLost.
+func (d *DAGStore) holdLock() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(d.config.InstanceLockTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.ctx.Done():
+			return
+		}
+
+		l, err := d.getLease(d.ctx)
+		if err != nil {
+			log.Warnw("failed to check instance lease", "error", err)
+			continue
+		}
+		if l != nil && l.Owner != d.config.InstanceID {
+			atomic.StoreInt32(&d.fenced, 1)
+			log.Errorw("instance lock taken over by another dagstore instance; refusing further writes", "instance", l.Owner)
+			return
+		}
+		if err := d.putLease(d.ctx); err != nil {
+			log.Warnw("failed to renew instance lease", "error", err)
+		}
+	}
+}
+
+// releaseLock drops the lease on the DAG store, if this instance still holds
+// it.
+func (d *DAGStore) releaseLock() {
+	ctx := context.TODO()
+	l, err := d.getLease(ctx)
+	if err != nil {
+		log.Warnw("failed to release instance lease", "error", err)
+		return
+	}
+	if l == nil || l.Owner != d.config.InstanceID {
+		return
+	}
+	if err := d.lockStore.Delete(ctx, d.lockKey()); err != nil {
+		log.Warnw("failed to release instance lease", "error", err)
+	}
+}
+
+// isFenced returns whether this instance lost its lease to another one.
+func (d *DAGStore) isFenced() bool {
+	return atomic.LoadInt32(&d.fenced) == 1
+}
@@ -0,0 +1,106 @@
+package dagstore
+
+import (
+	"hash/fnv"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// haltRequest is a request for an event loop worker to stop processing tasks
+// until resume is closed; the worker closes halted once it has stopped.
+type haltRequest struct {
+	halted chan struct{}
+	resume chan struct{}
+}
+
+// loopOf returns the index of the event loop worker, out of n, that owns the
+// shard with the given key.
+func loopOf(k shard.Key, n int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(k.String()))
+	return int(h.Sum32() % uint32(n))
+}
+
+// coordinate runs the operations that span all event loop workers: GC,
+// reconfiguration and the commit of moves of transients across tiers, which
+// run with exclusivity while all workers are halted, and pausing/resuming,
+// which is relayed to every worker.
+func (d *DAGStore) coordinate() {
+	defer d.wg.Done()
+
+	for {
+		select {
+		case req := <-d.gcCh:
+			resume := make(chan struct{})
+			if !d.haltLoops(resume) {
+				return
+			}
+			d.gc(req)
+			close(resume)
+
+		case req := <-d.reconfigCh:
+			resume := make(chan struct{})
+			if !d.haltLoops(resume) {
+				return
+			}
+			d.reconfigure(req.cfg)
+			close(resume)
+			close(req.done)
+
+		case req := <-d.tierCh:
+			resume := make(chan struct{})
+			if !d.haltLoops(resume) {
+				return
+			}
+			req.done <- d.commitTierMove(req)
+			close(resume)
+
+		case req := <-d.pauseCh:
+			// registrations are rejected from the moment the workers start
+			// pausing until they've all resumed, so that they never queue up
+			// behind a paused worker.
+			if req.pause {
+				d.setPausedFlag(true)
+			}
+			for _, ch := range d.loopPauseCh {
+				r := &pauseRequest{pause: req.pause, done: make(chan struct{})}
+				select {
+				case ch <- r:
+				case <-d.ctx.Done():
+					return
+				}
+				select {
+				case <-r.done:
+				case <-d.ctx.Done():
+					return
+				}
+			}
+			if !req.pause {
+				d.setPausedFlag(false)
+			}
+			close(req.done)
+
+		case <-d.ctx.Done():
+			return
+		}
+	}
+}
+
+// haltLoops halts all event loop workers until resume is closed. It returns
+// false if the DAG store was closed in the meantime.
+func (d *DAGStore) haltLoops(resume chan struct{}) bool {
+	for _, ch := range d.haltCh {
+		req := &haltRequest{halted: make(chan struct{}), resume: resume}
+		select {
+		case ch <- req:
+		case <-d.ctx.Done():
+			return false
+		}
+		select {
+		case <-req.halted:
+		case <-d.ctx.Done():
+			return false
+		}
+	}
+	return true
+}
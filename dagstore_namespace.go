@@ -0,0 +1,160 @@
+package dagstore
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// NamespaceQuota limits the resources that the shards of a namespace can take
+// up. Zero values are unlimited.
+type NamespaceQuota struct {
+	// MaxShards is the maximum number of shards registered in the namespace.
+	// Registrations beyond it fail with ErrNamespaceQuotaExceeded.
+	MaxShards int
+
+	// MaxTransientBytes is the maximum number of bytes taken up by the
+	// transients of the shards in the namespace. Fetches that would create a
+	// transient beyond it fail with ErrNamespaceQuotaExceeded; running GC on
+	// the namespace frees up room.
+	MaxTransientBytes int64
+}
+
+// NamespaceUsage reports the resources that the shards of a namespace take up.
+type NamespaceUsage struct {
+	// Shards is the number of shards registered in the namespace.
+	Shards int
+	// TransientBytes is the number of bytes taken up by their transients.
+	TransientBytes int64
+}
+
+// NamespaceUsage returns the resources currently taken up by the shards in
+// namespace ns. The empty namespace refers to shards with non-namespaced keys.
+func (d *DAGStore) NamespaceUsage(ns string) NamespaceUsage {
+	d.lk.RLock()
+	usage := NamespaceUsage{Shards: d.nsCount[ns]}
+	var paths []string
+	for k, s := range d.shards {
+		if k.Namespace() != ns {
+			continue
+		}
+		if path := s.mount.TransientPath(); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	d.lk.RUnlock()
+
+	// stat the transients without holding the lock; deduplicated transients
+	// are counted once.
+	seen := make(map[string]struct{}, len(paths))
+	for _, path := range paths {
+		if _, ok := seen[path]; ok {
+			continue
+		}
+		seen[path] = struct{}{}
+		if fi, err := os.Stat(path); err == nil {
+			usage.TransientBytes += fi.Size()
+		}
+	}
+	return usage
+}
+
+// addShard adds a shard to the catalogue, and accounts for it in the shard
+// count of its namespace. It must be called with d.lk held.
+func (d *DAGStore) addShard(s *Shard) {
+	if _, ok := d.shards[s.key]; !ok {
+		if d.nsCount == nil {
+			d.nsCount = make(map[string]int)
+		}
+		d.nsCount[s.key.Namespace()]++
+	}
+	d.shards[s.key] = s
+}
+
+// removeShard removes a shard from the catalogue, unless it was replaced in
+// the meantime. It must be called with d.lk held.
+func (d *DAGStore) removeShard(s *Shard) {
+	if d.shards[s.key] != s {
+		return
+	}
+	delete(d.shards, s.key)
+	if ns := s.key.Namespace(); d.nsCount[ns] > 1 {
+		d.nsCount[ns]--
+	} else {
+		delete(d.nsCount, ns)
+	}
+}
+
+// AllShardsInfoInNamespace returns the current state of all shards registered
+// in namespace ns. The empty namespace refers to shards with non-namespaced
+// keys.
+func (d *DAGStore) AllShardsInfoInNamespace(ns string) AllShardsInfo {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+
+	ret := make(AllShardsInfo)
+	for k, s := range d.shards {
+		if k.Namespace() != ns {
+			continue
+		}
+		s.lk.RLock()
+		info := d.shardInfo(s)
+		s.lk.RUnlock()
+		ret[k] = info
+	}
+	return ret
+}
+
+// GCNamespace performs garbage collection like GC, but only on the shards
+// registered in namespace ns, so that a tenant can reclaim room under its
+// quota without affecting others.
+func (d *DAGStore) GCNamespace(ctx context.Context, ns string) (*GCResult, error) {
+	filter := func(k shard.Key) bool { return k.Namespace() == ns }
+	return d.requestGC(ctx, &gcRequest{filter: filter})
+}
+
+// checkShardQuota verifies that registering the shard with key k, on top of
+// pending shards of the same namespace about to be registered, would not
+// exceed the shard count quota of its namespace. It must be called with d.lk
+// held.
+func (d *DAGStore) checkShardQuota(k shard.Key, pending int) error {
+	ns := k.Namespace()
+	q, ok := d.config.NamespaceQuotas[ns]
+	if !ok || q.MaxShards <= 0 {
+		return nil
+	}
+	if n := d.nsCount[ns]; n+pending >= q.MaxShards {
+		return fmt.Errorf("%s: %w: namespace %q has %d shards", k.String(), ErrNamespaceQuotaExceeded, ns, n)
+	}
+	return nil
+}
+
+// checkTransientQuota verifies that fetching the shard would not exceed the
+// transient bytes quota of its namespace. Fetches that don't create a
+// transient are always allowed.
+func (d *DAGStore) checkTransientQuota(ctx context.Context, s *Shard) error {
+	ns := s.key.Namespace()
+	q, ok := d.config.NamespaceQuotas[ns]
+	if !ok || q.MaxTransientBytes <= 0 {
+		return nil
+	}
+	if s.mount.Passthrough() || s.mount.TransientPath() != "" {
+		return nil
+	}
+
+	// the size may be unknown until fetched, in which case we only check
+	// that the namespace has room left.
+	var size int64
+	if stat, err := s.mount.Stat(ctx); err == nil {
+		size = stat.Size
+	}
+
+	usage := d.NamespaceUsage(ns)
+	if usage.TransientBytes >= q.MaxTransientBytes || usage.TransientBytes+size > q.MaxTransientBytes {
+		return fmt.Errorf("%s: %w: namespace %q uses %d of %d transient bytes, and the shard needs %d",
+			s.key.String(), ErrNamespaceQuotaExceeded, ns, usage.TransientBytes, q.MaxTransientBytes, size)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package dagstore
+
+import (
+	"context"
+	"fmt"
+)
+
+// pauseRequest is a request to pause or resume the event loop; done is closed
+// once the event loop has applied it.
+type pauseRequest struct {
+	pause bool
+	done  chan struct{}
+}
+
+// Pause pauses the DAG store for maintenance, e.g. to swap the underlying
+// storage or to run consistency checks.
+//
+// While paused, the DAG store stops dispatching new external tasks: acquires,
+// destroys and recoveries queue up and are processed upon Resume, whereas
+// registrations are rejected with ErrPaused. Operations already in flight
+// (fetches, indexing, etc.) continue, and their completions are processed as
+// usual, as are releases of accessors. GC requests are also processed.
+//
+// Pause returns once the event loop has stopped dispatching external tasks.
+// Pausing an already paused DAG store is a no-op. If ctx is done first, Pause
+// returns its error; the pause is still applied if the event loop had taken
+// it already, as Paused reports.
+func (d *DAGStore) Pause(ctx context.Context) error {
+	return d.setPaused(ctx, true)
+}
+
+// Resume resumes a DAG store paused with Pause, dispatching all external
+// tasks that were queued up in the meantime. Resuming a DAG store that is
+// not paused is a no-op.
+func (d *DAGStore) Resume(ctx context.Context) error {
+	return d.setPaused(ctx, false)
+}
+
+// Paused returns whether the DAG store is paused.
+func (d *DAGStore) Paused() bool {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+	return d.paused
+}
+
+// setPaused relays a pause request to the coordinator, which flips
+// d.paused as it applies it, so that an error returned here (e.g. if ctx is
+// done before the request is taken) never leaves d.paused out of step with
+// the event loop workers.
+func (d *DAGStore) setPaused(ctx context.Context, pause bool) error {
+	req := &pauseRequest{pause: pause, done: make(chan struct{})}
+	select {
+	case d.pauseCh <- req:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-d.ctx.Done():
+		return fmt.Errorf("dag store closed")
+	}
+
+	select {
+	case <-req.done:
+		if pause {
+			log.Infow("dagstore paused")
+		} else {
+			log.Infow("dagstore resumed")
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-d.ctx.Done():
+		return fmt.Errorf("dag store closed")
+	}
+}
+
+// setPausedFlag sets d.paused, which gates registrations.
+func (d *DAGStore) setPausedFlag(paused bool) {
+	d.lk.Lock()
+	d.paused = paused
+	d.lk.Unlock()
+}
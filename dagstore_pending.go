@@ -0,0 +1,86 @@
+package dagstore
+
+import (
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// PendingOps describes the work pending on a shard, so that callers can tell
+// a shard that's stuck from one that's busy, e.g. one that has been
+// initializing for a while with acquirers piling up.
+type PendingOps struct {
+	// Tasks is the number of tasks for the shard queued for the event loop,
+	// and not processed yet, by operation.
+	Tasks map[OpType]int
+
+	// Registering, Recovering and Destroying are set while a registration,
+	// recovery or destroy of the shard is in progress; destroys are in
+	// progress until the references of a tombstoned shard are drained.
+	Registering bool
+	Recovering  bool
+	Destroying  bool
+	// Initializing is set while the data of the shard is being fetched and
+	// indexed, by an initialization or a recovery.
+	Initializing bool
+
+	// InitQueuePosition is the 1-based position of the shard in the lazy
+	// initialization queue, or 0 if it's not queued.
+	InitQueuePosition int
+
+	// QueuedAcquirers is the number of acquirers waiting for the shard to
+	// become available, e.g. until it's initialized.
+	QueuedAcquirers int
+	// WaitingAcquirers is the number of acquirers waiting for a slot to open
+	// the shard (see Config.MaxConcurrentAcquiresPerShard), and
+	// OpeningAcquirers the number of those opening it.
+	WaitingAcquirers int
+	OpeningAcquirers int
+}
+
+// Idle returns whether no work is pending on the shard.
+func (p PendingOps) Idle() bool {
+	return len(p.Tasks) == 0 && !p.Registering && !p.Initializing && !p.Recovering && !p.Destroying &&
+		p.InitQueuePosition == 0 && p.QueuedAcquirers == 0 && p.WaitingAcquirers == 0 && p.OpeningAcquirers == 0
+}
+
+// PendingOps returns the work pending on the shard with the given key: the
+// tasks queued for the event loop, the operations in progress, and the
+// acquirers waiting for the shard.
+//
+// If the shard is not known, ErrShardUnknown is returned.
+func (d *DAGStore) PendingOps(key shard.Key) (PendingOps, error) {
+	d.lk.RLock()
+	s, ok := d.shards[key]
+	d.lk.RUnlock()
+	if !ok {
+		return PendingOps{}, ErrShardUnknown
+	}
+
+	var ret PendingOps
+	s.lk.RLock()
+	ret.Registering = s.wRegister != nil
+	ret.Recovering = s.wRecover != nil || s.state == ShardStateRecovering
+	ret.Destroying = s.wDestroy != nil || s.state == ShardStateTombstoned
+	ret.Initializing = s.state == ShardStateInitializing
+	ret.QueuedAcquirers = len(s.wAcquire)
+	ret.WaitingAcquirers = len(s.wDispatch)
+	ret.OpeningAcquirers = s.opening
+	if d.lazyInits != nil {
+		ret.InitQueuePosition = d.lazyInits.position(s)
+	}
+	s.lk.RUnlock()
+
+	d.initsLk.Lock()
+	if _, ok := d.inits[key]; ok {
+		ret.Initializing = true
+	}
+	d.initsLk.Unlock()
+
+	d.pendingLk.Lock()
+	ret.Tasks = make(map[OpType]int, len(d.pendingByShard[key]))
+	for op, n := range d.pendingByShard[key] {
+		ret.Tasks[op] = n
+	}
+	d.pendingLk.Unlock()
+
+	return ret, nil
+}
@@ -0,0 +1,52 @@
+package dagstore
+
+import (
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// FetchProgress is the progress of the fetch of a shard's transient from its
+// mount, reported by OpShardFetchProgress traces.
+type FetchProgress struct {
+	// Transferred is the number of bytes transferred so far.
+	Transferred int64
+	// Total is the size of the mount's asset, or 0 if it's unknown.
+	Total int64
+}
+
+// Done returns whether the fetch has transferred the whole asset.
+func (p FetchProgress) Done() bool {
+	return p.Total > 0 && p.Transferred >= p.Total
+}
+
+// fetchProgress returns the progress function of the upgrader of the shard
+// with the given key, or nil if progress traces are disabled. Progress is
+// reported at most once per Config.FetchProgressInterval, and always when the
+// fetch completes.
+func (d *DAGStore) fetchProgress(key shard.Key) mount.ProgressFunc {
+	interval := d.config.FetchProgressInterval
+	if interval <= 0 || !d.tracing() {
+		return nil
+	}
+
+	var (
+		lk   sync.Mutex
+		last time.Time
+	)
+	return func(transferred, total int64) {
+		p := FetchProgress{Transferred: transferred, Total: total}
+		now := time.Now()
+		lk.Lock()
+		if !p.Done() && now.Sub(last) < interval {
+			lk.Unlock()
+			return
+		}
+		last = now
+		lk.Unlock()
+
+		d.traceOutOfLoop(Trace{Key: key, Op: OpShardFetchProgress, Progress: &p})
+	}
+}
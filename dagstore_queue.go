@@ -0,0 +1,113 @@
+package dagstore
+
+import (
+	"fmt"
+	"time"
+)
+
+// queueAcquirer parks an acquirer until the shard becomes active, arming its
+// queue wait timer if Config.MaxAcquireQueueWait is set. If the queue is full,
+// it fails the acquirer with ErrAcquireQueueFull and returns false. It must be
+// called from the event loop.
+func (d *DAGStore) queueAcquirer(s *Shard, w *waiter) bool {
+	if max := d.config.MaxQueuedAcquires; max > 0 && len(s.wAcquire) >= max {
+		log.Debugw("acquire queue full; rejecting acquirer", "shard", s.key, "queued", len(s.wAcquire))
+		err := fmt.Errorf("%s: %w: %d acquirers waiting", s.key.String(), ErrAcquireQueueFull, len(s.wAcquire))
+		d.dispatchResult(&ShardResult{Key: s.key, Error: err}, w)
+		return false
+	}
+
+	s.wAcquire = append(s.wAcquire, w)
+
+	if wait := d.config.MaxAcquireQueueWait; wait > 0 {
+		w.expiry = time.AfterFunc(wait, func() {
+			_ = d.queueTask(&task{op: OpShardAcquireExpire, shard: s, waiter: w}, d.completionCh)
+		})
+	}
+	return true
+}
+
+// expireAcquirer removes an acquirer that has waited for longer than
+// Config.MaxAcquireQueueWait from the queue, failing it with
+// ErrAcquireQueueTimeout. It's a no-op if the acquirer is no longer queued. It
+// must be called from the event loop.
+func (d *DAGStore) expireAcquirer(s *Shard, w *waiter) {
+	for i, queued := range s.wAcquire {
+		if queued != w {
+			continue
+		}
+		s.wAcquire = append(s.wAcquire[:i], s.wAcquire[i+1:]...)
+
+		log.Debugw("acquirer waited for too long; expiring", "shard", s.key)
+		err := fmt.Errorf("%s: %w after %s", s.key.String(), ErrAcquireQueueTimeout, d.config.MaxAcquireQueueWait)
+		d.dispatchResult(&ShardResult{Key: s.key, Error: err}, w)
+		return
+	}
+}
+
+// dispatchAcquirer marks the shard as serving, takes a reference for the
+// acquirer, and launches the acquire. If Config.MaxConcurrentAcquiresPerShard
+// acquirers are already opening the shard, the acquirer waits for a slot in
+// FIFO order. It must be called from the event loop.
+func (d *DAGStore) dispatchAcquirer(s *Shard, w *waiter) {
+	// mark as serving.
+	s.state = ShardStateServing
+	now := time.Now()
+	s.recordAcquire(now)
+	if caller := w.acquireOpts.Caller; caller != "" {
+		s.callers.recordAcquire(caller, now, d.config.MaxCallersPerShard)
+	}
+
+	// optimistically increment the refcount to acquire the shard.
+	// The goroutine will send an `OpShardRelease` task
+	// to the event loop if it fails to acquire the shard.
+	d.refAcquired(s, w)
+
+	if max := d.config.MaxConcurrentAcquiresPerShard; max > 0 {
+		if s.opening >= max {
+			log.Debugw("too many acquirers opening shard; waiting for a slot", "shard", s.key, "opening", s.opening)
+			s.wDispatch = append(s.wDispatch, w)
+			return
+		}
+		s.opening++
+		w.slot = true
+	}
+	go d.acquireAsync(w.ctx, w, s, s.mount)
+}
+
+// acquireDone releases the opening slot of an acquirer, and launches waiting
+// acquirers in FIFO order, as long as slots are available; if the limit was
+// removed by Reconfigure, all of them are launched without taking a slot.
+// Acquirers whose context was cancelled while waiting are released in place,
+// without opening the shard, returning the outcome of the destroy of a
+// tombstoned shard whose references drained, if any. It must be called from
+// the event loop.
+func (d *DAGStore) acquireDone(s *Shard) (destroyed *ShardDestroyed) {
+	if s.opening > 0 {
+		s.opening--
+	}
+	max := d.config.MaxConcurrentAcquiresPerShard
+	for len(s.wDispatch) > 0 && (max <= 0 || s.opening < max) {
+		w := s.wDispatch[0]
+		s.wDispatch[0] = nil
+		s.wDispatch = s.wDispatch[1:]
+
+		if err := w.ctx.Err(); err != nil {
+			log.Debugw("context cancelled while waiting to open shard; releasing", "shard", s.key, "error", err)
+			// releasing through the event loop would block it on its own
+			// queue.
+			if res := d.releaseShard(s, &task{op: OpShardRelease, shard: s, ref: w.refID}); res != nil {
+				destroyed = res
+			}
+			d.dispatchResult(&ShardResult{Key: s.key, Error: err}, w)
+			continue
+		}
+
+		if max > 0 {
+			s.opening++
+			w.slot = true
+		}
+		go d.acquireAsync(w.ctx, w, s, s.mount)
+	}
+	return destroyed
+}
@@ -0,0 +1,25 @@
+package dagstore
+
+import (
+	"fmt"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// ReadOnly returns whether the DAG store was opened in read-only mode (see
+// Config.ReadOnly).
+func (d *DAGStore) ReadOnly() bool {
+	return d.config.ReadOnly
+}
+
+// checkWritable returns ErrReadOnly, wrapped with the shard key, if the DAG
+// store is in read-only mode, or ErrLockLost if it lost its instance lease.
+func (d *DAGStore) checkWritable(key shard.Key) error {
+	if d.config.ReadOnly {
+		return fmt.Errorf("%s: %w", key.String(), ErrReadOnly)
+	}
+	if d.isFenced() {
+		return fmt.Errorf("%s: %w", key.String(), ErrLockLost)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package dagstore
+
+import (
+	"context"
+	"fmt"
+)
+
+// reconfigRequest is a request to apply configuration changes; done is
+// closed once they've been applied.
+type reconfigRequest struct {
+	cfg  Config
+	done chan struct{}
+}
+
+// Reconfigure changes selected configuration values of a started DAG store at
+// runtime, without restarting it. Only the following fields of cfg are
+// applied; all others are ignored, so cfg is typically the Config the DAG store
+// was created with, with the desired changes:
+//
+//   - MaxConcurrentIndex and MaxConcurrentReadyFetches. Operations in flight
+//     are unaffected; lowering a limit below the number of operations in
+//     flight makes new ones wait until enough of them finish.
+//   - MaxConcurrentAcquiresPerShard, MaxQueuedAcquires and
+//     MaxAcquireQueueWait, which apply to acquirers dispatched or queued from
+//     then on.
+//   - MaxPendingTasks, MaxPendingTasksPerOp and Backpressure. Callers blocked
+//     waiting for admission are evaluated against the new limits; tasks
+//     submitted while no limit was configured aren't accounted.
+//   - ErrorHistorySize and MaxCallersPerShard, which apply to the next
+//     failure or acquire recorded for each shard.
+//   - GCRecencyHalfLife, which applies to the next GC.
+//   - TraceSinks, which replace the current sinks, resetting TraceSinkStats.
+//     Traces already buffered for the previous sinks are still written to
+//     them.
+//
+// Zero values mean the same as in NewDAGStore, i.e. unlimited or the default.
+//
+// Changes are applied between event loop iterations, with all workers halted
+// like during GC, so that every task is processed under either the old or the
+// new configuration. Reconfigure returns once they've been applied.
+func (d *DAGStore) Reconfigure(ctx context.Context, cfg Config) error {
+	req := &reconfigRequest{cfg: cfg, done: make(chan struct{})}
+	select {
+	case d.reconfigCh <- req:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-d.ctx.Done():
+		return fmt.Errorf("dag store closed")
+	}
+
+	select {
+	case <-req.done:
+		log.Infow("dagstore reconfigured")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-d.ctx.Done():
+		return fmt.Errorf("dag store closed")
+	}
+}
+
+// reconfigure applies the reconfigurable fields of cfg. It must be called
+// from the coordinator, with all event loop workers halted.
+func (d *DAGStore) reconfigure(cfg Config) {
+	d.throttleIndex.SetMax(cfg.MaxConcurrentIndex)
+	d.throttleReaadyFetch.SetMax(cfg.MaxConcurrentReadyFetches)
+	d.admission.setLimits(cfg.MaxPendingTasks, cfg.MaxPendingTasksPerOp, cfg.Backpressure)
+
+	// the config reflects the applied values; the fields read through it
+	// are only read from the event loop, or from GC, which is also run by
+	// the coordinator.
+	if cfg.ErrorHistorySize <= 0 {
+		cfg.ErrorHistorySize = DefaultErrorHistorySize
+	}
+	if cfg.MaxCallersPerShard <= 0 {
+		cfg.MaxCallersPerShard = DefaultMaxCallersPerShard
+	}
+	if cfg.GCRecencyHalfLife <= 0 {
+		cfg.GCRecencyHalfLife = DefaultGCRecencyHalfLife
+	}
+	d.config.MaxConcurrentIndex = cfg.MaxConcurrentIndex
+	d.config.MaxConcurrentReadyFetches = cfg.MaxConcurrentReadyFetches
+	d.config.MaxConcurrentAcquiresPerShard = cfg.MaxConcurrentAcquiresPerShard
+	d.config.MaxQueuedAcquires = cfg.MaxQueuedAcquires
+	d.config.MaxAcquireQueueWait = cfg.MaxAcquireQueueWait
+	d.config.ErrorHistorySize = cfg.ErrorHistorySize
+	d.config.MaxCallersPerShard = cfg.MaxCallersPerShard
+	d.config.GCRecencyHalfLife = cfg.GCRecencyHalfLife
+	d.config.MaxPendingTasks = cfg.MaxPendingTasks
+	d.config.MaxPendingTasksPerOp = cfg.MaxPendingTasksPerOp
+	d.config.Backpressure = cfg.Backpressure
+	d.config.TraceSinks = cfg.TraceSinks
+
+	d.replaceTraceSinks(cfg.TraceSinks)
+}
+
+// replaceTraceSinks replaces the trace sinks with new ones for the given
+// options, stopping the writers of the previous ones once they've drained
+// their buffers.
+func (d *DAGStore) replaceTraceSinks(opts []TraceSinkOpts) {
+	sinks := make([]*traceSink, 0, len(opts))
+	for _, o := range opts {
+		sinks = append(sinks, newTraceSink(o))
+	}
+
+	d.traceLk.Lock()
+	prev := d.traceSinks
+	d.traceSinks = sinks
+	d.traceLk.Unlock()
+
+	for _, sink := range prev {
+		close(sink.done)
+	}
+	for _, sink := range sinks {
+		d.wg.Add(1)
+		go d.traceWriter(sink)
+	}
+}
@@ -0,0 +1,159 @@
+package dagstore
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// DefaultRecoverAllPacing is the default value of Config.RecoverAllPacing.
+var DefaultRecoverAllPacing = 100 * time.Millisecond
+
+// RecoverAll recovers all shards in ShardStateErrored, e.g. after an outage of
+// the storage backing their mounts.
+//
+// Errored shards are grouped by failure domain, i.e. by the type and endpoint
+// of their mounts (see MountHealth), and the domains are recovered one at a
+// time, in lexical order. Before recovering a domain, RecoverAll probes a
+// sample of its mounts like CheckMountHealth; if all probes fail, the backend
+// is deemed still down, and the shards of the domain are skipped, reporting
+// ErrMountDegraded, rather than hammering the endpoint with recoveries bound
+// to fail.
+//
+// Within a domain, at most concurrency recoveries run at once (unbounded if
+// concurrency <= 0), and each one is issued after a random delay of up to
+// Config.RecoverAllPacing, so that recoveries don't hit the mounts in
+// lockstep.
+//
+// The result of each recovery or skipped shard is sent to out, if non-nil,
+// which the caller must service. RecoverAll blocks until all recoveries have
+// completed, and only returns an error if the context is cancelled,
+// ErrReadOnly in read-only mode, or ErrLockLost if the DAG store lost its
+// instance lease.
+func (d *DAGStore) RecoverAll(ctx context.Context, concurrency int, out chan ShardResult) error {
+	if d.config.ReadOnly {
+		return ErrReadOnly
+	}
+	if d.isFenced() {
+		return ErrLockLost
+	}
+
+	domains := d.erroredByDomain()
+	names := make([]string, 0, len(domains))
+	var total int
+	for g, shards := range domains {
+		names = append(names, g)
+		total += len(shards)
+	}
+	sort.Strings(names)
+
+	log.Infow("recovering all errored shards", "shards", total, "domains", len(names), "concurrency", concurrency)
+
+	for _, g := range names {
+		if ctx.Err() != nil {
+			break
+		}
+		shards := domains[g]
+		if h := d.probeMountGroup(ctx, g, shards); h.Degraded {
+			if ctx.Err() != nil {
+				break
+			}
+			log.Warnw("recover all: mounts still down; skipping failure domain", "mount", g, "shards", len(shards), "error", h.LastError)
+			for _, s := range shards {
+				d.sendRecoverResult(ctx, out, ShardResult{Key: s.key, Error: fmt.Errorf("%s: %w: %s", s.key.String(), ErrMountDegraded, g)})
+			}
+			continue
+		}
+		log.Infow("recover all: recovering failure domain", "mount", g, "shards", len(shards))
+		d.recoverShards(ctx, shards, concurrency, out)
+	}
+	return ctx.Err()
+}
+
+// erroredByDomain returns the shards in ShardStateErrored, grouped by failure
+// domain (see DAGStore.mountGroup).
+func (d *DAGStore) erroredByDomain() map[string][]*Shard {
+	d.lk.RLock()
+	defer d.lk.RUnlock()
+
+	ret := make(map[string][]*Shard)
+	for _, s := range d.shards {
+		s.lk.RLock()
+		errored := s.state == ShardStateErrored
+		s.lk.RUnlock()
+		if errored {
+			g := d.mountGroup(s)
+			ret[g] = append(ret[g], s)
+		}
+	}
+	return ret
+}
+
+// recoverShards recovers the supplied shards, with at most concurrency
+// recoveries at once, pacing them as configured, and blocks until all
+// recoveries have completed, or the context is cancelled.
+func (d *DAGStore) recoverShards(ctx context.Context, shards []*Shard, concurrency int, out chan ShardResult) {
+	var sem chan struct{}
+	if concurrency > 0 {
+		sem = make(chan struct{}, concurrency)
+	}
+
+	var wg sync.WaitGroup
+loop:
+	for _, s := range shards {
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				break loop
+			}
+		}
+
+		if pacing := d.config.RecoverAllPacing; pacing > 0 {
+			select {
+			case <-time.After(time.Duration(rand.Int63n(int64(pacing)))):
+			case <-ctx.Done():
+				break loop
+			}
+		}
+
+		k := s.key
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if sem != nil {
+				defer func() { <-sem }()
+			}
+
+			res := d.recoverAndWait(ctx, k)
+			if res.Error != nil {
+				log.Warnw("recover all: failed to recover shard", "shard", k, "error", res.Error)
+			}
+			d.sendRecoverResult(ctx, out, res)
+		}()
+	}
+	wg.Wait()
+}
+
+// sendRecoverResult sends the result of a recovery issued by RecoverAll to
+// out, if non-nil.
+func (d *DAGStore) sendRecoverResult(ctx context.Context, out chan ShardResult, res ShardResult) {
+	if out == nil {
+		return
+	}
+	select {
+	case out <- res:
+	case <-ctx.Done():
+	}
+}
+
+// recoverAndWait recovers a shard, and waits for the result of the recovery.
+func (d *DAGStore) recoverAndWait(ctx context.Context, k shard.Key) ShardResult {
+	err := d.RecoverShardSync(ctx, k, RecoverOpts{})
+	return ShardResult{Key: k, Error: err}
+}
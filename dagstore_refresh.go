@@ -0,0 +1,90 @@
+package dagstore
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ipfs/go-datastore/query"
+
+	"github.com/filecoin-project/dagstore/index"
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// Refresh picks up the shards that the writer node registered since the DAG
+// store started, in read-only mode (see Config.ReadOnly), and returns their
+// keys. Only the shards that the writer has made available are picked up;
+// the others are picked up by a later refresh, once they are. Shards that the
+// writer destroys are still known to the replica until it restarts, and fail
+// to be acquired. In read-write mode, it's a no-op, as the DAG store manages
+// the shards itself.
+func (d *DAGStore) Refresh(ctx context.Context) ([]shard.Key, error) {
+	if !d.config.ReadOnly {
+		return nil, nil
+	}
+
+	results, err := d.store.Query(ctx, query.Query{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan dagstore state: %w", err)
+	}
+	defer results.Close()
+
+	var found []*Shard
+	for res := range results.Next() {
+		if res.Error != nil {
+			return nil, fmt.Errorf("failed to scan dagstore state: %w", res.Error)
+		}
+		s := d.hydrateShard(res.Entry)
+		if s == nil {
+			continue
+		}
+		switch s.state {
+		case ShardStateServing:
+			// the acquirers are the writer's.
+			s.state = ShardStateAvailable
+		case ShardStateAvailable:
+		default:
+			continue
+		}
+		d.lk.RLock()
+		_, known := d.shards[s.key]
+		d.lk.RUnlock()
+		if !known {
+			found = append(found, s)
+		}
+	}
+
+	var added, toIndex []shard.Key
+	d.lk.Lock()
+	for _, s := range found {
+		if _, ok := d.shards[s.key]; ok {
+			continue // picked up by a concurrent refresh.
+		}
+		d.addShard(s)
+		added = append(added, s.key)
+		if !s.skipTopLevel {
+			toIndex = append(toIndex, s.key)
+		}
+	}
+	d.lk.Unlock()
+
+	if len(toIndex) > 0 {
+		// as on start, add the shards to the inverted index if it's missing
+		// them, and to the bloom filter.
+		if m, ok := d.TopLevelIndex.(index.ShardMembership); ok {
+			d.wg.Add(1)
+			go d.backfillInverted(m, toIndex)
+		}
+		if d.blooms.enabled() {
+			d.blooms.loading(toIndex)
+			d.wg.Add(1)
+			go func() {
+				defer d.wg.Done()
+				d.coverBloom(toIndex)
+			}()
+		}
+	}
+	if len(added) > 0 {
+		log.Infow("refreshed shard states", "added", len(added))
+	}
+	return added, nil
+}
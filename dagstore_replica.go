@@ -0,0 +1,122 @@
+package dagstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// ReplicaResolver locates replicas of shards held elsewhere, e.g. by another
+// DAG store node, which acquires of local shards that are errored or
+// recovering fall back to (see Config.ReplicaResolver).
+type ReplicaResolver interface {
+	// Replica returns a mount of a replica of the shard with the given key,
+	// or nil if there's none. The mount must support random access.
+	Replica(ctx context.Context, key shard.Key) (mount.Mount, error)
+}
+
+// ReplicaResolverFunc adapts a function to a ReplicaResolver.
+type ReplicaResolverFunc func(ctx context.Context, key shard.Key) (mount.Mount, error)
+
+func (f ReplicaResolverFunc) Replica(ctx context.Context, key shard.Key) (mount.Mount, error) {
+	return f(ctx, key)
+}
+
+// acquireReplica serves an acquire of an errored or recovering shard from a
+// replica, and queues the recovery of an errored shard in the background. It
+// must be called from the event loop.
+func (d *DAGStore) acquireReplica(s *Shard, w *waiter) {
+	var cause error
+	if s.state == ShardStateErrored {
+		cause = s.err
+	}
+	if s.state == ShardStateErrored && !d.config.ReadOnly && !d.isFenced() {
+		log.Infow("acquire: serving errored shard from replica; recovering in the background", "shard", s.key, "error", s.err)
+		s.recoverOnNextAcquire = false
+		// use the global context, so that the recovery outlives the acquire.
+		_ = d.queueTask(&task{op: OpShardRecover, shard: s, waiter: &waiter{ctx: d.ctx}}, d.internalCh)
+	}
+	go d.acquireReplicaAsync(w.ctx, w, s, cause)
+}
+
+// acquireReplicaAsync opens the replica of a shard, and delivers an accessor
+// of it to the acquirer. Replica accessors don't hold a reference to the
+// local shard, so that its recovery proceeds regardless of them.
+//
+// If the replica can't be opened, the acquire of an errored shard fails with
+// the error of the shard, and the acquire of a recovering shard is queued
+// again to wait for the recovery.
+func (d *DAGStore) acquireReplicaAsync(ctx context.Context, w *waiter, s *Shard, cause error) {
+	fail := func(err error) {
+		log.Warnw("acquire: failed to open replica", "shard", s.key, "error", err)
+		if cause == nil {
+			w.noReplica = true
+			if err := d.queueTask(&task{op: OpShardAcquire, shard: s, waiter: w}, d.externalCh); err != nil {
+				d.dispatchResult(&ShardResult{Key: s.key, Error: err}, w)
+			}
+			return
+		}
+		err = fmt.Errorf("shard is in errored state; err: %w; replica: %s", cause, err)
+		d.dispatchResult(&ShardResult{Key: s.key, Error: err}, w)
+	}
+
+	mnt, err := d.config.ReplicaResolver.Replica(ctx, s.key)
+	switch {
+	case err != nil:
+		fail(fmt.Errorf("failed to resolve replica: %w", err))
+		return
+	case mnt == nil:
+		fail(fmt.Errorf("no replica found"))
+		return
+	}
+	if info := mnt.Info(); !info.AccessRandom || !info.AccessSeek {
+		fail(fmt.Errorf("replica mount does not support random access"))
+		return
+	}
+
+	reader, err := mnt.Fetch(ctx)
+	if err != nil {
+		fail(fmt.Errorf("failed to fetch replica: %w", d.redact(err)))
+		return
+	}
+
+	// use the local index if we have it, otherwise index the replica.
+	idx, err := d.indices.GetFullIndex(s.key)
+	if err != nil {
+		idx, err = d.generateIndex(reader)
+		if err == nil {
+			_, err = reader.Seek(0, io.SeekStart)
+		}
+	}
+	if err != nil {
+		_ = reader.Close()
+		fail(fmt.Errorf("failed to index replica: %w", err))
+		return
+	}
+
+	restrict, err := newRestriction(idx, w.acquireOpts)
+	if err != nil {
+		_ = reader.Close()
+		d.dispatchResult(&ShardResult{Key: s.key, Error: err}, w)
+		return
+	}
+
+	log.Debugw("acquire: successful from replica; returning accessor", "shard", s.key)
+
+	sa, err := NewShardAccessor(reader, idx, s)
+	sa.replica = true
+	sa.restrict = restrict
+	sa.onBlockAccess = w.acquireOpts.OnBlockAccess
+	sa.caller = w.acquireOpts.Caller
+	if lease := w.acquireOpts.Lease; lease > 0 {
+		sa.startLease(lease)
+	}
+	w.notifyDead = func() {
+		log.Warnw("context cancelled while delivering replica accessor; closing", "shard", s.key)
+		_, _ = sa.release(d.completionCh)
+	}
+	d.dispatchResult(&ShardResult{Key: s.key, Accessor: sa, Error: err}, w)
+}
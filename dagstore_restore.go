@@ -0,0 +1,77 @@
+package dagstore
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ipfs/go-datastore/query"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// DefaultRestoreConcurrency is the default value of Config.RestoreConcurrency.
+var DefaultRestoreConcurrency = 16
+
+// restoreState loads the persisted shards into the shard catalogue. The
+// datastore is scanned sequentially, while the shards are hydrated by
+// Config.RestoreConcurrency workers, as hydrating a shard involves filesystem
+// and datastore accesses. No tasks are queued for the restored shards here;
+// Start decides which ones need to resume an operation.
+func (d *DAGStore) restoreState() error {
+	results, err := d.store.Query(d.ctx, query.Query{})
+	if err != nil {
+		return fmt.Errorf("failed to recover dagstore state from store: %w", err)
+	}
+	defer results.Close()
+
+	var (
+		wg      sync.WaitGroup
+		lk      sync.Mutex
+		entries = make(chan query.Entry, d.config.RestoreConcurrency)
+	)
+	for i := 0; i < d.config.RestoreConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range entries {
+				s := d.hydrateShard(e)
+				if s == nil {
+					continue
+				}
+				lk.Lock()
+				d.addShard(s)
+				lk.Unlock()
+			}
+		}()
+	}
+
+	for res := range results.Next() {
+		if res.Error != nil {
+			err = fmt.Errorf("failed to scan dagstore state: %w", res.Error)
+			break
+		}
+		entries <- res.Entry
+	}
+	close(entries)
+	wg.Wait()
+
+	if err == nil {
+		log.Infow("restored shard states", "shards", len(d.shards))
+	}
+	return err
+}
+
+// hydrateShard restores a shard from its persisted state, or returns nil if
+// it can't be restored.
+func (d *DAGStore) hydrateShard(e query.Entry) *Shard {
+	s := &Shard{d: d}
+	if err := s.UnmarshalJSON(e.Value); err != nil {
+		log.Warnf("failed to recover state of shard %s: %s; skipping", shard.KeyFromString(e.Key), err)
+		return nil
+	}
+
+	log.Debugw("restored shard state on dagstore startup", "shard", s.key, "shard state", s.state, "shard error", s.err,
+		"shard lazy", s.lazy)
+	d.restoreHistory(s)
+	return s
+}
@@ -0,0 +1,119 @@
+package dagstore
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/filecoin-project/dagstore/mount"
+)
+
+// AcquireRetryPolicy decides whether a failed fetch of the data of a shard
+// being acquired is retried, and after how long. Policies are configured per
+// mount scheme; see Config.AcquireRetryPolicies.
+type AcquireRetryPolicy interface {
+	// NextBackoff is called after the given failed attempt, counting from 1,
+	// with the time elapsed since the first attempt started, and the error of
+	// the attempt. It returns the delay before the next attempt, and false if
+	// the error should be surfaced instead.
+	NextBackoff(attempt int, elapsed time.Duration, err error) (time.Duration, bool)
+}
+
+// ExponentialRetry is an AcquireRetryPolicy that retries with exponential
+// backoff and jitter, up to a number of attempts and a maximum elapsed time.
+type ExponentialRetry struct {
+	// MaxAttempts is the maximum number of attempts, including the first one.
+	// Unlimited if zero, in which case MaxElapsed should be set.
+	MaxAttempts int
+	// MaxElapsed is the maximum time from the start of the first attempt
+	// until the start of the last one. Unlimited if zero.
+	MaxElapsed time.Duration
+
+	// InitialBackoff is the delay before the first retry. It doubles on every
+	// subsequent retry, up to MaxBackoff, if set.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Jitter randomizes the delays by up to this fraction of their value, in
+	// either direction, so that acquirers failing at once don't retry in
+	// lockstep. Must be within [0, 1].
+	Jitter float64
+
+	// Retryable decides which errors are retried. If nil, all errors are
+	// retried but those wrapping os.ErrNotExist, which retrying can't fix.
+	Retryable func(error) bool
+}
+
+var _ AcquireRetryPolicy = (*ExponentialRetry)(nil)
+
+// NextBackoff implements AcquireRetryPolicy.
+func (r *ExponentialRetry) NextBackoff(attempt int, elapsed time.Duration, err error) (time.Duration, bool) {
+	if r.MaxAttempts > 0 && attempt >= r.MaxAttempts {
+		return 0, false
+	}
+	if r.Retryable != nil {
+		if !r.Retryable(err) {
+			return 0, false
+		}
+	} else if errors.Is(err, os.ErrNotExist) {
+		return 0, false
+	}
+
+	backoff := r.InitialBackoff
+	for i := 1; i < attempt && (r.MaxBackoff == 0 || backoff < r.MaxBackoff); i++ {
+		backoff *= 2
+	}
+	if r.MaxBackoff > 0 && backoff > r.MaxBackoff {
+		backoff = r.MaxBackoff
+	}
+	if r.Jitter > 0 {
+		backoff += time.Duration((rand.Float64()*2 - 1) * r.Jitter * float64(backoff))
+	}
+
+	if r.MaxElapsed > 0 && elapsed+backoff > r.MaxElapsed {
+		return 0, false
+	}
+	return backoff, true
+}
+
+// fetchWithRetry fetches the data of a shard being acquired from its mount,
+// retrying failures according to the retry policy of the scheme of the
+// mount, if any. Errors caused by the context are returned right away.
+func (d *DAGStore) fetchWithRetry(ctx context.Context, s *Shard, mnt mount.Mount) (mount.Reader, error) {
+	start := time.Now()
+	reader, err := mnt.Fetch(ctx)
+	if err == nil || ctx.Err() != nil || len(d.config.AcquireRetryPolicies) == 0 {
+		return reader, err
+	}
+	u, rerr := d.mounts.Represent(s.mount)
+	if rerr != nil {
+		return nil, err
+	}
+	policy, ok := d.config.AcquireRetryPolicies[u.Scheme]
+	if !ok {
+		return nil, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		backoff, retry := policy.NextBackoff(attempt, time.Since(start), err)
+		if !retry {
+			return nil, err
+		}
+		log.Debugw("acquire: fetch failed; retrying", "shard", s.key, "attempt", attempt, "backoff", backoff,
+			"error", d.redact(err))
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+
+		reader, err = mnt.Fetch(ctx)
+		if err == nil || ctx.Err() != nil {
+			return reader, err
+		}
+	}
+}
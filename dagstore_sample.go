@@ -0,0 +1,227 @@
+package dagstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	carv2 "github.com/ipld/go-car/v2"
+	carindex "github.com/ipld/go-car/v2/index"
+	mh "github.com/multiformats/go-multihash"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// SampleReport is the outcome of sampling the content of a shard with
+// SampleShard.
+type SampleReport struct {
+	Key shard.Key
+
+	// Entries is the number of entries in the index of the shard that were
+	// eligible for sampling, i.e. excluding identity CIDs.
+	Entries int
+	// Sampled is the number of blocks sampled; the requested number, or
+	// Entries if the shard has fewer blocks.
+	Sampled int
+	// Verified is the number of sampled blocks whose data matched their
+	// multihash.
+	Verified int
+	// BytesRead is the number of block bytes read from the mount.
+	BytesRead uint64
+	// Failures holds the sampled blocks that couldn't be read or verified.
+	Failures []SampleFailure
+	// Duration is the time taken to read and verify the sampled blocks.
+	Duration time.Duration
+}
+
+// SampleFailure describes a sampled block that failed verification.
+type SampleFailure struct {
+	// Multihash is the multihash of the block, as recorded in the index.
+	Multihash mh.Multihash
+	// Offset is the offset of the block section in the CAR data payload.
+	Offset uint64
+	// Error is the reason the block failed verification.
+	Error error
+}
+
+// OK returns whether all sampled blocks were verified.
+func (r *SampleReport) OK() bool {
+	return r.Verified == r.Sampled && len(r.Failures) == 0
+}
+
+// SampleShard picks n random blocks of a shard from its full index, reads
+// them through the shard's mount, and verifies that their data hashes to the
+// multihash recorded in the index. It's a cheap spot check of the integrity
+// of the shard data, e.g. for storage providers to audit themselves before a
+// proving period; VerifyIndex does a full check of the index instead.
+//
+// Blocks failing verification are reported in the result, not as an error.
+// The shard must have been initialized; it's acquired for the duration of the
+// sampling.
+func (d *DAGStore) SampleShard(ctx context.Context, key shard.Key, n int) (*SampleReport, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid sample size: %d", n)
+	}
+
+	d.lk.RLock()
+	s, ok := d.shards[key]
+	d.lk.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", key.String(), ErrShardUnknown)
+	}
+
+	s.lk.RLock()
+	state := s.state
+	s.lk.RUnlock()
+	if state == ShardStateNew || state == ShardStateInitializing || state == ShardStateArchived {
+		return nil, fmt.Errorf("shard %s is not initialized; state: %s", key, state)
+	}
+
+	idx, err := d.indices.GetFullIndex(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get index for shard %s: %w", key, err)
+	}
+	entries, total, err := sampleEntries(idx, n)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sample index for shard %s: %w", key, err)
+	}
+
+	start := time.Now()
+	res := &SampleReport{Key: key, Entries: total, Sampled: len(entries)}
+	if len(entries) == 0 {
+		return res, nil
+	}
+
+	// hold a reference while reading, so that the shard isn't reclaimed or
+	// destroyed from under us.
+	sa, err := d.AcquireShardSync(ctx, key, AcquireOpts{Caller: "SampleShard"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire shard %s: %w", key, err)
+	}
+	defer sa.Close()
+	data, _, err := sa.CAR()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CAR for shard %s: %w", key, err)
+	}
+
+	r, err := carv2.NewReader(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CAR for shard %s: %w", key, err)
+	}
+	dr, err := r.DataReader()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CAR data payload for shard %s: %w", key, err)
+	}
+
+	var buf []byte
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		read, err := verifySection(dr, e.offset, e.mh, &buf)
+		res.BytesRead += uint64(read)
+		if err != nil {
+			res.Failures = append(res.Failures, SampleFailure{Multihash: e.mh, Offset: e.offset, Error: err})
+			continue
+		}
+		res.Verified++
+	}
+	res.Duration = time.Since(start)
+
+	if !res.OK() {
+		log.Warnw("shard sampling found corrupted blocks", "shard", key, "sampled", res.Sampled,
+			"failed", len(res.Failures))
+	}
+	return res, nil
+}
+
+// sampleEntry is an index entry picked by sampleEntries.
+type sampleEntry struct {
+	mh     mh.Multihash
+	offset uint64
+}
+
+// sampleEntries picks up to n random entries of an index by reservoir
+// sampling, and returns them sorted by offset, along with the number of
+// entries eligible for sampling. Identity multihashes are skipped, as they
+// carry their data inline.
+func sampleEntries(idx carindex.Index, n int) ([]sampleEntry, int, error) {
+	iterableIdx, ok := idx.(carindex.IterableIndex)
+	if !ok {
+		return nil, 0, fmt.Errorf("index of type %T is not iterable", idx)
+	}
+	var (
+		total int
+		ret   = make([]sampleEntry, 0, n)
+	)
+	err := iterableIdx.ForEach(func(h mh.Multihash, offset uint64) error {
+		if dh, err := mh.Decode(h); err == nil && dh.Code == mh.IDENTITY {
+			return nil
+		}
+		total++
+		e := sampleEntry{mh: h, offset: offset}
+		if len(ret) < n {
+			ret = append(ret, e)
+		} else if i := rand.Intn(total); i < n {
+			ret[i] = e
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	// read in offset order, to be friendly with sequential-ish mounts.
+	sort.Slice(ret, func(i, j int) bool { return ret[i].offset < ret[j].offset })
+	return ret, total, nil
+}
+
+// verifySection reads the CAR section at offset, and checks that it holds a
+// block with the expected multihash whose data hashes to it. It returns the
+// number of block bytes read.
+func verifySection(r io.ReaderAt, offset uint64, expected mh.Multihash, bufp *[]byte) (int, error) {
+	var lbuf [binary.MaxVarintLen64]byte
+	n, err := r.ReadAt(lbuf[:], int64(offset))
+	if err != nil && !(errors.Is(err, io.EOF) && n > 0) {
+		return 0, fmt.Errorf("failed to read section length: %w", err)
+	}
+	l, vn := binary.Uvarint(lbuf[:n])
+	if vn <= 0 || l == 0 {
+		return 0, errors.New("invalid section length")
+	}
+	if l > carv2.DefaultMaxAllowedSectionSize {
+		return 0, fmt.Errorf("section exceeds maximum allowed size: %d", l)
+	}
+
+	buf := *bufp
+	if uint64(cap(buf)) < l {
+		buf = make([]byte, l)
+		*bufp = buf
+	}
+	buf = buf[:l]
+	if rn, err := r.ReadAt(buf, int64(offset)+int64(vn)); rn < len(buf) {
+		return rn, fmt.Errorf("failed to read section: %w", err)
+	}
+
+	cn, c, err := cid.CidFromBytes(buf)
+	if err != nil {
+		return len(buf), fmt.Errorf("failed to read CID of section: %w", err)
+	}
+	if !bytes.Equal(c.Hash(), expected) {
+		return len(buf), fmt.Errorf("section holds block %s, not the indexed one", c)
+	}
+	actual, err := c.Prefix().Sum(buf[cn:])
+	if err != nil {
+		return len(buf), fmt.Errorf("failed to hash block data: %w", err)
+	}
+	if !actual.Equals(c) {
+		return len(buf), fmt.Errorf("data of block %s doesn't match its multihash", c)
+	}
+	return len(buf), nil
+}
@@ -0,0 +1,147 @@
+package dagstore
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// StateMachineFormat is the format of the output of
+// DAGStore.DumpStateMachine.
+type StateMachineFormat int
+
+const (
+	// StateMachineDOT renders the state machine as a Graphviz DOT digraph,
+	// with the current shard count of every state in its node label.
+	StateMachineDOT StateMachineFormat = iota
+
+	// StateMachineJSON renders the state machine as a JSON object, with the
+	// states and their current shard counts under "states", and the allowed
+	// transitions under "transitions".
+	StateMachineJSON
+)
+
+// stateDestroyed is the pseudo-state of shards removed from the DAG store,
+// which transitions from ShardStateTombstoned lead to.
+const stateDestroyed = "destroyed"
+
+// shardStates are the states that shards go through, in lifecycle order.
+var shardStates = []ShardState{
+	ShardStateNew,
+	ShardStateInitializing,
+	ShardStateAvailable,
+	ShardStateServing,
+	ShardStateRecovering,
+	ShardStateErrored,
+	ShardStateArchived,
+	ShardStateTombstoned,
+}
+
+// stateTransition is a transition of the shard state machine, performed by
+// the event loop when processing an operation.
+type stateTransition struct {
+	from ShardState
+	op   OpType
+	to   string
+}
+
+// shardTransitions are the allowed transitions of the shard state machine,
+// followed by failures and destroys, which can happen from any live state.
+// Keep in sync with the event loop.
+var shardTransitions = func() []stateTransition {
+	ts := []stateTransition{
+		{ShardStateNew, OpShardInitialize, ShardStateInitializing.String()},
+		{ShardStateInitializing, OpShardMakeAvailable, ShardStateAvailable.String()},
+		{ShardStateAvailable, OpShardAcquire, ShardStateServing.String()},
+		{ShardStateServing, OpShardAcquire, ShardStateServing.String()},
+		{ShardStateServing, OpShardRelease, ShardStateAvailable.String()},
+		{ShardStateErrored, OpShardRecover, ShardStateRecovering.String()},
+		{ShardStateRecovering, OpShardMakeAvailable, ShardStateAvailable.String()},
+		{ShardStateAvailable, OpShardArchive, ShardStateArchived.String()},
+		{ShardStateArchived, OpShardUnarchive, ShardStateAvailable.String()},
+		{ShardStateTombstoned, OpShardDestroyFinalize, stateDestroyed},
+		{ShardStateTombstoned, OpShardRelease, stateDestroyed},
+	}
+	for _, from := range []ShardState{ShardStateNew, ShardStateInitializing, ShardStateAvailable, ShardStateServing, ShardStateRecovering} {
+		ts = append(ts, stateTransition{from, OpShardFail, ShardStateErrored.String()})
+	}
+	for _, from := range shardStates {
+		if from != ShardStateTombstoned {
+			ts = append(ts, stateTransition{from, OpShardDestroy, ShardStateTombstoned.String()})
+		}
+	}
+	return ts
+}()
+
+// stateMachineJSON is the JSON representation of the shard state machine.
+type stateMachineJSON struct {
+	States      []stateCountJSON      `json:"states"`
+	Transitions []stateTransitionJSON `json:"transitions"`
+}
+
+type stateCountJSON struct {
+	State string `json:"state"`
+	Count int    `json:"count"`
+}
+
+type stateTransitionJSON struct {
+	From string `json:"from"`
+	Op   string `json:"op"`
+	To   string `json:"to"`
+}
+
+// DumpStateMachine writes a representation of the shard state machine to w,
+// in the given format: the shard states with the number of shards currently
+// in each, and the transitions allowed between them, labelled with the
+// operations that trigger them. It helps operators monitor the lifecycle of
+// shards, e.g. by rendering the DOT output with Graphviz.
+func (d *DAGStore) DumpStateMachine(w io.Writer, format StateMachineFormat) error {
+	counts := make(map[ShardState]int)
+	d.lk.RLock()
+	for _, s := range d.shards {
+		s.lk.RLock()
+		counts[s.state]++
+		s.lk.RUnlock()
+	}
+	d.lk.RUnlock()
+
+	switch format {
+	case StateMachineDOT:
+		return writeStateMachineDOT(w, counts)
+	case StateMachineJSON:
+		return writeStateMachineJSON(w, counts)
+	default:
+		return fmt.Errorf("unknown state machine format: %d", format)
+	}
+}
+
+func writeStateMachineDOT(w io.Writer, counts map[ShardState]int) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph shard_states {")
+	fmt.Fprintln(bw, "\trankdir=LR;")
+	for _, st := range shardStates {
+		label := strings.TrimPrefix(st.String(), "ShardState")
+		fmt.Fprintf(bw, "\t%q [label=\"%s (%d)\"];\n", st.String(), label, counts[st])
+	}
+	fmt.Fprintf(bw, "\t%q [shape=doublecircle];\n", stateDestroyed)
+	for _, t := range shardTransitions {
+		fmt.Fprintf(bw, "\t%q -> %q [label=%q];\n", t.from.String(), t.to, t.op.String())
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+func writeStateMachineJSON(w io.Writer, counts map[ShardState]int) error {
+	var out stateMachineJSON
+	for _, st := range shardStates {
+		out.States = append(out.States, stateCountJSON{State: st.String(), Count: counts[st]})
+	}
+	for _, t := range shardTransitions {
+		out.Transitions = append(out.Transitions, stateTransitionJSON{From: t.from.String(), Op: t.op.String(), To: t.to})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
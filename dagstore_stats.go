@@ -0,0 +1,350 @@
+package dagstore
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/filecoin-project/dagstore/shard"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore/query"
+	carindex "github.com/ipld/go-car/v2/index"
+	"github.com/multiformats/go-multihash"
+)
+
+// DefaultGCRecencyHalfLife is the default value of Config.GCRecencyHalfLife.
+var DefaultGCRecencyHalfLife = 24 * time.Hour
+
+// GCToTarget reclaims transients of shards that are available but inactive,
+// or errored, until the transients take up at most targetBytes, and keeps
+// the rest. Shards are evicted coldest first, ranking them by their acquire
+// count decayed by the time since they were last acquired (see
+// Config.GCRecencyHalfLife), so that both frequently and recently acquired
+// shards stay hot.
+//
+// Transients kept because the target was met are reported with
+// GCSkipWithinTarget. Like GC, it runs with exclusivity from the event loop.
+func (d *DAGStore) GCToTarget(ctx context.Context, targetBytes int64) (*GCResult, error) {
+	return d.requestGC(ctx, &gcRequest{bounded: true, target: targetBytes})
+}
+
+// recordAcquire updates the acquire statistics of a shard. It must be called
+// from the event loop.
+func (s *Shard) recordAcquire(now time.Time) {
+	s.acquireCount++
+	s.lastAcquiredAt = now
+}
+
+// evictionScore ranks a shard for eviction; lower scores are evicted first.
+// The acquire count halves with every halfLife elapsed since the last
+// acquire. It must be called with the shard lock held.
+func evictionScore(s *Shard, now time.Time, halfLife time.Duration) float64 {
+	last := s.lastAcquiredAt
+	if last.IsZero() {
+		last = s.registeredAt
+	}
+	var age float64
+	if !last.IsZero() && halfLife > 0 {
+		age = float64(now.Sub(last)) / float64(halfLife)
+	}
+	return float64(s.acquireCount+1) * math.Exp2(-age)
+}
+
+// selectEvictions trims the reclaimable shards to the coldest ones that need
+// to be evicted for the transients to fit in the target, updating the report
+// of the shards that are kept.
+func selectEvictions(reclaim []*Shard, scores map[shard.Key]float64, report map[shard.Key]GCShardReport, target int64) []*Shard {
+	var total int64
+	for _, r := range report {
+		total += r.TransientSize
+	}
+
+	sort.SliceStable(reclaim, func(i, j int) bool {
+		return scores[reclaim[i].key] < scores[reclaim[j].key]
+	})
+
+	var evict []*Shard
+	for _, s := range reclaim {
+		r := report[s.key]
+		if total <= target {
+			r.Reclaimable = false
+			r.Demote = false
+			r.SkipReason = GCSkipWithinTarget
+			report[s.key] = r
+			continue
+		}
+		evict = append(evict, s)
+		if !r.Demote { // demotions don't free space.
+			total -= r.TransientSize
+		}
+	}
+	return evict
+}
+
+// BlockAccessFunc is called with the key of the shard, the CID and the size
+// of a block read through an accessor, and the time it took to read it (see
+// AcquireOpts.OnBlockAccess).
+type BlockAccessFunc func(key shard.Key, c cid.Cid, size int, latency time.Duration)
+
+// statsBlockstore is a ReadBlockstore that accounts the bytes of the blocks
+// it serves to its shard, and to its caller, if non-empty, and reports reads
+// to onAccess, if non-nil.
+type statsBlockstore struct {
+	ReadBlockstore
+	shard    *Shard
+	onAccess BlockAccessFunc
+	caller   string
+}
+
+var (
+	_ ReadBlockstore = (*statsBlockstore)(nil)
+	_ BatchGetter    = (*statsBlockstore)(nil)
+	_ KeyIterable    = (*statsBlockstore)(nil)
+)
+
+func (b *statsBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	start := time.Now()
+	blk, err := b.ReadBlockstore.Get(ctx, c)
+	if err == nil {
+		b.served(c, len(blk.RawData()), start)
+	}
+	return blk, err
+}
+
+func (b *statsBlockstore) GetMany(ctx context.Context, cids []cid.Cid) ([]blocks.Block, error) {
+	start := time.Now()
+	blks, err := getMany(ctx, b.ReadBlockstore, cids)
+	if err != nil {
+		return nil, err
+	}
+	// the latency of every block is that of the whole batch.
+	for i, blk := range blks {
+		if blk != nil {
+			b.served(cids[i], len(blk.RawData()), start)
+		}
+	}
+	return blks, nil
+}
+
+func (b *statsBlockstore) View(ctx context.Context, c cid.Cid, callback func([]byte) error) error {
+	start := time.Now()
+	return b.ReadBlockstore.View(ctx, c, func(data []byte) error {
+		// the latency excludes the time spent in the callback.
+		b.served(c, len(data), start)
+		return callback(data)
+	})
+}
+
+// Iterator returns an iterator over the CIDs of the blocks of the underlying
+// blockstore; enumerating keys serves no blocks.
+func (b *statsBlockstore) Iterator() (*KeyIterator, error) {
+	return iteratorOf(b.ReadBlockstore)
+}
+
+// served accounts a block of the given size read since start.
+func (b *statsBlockstore) served(c cid.Cid, size int, start time.Time) {
+	atomic.AddUint64(&b.shard.bytesServed, uint64(size))
+	if b.caller != "" {
+		b.shard.callers.recordServed(b.caller, size)
+	}
+	if b.onAccess != nil {
+		b.onAccess(b.shard.key, c, size, time.Since(start))
+	}
+}
+
+// Stats are aggregate statistics about the DAG store (see DAGStore.Stats).
+type Stats struct {
+	// Shards is the number of shards in each state.
+	Shards map[ShardState]int
+	// IndexedBlocks is the total number of blocks in the indices of shards.
+	IndexedBlocks uint64
+	// TransientBytes is the total size in bytes of the transients of shards
+	// on disk. Shared transients are counted once.
+	TransientBytes int64
+	// DatastoreRecords is the number of shard records in the datastore.
+	DatastoreRecords int
+	// PendingOps is the number of tasks of each operation queued for the
+	// event loop.
+	PendingOps map[OpType]int
+	// Backpressure is the occupancy of the limits on pending tasks (see
+	// Config.MaxPendingTasks).
+	Backpressure BackpressureStats
+	// GC is the cumulative statistics of GC runs since the DAG store started.
+	GC GCStats
+	// Jobs is the status of the maintenance jobs (see Config.Jobs).
+	Jobs map[JobName]JobStatus
+	// DroppedTraces is the number of traces dropped because Config.TraceCh
+	// fell behind and its buffer was full.
+	DroppedTraces uint64
+}
+
+// GCStats are cumulative statistics of the GC runs of a DAG store, excluding
+// dry runs.
+type GCStats struct {
+	// Runs is the number of GC runs, including targeted ones.
+	Runs uint64
+	// Reclaimed, Demoted and Failed are the number of transients reclaimed,
+	// demoted to the warm tier, and that failed to be reclaimed, respectively.
+	Reclaimed uint64
+	Demoted   uint64
+	Failed    uint64
+	// ReclaimedBytes is the number of bytes reclaimed.
+	ReclaimedBytes int64
+	// LastRun is the time of the last GC run, or zero if GC never ran.
+	LastRun time.Time
+}
+
+// Stats returns aggregate statistics about the DAG store in a single call,
+// e.g. for health dashboards. It stats the transients of all shards, and
+// counts the shard records in the datastore, so it isn't meant to be called
+// at a high frequency.
+func (d *DAGStore) Stats(ctx context.Context) (Stats, error) {
+	ret := Stats{
+		Shards:       make(map[ShardState]int),
+		PendingOps:   d.pendingOps(),
+		Backpressure: d.backpressureStats(),
+		Jobs:         d.jobStatuses(),
+
+		DroppedTraces: d.droppedTraces(),
+	}
+
+	d.lk.RLock()
+	shards := make([]*Shard, 0, len(d.shards))
+	for _, s := range d.shards {
+		shards = append(shards, s)
+	}
+	d.lk.RUnlock()
+
+	transients := make(map[string]struct{})
+	for _, s := range shards {
+		s.lk.RLock()
+		state := s.state
+		s.lk.RUnlock()
+		ret.Shards[state]++
+		ret.IndexedBlocks += d.indexedBlocks(s, state)
+
+		path := s.mount.TransientPath()
+		if _, ok := transients[path]; ok || path == "" {
+			continue
+		}
+		transients[path] = struct{}{}
+		if fi, err := os.Stat(path); err == nil {
+			ret.TransientBytes += fi.Size()
+		}
+	}
+
+	res, err := d.store.Query(ctx, query.Query{KeysOnly: true})
+	if err != nil {
+		return ret, fmt.Errorf("failed to query datastore: %w", err)
+	}
+	defer res.Close()
+	for r := range res.Next() {
+		if r.Error != nil {
+			return ret, fmt.Errorf("failed to query datastore: %w", r.Error)
+		}
+		ret.DatastoreRecords++
+	}
+
+	d.gcStatsLk.Lock()
+	ret.GC = d.gcStats
+	d.gcStatsLk.Unlock()
+	return ret, nil
+}
+
+// indexedBlocks returns the number of blocks in the index of a shard, which
+// is counted once, when first needed, if the shard was indexed by a previous
+// version, or out of the event loop, e.g. by a ShardWriter.
+func (d *DAGStore) indexedBlocks(s *Shard, state ShardState) uint64 {
+	if n := atomic.LoadUint64(&s.indexedBlocks); n > 0 {
+		return n
+	}
+	if state != ShardStateAvailable && state != ShardStateServing {
+		return 0
+	}
+	idx, err := d.indices.GetFullIndex(s.key)
+	if err != nil {
+		return 0
+	}
+	n := countIndexed(idx)
+	atomic.CompareAndSwapUint64(&s.indexedBlocks, 0, n)
+	return n
+}
+
+// countIndexed returns the number of entries of an index, or zero if it isn't
+// iterable.
+func countIndexed(idx carindex.Index) uint64 {
+	iterable, ok := idx.(carindex.IterableIndex)
+	if !ok {
+		return 0
+	}
+	var n uint64
+	_ = iterable.ForEach(func(multihash.Multihash, uint64) error {
+		n++
+		return nil
+	})
+	return n
+}
+
+// recordGC accumulates the outcome of a GC run into the GC statistics.
+func (d *DAGStore) recordGC(res *GCResult) {
+	d.gcStatsLk.Lock()
+	defer d.gcStatsLk.Unlock()
+
+	d.gcStats.Runs++
+	d.gcStats.Reclaimed += uint64(res.Reclaimed)
+	d.gcStats.Demoted += uint64(res.Demoted)
+	d.gcStats.Failed += uint64(res.Failed)
+	d.gcStats.ReclaimedBytes += res.ReclaimedBytes
+	d.gcStats.LastRun = time.Now()
+}
+
+// opQueued and opDequeued account the tasks queued for the event loop, in
+// total and per shard.
+func (d *DAGStore) opQueued(key shard.Key, op OpType) {
+	d.pendingLk.Lock()
+	if d.pending == nil {
+		d.pending = make(map[OpType]int)
+		d.pendingByShard = make(map[shard.Key]map[OpType]int)
+	}
+	d.pending[op]++
+	byOp := d.pendingByShard[key]
+	if byOp == nil {
+		byOp = make(map[OpType]int)
+		d.pendingByShard[key] = byOp
+	}
+	byOp[op]++
+	d.pendingLk.Unlock()
+}
+
+func (d *DAGStore) opDequeued(key shard.Key, op OpType) {
+	d.pendingLk.Lock()
+	if d.pending[op]--; d.pending[op] <= 0 {
+		delete(d.pending, op)
+	}
+	if byOp := d.pendingByShard[key]; byOp != nil {
+		if byOp[op]--; byOp[op] <= 0 {
+			delete(byOp, op)
+		}
+		if len(byOp) == 0 {
+			delete(d.pendingByShard, key)
+		}
+	}
+	d.pendingLk.Unlock()
+}
+
+func (d *DAGStore) pendingOps() map[OpType]int {
+	d.pendingLk.Lock()
+	defer d.pendingLk.Unlock()
+
+	ret := make(map[OpType]int, len(d.pending))
+	for op, n := range d.pending {
+		ret[op] = n
+	}
+	return ret
+}
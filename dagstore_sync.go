@@ -0,0 +1,114 @@
+package dagstore
+
+import (
+	"context"
+	"sync"
+
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// Future is the pending result of a shard operation. Its Out channel is passed
+// to the channel-based API, and Wait blocks until the result is delivered.
+type Future struct {
+	Key shard.Key
+
+	ch chan ShardResult
+
+	lk   sync.Mutex
+	res  *ShardResult // set once the result has been received.
+	done chan struct{}
+}
+
+// NewFuture creates a Future for an operation on the supplied shard.
+func NewFuture(key shard.Key) *Future {
+	return &Future{Key: key, ch: make(chan ShardResult, 1), done: make(chan struct{})}
+}
+
+// Out returns the channel to pass as the output channel of the operation.
+func (f *Future) Out() chan ShardResult {
+	return f.ch
+}
+
+// Wait blocks until the result of the operation is delivered, or the context
+// is cancelled. It returns the result along with its error, or the error of
+// the context. Wait may be called several times, and from several goroutines.
+func (f *Future) Wait(ctx context.Context) (ShardResult, error) {
+	f.lk.Lock()
+	if f.res != nil {
+		res := *f.res
+		f.lk.Unlock()
+		return res, res.Error
+	}
+	f.lk.Unlock()
+
+	select {
+	case res := <-f.ch:
+		f.lk.Lock()
+		f.res = &res
+		close(f.done)
+		f.lk.Unlock()
+		return res, res.Error
+	case <-f.done:
+		return f.Wait(ctx)
+	case <-ctx.Done():
+		return ShardResult{Key: f.Key, Error: ctx.Err()}, ctx.Err()
+	}
+}
+
+// delivered returns whether the result has been received.
+func (f *Future) delivered() bool {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	return f.res != nil
+}
+
+// RegisterShardSync registers a shard like RegisterShard, and blocks until the
+// registration completes or the context is cancelled.
+func (d *DAGStore) RegisterShardSync(ctx context.Context, key shard.Key, mnt mount.Mount, opts RegisterOpts) error {
+	f := NewFuture(key)
+	if err := d.RegisterShard(ctx, key, mnt, f.Out(), opts); err != nil {
+		return err
+	}
+	_, err := f.Wait(ctx)
+	return err
+}
+
+// AcquireShardSync acquires a shard like AcquireShard, and blocks until the
+// acquisition completes or the context is cancelled. If the context is
+// cancelled, an accessor delivered afterwards is closed on the caller's
+// behalf.
+func (d *DAGStore) AcquireShardSync(ctx context.Context, key shard.Key, opts AcquireOpts) (*ShardAccessor, error) {
+	f := NewFuture(key)
+	if err := d.AcquireShard(ctx, key, f.Out(), opts); err != nil {
+		return nil, err
+	}
+	res, err := f.Wait(ctx)
+	if err != nil && !f.delivered() {
+		// we gave up, but the result may still be delivered; release the
+		// accessor, if any, so that the shard isn't held forever.
+		go func() {
+			select {
+			case res := <-f.Out():
+				if res.Accessor != nil {
+					_ = res.Accessor.Close()
+				}
+			case <-d.ctx.Done():
+			}
+		}()
+		return nil, err
+	}
+	return res.Accessor, err
+}
+
+// RecoverShardSync recovers a shard like RecoverShard, and blocks until the
+// recovery completes or the context is cancelled.
+func (d *DAGStore) RecoverShardSync(ctx context.Context, key shard.Key, opts RecoverOpts) error {
+	f := NewFuture(key)
+	if err := d.RecoverShard(ctx, key, f.Out(), opts); err != nil {
+		return err
+	}
+	_, err := f.Wait(ctx)
+	return err
+}
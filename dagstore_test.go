@@ -1,25 +1,42 @@
 package dagstore
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/multiformats/go-multihash"
 
+	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	dsq "github.com/ipfs/go-datastore/query"
 	dssync "github.com/ipfs/go-datastore/sync"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	blocksutil "github.com/ipfs/go-ipfs-blocksutil"
+	format "github.com/ipfs/go-ipld-format"
 	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipld/go-car/v2"
+	carindex "github.com/ipld/go-car/v2/index"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/sync/errgroup"
 
+	"github.com/filecoin-project/dagstore/blockcache"
 	"github.com/filecoin-project/dagstore/index"
 	"github.com/filecoin-project/dagstore/mount"
 	"github.com/filecoin-project/dagstore/shard"
@@ -153,6 +170,58 @@ func TestDestroyAcrossRestart(t *testing.T) {
 	require.Len(t, info, 80)
 }
 
+// TestDestroyWhileInitializing tests that destroying a shard while it's being
+// initialized is only finalized once the initialization completes, so that it
+// doesn't leave the index of the shard behind.
+func TestDestroyWhileInitializing(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	k := shard.KeyFromString("foo")
+	mnt := newBlockingMount(carv2mnt)
+	regCh := make(chan ShardResult, 1)
+	err = dagst.RegisterShard(context.Background(), k, mnt, regCh, RegisterOpts{})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		info, err := dagst.GetShardInfo(k)
+		return err == nil && info.ShardState == ShardStateInitializing
+	}, 5*time.Second, 10*time.Millisecond)
+
+	destroyCh := make(chan ShardResult, 1)
+	err = dagst.DestroyShard(context.Background(), k, destroyCh, DestroyOpts{})
+	require.NoError(t, err)
+
+	res := <-regCh
+	require.ErrorIs(t, res.Error, ErrShardTombstoned)
+
+	// the destroy waits for the initialization to complete.
+	select {
+	case res := <-destroyCh:
+		t.Fatalf("destroy finalized while initializing: %v", res.Error)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	mnt.UnblockNext(1)
+	res = <-destroyCh
+	require.NoError(t, res.Error)
+
+	_, err = dagst.GetShardInfo(k)
+	require.ErrorIs(t, err, ErrShardUnknown)
+	stat, err := dagst.indices.StatFullIndex(k)
+	require.NoError(t, err)
+	require.False(t, stat.Exists)
+	keys, err := dagst.ShardsContainingMultihash(context.Background(), testdata.RootCID.Hash())
+	require.Error(t, err)
+	require.Empty(t, keys)
+}
+
 func TestRegisterUsingExistingTransient(t *testing.T) {
 	ds := datastore.NewMapDatastore()
 	dagst, err := NewDAGStore(Config{
@@ -483,6 +552,380 @@ func TestRestartRestoresState(t *testing.T) {
 	}
 }
 
+func TestCloneShard(t *testing.T) {
+	ctx := context.Background()
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(ctx)
+	require.NoError(t, err)
+
+	src := registerShards(t, dagst, 1, carv2mnt, RegisterOpts{})[0]
+
+	// unknown sources and existing destinations are rejected.
+	ch := make(chan ShardResult, 1)
+	err = dagst.CloneShard(ctx, shard.KeyFromString("unknown"), shard.KeyFromString("dst"), carv2mnt, ch, CloneOpts{})
+	require.ErrorIs(t, err, ErrShardUnknown)
+	err = dagst.CloneShard(ctx, src, src, carv2mnt, ch, CloneOpts{})
+	require.ErrorIs(t, err, ErrShardExists)
+
+	for _, copyTransient := range []bool{true, false} {
+		dst := shard.KeyFromString(fmt.Sprintf("clone-%t", copyTransient))
+		mnt := &mount.Counting{Mount: carv2mnt}
+		err = dagst.CloneShard(ctx, src, dst, mnt, ch, CloneOpts{CopyTransient: copyTransient})
+		require.NoError(t, err)
+		res := <-ch
+		require.NoError(t, res.Error)
+		require.Equal(t, dst, res.Key)
+
+		// the clone is registered without being indexed again, so its mount
+		// is only fetched when acquiring it without a copied transient.
+		info, err := dagst.GetShardInfo(dst)
+		require.NoError(t, err)
+		require.Equal(t, ShardStateAvailable, info.ShardState)
+		require.Zero(t, mnt.Count())
+
+		accs := acquireShard(t, dagst, dst, 1)
+		releaseAll(t, dagst, dst, accs)
+		if copyTransient {
+			require.Zero(t, mnt.Count())
+		} else {
+			require.Equal(t, 1, mnt.Count())
+		}
+
+		keys, err := dagst.ShardsContainingMultihash(ctx, testdata.RootCID.Hash())
+		require.NoError(t, err)
+		require.Contains(t, keys, dst)
+	}
+
+	// the source shard was released.
+	require.Eventually(t, func() bool {
+		info, err := dagst.GetShardInfo(src)
+		return err == nil && info.ShardState == ShardStateAvailable && info.refs == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestRegisterChecksum(t *testing.T) {
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	config := Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		Datastore:     store,
+	}
+	dagst, err := NewDAGStore(config)
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	good, err := multihash.Sum(testdata.CarV2, multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	bad, err := multihash.Sum([]byte("junk"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+
+	ch := make(chan ShardResult, 1)
+	err = dagst.RegisterShard(context.Background(), shard.KeyFromString("good"), carv2mnt, ch, RegisterOpts{Checksum: good})
+	require.NoError(t, err)
+	require.NoError(t, (<-ch).Error)
+
+	// the shard fails instead of being indexed.
+	err = dagst.RegisterShard(context.Background(), shard.KeyFromString("bad"), carv2mnt, ch, RegisterOpts{Checksum: bad})
+	require.NoError(t, err)
+	require.ErrorIs(t, (<-ch).Error, ErrChecksumMismatch)
+
+	info, err := dagst.GetShardInfo(shard.KeyFromString("bad"))
+	require.NoError(t, err)
+	require.Equal(t, ShardStateErrored, info.ShardState)
+	require.Contains(t, info.Error.Error(), ErrChecksumMismatch.Error())
+
+	// the checksum survives restarts.
+	err = dagst.Close()
+	require.NoError(t, err)
+	dagst, err = NewDAGStore(config)
+	require.NoError(t, err)
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+	info, err = dagst.GetShardInfo(shard.KeyFromString("good"))
+	require.NoError(t, err)
+	require.Equal(t, ShardStateAvailable, info.ShardState)
+	require.Equal(t, multihash.Multihash(good), dagst.shards[shard.KeyFromString("good")].mount.Checksum())
+}
+
+func TestShardExpiry(t *testing.T) {
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	config := Config{
+		MountRegistry:       testRegistry(t),
+		TransientsDir:       t.TempDir(),
+		Datastore:           store,
+		IndexRepo:           index.NewMemoryRepo(),
+		DatastoreNamespace:  datastore.NewKey("custom"),
+		ExpirySweepInterval: 50 * time.Millisecond,
+	}
+	dagst, err := NewDAGStore(config)
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	short := shard.KeyFromString("short")
+	long := shard.KeyFromString("long")
+	forever := shard.KeyFromString("forever")
+	ch := make(chan ShardResult, 1)
+	for k, ttl := range map[shard.Key]time.Duration{short: 300 * time.Millisecond, long: time.Hour, forever: 0} {
+		err = dagst.RegisterShard(context.Background(), k, carv2mnt, ch, RegisterOpts{TTL: ttl})
+		require.NoError(t, err)
+		require.NoError(t, (<-ch).Error)
+	}
+
+	// shard state is persisted under the configured namespace.
+	ok, err := store.Has(context.Background(), datastore.NewKey("custom/short"))
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	info, err := dagst.GetShardInfo(long)
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now(), info.RegisteredAt, time.Minute)
+	require.Equal(t, info.RegisteredAt.Add(time.Hour), info.ExpiresAt)
+	info, err = dagst.GetShardInfo(forever)
+	require.NoError(t, err)
+	require.False(t, info.RegisteredAt.IsZero())
+	require.True(t, info.ExpiresAt.IsZero())
+
+	// an expired shard with active references isn't destroyed until released.
+	accs := acquireShard(t, dagst, short, 1)
+	time.Sleep(500 * time.Millisecond)
+	_, err = dagst.GetShardInfo(short)
+	require.NoError(t, err)
+	for _, acc := range accs {
+		require.NoError(t, acc.Close())
+	}
+	require.Eventually(t, func() bool {
+		_, err := dagst.GetShardInfo(short)
+		return errors.Is(err, ErrShardUnknown)
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Len(t, dagst.AllShardsInfo(), 2)
+
+	// expiries survive restarts.
+	err = dagst.Close()
+	require.NoError(t, err)
+	dagst, err = NewDAGStore(config)
+	require.NoError(t, err)
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	restored, err := dagst.GetShardInfo(long)
+	require.NoError(t, err)
+	require.True(t, info.RegisteredAt.Before(restored.ExpiresAt))
+	require.True(t, restored.RegisteredAt.Add(time.Hour).Equal(restored.ExpiresAt))
+	require.Len(t, dagst.AllShardsInfo(), 2)
+}
+
+func TestCompressTransients(t *testing.T) {
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	config := Config{
+		MountRegistry:      testRegistry(t),
+		TransientsDir:      t.TempDir(),
+		Datastore:          store,
+		IndexRepo:          index.NewMemoryRepo(),
+		CompressTransients: true,
+	}
+	dagst, err := NewDAGStore(config)
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	compressed := shard.KeyFromString("compressed")
+	plain := shard.KeyFromString("plain")
+	ch := make(chan ShardResult, 1)
+	err = dagst.RegisterShard(context.Background(), compressed, carv2mnt, ch, RegisterOpts{})
+	require.NoError(t, err)
+	require.NoError(t, (<-ch).Error)
+	err = dagst.RegisterShard(context.Background(), plain, carv2mnt, ch, RegisterOpts{Compression: TransientCompressionDisabled})
+	require.NoError(t, err)
+	require.NoError(t, (<-ch).Error)
+
+	transientSize := func(k shard.Key) int64 {
+		fi, err := os.Stat(dagst.shards[k].mount.TransientPath())
+		require.NoError(t, err)
+		return fi.Size()
+	}
+	require.Less(t, transientSize(compressed), int64(len(testdata.CarV2)))
+	require.EqualValues(t, len(testdata.CarV2), transientSize(plain))
+
+	// compressed transients are served with random access.
+	for _, k := range []shard.Key{compressed, plain} {
+		releaseAll(t, dagst, k, acquireShard(t, dagst, k, 2))
+	}
+
+	// the compression setting survives restarts.
+	err = dagst.Close()
+	require.NoError(t, err)
+	dagst, err = NewDAGStore(config)
+	require.NoError(t, err)
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+	defer dagst.Close()
+
+	require.True(t, dagst.shards[compressed].mount.Compression())
+	require.False(t, dagst.shards[plain].mount.Compression())
+	releaseAll(t, dagst, compressed, acquireShard(t, dagst, compressed, 1))
+}
+
+func TestShardWriter(t *testing.T) {
+	r := testRegistry(t)
+	require.NoError(t, r.Register("file", new(mount.FileMount)))
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:    r,
+		TransientsDir:    t.TempDir(),
+		WrittenShardsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+	defer dagst.Close()
+
+	gen := blocksutil.NewBlockGenerator()
+	blks := gen.Blocks(10)
+	k := shard.KeyFromString("written")
+	w, err := dagst.NewShardWriter(k, ShardWriterOpts{Roots: []cid.Cid{blks[0].Cid()}})
+	require.NoError(t, err)
+	require.NoError(t, w.Put(context.Background(), blks[0]))
+	require.NoError(t, w.PutMany(context.Background(), blks[1:]))
+
+	// the key is reserved while writing.
+	_, err = dagst.NewShardWriter(k, ShardWriterOpts{Roots: []cid.Cid{blks[0].Cid()}})
+	require.ErrorIs(t, err, ErrShardExists)
+	_, err = dagst.GetShardInfo(k)
+	require.ErrorIs(t, err, ErrShardUnknown)
+	var conflict *ShardConflictError
+	err = dagst.RegisterShard(context.Background(), k, carv2mnt, nil, RegisterOpts{})
+	require.ErrorAs(t, err, &conflict)
+	require.Equal(t, k, conflict.Key)
+
+	require.NoError(t, w.Commit(context.Background()))
+	require.ErrorIs(t, w.Put(context.Background(), blks[0]), ErrShardWriterClosed)
+
+	// the shard is available and indexed.
+	info, err := dagst.GetShardInfo(k)
+	require.NoError(t, err)
+	require.Equal(t, ShardStateAvailable, info.ShardState)
+	keys, err := dagst.ShardsContainingMultihash(context.Background(), blks[5].Cid().Hash())
+	require.NoError(t, err)
+	require.Equal(t, []shard.Key{k}, keys)
+
+	ch := make(chan ShardResult, 1)
+	err = dagst.AcquireShard(context.Background(), k, ch, AcquireOpts{})
+	require.NoError(t, err)
+	res := <-ch
+	require.NoError(t, res.Error)
+	bs, err := res.Accessor.Blockstore()
+	require.NoError(t, err)
+	for _, blk := range blks {
+		got, err := bs.Get(context.Background(), blk.Cid())
+		require.NoError(t, err)
+		require.Equal(t, blk.RawData(), got.RawData())
+	}
+	require.NoError(t, res.Accessor.Close())
+
+	// discarding a writer releases the key, and deletes the data.
+	discarded := shard.KeyFromString("discarded")
+	w, err = dagst.NewShardWriter(discarded, ShardWriterOpts{Roots: []cid.Cid{blks[0].Cid()}})
+	require.NoError(t, err)
+	require.NoError(t, w.Put(context.Background(), blks[0]))
+	require.NoError(t, w.Discard())
+	require.NoFileExists(t, w.path)
+	w, err = dagst.NewShardWriter(discarded, ShardWriterOpts{Roots: []cid.Cid{blks[0].Cid()}})
+	require.NoError(t, err)
+	require.NoError(t, w.Discard())
+}
+
+func TestShardHistory(t *testing.T) {
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	idx := index.NewMemoryRepo()
+	config := Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		Datastore:     store,
+		IndexRepo:     idx,
+		HistorySize:   2,
+	}
+	dagst, err := NewDAGStore(config)
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	good := shard.KeyFromString("good")
+	bad := shard.KeyFromString("bad")
+	ch := make(chan ShardResult, 1)
+	err = dagst.RegisterShard(context.Background(), good, carv2mnt, ch, RegisterOpts{})
+	require.NoError(t, err)
+	require.NoError(t, (<-ch).Error)
+	accs := acquireShard(t, dagst, good, 1)
+	releaseAll(t, dagst, good, accs)
+
+	err = dagst.RegisterShard(context.Background(), bad, junkmnt, ch, RegisterOpts{})
+	require.NoError(t, err)
+	require.Error(t, (<-ch).Error)
+
+	check := func(dagst *DAGStore) {
+		// the journal only retains the two most recent transitions.
+		require.Eventually(t, func() bool {
+			h, err := dagst.ShardHistory(good)
+			return err == nil && len(h) == 2 && h[1].Op == OpShardRelease
+		}, 5*time.Second, 10*time.Millisecond)
+		h, err := dagst.ShardHistory(good)
+		require.NoError(t, err)
+		require.Equal(t, OpShardAcquire, h[0].Op)
+		require.Equal(t, ShardStateAvailable, h[0].PrevState)
+		require.Equal(t, ShardStateServing, h[0].NewState)
+		require.Equal(t, ShardStateAvailable, h[1].NewState)
+		require.Empty(t, h[1].Error)
+
+		h, err = dagst.ShardHistory(bad)
+		require.NoError(t, err)
+		require.Len(t, h, 2)
+		require.Equal(t, OpShardInitialize, h[0].Op)
+		require.Equal(t, OpShardFail, h[1].Op)
+		require.Equal(t, ShardStateInitializing, h[1].PrevState)
+		require.Equal(t, ShardStateErrored, h[1].NewState)
+		require.NotEmpty(t, h[1].Error)
+		require.False(t, h[1].Time.Before(h[0].Time))
+	}
+	check(dagst)
+
+	// the journal survives restarts.
+	err = dagst.Close()
+	require.NoError(t, err)
+	dagst, err = NewDAGStore(config)
+	require.NoError(t, err)
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+	check(dagst)
+
+	// and is dropped when the shard is destroyed.
+	_, err = store.Get(context.Background(), HistoryNamespace.ChildString(bad.String()))
+	require.NoError(t, err)
+	err = dagst.DestroyShard(context.Background(), bad, ch, DestroyOpts{})
+	require.NoError(t, err)
+	require.NoError(t, (<-ch).Error)
+	_, err = dagst.ShardHistory(bad)
+	require.ErrorIs(t, err, ErrShardUnknown)
+	_, err = store.Get(context.Background(), HistoryNamespace.ChildString(bad.String()))
+	require.ErrorIs(t, err, datastore.ErrNotFound)
+
+	// the journal is disabled by default.
+	dagst, err = NewDAGStore(Config{MountRegistry: testRegistry(t), TransientsDir: t.TempDir()})
+	require.NoError(t, err)
+	_, err = dagst.ShardHistory(good)
+	require.Error(t, err)
+}
+
 func TestRestartResumesRegistration(t *testing.T) {
 	dir := t.TempDir()
 	store := datastore.NewLogDatastore(dssync.MutexWrap(datastore.NewMapDatastore()), "trace")
@@ -639,47 +1082,326 @@ func TestGC(t *testing.T) {
 	}
 }
 
-func TestOrphansRemovedOnStartup(t *testing.T) {
+func TestGCDryRun(t *testing.T) {
 	dir := t.TempDir()
-
-	// create random files in the transients directory, which we expect the GC
-	// procedure to remove.
-	var orphaned []string
-	for i := 0; i < 100; i++ {
-		file, err := os.CreateTemp(dir, "")
-		require.NoError(t, err)
-		orphaned = append(orphaned, file.Name())
-
-		// write random data
-		n, err := io.Copy(file, io.LimitReader(rand.Reader, 1024))
-		require.NoError(t, err)
-		require.EqualValues(t, 1024, n)
-
-		err = file.Close()
-		require.NoError(t, err)
-	}
-
 	dagst, err := NewDAGStore(Config{
 		MountRegistry: testRegistry(t),
 		TransientsDir: dir,
 	})
 	require.NoError(t, err)
-	defer dagst.Close()
 
 	err = dagst.Start(context.Background())
 	require.NoError(t, err)
 
-	// orphaned files are gone
-	for _, p := range orphaned {
-		_, err := os.Stat(p)
-		require.ErrorIs(t, err, os.ErrNotExist)
+	// register 100 shards
+	// acquire 25 with 5 acquirers, release 2 acquirers (refcount 3); non reclaimable
+	// acquire another 25, release them all, they're reclaimable
+	shards := registerShards(t, dagst, 100, carv2mnt, RegisterOpts{})
+	for _, k := range shards[0:25] {
+		accessors := acquireShard(t, dagst, k, 5)
+		for _, acc := range accessors[:2] {
+			err := acc.Close()
+			require.NoError(t, err)
+		}
 	}
+	for _, k := range shards[25:50] {
+		accessors := acquireShard(t, dagst, k, 5)
+		releaseAll(t, dagst, k, accessors)
+	}
+
+	// a dry run reports what would be reclaimed, without deleting anything.
+	dry, err := dagst.GCDryRun(context.Background())
+	require.NoError(t, err)
+	require.True(t, dry.DryRun)
+	require.Empty(t, dry.Shards)
+	require.Len(t, dry.Report, 100)
+	require.Equal(t, 75, dry.Reclaimed)
+	require.Zero(t, dry.Failed)
+	require.EqualValues(t, 75*len(testdata.CarV2), dry.ReclaimedBytes)
+	for _, k := range shards[0:25] {
+		require.False(t, dry.Report[k].Reclaimable)
+		require.Equal(t, GCSkipActiveRefs, dry.Report[k].SkipReason)
+	}
+
+	// the real run then reclaims exactly what the dry run reported.
+	results, err := dagst.GC(context.Background())
+	require.NoError(t, err)
+	require.Len(t, results.Shards, 75)
+	require.Zero(t, results.ShardFailures())
+	require.Equal(t, 75, results.Reclaimed)
+	require.Equal(t, dry.ReclaimedBytes, results.ReclaimedBytes)
 }
 
-// TestLazyInitialization tests that lazy initialization initializes shards on
-// their first acquisition.
-func TestLazyInitialization(t *testing.T) {
-	dir := t.TempDir()
+func TestTransientTiers(t *testing.T) {
+	warmDir, hotDir := t.TempDir(), t.TempDir()
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:         testRegistry(t),
+		TransientsDir:         warmDir,
+		HotTransientsDir:      hotDir,
+		HotTransientsCapacity: 2 * int64(len(testdata.CarV2)),
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	keys := registerShards(t, dagst, 3, carv2mnt, RegisterOpts{})
+
+	// transients are created in the warm tier.
+	for _, k := range keys {
+		info, err := dagst.GetShardInfo(k)
+		require.NoError(t, err)
+		require.Equal(t, TierWarm, info.Tier)
+	}
+
+	tiers := func() map[TransientTier]int {
+		ret := make(map[TransientTier]int)
+		for _, info := range dagst.AllShardsInfo() {
+			ret[info.Tier]++
+		}
+		return ret
+	}
+
+	// acquiring promotes transients to the hot tier in the background, while
+	// it has capacity.
+	for _, k := range keys {
+		res := acquireShard(t, dagst, k, 1)
+		releaseAll(t, dagst, k, res)
+	}
+	require.Eventually(t, func() bool {
+		return reflect.DeepEqual(map[TransientTier]int{TierHot: 2, TierWarm: 1}, tiers())
+	}, 5*time.Second, 10*time.Millisecond)
+
+	hot, err := os.ReadDir(hotDir)
+	require.NoError(t, err)
+	require.Len(t, hot, 2)
+
+	// GC demotes hot transients, and deletes warm ones.
+	gc, err := dagst.GC(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, gc.Demoted)
+	require.Equal(t, 1, gc.Reclaimed)
+	require.Zero(t, gc.Failed)
+
+	require.Eventually(t, func() bool {
+		return reflect.DeepEqual(map[TransientTier]int{TierWarm: 2, TierCold: 1}, tiers())
+	}, 5*time.Second, 10*time.Millisecond)
+
+	hot, err = os.ReadDir(hotDir)
+	require.NoError(t, err)
+	require.Empty(t, hot)
+
+	// demoted transients are still usable.
+	for _, k := range keys {
+		res := acquireShard(t, dagst, k, 1)
+		releaseAll(t, dagst, k, res)
+	}
+}
+
+func TestDeduplicateTransients(t *testing.T) {
+	dir := t.TempDir()
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:         testRegistry(t),
+		TransientsDir:         dir,
+		DeduplicateTransients: true,
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	// all shards point at the same object, so they share a single transient.
+	shards := registerShards(t, dagst, 10, carv2mnt, RegisterOpts{})
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	accessors := acquireShard(t, dagst, shards[0], 1)
+	releaseAll(t, dagst, shards[0], accessors)
+
+	// GC releases all references, removing the transient.
+	res, err := dagst.GC(context.Background())
+	require.NoError(t, err)
+	require.Zero(t, res.ShardFailures())
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestNamespaces(t *testing.T) {
+	size := int64(len(testdata.CarV2))
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		NamespaceQuotas: map[string]NamespaceQuota{
+			"t1": {MaxShards: 2, MaxTransientBytes: size},
+		},
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	register := func(ns, key string) (shard.Key, error) {
+		k := shard.KeyInNamespace(ns, shard.KeyFromString(key))
+		ch := make(chan ShardResult, 1)
+		if err := dagst.RegisterShard(context.Background(), k, carv2mnt, ch, RegisterOpts{}); err != nil {
+			return k, err
+		}
+		return k, (<-ch).Error
+	}
+
+	// the first shard of t1 takes up the entire transient quota, so the second
+	// one fails to initialize.
+	a1, err := register("t1", "a")
+	require.NoError(t, err)
+	b1, err := register("t1", "b")
+	require.ErrorIs(t, err, ErrNamespaceQuotaExceeded)
+
+	// t1 is full, but other namespaces are not affected.
+	_, err = register("t1", "c")
+	require.ErrorIs(t, err, ErrNamespaceQuotaExceeded)
+	for _, key := range []string{"a", "b", "c"} {
+		_, err = register("t2", key)
+		require.NoError(t, err)
+	}
+	_, err = register("", "x")
+	require.NoError(t, err)
+
+	require.Len(t, dagst.AllShardsInfoInNamespace("t1"), 2)
+	require.Len(t, dagst.AllShardsInfoInNamespace("t2"), 3)
+	require.Len(t, dagst.AllShardsInfoInNamespace(""), 1)
+	require.Equal(t, NamespaceUsage{Shards: 2, TransientBytes: size}, dagst.NamespaceUsage("t1"))
+	require.Equal(t, NamespaceUsage{Shards: 3, TransientBytes: 3 * size}, dagst.NamespaceUsage("t2"))
+
+	// GC on t1 only touches t1.
+	res, err := dagst.GCNamespace(context.Background(), "t1")
+	require.NoError(t, err)
+	require.Len(t, res.Report, 2)
+	require.Equal(t, size, res.ReclaimedBytes)
+	require.EqualValues(t, 0, dagst.NamespaceUsage("t1").TransientBytes)
+	require.Equal(t, NamespaceUsage{Shards: 3, TransientBytes: 3 * size}, dagst.NamespaceUsage("t2"))
+
+	// the errored shard can now be recovered, taking up the quota again.
+	ch := make(chan ShardResult, 1)
+	err = dagst.RecoverShard(context.Background(), b1, ch, RecoverOpts{})
+	require.NoError(t, err)
+	require.NoError(t, (<-ch).Error)
+
+	// acquiring a1 would need to fetch a new transient, which fails without
+	// affecting the shard.
+	err = dagst.AcquireShard(context.Background(), a1, ch, AcquireOpts{})
+	require.NoError(t, err)
+	require.ErrorIs(t, (<-ch).Error, ErrNamespaceQuotaExceeded)
+
+	require.Eventually(t, func() bool {
+		info, err := dagst.GetShardInfo(a1)
+		return err == nil && info.ShardState == ShardStateAvailable && info.refs == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestLocalityReport(t *testing.T) {
+	r := testRegistry(t)
+	err := r.Register("remote", &remoteMount{})
+	require.NoError(t, err)
+
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: r,
+		TransientsDir: t.TempDir(),
+		ShardGroup: func(key shard.Key) string {
+			return strings.SplitN(key.String(), "-", 2)[0]
+		},
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	register := func(key string, mnt mount.Mount, lazy bool) {
+		ch := make(chan ShardResult, 1)
+		err := dagst.RegisterShard(context.Background(), shard.KeyFromString(key), mnt, ch, RegisterOpts{LazyInitialization: lazy})
+		require.NoError(t, err)
+		res := <-ch
+		require.NoError(t, res.Error)
+	}
+
+	// eagerly initialized shards have local transients.
+	register("a-1", carv2mnt, false)
+	register("a-2", carv2mnt, false)
+	register("b-1", carv2mnt, false)
+	// lazy shards have no transient yet.
+	register("b-2", carv2mnt, true)
+	register("b-3", &remoteMount{Mount: carv2mnt}, true)
+	register("c-1", &remoteMount{Mount: carv2mnt}, true)
+
+	report, err := dagst.LocalityReport(context.Background())
+	require.NoError(t, err)
+
+	size := int64(len(testdata.CarV2))
+	require.Equal(t, 6, report.Total.Shards)
+	require.Equal(t, 3, report.Total.LocalTransient)
+	require.Equal(t, 1, report.Total.LocalMount)
+	require.Equal(t, 2, report.Total.RemoteOnly)
+	require.Equal(t, 3*size, report.Total.LocalBytes)
+
+	require.Len(t, report.ByGroup, 3)
+	require.Equal(t, 2, report.ByGroup["a"].LocalTransient)
+	require.Equal(t, 2*size, report.ByGroup["a"].LocalBytes)
+	require.Equal(t, 3, report.ByGroup["b"].Shards)
+	require.Equal(t, 1, report.ByGroup["b"].LocalTransient)
+	require.Equal(t, 1, report.ByGroup["b"].LocalMount)
+	require.Equal(t, 1, report.ByGroup["b"].RemoteOnly)
+	require.Equal(t, 1, report.ByGroup["c"].RemoteOnly)
+	require.Zero(t, report.ByGroup["c"].LocalBytes)
+
+	require.Len(t, report.ByScheme, 2)
+	require.Equal(t, 4, report.ByScheme["fs"].Shards)
+	require.Equal(t, 3*size, report.ByScheme["fs"].LocalBytes)
+	require.Equal(t, 2, report.ByScheme["remote"].RemoteOnly)
+}
+
+func TestOrphansRemovedOnStartup(t *testing.T) {
+	dir := t.TempDir()
+
+	// create random files in the transients directory, which we expect the GC
+	// procedure to remove.
+	var orphaned []string
+	for i := 0; i < 100; i++ {
+		file, err := os.CreateTemp(dir, "")
+		require.NoError(t, err)
+		orphaned = append(orphaned, file.Name())
+
+		// write random data
+		n, err := io.Copy(file, io.LimitReader(rand.Reader, 1024))
+		require.NoError(t, err)
+		require.EqualValues(t, 1024, n)
+
+		err = file.Close()
+		require.NoError(t, err)
+	}
+
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: dir,
+	})
+	require.NoError(t, err)
+	defer dagst.Close()
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	// orphaned files are gone
+	for _, p := range orphaned {
+		_, err := os.Stat(p)
+		require.ErrorIs(t, err, os.ErrNotExist)
+	}
+}
+
+// TestLazyInitialization tests that lazy initialization initializes shards on
+// their first acquisition.
+func TestLazyInitialization(t *testing.T) {
+	dir := t.TempDir()
 	store := datastore.NewLogDatastore(dssync.MutexWrap(datastore.NewMapDatastore()), "trace")
 	sink := tracer(128)
 	dagst, err := NewDAGStore(Config{
@@ -794,6 +1516,174 @@ func TestThrottleFetch(t *testing.T) {
 	require.Len(t, m[ShardStateAvailable], 5)
 }
 
+// TestThrottleLazyInit tests that initializations triggered by acquires of
+// lazy shards are capped independently, and that explicit registrations
+// still progress while lazy initializations are queued.
+func TestThrottleLazyInit(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+
+		MaxConcurrentLazyInit: 2,
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	mnt := newBlockingMount(carv2mnt)
+	mnt.ready = true
+	cnt := &mount.Counting{Mount: mnt}
+	regCh := make(chan ShardResult, 8)
+	for i := 0; i < 8; i++ {
+		k := shard.KeyFromString(strconv.Itoa(i))
+		err := dagst.RegisterShard(context.Background(), k, cnt, regCh, RegisterOpts{LazyInitialization: true})
+		require.NoError(t, err)
+		res := <-regCh
+		require.NoError(t, res.Error)
+	}
+
+	// acquire all lazy shards; this triggers their initialization.
+	acqCh := make(chan ShardResult, 8)
+	for i := 0; i < 8; i++ {
+		k := shard.KeyFromString(strconv.Itoa(i))
+		err := dagst.AcquireShard(context.Background(), k, acqCh, AcquireOpts{})
+		require.NoError(t, err)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	// only two lazy initializations were admitted.
+	require.EqualValues(t, 2, cnt.Count())
+	require.Len(t, acqCh, 0)
+
+	// an explicit registration is not held back by the queued lazy inits.
+	ch := make(chan ShardResult, 1)
+	err = dagst.RegisterShard(context.Background(), shard.KeyFromString("explicit"), carv2mnt, ch, RegisterOpts{})
+	require.NoError(t, err)
+	select {
+	case res := <-ch:
+		require.NoError(t, res.Error)
+	case <-time.After(5 * time.Second):
+		t.Fatal("explicit registration blocked by lazy initializations")
+	}
+
+	// unblock all fetches; all acquires eventually succeed.
+	mnt.UnblockNext(8)
+	for i := 0; i < 8; i++ {
+		res := <-acqCh
+		require.NoError(t, res.Error)
+		require.NoError(t, res.Accessor.Close())
+	}
+	require.EqualValues(t, 8, cnt.Count())
+}
+
+func TestLazyInitQueue(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+
+		MaxConcurrentLazyInit: 1,
+		MaxQueuedLazyInit:     3,
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	mnt := newBlockingMount(carv2mnt)
+	mnt.ready = true
+	cnt := &mount.Counting{Mount: mnt}
+	keys := make([]shard.Key, 5)
+	regCh := make(chan ShardResult, 1)
+	for i := range keys {
+		keys[i] = shard.KeyFromString(strconv.Itoa(i))
+		err := dagst.RegisterShard(context.Background(), keys[i], cnt, regCh, RegisterOpts{LazyInitialization: true})
+		require.NoError(t, err)
+		require.NoError(t, (<-regCh).Error)
+	}
+
+	// the first shard is being initialized.
+	acqCh := make(chan ShardResult, 5)
+	err = dagst.AcquireShard(context.Background(), keys[0], acqCh, AcquireOpts{})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return cnt.Count() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// the next three are queued, and the last one is rejected.
+	for _, k := range keys[1:] {
+		err := dagst.AcquireShard(context.Background(), k, acqCh, AcquireOpts{})
+		require.NoError(t, err)
+	}
+	res := <-acqCh
+	require.Equal(t, keys[4], res.Key)
+	require.ErrorIs(t, res.Error, ErrLazyInitQueueFull)
+
+	info := dagst.AllShardsInfo()
+	require.Zero(t, info[keys[0]].InitQueuePosition)
+	for i, k := range keys[1:4] {
+		require.Equal(t, i+1, info[k].InitQueuePosition)
+		require.Equal(t, ShardStateInitializing, info[k].ShardState)
+	}
+	require.Zero(t, info[keys[4]].InitQueuePosition)
+	require.Equal(t, ShardStateNew, info[keys[4]].ShardState)
+
+	// shards are initialized in the order they were first acquired.
+	for _, k := range keys[:4] {
+		mnt.UnblockNext(1)
+		res := <-acqCh
+		require.Equal(t, k, res.Key)
+		require.NoError(t, res.Error)
+		require.NoError(t, res.Accessor.Close())
+	}
+
+	// the rejected shard can be acquired once there's room.
+	err = dagst.AcquireShard(context.Background(), keys[4], acqCh, AcquireOpts{})
+	require.NoError(t, err)
+	mnt.UnblockNext(1)
+	res = <-acqCh
+	require.NoError(t, res.Error)
+	require.NoError(t, res.Accessor.Close())
+}
+
+func TestLazyInitQueuePositions(t *testing.T) {
+	q := newLazyInitQueue(3)
+	shards := make([]*Shard, 4)
+	for i := range shards {
+		shards[i] = &Shard{key: shard.KeyFromString(strconv.Itoa(i))}
+	}
+
+	// reserved places count towards the limit until released or taken up.
+	for range shards[:3] {
+		require.True(t, q.reserve())
+	}
+	require.False(t, q.reserve())
+	q.unreserve()
+	require.True(t, q.reserve())
+	for _, s := range shards[:3] {
+		q.push(s)
+	}
+	for i, s := range shards[:3] {
+		require.Equal(t, i+1, q.position(s))
+	}
+
+	// removing a shard moves up the shards behind it.
+	q.remove(shards[1])
+	require.Zero(t, q.position(shards[1]))
+	require.Equal(t, 1, q.position(shards[0]))
+	require.Equal(t, 2, q.position(shards[2]))
+
+	// popping moves up the rest.
+	require.True(t, q.reserve())
+	q.push(shards[3])
+	require.Same(t, shards[0], q.pop())
+	require.Equal(t, 1, q.position(shards[2]))
+	require.Equal(t, 2, q.position(shards[3]))
+	require.Same(t, shards[2], q.pop())
+	require.Same(t, shards[3], q.pop())
+	require.Nil(t, q.pop())
+	require.Zero(t, q.position(shards[3]))
+}
+
 func TestIndexingFailure(t *testing.T) {
 	r := testRegistry(t)
 	dir := t.TempDir()
@@ -1403,31 +2293,346 @@ func TestWaiterContextCancelled(t *testing.T) {
 	require.False(t, open)
 }
 
-func TestAcquireContextCancelled(t *testing.T) {
-	r := testRegistry(t)
-	err := r.Register("block", newBlockingMount(&mount.FSMount{FS: testdata.FS}))
-	require.NoError(t, err)
+func TestBlockCache(t *testing.T) {
+	for _, policy := range []blockcache.Policy{blockcache.PolicyARC, blockcache.Policy2Q} {
+		t.Run(policy.String(), func(t *testing.T) {
+			ctx := context.Background()
+			dagst, err := NewDAGStore(Config{
+				MountRegistry:    testRegistry(t),
+				TransientsDir:    t.TempDir(),
+				BlockCacheSize:   1 << 20,
+				BlockCachePolicy: policy,
+			})
+			require.NoError(t, err)
+
+			err = dagst.Start(ctx)
+			require.NoError(t, err)
+
+			keys := registerShards(t, dagst, 2, carv2mnt, RegisterOpts{})
+			accs := acquireShard(t, dagst, keys[0], 2)
+			defer releaseAll(t, dagst, keys[0], accs)
+
+			bs1, err := accs[0].Blockstore()
+			require.NoError(t, err)
+			bs2, err := accs[1].Blockstore()
+			require.NoError(t, err)
+
+			ch, err := bs1.AllKeysChan(ctx)
+			require.NoError(t, err)
+			var cids []cid.Cid
+			for c := range ch {
+				cids = append(cids, c)
+			}
+			require.NotEmpty(t, cids)
+
+			// the root was cached when acquiring.
+			before := dagst.BlockCacheStats()
+
+			// reads through one accessor populate the cache; reads through
+			// another accessor of the same shard hit it.
+			for _, c := range cids {
+				blk, err := bs1.Get(ctx, c)
+				require.NoError(t, err)
+				err = bs2.View(ctx, c, func(b []byte) error {
+					require.Equal(t, blk.RawData(), b)
+					return nil
+				})
+				require.NoError(t, err)
+			}
+			stats := dagst.BlockCacheStats()
+			require.EqualValues(t, len(cids)-1, stats.Misses-before.Misses)
+			require.EqualValues(t, len(cids)+1, stats.Hits-before.Hits)
+			require.Equal(t, len(cids), stats.Entries)
+
+			// cache entries are scoped to their shard.
+			other := acquireShard(t, dagst, keys[1], 1)
+			defer releaseAll(t, dagst, keys[1], other)
+			bs3, err := other[0].Blockstore()
+			require.NoError(t, err)
+
+			before = dagst.BlockCacheStats()
+			c := cids[0]
+			if string(c.Hash()) == string(testdata.RootCID.Hash()) {
+				c = cids[1]
+			}
+			_, err = bs3.Get(ctx, c)
+			require.NoError(t, err)
+			require.EqualValues(t, before.Misses+1, dagst.BlockCacheStats().Misses)
+		})
+	}
+}
 
+func TestAcquireRestricted(t *testing.T) {
+	ctx := context.Background()
 	dagst, err := NewDAGStore(Config{
-		MountRegistry: r,
+		MountRegistry: testRegistry(t),
 		TransientsDir: t.TempDir(),
 	})
 	require.NoError(t, err)
 
-	err = dagst.Start(context.Background())
+	err = dagst.Start(ctx)
 	require.NoError(t, err)
 
-	ch := make(chan ShardResult)
-	k := shard.KeyFromString("foo")
-	block := newBlockingMount(carv2mnt)
-	err = dagst.RegisterShard(context.Background(), k, block, ch, RegisterOpts{LazyInitialization: true})
-	require.NoError(t, err)
-	res := <-ch
-	require.NoError(t, res.Error)
+	k := registerShards(t, dagst, 1, carv2mnt, RegisterOpts{})[0]
 
-	ctx, cancel := context.WithCancel(context.Background())
-	cancel() // start with a cancelled context
-	err = dagst.AcquireShard(ctx, k, ch, AcquireOpts{})
+	// find the offset of the root block, and some other block.
+	ii, err := dagst.GetIterableIndex(k)
+	require.NoError(t, err)
+	var rootOffset uint64
+	var other multihash.Multihash
+	err = ii.ForEach(func(mh multihash.Multihash, offset uint64) error {
+		if bytes.Equal(mh, testdata.RootCID.Hash()) {
+			rootOffset = offset
+		} else {
+			other = mh
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	otherCid := cid.NewCidV1(cid.DagCBOR, other)
+
+	acquire := func(opts AcquireOpts) ShardResult {
+		ch := make(chan ShardResult, 1)
+		err := dagst.AcquireShard(ctx, k, ch, opts)
+		require.NoError(t, err)
+		return <-ch
+	}
+
+	check := func(bs ReadBlockstore, c cid.Cid, expect bool) {
+		has, err := bs.Has(ctx, c)
+		require.NoError(t, err)
+		require.Equal(t, expect, has)
+		_, err = bs.Get(ctx, c)
+		require.Equal(t, !expect, format.IsNotFound(err))
+	}
+
+	for name, opts := range map[string]AcquireOpts{
+		"cids":       {CIDs: []cid.Cid{testdata.RootCID}},
+		"byte range": {ByteRange: &ByteRange{Offset: rootOffset, Length: 1}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			res := acquire(opts)
+			require.NoError(t, res.Error)
+			bs, err := res.Accessor.Blockstore()
+			require.NoError(t, err)
+
+			check(bs, testdata.RootCID, true)
+			check(bs, otherCid, false)
+
+			ch, err := bs.AllKeysChan(ctx)
+			require.NoError(t, err)
+			var keys []cid.Cid
+			for c := range ch {
+				keys = append(keys, c)
+			}
+			require.Len(t, keys, 1)
+			require.NoError(t, res.Accessor.Close())
+		})
+	}
+
+	// restricting to a CID that's not in the shard fails, and releases the shard.
+	unknown, err := cid.Parse("bafykbzaceaeqhm77anl5mv2wjkmh4ofyf6s6eww3ujfmhtsfab65vi3rlccaq")
+	require.NoError(t, err)
+	res := acquire(AcquireOpts{CIDs: []cid.Cid{unknown}})
+	require.ErrorIs(t, res.Error, ErrBlockNotInShard)
+	require.Eventually(t, func() bool {
+		info, err := dagst.GetShardInfo(k)
+		return err == nil && info.ShardState == ShardStateAvailable && info.refs == 0
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func TestAcquireQueueLimits(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:       testRegistry(t),
+		TransientsDir:       t.TempDir(),
+		MaxQueuedAcquires:   2,
+		MaxAcquireQueueWait: 200 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	// the shard remains initializing until the mount is unblocked.
+	mnt := newBlockingMount(carv2mnt)
+	k := shard.KeyFromString("foo")
+	regCh := make(chan ShardResult, 1)
+	err = dagst.RegisterShard(context.Background(), k, mnt, regCh, RegisterOpts{})
+	require.NoError(t, err)
+
+	// two acquirers are queued; the third one is rejected right away.
+	ch := make(chan ShardResult, 3)
+	for i := 0; i < 3; i++ {
+		err = dagst.AcquireShard(context.Background(), k, ch, AcquireOpts{})
+		require.NoError(t, err)
+	}
+	res := <-ch
+	require.ErrorIs(t, res.Error, ErrAcquireQueueFull)
+	require.Len(t, ch, 0)
+
+	// the queued acquirers expire.
+	for i := 0; i < 2; i++ {
+		res := <-ch
+		require.ErrorIs(t, res.Error, ErrAcquireQueueTimeout)
+	}
+
+	// a new acquirer fits in the queue, and is served once the shard is
+	// initialized.
+	err = dagst.AcquireShard(context.Background(), k, ch, AcquireOpts{})
+	require.NoError(t, err)
+	mnt.UnblockNext(1)
+	require.NoError(t, (<-regCh).Error)
+
+	res = <-ch
+	require.NoError(t, res.Error)
+	require.NotNil(t, res.Accessor)
+	require.NoError(t, res.Accessor.Close())
+
+	// no expiry fires for the served acquirer.
+	time.Sleep(300 * time.Millisecond)
+	require.Len(t, ch, 0)
+}
+
+func TestAcquireConcurrencyPerShard(t *testing.T) {
+	r := testRegistry(t)
+	err := r.Register("opening", &openingMount{})
+	require.NoError(t, err)
+
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:                 r,
+		TransientsDir:                 t.TempDir(),
+		MaxConcurrentAcquiresPerShard: 2,
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	// the BytesMount is fully capable, so every acquire fetches from it.
+	mnt := &openingMount{Mount: &mount.BytesMount{Bytes: testdata.CarV2}, unblock: make(chan struct{})}
+	k := shard.KeyFromString("foo")
+	ch := make(chan ShardResult, 1)
+	err = dagst.RegisterShard(context.Background(), k, mnt, ch, RegisterOpts{})
+	require.NoError(t, err)
+	mnt.unblock <- struct{}{}
+	require.NoError(t, (<-ch).Error)
+
+	// the last acquirer gives up while waiting for a slot.
+	ctx, cancel := context.WithCancel(context.Background())
+	acqCh := make(chan ShardResult, 5)
+	for i := 0; i < 4; i++ {
+		err = dagst.AcquireShard(context.Background(), k, acqCh, AcquireOpts{})
+		require.NoError(t, err)
+	}
+	err = dagst.AcquireShard(ctx, k, acqCh, AcquireOpts{})
+	require.NoError(t, err)
+
+	// only two acquirers are opening the shard.
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&mnt.opening) == 2 }, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool { return dagst.AllShardsInfo()[k].refs == 5 }, 5*time.Second, 10*time.Millisecond)
+	require.EqualValues(t, 2, atomic.LoadInt32(&mnt.opening))
+	cancel()
+
+	// each acquirer that's done opening lets the next one in; the cancelled
+	// acquirer is released without opening the shard, and its result may be
+	// discarded.
+	go func() {
+		for i := 0; i < 4; i++ {
+			mnt.unblock <- struct{}{}
+		}
+	}()
+	var accs []*ShardAccessor
+	for len(accs) < 4 {
+		res := <-acqCh
+		if res.Error != nil {
+			require.ErrorIs(t, res.Error, context.Canceled)
+			continue
+		}
+		accs = append(accs, res.Accessor)
+	}
+	require.EqualValues(t, 2, atomic.LoadInt32(&mnt.max))
+	require.EqualValues(t, 5, atomic.LoadInt32(&mnt.fetches))
+	require.Eventually(t, func() bool { return dagst.AllShardsInfo()[k].refs == 4 }, 5*time.Second, 10*time.Millisecond)
+
+	releaseAll(t, dagst, k, accs)
+}
+
+func TestAcquireConcurrencyPerShardCancelled(t *testing.T) {
+	r := testRegistry(t)
+	err := r.Register("opening", &openingMount{})
+	require.NoError(t, err)
+
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:                 r,
+		TransientsDir:                 t.TempDir(),
+		MaxConcurrentAcquiresPerShard: 1,
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+	defer dagst.Close()
+
+	mnt := &openingMount{Mount: &mount.BytesMount{Bytes: testdata.CarV2}, unblock: make(chan struct{})}
+	k := shard.KeyFromString("foo")
+	ch := make(chan ShardResult, 1)
+	err = dagst.RegisterShard(context.Background(), k, mnt, ch, RegisterOpts{})
+	require.NoError(t, err)
+	mnt.unblock <- struct{}{}
+	require.NoError(t, (<-ch).Error)
+
+	// more acquirers give up while waiting for a slot than the completion
+	// queue of the event loop can hold.
+	const waiters = 80
+	acqCh := make(chan ShardResult, waiters+1)
+	err = dagst.AcquireShard(context.Background(), k, acqCh, AcquireOpts{})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	for i := 0; i < waiters; i++ {
+		err = dagst.AcquireShard(ctx, k, acqCh, AcquireOpts{})
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool { return dagst.AllShardsInfo()[k].refs == waiters+1 }, 30*time.Second, 10*time.Millisecond)
+	cancel()
+
+	// they're all released once the first acquirer is done opening the
+	// shard; their results may be discarded, as their context is done.
+	mnt.unblock <- struct{}{}
+	res := <-acqCh
+	for errors.Is(res.Error, context.Canceled) {
+		res = <-acqCh
+	}
+	require.NoError(t, res.Error)
+	require.Eventually(t, func() bool { return dagst.AllShardsInfo()[k].refs == 1 }, 5*time.Second, 10*time.Millisecond)
+	require.EqualValues(t, 2, atomic.LoadInt32(&mnt.fetches))
+	releaseAll(t, dagst, k, []*ShardAccessor{res.Accessor})
+}
+
+func TestAcquireContextCancelled(t *testing.T) {
+	r := testRegistry(t)
+	err := r.Register("block", newBlockingMount(&mount.FSMount{FS: testdata.FS}))
+	require.NoError(t, err)
+
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: r,
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	ch := make(chan ShardResult)
+	k := shard.KeyFromString("foo")
+	block := newBlockingMount(carv2mnt)
+	err = dagst.RegisterShard(context.Background(), k, block, ch, RegisterOpts{LazyInitialization: true})
+	require.NoError(t, err)
+	res := <-ch
+	require.NoError(t, res.Error)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // start with a cancelled context
+	err = dagst.AcquireShard(ctx, k, ch, AcquireOpts{})
 	require.NoError(t, err)
 
 	time.Sleep(1 * time.Second)
@@ -1463,117 +2668,434 @@ func TestAcquireContextCancelled(t *testing.T) {
 
 }
 
-// registerShards registers n shards concurrently, using the CARv2 mount.
-func registerShards(t *testing.T, dagst *DAGStore, n int, mnt mount.Mount, opts RegisterOpts) (ret []shard.Key) {
-	grp, _ := errgroup.WithContext(context.Background())
-	for i := 0; i < n; i++ {
-		k := shard.KeyFromString(fmt.Sprintf("shard-%d", i))
-		grp.Go(func() error {
-			ch := make(chan ShardResult, 1)
-			err := dagst.RegisterShard(context.Background(), k, mnt, ch, opts)
-			if err != nil {
-				return err
-			}
-			res := <-ch
-			return res.Error
-		})
-		ret = append(ret, k)
-	}
+func TestVerifyIndex(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
 
-	require.NoError(t, grp.Wait())
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
 
-	info := dagst.AllShardsInfo()
-	require.Len(t, info, n)
-	for k, ss := range info {
-		if opts.LazyInitialization {
-			require.Equal(t, ShardStateNew, ss.ShardState)
-			require.NoError(t, ss.Error)
-		} else {
-			require.Equal(t, ShardStateAvailable, ss.ShardState)
-			require.NoError(t, ss.Error)
+	ctx := context.Background()
+	keys := registerShards(t, dagst, 4, carv2mnt, RegisterOpts{})
 
-			istat, err := dagst.indices.StatFullIndex(k)
-			require.NoError(t, err)
-			require.True(t, istat.Exists)
-		}
+	// all indices are sound.
+	results, err := dagst.VerifyAll(ctx, 2, VerifyIndexOpts{})
+	require.NoError(t, err)
+	require.Len(t, results, 4)
+	for _, res := range results {
+		require.True(t, res.OK())
+		require.NotZero(t, res.Entries)
 	}
 
-	return ret
-}
+	// verification reads from the mount, not the transient.
+	path := dagst.shards[keys[3]].mount.TransientPath()
+	require.NotEmpty(t, path)
+	require.NoError(t, os.Truncate(path, 0))
+	res, err := dagst.VerifyIndex(ctx, keys[3], VerifyIndexOpts{})
+	require.NoError(t, err)
+	require.True(t, res.OK())
 
-// acquireShard acquires the shard known by key `k` concurrently `n` times.
-func acquireShard(t *testing.T, dagst *DAGStore, k shard.Key, n int) []*ShardAccessor {
-	accessors := make([]*ShardAccessor, n)
+	// drop an index, and replace another with one that has an extra entry.
+	_, err = dagst.indices.DropFullIndex(keys[0])
+	require.NoError(t, err)
 
-	// acquire
-	grp, _ := errgroup.WithContext(context.Background())
-	for i := 0; i < n; i++ {
-		i := i
-		grp.Go(func() error {
-			ch := make(chan ShardResult, 1)
-			err := dagst.AcquireShard(context.Background(), k, ch, AcquireOpts{})
-			if err != nil {
-				return err
-			}
+	idx, err := dagst.indices.GetFullIndex(keys[1])
+	require.NoError(t, err)
+	var records []carindex.Record
+	err = idx.(carindex.IterableIndex).ForEach(func(h multihash.Multihash, offset uint64) error {
+		records = append(records, carindex.Record{Cid: cid.NewCidV1(cid.Raw, h), Offset: offset})
+		return nil
+	})
+	require.NoError(t, err)
+	bogus, err := multihash.Sum([]byte("bogus"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	records = append(records, carindex.Record{Cid: cid.NewCidV1(cid.Raw, bogus), Offset: 42})
+	corrupt := carindex.NewMultihashSorted()
+	require.NoError(t, corrupt.Load(records))
+	require.NoError(t, dagst.indices.AddFullIndex(keys[1], corrupt))
 
-			res := <-ch
-			if res.Error != nil {
-				return res.Error
-			}
+	res, err = dagst.VerifyIndex(ctx, keys[0], VerifyIndexOpts{})
+	require.NoError(t, err)
+	require.False(t, res.OK())
+	require.True(t, res.StoredMissing)
+	require.Equal(t, res.Entries, res.Missing)
+	require.False(t, res.Repaired)
 
-			bs, err := res.Accessor.Blockstore()
-			if err != nil {
-				return err
-			}
+	res, err = dagst.VerifyIndex(ctx, keys[1], VerifyIndexOpts{})
+	require.NoError(t, err)
+	require.False(t, res.OK())
+	require.Zero(t, res.Missing)
+	require.Equal(t, 1, res.Unexpected)
 
-			state, err := dagst.GetShardInfo(k)
-			if err != nil {
-				return err
-			} else if state.ShardState != ShardStateServing {
-				return fmt.Errorf("expected state ShardStateServing; was: %s", state.ShardState)
-			}
+	// repair all, then verify again.
+	results, err = dagst.VerifyAll(ctx, 2, VerifyIndexOpts{Repair: true})
+	require.NoError(t, err)
+	require.Len(t, results, 4)
+	require.True(t, results[keys[0]].Repaired)
+	require.True(t, results[keys[1]].Repaired)
+	require.False(t, results[keys[2]].Repaired)
 
-			if _, err := bs.Get(context.TODO(), testdata.RootCID); err != nil {
-				return err
-			}
+	results, err = dagst.VerifyAll(ctx, 0, VerifyIndexOpts{})
+	require.NoError(t, err)
+	for _, res := range results {
+		require.True(t, res.OK())
+	}
 
-			accessors[i] = res.Accessor
-			return nil
-		})
+	_, err = dagst.VerifyIndex(ctx, shard.KeyFromString("unknown"), VerifyIndexOpts{})
+	require.ErrorIs(t, err, ErrShardUnknown)
+}
+
+// TestRefcountAccounting tests that refcount accounting tracks the provenance
+// of references, and reports double releases instead of letting the refcount
+// drift.
+func TestRefcountAccounting(t *testing.T) {
+	failures := make(chan ShardResult, 16)
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:      testRegistry(t),
+		TransientsDir:      t.TempDir(),
+		FailureCh:          failures,
+		RefcountAccounting: true,
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	keys := registerShards(t, dagst, 1, carv2mnt, RegisterOpts{})
+	k := keys[0]
+	accs := acquireShard(t, dagst, k, 2)
+
+	refs, err := dagst.ShardRefs(k)
+	require.NoError(t, err)
+	require.Len(t, refs, 2)
+	for _, ref := range refs {
+		require.Contains(t, ref.Provenance, "dagstore_test.go")
+		require.False(t, ref.AcquiredAt.IsZero())
 	}
+	require.Less(t, refs[0].ID, refs[1].ID)
 
-	require.NoError(t, grp.Wait())
+	// closing the first accessor twice reports a violation, and doesn't
+	// release the reference held by the second accessor.
+	require.NoError(t, accs[0].Close())
+	require.NoError(t, accs[0].Close())
 
-	// check shard state.
+	select {
+	case res := <-failures:
+		require.Equal(t, k, res.Key)
+		require.ErrorIs(t, res.Error, ErrRefcountViolation)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a refcount violation")
+	}
+
+	refs, err = dagst.ShardRefs(k)
+	require.NoError(t, err)
+	require.Len(t, refs, 1)
 	info, err := dagst.GetShardInfo(k)
 	require.NoError(t, err)
 	require.Equal(t, ShardStateServing, info.ShardState)
 	require.NoError(t, info.Error)
-	// refs should be equal to number of acquirers since we've not closed any acquirer/released any shard.
-	require.EqualValues(t, n, info.refs)
-
-	return accessors
-}
-
-// releaseAll releases all accessors for a given shard.
-func releaseAll(t *testing.T, dagst *DAGStore, k shard.Key, accs []*ShardAccessor) {
-	grp, _ := errgroup.WithContext(context.Background())
-	for _, acc := range accs {
-		// close all accessors.
-		grp.Go(acc.Close)
-	}
 
-	require.NoError(t, grp.Wait())
+	require.NoError(t, accs[1].Close())
 	require.Eventually(t, func() bool {
 		info, err := dagst.GetShardInfo(k)
-		return err == nil && info.ShardState == ShardStateAvailable && info.refs == 0
-	}, 5*time.Second, 100*time.Millisecond)
+		return err == nil && info.ShardState == ShardStateAvailable
+	}, 5*time.Second, 10*time.Millisecond)
 
+	refs, err = dagst.ShardRefs(k)
+	require.NoError(t, err)
+	require.Empty(t, refs)
+	require.Len(t, failures, 0)
 }
 
-func testRegistry(t *testing.T) *mount.Registry {
-	r := mount.NewRegistry()
-	err := r.Register("fs", &mount.FSMount{FS: testdata.FS})
+// TestPauseResume tests that pausing the DAG store queues acquires, rejects
+// registrations, and lets in-flight operations complete.
+func TestEventLoops(t *testing.T) {
+	sink := tracer(1024)
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		TraceCh:       sink,
+		EventLoops:    4,
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	// shards are spread across workers.
+	keys := registerShards(t, dagst, 32, carv2mnt, RegisterOpts{})
+	workers := make(map[int]struct{})
+	for _, k := range keys {
+		workers[loopOf(k, 4)] = struct{}{}
+	}
+	require.Len(t, workers, 4)
+
+	grp, _ := errgroup.WithContext(context.Background())
+	for _, k := range keys {
+		k := k
+		grp.Go(func() error {
+			ch := make(chan ShardResult, 1)
+			if err := dagst.AcquireShard(context.Background(), k, ch, AcquireOpts{}); err != nil {
+				return err
+			}
+			res := <-ch
+			if res.Error != nil {
+				return res.Error
+			}
+			return res.Accessor.Close()
+		})
+	}
+	require.NoError(t, grp.Wait())
+
+	// register, initialize, make available, acquire and release per shard.
+	evts := make([]Trace, 32*5)
+	n, timedOut := sink.Read(evts, 5*time.Second)
+	require.False(t, timedOut)
+	require.Equal(t, len(evts), n)
+
+	// traces are delivered in global sequence, and operations on each shard
+	// are processed in order.
+	lastSeq := make(map[shard.Key]uint64)
+	lastOp := make(map[shard.Key]OpType)
+	for i, evt := range evts {
+		require.EqualValues(t, i+1, evt.Seq)
+		require.Equal(t, lastSeq[evt.Key]+1, evt.ShardSeq)
+		lastSeq[evt.Key] = evt.ShardSeq
+		if evt.Op == OpShardRelease {
+			require.Equal(t, OpShardAcquire, lastOp[evt.Key])
+		}
+		lastOp[evt.Key] = evt.Op
+	}
+
+	// GC halts all workers, and reclaims all transients.
+	res, err := dagst.GC(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 32, res.Reclaimed)
+
+	// pausing is relayed to all workers.
+	err = dagst.Pause(context.Background())
+	require.NoError(t, err)
+	ch := make(chan ShardResult, len(keys))
+	for _, k := range keys {
+		err := dagst.AcquireShard(context.Background(), k, ch, AcquireOpts{})
+		require.NoError(t, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	require.Len(t, ch, 0)
+
+	err = dagst.Resume(context.Background())
+	require.NoError(t, err)
+	for range keys {
+		res := <-ch
+		require.NoError(t, res.Error)
+		require.NoError(t, res.Accessor.Close())
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	r := testRegistry(t)
+	err := r.Register("block", newBlockingMount(&mount.FSMount{FS: testdata.FS}))
+	require.NoError(t, err)
+
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: r,
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	keys := registerShards(t, dagst, 1, carv2mnt, RegisterOpts{})
+
+	// start a registration that blocks while fetching.
+	block := newBlockingMount(carv2mnt)
+	regCh := make(chan ShardResult, 1)
+	err = dagst.RegisterShard(ctx, shard.KeyFromString("blocked"), block, regCh, RegisterOpts{})
+	require.NoError(t, err)
+
+	err = dagst.Pause(ctx)
+	require.NoError(t, err)
+	require.True(t, dagst.Paused())
+
+	// registrations are rejected.
+	err = dagst.RegisterShard(ctx, shard.KeyFromString("rejected"), carv2mnt, nil, RegisterOpts{})
+	require.ErrorIs(t, err, ErrPaused)
+
+	// acquires queue up.
+	acqCh := make(chan ShardResult, 1)
+	err = dagst.AcquireShard(ctx, keys[0], acqCh, AcquireOpts{})
+	require.NoError(t, err)
+
+	// the in-flight registration completes.
+	block.UnblockNext(1)
+	res := <-regCh
+	require.NoError(t, res.Error)
+
+	select {
+	case res := <-acqCh:
+		t.Fatalf("expected no ShardResult while paused, got: %+v", res)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// upon resume, the queued acquire is dispatched.
+	err = dagst.Resume(ctx)
+	require.NoError(t, err)
+	require.False(t, dagst.Paused())
+
+	res = <-acqCh
+	require.NoError(t, res.Error)
+
+	// accessors are released while paused.
+	require.NoError(t, dagst.Pause(ctx))
+	require.NoError(t, res.Accessor.Close())
+	require.Eventually(t, func() bool {
+		info, err := dagst.GetShardInfo(keys[0])
+		return err == nil && info.refs == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, dagst.Resume(ctx))
+
+	err = dagst.RegisterShard(ctx, shard.KeyFromString("accepted"), carv2mnt, regCh, RegisterOpts{})
+	require.NoError(t, err)
+	res = <-regCh
+	require.NoError(t, res.Error)
+}
+
+func TestPauseTimeout(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	// the event loop isn't running, so pause requests are never taken; a
+	// pause that times out doesn't leave the DAG store rejecting
+	// registrations.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, dagst.Pause(ctx), context.DeadlineExceeded)
+	require.False(t, dagst.Paused())
+
+	require.NoError(t, dagst.Start(context.Background()))
+	defer dagst.Close()
+	require.NoError(t, dagst.RegisterShardSync(context.Background(), shard.KeyFromString("foo"), carv2mnt, RegisterOpts{}))
+}
+
+// registerShards registers n shards concurrently, using the CARv2 mount.
+func registerShards(t *testing.T, dagst *DAGStore, n int, mnt mount.Mount, opts RegisterOpts) (ret []shard.Key) {
+	grp, _ := errgroup.WithContext(context.Background())
+	for i := 0; i < n; i++ {
+		k := shard.KeyFromString(fmt.Sprintf("shard-%d", i))
+		grp.Go(func() error {
+			ch := make(chan ShardResult, 1)
+			err := dagst.RegisterShard(context.Background(), k, mnt, ch, opts)
+			if err != nil {
+				return err
+			}
+			res := <-ch
+			return res.Error
+		})
+		ret = append(ret, k)
+	}
+
+	require.NoError(t, grp.Wait())
+
+	info := dagst.AllShardsInfo()
+	require.Len(t, info, n)
+	for k, ss := range info {
+		if opts.LazyInitialization {
+			require.Equal(t, ShardStateNew, ss.ShardState)
+			require.NoError(t, ss.Error)
+		} else {
+			require.Equal(t, ShardStateAvailable, ss.ShardState)
+			require.NoError(t, ss.Error)
+
+			istat, err := dagst.indices.StatFullIndex(k)
+			require.NoError(t, err)
+			require.True(t, istat.Exists)
+		}
+	}
+
+	return ret
+}
+
+// acquireShard acquires the shard known by key `k` concurrently `n` times.
+func acquireShard(t *testing.T, dagst *DAGStore, k shard.Key, n int) []*ShardAccessor {
+	accessors := make([]*ShardAccessor, n)
+
+	// acquire
+	grp, _ := errgroup.WithContext(context.Background())
+	for i := 0; i < n; i++ {
+		i := i
+		grp.Go(func() error {
+			ch := make(chan ShardResult, 1)
+			err := dagst.AcquireShard(context.Background(), k, ch, AcquireOpts{})
+			if err != nil {
+				return err
+			}
+
+			res := <-ch
+			if res.Error != nil {
+				return res.Error
+			}
+
+			bs, err := res.Accessor.Blockstore()
+			if err != nil {
+				return err
+			}
+
+			state, err := dagst.GetShardInfo(k)
+			if err != nil {
+				return err
+			} else if state.ShardState != ShardStateServing {
+				return fmt.Errorf("expected state ShardStateServing; was: %s", state.ShardState)
+			}
+
+			if _, err := bs.Get(context.TODO(), testdata.RootCID); err != nil {
+				return err
+			}
+
+			accessors[i] = res.Accessor
+			return nil
+		})
+	}
+
+	require.NoError(t, grp.Wait())
+
+	// check shard state.
+	info, err := dagst.GetShardInfo(k)
+	require.NoError(t, err)
+	require.Equal(t, ShardStateServing, info.ShardState)
+	require.NoError(t, info.Error)
+	// refs should be equal to number of acquirers since we've not closed any acquirer/released any shard.
+	require.EqualValues(t, n, info.refs)
+
+	return accessors
+}
+
+// releaseAll releases all accessors for a given shard.
+func releaseAll(t *testing.T, dagst *DAGStore, k shard.Key, accs []*ShardAccessor) {
+	grp, _ := errgroup.WithContext(context.Background())
+	for _, acc := range accs {
+		// close all accessors.
+		grp.Go(acc.Close)
+	}
+
+	require.NoError(t, grp.Wait())
+	require.Eventually(t, func() bool {
+		info, err := dagst.GetShardInfo(k)
+		return err == nil && info.ShardState == ShardStateAvailable && info.refs == 0
+	}, 5*time.Second, 100*time.Millisecond)
+
+}
+
+func testRegistry(t *testing.T) *mount.Registry {
+	r := mount.NewRegistry()
+	err := r.Register("fs", &mount.FSMount{FS: testdata.FS})
 	require.NoError(t, err)
 	err = r.Register("counting", new(mount.Counting))
 	require.NoError(t, err)
@@ -1600,6 +3122,18 @@ func (m Tracer) Read(dst []Trace, timeout time.Duration) (n int, timedOut bool)
 	return len(dst), false
 }
 
+// remoteMount is a mount that proxies to another mount, but reports itself as
+// remote.
+type remoteMount struct {
+	mount.Mount
+}
+
+func (r *remoteMount) Info() mount.Info {
+	info := r.Mount.Info()
+	info.Kind = mount.KindRemote
+	return info
+}
+
 // blockingMount is a mount that proxies to another mount, but it blocks by
 // default, unless unblock tokens are added via UnblockNext.
 type blockingMount struct {
@@ -1608,6 +3142,31 @@ type blockingMount struct {
 	ready     bool
 }
 
+// openingMount blocks calls to Fetch until unblocked, tracking how many are
+// in progress.
+type openingMount struct {
+	mount.Mount
+	unblock chan struct{}
+
+	fetches int32 // number of calls to Fetch.
+	opening int32 // number of calls to Fetch in progress.
+	max     int32 // maximum number of calls to Fetch in progress.
+}
+
+func (o *openingMount) Fetch(ctx context.Context) (mount.Reader, error) {
+	atomic.AddInt32(&o.fetches, 1)
+	n := atomic.AddInt32(&o.opening, 1)
+	defer atomic.AddInt32(&o.opening, -1)
+	for {
+		max := atomic.LoadInt32(&o.max)
+		if n <= max || atomic.CompareAndSwapInt32(&o.max, max, n) {
+			break
+		}
+	}
+	<-o.unblock
+	return o.Mount.Fetch(ctx)
+}
+
 func newBlockingMount(mnt mount.Mount) *blockingMount {
 	return &blockingMount{Mount: mnt, UnblockCh: make(chan struct{})}
 }
@@ -1634,3 +3193,3697 @@ func (b *blockingMount) Stat(ctx context.Context) (mount.Stat, error) {
 	s.Ready = b.ready
 	return s, err
 }
+
+func TestFailureBuffer(t *testing.T) {
+	failures := make(chan ShardResult)
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:     testRegistry(t),
+		TransientsDir:     t.TempDir(),
+		FailureCh:         failures,
+		FailureBufferSize: 2,
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+	defer dagst.Close()
+
+	// register 5 shards that fail indexing, without consuming failures; the
+	// event loop must not block.
+	junkmnt := *junkmnt // take a copy
+	for i := 0; i < 5; i++ {
+		ch := make(chan ShardResult, 1)
+		k := shard.KeyFromString(strconv.Itoa(i))
+		err := dagst.RegisterShard(context.Background(), k, &junkmnt, ch, RegisterOpts{})
+		require.NoError(t, err)
+		res := <-ch
+		require.Error(t, res.Error)
+	}
+
+	// one failure is being delivered, the last two are buffered, and the
+	// rest were dropped.
+	require.Eventually(t, func() bool {
+		return dagst.FailureStats() == NotifyStats{Pending: 2, Dropped: 2}
+	}, 5*time.Second, 10*time.Millisecond)
+
+	res := <-failures
+	require.Error(t, res.Error)
+	for _, k := range []string{"3", "4"} {
+		res := <-failures
+		require.Equal(t, k, res.Key.String())
+		require.Error(t, res.Error)
+	}
+	require.Eventually(t, func() bool {
+		return dagst.FailureStats() == NotifyStats{Delivered: 3, Dropped: 2}
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// fixableFS serves the junk test file, until it's fixed, after which it serves
+// the CARv2 test file in its place. Fixing it is safe while mounts read it.
+type fixableFS struct {
+	fixed int32
+}
+
+func (f *fixableFS) Open(name string) (fs.File, error) {
+	if name == testdata.FSPathJunk && atomic.LoadInt32(&f.fixed) == 1 {
+		name = testdata.FSPathCarV2
+	}
+	return testdata.FS.Open(name)
+}
+
+func TestRecoverAll(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:    testRegistry(t),
+		TransientsDir:    t.TempDir(),
+		RecoverAllPacing: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+	defer dagst.Close()
+
+	// register 8 shards with junk in them, so they will fail indexing.
+	fsys := new(fixableFS)
+	junkmnt := &mount.FSMount{FS: fsys, Path: testdata.FSPathJunk}
+	for i := 0; i < 8; i++ {
+		ch := make(chan ShardResult, 1)
+		k := shard.KeyFromString(strconv.Itoa(i))
+		err := dagst.RegisterShard(context.Background(), k, junkmnt, ch, RegisterOpts{})
+		require.NoError(t, err)
+		require.Error(t, (<-ch).Error)
+	}
+
+	// fix the mount, and recover all shards.
+	atomic.StoreInt32(&fsys.fixed, 1)
+	out := make(chan ShardResult, 8)
+	err = dagst.RecoverAll(context.Background(), 2, out)
+	require.NoError(t, err)
+	require.Len(t, out, 8)
+	for i := 0; i < 8; i++ {
+		require.NoError(t, (<-out).Error)
+	}
+	for _, info := range dagst.AllShardsInfo() {
+		require.Equal(t, ShardStateAvailable, info.ShardState)
+	}
+
+	// nothing left to recover.
+	err = dagst.RecoverAll(context.Background(), 2, out)
+	require.NoError(t, err)
+	require.Len(t, out, 0)
+
+	// a cancelled context aborts the recoveries.
+	ch := make(chan ShardResult, 1)
+	err = dagst.RegisterShard(context.Background(), shard.KeyFromString("bad"), &mount.FSMount{FS: testdata.FS, Path: testdata.FSPathJunk}, ch, RegisterOpts{})
+	require.NoError(t, err)
+	require.Error(t, (<-ch).Error)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = dagst.RecoverAll(ctx, 2, out)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+// flakyMount is an FSMount that fails while down is set.
+type flakyMount struct {
+	mount.FSMount
+	down *int32
+}
+
+func (f *flakyMount) Fetch(ctx context.Context) (mount.Reader, error) {
+	if atomic.LoadInt32(f.down) == 1 {
+		return nil, fmt.Errorf("mount is down")
+	}
+	return f.FSMount.Fetch(ctx)
+}
+
+func (f *flakyMount) Stat(ctx context.Context) (mount.Stat, error) {
+	if atomic.LoadInt32(f.down) == 1 {
+		return mount.Stat{}, fmt.Errorf("mount is down")
+	}
+	return f.FSMount.Stat(ctx)
+}
+
+func TestMountHealth(t *testing.T) {
+	newDAGStore := func(t *testing.T, policy DegradedMountPolicy, down *int32) *DAGStore {
+		r := testRegistry(t)
+		err := r.Register("flaky", &flakyMount{FSMount: mount.FSMount{FS: testdata.FS}, down: down})
+		require.NoError(t, err)
+		dagst, err := NewDAGStore(Config{
+			MountRegistry:       r,
+			TransientsDir:       t.TempDir(),
+			DegradedMountPolicy: policy,
+			// probe by hand, through CheckMountHealth.
+			MountHealthCheckInterval: time.Hour,
+		})
+		require.NoError(t, err)
+		err = dagst.Start(context.Background())
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = dagst.Close() })
+
+		for i := 0; i < 4; i++ {
+			ch := make(chan ShardResult, 1)
+			mnt := &flakyMount{FSMount: mount.FSMount{FS: testdata.FS, Path: testdata.FSPathCarV2}, down: down}
+			err := dagst.RegisterShard(context.Background(), shard.KeyFromString(strconv.Itoa(i)), mnt, ch, RegisterOpts{})
+			require.NoError(t, err)
+			require.NoError(t, (<-ch).Error)
+		}
+		return dagst
+	}
+
+	// takeDown marks the mount down, and reclaims the transients, so that
+	// acquires need to fetch from the mount.
+	takeDown := func(t *testing.T, dagst *DAGStore, down *int32) string {
+		atomic.StoreInt32(down, 1)
+		_, err := dagst.GC(context.Background())
+		require.NoError(t, err)
+
+		health := dagst.CheckMountHealth(context.Background())
+		require.Len(t, health, 1)
+		for g, h := range health {
+			require.True(t, h.Degraded)
+			require.Equal(t, 4, h.Shards)
+			require.Equal(t, 3, h.Probed)
+			require.Equal(t, 3, h.Failed)
+			require.Error(t, h.LastError)
+			require.Equal(t, health, dagst.MountHealth())
+			return g
+		}
+		return ""
+	}
+
+	t.Run("fail fast", func(t *testing.T) {
+		var down int32
+		dagst := newDAGStore(t, DegradedMountFailFast, &down)
+
+		health := dagst.CheckMountHealth(context.Background())
+		require.Len(t, health, 1)
+		for _, h := range health {
+			require.False(t, h.Degraded)
+			require.Zero(t, h.Failed)
+		}
+
+		takeDown(t, dagst, &down)
+		ch := make(chan ShardResult, 1)
+		err := dagst.AcquireShard(context.Background(), shard.KeyFromString("0"), ch, AcquireOpts{})
+		require.NoError(t, err)
+		res := <-ch
+		require.ErrorIs(t, res.Error, ErrMountDegraded)
+
+		// the shard isn't failed, and can be acquired once the mount heals.
+		require.Eventually(t, func() bool {
+			info, err := dagst.GetShardInfo(shard.KeyFromString("0"))
+			return err == nil && info.ShardState == ShardStateAvailable
+		}, 5*time.Second, 10*time.Millisecond)
+
+		atomic.StoreInt32(&down, 0)
+		dagst.CheckMountHealth(context.Background())
+		releaseAll(t, dagst, shard.KeyFromString("0"), acquireShard(t, dagst, shard.KeyFromString("0"), 1))
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		var down int32
+		dagst := newDAGStore(t, DegradedMountQueue, &down)
+		takeDown(t, dagst, &down)
+
+		ch := make(chan ShardResult, 1)
+		err := dagst.AcquireShard(context.Background(), shard.KeyFromString("0"), ch, AcquireOpts{})
+		require.NoError(t, err)
+		select {
+		case res := <-ch:
+			t.Fatalf("acquire wasn't parked: %v", res.Error)
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		atomic.StoreInt32(&down, 0)
+		dagst.CheckMountHealth(context.Background())
+		res := <-ch
+		require.NoError(t, res.Error)
+		require.NoError(t, res.Accessor.Close())
+	})
+
+	t.Run("queue without probes", func(t *testing.T) {
+		// nothing would resume the parked acquires.
+		_, err := NewDAGStore(Config{
+			MountRegistry:       testRegistry(t),
+			TransientsDir:       t.TempDir(),
+			DegradedMountPolicy: DegradedMountQueue,
+		})
+		require.Error(t, err)
+	})
+}
+
+func TestIndexCache(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:  testRegistry(t),
+		TransientsDir:  t.TempDir(),
+		IndexCacheSize: 4,
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+	defer dagst.Close()
+
+	ch := make(chan ShardResult, 1)
+	k := shard.KeyFromString("foo")
+	err = dagst.RegisterShard(context.Background(), k, carv2mnt, ch, RegisterOpts{})
+	require.NoError(t, err)
+	require.NoError(t, (<-ch).Error)
+
+	// acquirers after the first one reuse the parsed index.
+	for i := 0; i < 3; i++ {
+		releaseAll(t, dagst, k, acquireShard(t, dagst, k, 1))
+	}
+	stats := dagst.IndexCacheStats()
+	require.EqualValues(t, 1, stats.Misses)
+	require.EqualValues(t, 2, stats.Hits)
+	require.Equal(t, 1, stats.Entries)
+}
+
+func TestTraceSinks(t *testing.T) {
+	var funcTraces int32
+	blocked := make(chan Trace) // never read.
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		TraceSinks: []TraceSinkOpts{
+			{Sink: TraceFunc(func(Trace) { atomic.AddInt32(&funcTraces, 1) })},
+			{Sink: ChannelTraceSink(blocked), BufferSize: 2},
+			{Sink: NewJSONLTraceSink(f)},
+		},
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	// registering shards must not block on the stalled sink.
+	registerShards(t, dagst, 4, carv2mnt, RegisterOpts{})
+
+	// each registration produces three traces: register, initialize and
+	// make available.
+	require.Eventually(t, func() bool {
+		stats := dagst.TraceSinkStats()
+		return stats[0].Written == 12 && stats[2].Written == 12
+	}, 5*time.Second, 10*time.Millisecond)
+	require.EqualValues(t, 12, atomic.LoadInt32(&funcTraces))
+
+	// the stalled sink is writing at most one trace and buffers two; the rest
+	// were dropped.
+	stats := dagst.TraceSinkStats()
+	require.Zero(t, stats[1].Written)
+	require.GreaterOrEqual(t, stats[1].Dropped, uint64(9))
+
+	require.NoError(t, dagst.Close())
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	require.Len(t, lines, 12)
+	for _, l := range lines {
+		var tj traceJSON
+		require.NoError(t, json.Unmarshal([]byte(l), &tj))
+		require.NotEmpty(t, tj.Key)
+		require.NotEmpty(t, tj.Op)
+	}
+}
+
+func TestTraceSequence(t *testing.T) {
+	sink := tracer(128)
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		TraceCh:       sink,
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+
+	// register 16 shards with junk in them, so that each emits an
+	// OpShardRegister, OpShardInitialize and OpShardFail trace.
+	resCh := make(chan ShardResult, 16)
+	junkmnt := *junkmnt // take a copy
+	for i := 0; i < 16; i++ {
+		k := shard.KeyFromString(strconv.Itoa(i))
+		err := dagst.RegisterShard(context.Background(), k, &junkmnt, resCh, RegisterOpts{})
+		require.NoError(t, err)
+	}
+	for i := 0; i < 16; i++ {
+		res := <-resCh
+		require.Error(t, res.Error)
+	}
+
+	evts := make([]Trace, 48)
+	n, timedOut := sink.Read(evts, 5*time.Second)
+	require.False(t, timedOut)
+	require.Equal(t, 48, n)
+
+	// traces are numbered globally and per shard, without gaps.
+	shardSeqs := make(map[shard.Key]uint64)
+	for i, evt := range evts {
+		require.EqualValues(t, i+1, evt.Seq)
+		shardSeqs[evt.Key]++
+		require.Equal(t, shardSeqs[evt.Key], evt.ShardSeq)
+	}
+	require.Len(t, shardSeqs, 16)
+	for _, seq := range shardSeqs {
+		require.EqualValues(t, 3, seq)
+	}
+}
+
+func TestTraceChNeverBlocks(t *testing.T) {
+	defer func(size int) { DefaultTraceBufferSize = size }(DefaultTraceBufferSize)
+	DefaultTraceBufferSize = 2
+
+	blocked := make(chan Trace) // never read.
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		TraceCh:       blocked,
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+	defer dagst.Close()
+
+	// registering shards must not block on the trace channel; it's writing at
+	// most one trace and buffers two, and the rest are dropped.
+	registerShards(t, dagst, 4, carv2mnt, RegisterOpts{})
+	require.Eventually(t, func() bool {
+		stats, err := dagst.Stats(context.Background())
+		return err == nil && stats.DroppedTraces >= 9
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestOTLPTraceSink(t *testing.T) {
+	reqs := make(chan otlpLogsRequest, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpLogsRequest
+		if r.URL.Path != "/v1/logs" || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reqs <- req
+	}))
+	defer srv.Close()
+
+	sink := NewOTLPTraceSink(srv.URL+"/v1/logs", "test", nil)
+	err := sink.WriteTrace(context.Background(), Trace{
+		Key:      shard.KeyFromString("foo"),
+		Op:       OpShardFail,
+		After:    ShardInfo{ShardState: ShardStateErrored, Error: errors.New("boom")},
+		Seq:      7,
+		ShardSeq: 3,
+	})
+	require.NoError(t, err)
+
+	req := <-reqs
+	require.Len(t, req.ResourceLogs, 1)
+	require.Equal(t, "service.name", req.ResourceLogs[0].Resource.Attributes[0].Key)
+	require.Equal(t, "test", *req.ResourceLogs[0].Resource.Attributes[0].Value.StringValue)
+	rec := req.ResourceLogs[0].ScopeLogs[0].LogRecords[0]
+	require.Equal(t, "OpShardFail", *rec.Body.StringValue)
+	require.Equal(t, "ERROR", rec.SeverityText)
+	attrs := make(map[string]otlpAnyValue)
+	for _, kv := range rec.Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	require.Equal(t, "foo", *attrs["dagstore.shard.key"].StringValue)
+	require.Equal(t, "ShardStateErrored", *attrs["dagstore.shard.state"].StringValue)
+	require.Equal(t, "7", *attrs["dagstore.seq"].IntValue)
+	require.Equal(t, "boom", *attrs["dagstore.error"].StringValue)
+
+	// collector errors are reported.
+	sink = NewOTLPTraceSink(srv.URL+"/wrong", "test", nil)
+	err = sink.WriteTrace(context.Background(), Trace{Key: shard.KeyFromString("foo")})
+	require.Error(t, err)
+}
+
+func TestSyncWrappers(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+	defer dagst.Close()
+
+	ctx := context.Background()
+	k := shard.KeyFromString("foo")
+	err = dagst.RegisterShardSync(ctx, k, carv2mnt, RegisterOpts{})
+	require.NoError(t, err)
+
+	// registering it again fails synchronously.
+	err = dagst.RegisterShardSync(ctx, k, carv2mnt, RegisterOpts{})
+	require.ErrorIs(t, err, ErrShardExists)
+
+	acc, err := dagst.AcquireShardSync(ctx, k, AcquireOpts{})
+	require.NoError(t, err)
+	require.NotNil(t, acc)
+	require.NoError(t, acc.Close())
+
+	_, err = dagst.AcquireShardSync(ctx, shard.KeyFromString("bar"), AcquireOpts{})
+	require.ErrorIs(t, err, ErrShardUnknown)
+
+	// recovering a shard that isn't errored fails with the result error.
+	err = dagst.RecoverShardSync(ctx, k, RecoverOpts{})
+	require.Error(t, err)
+
+	// an acquire given up on releases its accessor once it's delivered.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = dagst.AcquireShardSync(cctx, k, AcquireOpts{})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Eventually(t, func() bool {
+		info, err := dagst.GetShardInfo(k)
+		return err == nil && info.ShardState == ShardStateAvailable
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// a future can be waited on several times.
+	f := NewFuture(k)
+	err = dagst.AcquireShard(ctx, k, f.Out(), AcquireOpts{})
+	require.NoError(t, err)
+	res1, err := f.Wait(ctx)
+	require.NoError(t, err)
+	res2, err := f.Wait(ctx)
+	require.NoError(t, err)
+	require.Same(t, res1.Accessor, res2.Accessor)
+	require.NoError(t, res1.Accessor.Close())
+}
+
+func TestPersistInvertedIndex(t *testing.T) {
+	ctx := context.Background()
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	idx, err := index.NewFSRepo(t.TempDir())
+	require.NoError(t, err)
+	dir := t.TempDir()
+
+	start := func(persist bool) *DAGStore {
+		dagst, err := NewDAGStore(Config{
+			MountRegistry:        testRegistry(t),
+			TransientsDir:        dir,
+			Datastore:            store,
+			IndexRepo:            idx,
+			PersistInvertedIndex: persist,
+		})
+		require.NoError(t, err)
+		err = dagst.Start(ctx)
+		require.NoError(t, err)
+		return dagst
+	}
+
+	// register a shard with an in-memory inverted index.
+	foo, bar := shard.KeyFromString("foo"), shard.KeyFromString("bar")
+	dagst := start(false)
+	err = dagst.RegisterShardSync(ctx, foo, carv2mnt, RegisterOpts{})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Close())
+
+	// the shard is backfilled into the persisted inverted index on start.
+	dagst = start(true)
+	require.Eventually(t, func() bool {
+		keys, err := dagst.ShardsContainingCid(ctx, testdata.RootCID)
+		return err == nil && len(keys) == 1 && keys[0] == foo
+	}, 5*time.Second, 10*time.Millisecond)
+	err = dagst.RegisterShardSync(ctx, bar, carv2mnt, RegisterOpts{})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Close())
+
+	// both shards survive the restart; CIDs resolve by multihash.
+	dagst = start(true)
+	defer dagst.Close()
+	v1 := cid.NewCidV1(testdata.RootCID.Prefix().Codec, testdata.RootCID.Hash())
+	for _, c := range []cid.Cid{testdata.RootCID, v1} {
+		keys, err := dagst.ShardsContainingCid(ctx, c)
+		require.NoError(t, err)
+		require.ElementsMatch(t, []shard.Key{foo, bar}, keys)
+	}
+
+	// destroyed shards are removed from the persisted inverted index.
+	res := make(chan ShardResult, 1)
+	err = dagst.DestroyShard(ctx, foo, res, DestroyOpts{})
+	require.NoError(t, err)
+	require.NoError(t, (<-res).Error)
+	keys, err := dagst.ShardsContainingCid(ctx, testdata.RootCID)
+	require.NoError(t, err)
+	require.Equal(t, []shard.Key{bar}, keys)
+
+	// a non-batching datastore can't persist the inverted index.
+	_, err = NewDAGStore(Config{
+		MountRegistry:        testRegistry(t),
+		TransientsDir:        dir,
+		Datastore:            struct{ datastore.Datastore }{store},
+		PersistInvertedIndex: true,
+	})
+	require.Error(t, err)
+}
+
+func TestTransientsLayout(t *testing.T) {
+	ctx := context.Background()
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	idx, err := index.NewFSRepo(t.TempDir())
+	require.NoError(t, err)
+	dir := t.TempDir()
+
+	start := func(layout shard.Layout) *DAGStore {
+		dagst, err := NewDAGStore(Config{
+			MountRegistry:    testRegistry(t),
+			TransientsDir:    dir,
+			TransientsLayout: layout,
+			Datastore:        store,
+			IndexRepo:        idx,
+		})
+		require.NoError(t, err)
+		err = dagst.Start(ctx)
+		require.NoError(t, err)
+		return dagst
+	}
+	transientPath := func(dagst *DAGStore, k shard.Key) string {
+		dagst.lk.RLock()
+		defer dagst.lk.RUnlock()
+		return dagst.shards[k].mount.TransientPath()
+	}
+
+	// register a shard with the flat layout.
+	foo, bar := shard.KeyFromString("foo"), shard.KeyFromString("bar")
+	dagst := start(shard.LayoutFlat)
+	err = dagst.RegisterShardSync(ctx, foo, carv2mnt, RegisterOpts{})
+	require.NoError(t, err)
+	require.Equal(t, dir, filepath.Dir(transientPath(dagst, foo)))
+	require.NoError(t, dagst.Close())
+
+	// its transient is migrated on start with the sharded layout, and new
+	// transients are created with it.
+	dagst = start(shard.LayoutSharded)
+	path := transientPath(dagst, foo)
+	require.Equal(t, shard.LayoutSharded.Dir(dir, foo), filepath.Dir(path))
+	_, err = os.Stat(path)
+	require.NoError(t, err)
+	err = dagst.RegisterShardSync(ctx, bar, carv2mnt, RegisterOpts{})
+	require.NoError(t, err)
+	require.Equal(t, shard.LayoutSharded.Dir(dir, bar), filepath.Dir(transientPath(dagst, bar)))
+	require.NoError(t, dagst.Close())
+
+	// the migrated path was persisted, and the transient is used as is.
+	dagst = start(shard.LayoutSharded)
+	defer dagst.Close()
+	require.Equal(t, path, transientPath(dagst, foo))
+	for _, k := range []shard.Key{foo, bar} {
+		acc, err := dagst.AcquireShardSync(ctx, k, AcquireOpts{})
+		require.NoError(t, err)
+		require.NoError(t, acc.Close())
+	}
+	// the transients were used; nothing was fetched again.
+	require.Zero(t, dagst.shards[foo].mount.TimesFetched())
+	require.Zero(t, dagst.shards[bar].mount.TimesFetched())
+}
+
+func TestAcquireLease(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+	defer dagst.Close()
+
+	ctx := context.Background()
+	k := shard.KeyFromString("foo")
+	err = dagst.RegisterShardSync(ctx, k, carv2mnt, RegisterOpts{})
+	require.NoError(t, err)
+
+	refs := func() uint32 {
+		info, err := dagst.GetShardInfo(k)
+		require.NoError(t, err)
+		return info.refs
+	}
+
+	// a leaked accessor is force-released when its lease expires.
+	acc, err := dagst.AcquireShardSync(ctx, k, AcquireOpts{Lease: 50 * time.Millisecond})
+	require.NoError(t, err)
+	require.EqualValues(t, 1, refs())
+	bs, err := acc.Blockstore()
+	require.NoError(t, err)
+	kctx, cancel := context.WithCancel(ctx)
+	keys, err := bs.AllKeysChan(kctx)
+	require.NoError(t, err)
+	c := <-keys
+	cancel()
+	require.Eventually(t, func() bool { return refs() == 0 }, 5*time.Second, 10*time.Millisecond)
+	_, err = acc.Blockstore()
+	require.ErrorIs(t, err, ErrLeaseExpired)
+	// the data is only freed once the accessor is closed, as readers may
+	// still be reading it.
+	_, err = bs.Get(ctx, c)
+	require.NoError(t, err)
+	require.ErrorIs(t, acc.Extend(time.Second), ErrLeaseExpired)
+	require.ErrorIs(t, acc.Close(), ErrLeaseExpired)
+	require.EqualValues(t, 0, refs())
+
+	// an extended lease keeps the accessor valid until it's closed, once.
+	acc, err = dagst.AcquireShardSync(ctx, k, AcquireOpts{Lease: 50 * time.Millisecond})
+	require.NoError(t, err)
+	require.NoError(t, acc.Extend(time.Minute))
+	time.Sleep(200 * time.Millisecond)
+	require.EqualValues(t, 1, refs())
+	_, err = acc.Blockstore()
+	require.NoError(t, err)
+	require.NoError(t, acc.Close())
+	require.NoError(t, acc.Close())
+	require.Eventually(t, func() bool { return refs() == 0 }, 5*time.Second, 10*time.Millisecond)
+
+	// accessors without a lease can't be extended.
+	acc, err = dagst.AcquireShardSync(ctx, k, AcquireOpts{})
+	require.NoError(t, err)
+	require.Error(t, acc.Extend(time.Second))
+	require.NoError(t, acc.Close())
+}
+
+func TestShardCids(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	err = dagst.Start(context.Background())
+	require.NoError(t, err)
+	defer dagst.Close()
+
+	ctx := context.Background()
+	k := shard.KeyFromString("foo")
+	err = dagst.RegisterShardSync(ctx, k, carv2mnt, RegisterOpts{})
+	require.NoError(t, err)
+
+	collect := func(ch <-chan cid.Cid) (ret []string) {
+		for c := range ch {
+			ret = append(ret, string(c.Hash()))
+		}
+		return ret
+	}
+
+	// the CIDs listed from the index match the keys of the blockstore, except
+	// for identity CIDs, which aren't indexed.
+	ch, err := dagst.ShardCids(ctx, k)
+	require.NoError(t, err)
+	listed := collect(ch)
+	require.NotEmpty(t, listed)
+
+	acc, err := dagst.AcquireShardSync(ctx, k, AcquireOpts{})
+	require.NoError(t, err)
+	bs, err := acc.Blockstore()
+	require.NoError(t, err)
+	ch, err = bs.AllKeysChan(ctx)
+	require.NoError(t, err)
+	var keys []string
+	for c := range ch {
+		if c.Prefix().MhType != multihash.IDENTITY {
+			keys = append(keys, string(c.Hash()))
+		}
+	}
+	require.ElementsMatch(t, keys, listed)
+
+	ch, err = acc.Cids(ctx)
+	require.NoError(t, err)
+	require.ElementsMatch(t, listed, collect(ch))
+	require.NoError(t, acc.Close())
+
+	// restricted accessors only list the blocks they expose.
+	acc, err = dagst.AcquireShardSync(ctx, k, AcquireOpts{CIDs: []cid.Cid{testdata.RootCID}})
+	require.NoError(t, err)
+	ch, err = acc.Cids(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{string(testdata.RootCID.Hash())}, collect(ch))
+	require.NoError(t, acc.Close())
+
+	// cancelling the context stops the stream.
+	cctx, cancel := context.WithCancel(ctx)
+	ch, err = dagst.ShardCids(cctx, k)
+	require.NoError(t, err)
+	<-ch
+	cancel()
+	require.Less(t, len(collect(ch)), len(listed))
+
+	_, err = dagst.ShardCids(ctx, shard.KeyFromString("bar"))
+	require.ErrorIs(t, err, ErrShardUnknown)
+}
+
+func TestTwoPhaseDestroy(t *testing.T) {
+	ctx := context.Background()
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	dir := t.TempDir()
+	start := func() *DAGStore {
+		dagst, err := NewDAGStore(Config{
+			MountRegistry: testRegistry(t),
+			TransientsDir: dir,
+			Datastore:     store,
+		})
+		require.NoError(t, err)
+		err = dagst.Start(ctx)
+		require.NoError(t, err)
+		return dagst
+	}
+	state := func(dagst *DAGStore, k shard.Key) ShardState {
+		info, err := dagst.GetShardInfo(k)
+		if errors.Is(err, ErrShardUnknown) {
+			return ShardStateUnknown
+		}
+		require.NoError(t, err)
+		return info.ShardState
+	}
+	persisted := func(k shard.Key) bool {
+		has, err := store.Has(ctx, StoreNamespace.Child(datastore.NewKey(k.String())))
+		require.NoError(t, err)
+		return has
+	}
+
+	dagst := start()
+	foo, bar, baz := shard.KeyFromString("foo"), shard.KeyFromString("bar"), shard.KeyFromString("baz")
+	for _, k := range []shard.Key{foo, bar, baz} {
+		require.NoError(t, dagst.RegisterShardSync(ctx, k, carv2mnt, RegisterOpts{}))
+	}
+
+	// the shard is tombstoned until its references drain.
+	acc, err := dagst.AcquireShardSync(ctx, foo, AcquireOpts{})
+	require.NoError(t, err)
+	transient := dagst.shards[foo].mount.TransientPath()
+	ch := make(chan ShardResult, 1)
+	err = dagst.DestroyShard(ctx, foo, ch, DestroyOpts{DrainTimeout: time.Minute})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return state(dagst, foo) == ShardStateTombstoned }, 5*time.Second, 10*time.Millisecond)
+	_, err = dagst.AcquireShardSync(ctx, foo, AcquireOpts{})
+	require.ErrorIs(t, err, ErrShardTombstoned)
+	require.Empty(t, ch)
+
+	require.NoError(t, acc.Close())
+	res := <-ch
+	require.NoError(t, res.Error)
+	require.Equal(t, ShardStateUnknown, state(dagst, foo))
+	require.False(t, persisted(foo))
+	_, err = os.Stat(transient)
+	require.True(t, os.IsNotExist(err))
+	istat, err := dagst.indices.StatFullIndex(foo)
+	require.NoError(t, err)
+	require.False(t, istat.Exists)
+
+	// the shard is destroyed when the deadline passes, and releasing the
+	// leftover reference afterwards doesn't resurrect it.
+	acc, err = dagst.AcquireShardSync(ctx, bar, AcquireOpts{})
+	require.NoError(t, err)
+	err = dagst.DestroyShard(ctx, bar, ch, DestroyOpts{DrainTimeout: 50 * time.Millisecond})
+	require.NoError(t, err)
+	res = <-ch
+	require.NoError(t, res.Error)
+	require.Equal(t, ShardStateUnknown, state(dagst, bar))
+	require.NoError(t, acc.Close())
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, ShardStateUnknown, state(dagst, bar))
+	require.False(t, persisted(bar))
+
+	// a tombstone survives a restart, and the destroy is resumed on start.
+	_, err = dagst.AcquireShardSync(ctx, baz, AcquireOpts{})
+	require.NoError(t, err)
+	err = dagst.DestroyShard(ctx, baz, ch, DestroyOpts{DrainTimeout: time.Minute})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return state(dagst, baz) == ShardStateTombstoned }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, dagst.Close())
+	require.True(t, persisted(baz))
+
+	dagst = start()
+	defer dagst.Close()
+	require.Eventually(t, func() bool { return state(dagst, baz) == ShardStateUnknown }, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool { return !persisted(baz) }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestOpHooks(t *testing.T) {
+	ctx := context.Background()
+	protected, blocked, junk := shard.KeyFromString("protected"), shard.KeyFromString("blocked"), shard.KeyFromString("junk")
+
+	var lk sync.Mutex
+	failures := make(map[shard.Key]int)
+	var afterVeto []OpType
+	hook := OpHookFuncs{
+		Before: func(op OpType, key shard.Key, before ShardInfo) error {
+			switch {
+			case op == OpShardDestroy && key == protected:
+				return errors.New("shard is protected")
+			case op == OpShardAcquire && key == blocked:
+				return errors.New("shard is blocked")
+			case op == OpShardRecover && key == junk:
+				require.Equal(t, ShardStateErrored, before.ShardState)
+				return errors.New("junk is beyond repair")
+			case op == OpShardMakeAvailable:
+				return errors.New("not vetoable") // ignored.
+			}
+			return nil
+		},
+		After: func(op OpType, key shard.Key, after ShardInfo, err error) {
+			lk.Lock()
+			defer lk.Unlock()
+			if op == OpShardFail {
+				require.Error(t, err)
+				require.Equal(t, ShardStateErrored, after.ShardState)
+				failures[key]++
+			}
+			if errors.Is(err, ErrOpVetoed) {
+				afterVeto = append(afterVeto, op)
+			}
+		},
+	}
+
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		Datastore:     dssync.MutexWrap(datastore.NewMapDatastore()),
+		OpHooks:       []OpHook{hook},
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+	defer dagst.Close()
+
+	require.NoError(t, dagst.RegisterShardSync(ctx, protected, carv2mnt, RegisterOpts{}))
+	require.NoError(t, dagst.RegisterShardSync(ctx, blocked, carv2mnt, RegisterOpts{}))
+	require.Error(t, dagst.RegisterShardSync(ctx, junk, junkmnt, RegisterOpts{}))
+
+	// vetoed destroys leave the shard alone.
+	ch := make(chan ShardResult, 1)
+	require.NoError(t, dagst.DestroyShard(ctx, protected, ch, DestroyOpts{}))
+	res := <-ch
+	require.ErrorIs(t, res.Error, ErrOpVetoed)
+	require.Contains(t, res.Error.Error(), "shard is protected")
+	info, err := dagst.GetShardInfo(protected)
+	require.NoError(t, err)
+	require.Equal(t, ShardStateAvailable, info.ShardState)
+
+	// vetoed acquires fail, other shards are unaffected.
+	_, err = dagst.AcquireShardSync(ctx, blocked, AcquireOpts{})
+	require.ErrorIs(t, err, ErrOpVetoed)
+	acc, err := dagst.AcquireShardSync(ctx, protected, AcquireOpts{})
+	require.NoError(t, err)
+	require.NoError(t, acc.Close())
+
+	// vetoed recoveries leave the shard errored.
+	err = dagst.RecoverShardSync(ctx, junk, RecoverOpts{})
+	require.ErrorIs(t, err, ErrOpVetoed)
+	info, err = dagst.GetShardInfo(junk)
+	require.NoError(t, err)
+	require.Equal(t, ShardStateErrored, info.ShardState)
+
+	// unvetoed destroys go through.
+	require.NoError(t, dagst.DestroyShard(ctx, blocked, ch, DestroyOpts{}))
+	res = <-ch
+	require.NoError(t, res.Error)
+
+	lk.Lock()
+	defer lk.Unlock()
+	require.Equal(t, map[shard.Key]int{junk: 1}, failures)
+	require.ElementsMatch(t, []OpType{OpShardDestroy, OpShardAcquire, OpShardRecover}, afterVeto)
+}
+
+func TestAcquireStats(t *testing.T) {
+	ctx := context.Background()
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	dir := t.TempDir()
+	start := func() *DAGStore {
+		dagst, err := NewDAGStore(Config{
+			MountRegistry: testRegistry(t),
+			TransientsDir: dir,
+			Datastore:     store,
+		})
+		require.NoError(t, err)
+		require.NoError(t, dagst.Start(ctx))
+		return dagst
+	}
+
+	dagst := start()
+	hot, warm, cold := shard.KeyFromString("hot"), shard.KeyFromString("warm"), shard.KeyFromString("cold")
+	for _, k := range []shard.Key{hot, warm, cold} {
+		require.NoError(t, dagst.RegisterShardSync(ctx, k, carv2mnt, RegisterOpts{}))
+	}
+
+	acquire := func(k shard.Key) int {
+		acc, err := dagst.AcquireShardSync(ctx, k, AcquireOpts{})
+		require.NoError(t, err)
+		defer acc.Close()
+		bs, err := acc.Blockstore()
+		require.NoError(t, err)
+		blk, err := bs.Get(ctx, testdata.RootCID)
+		require.NoError(t, err)
+		return len(blk.RawData())
+	}
+	before := time.Now()
+	var served int
+	for i := 0; i < 3; i++ {
+		served += acquire(hot)
+	}
+	acquire(warm)
+
+	info, err := dagst.GetShardInfo(hot)
+	require.NoError(t, err)
+	require.EqualValues(t, 3, info.AcquireCount)
+	require.EqualValues(t, served, info.BytesServed)
+	require.False(t, info.LastAcquiredAt.Before(before))
+	info, err = dagst.GetShardInfo(cold)
+	require.NoError(t, err)
+	require.Zero(t, info.AcquireCount)
+	require.True(t, info.LastAcquiredAt.IsZero())
+
+	// statistics survive restarts.
+	require.Eventually(t, func() bool {
+		info, err := dagst.GetShardInfo(hot)
+		return err == nil && info.ShardState == ShardStateAvailable
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, dagst.Close())
+	dagst = start()
+	defer dagst.Close()
+	info, err = dagst.GetShardInfo(hot)
+	require.NoError(t, err)
+	require.EqualValues(t, 3, info.AcquireCount)
+	require.EqualValues(t, served, info.BytesServed)
+
+	// GC evicts the coldest shards until the transients fit in the target.
+	res, err := dagst.GCDryRun(ctx)
+	require.NoError(t, err)
+	size := res.Report[hot].TransientSize
+	require.NotZero(t, size)
+
+	res, err = dagst.GCToTarget(ctx, size)
+	require.NoError(t, err)
+	require.Equal(t, 2, res.Reclaimed)
+	require.Contains(t, res.Shards, cold)
+	require.Contains(t, res.Shards, warm)
+	require.NotContains(t, res.Shards, hot)
+	require.False(t, res.Report[hot].Reclaimable)
+	require.Equal(t, GCSkipWithinTarget, res.Report[hot].SkipReason)
+	require.NotEmpty(t, dagst.shards[hot].mount.TransientPath())
+}
+
+func TestTxn(t *testing.T) {
+	ctx := context.Background()
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	dir := t.TempDir()
+	start := func() *DAGStore {
+		dagst, err := NewDAGStore(Config{
+			MountRegistry: testRegistry(t),
+			TransientsDir: dir,
+			Datastore:     store,
+		})
+		require.NoError(t, err)
+		require.NoError(t, dagst.Start(ctx))
+		return dagst
+	}
+	state := func(dagst *DAGStore, k shard.Key) ShardState {
+		info, err := dagst.GetShardInfo(k)
+		if errors.Is(err, ErrShardUnknown) {
+			return ShardStateUnknown
+		}
+		require.NoError(t, err)
+		return info.ShardState
+	}
+	persisted := func(k shard.Key) bool {
+		has, err := store.Has(ctx, StoreNamespace.Child(datastore.NewKey(k.String())))
+		require.NoError(t, err)
+		return has
+	}
+
+	dagst := start()
+	a, b, c, x := shard.KeyFromString("a"), shard.KeyFromString("b"), shard.KeyFromString("c"), shard.KeyFromString("x")
+
+	// registrations are applied together.
+	cha, chb := make(chan ShardResult, 1), make(chan ShardResult, 1)
+	err := dagst.Txn(ctx, func(tx *ShardTxn) error {
+		require.NoError(t, tx.RegisterShard(a, carv2mnt, cha, RegisterOpts{}))
+		require.Error(t, tx.DestroyShard(a, nil, DestroyOpts{})) // already staged.
+		return tx.RegisterShard(b, carv2mnt, chb, RegisterOpts{})
+	})
+	require.NoError(t, err)
+	require.NoError(t, (<-cha).Error)
+	require.NoError(t, (<-chb).Error)
+	require.True(t, persisted(a))
+	require.True(t, persisted(b))
+
+	// nothing is applied if the callback fails, or if any operation is
+	// invalid.
+	err = dagst.Txn(ctx, func(tx *ShardTxn) error {
+		require.NoError(t, tx.DestroyShard(a, nil, DestroyOpts{}))
+		return errors.New("changed my mind")
+	})
+	require.EqualError(t, err, "changed my mind")
+
+	err = dagst.Txn(ctx, func(tx *ShardTxn) error {
+		require.NoError(t, tx.RegisterShard(x, carv2mnt, nil, RegisterOpts{}))
+		require.NoError(t, tx.DestroyShard(a, nil, DestroyOpts{}))
+		return tx.RegisterShard(b, carv2mnt, nil, RegisterOpts{})
+	})
+	require.ErrorIs(t, err, ErrShardExists)
+
+	acc, err := dagst.AcquireShardSync(ctx, b, AcquireOpts{})
+	require.NoError(t, err)
+	err = dagst.Txn(ctx, func(tx *ShardTxn) error {
+		require.NoError(t, tx.RegisterShard(x, carv2mnt, nil, RegisterOpts{}))
+		require.NoError(t, tx.DestroyShard(a, nil, DestroyOpts{}))
+		return tx.DestroyShard(b, nil, DestroyOpts{})
+	})
+	require.Error(t, err)
+	require.NoError(t, acc.Close())
+
+	require.Equal(t, ShardStateAvailable, state(dagst, a))
+	require.Eventually(t, func() bool { return state(dagst, b) == ShardStateAvailable }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, ShardStateUnknown, state(dagst, x))
+	require.False(t, persisted(x))
+
+	// destroys and registrations are applied together.
+	cha, chb = make(chan ShardResult, 1), make(chan ShardResult, 1)
+	chc := make(chan ShardResult, 1)
+	err = dagst.Txn(ctx, func(tx *ShardTxn) error {
+		require.NoError(t, tx.DestroyShard(a, cha, DestroyOpts{}))
+		require.NoError(t, tx.DestroyShard(b, chb, DestroyOpts{}))
+		return tx.RegisterShard(c, carv2mnt, chc, RegisterOpts{})
+	})
+	require.NoError(t, err)
+	require.NoError(t, (<-cha).Error)
+	require.NoError(t, (<-chb).Error)
+	require.NoError(t, (<-chc).Error)
+	require.Equal(t, ShardStateUnknown, state(dagst, a))
+	require.Equal(t, ShardStateUnknown, state(dagst, b))
+	require.Equal(t, ShardStateAvailable, state(dagst, c))
+	require.Eventually(t, func() bool { return !persisted(a) && !persisted(b) }, 5*time.Second, 10*time.Millisecond)
+
+	// transactions interrupted by a restart are resumed.
+	err = dagst.Txn(ctx, func(tx *ShardTxn) error {
+		require.NoError(t, tx.DestroyShard(c, nil, DestroyOpts{}))
+		return tx.RegisterShard(x, carv2mnt, nil, RegisterOpts{})
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Close())
+
+	dagst = start()
+	defer dagst.Close()
+	require.Eventually(t, func() bool { return state(dagst, c) == ShardStateUnknown }, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool { return state(dagst, x) == ShardStateAvailable }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestTxnPaused(t *testing.T) {
+	ctx := context.Background()
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	var (
+		lk     sync.Mutex
+		traces []Trace
+	)
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		Datastore:     store,
+		TraceSinks: []TraceSinkOpts{{Sink: TraceFunc(func(tr Trace) {
+			lk.Lock()
+			traces = append(traces, tr)
+			lk.Unlock()
+		})}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+	defer dagst.Close()
+
+	k := shard.KeyFromString("foo")
+	require.NoError(t, dagst.RegisterShardSync(ctx, k, carv2mnt, RegisterOpts{}))
+
+	// destroys queue up while paused, although their tombstone is persisted
+	// right away.
+	require.NoError(t, dagst.Pause(ctx))
+	ch := make(chan ShardResult, 1)
+	err = dagst.Txn(ctx, func(tx *ShardTxn) error {
+		return tx.DestroyShard(k, ch, DestroyOpts{})
+	})
+	require.NoError(t, err)
+	select {
+	case res := <-ch:
+		t.Fatalf("expected no ShardResult while paused, got: %+v", res)
+	case <-time.After(200 * time.Millisecond):
+	}
+	info, err := dagst.GetShardInfo(k)
+	require.NoError(t, err)
+	require.Equal(t, ShardStateAvailable, info.ShardState)
+	v, err := store.Get(ctx, StoreNamespace.Child(datastore.NewKey(k.String())))
+	require.NoError(t, err)
+	var ps PersistedShard
+	require.NoError(t, json.Unmarshal(v, &ps))
+	require.Equal(t, ShardStateTombstoned, ps.State)
+
+	// upon resume, the shard is tombstoned through the event loop, and then
+	// destroyed.
+	require.NoError(t, dagst.Resume(ctx))
+	require.NoError(t, (<-ch).Error)
+	_, err = dagst.GetShardInfo(k)
+	require.ErrorIs(t, err, ErrShardUnknown)
+	require.Eventually(t, func() bool {
+		lk.Lock()
+		defer lk.Unlock()
+		for _, tr := range traces {
+			if tr.Key == k && tr.Op == OpShardDestroy && tr.After.ShardState == ShardStateTombstoned {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestFetchProgress(t *testing.T) {
+	var (
+		lk       sync.Mutex
+		progress []FetchProgress
+	)
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:         testRegistry(t),
+		TransientsDir:         t.TempDir(),
+		FetchProgressInterval: time.Nanosecond,
+		TraceSinks: []TraceSinkOpts{{Sink: TraceFunc(func(tr Trace) {
+			if tr.Op != OpShardFetchProgress {
+				return
+			}
+			require.NotNil(t, tr.Progress)
+			lk.Lock()
+			progress = append(progress, *tr.Progress)
+			lk.Unlock()
+		})}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+	defer dagst.Close()
+
+	registerShards(t, dagst, 1, carv2mnt, RegisterOpts{})
+
+	// the fetch of the transient reports its progress, up to completion.
+	require.Eventually(t, func() bool {
+		lk.Lock()
+		defer lk.Unlock()
+		return len(progress) > 0 && progress[len(progress)-1].Done()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	lk.Lock()
+	defer lk.Unlock()
+	require.Greater(t, len(progress), 1)
+	for i := 1; i < len(progress); i++ {
+		require.Greater(t, progress[i].Transferred, progress[i-1].Transferred)
+	}
+	require.EqualValues(t, len(testdata.CarV2), progress[len(progress)-1].Total)
+}
+
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	idx, err := index.NewFSRepo(t.TempDir())
+	require.NoError(t, err)
+
+	start := func(readOnly bool) *DAGStore {
+		dagst, err := NewDAGStore(Config{
+			MountRegistry: testRegistry(t),
+			TransientsDir: t.TempDir(),
+			Datastore:     store,
+			IndexRepo:     idx,
+			ReadOnly:      readOnly,
+		})
+		require.NoError(t, err)
+		err = dagst.Start(ctx)
+		require.NoError(t, err)
+		return dagst
+	}
+
+	// the writer registers a shard.
+	foo, bar := shard.KeyFromString("foo"), shard.KeyFromString("bar")
+	writer := start(false)
+	require.NoError(t, writer.RegisterShardSync(ctx, foo, carv2mnt, RegisterOpts{}))
+	require.NoError(t, writer.Close())
+
+	dskey := StoreNamespace.Child(datastore.NewKey(foo.String()))
+	persisted, err := store.Get(ctx, dskey)
+	require.NoError(t, err)
+
+	// the replica rejects mutations.
+	replica := start(true)
+	defer replica.Close()
+	require.True(t, replica.ReadOnly())
+
+	err = replica.RegisterShard(ctx, bar, carv2mnt, nil, RegisterOpts{})
+	require.ErrorIs(t, err, ErrReadOnly)
+	err = replica.DestroyShard(ctx, foo, nil, DestroyOpts{})
+	require.ErrorIs(t, err, ErrReadOnly)
+	err = replica.RecoverShard(ctx, foo, nil, RecoverOpts{})
+	require.ErrorIs(t, err, ErrReadOnly)
+	err = replica.Txn(ctx, func(tx *ShardTxn) error {
+		return tx.RegisterShard(bar, carv2mnt, nil, RegisterOpts{})
+	})
+	require.ErrorIs(t, err, ErrReadOnly)
+
+	// but serves acquires, without touching the persisted state.
+	acc, err := replica.AcquireShardSync(ctx, foo, AcquireOpts{})
+	require.NoError(t, err)
+	bs, err := acc.Blockstore()
+	require.NoError(t, err)
+	has, err := bs.Has(ctx, testdata.RootCID)
+	require.NoError(t, err)
+	require.True(t, has)
+	require.NoError(t, acc.Close())
+
+	info, err := replica.GetShardInfo(foo)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, info.AcquireCount)
+
+	after, err := store.Get(ctx, dskey)
+	require.NoError(t, err)
+	require.Equal(t, persisted, after)
+
+	// GC leaves the transients to the writer.
+	res, err := replica.GC(ctx)
+	require.NoError(t, err)
+	require.Zero(t, res.Reclaimed)
+	require.Equal(t, GCSkipReadOnly, res.Report[foo].SkipReason)
+	require.NotEmpty(t, replica.shards[foo].mount.TransientPath())
+
+	// shards registered by the writer later are picked up on refresh.
+	writer = start(false)
+	require.NoError(t, writer.RegisterShardSync(ctx, bar, carv2mnt, RegisterOpts{}))
+	require.NoError(t, writer.Close())
+
+	_, err = replica.GetShardInfo(bar)
+	require.ErrorIs(t, err, ErrShardUnknown)
+	added, err := replica.Refresh(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []shard.Key{bar}, added)
+	added, err = replica.Refresh(ctx)
+	require.NoError(t, err)
+	require.Empty(t, added)
+
+	acc, err = replica.AcquireShardSync(ctx, bar, AcquireOpts{})
+	require.NoError(t, err)
+	require.NoError(t, acc.Close())
+}
+
+func TestShardLimits(t *testing.T) {
+	ctx := context.Background()
+	register := func(cfg Config) error {
+		cfg.MountRegistry = testRegistry(t)
+		cfg.TransientsDir = t.TempDir()
+		dagst, err := NewDAGStore(cfg)
+		require.NoError(t, err)
+		require.NoError(t, dagst.Start(ctx))
+		defer dagst.Close()
+		return dagst.RegisterShardSync(ctx, shard.KeyFromString("foo"), carv2mnt, RegisterOpts{})
+	}
+
+	// generous limits.
+	err := register(Config{MaxShardSize: 1 << 30, MaxShardBlocks: 1 << 20, MaxBlockSize: 1 << 20})
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		cfg   Config
+		limit ShardLimit
+	}{
+		{Config{MaxShardSize: 1024}, LimitShardSize},
+		{Config{MaxShardBlocks: 10}, LimitShardBlocks},
+		{Config{MaxBlockSize: 16}, LimitBlockSize},
+	} {
+		err := register(tc.cfg)
+		var lerr *ShardLimitError
+		require.ErrorAs(t, err, &lerr, tc.limit.String())
+		require.Equal(t, tc.limit, lerr.Limit)
+		require.Greater(t, lerr.Actual, lerr.Max)
+	}
+}
+
+func TestExpiryProvider(t *testing.T) {
+	ctx := context.Background()
+	dealEnd := shard.KeyFromString("deal-end")
+	inGrace := shard.KeyFromString("in-grace")
+	ttl := shard.KeyFromString("ttl")
+
+	provider := ExpiryProviderFunc(func(_ context.Context, k shard.Key) (time.Time, error) {
+		switch k {
+		case dealEnd:
+			return time.Now().Add(-2 * time.Hour), nil
+		case inGrace:
+			return time.Now().Add(-30 * time.Minute), nil
+		default:
+			// defer to the TTL.
+			return time.Time{}, nil
+		}
+	})
+
+	var lk sync.Mutex
+	var expired []shard.Key
+	start := func(action ExpiryAction) *DAGStore {
+		dagst, err := NewDAGStore(Config{
+			MountRegistry:       testRegistry(t),
+			TransientsDir:       t.TempDir(),
+			ExpirySweepInterval: time.Hour, // swept manually.
+			ExpiryProvider:      provider,
+			ExpiryGracePeriod:   time.Hour,
+			ExpiryAction:        action,
+			TraceSinks: []TraceSinkOpts{{Sink: TraceFunc(func(tr Trace) {
+				if tr.Op == OpShardExpire {
+					lk.Lock()
+					expired = append(expired, tr.Key)
+					lk.Unlock()
+				}
+			})}},
+		})
+		require.NoError(t, err)
+		require.NoError(t, dagst.Start(ctx))
+
+		for k, opts := range map[shard.Key]RegisterOpts{dealEnd: {}, inGrace: {}, ttl: {TTL: time.Nanosecond}} {
+			require.NoError(t, dagst.RegisterShardSync(ctx, k, carv2mnt, opts))
+		}
+		return dagst
+	}
+	tracedExpiries := func() []shard.Key {
+		lk.Lock()
+		defer lk.Unlock()
+		ret := expired
+		expired = nil
+		return ret
+	}
+
+	// shards past their expiry and grace period are destroyed; those within
+	// the grace period are kept. The TTL applies when the provider doesn't
+	// know the expiry.
+	dagst := start(ExpiryDestroy)
+	time.Sleep(10 * time.Millisecond)
+	swept := dagst.SweepExpired()
+	require.ElementsMatch(t, []shard.Key{dealEnd}, swept)
+	require.Eventually(t, func() bool {
+		_, err := dagst.GetShardInfo(dealEnd)
+		return errors.Is(err, ErrShardUnknown)
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err := dagst.GetShardInfo(inGrace)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return len(tracedExpiries()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, dagst.Close())
+
+	// archived shards stay registered, but lose their transients.
+	dagst = start(ExpiryArchive)
+	swept = dagst.SweepExpired()
+	require.ElementsMatch(t, []shard.Key{dealEnd}, swept)
+	info, err := dagst.GetShardInfo(dealEnd)
+	require.NoError(t, err)
+	require.Equal(t, ShardStateAvailable, info.ShardState)
+	require.Equal(t, TierCold, info.Tier)
+	require.Eventually(t, func() bool {
+		keys := tracedExpiries()
+		return len(keys) == 1 && keys[0] == dealEnd
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// archived shards are not archived again, and can still be acquired.
+	require.Empty(t, dagst.SweepExpired())
+	acc, err := dagst.AcquireShardSync(ctx, dealEnd, AcquireOpts{})
+	require.NoError(t, err)
+	require.NoError(t, acc.Close())
+	require.NoError(t, dagst.Close())
+}
+
+func TestDispatchWorkers(t *testing.T) {
+	ctx := context.Background()
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:   testRegistry(t),
+		TransientsDir:   t.TempDir(),
+		DispatchWorkers: 2,
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+	defer dagst.Close()
+
+	keys := registerShards(t, dagst, 2, carv2mnt, RegisterOpts{})
+
+	// an acquirer that never receives its result ties up a single worker.
+	stalledCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stalled := make(chan ShardResult)
+	require.NoError(t, dagst.AcquireShard(stalledCtx, keys[0], stalled, AcquireOpts{}))
+	require.Eventually(t, func() bool {
+		return dagst.DispatchStats().Busy == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// other results are still delivered.
+	acc, err := dagst.AcquireShardSync(ctx, keys[1], AcquireOpts{})
+	require.NoError(t, err)
+	require.NoError(t, acc.Close())
+
+	// once the stalled acquirer gives up, its result is abandoned.
+	cancel()
+	require.Eventually(t, func() bool {
+		stats := dagst.DispatchStats()
+		return stats.Busy == 0 && stats.Abandoned == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	stats := dagst.DispatchStats()
+	require.Equal(t, 2, stats.Workers)
+	require.Equal(t, DefaultDispatchQueueSize, stats.Capacity)
+	require.Zero(t, stats.Backlog)
+	require.GreaterOrEqual(t, stats.Delivered, uint64(3)) // two registrations and an acquire.
+}
+
+func TestDumpStateMachine(t *testing.T) {
+	ctx := context.Background()
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+	defer dagst.Close()
+
+	keys := registerShards(t, dagst, 3, carv2mnt, RegisterOpts{})
+	acc, err := dagst.AcquireShardSync(ctx, keys[0], AcquireOpts{})
+	require.NoError(t, err)
+	defer acc.Close()
+
+	var buf bytes.Buffer
+	require.NoError(t, dagst.DumpStateMachine(&buf, StateMachineDOT))
+	dot := buf.String()
+	require.True(t, strings.HasPrefix(dot, "digraph shard_states {"))
+	require.Contains(t, dot, `"ShardStateAvailable" [label="Available (2)"];`)
+	require.Contains(t, dot, `"ShardStateServing" [label="Serving (1)"];`)
+	require.Contains(t, dot, `"ShardStateServing" -> "ShardStateAvailable" [label="OpShardRelease"];`)
+	require.Contains(t, dot, `"ShardStateTombstoned" -> "destroyed" [label="OpShardDestroyFinalize"];`)
+
+	buf.Reset()
+	require.NoError(t, dagst.DumpStateMachine(&buf, StateMachineJSON))
+	var sm stateMachineJSON
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &sm))
+	counts := make(map[string]int)
+	for _, st := range sm.States {
+		counts[st.State] = st.Count
+	}
+	require.Equal(t, map[string]int{
+		"ShardStateNew":          0,
+		"ShardStateInitializing": 0,
+		"ShardStateAvailable":    2,
+		"ShardStateServing":      1,
+		"ShardStateRecovering":   0,
+		"ShardStateErrored":      0,
+		"ShardStateArchived":     0,
+		"ShardStateTombstoned":   0,
+	}, counts)
+	require.Contains(t, sm.Transitions, stateTransitionJSON{From: "ShardStateErrored", Op: "OpShardRecover", To: "ShardStateRecovering"})
+
+	require.Error(t, dagst.DumpStateMachine(&buf, StateMachineFormat(42)))
+}
+
+func TestDetachedIndex(t *testing.T) {
+	ctx := context.Background()
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+	defer dagst.Close()
+
+	full, err := car.ReadOrGenerateIndex(bytes.NewReader(testdata.CarV2), car.ZeroLengthSectionAsEOF(true), car.StoreIdentityCIDs(true))
+	require.NoError(t, err)
+
+	// find the first section, and a block past it.
+	var (
+		first, other     multihash.Multihash
+		firstOff, maxOff uint64
+	)
+	err = full.(carindex.IterableIndex).ForEach(func(mh multihash.Multihash, off uint64) error {
+		if first == nil || off < firstOff {
+			first, firstOff = mh, off
+		}
+		if off > maxOff {
+			other, maxOff = mh, off
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	encode := func(records ...carindex.Record) []byte {
+		idx := carindex.NewMultihashSorted()
+		require.NoError(t, idx.Load(records))
+		var buf bytes.Buffer
+		_, err := carindex.WriteTo(idx, &buf)
+		require.NoError(t, err)
+		return buf.Bytes()
+	}
+	// the root is the first block of the sample CAR.
+	require.Equal(t, testdata.RootCID.Hash(), first)
+	root := carindex.Record{Cid: testdata.RootCID, Offset: firstOff}
+
+	// a partial index proves that the supplied index is used as-is.
+	partial := encode(root)
+	k := shard.KeyFromString("partial")
+	require.NoError(t, dagst.RegisterShardSync(ctx, k, carv2mnt, RegisterOpts{DetachedIndex: partial}))
+	acc, err := dagst.AcquireShardSync(ctx, k, AcquireOpts{})
+	require.NoError(t, err)
+	bs, err := acc.Blockstore()
+	require.NoError(t, err)
+	has, err := bs.Has(ctx, testdata.RootCID)
+	require.NoError(t, err)
+	require.True(t, has)
+	has, err = bs.Has(ctx, cid.NewCidV1(cid.Raw, other))
+	require.NoError(t, err)
+	require.False(t, has)
+	require.NoError(t, acc.Close())
+
+	// a full index, from a file.
+	var buf bytes.Buffer
+	_, err = carindex.WriteTo(full, &buf)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "sample.idx")
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0644))
+	require.NoError(t, dagst.RegisterShardSync(ctx, shard.KeyFromString("file"), carv2mnt, RegisterOpts{DetachedIndexPath: path}))
+
+	// undecodable indexes are rejected at registration.
+	err = dagst.RegisterShardSync(ctx, shard.KeyFromString("junk"), carv2mnt, RegisterOpts{DetachedIndex: []byte("junk")})
+	require.ErrorIs(t, err, ErrInvalidDetachedIndex)
+
+	// indexes that don't match the CAR fail initialization.
+	for name, idx := range map[string][]byte{
+		"shifted":     encode(carindex.Record{Cid: testdata.RootCID, Offset: firstOff + 1}),
+		"wrong-block": encode(carindex.Record{Cid: cid.NewCidV1(cid.Raw, other), Offset: firstOff}),
+		"overflow":    encode(root, carindex.Record{Cid: cid.NewCidV1(cid.Raw, other), Offset: 1 << 40}),
+	} {
+		err := dagst.RegisterShardSync(ctx, shard.KeyFromString(name), carv2mnt, RegisterOpts{DetachedIndex: idx})
+		require.ErrorIs(t, err, ErrInvalidDetachedIndex, name)
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	ctx := context.Background()
+	unblock := make(chan struct{}) // the hook blocks the event loop until closed.
+	hook := OpHookFuncs{Before: func(OpType, shard.Key, ShardInfo) error {
+		<-unblock
+		return nil
+	}}
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:   testRegistry(t),
+		TransientsDir:   t.TempDir(),
+		OpHooks:         []OpHook{hook},
+		WatchdogTimeout: 100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+	defer dagst.Close()
+
+	h := dagst.Health()
+	require.True(t, h.Healthy)
+	require.Len(t, h.Loops, 1)
+
+	ch := make(chan ShardResult, 2)
+	for _, k := range []string{"foo", "bar"} {
+		require.NoError(t, dagst.RegisterShard(ctx, shard.KeyFromString(k), carv2mnt, ch, RegisterOpts{LazyInitialization: true}))
+	}
+	require.Eventually(t, func() bool {
+		return !dagst.Health().Healthy
+	}, 5*time.Second, 10*time.Millisecond)
+	h = dagst.Health()
+	require.True(t, h.Loops[0].Stalled)
+	require.Positive(t, h.Loops[0].Queued)
+	require.False(t, h.Loops[0].StalledSince.IsZero())
+
+	// unblocking the hook unblocks the event loop.
+	close(unblock)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, (<-ch).Error)
+	}
+	require.Eventually(t, func() bool {
+		return dagst.Health().Healthy
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NotZero(t, dagst.Health().Loops[0].Processed)
+}
+
+func TestArchiveShard(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		Archive:       &DirArchive{Dir: dir},
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+	defer dagst.Close()
+
+	k := shard.KeyFromString("foo")
+	mnt := &mount.Counting{Mount: carv2mnt}
+	require.NoError(t, dagst.RegisterShardSync(ctx, k, mnt, RegisterOpts{}))
+	require.EqualValues(t, 1, mnt.Count())
+
+	require.NoError(t, dagst.ArchiveShard(ctx, k))
+	info, err := dagst.GetShardInfo(k)
+	require.NoError(t, err)
+	require.Equal(t, ShardStateArchived, info.ShardState)
+	require.Empty(t, dagst.shards[k].mount.TransientPath())
+	istat, err := dagst.indices.StatFullIndex(k)
+	require.NoError(t, err)
+	require.False(t, istat.Exists)
+	for _, name := range []string{"foo.car", "foo.idx"} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		require.NoError(t, err)
+	}
+
+	// archived shards are no longer discoverable.
+	_, err = dagst.ShardsContainingMultihash(ctx, testdata.RootCID.Hash())
+	require.Error(t, err)
+
+	// archived shards can't be acquired, nor archived again.
+	_, err = dagst.AcquireShardSync(ctx, k, AcquireOpts{})
+	require.ErrorIs(t, err, ErrShardArchived)
+	require.Error(t, dagst.ArchiveShard(ctx, k))
+
+	// unarchiving restores the transient from the archive, without fetching
+	// from the mount.
+	require.NoError(t, dagst.UnarchiveShard(ctx, k))
+	info, err = dagst.GetShardInfo(k)
+	require.NoError(t, err)
+	require.Equal(t, ShardStateAvailable, info.ShardState)
+	require.Error(t, dagst.UnarchiveShard(ctx, k))
+	keys, err := dagst.ShardsContainingMultihash(ctx, testdata.RootCID.Hash())
+	require.NoError(t, err)
+	require.Equal(t, []shard.Key{k}, keys)
+
+	acc, err := dagst.AcquireShardSync(ctx, k, AcquireOpts{})
+	require.NoError(t, err)
+	bs, err := acc.Blockstore()
+	require.NoError(t, err)
+	has, err := bs.Has(ctx, testdata.RootCID)
+	require.NoError(t, err)
+	require.True(t, has)
+	require.NoError(t, acc.Close())
+	require.EqualValues(t, 1, mnt.Count())
+
+	// archiving requires an archive.
+	dagst2, err := NewDAGStore(Config{MountRegistry: testRegistry(t), TransientsDir: t.TempDir()})
+	require.NoError(t, err)
+	require.ErrorIs(t, dagst2.ArchiveShard(ctx, k), ErrNoArchive)
+}
+
+func TestBlockAccessCallback(t *testing.T) {
+	ctx := context.Background()
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+	defer dagst.Close()
+
+	k := shard.KeyFromString("foo")
+	require.NoError(t, dagst.RegisterShardSync(ctx, k, carv2mnt, RegisterOpts{}))
+
+	type access struct {
+		key  shard.Key
+		c    cid.Cid
+		size int
+	}
+	var accesses []access
+	acc, err := dagst.AcquireShardSync(ctx, k, AcquireOpts{
+		OnBlockAccess: func(key shard.Key, c cid.Cid, size int, latency time.Duration) {
+			require.GreaterOrEqual(t, latency, time.Duration(0))
+			accesses = append(accesses, access{key, c, size})
+		},
+	})
+	require.NoError(t, err)
+	defer acc.Close()
+	bs, err := acc.Blockstore()
+	require.NoError(t, err)
+
+	// Has doesn't read the block.
+	_, err = bs.Has(ctx, testdata.RootCID)
+	require.NoError(t, err)
+	require.Empty(t, accesses)
+
+	blk, err := bs.Get(ctx, testdata.RootCID)
+	require.NoError(t, err)
+	require.NoError(t, bs.View(ctx, testdata.RootCID, func([]byte) error { return nil }))
+	want := access{k, testdata.RootCID, len(blk.RawData())}
+	require.Equal(t, []access{want, want}, accesses)
+
+	// failed reads aren't reported.
+	missing, err := multihash.Sum([]byte("missing"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	_, err = bs.Get(ctx, cid.NewCidV1(cid.Raw, missing))
+	require.Error(t, err)
+	require.Len(t, accesses, 2)
+}
+
+func TestParallelIndexGeneration(t *testing.T) {
+	expected, err := car.GenerateIndex(bytes.NewReader(testdata.CarV1), car.ZeroLengthSectionAsEOF(true), car.StoreIdentityCIDs(true))
+	require.NoError(t, err)
+	want, err := indexEntries(expected)
+	require.NoError(t, err)
+
+	defer func(size int64) { indexChunkSize = size }(indexChunkSize)
+
+	// chunk boundaries falling anywhere within sections must not alter the
+	// result.
+	r := bytes.NewReader(testdata.CarV1)
+	for _, chunk := range []int64{97, 512, 1000, 4096, 10007, 65536} {
+		indexChunkSize = chunk
+		for _, workers := range []int{2, 3, 8, 64} {
+			records, err := scanSectionsParallel(r, int64(len(testdata.CarV1)), workers)
+			require.NoError(t, err)
+			idx := carindex.NewMultihashSorted()
+			require.NoError(t, idx.Load(records))
+			got, err := indexEntries(idx)
+			require.NoError(t, err)
+			require.Equal(t, want, got, "chunk %d, workers %d", chunk, workers)
+		}
+	}
+
+	// end to end.
+	indexChunkSize = 4096
+	ctx := context.Background()
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		IndexWorkers:  4,
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+	defer dagst.Close()
+
+	k := shard.KeyFromString("foo")
+	mnt := &mount.FSMount{FS: testdata.FS, Path: testdata.FSPathCarV1}
+	require.NoError(t, dagst.RegisterShardSync(ctx, k, mnt, RegisterOpts{}))
+	idx, err := dagst.GetIterableIndex(k)
+	require.NoError(t, err)
+	got, err := indexEntries(idx)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+}
+
+func TestInstanceLock(t *testing.T) {
+	ctx := context.Background()
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+
+	newStore := func(id string, takeOver bool) *DAGStore {
+		dagst, err := NewDAGStore(Config{
+			MountRegistry:   testRegistry(t),
+			TransientsDir:   t.TempDir(),
+			Datastore:       store,
+			InstanceLockTTL: 90 * time.Millisecond,
+			InstanceID:      id,
+			TakeOverLock:    takeOver,
+		})
+		require.NoError(t, err)
+		return dagst
+	}
+
+	first := newStore("first", false)
+	require.NoError(t, first.Start(ctx))
+	foo := shard.KeyFromString("foo")
+	require.NoError(t, first.RegisterShardSync(ctx, foo, carv2mnt, RegisterOpts{}))
+
+	// a second writer refuses to start, even past the TTL, since the lease is
+	// being renewed.
+	time.Sleep(150 * time.Millisecond)
+	second := newStore("second", false)
+	err := second.Start(ctx)
+	require.ErrorIs(t, err, ErrLocked)
+	require.NoError(t, second.Close())
+
+	// read-only instances don't need the lease.
+	replica, err := NewDAGStore(Config{
+		MountRegistry:   testRegistry(t),
+		TransientsDir:   t.TempDir(),
+		Datastore:       store,
+		InstanceLockTTL: 90 * time.Millisecond,
+		ReadOnly:        true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, replica.Start(ctx))
+	require.NoError(t, replica.Close())
+
+	// an explicit takeover fences the first instance.
+	second = newStore("second", true)
+	require.NoError(t, second.Start(ctx))
+	require.Eventually(t, first.isFenced, 5*time.Second, 10*time.Millisecond)
+	bar := shard.KeyFromString("bar")
+	err = first.RegisterShard(ctx, bar, carv2mnt, nil, RegisterOpts{})
+	require.ErrorIs(t, err, ErrLockLost)
+	err = first.RecoverAll(ctx, 1, nil)
+	require.ErrorIs(t, err, ErrLockLost)
+
+	// closing the fenced instance leaves the lease of the second in place.
+	require.NoError(t, first.Close())
+	third := newStore("third", false)
+	err = third.Start(ctx)
+	require.ErrorIs(t, err, ErrLocked)
+	require.NoError(t, third.Close())
+
+	// the lease is released on close.
+	require.NoError(t, second.RegisterShardSync(ctx, bar, carv2mnt, RegisterOpts{}))
+	require.NoError(t, second.Close())
+	third = newStore("third", false)
+	require.NoError(t, third.Start(ctx))
+	defer third.Close()
+	require.Len(t, third.AllShardsInfo(), 2)
+}
+
+func TestAcquireFromReplica(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "replica.car")
+	require.NoError(t, os.WriteFile(path, testdata.CarV2, 0644))
+
+	var resolved int32
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		Datastore:     dssync.MutexWrap(datastore.NewMapDatastore()),
+		ReplicaResolver: ReplicaResolverFunc(func(ctx context.Context, key shard.Key) (mount.Mount, error) {
+			atomic.AddInt32(&resolved, 1)
+			if key.String() == "orphan" {
+				return nil, nil
+			}
+			return &mount.FileMount{Path: path}, nil
+		}),
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+	defer dagst.Close()
+
+	// healthy shards are served locally.
+	foo := shard.KeyFromString("foo")
+	require.NoError(t, dagst.RegisterShardSync(ctx, foo, carv2mnt, RegisterOpts{}))
+	sa, err := dagst.AcquireShardSync(ctx, foo, AcquireOpts{})
+	require.NoError(t, err)
+	require.False(t, sa.Replica())
+	require.NoError(t, sa.Close())
+	require.EqualValues(t, 0, atomic.LoadInt32(&resolved))
+
+	// errored shards are served from their replica.
+	bad, err := multihash.Sum([]byte("junk"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	for _, k := range []string{"bar", "orphan"} {
+		err = dagst.RegisterShardSync(ctx, shard.KeyFromString(k), carv2mnt, RegisterOpts{Checksum: bad})
+		require.ErrorIs(t, err, ErrChecksumMismatch)
+	}
+
+	bar := shard.KeyFromString("bar")
+	sa, err = dagst.AcquireShardSync(ctx, bar, AcquireOpts{})
+	require.NoError(t, err)
+	require.True(t, sa.Replica())
+	bs, err := sa.Blockstore()
+	require.NoError(t, err)
+	has, err := bs.Has(ctx, testdata.RootCID)
+	require.NoError(t, err)
+	require.True(t, has)
+	require.NoError(t, sa.Close())
+
+	// the local shard recovers in the background; here it fails again, and
+	// holds no reference from the replica accessor.
+	require.Eventually(t, func() bool {
+		info, err := dagst.GetShardInfo(bar)
+		return err == nil && info.ShardState == ShardStateErrored && info.refs == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// acquires fail if there's no replica.
+	_, err = dagst.AcquireShardSync(ctx, shard.KeyFromString("orphan"), AcquireOpts{})
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+	require.Contains(t, err.Error(), "no replica found")
+}
+
+func TestRecentTraces(t *testing.T) {
+	ctx := context.Background()
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	idx, err := index.NewFSRepo(t.TempDir())
+	require.NoError(t, err)
+	config := Config{
+		MountRegistry:       testRegistry(t),
+		TransientsDir:       t.TempDir(),
+		Datastore:           store,
+		IndexRepo:           idx,
+		RecentTracesSize:    4,
+		PersistRecentTraces: true,
+	}
+	dagst, err := NewDAGStore(config)
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+
+	foo, bar := shard.KeyFromString("foo"), shard.KeyFromString("bar")
+	require.NoError(t, dagst.RegisterShardSync(ctx, foo, carv2mnt, RegisterOpts{}))
+	require.NoError(t, dagst.RegisterShardSync(ctx, bar, carv2mnt, RegisterOpts{}))
+	sa, err := dagst.AcquireShardSync(ctx, foo, AcquireOpts{})
+	require.NoError(t, err)
+	require.NoError(t, sa.Close())
+
+	// only the last 4 traces are kept, in order.
+	var all []Trace
+	require.Eventually(t, func() bool {
+		all = dagst.RecentTraces(TraceFilter{})
+		return len(all) == 4 && all[3].Op == OpShardRelease
+	}, 5*time.Second, 10*time.Millisecond)
+	for i := 1; i < len(all); i++ {
+		require.Equal(t, all[i-1].Seq+1, all[i].Seq)
+	}
+
+	traces := dagst.RecentTraces(TraceFilter{Keys: []shard.Key{foo}})
+	require.Len(t, traces, 2)
+	require.Equal(t, OpShardAcquire, traces[0].Op)
+	traces = dagst.RecentTraces(TraceFilter{Ops: []OpType{OpShardMakeAvailable}})
+	require.Len(t, traces, 1)
+	require.Equal(t, bar, traces[0].Key)
+	traces = dagst.RecentTraces(TraceFilter{AfterSeq: all[1].Seq})
+	require.Equal(t, all[2:], traces)
+	traces = dagst.RecentTraces(TraceFilter{Limit: 1})
+	require.Equal(t, all[3:], traces)
+	require.Empty(t, dagst.RecentTraces(TraceFilter{ErrorsOnly: true}))
+
+	// traces survive restarts, and their sequence resumes after them.
+	require.NoError(t, dagst.Close())
+	dagst, err = NewDAGStore(config)
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+	defer dagst.Close()
+
+	traces = dagst.RecentTraces(TraceFilter{})
+	require.Len(t, traces, 4)
+	for i := range traces {
+		require.Equal(t, all[i].Seq, traces[i].Seq)
+		require.Equal(t, all[i].Op, traces[i].Op)
+		require.Equal(t, all[i].Key, traces[i].Key)
+		require.Equal(t, all[i].After.ShardState, traces[i].After.ShardState)
+	}
+	sa, err = dagst.AcquireShardSync(ctx, bar, AcquireOpts{})
+	require.NoError(t, err)
+	require.NoError(t, sa.Close())
+	require.Eventually(t, func() bool {
+		return len(dagst.RecentTraces(TraceFilter{AfterSeq: all[3].Seq})) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestIdleReclaim(t *testing.T) {
+	ctx := context.Background()
+	idle := make(chan shard.Key, 16)
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:      testRegistry(t),
+		TransientsDir:      t.TempDir(),
+		Datastore:          dssync.MutexWrap(datastore.NewMapDatastore()),
+		OnShardIdle:        func(key shard.Key) { idle <- key },
+		IdleReclaimTimeout: 50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+	defer dagst.Close()
+
+	transient := func(k shard.Key) string {
+		dagst.lk.RLock()
+		defer dagst.lk.RUnlock()
+		return dagst.shards[k].mount.TransientPath()
+	}
+
+	foo, bar := shard.KeyFromString("foo"), shard.KeyFromString("bar")
+	for _, k := range []shard.Key{foo, bar} {
+		require.NoError(t, dagst.RegisterShardSync(ctx, k, carv2mnt, RegisterOpts{}))
+	}
+	foosa, err := dagst.AcquireShardSync(ctx, foo, AcquireOpts{})
+	require.NoError(t, err)
+	barsa, err := dagst.AcquireShardSync(ctx, bar, AcquireOpts{})
+	require.NoError(t, err)
+	require.NotEmpty(t, transient(foo))
+	require.NotEmpty(t, transient(bar))
+
+	// the transient of the idle shard is reclaimed after the timeout.
+	require.NoError(t, foosa.Close())
+	require.Equal(t, foo, <-idle)
+	require.Eventually(t, func() bool { return transient(foo) == "" }, 5*time.Second, 10*time.Millisecond)
+
+	// the transient of the shard in use is kept.
+	time.Sleep(100 * time.Millisecond)
+	require.NotEmpty(t, transient(bar))
+	require.Empty(t, idle)
+
+	// acquiring the shard again disarms the timer.
+	require.NoError(t, barsa.Close())
+	require.Equal(t, bar, <-idle)
+	barsa, err = dagst.AcquireShardSync(ctx, bar, AcquireOpts{})
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	require.NotEmpty(t, transient(bar))
+	require.NoError(t, barsa.Close())
+	require.Equal(t, bar, <-idle)
+	require.Eventually(t, func() bool { return transient(bar) == "" }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestStats(t *testing.T) {
+	ctx := context.Background()
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		Datastore:     dssync.MutexWrap(datastore.NewMapDatastore()),
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+	defer dagst.Close()
+
+	stats, err := dagst.Stats(ctx)
+	require.NoError(t, err)
+	require.Empty(t, stats.Shards)
+	require.Zero(t, stats.DatastoreRecords)
+
+	foo, bar := shard.KeyFromString("foo"), shard.KeyFromString("bar")
+	require.NoError(t, dagst.RegisterShardSync(ctx, foo, carv2mnt, RegisterOpts{}))
+	require.NoError(t, dagst.RegisterShardSync(ctx, bar, carv2mnt, RegisterOpts{}))
+	sa, err := dagst.AcquireShardSync(ctx, foo, AcquireOpts{})
+	require.NoError(t, err)
+
+	// count the entries of the index of the shards.
+	idx, err := dagst.indices.GetFullIndex(foo)
+	require.NoError(t, err)
+	var blocks uint64
+	require.NoError(t, idx.(carindex.IterableIndex).ForEach(func(multihash.Multihash, uint64) error {
+		blocks++
+		return nil
+	}))
+
+	stats, err = dagst.Stats(ctx)
+	require.NoError(t, err)
+	require.Equal(t, map[ShardState]int{ShardStateServing: 1, ShardStateAvailable: 1}, stats.Shards)
+	require.Equal(t, 2*blocks, stats.IndexedBlocks)
+	require.Equal(t, 2*int64(len(testdata.CarV2)), stats.TransientBytes)
+	require.Equal(t, 2, stats.DatastoreRecords)
+	require.Zero(t, stats.GC.Runs)
+
+	// the transient of the available shard is reclaimed.
+	require.NoError(t, sa.Close())
+	require.Eventually(t, func() bool {
+		info, err := dagst.GetShardInfo(foo)
+		return err == nil && info.ShardState == ShardStateAvailable
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err = dagst.GC(ctx)
+	require.NoError(t, err)
+
+	stats, err = dagst.Stats(ctx)
+	require.NoError(t, err)
+	require.Equal(t, map[ShardState]int{ShardStateAvailable: 2}, stats.Shards)
+	require.Zero(t, stats.TransientBytes)
+	require.EqualValues(t, 1, stats.GC.Runs)
+	require.EqualValues(t, 2, stats.GC.Reclaimed)
+	require.Equal(t, 2*int64(len(testdata.CarV2)), stats.GC.ReclaimedBytes)
+	require.False(t, stats.GC.LastRun.IsZero())
+
+	// tasks queued while paused are pending.
+	require.NoError(t, dagst.Pause(ctx))
+	out := make(chan ShardResult, 2)
+	require.NoError(t, dagst.AcquireShard(ctx, foo, out, AcquireOpts{}))
+	require.NoError(t, dagst.AcquireShard(ctx, bar, out, AcquireOpts{}))
+	stats, err = dagst.Stats(ctx)
+	require.NoError(t, err)
+	require.Equal(t, map[OpType]int{OpShardAcquire: 2}, stats.PendingOps)
+	require.NoError(t, dagst.Resume(ctx))
+	for i := 0; i < 2; i++ {
+		res := <-out
+		require.NoError(t, res.Error)
+		require.NoError(t, res.Accessor.Close())
+	}
+}
+
+func TestShardFailures(t *testing.T) {
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	config := Config{
+		MountRegistry:    testRegistry(t),
+		TransientsDir:    t.TempDir(),
+		Datastore:        store,
+		ErrorHistorySize: 2,
+	}
+	dagst, err := NewDAGStore(config)
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+
+	k := shard.KeyFromString("bad")
+	ch := make(chan ShardResult, 1)
+	require.NoError(t, dagst.RegisterShard(context.Background(), k, junkmnt, ch, RegisterOpts{}))
+	require.Error(t, (<-ch).Error)
+
+	info, err := dagst.GetShardInfo(k)
+	require.NoError(t, err)
+	require.Len(t, info.Failures, 1)
+	f := info.Failures[0]
+	require.Equal(t, OpShardInitialize, f.Op)
+	require.False(t, f.At.IsZero())
+	require.Equal(t, info.Error.Error(), f.Chain[0])
+	require.Greater(t, len(f.Chain), 1) // the causes are unwrapped.
+
+	// failures are kept across recoveries, up to ErrorHistorySize.
+	for i := 0; i < 2; i++ {
+		require.NoError(t, dagst.RecoverShard(context.Background(), k, ch, RecoverOpts{}))
+		require.Error(t, (<-ch).Error)
+	}
+	info, err = dagst.GetShardInfo(k)
+	require.NoError(t, err)
+	require.Len(t, info.Failures, 2)
+	for _, f := range info.Failures {
+		require.Equal(t, OpShardRecover, f.Op)
+	}
+	require.False(t, info.Failures[1].At.Before(info.Failures[0].At))
+
+	// and survive restarts.
+	require.NoError(t, dagst.Close())
+	dagst, err = NewDAGStore(config)
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+	defer dagst.Close()
+
+	restored, err := dagst.GetShardInfo(k)
+	require.NoError(t, err)
+	require.Len(t, restored.Failures, 2)
+	for i, f := range restored.Failures {
+		require.Equal(t, info.Failures[i].Op, f.Op)
+		require.Equal(t, info.Failures[i].Chain, f.Chain)
+		require.True(t, info.Failures[i].At.Equal(f.At))
+	}
+}
+
+func TestSkipTopLevelIndex(t *testing.T) {
+	ctx := context.Background()
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	idx, err := index.NewFSRepo(t.TempDir())
+	require.NoError(t, err)
+	config := Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		Datastore:     store,
+		IndexRepo:     idx,
+	}
+	dagst, err := NewDAGStore(config)
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+
+	public := shard.KeyFromString("public")
+	private := shard.KeyFromString("private")
+	ch := make(chan ShardResult, 1)
+	require.NoError(t, dagst.RegisterShard(ctx, public, carv2mnt, ch, RegisterOpts{}))
+	require.NoError(t, (<-ch).Error)
+	// the private shard is initialized on its first acquire.
+	require.NoError(t, dagst.RegisterShard(ctx, private, carv2mnt, ch, RegisterOpts{SkipTopLevelIndex: true, LazyInitialization: true}))
+	require.NoError(t, (<-ch).Error)
+	accs := acquireShard(t, dagst, private, 1)
+	releaseAll(t, dagst, private, accs)
+
+	check := func(dagst *DAGStore, expected ...shard.Key) {
+		keys, err := dagst.ShardsContainingMultihash(ctx, testdata.RootCID.Hash())
+		require.NoError(t, err)
+		require.ElementsMatch(t, expected, keys)
+	}
+	check(dagst, public)
+
+	// clones of the private shard are private too.
+	clone := shard.KeyFromString("clone")
+	require.NoError(t, dagst.CloneShard(ctx, private, clone, carv2mnt, ch, CloneOpts{}))
+	require.NoError(t, (<-ch).Error)
+	check(dagst, public)
+
+	// the flag is persisted, and respected when backfilling the index on
+	// restart.
+	require.NoError(t, dagst.Close())
+	config.TopLevelIndex = index.NewInverted(dssync.MutexWrap(datastore.NewMapDatastore()))
+	dagst, err = NewDAGStore(config)
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+	defer dagst.Close()
+	require.Eventually(t, func() bool {
+		keys, err := dagst.ShardsContainingMultihash(ctx, testdata.RootCID.Hash())
+		return err == nil && len(keys) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	check(dagst, public)
+	for _, k := range []shard.Key{private, clone} {
+		dagst.lk.RLock()
+		require.True(t, dagst.shards[k].skipTopLevel)
+		dagst.lk.RUnlock()
+	}
+}
+
+func TestRestoreConcurrency(t *testing.T) {
+	ctx := context.Background()
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	config := Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		Datastore:     store,
+		HistorySize:   4,
+	}
+	dagst, err := NewDAGStore(config)
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+
+	const n = 64
+	ch := make(chan ShardResult, n)
+	for i := 0; i < n; i++ {
+		k := shard.KeyFromString(fmt.Sprintf("shard-%d", i))
+		require.NoError(t, dagst.RegisterShard(ctx, k, carv2mnt, ch, RegisterOpts{LazyInitialization: i%2 == 0}))
+	}
+	for i := 0; i < n; i++ {
+		require.NoError(t, (<-ch).Error)
+	}
+	before := dagst.AllShardsInfo()
+	require.NoError(t, dagst.Close())
+
+	// shards are hydrated concurrently on restart.
+	config.RestoreConcurrency = 4
+	dagst, err = NewDAGStore(config)
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+	defer dagst.Close()
+
+	after := dagst.AllShardsInfo()
+	require.Len(t, after, n)
+	for k, info := range before {
+		require.Equal(t, info.ShardState, after[k].ShardState, k)
+		if info.ShardState == ShardStateNew {
+			continue // lazy shards have no transitions yet.
+		}
+		h, err := dagst.ShardHistory(k)
+		require.NoError(t, err)
+		require.NotEmpty(t, h)
+	}
+}
+
+func TestAcquireCallers(t *testing.T) {
+	ctx := context.Background()
+	sink := tracer(128)
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:      testRegistry(t),
+		TransientsDir:      t.TempDir(),
+		Datastore:          dssync.MutexWrap(datastore.NewMapDatastore()),
+		TraceCh:            sink,
+		MaxCallersPerShard: 2,
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+	defer dagst.Close()
+
+	k := shard.KeyFromString("foo")
+	require.NoError(t, dagst.RegisterShardSync(ctx, k, carv2mnt, RegisterOpts{}))
+
+	acquire := func(caller string) int {
+		acc, err := dagst.AcquireShardSync(ctx, k, AcquireOpts{Caller: caller})
+		require.NoError(t, err)
+		defer acc.Close()
+		bs, err := acc.Blockstore()
+		require.NoError(t, err)
+		blk, err := bs.Get(ctx, testdata.RootCID)
+		require.NoError(t, err)
+		return len(blk.RawData())
+	}
+	served := acquire("peer-a")
+	served += acquire("peer-a")
+	acquire("peer-b")
+	acquire("")
+
+	info, err := dagst.GetShardInfo(k)
+	require.NoError(t, err)
+	require.EqualValues(t, 4, info.AcquireCount)
+	require.Len(t, info.Callers, 2)
+	require.EqualValues(t, 2, info.Callers["peer-a"].Acquires)
+	require.EqualValues(t, served, info.Callers["peer-a"].BytesServed)
+	require.EqualValues(t, 1, info.Callers["peer-b"].Acquires)
+	require.False(t, info.Callers["peer-b"].LastAcquiredAt.Before(info.Callers["peer-a"].LastAcquiredAt))
+
+	// the caller that acquired the shard least recently is dropped once the
+	// limit is reached.
+	acquire("peer-c")
+	info, err = dagst.GetShardInfo(k)
+	require.NoError(t, err)
+	require.Len(t, info.Callers, 2)
+	require.NotContains(t, info.Callers, "peer-a")
+	require.Contains(t, info.Callers, "peer-b")
+	require.Contains(t, info.Callers, "peer-c")
+
+	// acquire traces carry the caller.
+	traces := make([]Trace, 128)
+	n, _ := sink.Read(traces, 1*time.Second)
+	var callers []string
+	for _, tr := range traces[:n] {
+		if tr.Op == OpShardAcquire {
+			callers = append(callers, tr.Caller)
+		} else {
+			require.Empty(t, tr.Caller)
+		}
+	}
+	require.Equal(t, []string{"peer-a", "peer-a", "peer-b", "", "peer-c"}, callers)
+}
+
+func TestSweepIndices(t *testing.T) {
+	ctx := context.Background()
+	idx, err := index.NewFSRepo(t.TempDir())
+	require.NoError(t, err)
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		Datastore:     dssync.MutexWrap(datastore.NewMapDatastore()),
+		IndexRepo:     idx,
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+	defer dagst.Close()
+
+	kept := shard.KeyFromString("kept")
+	require.NoError(t, dagst.RegisterShardSync(ctx, kept, carv2mnt, RegisterOpts{}))
+
+	// orphan an index, as a failed destroy would.
+	orphan := shard.KeyFromString("orphan")
+	full, err := idx.GetFullIndex(kept)
+	require.NoError(t, err)
+	require.NoError(t, idx.AddFullIndex(orphan, full))
+	st, err := idx.StatFullIndex(orphan)
+	require.NoError(t, err)
+
+	res, err := dagst.SweepIndices(ctx, IndexSweepOpts{DryRun: true})
+	require.NoError(t, err)
+	require.True(t, res.DryRun)
+	require.Equal(t, map[shard.Key]error{orphan: nil}, res.Orphans)
+	require.Equal(t, st.Size, res.ReclaimedBytes)
+	st, err = idx.StatFullIndex(orphan)
+	require.NoError(t, err)
+	require.True(t, st.Exists)
+
+	// the orphaned index is moved to the quarantine directory.
+	quarantine := filepath.Join(t.TempDir(), "quarantine")
+	res, err = dagst.SweepIndices(ctx, IndexSweepOpts{QuarantineDir: quarantine})
+	require.NoError(t, err)
+	require.False(t, res.DryRun)
+	require.Equal(t, map[shard.Key]error{orphan: nil}, res.Orphans)
+	require.Equal(t, st.Size, res.ReclaimedBytes)
+
+	st, err = idx.StatFullIndex(orphan)
+	require.NoError(t, err)
+	require.False(t, st.Exists)
+	st, err = idx.StatFullIndex(kept)
+	require.NoError(t, err)
+	require.True(t, st.Exists)
+
+	f, err := os.Open(filepath.Join(quarantine, orphan.String()+".full.idx"))
+	require.NoError(t, err)
+	defer f.Close()
+	quarantined, err := carindex.ReadFrom(f)
+	require.NoError(t, err)
+	_, err = carindex.GetFirst(quarantined, testdata.RootCID)
+	require.NoError(t, err)
+
+	// nothing is left to sweep.
+	res, err = dagst.SweepIndices(ctx, IndexSweepOpts{})
+	require.NoError(t, err)
+	require.Empty(t, res.Orphans)
+
+	// shards can't be registered while their orphaned index is being removed.
+	dagst.lk.Lock()
+	dagst.sweeping[orphan] = struct{}{}
+	dagst.lk.Unlock()
+	err = dagst.RegisterShard(ctx, orphan, carv2mnt, make(chan ShardResult, 1), RegisterOpts{})
+	require.ErrorIs(t, err, ErrIndexSweeping)
+
+	dagst.lk.Lock()
+	delete(dagst.sweeping, orphan)
+	dagst.lk.Unlock()
+	require.NoError(t, dagst.RegisterShardSync(ctx, orphan, carv2mnt, RegisterOpts{}))
+}
+
+func TestBackpressure(t *testing.T) {
+	ctx := context.Background()
+	newDAGStore := func(cfg Config) *DAGStore {
+		cfg.MountRegistry = testRegistry(t)
+		cfg.TransientsDir = t.TempDir()
+		cfg.Datastore = dssync.MutexWrap(datastore.NewMapDatastore())
+		dagst, err := NewDAGStore(cfg)
+		require.NoError(t, err)
+		require.NoError(t, dagst.Start(ctx))
+		t.Cleanup(func() { _ = dagst.Close() })
+		return dagst
+	}
+	backpressure := func(dagst *DAGStore) BackpressureStats {
+		st, err := dagst.Stats(ctx)
+		require.NoError(t, err)
+		return st.Backpressure
+	}
+	k := shard.KeyFromString("foo")
+
+	t.Run("reject", func(t *testing.T) {
+		dagst := newDAGStore(Config{
+			MaxPendingTasksPerOp: map[OpType]int{OpShardAcquire: 2},
+			Backpressure:         BackpressureReject,
+		})
+		require.NoError(t, dagst.RegisterShardSync(ctx, k, carv2mnt, RegisterOpts{}))
+
+		// acquires queue up while paused, until the limit is reached.
+		require.NoError(t, dagst.Pause(ctx))
+		ch := make(chan ShardResult, 2)
+		for i := 0; i < 2; i++ {
+			require.NoError(t, dagst.AcquireShard(ctx, k, ch, AcquireOpts{}))
+		}
+		err := dagst.AcquireShard(ctx, k, ch, AcquireOpts{})
+		require.ErrorIs(t, err, ErrBackpressure)
+
+		// other operations are not limited.
+		require.NoError(t, dagst.RecoverShard(ctx, k, make(chan ShardResult, 1), RecoverOpts{}))
+
+		bp := backpressure(dagst)
+		require.Equal(t, map[OpType]int{OpShardAcquire: 2, OpShardRecover: 1}, bp.Admitted)
+		require.EqualValues(t, 1, bp.Rejected)
+
+		// the admitted tasks are released once processed.
+		require.NoError(t, dagst.Resume(ctx))
+		for i := 0; i < 2; i++ {
+			res := <-ch
+			require.NoError(t, res.Error)
+			require.NoError(t, res.Accessor.Close())
+		}
+		require.Eventually(t, func() bool {
+			return len(backpressure(dagst).Admitted) == 0
+		}, 5*time.Second, 10*time.Millisecond)
+		acc, err := dagst.AcquireShardSync(ctx, k, AcquireOpts{})
+		require.NoError(t, err)
+		require.NoError(t, acc.Close())
+	})
+
+	t.Run("block", func(t *testing.T) {
+		dagst := newDAGStore(Config{MaxPendingTasks: 1})
+		require.NoError(t, dagst.RegisterShardSync(ctx, k, carv2mnt, RegisterOpts{}))
+
+		require.NoError(t, dagst.Pause(ctx))
+		ch := make(chan ShardResult, 2)
+		require.NoError(t, dagst.AcquireShard(ctx, k, ch, AcquireOpts{}))
+
+		// callers block until their context is done.
+		tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		err := dagst.AcquireShard(tctx, k, ch, AcquireOpts{})
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+
+		// or until there's room.
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- dagst.AcquireShard(ctx, k, ch, AcquireOpts{})
+		}()
+		require.Eventually(t, func() bool {
+			return backpressure(dagst).Waiting == 1
+		}, 5*time.Second, 10*time.Millisecond)
+
+		require.NoError(t, dagst.Resume(ctx))
+		require.NoError(t, <-errCh)
+		for i := 0; i < 2; i++ {
+			res := <-ch
+			require.NoError(t, res.Error)
+			require.NoError(t, res.Accessor.Close())
+		}
+		require.Zero(t, backpressure(dagst).Rejected)
+	})
+}
+
+func TestReconfigure(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{
+		MountRegistry:   testRegistry(t),
+		TransientsDir:   t.TempDir(),
+		Datastore:       dssync.MutexWrap(datastore.NewMapDatastore()),
+		MaxPendingTasks: 1,
+	}
+	dagst, err := NewDAGStore(cfg)
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+	defer dagst.Close()
+
+	k := shard.KeyFromString("foo")
+	require.NoError(t, dagst.RegisterShardSync(ctx, k, carv2mnt, RegisterOpts{}))
+
+	// block an acquire behind the limit on pending tasks.
+	require.NoError(t, dagst.Pause(ctx))
+	ch := make(chan ShardResult, 2)
+	require.NoError(t, dagst.AcquireShard(ctx, k, ch, AcquireOpts{}))
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- dagst.AcquireShard(ctx, k, ch, AcquireOpts{})
+	}()
+	require.Eventually(t, func() bool {
+		st, err := dagst.Stats(ctx)
+		require.NoError(t, err)
+		return st.Backpressure.Waiting == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// lift the limit, and change the throttles and trace sinks.
+	traces := make(chan Trace, 16)
+	cfg.MaxPendingTasks = 0
+	cfg.MaxConcurrentIndex = 3
+	cfg.MaxConcurrentReadyFetches = 2
+	cfg.TraceSinks = []TraceSinkOpts{{Sink: ChannelTraceSink(traces)}}
+	require.NoError(t, dagst.Reconfigure(ctx, cfg))
+
+	// the blocked acquire is admitted.
+	select {
+	case err := <-errCh:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("acquire still blocked after lifting the limit")
+	}
+	require.Equal(t, 3, dagst.throttleIndex.Max())
+	require.Equal(t, 2, dagst.throttleReaadyFetch.Max())
+
+	// traces are written to the new sink.
+	require.NoError(t, dagst.Resume(ctx))
+	for i := 0; i < 2; i++ {
+		res := <-ch
+		require.NoError(t, res.Error)
+		require.NoError(t, res.Accessor.Close())
+	}
+	select {
+	case tr := <-traces:
+		require.Equal(t, k, tr.Key)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no trace written to the new sink")
+	}
+	require.Len(t, dagst.TraceSinkStats(), 1)
+
+	// removing the sinks stops tracing to them.
+	cfg.TraceSinks = nil
+	require.NoError(t, dagst.Reconfigure(ctx, cfg))
+	require.Empty(t, dagst.TraceSinkStats())
+
+	// a closed DAG store can't be reconfigured.
+	require.NoError(t, dagst.Close())
+	require.Error(t, dagst.Reconfigure(ctx, cfg))
+}
+
+func TestRegisterShardConflict(t *testing.T) {
+	ctx := context.Background()
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		Datastore:     dssync.MutexWrap(datastore.NewMapDatastore()),
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+	defer dagst.Close()
+
+	k := shard.KeyFromPath(testdata.FSPathCarV2)
+	require.NoError(t, dagst.RegisterShardSync(ctx, k, carv2mnt, RegisterOpts{}))
+
+	// registering the same mount again is a plain duplicate.
+	err = dagst.RegisterShard(ctx, k, &mount.FSMount{FS: testdata.FS, Path: testdata.FSPathCarV2}, nil, RegisterOpts{})
+	require.ErrorIs(t, err, ErrShardExists)
+	var conflict *ShardConflictError
+	require.False(t, errors.As(err, &conflict))
+
+	// a different mount under the same key is a conflict.
+	err = dagst.RegisterShard(ctx, k, &mount.FSMount{FS: testdata.FS, Path: testdata.FSPathCarV1}, nil, RegisterOpts{})
+	require.ErrorIs(t, err, ErrShardExists)
+	require.True(t, errors.As(err, &conflict))
+	require.Equal(t, k, conflict.Key)
+	require.Contains(t, conflict.ExistingURL, "sample-wrapped-v2.car")
+	require.Contains(t, conflict.URL, "sample-v1.car")
+	require.Contains(t, err.Error(), conflict.ExistingURL)
+	require.Contains(t, err.Error(), conflict.URL)
+}
+
+// staleMount is a mount whose readers fail with mount.ErrStale while stale is
+// set.
+type staleMount struct {
+	mount.Mount
+	stale int32
+}
+
+func (m *staleMount) Fetch(ctx context.Context) (mount.Reader, error) {
+	rd, err := m.Mount.Fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &staleMountReader{Reader: rd, m: m}, nil
+}
+
+type staleMountReader struct {
+	mount.Reader
+	m *staleMount
+}
+
+func (r *staleMountReader) ReadAt(p []byte, off int64) (int, error) {
+	if atomic.LoadInt32(&r.m.stale) == 1 {
+		return 0, fmt.Errorf("read: %w", mount.ErrStale)
+	}
+	return r.Reader.ReadAt(p, off)
+}
+
+func TestStaleMountRecovery(t *testing.T) {
+	ctx := context.Background()
+	r := testRegistry(t)
+	require.NoError(t, r.Register("stale", &staleMount{}))
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: r,
+		TransientsDir: t.TempDir(),
+		Datastore:     dssync.MutexWrap(datastore.NewMapDatastore()),
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+	defer dagst.Close()
+
+	mnt := &staleMount{Mount: &mount.BytesMount{Bytes: testdata.CarV2}}
+	k := shard.KeyFromString("foo")
+	require.NoError(t, dagst.RegisterShardSync(ctx, k, mnt, RegisterOpts{}))
+
+	acc, err := dagst.AcquireShardSync(ctx, k, AcquireOpts{})
+	require.NoError(t, err)
+	bs, err := acc.Blockstore()
+	require.NoError(t, err)
+
+	// reads fail once the mount goes stale, and the shard is failed.
+	atomic.StoreInt32(&mnt.stale, 1)
+	_, err = bs.Get(ctx, testdata.RootCID)
+	require.ErrorIs(t, err, mount.ErrStale)
+	require.Eventually(t, func() bool {
+		info, err := dagst.GetShardInfo(k)
+		require.NoError(t, err)
+		return info.ShardState == ShardStateErrored
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// releasing the last reference doesn't make the shard available again.
+	require.NoError(t, acc.Close())
+	require.Eventually(t, func() bool {
+		info, err := dagst.GetShardInfo(k)
+		require.NoError(t, err)
+		return info.refs == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	info, err := dagst.GetShardInfo(k)
+	require.NoError(t, err)
+	require.Equal(t, ShardStateErrored, info.ShardState)
+
+	// the shard is recovered on its next acquire, once the mount is back.
+	atomic.StoreInt32(&mnt.stale, 0)
+	acc, err = dagst.AcquireShardSync(ctx, k, AcquireOpts{})
+	require.NoError(t, err)
+	bs, err = acc.Blockstore()
+	require.NoError(t, err)
+	_, err = bs.Get(ctx, testdata.RootCID)
+	require.NoError(t, err)
+	require.NoError(t, acc.Close())
+}
+
+// hangingMount is a remote mount whose readers serve the first bytes of the
+// data, and then hang until the context of the fetch is done.
+type hangingMount struct {
+	mount.BytesMount
+}
+
+func (m *hangingMount) Info() mount.Info {
+	return mount.Info{Kind: mount.KindRemote, AccessSequential: true}
+}
+
+func (m *hangingMount) Stat(_ context.Context) (mount.Stat, error) {
+	return mount.Stat{Exists: true, Size: int64(len(m.Bytes)), Ready: true}, nil
+}
+
+func (m *hangingMount) Fetch(ctx context.Context) (mount.Reader, error) {
+	return &mount.NopCloser{Reader: io.MultiReader(bytes.NewReader(m.Bytes[:16]), &hangingReader{ctx: ctx})}, nil
+}
+
+type hangingReader struct {
+	ctx context.Context
+}
+
+func (r *hangingReader) Read(_ []byte) (int, error) {
+	<-r.ctx.Done()
+	return 0, r.ctx.Err()
+}
+
+func TestInitTimeoutAndCancel(t *testing.T) {
+	ctx := context.Background()
+	newDAGStore := func(t *testing.T, timeout time.Duration) (*DAGStore, string) {
+		r := testRegistry(t)
+		require.NoError(t, r.Register("hanging", &hangingMount{}))
+		dir := t.TempDir()
+		dagst, err := NewDAGStore(Config{
+			MountRegistry: r,
+			TransientsDir: dir,
+			Datastore:     dssync.MutexWrap(datastore.NewMapDatastore()),
+			InitTimeout:   timeout,
+		})
+		require.NoError(t, err)
+		require.NoError(t, dagst.Start(ctx))
+		t.Cleanup(func() { _ = dagst.Close() })
+		return dagst, dir
+	}
+	requireNoTransients := func(t *testing.T, dir string) {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	}
+	mnt := &hangingMount{BytesMount: mount.BytesMount{Bytes: testdata.CarV2}}
+
+	t.Run("timeout", func(t *testing.T) {
+		dagst, dir := newDAGStore(t, 100*time.Millisecond)
+		k := shard.KeyFromString("foo")
+		err := dagst.RegisterShardSync(ctx, k, mnt, RegisterOpts{})
+		require.ErrorIs(t, err, ErrInitTimeout)
+
+		info, err := dagst.GetShardInfo(k)
+		require.NoError(t, err)
+		require.Equal(t, ShardStateErrored, info.ShardState)
+		requireNoTransients(t, dir)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		dagst, dir := newDAGStore(t, 0)
+		k := shard.KeyFromString("foo")
+		require.ErrorIs(t, dagst.CancelInit(k), ErrShardUnknown)
+
+		ch := make(chan ShardResult, 1)
+		require.NoError(t, dagst.RegisterShard(ctx, k, mnt, ch, RegisterOpts{}))
+		require.Eventually(t, func() bool {
+			return dagst.CancelInit(k) == nil
+		}, 5*time.Second, 10*time.Millisecond)
+
+		res := <-ch
+		require.ErrorIs(t, res.Error, ErrInitCancelled)
+		require.Eventually(t, func() bool {
+			return errors.Is(dagst.CancelInit(k), ErrNotInitializing)
+		}, 5*time.Second, 10*time.Millisecond)
+		requireNoTransients(t, dir)
+
+		// initializations of other shards are unaffected.
+		require.NoError(t, dagst.RegisterShardSync(ctx, shard.KeyFromString("bar"), carv2mnt, RegisterOpts{}))
+	})
+}
+
+// countingInverted is an inverted index that counts its lookups.
+type countingInverted struct {
+	index.Inverted
+	lookups int32
+}
+
+func (c *countingInverted) GetShardsForMultihash(ctx context.Context, h multihash.Multihash) ([]shard.Key, error) {
+	atomic.AddInt32(&c.lookups, 1)
+	return c.Inverted.GetShardsForMultihash(ctx, h)
+}
+
+func TestBloomFilters(t *testing.T) {
+	ctx := context.Background()
+	idx, err := index.NewFSRepo(t.TempDir())
+	require.NoError(t, err)
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	inverted := index.NewInverted(dssync.MutexWrap(datastore.NewMapDatastore()))
+	newDAGStore := func() (*DAGStore, *countingInverted) {
+		ci := &countingInverted{Inverted: inverted}
+		dagst, err := NewDAGStore(Config{
+			MountRegistry:          testRegistry(t),
+			TransientsDir:          t.TempDir(),
+			Datastore:              store,
+			IndexRepo:              idx,
+			TopLevelIndex:          ci,
+			BloomFalsePositiveRate: 0.01,
+		})
+		require.NoError(t, err)
+		require.NoError(t, dagst.Start(ctx))
+		return dagst, ci
+	}
+
+	_, err = NewDAGStore(Config{TransientsDir: t.TempDir(), BloomFalsePositiveRate: 1})
+	require.Error(t, err)
+
+	dagst, ci := newDAGStore()
+	k := shard.KeyFromString("foo")
+	ch := make(chan ShardResult, 1)
+	require.NoError(t, dagst.RegisterShard(ctx, k, carv2mnt, ch, RegisterOpts{}))
+	require.NoError(t, (<-ch).Error)
+
+	// hits are looked up in the inverted index.
+	keys, err := dagst.ShardsContainingMultihash(ctx, testdata.RootCID.Hash())
+	require.NoError(t, err)
+	require.Equal(t, []shard.Key{k}, keys)
+	require.EqualValues(t, 1, atomic.LoadInt32(&ci.lookups))
+
+	// misses are turned down by the filter.
+	absent, err := multihash.Sum([]byte("absent"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	_, err = dagst.ShardsContainingMultihash(ctx, absent)
+	require.ErrorIs(t, err, datastore.ErrNotFound)
+	_, err = dagst.ShardsContainingCid(ctx, cid.NewCidV1(cid.Raw, absent))
+	require.ErrorIs(t, err, datastore.ErrNotFound)
+	require.EqualValues(t, 1, atomic.LoadInt32(&ci.lookups))
+
+	// the filter is persisted on close, and loaded on start, after which it's
+	// dropped until the next close.
+	_, _, err = idx.GetBloom()
+	require.ErrorIs(t, err, index.ErrNotFound)
+	require.NoError(t, dagst.Close())
+	_, covered, err := idx.GetBloom()
+	require.NoError(t, err)
+	require.Equal(t, []shard.Key{k}, covered)
+	dagst, ci = newDAGStore()
+	defer dagst.Close()
+	require.Eventually(t, func() bool {
+		return dagst.blooms.miss(absent)
+	}, 5*time.Second, 10*time.Millisecond)
+	_, _, err = idx.GetBloom()
+	require.ErrorIs(t, err, index.ErrNotFound)
+	_, err = dagst.ShardsContainingMultihash(ctx, absent)
+	require.ErrorIs(t, err, datastore.ErrNotFound)
+	require.Zero(t, atomic.LoadInt32(&ci.lookups))
+	keys, err = dagst.ShardsContainingMultihash(ctx, testdata.RootCID.Hash())
+	require.NoError(t, err)
+	require.Equal(t, []shard.Key{k}, keys)
+
+	// destroyed shards are no longer covered.
+	require.NoError(t, dagst.DestroyShard(ctx, k, ch, DestroyOpts{}))
+	require.NoError(t, (<-ch).Error)
+	require.NotContains(t, dagst.blooms.keys(), k)
+}
+
+func TestBloomFilterRebuild(t *testing.T) {
+	defer func(prev uint64) { bloomMinCapacity = prev }(bloomMinCapacity)
+	bloomMinCapacity = 1
+
+	ctx := context.Background()
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:          testRegistry(t),
+		TransientsDir:          t.TempDir(),
+		BloomFalsePositiveRate: 0.01,
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+	defer dagst.Close()
+	require.Eventually(t, func() bool {
+		dagst.blooms.lk.RLock()
+		defer dagst.blooms.lk.RUnlock()
+		return dagst.blooms.filter != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the filter has no room for the shard, so it's rebuilt with room to
+	// spare, and covers the shard once it's done.
+	k := shard.KeyFromString("foo")
+	require.NoError(t, dagst.RegisterShardSync(ctx, k, carv2mnt, RegisterOpts{}))
+	absent, err := multihash.Sum([]byte("absent"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return dagst.blooms.miss(absent)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	blocks := atomic.LoadUint64(&dagst.shards[k].indexedBlocks)
+	dagst.blooms.lk.RLock()
+	require.EqualValues(t, bloomHeadroom*blocks, dagst.blooms.filter.Capacity())
+	require.EqualValues(t, blocks, dagst.blooms.filter.Count())
+	dagst.blooms.lk.RUnlock()
+
+	keys, err := dagst.ShardsContainingMultihash(ctx, testdata.RootCID.Hash())
+	require.NoError(t, err)
+	require.Equal(t, []shard.Key{k}, keys)
+}
+
+func TestMountMiddlewares(t *testing.T) {
+	ctx := context.Background()
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	idx, err := index.NewFSRepo(t.TempDir())
+	require.NoError(t, err)
+	metrics := new(mount.Metrics)
+	newDAGStore := func() *DAGStore {
+		r := testRegistry(t)
+		require.NoError(t, r.Use("fs", mount.WithLogging(), mount.WithMetrics(metrics)))
+		dagst, err := NewDAGStore(Config{
+			MountRegistry: r,
+			TransientsDir: t.TempDir(),
+			Datastore:     store,
+			IndexRepo:     idx,
+		})
+		require.NoError(t, err)
+		require.NoError(t, dagst.Start(ctx))
+		return dagst
+	}
+
+	// mounts of registered shards are wrapped.
+	dagst := newDAGStore()
+	k := shard.KeyFromString("foo")
+	require.NoError(t, dagst.RegisterShardSync(ctx, k, carv2mnt, RegisterOpts{}))
+	accs := acquireShard(t, dagst, k, 1)
+	releaseAll(t, dagst, k, accs)
+	require.NotZero(t, metrics.Snapshot().Fetches)
+	require.Zero(t, metrics.Snapshot().OpenReaders)
+
+	// they're persisted as the mounts they wrap, and wrapped again when
+	// restored.
+	require.NoError(t, dagst.Close())
+	dagst = newDAGStore()
+	defer dagst.Close()
+	dagst.lk.RLock()
+	underlying := dagst.shards[k].mount.Underlying()
+	dagst.lk.RUnlock()
+	require.Equal(t, carv2mnt, mount.Unwrap(underlying))
+	require.NotEqual(t, carv2mnt, underlying)
+	_, err = underlying.Stat(ctx)
+	require.NoError(t, err)
+	require.NotZero(t, metrics.Snapshot().Stats)
+}
+
+func TestMaintenanceJobs(t *testing.T) {
+	ctx := context.Background()
+	_, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		Datastore:     dssync.MutexWrap(datastore.NewMapDatastore()),
+		Jobs:          map[JobName]JobConfig{"unknown": {Enabled: true}},
+	})
+	require.Error(t, err)
+
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		Datastore:     dssync.MutexWrap(datastore.NewMapDatastore()),
+		Jobs: map[JobName]JobConfig{
+			JobMountHealth:        {Enabled: true, Interval: 10 * time.Millisecond, Jitter: 5 * time.Millisecond},
+			JobValidateTransients: {Interval: time.Hour},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+	defer dagst.Close()
+
+	k := shard.KeyFromString("foo")
+	require.NoError(t, dagst.RegisterShardSync(ctx, k, carv2mnt, RegisterOpts{}))
+	dagst.lk.RLock()
+	transient := dagst.shards[k].mount.TransientPath()
+	dagst.lk.RUnlock()
+	require.NotEmpty(t, transient)
+
+	// enabled jobs run periodically.
+	require.Eventually(t, func() bool {
+		st, err := dagst.Stats(ctx)
+		require.NoError(t, err)
+		j := st.Jobs[JobMountHealth]
+		return j.Runs >= 2 && !j.NextRun.IsZero()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// others only on demand.
+	require.NoError(t, dagst.RunJob(ctx, JobVerifyIndices))
+	require.Error(t, dagst.RunJob(ctx, "unknown"))
+
+	// a truncated transient fails validation, and is removed.
+	require.NoError(t, os.Truncate(transient, 10))
+	err = dagst.RunJob(ctx, JobValidateTransients)
+	require.Error(t, err)
+	_, err = os.Stat(transient)
+	require.True(t, os.IsNotExist(err))
+	st, err := dagst.Stats(ctx)
+	require.NoError(t, err)
+	j := st.Jobs[JobValidateTransients]
+	require.False(t, j.Enabled)
+	require.Equal(t, time.Hour, j.Interval)
+	require.EqualValues(t, 1, j.Runs)
+	require.EqualValues(t, 1, j.Failures)
+	require.NotEmpty(t, j.LastError)
+	require.True(t, j.NextRun.IsZero())
+	require.EqualValues(t, 1, st.Jobs[JobVerifyIndices].Runs)
+	require.Empty(t, st.Jobs[JobVerifyIndices].LastError)
+
+	// the shard is served again, refetching the transient.
+	accs := acquireShard(t, dagst, k, 1)
+	releaseAll(t, dagst, k, accs)
+	require.NoError(t, dagst.RunJob(ctx, JobValidateTransients))
+
+	// GC reclaims it.
+	require.NoError(t, dagst.RunJob(ctx, JobGC))
+	_, err = os.Stat(transient)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestAcquireShards(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	src, err := testdata.CreateRandomFile(dir, 7, 64<<10)
+	require.NoError(t, err)
+	_, path, err := testdata.CreateDenseCARv2(dir, src)
+	require.NoError(t, err)
+
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		Datastore:     dssync.MutexWrap(datastore.NewMapDatastore()),
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+	defer dagst.Close()
+
+	a, b := shard.KeyFromString("a"), shard.KeyFromString("b")
+	require.NoError(t, dagst.RegisterShardSync(ctx, a, carv2mnt, RegisterOpts{}))
+	require.NoError(t, dagst.RegisterShardSync(ctx, b, &mount.FileMount{Path: path}, RegisterOpts{}))
+
+	keysOf := func(k shard.Key) map[cid.Cid]struct{} {
+		sa, err := dagst.AcquireShardSync(ctx, k, AcquireOpts{})
+		require.NoError(t, err)
+		defer sa.Close()
+		bs, err := sa.Blockstore()
+		require.NoError(t, err)
+		ch, err := bs.AllKeysChan(ctx)
+		require.NoError(t, err)
+		ret := make(map[cid.Cid]struct{})
+		for c := range ch {
+			ret[c] = struct{}{}
+		}
+		return ret
+	}
+	ka, kb := keysOf(a), keysOf(b)
+	require.NotEmpty(t, ka)
+	require.NotEmpty(t, kb)
+
+	_, err = dagst.AcquireShards(ctx, nil, AcquireOpts{})
+	require.Error(t, err)
+
+	// duplicate keys are acquired once.
+	g, err := dagst.AcquireShards(ctx, []shard.Key{a, b, a}, AcquireOpts{})
+	require.NoError(t, err)
+	require.Equal(t, []shard.Key{a, b}, g.Shards())
+
+	bs, err := g.Blockstore()
+	require.NoError(t, err)
+	for _, keys := range []map[cid.Cid]struct{}{ka, kb} {
+		for c := range keys {
+			has, err := bs.Has(ctx, c)
+			require.NoError(t, err)
+			require.True(t, has)
+			blk, err := bs.Get(ctx, c)
+			require.NoError(t, err)
+			require.Equal(t, c, blk.Cid())
+		}
+	}
+	gen := blocksutil.NewBlockGenerator()
+	absent := gen.Next().Cid()
+	has, err := bs.Has(ctx, absent)
+	require.NoError(t, err)
+	require.False(t, has)
+	_, err = bs.Get(ctx, absent)
+	require.True(t, format.IsNotFound(err))
+
+	// keys are those of both shards, without duplicates.
+	union := make(map[cid.Cid]struct{})
+	for _, keys := range []map[cid.Cid]struct{}{ka, kb} {
+		for c := range keys {
+			union[c] = struct{}{}
+		}
+	}
+	it, err := bs.(KeyIterable).Iterator()
+	require.NoError(t, err)
+	var n int
+	for {
+		c, err := it.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.Contains(t, union, c)
+		n++
+	}
+	require.Equal(t, len(union), n)
+
+	require.NoError(t, g.Close())
+	for _, k := range []shard.Key{a, b} {
+		require.Eventually(t, func() bool {
+			info, err := dagst.GetShardInfo(k)
+			return err == nil && info.refs == 0
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	// a failure to acquire any shard releases the others.
+	_, err = dagst.AcquireShards(ctx, []shard.Key{a, shard.KeyFromString("unknown")}, AcquireOpts{})
+	require.ErrorIs(t, err, ErrShardUnknown)
+	require.Eventually(t, func() bool {
+		info, err := dagst.GetShardInfo(a)
+		return err == nil && info.refs == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestRegisterOptsPersisted(t *testing.T) {
+	ctx := context.Background()
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	cfg := Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		Datastore:     store,
+	}
+	dagst, err := NewDAGStore(cfg)
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+
+	opts := RegisterOpts{
+		LazyInitialization: true,
+		TTL:                time.Hour,
+		Compression:        TransientCompressionDisabled,
+		SkipTopLevelIndex:  true,
+		Labels:             map[string]string{"deal": "42"},
+	}
+	k := shard.KeyFromString("foo")
+	require.NoError(t, dagst.RegisterShardSync(ctx, k, carv2mnt, opts))
+	opts.Labels["deal"] = "mutated" // the shard keeps its own copy.
+
+	want := opts
+	want.Labels = map[string]string{"deal": "42"}
+	info, err := dagst.GetShardInfo(k)
+	require.NoError(t, err)
+	require.Equal(t, want, info.RegisterOpts)
+	require.Equal(t, want, dagst.AllShardsInfo()[k].RegisterOpts)
+	require.NoError(t, dagst.Close())
+
+	// the options survive a restart.
+	dagst, err = NewDAGStore(cfg)
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+	defer dagst.Close()
+
+	info, err = dagst.GetShardInfo(k)
+	require.NoError(t, err)
+	require.Equal(t, want, info.RegisterOpts)
+}
+
+func TestRecoverAllFailureDomains(t *testing.T) {
+	ctx := context.Background()
+	down := new(int32)
+	r := testRegistry(t)
+	require.NoError(t, r.Register("flaky", &flakyMount{FSMount: mount.FSMount{FS: testdata.FS}, down: down}))
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:    r,
+		TransientsDir:    t.TempDir(),
+		RecoverAllPacing: -1,
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+	defer dagst.Close()
+
+	// shards of a backend that's down, and shards with junk in them.
+	atomic.StoreInt32(down, 1)
+	fsys := new(fixableFS)
+	junkmnt := &mount.FSMount{FS: fsys, Path: testdata.FSPathJunk}
+	for i := 0; i < 4; i++ {
+		flaky := &flakyMount{FSMount: mount.FSMount{FS: testdata.FS, Path: testdata.FSPathCarV2}, down: down}
+		require.Error(t, dagst.RegisterShardSync(ctx, shard.KeyFromString("flaky"+strconv.Itoa(i)), flaky, RegisterOpts{}))
+		require.Error(t, dagst.RegisterShardSync(ctx, shard.KeyFromString("fs"+strconv.Itoa(i)), junkmnt, RegisterOpts{}))
+	}
+
+	// the domain of the backend that's still down is skipped.
+	atomic.StoreInt32(&fsys.fixed, 1)
+	out := make(chan ShardResult, 8)
+	require.NoError(t, dagst.RecoverAll(ctx, 2, out))
+	require.Len(t, out, 8)
+	for i := 0; i < 8; i++ {
+		res := <-out
+		if strings.HasPrefix(res.Key.String(), "flaky") {
+			require.ErrorIs(t, res.Error, ErrMountDegraded)
+		} else {
+			require.NoError(t, res.Error)
+		}
+	}
+	for k, info := range dagst.AllShardsInfo() {
+		if strings.HasPrefix(k.String(), "flaky") {
+			require.Equal(t, ShardStateErrored, info.ShardState)
+		} else {
+			require.Equal(t, ShardStateAvailable, info.ShardState)
+		}
+	}
+
+	// once the backend is back, its shards are recovered.
+	atomic.StoreInt32(down, 0)
+	require.NoError(t, dagst.RecoverAll(ctx, 2, out))
+	require.Len(t, out, 4)
+	for i := 0; i < 4; i++ {
+		require.NoError(t, (<-out).Error)
+	}
+	for _, info := range dagst.AllShardsInfo() {
+		require.Equal(t, ShardStateAvailable, info.ShardState)
+	}
+}
+
+func TestDirectIO(t *testing.T) {
+	ctx := context.Background()
+	repo, err := index.NewFSRepo(t.TempDir())
+	require.NoError(t, err)
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:        testRegistry(t),
+		TransientsDir:        t.TempDir(),
+		IndexRepo:            repo,
+		DirectIO:             true,
+		DirectIOSyncInterval: 4096,
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+	defer dagst.Close()
+
+	// transients and indices written with direct IO read back the same.
+	for i, compression := range []TransientCompression{TransientCompressionDisabled, TransientCompressionEnabled} {
+		k := shard.KeyFromString(strconv.Itoa(i))
+		require.NoError(t, dagst.RegisterShardSync(ctx, k, carv2mnt, RegisterOpts{Compression: compression}))
+
+		res, err := dagst.VerifyIndex(ctx, k, VerifyIndexOpts{})
+		require.NoError(t, err)
+		require.True(t, res.OK())
+
+		sa, err := dagst.AcquireShardSync(ctx, k, AcquireOpts{})
+		require.NoError(t, err)
+		bs, err := sa.Blockstore()
+		require.NoError(t, err)
+		ch, err := bs.AllKeysChan(ctx)
+		require.NoError(t, err)
+		var n int
+		for c := range ch {
+			blk, err := bs.Get(ctx, c)
+			require.NoError(t, err)
+			require.Equal(t, c, blk.Cid())
+			n++
+		}
+		require.NotZero(t, n)
+		require.NoError(t, sa.Close())
+	}
+}
+
+func TestPendingOps(t *testing.T) {
+	ctx := context.Background()
+	r := testRegistry(t)
+	require.NoError(t, r.Register("block", newBlockingMount(&mount.FSMount{FS: testdata.FS})))
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: r,
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+	defer dagst.Close()
+
+	_, err = dagst.PendingOps(shard.KeyFromString("unknown"))
+	require.ErrorIs(t, err, ErrShardUnknown)
+
+	// the initialization hangs until the mount is unblocked.
+	k := shard.KeyFromString("foo")
+	block := newBlockingMount(carv2mnt)
+	regCh := make(chan ShardResult, 1)
+	require.NoError(t, dagst.RegisterShard(ctx, k, block, regCh, RegisterOpts{}))
+	acqCh := make(chan ShardResult, 2)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, dagst.AcquireShard(ctx, k, acqCh, AcquireOpts{}))
+	}
+
+	require.Eventually(t, func() bool {
+		p, err := dagst.PendingOps(k)
+		require.NoError(t, err)
+		return p.Registering && p.Initializing && p.QueuedAcquirers == 2 && len(p.Tasks) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	p, err := dagst.PendingOps(k)
+	require.NoError(t, err)
+	require.False(t, p.Idle())
+
+	block.UnblockNext(1)
+	require.NoError(t, (<-regCh).Error)
+	for i := 0; i < 2; i++ {
+		res := <-acqCh
+		require.NoError(t, res.Error)
+		require.NoError(t, res.Accessor.Close())
+	}
+
+	require.Eventually(t, func() bool {
+		p, err := dagst.PendingOps(k)
+		require.NoError(t, err)
+		return p.Idle()
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSampleShard(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+
+	ctx := context.Background()
+	k := registerShards(t, dagst, 1, carv2mnt, RegisterOpts{})[0]
+
+	res, err := dagst.SampleShard(ctx, k, 5)
+	require.NoError(t, err)
+	require.True(t, res.OK())
+	require.Equal(t, 5, res.Sampled)
+	require.Equal(t, 5, res.Verified)
+	require.NotZero(t, res.BytesRead)
+	require.Greater(t, res.Entries, 5)
+
+	// asking for more blocks than there are samples them all.
+	res, err = dagst.SampleShard(ctx, k, 1<<20)
+	require.NoError(t, err)
+	require.True(t, res.OK())
+	require.Equal(t, res.Entries, res.Sampled)
+
+	_, err = dagst.SampleShard(ctx, k, 0)
+	require.Error(t, err)
+	_, err = dagst.SampleShard(ctx, shard.KeyFromString("unknown"), 1)
+	require.ErrorIs(t, err, ErrShardUnknown)
+
+	// corrupt the last byte of the data payload of a shard, which belongs to
+	// the data of the last block.
+	data := append([]byte(nil), testdata.CarV2...)
+	cr, err := car.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	mnt := &mount.BytesMount{Bytes: data}
+	ck := shard.KeyFromString("corrupt")
+	require.NoError(t, dagst.RegisterShardSync(ctx, ck, mnt, RegisterOpts{}))
+	data[cr.Header.DataOffset+cr.Header.DataSize-1] ^= 0xff
+
+	res, err = dagst.SampleShard(ctx, ck, 1<<20)
+	require.NoError(t, err)
+	require.False(t, res.OK())
+	require.Len(t, res.Failures, 1)
+	require.Equal(t, res.Sampled-1, res.Verified)
+	require.Contains(t, res.Failures[0].Error.Error(), "doesn't match its multihash")
+}
+
+func TestRegisterInvalidKey(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+
+	ctx := context.Background()
+	err = dagst.RegisterShard(ctx, shard.KeyFromString(""), carv2mnt, nil, RegisterOpts{})
+	require.ErrorIs(t, err, shard.ErrInvalidKey)
+	err = dagst.RegisterShard(ctx, shard.KeyFromString("123E4567-E89B-12D3-A456-426614174000"), carv2mnt, nil, RegisterOpts{})
+	require.ErrorIs(t, err, shard.ErrInvalidKey)
+	err = dagst.Txn(ctx, func(tx *ShardTxn) error {
+		return tx.RegisterShard(shard.KeyFromString("a\x00b"), carv2mnt, nil, RegisterOpts{})
+	})
+	require.ErrorIs(t, err, shard.ErrInvalidKey)
+	require.Empty(t, dagst.AllShardsInfo())
+
+	k, err := shard.ParseUUIDKey("123E4567-E89B-12D3-A456-426614174000")
+	require.NoError(t, err)
+	require.NoError(t, dagst.RegisterShardSync(ctx, k, carv2mnt, RegisterOpts{}))
+}
+
+func TestAcquireRetry(t *testing.T) {
+	var down int32
+	r := testRegistry(t)
+	require.NoError(t, r.Register("flaky", &flakyMount{FSMount: mount.FSMount{FS: testdata.FS}, down: &down}))
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: r,
+		TransientsDir: t.TempDir(),
+		AcquireRetryPolicies: map[string]AcquireRetryPolicy{
+			"flaky": &ExponentialRetry{
+				MaxElapsed:     5 * time.Second,
+				InitialBackoff: 10 * time.Millisecond,
+				MaxBackoff:     50 * time.Millisecond,
+				Jitter:         0.5,
+			},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+	t.Cleanup(func() { _ = dagst.Close() })
+
+	ctx := context.Background()
+	k := shard.KeyFromString("flaky")
+	mnt := &flakyMount{FSMount: mount.FSMount{FS: testdata.FS, Path: testdata.FSPathCarV2}, down: &down}
+	require.NoError(t, dagst.RegisterShardSync(ctx, k, mnt, RegisterOpts{}))
+
+	// drop the transient, so that the acquire fetches from the mount, and
+	// bring the mount back up after a few failed attempts.
+	atomic.StoreInt32(&down, 1)
+	_, err = dagst.GC(ctx)
+	require.NoError(t, err)
+	time.AfterFunc(100*time.Millisecond, func() { atomic.StoreInt32(&down, 0) })
+
+	ch := make(chan ShardResult, 1)
+	require.NoError(t, dagst.AcquireShard(ctx, k, ch, AcquireOpts{}))
+	res := <-ch
+	require.NoError(t, res.Error)
+	require.NoError(t, res.Accessor.Close())
+
+	info, err := dagst.GetShardInfo(k)
+	require.NoError(t, err)
+	require.NotEqual(t, ShardStateErrored, info.ShardState)
+}
+
+func TestExponentialRetry(t *testing.T) {
+	p := &ExponentialRetry{
+		MaxAttempts:    4,
+		MaxElapsed:     time.Second,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     300 * time.Millisecond,
+	}
+	errFail := errors.New("fail")
+
+	for attempt, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond} {
+		backoff, ok := p.NextBackoff(attempt+1, 0, errFail)
+		require.True(t, ok)
+		require.Equal(t, want, backoff)
+	}
+	_, ok := p.NextBackoff(4, 0, errFail)
+	require.False(t, ok, "max attempts")
+	_, ok = p.NextBackoff(1, 950*time.Millisecond, errFail)
+	require.False(t, ok, "max elapsed")
+	_, ok = p.NextBackoff(1, 0, fmt.Errorf("gone: %w", os.ErrNotExist))
+	require.False(t, ok, "not retryable")
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		backoff, ok := p.NextBackoff(1, 0, errFail)
+		require.True(t, ok)
+		require.GreaterOrEqual(t, int64(backoff), int64(50*time.Millisecond))
+		require.LessOrEqual(t, int64(backoff), int64(150*time.Millisecond))
+	}
+}
+
+func TestDestroyCh(t *testing.T) {
+	destroyCh := make(chan ShardDestroyed, 4)
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+		DestroyCh:     destroyCh,
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+	t.Cleanup(func() { _ = dagst.Close() })
+
+	ctx := context.Background()
+	keys := registerShards(t, dagst, 2, carv2mnt, RegisterOpts{})
+
+	ch := make(chan ShardResult, 1)
+	require.NoError(t, dagst.DestroyShard(ctx, keys[0], ch, DestroyOpts{}))
+	require.NoError(t, (<-ch).Error)
+	n := <-destroyCh
+	require.Equal(t, keys[0], n.Key)
+	require.True(t, n.TransientRemoved)
+	require.True(t, n.IndexRemoved)
+	require.False(t, n.Forced)
+	require.Greater(t, n.FreedBytes, uint64(len(testdata.CarV2)))
+
+	// shards destroyed with active references once the drain timeout elapses
+	// are flagged as such.
+	acc, err := dagst.AcquireShardSync(ctx, keys[1], AcquireOpts{})
+	require.NoError(t, err)
+	defer acc.Close()
+	require.NoError(t, dagst.DestroyShard(ctx, keys[1], ch, DestroyOpts{DrainTimeout: 50 * time.Millisecond}))
+	require.NoError(t, (<-ch).Error)
+	n = <-destroyCh
+	require.Equal(t, keys[1], n.Key)
+	require.True(t, n.Forced)
+	require.True(t, n.IndexRemoved)
+
+	require.Eventually(t, func() bool {
+		return dagst.DestroyStats() == NotifyStats{Delivered: 2}
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestIndexMemoryBudget(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:     testRegistry(t),
+		TransientsDir:     t.TempDir(),
+		IndexMemoryBudget: 1,
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+
+	ctx := context.Background()
+	k := shard.KeyFromString("carv1")
+	mnt := &mount.FSMount{FS: testdata.FS, Path: testdata.FSPathCarV1}
+	require.NoError(t, dagst.RegisterShardSync(ctx, k, mnt, RegisterOpts{}))
+
+	// the index matches the one generated by go-car.
+	res, err := dagst.VerifyIndex(ctx, k, VerifyIndexOpts{})
+	require.NoError(t, err)
+	require.True(t, res.OK())
+	require.NotZero(t, res.Entries)
+
+	acc, err := dagst.AcquireShardSync(ctx, k, AcquireOpts{})
+	require.NoError(t, err)
+	defer acc.Close()
+	bs, err := acc.Blockstore()
+	require.NoError(t, err)
+	ch, err := bs.AllKeysChan(ctx)
+	require.NoError(t, err)
+	var n int
+	for c := range ch {
+		_, err := bs.Get(ctx, c)
+		require.NoError(t, err)
+		n++
+	}
+	require.NotZero(t, n)
+}
+
+func TestIndexedGetSize(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:  testRegistry(t),
+		TransientsDir:  t.TempDir(),
+		IndexedGetSize: true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+
+	// the index generated by the DAG store records all sections, unlike the
+	// one embedded in the CARv2 fixture, which omits identity CIDs.
+	ctx := context.Background()
+	k := shard.KeyFromString("carv1")
+	mnt := &mount.FSMount{FS: testdata.FS, Path: testdata.FSPathCarV1}
+	require.NoError(t, dagst.RegisterShardSync(ctx, k, mnt, RegisterOpts{}))
+	acc, err := dagst.AcquireShardSync(ctx, k, AcquireOpts{})
+	require.NoError(t, err)
+	defer acc.Close()
+	bs, err := acc.Blockstore()
+	require.NoError(t, err)
+
+	ch, err := bs.AllKeysChan(ctx)
+	require.NoError(t, err)
+	var n int
+	for c := range ch {
+		blk, err := bs.Get(ctx, c)
+		require.NoError(t, err)
+		size, err := bs.GetSize(ctx, c)
+		require.NoError(t, err)
+		require.Equal(t, len(blk.RawData()), size, c)
+		n++
+	}
+	require.NotZero(t, n)
+
+	gen := blocksutil.NewBlockGenerator()
+	_, err = bs.GetSize(ctx, gen.Next().Cid())
+	require.True(t, format.IsNotFound(err))
+
+	// the offsets are loaded once per index, not per blockstore.
+	offsets := dagst.shards[k].offsets
+	require.NotNil(t, offsets)
+	_, err = acc.Blockstore()
+	require.NoError(t, err)
+	require.Same(t, offsets, dagst.shards[k].offsets)
+}
+
+func TestHashOnRead(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry: testRegistry(t),
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+
+	// corrupt the last byte of the data payload of a shard, which belongs to
+	// the data of the last block.
+	ctx := context.Background()
+	data := append([]byte(nil), testdata.CarV2...)
+	cr, err := car.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	k := shard.KeyFromString("corrupt")
+	require.NoError(t, dagst.RegisterShardSync(ctx, k, &mount.BytesMount{Bytes: data}, RegisterOpts{}))
+	data[cr.Header.DataOffset+cr.Header.DataSize-1] ^= 0xff
+
+	acc, err := dagst.AcquireShardSync(ctx, k, AcquireOpts{})
+	require.NoError(t, err)
+	defer acc.Close()
+	bs, err := acc.Blockstore()
+	require.NoError(t, err)
+
+	// keys are iterated in CAR order.
+	it, err := bs.(KeyIterable).Iterator()
+	require.NoError(t, err)
+	var last cid.Cid
+	for {
+		c, err := it.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		last = c
+	}
+
+	_, err = bs.Get(ctx, last)
+	require.NoError(t, err)
+
+	bs.HashOnRead(true)
+	_, err = bs.Get(ctx, last)
+	require.ErrorIs(t, err, bstore.ErrHashMismatch)
+	_, err = bs.(BatchGetter).GetMany(ctx, []cid.Cid{testdata.RootCID, last})
+	require.ErrorIs(t, err, bstore.ErrHashMismatch)
+	err = bs.View(ctx, last, func([]byte) error { return nil })
+	require.ErrorIs(t, err, bstore.ErrHashMismatch)
+	_, err = bs.Get(ctx, testdata.RootCID)
+	require.NoError(t, err)
+}
+
+func TestGetMany(t *testing.T) {
+	dagst, err := NewDAGStore(Config{
+		MountRegistry:  testRegistry(t),
+		TransientsDir:  t.TempDir(),
+		BlockCacheSize: 1 << 20,
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+
+	ctx := context.Background()
+	k := registerShards(t, dagst, 1, carv2mnt, RegisterOpts{})[0]
+	acc, err := dagst.AcquireShardSync(ctx, k, AcquireOpts{})
+	require.NoError(t, err)
+	defer acc.Close()
+	bs, err := acc.Blockstore()
+	require.NoError(t, err)
+
+	var cids []cid.Cid
+	ch, err := bs.AllKeysChan(ctx)
+	require.NoError(t, err)
+	for c := range ch {
+		cids = append(cids, c)
+	}
+	require.Greater(t, len(cids), 4)
+
+	// request the blocks in reverse CAR order, with a block not in the shard.
+	var req []cid.Cid
+	for i := len(cids) - 1; i >= 0; i-- {
+		req = append(req, cids[i])
+	}
+	gen := blocksutil.NewBlockGenerator()
+	req = append(req, gen.Next().Cid())
+
+	// warm the cache with one of the blocks, so that it's served from it.
+	_, err = bs.Get(ctx, req[1])
+	require.NoError(t, err)
+
+	blks, err := bs.(BatchGetter).GetMany(ctx, req)
+	require.NoError(t, err)
+	require.Len(t, blks, len(req))
+	for i, c := range req[:len(req)-1] {
+		want, err := bs.Get(ctx, c)
+		require.NoError(t, err)
+		require.Equal(t, c, blks[i].Cid())
+		require.Equal(t, want.RawData(), blks[i].RawData())
+	}
+	require.Nil(t, blks[len(req)-1])
+
+	// restricted accessors only return the blocks they expose.
+	racc, err := dagst.AcquireShardSync(ctx, k, AcquireOpts{CIDs: []cid.Cid{cids[0]}})
+	require.NoError(t, err)
+	defer racc.Close()
+	rbs, err := racc.Blockstore()
+	require.NoError(t, err)
+	blks, err = rbs.(BatchGetter).GetMany(ctx, cids[:2])
+	require.NoError(t, err)
+	require.NotNil(t, blks[0])
+	require.Nil(t, blks[1])
+}
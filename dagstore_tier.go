@@ -0,0 +1,217 @@
+package dagstore
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/filecoin-project/dagstore/mount"
+)
+
+// TransientTier indicates where the local copy of a shard's data lives.
+type TransientTier int
+
+const (
+	// TierCold indicates that the shard has no local transient; its data is
+	// read from the mount.
+	TierCold TransientTier = iota
+
+	// TierWarm indicates that the shard's transient lives in the warm tier,
+	// i.e. under Config.TransientsDir.
+	TierWarm
+
+	// TierHot indicates that the shard's transient lives in the hot tier,
+	// i.e. under Config.HotTransientsDir.
+	TierHot
+)
+
+func (t TransientTier) String() string {
+	return [...]string{
+		"TierCold",
+		"TierWarm",
+		"TierHot"}[t]
+}
+
+// tieringEnabled returns whether transients are tiered.
+func (d *DAGStore) tieringEnabled() bool {
+	return d.config.HotTransientsDir != ""
+}
+
+// transientTier returns the tier of the shard's transient.
+func (d *DAGStore) transientTier(s *Shard) TransientTier {
+	path := s.mount.TransientPath()
+	switch {
+	case path == "":
+		return TierCold
+	case d.tieringEnabled() && filepath.Dir(path) == d.config.TransientsLayout.Dir(filepath.Clean(d.config.HotTransientsDir), s.key):
+		return TierHot
+	default:
+		return TierWarm
+	}
+}
+
+// tierQueueSize is the number of moves of transients across tiers that can be
+// queued for the tier worker; further moves are skipped until it catches up.
+const tierQueueSize = 128
+
+// tierJob is a move of the transient of a shard to another tier, queued for
+// the tier worker.
+type tierJob struct {
+	s  *Shard
+	to TransientTier
+}
+
+// tierMove is a move of a transient across tiers staged by the tier worker,
+// sent to the coordinator to be committed. The error of the commit is sent on
+// done.
+type tierMove struct {
+	tierJob
+	move *mount.TransientMove
+	done chan error
+}
+
+// promoteTransient queues the move of the transient of a shard being acquired
+// to the hot tier, if it's in the warm tier. The shard keeps reading from the
+// warm tier until the move completes.
+func (d *DAGStore) promoteTransient(s *Shard) {
+	if !d.tieringEnabled() || d.transientTier(s) != TierWarm {
+		return
+	}
+	d.queueTierJob(tierJob{s: s, to: TierHot})
+}
+
+// queueTierJob queues a move of a transient for the tier worker, and returns
+// whether it was queued.
+func (d *DAGStore) queueTierJob(j tierJob) bool {
+	select {
+	case d.tierQueue <- j:
+		return true
+	default:
+		log.Debugw("tier queue is full; not moving transient", "shard", j.s.key, "to", j.to)
+		return false
+	}
+}
+
+// tierWorker moves transients across tiers. Transients are copied in the
+// background, one at a time so that concurrent promotions don't overcommit
+// the hot tier, and the coordinator only swaps paths while the event loops
+// are halted. Failures are logged and otherwise ignored, as the transients
+// remain usable in their tier.
+func (d *DAGStore) tierWorker() {
+	defer d.wg.Done()
+
+	for {
+		var j tierJob
+		select {
+		case j = <-d.tierQueue:
+		case <-d.ctx.Done():
+			return
+		}
+
+		if err := d.moveTier(j); err != nil {
+			log.Warnw("failed to move transient across tiers", "shard", j.s.key, "to", j.to, "error", err)
+		}
+	}
+}
+
+// moveTier stages the move of a transient, and has the coordinator commit it.
+func (d *DAGStore) moveTier(j tierJob) error {
+	s := j.s
+	var dir string
+	switch j.to {
+	case TierHot:
+		if d.transientTier(s) != TierWarm {
+			return nil // promoted, or deleted, in the meantime.
+		}
+		fi, err := os.Stat(s.mount.TransientPath())
+		if err != nil {
+			return nil
+		}
+		used, err := dirSize(d.config.HotTransientsDir)
+		if err != nil {
+			return fmt.Errorf("failed to compute hot tier usage: %w", err)
+		}
+		if used+fi.Size() > d.config.HotTransientsCapacity {
+			log.Debugw("hot tier is full; not promoting transient", "shard", s.key, "used", used, "size", fi.Size())
+			return nil
+		}
+		dir = d.config.TransientsLayout.Dir(d.config.HotTransientsDir, s.key)
+	case TierWarm:
+		if d.transientTier(s) != TierHot {
+			return nil
+		}
+		dir = d.config.TransientsLayout.Dir(d.config.TransientsDir, s.key)
+	default:
+		return fmt.Errorf("invalid target tier: %s", j.to)
+	}
+
+	move, err := s.mount.StageTransientMove(dir)
+	if err != nil {
+		return err
+	}
+	req := &tierMove{tierJob: j, move: move, done: make(chan error, 1)}
+	select {
+	case d.tierCh <- req:
+	case <-d.ctx.Done():
+		move.Abort()
+		return d.ctx.Err()
+	}
+	select {
+	case err = <-req.done:
+		return err
+	case <-d.ctx.Done():
+		return d.ctx.Err()
+	}
+}
+
+// commitTierMove commits a staged move of a transient across tiers. It's
+// called by the coordinator while the event loops are halted. Demotions are
+// aborted if the shard was acquired since GC scheduled them.
+func (d *DAGStore) commitTierMove(req *tierMove) error {
+	s := req.s
+	s.lk.RLock()
+	defer s.lk.RUnlock()
+
+	if req.to == TierWarm && !d.gcReport(s).Reclaimable {
+		req.move.Abort()
+		log.Debugw("shard in use; not demoting transient", "shard", s.key)
+		return nil
+	}
+	path, err := req.move.Commit()
+	if err != nil {
+		return err
+	}
+	log.Debugw("moved transient across tiers", "shard", s.key, "to", req.to, "path", path)
+
+	// flush the new path of the transient, unless the writer node owns it.
+	if !d.config.ReadOnly && !d.isFenced() {
+		if err := s.persist(d.ctx, d.config.Datastore); err != nil {
+			log.Warnw("failed to persist shard", "shard", s.key, "error", err)
+		}
+	}
+	return nil
+}
+
+// dirSize returns the total size of the regular files in dir, recursively.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, e fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path != dir {
+				return nil // removed in the meantime.
+			}
+			return err
+		}
+		if !e.Type().IsRegular() {
+			return nil
+		}
+		fi, err := e.Info()
+		if err != nil {
+			return nil // removed in the meantime.
+		}
+		size += fi.Size()
+		return nil
+	})
+	return size, err
+}
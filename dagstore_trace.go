@@ -0,0 +1,287 @@
+package dagstore
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// DefaultTraceBufferSize is the default value of TraceSinkOpts.BufferSize.
+var DefaultTraceBufferSize = 128
+
+// TraceSink consumes traces of shard operations. Sinks configured through
+// Config.TraceSinks are fed from a dedicated goroutine each, so a slow sink
+// never stalls the event loop; see TraceSinkOpts. Applications can implement
+// it to export traces to other systems; OTLPTraceSink exports them to an
+// OpenTelemetry collector.
+type TraceSink interface {
+	// WriteTrace consumes a trace. Traces are written one at a time, in
+	// order. The context is cancelled when the DAG store is closed.
+	WriteTrace(context.Context, Trace) error
+}
+
+// TraceFunc is a TraceSink that calls a function with every trace.
+type TraceFunc func(Trace)
+
+func (f TraceFunc) WriteTrace(_ context.Context, t Trace) error {
+	f(t)
+	return nil
+}
+
+// ChannelTraceSink is a TraceSink that sends traces to a channel. Writes wait
+// for the channel to receive the trace; as the sink is fed from its own
+// buffer, a channel that isn't being consumed only causes its traces to be
+// dropped according to the drop policy, without stalling the event loop.
+type ChannelTraceSink chan<- Trace
+
+func (c ChannelTraceSink) WriteTrace(ctx context.Context, t Trace) error {
+	select {
+	case c <- t:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// JSONLTraceSink is a TraceSink that writes traces to a writer, e.g. a file,
+// as JSON objects, one per line.
+type JSONLTraceSink struct {
+	enc *json.Encoder
+}
+
+// NewJSONLTraceSink creates a JSONLTraceSink writing to w.
+func NewJSONLTraceSink(w io.Writer) *JSONLTraceSink {
+	return &JSONLTraceSink{enc: json.NewEncoder(w)}
+}
+
+// traceJSON is the JSON representation of a Trace.
+type traceJSON struct {
+	Seq      uint64 `json:"seq"`
+	ShardSeq uint64 `json:"shard_seq"`
+	Key      string `json:"key"`
+	Op       string `json:"op"`
+	State    string `json:"state"`
+	Error    string `json:"error,omitempty"`
+
+	Transferred int64 `json:"transferred,omitempty"`
+	Total       int64 `json:"total,omitempty"`
+}
+
+func (j *JSONLTraceSink) WriteTrace(_ context.Context, t Trace) error {
+	tj := traceJSON{
+		Seq:      t.Seq,
+		ShardSeq: t.ShardSeq,
+		Key:      t.Key.String(),
+		Op:       t.Op.String(),
+		State:    t.After.ShardState.String(),
+	}
+	if t.After.Error != nil {
+		tj.Error = t.After.Error.Error()
+	}
+	if t.Progress != nil {
+		tj.Transferred = t.Progress.Transferred
+		tj.Total = t.Progress.Total
+	}
+	return j.enc.Encode(tj)
+}
+
+// TraceDropPolicy specifies which traces a sink drops when its buffer is full.
+type TraceDropPolicy int
+
+const (
+	// TraceDropNewest drops incoming traces while the buffer is full.
+	TraceDropNewest TraceDropPolicy = iota
+
+	// TraceDropOldest drops the oldest buffered trace to make room for the
+	// incoming one, so that the sink sees the most recent traces.
+	TraceDropOldest
+)
+
+// TraceSinkOpts configures a trace sink.
+type TraceSinkOpts struct {
+	// Sink is the sink traces are written to.
+	Sink TraceSink
+
+	// BufferSize is the maximum number of traces buffered while the sink is
+	// busy. Defaults to DefaultTraceBufferSize.
+	BufferSize int
+
+	// DropPolicy specifies which traces are dropped when the buffer is full.
+	DropPolicy TraceDropPolicy
+}
+
+// TraceSinkStats are statistics about a trace sink.
+type TraceSinkStats struct {
+	// Written is the number of traces written to the sink.
+	Written uint64
+	// Dropped is the number of traces dropped because the buffer was full.
+	Dropped uint64
+	// Errors is the number of traces the sink failed to write.
+	Errors uint64
+}
+
+// traceSink buffers traces for a sink, which are written by a dedicated
+// goroutine.
+type traceSink struct {
+	opts TraceSinkOpts
+
+	lk      sync.Mutex
+	pending []Trace
+	stats   TraceSinkStats
+
+	signal chan struct{} // signals the writer that traces were pushed.
+	done   chan struct{} // closed when the sink is replaced by Reconfigure.
+}
+
+func newTraceSink(opts TraceSinkOpts) *traceSink {
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = DefaultTraceBufferSize
+	}
+	return &traceSink{opts: opts, signal: make(chan struct{}, 1), done: make(chan struct{})}
+}
+
+// push buffers a trace without blocking, applying the drop policy if the
+// buffer is full.
+func (t *traceSink) push(trace Trace) {
+	t.lk.Lock()
+	if len(t.pending) >= t.opts.BufferSize {
+		t.stats.Dropped++
+		if t.opts.DropPolicy == TraceDropNewest {
+			t.lk.Unlock()
+			return
+		}
+		t.pending = t.pending[1:]
+	}
+	t.pending = append(t.pending, trace)
+	t.lk.Unlock()
+
+	select {
+	case t.signal <- struct{}{}:
+	default:
+	}
+}
+
+// pop removes the oldest buffered trace, returning false if the buffer is
+// empty.
+func (t *traceSink) pop() (Trace, bool) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	if len(t.pending) == 0 {
+		return Trace{}, false
+	}
+	trace := t.pending[0]
+	t.pending = t.pending[1:]
+	return trace, true
+}
+
+// written records the outcome of writing a trace.
+func (t *traceSink) written(err error) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	if err != nil {
+		t.stats.Errors++
+		return
+	}
+	t.stats.Written++
+}
+
+// emitTrace buffers a trace for the trace channel and all sinks, and keeps it
+// in the recent traces. It must be called with traceLk held, so that sinks
+// receive traces in sequence.
+func (d *DAGStore) emitTrace(trace Trace) {
+	if d.traceChSink != nil {
+		d.traceChSink.push(trace)
+	}
+	if d.recentTraces != nil {
+		d.recentTraces.push(trace)
+	}
+	for _, sink := range d.traceSinks {
+		sink.push(trace)
+	}
+}
+
+// traceOutOfLoop emits a trace for a shard from outside the event loop, e.g.
+// from the goroutines fetching transients, filling in the shard state and
+// sequence numbers. It's a no-op if traces aren't consumed, or if the shard is
+// gone. It must not be called with the shard lock held.
+func (d *DAGStore) traceOutOfLoop(n Trace) {
+	if !d.tracing() {
+		return
+	}
+
+	d.lk.RLock()
+	s, ok := d.shards[n.Key]
+	d.lk.RUnlock()
+	if !ok {
+		return
+	}
+
+	s.lk.RLock()
+	n.After = d.shardInfo(s)
+	s.lk.RUnlock()
+
+	d.traceLk.Lock()
+	defer d.traceLk.Unlock()
+
+	d.traceSeq++
+	s.traceSeq++
+	n.Seq, n.ShardSeq = d.traceSeq, s.traceSeq
+	d.emitTrace(n)
+}
+
+// traceWriter writes the buffered traces of a sink, until the DAG store is
+// closed, or the sink is replaced and its buffer drained.
+func (d *DAGStore) traceWriter(sink *traceSink) {
+	defer d.wg.Done()
+
+	for {
+		trace, ok := sink.pop()
+		if !ok {
+			select {
+			case <-sink.signal:
+				continue
+			case <-sink.done:
+				return
+			case <-d.ctx.Done():
+				return
+			}
+		}
+
+		err := sink.opts.Sink.WriteTrace(d.ctx, trace)
+		if err != nil && d.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Warnw("failed to write trace to sink", "shard", trace.Key, "error", err)
+		}
+		sink.written(err)
+	}
+}
+
+// droppedTraces returns the number of traces dropped for Config.TraceCh.
+func (d *DAGStore) droppedTraces() uint64 {
+	if d.traceChSink == nil {
+		return 0
+	}
+	d.traceChSink.lk.Lock()
+	defer d.traceChSink.lk.Unlock()
+	return d.traceChSink.stats.Dropped
+}
+
+// TraceSinkStats returns statistics about the sinks in Config.TraceSinks, in
+// the same order. After Reconfigure, they're about the sinks it set up.
+func (d *DAGStore) TraceSinkStats() []TraceSinkStats {
+	d.traceLk.Lock()
+	defer d.traceLk.Unlock()
+
+	ret := make([]TraceSinkStats, 0, len(d.traceSinks))
+	for _, sink := range d.traceSinks {
+		sink.lk.Lock()
+		ret = append(ret, sink.stats)
+		sink.lk.Unlock()
+	}
+	return ret
+}
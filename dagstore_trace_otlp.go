@@ -0,0 +1,152 @@
+package dagstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// OTLPTraceSink is a TraceSink that exports traces to an OpenTelemetry
+// collector as log records, through the OTLP/HTTP protocol with the JSON
+// encoding. Each trace is exported in its own request, so it's best paired
+// with a generous TraceSinkOpts.BufferSize.
+type OTLPTraceSink struct {
+	endpoint string
+	client   *http.Client
+	resource []otlpKeyValue
+}
+
+// NewOTLPTraceSink creates an OTLPTraceSink exporting to the logs endpoint of
+// a collector, e.g. http://localhost:4318/v1/logs. The service name is
+// reported as the service.name attribute of the exported resource. If client
+// is nil, http.DefaultClient is used.
+func NewOTLPTraceSink(endpoint, serviceName string, client *http.Client) *OTLPTraceSink {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &OTLPTraceSink{
+		endpoint: endpoint,
+		client:   client,
+		resource: []otlpKeyValue{otlpString("service.name", serviceName)},
+	}
+}
+
+// The types below are the subset of the OTLP JSON encoding of logs used by
+// OTLPTraceSink. 64-bit integers are encoded as strings, as per the protobuf
+// JSON mapping.
+type (
+	otlpLogsRequest struct {
+		ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+	}
+	otlpResourceLogs struct {
+		Resource  otlpResource    `json:"resource"`
+		ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeLogs struct {
+		Scope      otlpScope       `json:"scope"`
+		LogRecords []otlpLogRecord `json:"logRecords"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpLogRecord struct {
+		ObservedTimeUnixNano string         `json:"observedTimeUnixNano"`
+		SeverityNumber       int            `json:"severityNumber"`
+		SeverityText         string         `json:"severityText"`
+		Body                 otlpAnyValue   `json:"body"`
+		Attributes           []otlpKeyValue `json:"attributes"`
+	}
+	otlpKeyValue struct {
+		Key   string       `json:"key"`
+		Value otlpAnyValue `json:"value"`
+	}
+	otlpAnyValue struct {
+		StringValue *string `json:"stringValue,omitempty"`
+		IntValue    *string `json:"intValue,omitempty"`
+	}
+)
+
+// OTLP severity numbers of the levels traces are exported with.
+const (
+	otlpSeverityInfo  = 9
+	otlpSeverityError = 17
+)
+
+func otlpString(key, v string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: &v}}
+}
+
+func otlpInt(key string, v int64) otlpKeyValue {
+	s := strconv.FormatInt(v, 10)
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{IntValue: &s}}
+}
+
+// logRecord converts a trace to a log record. Traces don't record when the
+// operation happened, so only the observed time is set.
+func (o *OTLPTraceSink) logRecord(t Trace) otlpLogRecord {
+	op := t.Op.String()
+	rec := otlpLogRecord{
+		ObservedTimeUnixNano: strconv.FormatInt(time.Now().UnixNano(), 10),
+		SeverityNumber:       otlpSeverityInfo,
+		SeverityText:         "INFO",
+		Body:                 otlpAnyValue{StringValue: &op},
+		Attributes: []otlpKeyValue{
+			otlpString("dagstore.shard.key", t.Key.String()),
+			otlpString("dagstore.op", op),
+			otlpString("dagstore.shard.state", t.After.ShardState.String()),
+			otlpInt("dagstore.seq", int64(t.Seq)),
+			otlpInt("dagstore.shard.seq", int64(t.ShardSeq)),
+		},
+	}
+	if t.After.Error != nil {
+		rec.SeverityNumber, rec.SeverityText = otlpSeverityError, "ERROR"
+		rec.Attributes = append(rec.Attributes, otlpString("dagstore.error", t.After.Error.Error()))
+	}
+	if t.Caller != "" {
+		rec.Attributes = append(rec.Attributes, otlpString("dagstore.caller", t.Caller))
+	}
+	if t.Progress != nil {
+		rec.Attributes = append(rec.Attributes,
+			otlpInt("dagstore.fetch.transferred", t.Progress.Transferred),
+			otlpInt("dagstore.fetch.total", t.Progress.Total))
+	}
+	return rec
+}
+
+func (o *OTLPTraceSink) WriteTrace(ctx context.Context, t Trace) error {
+	body, err := json.Marshal(otlpLogsRequest{ResourceLogs: []otlpResourceLogs{{
+		Resource: otlpResource{Attributes: o.resource},
+		ScopeLogs: []otlpScopeLogs{{
+			Scope:      otlpScope{Name: "github.com/filecoin-project/dagstore"},
+			LogRecords: []otlpLogRecord{o.logRecord(t)},
+		}},
+	}}})
+	if err != nil {
+		return fmt.Errorf("failed to encode trace: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create OTLP request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to export trace: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("failed to export trace: collector returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package dagstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// TraceFilter selects the traces returned by DAGStore.RecentTraces. The zero
+// value selects all of them.
+type TraceFilter struct {
+	// Keys, if not empty, selects the traces of these shards only.
+	Keys []shard.Key
+	// Ops, if not empty, selects the traces of these operations only.
+	Ops []OpType
+	// AfterSeq selects the traces with a sequence number greater than this
+	// one, e.g. to poll for traces past the last one seen.
+	AfterSeq uint64
+	// ErrorsOnly selects the traces of shards carrying an error only.
+	ErrorsOnly bool
+	// Limit, if positive, selects at most this many of the most recent
+	// matching traces.
+	Limit int
+}
+
+func (f *TraceFilter) match(t *Trace) bool {
+	if t.Seq <= f.AfterSeq {
+		return false
+	}
+	if f.ErrorsOnly && t.After.Error == nil {
+		return false
+	}
+	if len(f.Keys) > 0 {
+		var ok bool
+		for _, k := range f.Keys {
+			ok = ok || k == t.Key
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(f.Ops) > 0 {
+		var ok bool
+		for _, op := range f.Ops {
+			ok = ok || op == t.Op
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// traceRing holds the most recent traces (see Config.RecentTracesSize).
+type traceRing struct {
+	lk     sync.Mutex
+	traces []Trace // guarded by lk; a ring buffer once full.
+	next   int     // guarded by lk; the index the next trace is written to.
+}
+
+func newTraceRing(size int) *traceRing {
+	return &traceRing{traces: make([]Trace, 0, size)}
+}
+
+func (r *traceRing) push(t Trace) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	if len(r.traces) < cap(r.traces) {
+		r.traces = append(r.traces, t)
+		return
+	}
+	r.traces[r.next] = t
+	r.next = (r.next + 1) % len(r.traces)
+}
+
+// all returns the traces in the ring, oldest first.
+func (r *traceRing) all() []Trace {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	ret := make([]Trace, 0, len(r.traces))
+	ret = append(ret, r.traces[r.next:]...)
+	return append(ret, r.traces[:r.next]...)
+}
+
+// RecentTraces returns the most recent traces matching the filter, oldest
+// first. Up to Config.RecentTracesSize traces are kept, whether or not a trace
+// channel or sinks are attached, so that tools can inspect recent activity
+// after the fact. It returns nil if recent traces aren't kept.
+func (d *DAGStore) RecentTraces(filter TraceFilter) []Trace {
+	if d.recentTraces == nil {
+		return nil
+	}
+	var ret []Trace
+	for _, t := range d.recentTraces.all() {
+		if filter.match(&t) {
+			ret = append(ret, t)
+		}
+	}
+	if filter.Limit > 0 && len(ret) > filter.Limit {
+		ret = ret[len(ret)-filter.Limit:]
+	}
+	return ret
+}
+
+// tracing returns whether traces need to be emitted.
+func (d *DAGStore) tracing() bool {
+	if d.traceChSink != nil || d.recentTraces != nil {
+		return true
+	}
+	d.traceLk.Lock()
+	defer d.traceLk.Unlock()
+	return len(d.traceSinks) > 0
+}
+
+// persistedTrace is the persisted representation of a trace in the ring.
+type persistedTrace struct {
+	Seq      uint64     `json:"seq"`
+	ShardSeq uint64     `json:"shard_seq"`
+	Key      string     `json:"key"`
+	Op       OpType     `json:"op"`
+	State    ShardState `json:"state"`
+	Error    string     `json:"err,omitempty"`
+
+	Transferred int64 `json:"transferred,omitempty"`
+	Total       int64 `json:"total,omitempty"`
+}
+
+// persistRecentTraces saves the traces in the ring to the datastore, under
+// TracesNamespace, so that they're restored on the next start.
+func (d *DAGStore) persistRecentTraces(ctx context.Context) error {
+	traces := d.recentTraces.all()
+	ps := make([]persistedTrace, 0, len(traces))
+	for _, t := range traces {
+		p := persistedTrace{
+			Seq:      t.Seq,
+			ShardSeq: t.ShardSeq,
+			Key:      t.Key.String(),
+			Op:       t.Op,
+			State:    t.After.ShardState,
+		}
+		if t.After.Error != nil {
+			p.Error = t.After.Error.Error()
+		}
+		if t.Progress != nil {
+			p.Transferred, p.Total = t.Progress.Transferred, t.Progress.Total
+		}
+		ps = append(ps, p)
+	}
+	bz, err := json.Marshal(ps)
+	if err != nil {
+		return fmt.Errorf("failed to serialize recent traces: %w", err)
+	}
+	if err := d.tracesStore.Put(ctx, d.config.DatastoreNamespace, bz); err != nil {
+		return fmt.Errorf("failed to persist recent traces: %w", err)
+	}
+	return d.tracesStore.Sync(ctx, d.config.DatastoreNamespace)
+}
+
+// restoreRecentTraces loads the persisted traces into the ring, and resumes
+// the trace sequence after them. Restored errors retain their message only.
+func (d *DAGStore) restoreRecentTraces(ctx context.Context) error {
+	bz, err := d.tracesStore.Get(ctx, d.config.DatastoreNamespace)
+	if errors.Is(err, ds.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get recent traces: %w", err)
+	}
+	var ps []persistedTrace
+	if err := json.Unmarshal(bz, &ps); err != nil {
+		return fmt.Errorf("failed to decode recent traces: %w", err)
+	}
+
+	d.traceLk.Lock()
+	defer d.traceLk.Unlock()
+	for _, p := range ps {
+		t := Trace{
+			Key:      shard.KeyFromString(p.Key),
+			Op:       p.Op,
+			After:    ShardInfo{ShardState: p.State},
+			Seq:      p.Seq,
+			ShardSeq: p.ShardSeq,
+		}
+		if p.Error != "" {
+			t.After.Error = errors.New(p.Error)
+		}
+		if p.Op == OpShardFetchProgress {
+			t.Progress = &FetchProgress{Transferred: p.Transferred, Total: p.Total}
+		}
+		d.recentTraces.push(t)
+		if p.Seq > d.traceSeq {
+			d.traceSeq = p.Seq
+		}
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+package dagstore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/shard"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// ShardTxn stages shard registrations and destroys, to be applied atomically
+// by DAGStore.Txn. It must not be used outside of the Txn callback.
+type ShardTxn struct {
+	d *DAGStore
+
+	registers []txnRegister
+	destroys  []txnDestroy
+	keys      map[shard.Key]struct{}
+}
+
+type txnRegister struct {
+	key  shard.Key
+	mnt  mount.Mount
+	out  chan ShardResult
+	opts RegisterOpts
+}
+
+type txnDestroy struct {
+	key  shard.Key
+	out  chan ShardResult
+	opts DestroyOpts
+}
+
+// RegisterShard stages the registration of a shard, like
+// DAGStore.RegisterShard. The result of the registration is sent to out, if
+// non-nil, once the transaction is committed and the shard is initialized.
+func (tx *ShardTxn) RegisterShard(key shard.Key, mnt mount.Mount, out chan ShardResult, opts RegisterOpts) error {
+	if err := key.Validate(); err != nil {
+		return fmt.Errorf("%s: %w", key.String(), err)
+	}
+	if err := tx.stage(key); err != nil {
+		return err
+	}
+	tx.registers = append(tx.registers, txnRegister{key: key, mnt: mnt, out: out, opts: opts})
+	return nil
+}
+
+// DestroyShard stages the destroy of a shard, like DAGStore.DestroyShard. The
+// result of the destroy is sent to out, if non-nil, once the transaction is
+// committed and the shard is destroyed.
+func (tx *ShardTxn) DestroyShard(key shard.Key, out chan ShardResult, opts DestroyOpts) error {
+	if err := tx.stage(key); err != nil {
+		return err
+	}
+	tx.destroys = append(tx.destroys, txnDestroy{key: key, out: out, opts: opts})
+	return nil
+}
+
+func (tx *ShardTxn) stage(key shard.Key) error {
+	if _, ok := tx.keys[key]; ok {
+		return fmt.Errorf("%s: shard already staged in transaction", key.String())
+	}
+	tx.keys[key] = struct{}{}
+	return nil
+}
+
+// Txn registers and destroys a set of shards atomically, from the viewpoint of
+// the shard registry: either all the operations staged by fn are persisted,
+// or none is. This is useful when a single deal maps to several shards.
+//
+// If fn returns an error, nothing is applied. Otherwise, all the operations
+// are validated (registered keys must be free, destroyed shards must exist and
+// be destroyable, and operation hooks must not veto the destroys), persisted
+// in a single datastore batch, and then carried out asynchronously like their
+// non-transactional counterparts; Txn returns once they're persisted. If the
+// process stops before they complete, they are resumed on start.
+//
+// Txn requires Config.Datastore to support batching.
+func (d *DAGStore) Txn(ctx context.Context, fn func(tx *ShardTxn) error) error {
+	tx := &ShardTxn{d: d, keys: make(map[shard.Key]struct{})}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if len(tx.registers) == 0 && len(tx.destroys) == 0 {
+		return nil
+	}
+	if d.config.ReadOnly {
+		return ErrReadOnly
+	}
+	if d.isFenced() {
+		return ErrLockLost
+	}
+
+	bds, ok := d.config.Datastore.(ds.Batching)
+	if !ok {
+		return fmt.Errorf("transactions require a batching datastore")
+	}
+
+	// reserve the keys of the registered shards, and create them.
+	registered, err := d.reserveTxnShards(tx.registers)
+	if err != nil {
+		return err
+	}
+	defer d.releaseTxnKeys(tx.registers)
+
+	// lock the destroyed shards, in a consistent order to prevent deadlocks
+	// with concurrent transactions, and check that they can be destroyed.
+	destroyed, unlock, err := d.lockTxnDestroys(tx.destroys)
+	if err != nil {
+		return err
+	}
+
+	// persist the new shards and the tombstones in a single batch. The
+	// destroyed shards stay persisted as tombstoned until the event loop
+	// tombstones them.
+	for _, s := range destroyed {
+		s.txnTombstone = true
+	}
+	if err := d.persistTxn(ctx, bds, registered, destroyed); err != nil {
+		for _, s := range destroyed {
+			s.txnTombstone = false
+		}
+		unlock()
+		return fmt.Errorf("failed to persist transaction: %w", err)
+	}
+	unlock()
+
+	// carry out the destroys through the event loop, like DestroyShard, so
+	// that they queue up while paused.
+	for i, s := range destroyed {
+		op := tx.destroys[i]
+		w := &waiter{ctx: ctx, outCh: op.out, destroyOpts: op.opts}
+		_ = d.queueTask(&task{op: OpShardDestroy, shard: s, waiter: w, committed: true}, d.externalCh)
+	}
+
+	// add the registered shards to the catalogue, and queue their
+	// registration.
+	d.lk.Lock()
+	for _, s := range registered {
+		d.addShard(s)
+	}
+	d.lk.Unlock()
+	for i, s := range registered {
+		op := tx.registers[i]
+		_ = d.queueTask(&task{op: OpShardRegister, shard: s, waiter: &waiter{ctx: ctx, outCh: op.out}}, d.externalCh)
+	}
+	return nil
+}
+
+// reserveTxnShards checks that the keys of the shards registered by a
+// transaction are free and within quotas, reserves them, and creates the
+// shards.
+func (d *DAGStore) reserveTxnShards(registers []txnRegister) ([]*Shard, error) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+
+	if d.paused && len(registers) > 0 {
+		return nil, ErrPaused
+	}
+
+	pending := make(map[string]int)
+	shards := make([]*Shard, 0, len(registers))
+	for _, op := range registers {
+		_, registered := d.shards[op.key]
+		_, writing := d.writing[op.key]
+		_, inTxn := d.txnKeys[op.key]
+		if registered || writing || inTxn {
+			return nil, fmt.Errorf("%s: %w", op.key.String(), ErrShardExists)
+		}
+		if _, ok := d.sweeping[op.key]; ok {
+			return nil, fmt.Errorf("%s: %w", op.key.String(), ErrIndexSweeping)
+		}
+		ns := op.key.Namespace()
+		if err := d.checkShardQuota(op.key, pending[ns]); err != nil {
+			return nil, err
+		}
+		pending[ns]++
+
+		s, err := d.newShard(op.key, op.mnt, op.opts)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op.key.String(), err)
+		}
+		shards = append(shards, s)
+	}
+	for _, op := range registers {
+		d.txnKeys[op.key] = struct{}{}
+	}
+	return shards, nil
+}
+
+// releaseTxnKeys releases the reservations of reserveTxnShards.
+func (d *DAGStore) releaseTxnKeys(registers []txnRegister) {
+	d.lk.Lock()
+	for _, op := range registers {
+		delete(d.txnKeys, op.key)
+	}
+	d.lk.Unlock()
+}
+
+// lockTxnDestroys locks the shards destroyed by a transaction, and checks that
+// they can be destroyed. On success, the caller must call unlock.
+func (d *DAGStore) lockTxnDestroys(destroys []txnDestroy) (shards []*Shard, unlock func(), err error) {
+	d.lk.RLock()
+	for _, op := range destroys {
+		s, ok := d.shards[op.key]
+		if !ok {
+			d.lk.RUnlock()
+			return nil, nil, fmt.Errorf("%s: %w", op.key.String(), ErrShardUnknown)
+		}
+		shards = append(shards, s)
+	}
+	d.lk.RUnlock()
+
+	order := make([]*Shard, len(shards))
+	copy(order, shards)
+	sort.Slice(order, func(i, j int) bool { return order[i].key.String() < order[j].key.String() })
+
+	var locked []*Shard
+	unlock = func() {
+		for _, s := range locked {
+			s.lk.Unlock()
+		}
+	}
+	for _, s := range order {
+		s.lk.Lock()
+		locked = append(locked, s)
+	}
+
+	for i, s := range shards {
+		switch op := destroys[i]; {
+		case s.destroyed:
+			err = fmt.Errorf("%s: %w", s.key.String(), ErrShardUnknown)
+		case s.state == ShardStateTombstoned:
+			err = fmt.Errorf("%s: %w", s.key.String(), ErrShardTombstoned)
+		case s.refs > 0 && op.opts.DrainTimeout <= 0:
+			err = fmt.Errorf("%s: failed to destroy shard; active references: %d", s.key.String(), s.refs)
+		default:
+			err = d.beforeOp(s, &task{op: OpShardDestroy, shard: s})
+		}
+		if err != nil {
+			unlock()
+			return nil, nil, err
+		}
+	}
+	return shards, unlock, nil
+}
+
+// persistTxn persists the registered shards and the tombstones of the
+// destroyed shards of a transaction in a single batch. The destroyed shards
+// must be locked, and marked with txnTombstone.
+func (d *DAGStore) persistTxn(ctx context.Context, bds ds.Batching, registered, destroyed []*Shard) error {
+	b, err := bds.Batch(ctx)
+	if err != nil {
+		return err
+	}
+	for _, s := range registered {
+		ps, err := s.MarshalJSON()
+		if err != nil {
+			return fmt.Errorf("failed to serialize shard state: %w", err)
+		}
+		if err := b.Put(ctx, ds.NewKey(s.key.String()), ps); err != nil {
+			return err
+		}
+	}
+	for _, s := range destroyed {
+		ps, err := s.MarshalJSON()
+		if err != nil {
+			return fmt.Errorf("failed to serialize shard state: %w", err)
+		}
+		if err := b.Put(ctx, ds.NewKey(s.key.String()), ps); err != nil {
+			return err
+		}
+	}
+	if err := b.Commit(ctx); err != nil {
+		return err
+	}
+	return bds.Sync(ctx, ds.Key{})
+}
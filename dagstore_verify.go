@@ -0,0 +1,308 @@
+package dagstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ipld/go-car/v2"
+	carindex "github.com/ipld/go-car/v2/index"
+	mh "github.com/multiformats/go-multihash"
+
+	"github.com/filecoin-project/dagstore/index"
+	"github.com/filecoin-project/dagstore/shard"
+	"github.com/filecoin-project/dagstore/throttle"
+)
+
+// VerifyIndexOpts are the options for VerifyIndex and VerifyAll.
+type VerifyIndexOpts struct {
+	// Repair, if true, replaces the stored full index with the recomputed one
+	// when they don't match, and adds the recomputed entries to the top-level
+	// index. Entries that are only present in the stored index are not
+	// removed from the top-level index.
+	Repair bool
+}
+
+// IndexVerifyResult is the outcome of verifying the index of a shard.
+type IndexVerifyResult struct {
+	Key shard.Key
+
+	// Entries is the number of entries in the recomputed index, excluding
+	// identity CIDs.
+	Entries int
+	// StoredMissing is true if there was no stored full index for the shard.
+	StoredMissing bool
+	// Missing is the number of entries present in the CAR but absent from
+	// the stored index.
+	Missing int
+	// Unexpected is the number of entries present in the stored index but
+	// absent from the CAR.
+	Unexpected int
+	// Repaired is true if the stored index was replaced by the recomputed one.
+	Repaired bool
+
+	// Error is the error that prevented verification, if any. Only set in
+	// results returned by VerifyAll.
+	Error error
+}
+
+// OK returns whether the stored index matches the CAR.
+func (r *IndexVerifyResult) OK() bool {
+	return r.Error == nil && !r.StoredMissing && r.Missing == 0 && r.Unexpected == 0
+}
+
+// VerifyIndex verifies the integrity of the stored full index of a shard. It
+// re-reads the CAR from the shard's mount, bypassing its transient, recomputes
+// its index, and compares it with the stored one, reporting mismatches. If
+// opts.Repair is set, a mismatching index is replaced with the recomputed one.
+//
+// The shard must have been initialized. Verification runs outside the event
+// loop, under the indexing throttle.
+func (d *DAGStore) VerifyIndex(ctx context.Context, key shard.Key, opts VerifyIndexOpts) (*IndexVerifyResult, error) {
+	d.lk.RLock()
+	s, ok := d.shards[key]
+	d.lk.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", key.String(), ErrShardUnknown)
+	}
+
+	s.lk.RLock()
+	state := s.state
+	s.lk.RUnlock()
+	if state == ShardStateNew || state == ShardStateInitializing || state == ShardStateArchived {
+		return nil, fmt.Errorf("shard %s is not initialized; state: %s", key, state)
+	}
+
+	var computed carindex.Index
+	err := d.throttleIndex.Do(ctx, func(ctx context.Context) error {
+		var err error
+		computed, err = d.recomputeIndex(ctx, s)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to recompute index for shard %s: %w", key, d.redact(err))
+	}
+
+	res := &IndexVerifyResult{Key: key}
+	computedEntries, err := indexEntries(computed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to iterate over recomputed index for shard %s: %w", key, err)
+	}
+	for _, offsets := range computedEntries {
+		res.Entries += len(offsets)
+	}
+
+	stored, err := d.indices.GetFullIndex(key)
+	switch {
+	case errors.Is(err, index.ErrNotFound):
+		res.StoredMissing = true
+		res.Missing = res.Entries
+	case err != nil:
+		return nil, fmt.Errorf("failed to get stored index for shard %s: %w", key, err)
+	default:
+		storedEntries, err := indexEntries(stored)
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate over stored index for shard %s: %w", key, err)
+		}
+		res.Missing = diffEntries(computedEntries, storedEntries)
+		res.Unexpected = diffEntries(storedEntries, computedEntries)
+	}
+
+	if res.OK() {
+		return res, nil
+	}
+	log.Warnw("index verification found mismatches", "shard", key, "stored_missing", res.StoredMissing,
+		"missing", res.Missing, "unexpected", res.Unexpected)
+
+	if !opts.Repair {
+		return res, nil
+	}
+	if err := d.indices.AddFullIndex(key, computed); err != nil {
+		return res, fmt.Errorf("failed to replace index for shard %s: %w", key, err)
+	}
+	atomic.StoreUint64(&s.indexedBlocks, countIndexed(computed))
+	if iterableIdx, ok := computed.(carindex.IterableIndex); ok && !s.skipTopLevel {
+		if err := d.addToInverted(ctx, key, iterableIdx); err != nil {
+			return res, fmt.Errorf("failed to add shard multihashes to the inverted index: %w", err)
+		}
+	}
+	res.Repaired = true
+	log.Infow("repaired index", "shard", key)
+	return res, nil
+}
+
+// VerifyAll verifies the indices of all initialized shards, running at most
+// concurrency verifications at once (unbounded if concurrency <= 0). Errors
+// verifying individual shards are reported in their results.
+//
+// VerifyAll only returns an error if the context is cancelled.
+func (d *DAGStore) VerifyAll(ctx context.Context, concurrency int, opts VerifyIndexOpts) (map[shard.Key]*IndexVerifyResult, error) {
+	var keys []shard.Key
+	d.lk.RLock()
+	for k, s := range d.shards {
+		s.lk.RLock()
+		if s.state != ShardStateNew && s.state != ShardStateInitializing {
+			keys = append(keys, k)
+		}
+		s.lk.RUnlock()
+	}
+	d.lk.RUnlock()
+
+	thr := throttle.Noop()
+	if concurrency > 0 {
+		thr = throttle.Fixed(concurrency)
+	}
+
+	var (
+		wg  sync.WaitGroup
+		lk  sync.Mutex
+		ret = make(map[shard.Key]*IndexVerifyResult, len(keys))
+	)
+	for _, k := range keys {
+		k := k
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = thr.Do(ctx, func(ctx context.Context) error {
+				res, err := d.VerifyIndex(ctx, k, opts)
+				if err != nil {
+					res = &IndexVerifyResult{Key: k, Error: err}
+				}
+				lk.Lock()
+				ret[k] = res
+				lk.Unlock()
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return ret, err
+	}
+	return ret, nil
+}
+
+// recomputeIndex generates a fresh index from the CAR data of the shard,
+// ignoring any index embedded in the CAR. The data is read from the mount of
+// the shard itself, bypassing its transient, so that the index is checked
+// against the source of the data rather than a local copy of it. It's read
+// sequentially, as the mount may not support random access.
+func (d *DAGStore) recomputeIndex(ctx context.Context, s *Shard) (carindex.Index, error) {
+	reader, err := s.mount.Underlying().Fetch(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch from mount: %w", err)
+	}
+	defer reader.Close()
+
+	dr, err := carDataPayload(reader)
+	if err != nil {
+		return nil, err
+	}
+	// use the same options as initialization, so the indices are comparable.
+	return car.GenerateIndex(&sequentialReader{Reader: dr}, car.ZeroLengthSectionAsEOF(true), car.StoreIdentityCIDs(true))
+}
+
+// carDataPayload returns a reader of the CARv1 data payload of a CARv1 or
+// CARv2 read sequentially from r.
+func carDataPayload(r io.Reader) (io.Reader, error) {
+	// the CARv1 header is read back along with the payload.
+	var head bytes.Buffer
+	version, err := car.ReadVersion(io.TeeReader(r, &head))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CAR version: %w", err)
+	}
+	switch version {
+	case 1:
+		return io.MultiReader(&head, r), nil
+	case 2:
+	default:
+		return nil, fmt.Errorf("unsupported CAR version: %d", version)
+	}
+
+	var h car.Header
+	if _, err := h.ReadFrom(r); err != nil {
+		return nil, fmt.Errorf("failed to read CARv2 header: %w", err)
+	}
+	skip := int64(h.DataOffset) - car.PragmaSize - car.HeaderSize
+	if skip < 0 {
+		return nil, fmt.Errorf("invalid CARv2 data offset: %d", h.DataOffset)
+	}
+	if _, err := io.CopyN(io.Discard, r, skip); err != nil {
+		return nil, fmt.Errorf("failed to read CARv2 data payload: %w", err)
+	}
+	return io.LimitReader(r, int64(h.DataSize)), nil
+}
+
+// sequentialReader tracks the offset of a sequential reader, so that the index
+// generator, which gets section offsets by seeking, doesn't mistake it for a
+// reader positioned at the start of the data.
+type sequentialReader struct {
+	io.Reader
+	off int64
+}
+
+func (r *sequentialReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.off += int64(n)
+	return n, err
+}
+
+// Seek only supports getting the current offset, and skipping forward.
+func (r *sequentialReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		offset -= r.off
+	case io.SeekCurrent:
+	default:
+		return 0, fmt.Errorf("unsupported seek whence: %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.New("cannot seek backwards in sequential reader")
+	}
+	if _, err := io.CopyN(io.Discard, r, offset); err != nil {
+		return 0, err
+	}
+	return r.off, nil
+}
+
+// indexEntries returns the entries of an index as a map of multihash to
+// offsets. Identity multihashes are skipped: blocks with identity CIDs are
+// resolved inline, and indices embedded in CARv2 files usually omit them.
+func indexEntries(idx carindex.Index) (map[string]map[uint64]struct{}, error) {
+	iterableIdx, ok := idx.(carindex.IterableIndex)
+	if !ok {
+		return nil, fmt.Errorf("index of type %T is not iterable", idx)
+	}
+	ret := make(map[string]map[uint64]struct{})
+	err := iterableIdx.ForEach(func(h mh.Multihash, offset uint64) error {
+		if dh, err := mh.Decode(h); err == nil && dh.Code == mh.IDENTITY {
+			return nil
+		}
+		offsets, ok := ret[string(h)]
+		if !ok {
+			offsets = make(map[uint64]struct{}, 1)
+			ret[string(h)] = offsets
+		}
+		offsets[offset] = struct{}{}
+		return nil
+	})
+	return ret, err
+}
+
+// diffEntries returns the number of entries in a that are not in b.
+func diffEntries(a, b map[string]map[uint64]struct{}) int {
+	var n int
+	for h, offsets := range a {
+		for offset := range offsets {
+			if _, ok := b[h][offset]; !ok {
+				n++
+			}
+		}
+	}
+	return n
+}
@@ -0,0 +1,136 @@
+package dagstore
+
+import (
+	"bytes"
+	"runtime/pprof"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Health is the health of the event loop of the DAG store, as seen by the
+// watchdog (see Config.WatchdogTimeout).
+type Health struct {
+	// Healthy is false while any event loop worker is stalled.
+	Healthy bool
+	// Loops is the health of every event loop worker.
+	Loops []LoopHealth
+}
+
+// LoopHealth is the health of an event loop worker.
+type LoopHealth struct {
+	// Queued is the number of tasks waiting to be processed by the worker.
+	// External tasks aren't counted while the DAG store is paused.
+	Queued int
+	// Processed is the number of tasks processed by the worker.
+	Processed uint64
+	// Stalled is true if the worker has had tasks queued without processing
+	// any for longer than Config.WatchdogTimeout, e.g. because it's blocked
+	// sending to a trace or failure channel nobody consumes.
+	Stalled bool
+	// StalledSince is the time since which the worker hasn't made progress,
+	// if it's stalled.
+	StalledSince time.Time
+}
+
+// watchdog tracks the progress of the event loop workers.
+type watchdog struct {
+	// processed holds the number of tasks processed by each worker; accessed
+	// atomically.
+	processed []uint64
+
+	lk sync.Mutex
+	// stalledSince holds the time since which each worker is stalled, or zero
+	// if it isn't; guarded by lk.
+	stalledSince []time.Time
+}
+
+func newWatchdog(loops int) *watchdog {
+	return &watchdog{processed: make([]uint64, loops), stalledSince: make([]time.Time, loops)}
+}
+
+// Health returns the health of the event loop. Workers are only ever reported
+// as stalled if Config.WatchdogTimeout is set.
+func (d *DAGStore) Health() Health {
+	h := Health{Healthy: true, Loops: make([]LoopHealth, len(d.externalCh))}
+	d.watchdog.lk.Lock()
+	defer d.watchdog.lk.Unlock()
+
+	for i := range h.Loops {
+		since := d.watchdog.stalledSince[i]
+		h.Loops[i] = LoopHealth{
+			Queued:       d.queued(i),
+			Processed:    atomic.LoadUint64(&d.watchdog.processed[i]),
+			Stalled:      !since.IsZero(),
+			StalledSince: since,
+		}
+		if !since.IsZero() {
+			h.Healthy = false
+		}
+	}
+	return h
+}
+
+// queued returns the number of tasks waiting for the i-th event loop worker.
+func (d *DAGStore) queued(i int) int {
+	n := len(d.internalCh[i]) + len(d.completionCh[i])
+	d.lk.RLock()
+	if !d.paused {
+		n += len(d.externalCh[i])
+	}
+	d.lk.RUnlock()
+	return n
+}
+
+// watch periodically checks that every event loop worker with tasks queued is
+// making progress. Workers that haven't processed a task for longer than
+// Config.WatchdogTimeout are reported as stalled, and a dump of all
+// goroutines is logged to help find what they're blocked on.
+func (d *DAGStore) watch() {
+	defer d.wg.Done()
+
+	timeout := d.config.WatchdogTimeout
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+
+	loops := len(d.externalCh)
+	last := make([]uint64, loops)
+	idleSince := make([]time.Time, loops) // since when each worker has had tasks queued without progress.
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.ctx.Done():
+			return
+		}
+
+		now := time.Now()
+		for i := 0; i < loops; i++ {
+			processed := atomic.LoadUint64(&d.watchdog.processed[i])
+			progressed := processed != last[i] || d.queued(i) == 0
+			last[i] = processed
+
+			d.watchdog.lk.Lock()
+			wasStalled := !d.watchdog.stalledSince[i].IsZero()
+			switch {
+			case progressed:
+				idleSince[i] = time.Time{}
+				d.watchdog.stalledSince[i] = time.Time{}
+			case idleSince[i].IsZero():
+				idleSince[i] = now
+			case now.Sub(idleSince[i]) >= timeout:
+				d.watchdog.stalledSince[i] = idleSince[i]
+			}
+			stalled := !d.watchdog.stalledSince[i].IsZero()
+			d.watchdog.lk.Unlock()
+
+			switch {
+			case stalled && !wasStalled:
+				var buf bytes.Buffer
+				_ = pprof.Lookup("goroutine").WriteTo(&buf, 2)
+				log.Errorw("event loop stalled; tasks are queued but none was processed", "loop", i, "since", idleSince[i], "queued", d.queued(i), "goroutines", buf.String())
+			case !stalled && wasStalled:
+				log.Infow("event loop no longer stalled", "loop", i)
+			}
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package dagstore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2"
+	carblockstore "github.com/ipld/go-car/v2/blockstore"
+	carindex "github.com/ipld/go-car/v2/index"
+
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+type ShardWriterOpts struct {
+	// Roots are the roots of the CAR of the shard. At least one is required.
+	Roots []cid.Cid
+
+	// RegisterOpts are the options the shard is registered with on commit.
+	// ExistingTransient and LazyInitialization are ignored.
+	RegisterOpts RegisterOpts
+}
+
+// ShardWriter ingests blocks into a new shard. Blocks are streamed into a
+// CARv2 under Config.WrittenShardsDir, and the shard is only registered once
+// the writer is committed, directly as available, without re-indexing it.
+//
+// A ShardWriter is safe for concurrent use. It must be committed or discarded
+// once done.
+type ShardWriter struct {
+	d    *DAGStore
+	key  shard.Key
+	path string
+	opts RegisterOpts
+
+	lk     sync.Mutex
+	bs     *carblockstore.ReadWrite // guarded by lk
+	closed bool                     // guarded by lk
+}
+
+// NewShardWriter opens a writer for a new shard under the supplied key. The
+// key is reserved until the writer is committed or discarded; it fails with
+// ErrShardExists if the key is already registered or being written.
+func (d *DAGStore) NewShardWriter(key shard.Key, opts ShardWriterOpts) (*ShardWriter, error) {
+	if err := d.checkWritable(key); err != nil {
+		return nil, err
+	}
+	if d.config.WrittenShardsDir == "" {
+		return nil, fmt.Errorf("written shards dir not configured")
+	}
+	if len(opts.Roots) == 0 {
+		return nil, fmt.Errorf("at least one root is required")
+	}
+
+	path := filepath.Join(d.config.WrittenShardsDir, key.String()+".car")
+	if _, err := d.mounts.Represent(&mount.FileMount{Path: path}); err != nil {
+		return nil, fmt.Errorf("written shards require a registered file mount: %w", err)
+	}
+
+	d.lk.Lock()
+	_, registered := d.shards[key]
+	_, writing := d.writing[key]
+	_, inTxn := d.txnKeys[key]
+	if registered || writing || inTxn {
+		d.lk.Unlock()
+		return nil, fmt.Errorf("%s: %w", key.String(), ErrShardExists)
+	}
+	if _, ok := d.sweeping[key]; ok {
+		d.lk.Unlock()
+		return nil, fmt.Errorf("%s: %w", key.String(), ErrIndexSweeping)
+	}
+	d.writing[key] = path
+	d.lk.Unlock()
+
+	// discard leftovers of a writer that was interrupted, e.g. by a crash.
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		d.releaseWriting(key)
+		return nil, fmt.Errorf("failed to remove stale shard file: %w", err)
+	}
+	bs, err := carblockstore.OpenReadWrite(path, opts.Roots)
+	if err != nil {
+		d.releaseWriting(key)
+		return nil, fmt.Errorf("failed to open shard file: %w", err)
+	}
+
+	return &ShardWriter{d: d, key: key, path: path, opts: opts.RegisterOpts, bs: bs}, nil
+}
+
+// Put writes a block into the shard.
+func (w *ShardWriter) Put(ctx context.Context, blk blocks.Block) error {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+
+	if w.closed {
+		return fmt.Errorf("%s: %w", w.key.String(), ErrShardWriterClosed)
+	}
+	return w.bs.Put(ctx, blk)
+}
+
+// PutMany writes several blocks into the shard.
+func (w *ShardWriter) PutMany(ctx context.Context, blks []blocks.Block) error {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+
+	if w.closed {
+		return fmt.Errorf("%s: %w", w.key.String(), ErrShardWriterClosed)
+	}
+	return w.bs.PutMany(ctx, blks)
+}
+
+// Commit finalizes the CAR of the shard, and registers the shard as
+// available, waiting for the registration to complete. If it fails, the
+// written data is discarded.
+func (w *ShardWriter) Commit(ctx context.Context) error {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+
+	if w.closed {
+		return fmt.Errorf("%s: %w", w.key.String(), ErrShardWriterClosed)
+	}
+	w.closed = true
+	defer w.d.releaseWriting(w.key)
+
+	if err := w.commit(ctx); err != nil {
+		_ = os.Remove(w.path)
+		return err
+	}
+	return nil
+}
+
+func (w *ShardWriter) commit(ctx context.Context) error {
+	d := w.d
+
+	if err := w.bs.Finalize(); err != nil {
+		return fmt.Errorf("failed to finalize shard: %w", err)
+	}
+
+	// load the index written into the CARv2, which the registration adds once
+	// it succeeds, instead of re-indexing the shard.
+	idx, err := readCarIndex(w.path)
+	if err != nil {
+		return err
+	}
+
+	iterableIdx, ok := idx.(carindex.IterableIndex)
+	if !ok {
+		return fmt.Errorf("index of type %T is not iterable", idx)
+	}
+
+	opts := w.opts
+	opts.ExistingTransient = ""
+	opts.LazyInitialization = false
+	opts.DetachedIndex, opts.DetachedIndexPath = nil, ""
+
+	mnt := &mount.FileMount{Path: w.path}
+	ch := make(chan ShardResult, 1)
+	err = d.registerShard(ctx, w.key, mnt, ch, opts, iterableIdx)
+	if err == nil {
+		select {
+		case res := <-ch:
+			err = res.Error
+		case <-ctx.Done():
+			// the registration is underway; it will complete or fail on its
+			// own, so leave the data in place.
+			return ctx.Err()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to register shard: %w", err)
+	}
+	return nil
+}
+
+// Discard aborts the writer, deleting the written data. It's a no-op if the
+// writer was already committed or discarded.
+func (w *ShardWriter) Discard() error {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.d.releaseWriting(w.key)
+
+	w.bs.Discard()
+	if err := os.Remove(w.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// releaseWriting releases the reservation of a key by a ShardWriter.
+func (d *DAGStore) releaseWriting(key shard.Key) {
+	d.lk.Lock()
+	delete(d.writing, key)
+	d.lk.Unlock()
+}
+
+// readCarIndex reads the index embedded in a CARv2 file.
+func readCarIndex(path string) (carindex.Index, error) {
+	r, err := car.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open shard file: %w", err)
+	}
+	defer r.Close()
+
+	ir, err := r.IndexReader()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index of shard: %w", err)
+	}
+	idx, err := carindex.ReadFrom(ir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index of shard: %w", err)
+	}
+	return idx, nil
+}
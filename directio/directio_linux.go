@@ -0,0 +1,33 @@
+//go:build linux
+// +build linux
+
+package directio
+
+import (
+	"os"
+	"syscall"
+)
+
+// setDirect sets or clears O_DIRECT on an open file.
+func setDirect(f *os.File, enabled bool) error {
+	fd := f.Fd()
+	flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_GETFL, 0)
+	if errno != 0 {
+		return errno
+	}
+	if enabled {
+		flags |= syscall.O_DIRECT
+	} else {
+		flags &^= syscall.O_DIRECT
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_SETFL, flags); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// datasync flushes the data of a file to storage, without its metadata unless
+// needed to read the data back.
+func datasync(f *os.File) error {
+	return syscall.Fdatasync(int(f.Fd()))
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package directio
+
+import (
+	"errors"
+	"os"
+)
+
+// setDirect fails on platforms without O_DIRECT, which fall back to buffered
+// writes. Disabling direct IO is a no-op.
+func setDirect(_ *os.File, enabled bool) error {
+	if enabled {
+		return errors.New("direct IO not supported on this platform")
+	}
+	return nil
+}
+
+// datasync flushes the data of a file to storage.
+func datasync(f *os.File) error {
+	return f.Sync()
+}
@@ -0,0 +1,5 @@
+// Package directio provides a writer of files that bypasses the page cache
+// where the platform and filesystem allow it (O_DIRECT on Linux), and batches
+// the flushes of written data to storage, so that writing large files, such as
+// transients and indices, doesn't evict the pages serving retrievals.
+package directio
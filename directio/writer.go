@@ -0,0 +1,180 @@
+package directio
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("dagstore/directio")
+
+const (
+	// blockSize is the alignment of the memory, offsets and lengths of direct
+	// writes, which fits the logical block size of common devices.
+	blockSize = 4096
+
+	// bufferSize is the size of the buffer direct writes are issued from.
+	bufferSize = 256 * blockSize // 1MiB
+)
+
+// DefaultSyncInterval is the default value of Options.SyncInterval.
+var DefaultSyncInterval int64 = 64 << 20 // 64MiB
+
+// Options are options of NewWriter.
+type Options struct {
+	// SyncInterval is the number of bytes written between flushes of the
+	// written data to storage (fdatasync), which bounds the amount of dirty
+	// data, and the stall of the final flush on Close. Defaults to
+	// DefaultSyncInterval.
+	SyncInterval int64
+}
+
+// Writer writes to a file with direct IO, if supported, falling back to
+// buffered writes otherwise. The data written is flushed to storage every
+// Options.SyncInterval bytes, and on Close.
+//
+// A Writer is not safe for concurrent use, and the file must not be written
+// to otherwise until the Writer is closed.
+type Writer struct {
+	f            *os.File
+	syncInterval int64
+
+	direct   bool
+	buf      []byte // aligned; only used with direct IO.
+	n        int    // bytes buffered in buf.
+	unsynced int64  // bytes written since the last flush.
+	closed   bool
+}
+
+var _ io.WriteCloser = (*Writer)(nil)
+
+// NewWriter returns a Writer that writes to the file from its current offset.
+// Direct IO is used if the platform and the filesystem of the file support it,
+// and the offset is block-aligned, e.g. for files just created.
+func NewWriter(f *os.File, opts Options) *Writer {
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = DefaultSyncInterval
+	}
+	w := &Writer{f: f, syncInterval: opts.SyncInterval}
+
+	off, err := f.Seek(0, io.SeekCurrent)
+	switch {
+	case err != nil:
+		log.Debugw("failed to determine file offset; using buffered writes", "path", f.Name(), "error", err)
+	case off%blockSize != 0:
+		log.Debugw("file offset not aligned; using buffered writes", "path", f.Name(), "offset", off)
+	default:
+		if err := setDirect(f, true); err != nil {
+			log.Debugw("direct IO not supported; using buffered writes", "path", f.Name(), "error", err)
+			break
+		}
+		w.direct = true
+		w.buf = alignedBuffer(bufferSize)
+	}
+	return w
+}
+
+// Direct returns whether the Writer is writing with direct IO.
+func (w *Writer) Direct() bool {
+	return w.direct
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed direct IO writer")
+	}
+	if !w.direct {
+		n, err := w.f.Write(p)
+		if err == nil {
+			err = w.wrote(n)
+		}
+		return n, err
+	}
+
+	var written int
+	for len(p) > 0 {
+		c := copy(w.buf[w.n:], p)
+		w.n += c
+		p = p[c:]
+		written += c
+		if w.n == len(w.buf) {
+			if err := w.flushBuffer(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close writes the buffered data, if any, and flushes the written data to
+// storage. It doesn't close the file, which can be used normally afterwards.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	if w.direct {
+		// the length of the tail is unlikely to be aligned, so it's written
+		// with buffered IO.
+		if err := setDirect(w.f, false); err != nil {
+			return fmt.Errorf("failed to disable direct IO: %w", err)
+		}
+		w.direct = false
+		if w.n > 0 {
+			if _, err := w.f.Write(w.buf[:w.n]); err != nil {
+				return err
+			}
+			w.n = 0
+		}
+	}
+	return datasync(w.f)
+}
+
+// flushBuffer writes the full buffer with direct IO.
+func (w *Writer) flushBuffer() error {
+	if _, err := w.f.Write(w.buf[:w.n]); err != nil {
+		if !errors.Is(err, syscall.EINVAL) {
+			return err
+		}
+		// some filesystems accept the flag, but reject direct writes.
+		log.Debugw("direct write rejected; using buffered writes", "path", w.f.Name(), "error", err)
+		if err := setDirect(w.f, false); err != nil {
+			return fmt.Errorf("failed to disable direct IO: %w", err)
+		}
+		w.direct = false
+		if _, err := w.f.Write(w.buf[:w.n]); err != nil {
+			return err
+		}
+	}
+	n := w.n
+	w.n = 0
+	return w.wrote(n)
+}
+
+// wrote accounts for n bytes written, flushing them to storage once
+// syncInterval bytes have been written.
+func (w *Writer) wrote(n int) error {
+	w.unsynced += int64(n)
+	if w.unsynced < w.syncInterval {
+		return nil
+	}
+	w.unsynced = 0
+	return datasync(w.f)
+}
+
+// alignedBuffer returns a buffer of the given size whose memory is aligned to
+// blockSize.
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+blockSize)
+	off := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) & (blockSize - 1)); rem != 0 {
+		off = blockSize - rem
+	}
+	return buf[off : off+size]
+}
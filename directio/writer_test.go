@@ -0,0 +1,75 @@
+package directio
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriter(t *testing.T) {
+	for _, size := range []int{0, 1, blockSize, bufferSize - 1, bufferSize, 3*bufferSize + 123} {
+		data := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(data)
+
+		path := filepath.Join(t.TempDir(), "file")
+		f, err := os.Create(path)
+		require.NoError(t, err)
+
+		// a small sync interval exercises the flushes.
+		w := NewWriter(f, Options{SyncInterval: bufferSize / 2})
+		t.Logf("size=%d direct=%t", size, w.Direct())
+
+		// write in odd-sized chunks.
+		for p := data; len(p) > 0; {
+			n := 7777
+			if n > len(p) {
+				n = len(p)
+			}
+			written, err := w.Write(p[:n])
+			require.NoError(t, err)
+			require.Equal(t, n, written)
+			p = p[n:]
+		}
+		require.NoError(t, w.Close())
+		require.NoError(t, w.Close())
+		_, err = w.Write([]byte("x"))
+		require.Error(t, err)
+		require.NoError(t, f.Close())
+
+		got, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(data, got), "size %d", size)
+	}
+}
+
+func TestWriterUnalignedOffset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	_, err = f.Write([]byte("header"))
+	require.NoError(t, err)
+	w := NewWriter(f, Options{})
+	require.False(t, w.Direct())
+	_, err = w.Write([]byte("body"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	got, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "headerbody", string(got))
+}
+
+func TestAlignedBuffer(t *testing.T) {
+	for i := 0; i < 16; i++ {
+		buf := alignedBuffer(blockSize)
+		require.Len(t, buf, blockSize)
+		require.Zero(t, uintptr(unsafe.Pointer(&buf[0]))%blockSize)
+	}
+}
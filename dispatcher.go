@@ -1,8 +1,49 @@
 package dagstore
 
-// dispatcher takes care of dispatching results back to the application.
+import (
+	"sync/atomic"
+)
+
+// DefaultDispatchWorkers is the default value of Config.DispatchWorkers.
+var DefaultDispatchWorkers = 8
+
+// DefaultDispatchQueueSize is the default value of Config.DispatchQueueSize.
+var DefaultDispatchQueueSize = 128
+
+// DispatchStats are statistics about the delivery of operation results to
+// the application.
+type DispatchStats struct {
+	// Backlog is the number of results queued up, waiting for a dispatcher
+	// worker.
+	Backlog int
+	// Capacity is the size of the dispatch queue; once the backlog reaches it,
+	// the producers of results (including the event loop) block.
+	Capacity int
+	// Workers is the number of dispatcher workers.
+	Workers int
+	// Busy is the number of workers currently waiting for the application to
+	// receive a result.
+	Busy int64
+	// Delivered is the number of results delivered to the application.
+	Delivered uint64
+	// Abandoned is the number of results not delivered because the context
+	// of the operation was cancelled first.
+	Abandoned uint64
+}
+
+// dispatchCounters are the counters of DispatchStats, accessed atomically.
+type dispatchCounters struct {
+	delivered uint64
+	abandoned uint64
+	busy      int64
+}
+
+// dispatcher takes care of dispatching results back to the application. A
+// pool of Config.DispatchWorkers dispatchers services the dispatch queue, so
+// that an application slow to receive a result only ties up one worker.
 //
-// These can be results of API operations, or shard failures.
+// These are results of API operations; shard failures are dispatched by
+// failureDispatcher.
 func (d *DAGStore) dispatcher(ch chan *dispatch) {
 	defer d.wg.Done()
 
@@ -13,11 +54,19 @@ func (d *DAGStore) dispatcher(ch chan *dispatch) {
 		case <-d.ctx.Done():
 			return
 		}
-		di.w.deliver(di.res)
+
+		atomic.AddInt64(&d.dispatchCounters.busy, 1)
+		if di.w.deliver(di.res) {
+			atomic.AddUint64(&d.dispatchCounters.delivered, 1)
+		} else {
+			atomic.AddUint64(&d.dispatchCounters.abandoned, 1)
+		}
+		atomic.AddInt64(&d.dispatchCounters.busy, -1)
 	}
 }
 
 func (d *DAGStore) dispatchResult(res *ShardResult, waiters ...*waiter) {
+	res.Error = d.redact(res.Error)
 	for _, w := range waiters {
 		if w.outCh == nil {
 			// no return channel; skip.
@@ -26,3 +75,17 @@ func (d *DAGStore) dispatchResult(res *ShardResult, waiters ...*waiter) {
 		d.dispatchResultsCh <- &dispatch{w: w, res: res}
 	}
 }
+
+// DispatchStats returns statistics about the delivery of operation results to
+// the application. A growing backlog means that the application isn't
+// receiving results promptly.
+func (d *DAGStore) DispatchStats() DispatchStats {
+	return DispatchStats{
+		Backlog:   len(d.dispatchResultsCh),
+		Capacity:  cap(d.dispatchResultsCh),
+		Workers:   d.config.DispatchWorkers,
+		Busy:      atomic.LoadInt64(&d.dispatchCounters.busy),
+		Delivered: atomic.LoadUint64(&d.dispatchCounters.delivered),
+		Abandoned: atomic.LoadUint64(&d.dispatchCounters.abandoned),
+	}
+}
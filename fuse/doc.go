@@ -0,0 +1,16 @@
+// Package fuse exposes the shards registered in a DAG store as a read-only
+// filesystem, for debugging and ad-hoc data export.
+//
+// In ModeCAR, the root directory holds a file per shard, named after its key
+// with a .car extension, with the CAR data of the shard as its contents. In
+// ModeUnixFS, the root directory holds a directory per shard, which in turn
+// holds the UnixFS DAGs rooted at the roots of its CAR, named after their CIDs.
+// Shard keys are path-escaped in file names.
+//
+// Shards are acquired when their files are opened, and released when they're
+// closed. Directories acquire their shards for the duration of the listing or
+// lookup only.
+//
+// The filesystem is served through FUSE, and so is only available on Linux and
+// FreeBSD, where FUSE must be installed.
+package fuse
@@ -0,0 +1,262 @@
+//go:build linux || freebsd
+// +build linux freebsd
+
+package fuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	fuselib "bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	logging "github.com/ipfs/go-log/v2"
+
+	"github.com/filecoin-project/dagstore"
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+var log = logging.Logger("dagstore/fuse")
+
+// Mode determines how shards are laid out in the filesystem.
+type Mode int
+
+const (
+	// ModeCAR exposes every shard as a CAR file.
+	ModeCAR Mode = iota
+	// ModeUnixFS exposes every shard as a directory holding the UnixFS DAGs
+	// rooted at its roots.
+	ModeUnixFS
+)
+
+// carExt is the extension of the files of shards in ModeCAR.
+const carExt = ".car"
+
+// FS is a read-only filesystem over the shards of a DAG store.
+type FS struct {
+	dagst *dagstore.DAGStore
+	mode  Mode
+}
+
+var _ fusefs.FS = (*FS)(nil)
+
+// New creates a filesystem over the shards of the DAG store, laid out as
+// per mode.
+func New(dagst *dagstore.DAGStore, mode Mode) *FS {
+	return &FS{dagst: dagst, mode: mode}
+}
+
+// Root returns the root directory of the filesystem.
+func (f *FS) Root() (fusefs.Node, error) {
+	return &rootDir{fs: f}, nil
+}
+
+// Serve mounts the filesystem read-only at dir, and serves it until ctx is
+// done, at which point it's unmounted, or until it's unmounted externally.
+func Serve(ctx context.Context, dir string, f *FS) error {
+	c, err := fuselib.Mount(dir, fuselib.ReadOnly(), fuselib.FSName("dagstore"), fuselib.Subtype("dagstore"))
+	if err != nil {
+		return fmt.Errorf("failed to mount filesystem at %s: %w", dir, err)
+	}
+	defer c.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := fuselib.Unmount(dir); err != nil {
+				log.Warnw("failed to unmount filesystem", "dir", dir, "error", err)
+			}
+		case <-done:
+		}
+	}()
+
+	if err := fusefs.Serve(c, f); err != nil {
+		return fmt.Errorf("failed to serve filesystem: %w", err)
+	}
+	return nil
+}
+
+// acquire acquires a shard, closing the accessor if it's delivered after ctx
+// is done.
+func (f *FS) acquire(ctx context.Context, key shard.Key) (*dagstore.ShardAccessor, error) {
+	ch := make(chan dagstore.ShardResult, 1)
+	if err := f.dagst.AcquireShard(ctx, key, ch, dagstore.AcquireOpts{}); err != nil {
+		return nil, toErrno(err)
+	}
+	select {
+	case res := <-ch:
+		if res.Error != nil {
+			return nil, toErrno(res.Error)
+		}
+		return res.Accessor, nil
+	case <-ctx.Done():
+		go func() {
+			if res := <-ch; res.Accessor != nil {
+				_ = res.Accessor.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// toErrno maps errors of the DAG store to the errnos reported through FUSE.
+// Other errors are reported as EIO.
+func toErrno(err error) error {
+	if errors.Is(err, dagstore.ErrShardUnknown) {
+		return fuselib.ENOENT
+	}
+	log.Warnw("failed to access shard", "error", err)
+	return err
+}
+
+// fileName returns the name of the entry of the shard with the given key in
+// the root directory.
+func (f *FS) fileName(key shard.Key) string {
+	name := url.PathEscape(key.String())
+	if f.mode == ModeCAR {
+		name += carExt
+	}
+	return name
+}
+
+// parseFileName returns the key of the shard with the given entry name in
+// the root directory.
+func (f *FS) parseFileName(name string) (shard.Key, bool) {
+	if f.mode == ModeCAR {
+		if !strings.HasSuffix(name, carExt) {
+			return shard.Key{}, false
+		}
+		name = strings.TrimSuffix(name, carExt)
+	}
+	k, err := url.PathUnescape(name)
+	if err != nil {
+		return shard.Key{}, false
+	}
+	return shard.KeyFromString(k), true
+}
+
+// rootDir is the root directory, holding an entry per shard.
+type rootDir struct {
+	fs *FS
+}
+
+var (
+	_ fusefs.HandleReadDirAller = (*rootDir)(nil)
+	_ fusefs.NodeStringLookuper = (*rootDir)(nil)
+)
+
+func (d *rootDir) Attr(_ context.Context, a *fuselib.Attr) error {
+	a.Mode = os.ModeDir | 0555
+	return nil
+}
+
+func (d *rootDir) ReadDirAll(_ context.Context) ([]fuselib.Dirent, error) {
+	typ := fuselib.DT_File
+	if d.fs.mode == ModeUnixFS {
+		typ = fuselib.DT_Dir
+	}
+	var ret []fuselib.Dirent
+	for k, info := range d.fs.dagst.AllShardsInfo() {
+		if info.ShardState == dagstore.ShardStateTombstoned {
+			continue
+		}
+		ret = append(ret, fuselib.Dirent{Name: d.fs.fileName(k), Type: typ})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret, nil
+}
+
+func (d *rootDir) Lookup(_ context.Context, name string) (fusefs.Node, error) {
+	key, ok := d.fs.parseFileName(name)
+	if !ok {
+		return nil, fuselib.ENOENT
+	}
+	info, err := d.fs.dagst.GetShardInfo(key)
+	if err != nil || info.ShardState == dagstore.ShardStateTombstoned {
+		return nil, fuselib.ENOENT
+	}
+	if d.fs.mode == ModeUnixFS {
+		return &shardDir{fs: d.fs, key: key}, nil
+	}
+	return &carFile{fs: d.fs, key: key}, nil
+}
+
+// carFile is the CAR file of a shard, in ModeCAR.
+type carFile struct {
+	// size is the size of the CAR data, accessed atomically, and kept first
+	// for 64-bit alignment. It's only known once the file has been opened, so
+	// files are opened with direct I/O.
+	size int64
+
+	fs  *FS
+	key shard.Key
+}
+
+var _ fusefs.NodeOpener = (*carFile)(nil)
+
+func (n *carFile) Attr(_ context.Context, a *fuselib.Attr) error {
+	a.Mode = 0444
+	a.Size = uint64(atomic.LoadInt64(&n.size))
+	return nil
+}
+
+func (n *carFile) Open(ctx context.Context, req *fuselib.OpenRequest, resp *fuselib.OpenResponse) (fusefs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, fuselib.Errno(syscall.EROFS)
+	}
+	sa, err := n.fs.acquire(ctx, n.key)
+	if err != nil {
+		return nil, err
+	}
+	r, size, err := sa.CAR()
+	if err != nil {
+		_ = sa.Close()
+		return nil, err
+	}
+	atomic.StoreInt64(&n.size, size)
+	resp.Flags |= fuselib.OpenDirectIO
+	return &carHandle{sa: sa, r: r, size: size}, nil
+}
+
+// carHandle is an open CAR file, which holds the shard acquired until it's
+// released.
+type carHandle struct {
+	sa   *dagstore.ShardAccessor
+	r    io.ReaderAt
+	size int64
+}
+
+var (
+	_ fusefs.HandleReader   = (*carHandle)(nil)
+	_ fusefs.HandleReleaser = (*carHandle)(nil)
+)
+
+func (h *carHandle) Read(_ context.Context, req *fuselib.ReadRequest, resp *fuselib.ReadResponse) error {
+	if req.Offset >= h.size {
+		return nil
+	}
+	l := int64(req.Size)
+	if rem := h.size - req.Offset; l > rem {
+		l = rem
+	}
+	buf := make([]byte, l)
+	n, err := h.r.ReadAt(buf, req.Offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	resp.Data = buf[:n]
+	return nil
+}
+
+func (h *carHandle) Release(_ context.Context, _ *fuselib.ReleaseRequest) error {
+	return h.sa.Close()
+}
@@ -0,0 +1,147 @@
+//go:build linux || freebsd
+// +build linux freebsd
+
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	fuselib "bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/dagstore"
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/shard"
+	"github.com/filecoin-project/dagstore/testdata"
+)
+
+func newDAGStore(t *testing.T) *dagstore.DAGStore {
+	dagst, err := dagstore.NewDAGStore(dagstore.Config{
+		MountRegistry: mount.NewRegistry(),
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+	t.Cleanup(func() { _ = dagst.Close() })
+	return dagst
+}
+
+func register(t *testing.T, dagst *dagstore.DAGStore, key shard.Key, mnt mount.Mount) {
+	ch := make(chan dagstore.ShardResult, 1)
+	require.NoError(t, dagst.RegisterShard(context.Background(), key, mnt, ch, dagstore.RegisterOpts{}))
+	require.NoError(t, (<-ch).Error)
+}
+
+// readAll opens a file node, and reads it in full through its handle.
+func readAll(t *testing.T, n fusefs.Node) []byte {
+	ctx := context.Background()
+	var resp fuselib.OpenResponse
+	h, err := n.(fusefs.NodeOpener).Open(ctx, &fuselib.OpenRequest{Flags: fuselib.OpenReadOnly}, &resp)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	for {
+		var rresp fuselib.ReadResponse
+		err := h.(fusefs.HandleReader).Read(ctx, &fuselib.ReadRequest{Offset: int64(buf.Len()), Size: 4096}, &rresp)
+		require.NoError(t, err)
+		if len(rresp.Data) == 0 {
+			break
+		}
+		buf.Write(rresp.Data)
+	}
+	require.NoError(t, h.(fusefs.HandleReleaser).Release(ctx, &fuselib.ReleaseRequest{}))
+	return buf.Bytes()
+}
+
+// requireReleased waits until the shard is no longer acquired.
+func requireReleased(t *testing.T, dagst *dagstore.DAGStore, key shard.Key) {
+	require.Eventually(t, func() bool {
+		info, err := dagst.GetShardInfo(key)
+		return err == nil && info.ShardState == dagstore.ShardStateAvailable
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestCARMode(t *testing.T) {
+	ctx := context.Background()
+	dagst := newDAGStore(t)
+	keys := []shard.Key{shard.KeyFromString("foo"), shard.KeyFromString("bar/baz")}
+	for _, k := range keys {
+		register(t, dagst, k, &mount.BytesMount{Bytes: testdata.CarV2})
+	}
+
+	root, err := New(dagst, ModeCAR).Root()
+	require.NoError(t, err)
+	ents, err := root.(fusefs.HandleReadDirAller).ReadDirAll(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []fuselib.Dirent{
+		{Name: "bar%2Fbaz.car", Type: fuselib.DT_File},
+		{Name: "foo.car", Type: fuselib.DT_File},
+	}, ents)
+
+	for _, name := range []string{"baz.car", "foo", "foo.txt"} {
+		_, err = root.(fusefs.NodeStringLookuper).Lookup(ctx, name)
+		require.Equal(t, fuselib.ENOENT, err)
+	}
+
+	n, err := root.(fusefs.NodeStringLookuper).Lookup(ctx, "bar%2Fbaz.car")
+	require.NoError(t, err)
+	require.Equal(t, testdata.CarV2, readAll(t, n))
+	requireReleased(t, dagst, keys[1])
+
+	// the size is known once opened.
+	var a fuselib.Attr
+	require.NoError(t, n.Attr(ctx, &a))
+	require.EqualValues(t, len(testdata.CarV2), a.Size)
+
+	// writes are rejected.
+	_, err = n.(fusefs.NodeOpener).Open(ctx, &fuselib.OpenRequest{Flags: fuselib.OpenReadWrite}, &fuselib.OpenResponse{})
+	require.Error(t, err)
+}
+
+func TestUnixFSMode(t *testing.T) {
+	ctx := context.Background()
+	dagst := newDAGStore(t)
+
+	dir := t.TempDir()
+	src, err := testdata.CreateRandomFile(dir, 42, 100<<10)
+	require.NoError(t, err)
+	rootCid, path, err := testdata.CreateDenseCARv2(dir, src)
+	require.NoError(t, err)
+
+	key := shard.KeyFromString("foo")
+	register(t, dagst, key, &mount.FileMount{Path: path})
+
+	root, err := New(dagst, ModeUnixFS).Root()
+	require.NoError(t, err)
+	ents, err := root.(fusefs.HandleReadDirAller).ReadDirAll(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []fuselib.Dirent{{Name: "foo", Type: fuselib.DT_Dir}}, ents)
+
+	sd, err := root.(fusefs.NodeStringLookuper).Lookup(ctx, "foo")
+	require.NoError(t, err)
+	ents, err = sd.(fusefs.HandleReadDirAller).ReadDirAll(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []fuselib.Dirent{{Name: rootCid.String(), Type: fuselib.DT_Unknown}}, ents)
+	requireReleased(t, dagst, key)
+
+	_, err = sd.(fusefs.NodeStringLookuper).Lookup(ctx, testdata.RootCID.String())
+	require.Equal(t, fuselib.ENOENT, err)
+
+	// the root is the UnixFS file we imported.
+	n, err := sd.(fusefs.NodeStringLookuper).Lookup(ctx, rootCid.String())
+	require.NoError(t, err)
+	expected, err := os.ReadFile(filepath.Clean(src))
+	require.NoError(t, err)
+
+	var a fuselib.Attr
+	require.NoError(t, n.Attr(ctx, &a))
+	require.EqualValues(t, len(expected), a.Size)
+	require.Equal(t, expected, readAll(t, n))
+	requireReleased(t, dagst, key)
+}
@@ -0,0 +1,301 @@
+//go:build linux || freebsd
+// +build linux freebsd
+
+package fuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+
+	fuselib "bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	uio "github.com/ipfs/go-unixfs/io"
+	carv2 "github.com/ipld/go-car/v2"
+
+	"github.com/filecoin-project/dagstore"
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// nodeGetter loads IPLD nodes from the blockstore of a shard.
+type nodeGetter struct {
+	bs dagstore.ReadBlockstore
+}
+
+var _ format.NodeGetter = (*nodeGetter)(nil)
+
+func (g *nodeGetter) Get(ctx context.Context, c cid.Cid) (format.Node, error) {
+	blk, err := g.bs.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return format.Decode(blk)
+}
+
+func (g *nodeGetter) GetMany(ctx context.Context, cids []cid.Cid) <-chan *format.NodeOption {
+	ch := make(chan *format.NodeOption, len(cids))
+	for _, c := range cids {
+		nd, err := g.Get(ctx, c)
+		ch <- &format.NodeOption{Node: nd, Err: err}
+	}
+	close(ch)
+	return ch
+}
+
+// withDAG acquires a shard, and calls fn with a read-only DAG service over
+// it, releasing the shard once fn returns.
+func (f *FS) withDAG(ctx context.Context, key shard.Key, fn func(sa *dagstore.ShardAccessor, dserv format.DAGService) error) error {
+	sa, err := f.acquire(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer sa.Close()
+
+	bs, err := sa.Blockstore()
+	if err != nil {
+		return err
+	}
+	return fn(sa, merkledag.NewReadOnlyDagService(&nodeGetter{bs: bs}))
+}
+
+// newUnixFSNode returns the filesystem node of a UnixFS node of a shard.
+func (f *FS) newUnixFSNode(key shard.Key, nd format.Node) (fusefs.Node, error) {
+	switch nd := nd.(type) {
+	case *merkledag.RawNode:
+		return &unixfsFile{fs: f, key: key, c: nd.Cid(), size: uint64(len(nd.RawData()))}, nil
+	case *merkledag.ProtoNode:
+		fsn, err := unixfs.FSNodeFromBytes(nd.Data())
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode UnixFS node %s: %w", nd.Cid(), err)
+		}
+		switch fsn.Type() {
+		case unixfs.TDirectory, unixfs.THAMTShard:
+			return &unixfsDir{fs: f, key: key, c: nd.Cid()}, nil
+		case unixfs.TFile, unixfs.TRaw:
+			return &unixfsFile{fs: f, key: key, c: nd.Cid(), size: fsn.FileSize()}, nil
+		}
+		return nil, fmt.Errorf("unsupported UnixFS node %s of type %s", nd.Cid(), fsn.Type())
+	default:
+		return nil, fmt.Errorf("unsupported node %s with codec %d", nd.Cid(), nd.Cid().Type())
+	}
+}
+
+// shardDir is the directory of a shard, in ModeUnixFS, holding an entry per
+// root of its CAR, named after its CID.
+type shardDir struct {
+	fs  *FS
+	key shard.Key
+}
+
+var (
+	_ fusefs.HandleReadDirAller = (*shardDir)(nil)
+	_ fusefs.NodeStringLookuper = (*shardDir)(nil)
+)
+
+func (d *shardDir) Attr(_ context.Context, a *fuselib.Attr) error {
+	a.Mode = os.ModeDir | 0555
+	return nil
+}
+
+// roots returns the roots of the CAR of the shard.
+func roots(sa *dagstore.ShardAccessor) ([]cid.Cid, error) {
+	r, _, err := sa.CAR()
+	if err != nil {
+		return nil, err
+	}
+	cr, err := carv2.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CAR header: %w", err)
+	}
+	return cr.Roots()
+}
+
+func (d *shardDir) ReadDirAll(ctx context.Context) ([]fuselib.Dirent, error) {
+	var ret []fuselib.Dirent
+	err := d.fs.withDAG(ctx, d.key, func(sa *dagstore.ShardAccessor, _ format.DAGService) error {
+		rs, err := roots(sa)
+		for _, c := range rs {
+			ret = append(ret, fuselib.Dirent{Name: c.String(), Type: fuselib.DT_Unknown})
+		}
+		return err
+	})
+	return ret, err
+}
+
+func (d *shardDir) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
+	c, err := cid.Parse(name)
+	if err != nil {
+		return nil, fuselib.ENOENT
+	}
+	var ret fusefs.Node
+	err = d.fs.withDAG(ctx, d.key, func(sa *dagstore.ShardAccessor, dserv format.DAGService) error {
+		rs, err := roots(sa)
+		if err != nil {
+			return err
+		}
+		for _, r := range rs {
+			if !r.Equals(c) {
+				continue
+			}
+			nd, err := dserv.Get(ctx, c)
+			if err != nil {
+				return err
+			}
+			ret, err = d.fs.newUnixFSNode(d.key, nd)
+			return err
+		}
+		return fuselib.ENOENT
+	})
+	return ret, err
+}
+
+// unixfsDir is a UnixFS directory within a shard.
+type unixfsDir struct {
+	fs  *FS
+	key shard.Key
+	c   cid.Cid
+}
+
+var (
+	_ fusefs.HandleReadDirAller = (*unixfsDir)(nil)
+	_ fusefs.NodeStringLookuper = (*unixfsDir)(nil)
+)
+
+func (d *unixfsDir) Attr(_ context.Context, a *fuselib.Attr) error {
+	a.Mode = os.ModeDir | 0555
+	return nil
+}
+
+// withDir calls fn with the UnixFS directory, while its shard is acquired.
+func (d *unixfsDir) withDir(ctx context.Context, fn func(dir uio.Directory) error) error {
+	return d.fs.withDAG(ctx, d.key, func(_ *dagstore.ShardAccessor, dserv format.DAGService) error {
+		nd, err := dserv.Get(ctx, d.c)
+		if err != nil {
+			return err
+		}
+		dir, err := uio.NewDirectoryFromNode(dserv, nd)
+		if err != nil {
+			return fmt.Errorf("failed to open UnixFS directory %s: %w", d.c, err)
+		}
+		return fn(dir)
+	})
+}
+
+func (d *unixfsDir) ReadDirAll(ctx context.Context) ([]fuselib.Dirent, error) {
+	var ret []fuselib.Dirent
+	err := d.withDir(ctx, func(dir uio.Directory) error {
+		return dir.ForEachLink(ctx, func(l *format.Link) error {
+			ret = append(ret, fuselib.Dirent{Name: l.Name, Type: fuselib.DT_Unknown})
+			return nil
+		})
+	})
+	return ret, err
+}
+
+func (d *unixfsDir) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
+	var ret fusefs.Node
+	err := d.withDir(ctx, func(dir uio.Directory) error {
+		nd, err := dir.Find(ctx, name)
+		if errors.Is(err, os.ErrNotExist) {
+			return fuselib.ENOENT
+		}
+		if err != nil {
+			return err
+		}
+		ret, err = d.fs.newUnixFSNode(d.key, nd)
+		return err
+	})
+	return ret, err
+}
+
+// unixfsFile is a UnixFS file within a shard.
+type unixfsFile struct {
+	fs   *FS
+	key  shard.Key
+	c    cid.Cid
+	size uint64
+}
+
+var _ fusefs.NodeOpener = (*unixfsFile)(nil)
+
+func (n *unixfsFile) Attr(_ context.Context, a *fuselib.Attr) error {
+	a.Mode = 0444
+	a.Size = n.size
+	return nil
+}
+
+func (n *unixfsFile) Open(ctx context.Context, req *fuselib.OpenRequest, _ *fuselib.OpenResponse) (fusefs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, fuselib.Errno(syscall.EROFS)
+	}
+	sa, err := n.fs.acquire(ctx, n.key)
+	if err != nil {
+		return nil, err
+	}
+	bs, err := sa.Blockstore()
+	if err != nil {
+		_ = sa.Close()
+		return nil, err
+	}
+	ng := &nodeGetter{bs: bs}
+	nd, err := ng.Get(ctx, n.c)
+	if err != nil {
+		_ = sa.Close()
+		return nil, err
+	}
+	// the reader outlives the open request.
+	rd, err := uio.NewDagReader(context.Background(), nd, ng)
+	if err != nil {
+		_ = sa.Close()
+		return nil, fmt.Errorf("failed to open UnixFS file %s: %w", n.c, err)
+	}
+	return &unixfsHandle{sa: sa, rd: rd}, nil
+}
+
+// unixfsHandle is an open UnixFS file, which holds its shard acquired until
+// it's released.
+type unixfsHandle struct {
+	sa *dagstore.ShardAccessor
+
+	lk sync.Mutex
+	rd uio.DagReader // guarded by lk.
+}
+
+var (
+	_ fusefs.HandleReader   = (*unixfsHandle)(nil)
+	_ fusefs.HandleReleaser = (*unixfsHandle)(nil)
+)
+
+func (h *unixfsHandle) Read(_ context.Context, req *fuselib.ReadRequest, resp *fuselib.ReadResponse) error {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	if _, err := h.rd.Seek(req.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	buf := make([]byte, req.Size)
+	n, err := io.ReadFull(h.rd, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	resp.Data = buf[:n]
+	return nil
+}
+
+func (h *unixfsHandle) Release(_ context.Context, _ *fuselib.ReleaseRequest) error {
+	h.lk.Lock()
+	err := h.rd.Close()
+	h.lk.Unlock()
+	if cerr := h.sa.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,200 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+
+	"github.com/filecoin-project/dagstore/shard"
+	"github.com/multiformats/go-multihash"
+)
+
+// bloomVersion is the version of the serialized form of a Bloom.
+const bloomVersion = 2
+
+// bloomHeaderSize is the size of the header of the serialized form of a Bloom:
+// its version, number of hash functions, capacity and count.
+const bloomHeaderSize = 21
+
+// Bloom is a bloom filter of multihashes. It answers whether a multihash may
+// have been added, with no false negatives, and false positives at the rate it
+// was sized for, as long as no more multihashes than its capacity are added.
+// It's safe for concurrent reads, but not for reads concurrent with additions.
+type Bloom struct {
+	k    uint32   // number of hash functions.
+	c    uint64   // number of multihashes the filter is sized for.
+	n    uint64   // number of multihashes added.
+	bits []uint64 // bitset, of len(bits)*64 bits.
+}
+
+// BloomRepo is implemented by index repos that can persist a bloom filter of
+// the multihashes of the shards alongside the full indices, so that it needn't
+// be rebuilt on start.
+type BloomRepo interface {
+	// GetBloom returns the persisted bloom filter, and the keys of the shards
+	// whose multihashes it holds, or an error wrapping ErrNotFound if there's
+	// none.
+	GetBloom() (*Bloom, []shard.Key, error)
+
+	// PutBloom persists a bloom filter, and the keys of the shards whose
+	// multihashes it holds, replacing any previous one.
+	PutBloom(b *Bloom, keys []shard.Key) error
+
+	// DropBloom drops the persisted bloom filter, if any.
+	DropBloom() error
+}
+
+// NewBloom returns an empty bloom filter sized for n multihashes with the
+// given false positive rate, which must be between 0 and 1.
+func NewBloom(n uint64, fpRate float64) *Bloom {
+	if n == 0 {
+		n = 1
+	}
+	// optimal number of bits and hash functions for n items and the rate.
+	m := math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	words := uint64(math.Ceil(m / 64))
+	if words == 0 {
+		words = 1
+	}
+	k := uint32(math.Round(float64(words*64) / float64(n) * math.Ln2))
+	if k == 0 {
+		k = 1
+	}
+	return &Bloom{k: k, c: n, bits: make([]uint64, words)}
+}
+
+// Add adds a multihash to the filter.
+func (b *Bloom) Add(mh multihash.Multihash) {
+	b.n++
+	h1, h2 := bloomHashes(mh)
+	n := uint64(len(b.bits)) * 64
+	for i := uint32(0); i < b.k; i++ {
+		bit := (h1 + uint64(i)*h2) % n
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// Has returns whether the filter may contain a multihash. False means that
+// the multihash was never added.
+func (b *Bloom) Has(mh multihash.Multihash) bool {
+	h1, h2 := bloomHashes(mh)
+	n := uint64(len(b.bits)) * 64
+	for i := uint32(0); i < b.k; i++ {
+		bit := (h1 + uint64(i)*h2) % n
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Size returns the size of the filter in bytes.
+func (b *Bloom) Size() uint64 {
+	return uint64(len(b.bits)) * 8
+}
+
+// Count returns the number of multihashes added to the filter, including
+// duplicates.
+func (b *Bloom) Count() uint64 {
+	return b.n
+}
+
+// Capacity returns the number of multihashes the filter is sized for: past
+// it, the false positive rate degrades.
+func (b *Bloom) Capacity() uint64 {
+	return b.c
+}
+
+// MarshalBinary encodes the filter as its version, the number of hash
+// functions, its capacity, the number of multihashes added and the bitset, in
+// little endian.
+func (b *Bloom) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, bloomHeaderSize+len(b.bits)*8)
+	buf[0] = bloomVersion
+	binary.LittleEndian.PutUint32(buf[1:], b.k)
+	binary.LittleEndian.PutUint64(buf[5:], b.c)
+	binary.LittleEndian.PutUint64(buf[13:], b.n)
+	for i, w := range b.bits {
+		binary.LittleEndian.PutUint64(buf[bloomHeaderSize+i*8:], w)
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a filter encoded by MarshalBinary.
+func (b *Bloom) UnmarshalBinary(data []byte) error {
+	if len(data) < bloomHeaderSize || data[0] != bloomVersion {
+		return fmt.Errorf("invalid bloom filter: unknown version or truncated header")
+	}
+	words := data[bloomHeaderSize:]
+	if len(words) == 0 || len(words)%8 != 0 {
+		return fmt.Errorf("invalid bloom filter: bitset of %d bytes", len(words))
+	}
+	k := binary.LittleEndian.Uint32(data[1:])
+	if k == 0 {
+		return fmt.Errorf("invalid bloom filter: no hash functions")
+	}
+	bits := make([]uint64, len(words)/8)
+	for i := range bits {
+		bits[i] = binary.LittleEndian.Uint64(words[i*8:])
+	}
+	b.k, b.bits = k, bits
+	b.c, b.n = binary.LittleEndian.Uint64(data[5:]), binary.LittleEndian.Uint64(data[13:])
+	return nil
+}
+
+// marshalBloomSnapshot encodes a filter persisted by a BloomRepo along with
+// the keys of the shards it holds, as the number of keys and each key
+// prefixed with its length, as uvarints, followed by the filter.
+func marshalBloomSnapshot(b *Bloom, keys []shard.Key) ([]byte, error) {
+	bs, err := b.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		buf bytes.Buffer
+		tmp [binary.MaxVarintLen64]byte
+	)
+	buf.Write(tmp[:binary.PutUvarint(tmp[:], uint64(len(keys)))])
+	for _, k := range keys {
+		buf.Write(tmp[:binary.PutUvarint(tmp[:], uint64(len(k.String())))])
+		buf.WriteString(k.String())
+	}
+	buf.Write(bs)
+	return buf.Bytes(), nil
+}
+
+// unmarshalBloomSnapshot decodes a snapshot encoded by marshalBloomSnapshot.
+func unmarshalBloomSnapshot(data []byte) (*Bloom, []shard.Key, error) {
+	n, sz := binary.Uvarint(data)
+	if sz <= 0 || n > uint64(len(data)) {
+		return nil, nil, fmt.Errorf("invalid bloom filter snapshot: bad key count")
+	}
+	data = data[sz:]
+	keys := make([]shard.Key, 0, n)
+	for i := uint64(0); i < n; i++ {
+		l, sz := binary.Uvarint(data)
+		if sz <= 0 || l > uint64(len(data)-sz) {
+			return nil, nil, fmt.Errorf("invalid bloom filter snapshot: truncated key")
+		}
+		keys = append(keys, shard.KeyFromString(string(data[sz:sz+int(l)])))
+		data = data[sz+int(l):]
+	}
+	b := new(Bloom)
+	if err := b.UnmarshalBinary(data); err != nil {
+		return nil, nil, err
+	}
+	return b, keys, nil
+}
+
+// bloomHashes returns the two hashes of a multihash from which the positions
+// of its bits are derived, through double hashing.
+func bloomHashes(mh multihash.Multihash) (uint64, uint64) {
+	h := fnv.New64a()
+	_, _ = h.Write(mh)
+	sum := h.Sum64()
+	h1, h2 := sum&math.MaxUint32, sum>>32
+	// an odd step visits distinct bits for every hash function.
+	return h1, h2 | 1
+}
@@ -0,0 +1,66 @@
+package index
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func testMultihashes(t *testing.T, prefix string, n int) []multihash.Multihash {
+	mhs := make([]multihash.Multihash, 0, n)
+	for i := 0; i < n; i++ {
+		h, err := multihash.Sum([]byte(fmt.Sprintf("%s-%d", prefix, i)), multihash.SHA2_256, -1)
+		require.NoError(t, err)
+		mhs = append(mhs, h)
+	}
+	return mhs
+}
+
+func TestBloom(t *testing.T) {
+	const n = 10000
+	added := testMultihashes(t, "added", n)
+	b := NewBloom(n, 0.01)
+	for _, h := range added {
+		b.Add(h)
+	}
+
+	// no false negatives.
+	for _, h := range added {
+		require.True(t, b.Has(h))
+	}
+
+	require.EqualValues(t, n, b.Count())
+	require.EqualValues(t, n, b.Capacity())
+
+	// false positives within a margin of the configured rate.
+	var fp int
+	for _, h := range testMultihashes(t, "absent", n) {
+		if b.Has(h) {
+			fp++
+		}
+	}
+	require.Less(t, fp, n*2/100)
+
+	// round trip.
+	bs, err := b.MarshalBinary()
+	require.NoError(t, err)
+	require.EqualValues(t, len(bs), bloomHeaderSize+b.Size())
+	var b2 Bloom
+	require.NoError(t, b2.UnmarshalBinary(bs))
+	require.Equal(t, b, &b2)
+
+	// truncated or corrupted filters are rejected.
+	require.Error(t, b2.UnmarshalBinary(bs[:4]))
+	require.Error(t, b2.UnmarshalBinary(bs[:len(bs)-1]))
+	bs[0] = 0
+	require.Error(t, b2.UnmarshalBinary(bs))
+}
+
+func TestBloomEmpty(t *testing.T) {
+	b := NewBloom(0, 0.01)
+	for _, h := range testMultihashes(t, "absent", 100) {
+		require.False(t, b.Has(h))
+	}
+}
@@ -0,0 +1,330 @@
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+	carindex "github.com/ipld/go-car/v2/index"
+	"github.com/multiformats/go-multihash"
+)
+
+// MinBuildBudget is the minimum memory budget of a BoundedBuilder; smaller
+// budgets are raised to it.
+const MinBuildBudget = 1 << 20
+
+// entryOverhead approximates the memory used by a buffered entry besides its
+// bytes, i.e. its slice header.
+const entryOverhead = 24
+
+// BoundedBuilder builds MultihashIndexSorted indices, the type of index that
+// the DAG store generates, within a memory budget, so that indexing huge CARs
+// doesn't spike memory use. Records are buffered up to the budget, and then
+// sorted and spilled to temporary files, which are merged when the index is
+// built.
+//
+// The resulting index is held in memory in its compact form, as with any
+// other index; the budget bounds the memory used on top of it. A
+// BoundedBuilder is not safe for concurrent use.
+type BoundedBuilder struct {
+	budget int64
+	dir    string
+
+	buf      [][]byte // encoded entries; see encodeEntry.
+	bufBytes int64
+	runs     []*os.File
+	// counts is the number of records per bucket of the index.
+	counts map[bucket]uint64
+}
+
+// bucket identifies a bucket of a MultihashIndexSorted index: records with
+// the same multihash code and digest length.
+type bucket struct {
+	code  uint64
+	width uint32 // digest length + 8 bytes of offset.
+}
+
+// NewBoundedBuilder returns a builder that buffers up to budget bytes of
+// records in memory, spilling them to temporary files in dir beyond it. If dir
+// is empty, the default directory for temporary files is used.
+func NewBoundedBuilder(budget int64, dir string) *BoundedBuilder {
+	if budget < MinBuildBudget {
+		budget = MinBuildBudget
+	}
+	return &BoundedBuilder{budget: budget, dir: dir, counts: make(map[bucket]uint64)}
+}
+
+// Add adds a record of the block with CID c, at the given offset of the CAR
+// data payload.
+func (b *BoundedBuilder) Add(c cid.Cid, offset uint64) error {
+	dmh, err := multihash.Decode(c.Hash())
+	if err != nil {
+		return err
+	}
+	e := encodeEntry(dmh.Code, dmh.Digest, offset)
+	b.buf = append(b.buf, e)
+	b.bufBytes += int64(len(e)) + entryOverhead
+	b.counts[bucket{code: dmh.Code, width: uint32(len(dmh.Digest)) + 8}]++
+
+	if b.bufBytes >= b.budget {
+		return b.spill()
+	}
+	return nil
+}
+
+// Spilled returns the number of runs of records spilled to disk so far.
+func (b *BoundedBuilder) Spilled() int {
+	return len(b.runs)
+}
+
+// Build merges the records added into an index. The builder must not be used
+// afterwards, other than to be closed.
+func (b *BoundedBuilder) Build() (carindex.Index, error) {
+	sortEntries(b.buf)
+
+	var (
+		w      io.Writer
+		mem    bytes.Buffer
+		tmp    *os.File
+		sorted = []entrySource{&memSource{entries: b.buf}}
+	)
+	if len(b.runs) == 0 {
+		w = &mem
+	} else {
+		var err error
+		if tmp, err = os.CreateTemp(b.dir, "index-build-*"); err != nil {
+			return nil, fmt.Errorf("failed to create temporary index file: %w", err)
+		}
+		defer os.Remove(tmp.Name()) //nolint:errcheck
+		defer tmp.Close()           //nolint:errcheck
+		w = bufio.NewWriter(tmp)
+
+		for _, run := range b.runs {
+			if _, err := run.Seek(0, io.SeekStart); err != nil {
+				return nil, fmt.Errorf("failed to rewind spilled records: %w", err)
+			}
+			sorted = append(sorted, &runSource{r: bufio.NewReader(run)})
+		}
+	}
+
+	if err := b.write(w, sorted); err != nil {
+		return nil, fmt.Errorf("failed to write index: %w", err)
+	}
+	b.buf, b.bufBytes = nil, 0
+
+	var r io.Reader = &mem
+	if tmp != nil {
+		if err := w.(*bufio.Writer).Flush(); err != nil {
+			return nil, fmt.Errorf("failed to write index: %w", err)
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to rewind index: %w", err)
+		}
+		r = tmp
+	}
+	idx := carindex.NewMultihashSorted()
+	if err := idx.Unmarshal(r); err != nil {
+		return nil, fmt.Errorf("failed to load index: %w", err)
+	}
+	return idx, nil
+}
+
+// Close removes the temporary files of the builder.
+func (b *BoundedBuilder) Close() error {
+	var err error
+	for _, run := range b.runs {
+		_ = run.Close()
+		if rerr := os.Remove(run.Name()); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	b.runs, b.buf = nil, nil
+	return err
+}
+
+// spill sorts the buffered records and writes them to a new run file.
+func (b *BoundedBuilder) spill() error {
+	sortEntries(b.buf)
+	f, err := os.CreateTemp(b.dir, "index-run-*")
+	if err != nil {
+		return fmt.Errorf("failed to create run file: %w", err)
+	}
+	b.runs = append(b.runs, f)
+
+	w := bufio.NewWriter(f)
+	var lbuf [binary.MaxVarintLen64]byte
+	for _, e := range b.buf {
+		n := binary.PutUvarint(lbuf[:], uint64(len(e)))
+		if _, err := w.Write(lbuf[:n]); err != nil {
+			return fmt.Errorf("failed to spill records: %w", err)
+		}
+		if _, err := w.Write(e); err != nil {
+			return fmt.Errorf("failed to spill records: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to spill records: %w", err)
+	}
+	b.buf, b.bufBytes = b.buf[:0], 0
+	return nil
+}
+
+// write merges the sorted sources, and writes the records in the
+// serialization format of MultihashIndexSorted (without the codec prefix):
+// the buckets are laid out by ascending multihash code and width, each
+// holding its records sorted by digest.
+func (b *BoundedBuilder) write(w io.Writer, sources []entrySource) error {
+	perCode := make(map[uint64]int32)
+	for bk := range b.counts {
+		perCode[bk.code]++
+	}
+	if err := binary.Write(w, binary.LittleEndian, int32(len(perCode))); err != nil {
+		return err
+	}
+
+	h := &entryHeap{}
+	for _, src := range sources {
+		if err := h.pushNext(src); err != nil {
+			return err
+		}
+	}
+
+	var (
+		cur     bucket
+		started bool
+		out     []byte
+	)
+	for h.Len() > 0 {
+		top := (*h)[0]
+		code, digest, offset := decodeEntry(top.entry)
+		bk := bucket{code: code, width: uint32(len(digest)) + 8}
+		if !started || bk.code != cur.code {
+			if err := binary.Write(w, binary.LittleEndian, code); err != nil {
+				return err
+			}
+			if err := binary.Write(w, binary.LittleEndian, perCode[code]); err != nil {
+				return err
+			}
+		}
+		if !started || bk != cur {
+			if err := binary.Write(w, binary.LittleEndian, bk.width); err != nil {
+				return err
+			}
+			if err := binary.Write(w, binary.LittleEndian, int64(b.counts[bk])*int64(bk.width)); err != nil {
+				return err
+			}
+			cur, started = bk, true
+		}
+
+		out = append(out[:0], digest...)
+		out = append(out, make([]byte, 8)...)
+		binary.LittleEndian.PutUint64(out[len(digest):], offset)
+		if _, err := w.Write(out); err != nil {
+			return err
+		}
+
+		heap.Pop(h)
+		if err := h.pushNext(top.src); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeEntry encodes a record so that entries sort bytewise by multihash
+// code, digest length, digest and offset.
+func encodeEntry(code uint64, digest []byte, offset uint64) []byte {
+	e := make([]byte, 8+4+len(digest)+8)
+	binary.BigEndian.PutUint64(e, code)
+	binary.BigEndian.PutUint32(e[8:], uint32(len(digest)))
+	copy(e[12:], digest)
+	binary.BigEndian.PutUint64(e[12+len(digest):], offset)
+	return e
+}
+
+func decodeEntry(e []byte) (code uint64, digest []byte, offset uint64) {
+	code = binary.BigEndian.Uint64(e)
+	l := binary.BigEndian.Uint32(e[8:])
+	digest = e[12 : 12+l]
+	offset = binary.BigEndian.Uint64(e[12+l:])
+	return code, digest, offset
+}
+
+func sortEntries(entries [][]byte) {
+	sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i], entries[j]) < 0 })
+}
+
+// entrySource is a sorted sequence of encoded entries. next returns io.EOF at
+// the end of the sequence.
+type entrySource interface {
+	next() ([]byte, error)
+}
+
+type memSource struct {
+	entries [][]byte
+}
+
+func (s *memSource) next() ([]byte, error) {
+	if len(s.entries) == 0 {
+		return nil, io.EOF
+	}
+	e := s.entries[0]
+	s.entries = s.entries[1:]
+	return e, nil
+}
+
+// runSource reads the entries spilled to a run file.
+type runSource struct {
+	r *bufio.Reader
+}
+
+func (s *runSource) next() ([]byte, error) {
+	l, err := binary.ReadUvarint(s.r)
+	if err != nil {
+		return nil, err // io.EOF at the end of the run.
+	}
+	e := make([]byte, l)
+	if _, err := io.ReadFull(s.r, e); err != nil {
+		return nil, fmt.Errorf("failed to read spilled records: %w", err)
+	}
+	return e, nil
+}
+
+type heapItem struct {
+	entry []byte
+	src   entrySource
+}
+
+// entryHeap is a min-heap of the next entries of the sources being merged.
+type entryHeap []heapItem
+
+func (h entryHeap) Len() int            { return len(h) }
+func (h entryHeap) Less(i, j int) bool  { return bytes.Compare(h[i].entry, h[j].entry) < 0 }
+func (h entryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *entryHeap) Push(x interface{}) { *h = append(*h, x.(heapItem)) }
+func (h *entryHeap) Pop() interface{} {
+	old := *h
+	it := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return it
+}
+
+// pushNext pushes the next entry of src, if any.
+func (h *entryHeap) pushNext(src entrySource) error {
+	e, err := src.next()
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	heap.Push(h, heapItem{entry: e, src: src})
+	return nil
+}
@@ -0,0 +1,66 @@
+package index
+
+import (
+	"os"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	blocksutil "github.com/ipfs/go-ipfs-blocksutil"
+	carindex "github.com/ipld/go-car/v2/index"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBoundedBuilder(t *testing.T) {
+	gen := blocksutil.NewBlockGenerator()
+	var records []carindex.Record
+	for i := 0; i < 50000; i++ {
+		records = append(records, carindex.Record{Cid: gen.Next().Cid(), Offset: uint64(i * 100)})
+	}
+	// mix in other multihash codes and digest lengths.
+	for i, code := range []uint64{multihash.SHA2_512, multihash.IDENTITY, multihash.BLAKE2B_MIN + 19} {
+		mh, err := multihash.Sum([]byte{byte(i)}, code, -1)
+		require.NoError(t, err)
+		records = append(records, carindex.Record{Cid: cid.NewCidV1(cid.Raw, mh), Offset: uint64(i)})
+	}
+
+	want := carindex.NewMultihashSorted()
+	require.NoError(t, want.Load(records))
+	wantDigest, err := indexDigest(want)
+	require.NoError(t, err)
+
+	for _, budget := range []int64{0, 64 << 20} {
+		dir := t.TempDir()
+		b := NewBoundedBuilder(budget, dir)
+		for _, r := range records {
+			require.NoError(t, b.Add(r.Cid, r.Offset))
+		}
+		if budget == 0 {
+			require.NotZero(t, b.Spilled(), "the minimum budget is exceeded")
+		} else {
+			require.Zero(t, b.Spilled())
+		}
+		idx, err := b.Build()
+		require.NoError(t, err)
+		require.NoError(t, b.Close())
+
+		digest, err := indexDigest(idx)
+		require.NoError(t, err)
+		require.Equal(t, wantDigest, digest, "budget %d", budget)
+
+		// temporary files are gone.
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	}
+
+	// an empty index.
+	idx, err := NewBoundedBuilder(0, t.TempDir()).Build()
+	require.NoError(t, err)
+	var n int
+	require.NoError(t, idx.(carindex.IterableIndex).ForEach(func(multihash.Multihash, uint64) error {
+		n++
+		return nil
+	}))
+	require.Zero(t, n)
+}
@@ -15,11 +15,16 @@ import (
 	"github.com/filecoin-project/dagstore/shard"
 )
 
-var _ Inverted = (*invertedIndexImpl)(nil)
+var (
+	_ Inverted        = (*invertedIndexImpl)(nil)
+	_ ShardMembership = (*invertedIndexImpl)(nil)
+	_ ShardRemover    = (*invertedIndexImpl)(nil)
+)
 
 type invertedIndexImpl struct {
-	mu sync.Mutex
-	ds ds.Batching
+	mu     sync.Mutex
+	ds     ds.Batching
+	shards ds.Datastore // records the shards whose multihashes were added.
 }
 
 // NewInverted returns a new inverted index that uses `go-indexer-core`
@@ -27,9 +32,9 @@ type invertedIndexImpl struct {
 // as it's been optimized to store (multihash -> Value) kind of data and
 // supports bulk updates via context ID and metadata-deduplication which are useful properties for our use case here.
 func NewInverted(dts ds.Batching) *invertedIndexImpl {
-	dts = namespace.Wrap(dts, ds.NewKey("/inverted/index"))
 	return &invertedIndexImpl{
-		ds: dts,
+		ds:     namespace.Wrap(dts, ds.NewKey("/inverted/index")),
+		shards: namespace.Wrap(dts, ds.NewKey("/inverted/shards")),
 	}
 }
 
@@ -92,13 +97,98 @@ func (d *invertedIndexImpl) AddMultihashesForShard(ctx context.Context, mhIter M
 		return fmt.Errorf("failed to commit batch: %w", err)
 	}
 
+	// record the shard once its multihashes are committed, so that a shard
+	// interrupted halfway is added again.
+	if err := d.shards.Put(ctx, ds.NewKey(s.String()), []byte{}); err != nil {
+		return fmt.Errorf("failed to record shard: %w", err)
+	}
+
 	if err := d.ds.Sync(ctx, ds.Key{}); err != nil {
 		return fmt.Errorf("failed to sync puts: %w", err)
 	}
+	if err := d.shards.Sync(ctx, ds.Key{}); err != nil {
+		return fmt.Errorf("failed to sync puts: %w", err)
+	}
 
 	return nil
 }
 
+func (d *invertedIndexImpl) RemoveMultihashesForShard(ctx context.Context, mhIter MultihashIterator, s shard.Key) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// forget the shard first, so that a shard interrupted halfway isn't
+	// mistaken for a complete one.
+	if err := d.shards.Delete(ctx, ds.NewKey(s.String())); err != nil {
+		return fmt.Errorf("failed to delete shard record: %w", err)
+	}
+
+	batch, err := d.ds.Batch(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create ds batch: %w", err)
+	}
+
+	if err := mhIter.ForEach(func(mh multihash.Multihash) error {
+		key := ds.NewKey(string(mh))
+		val, err := d.ds.Get(ctx, key)
+		if err == ds.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get value for multihash %s, err: %w", mh, err)
+		}
+
+		var es []shard.Key
+		if err := json.Unmarshal(val, &es); err != nil {
+			return fmt.Errorf("failed to unmarshal shard keys: %w", err)
+		}
+		if !has(es, s) {
+			return nil
+		}
+
+		rest := make([]shard.Key, 0, len(es)-1)
+		for _, k := range es {
+			if k != s {
+				rest = append(rest, k)
+			}
+		}
+		// drop the entry altogether once no shard has the multihash.
+		if len(rest) == 0 {
+			if err := batch.Delete(ctx, key); err != nil {
+				return fmt.Errorf("failed to delete mh=%s, err=%w", mh, err)
+			}
+			return nil
+		}
+		bz, err := json.Marshal(rest)
+		if err != nil {
+			return fmt.Errorf("failed to marshal shard keys: %w", err)
+		}
+		if err := batch.Put(ctx, key, bz); err != nil {
+			return fmt.Errorf("failed to put mh=%s, err=%w", mh, err)
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to remove index entry: %w", err)
+	}
+
+	if err := batch.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit batch: %w", err)
+	}
+
+	if err := d.ds.Sync(ctx, ds.Key{}); err != nil {
+		return fmt.Errorf("failed to sync deletes: %w", err)
+	}
+	if err := d.shards.Sync(ctx, ds.Key{}); err != nil {
+		return fmt.Errorf("failed to sync deletes: %w", err)
+	}
+
+	return nil
+}
+
+func (d *invertedIndexImpl) HasShard(ctx context.Context, s shard.Key) (bool, error) {
+	return d.shards.Has(ctx, ds.NewKey(s.String()))
+}
+
 func (d *invertedIndexImpl) GetShardsForMultihash(ctx context.Context, mh multihash.Multihash) ([]shard.Key, error) {
 	key := ds.NewKey(string(mh))
 	sbz, err := d.ds.Get(ctx, key)
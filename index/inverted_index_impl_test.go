@@ -143,3 +143,67 @@ func GenerateMhs(n int) []multihash.Multihash {
 	}
 	return mhs
 }
+
+func TestDatastoreIndexHasShard(t *testing.T) {
+	ctx := context.Background()
+	dstore := sync.MutexWrap(ds.NewMapDatastore())
+	idx := NewInverted(dstore)
+
+	sk1 := shard.KeyFromString("shard-key-1")
+	has, err := idx.HasShard(ctx, sk1)
+	require.NoError(t, err)
+	require.False(t, has)
+
+	err = idx.AddMultihashesForShard(ctx, &mhIt{GenerateMhs(10)}, sk1)
+	require.NoError(t, err)
+
+	// membership survives reopening the index over the same datastore.
+	idx = NewInverted(dstore)
+	has, err = idx.HasShard(ctx, sk1)
+	require.NoError(t, err)
+	require.True(t, has)
+
+	has, err = idx.HasShard(ctx, shard.KeyFromString("shard-key-2"))
+	require.NoError(t, err)
+	require.False(t, has)
+}
+
+func TestDatastoreIndexRemoveShard(t *testing.T) {
+	ctx := context.Background()
+	idx := NewInverted(sync.MutexWrap(ds.NewMapDatastore()))
+
+	mhs := GenerateMhs(3)
+	sk1 := shard.KeyFromString("shard-key-1")
+	sk2 := shard.KeyFromString("shard-key-2")
+
+	// mhs[0] -> [shard-key-1, shard-key-2]
+	// mhs[1] -> [shard-key-1]
+	// mhs[2] -> [shard-key-2]
+	err := idx.AddMultihashesForShard(ctx, &mhIt{mhs[:2]}, sk1)
+	require.NoError(t, err)
+	err = idx.AddMultihashesForShard(ctx, &mhIt{[]multihash.Multihash{mhs[0], mhs[2]}}, sk2)
+	require.NoError(t, err)
+
+	err = idx.RemoveMultihashesForShard(ctx, &mhIt{mhs[:2]}, sk1)
+	require.NoError(t, err)
+
+	shards, err := idx.GetShardsForMultihash(ctx, mhs[0])
+	require.NoError(t, err)
+	require.Equal(t, []shard.Key{sk2}, shards)
+
+	// the entry of a multihash no shard has anymore is gone.
+	_, err = idx.GetShardsForMultihash(ctx, mhs[1])
+	require.True(t, xerrors.Is(err, ds.ErrNotFound))
+
+	shards, err = idx.GetShardsForMultihash(ctx, mhs[2])
+	require.NoError(t, err)
+	require.Equal(t, []shard.Key{sk2}, shards)
+
+	has, err := idx.HasShard(ctx, sk1)
+	require.NoError(t, err)
+	require.False(t, has)
+
+	// removing it again is a no-op.
+	err = idx.RemoveMultihashesForShard(ctx, &mhIt{mhs[:2]}, sk1)
+	require.NoError(t, err)
+}
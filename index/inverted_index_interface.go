@@ -18,3 +18,20 @@ type Inverted interface {
 	// GetShardsForMultihash returns keys for all the shards that has the given multihash.
 	GetShardsForMultihash(ctx context.Context, h multihash.Multihash) ([]shard.Key, error)
 }
+
+// ShardMembership is implemented by inverted indices that record which shards
+// they contain. The DAG store uses it to backfill shards missing from a
+// persisted inverted index on start.
+type ShardMembership interface {
+	// HasShard returns whether the multihashes of the shard were added.
+	HasShard(ctx context.Context, s shard.Key) (bool, error)
+}
+
+// ShardRemover is implemented by inverted indices that can remove the
+// multihashes of a shard again. The DAG store uses it to forget destroyed
+// shards.
+type ShardRemover interface {
+	// RemoveMultihashesForShard removes the shard key from the mappings of all
+	// multihashes returned by the given MultihashIterator.
+	RemoveMultihashesForShard(ctx context.Context, mhIter MultihashIterator, s shard.Key) error
+}
@@ -0,0 +1,206 @@
+package index
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+
+	carindex "github.com/ipld/go-car/v2/index"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// MigrateOpts are options of Migrate.
+type MigrateOpts struct {
+	// Concurrency is the number of indices copied at once. Defaults to 1.
+	Concurrency int
+
+	// Progress, if non-nil, is called after every index is processed, from
+	// one goroutine at a time.
+	Progress func(MigrateProgress)
+}
+
+// MigrateProgress reports the progress of Migrate.
+type MigrateProgress struct {
+	// Key is the key of the shard whose index was processed.
+	Key shard.Key
+	// Done is the number of indices processed so far, including Key, out of
+	// Total.
+	Done, Total int
+	// Skipped is true if the index was already in the destination repo.
+	Skipped bool
+	// Err is the error the index failed to be migrated with, if any.
+	Err error
+}
+
+// MigrateResult is the result of Migrate.
+type MigrateResult struct {
+	// Copied is the number of indices copied to the destination repo.
+	Copied int
+	// Skipped is the number of indices already in the destination repo,
+	// e.g. copied by an interrupted migration.
+	Skipped int
+	// Failed holds the errors of the indices that failed to be migrated.
+	Failed map[shard.Key]error
+}
+
+// Migrate copies all full indices from the src repo to the dst repo, e.g. to
+// switch a DAG store to another index repo implementation. Copied indices are
+// read back from dst and verified to serialize identically to the source. The
+// bloom filter is copied along if both repos are BloomRepos.
+// Indices aren't dropped from src.
+//
+// Migrations are resumable: indices already in dst that match the source are
+// skipped, so an interrupted migration can be run again. Those that don't
+// match, e.g. because they were being written when the migration was
+// interrupted, are copied again.
+//
+// The indices that fail to be migrated are reported in the result, along with
+// an error; the others are still migrated. Migrate stops early if the context
+// is cancelled.
+func Migrate(ctx context.Context, src, dst FullIndexRepo, opts MigrateOpts) (*MigrateResult, error) {
+	var keys []shard.Key
+	err := src.ForEach(func(k shard.Key) (bool, error) {
+		keys = append(keys, k)
+		return true, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list source indices: %w", err)
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	var (
+		wg     sync.WaitGroup
+		lk     sync.Mutex
+		done   int
+		result = &MigrateResult{Failed: make(map[shard.Key]error)}
+		work   = make(chan shard.Key)
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range work {
+				skipped, err := migrateIndex(src, dst, k)
+
+				lk.Lock()
+				done++
+				switch {
+				case err != nil:
+					result.Failed[k] = err
+				case skipped:
+					result.Skipped++
+				default:
+					result.Copied++
+				}
+				if opts.Progress != nil {
+					opts.Progress(MigrateProgress{Key: k, Done: done, Total: len(keys), Skipped: skipped, Err: err})
+				}
+				lk.Unlock()
+			}
+		}()
+	}
+
+loop:
+	for _, k := range keys {
+		select {
+		case work <- k:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+	if err := migrateBloom(src, dst); err != nil {
+		return result, err
+	}
+	if len(result.Failed) > 0 {
+		return result, fmt.Errorf("failed to migrate %d of %d indices", len(result.Failed), len(keys))
+	}
+	return result, nil
+}
+
+// migrateIndex copies the index of a shard from src to dst, unless dst holds
+// a matching one already, in which case it returns true.
+func migrateIndex(src, dst FullIndexRepo, k shard.Key) (bool, error) {
+	idx, err := src.GetFullIndex(k)
+	if err != nil {
+		return false, fmt.Errorf("failed to get source index: %w", err)
+	}
+	digest, err := indexDigest(idx)
+	if err != nil {
+		return false, fmt.Errorf("failed to serialize source index: %w", err)
+	}
+
+	if stat, err := dst.StatFullIndex(k); err == nil && stat.Exists {
+		if existing, err := dst.GetFullIndex(k); err == nil {
+			if d, err := indexDigest(existing); err == nil && bytes.Equal(d, digest) {
+				return true, nil
+			}
+		}
+		// a mismatching index is replaced below.
+	}
+
+	if err := dst.AddFullIndex(k, idx); err != nil {
+		return false, fmt.Errorf("failed to add index: %w", err)
+	}
+	copied, err := dst.GetFullIndex(k)
+	if err != nil {
+		return false, fmt.Errorf("failed to read back copied index: %w", err)
+	}
+	d, err := indexDigest(copied)
+	if err != nil {
+		return false, fmt.Errorf("failed to serialize copied index: %w", err)
+	}
+	if !bytes.Equal(d, digest) {
+		if _, err := dst.DropFullIndex(k); err != nil {
+			return false, fmt.Errorf("copied index doesn't match source, and failed to drop it: %w", err)
+		}
+		return false, errors.New("copied index doesn't match source")
+	}
+	return false, nil
+}
+
+// migrateBloom copies the bloom filter from src to dst, if both are BloomRepos
+// and src has one.
+func migrateBloom(src, dst FullIndexRepo) error {
+	sb, ok := src.(BloomRepo)
+	if !ok {
+		return nil
+	}
+	db, ok := dst.(BloomRepo)
+	if !ok {
+		return nil
+	}
+	b, keys, err := sb.GetBloom()
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get source bloom filter: %w", err)
+	}
+	if err := db.PutBloom(b, keys); err != nil {
+		return fmt.Errorf("failed to add bloom filter: %w", err)
+	}
+	return nil
+}
+
+// indexDigest returns the SHA-256 digest of the serialized form of an index.
+func indexDigest(idx carindex.Index) ([]byte, error) {
+	h := sha256.New()
+	if _, err := carindex.WriteTo(idx, h); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,107 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	blocksutil "github.com/ipfs/go-ipfs-blocksutil"
+	carindex "github.com/ipld/go-car/v2/index"
+	"github.com/multiformats/go-multicodec"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	src, err := NewFSRepo(t.TempDir())
+	require.NoError(t, err)
+	dst, err := NewDedupFSRepo(t.TempDir())
+	require.NoError(t, err)
+
+	gen := blocksutil.NewBlockGenerator()
+	newIndex := func(n int) carindex.Index {
+		idx, err := carindex.New(multicodec.CarMultihashIndexSorted)
+		require.NoError(t, err)
+		var recs []carindex.Record
+		for i := 0; i < n; i++ {
+			recs = append(recs, carindex.Record{Cid: gen.Next().Cid(), Offset: uint64(i * 100)})
+		}
+		require.NoError(t, idx.Load(recs))
+		return idx
+	}
+	var keys []shard.Key
+	for i := 0; i < 5; i++ {
+		k := shard.KeyFromString(fmt.Sprintf("shard-%d", i))
+		require.NoError(t, src.AddFullIndex(k, newIndex(10+i)))
+		keys = append(keys, k)
+	}
+
+	var progress []MigrateProgress
+	res, err := Migrate(ctx, src, dst, MigrateOpts{
+		Concurrency: 3,
+		Progress:    func(p MigrateProgress) { progress = append(progress, p) },
+	})
+	require.NoError(t, err)
+	require.Equal(t, 5, res.Copied)
+	require.Zero(t, res.Skipped)
+	require.Empty(t, res.Failed)
+	require.Len(t, progress, 5)
+	for i, p := range progress {
+		require.Equal(t, i+1, p.Done)
+		require.Equal(t, 5, p.Total)
+		require.NoError(t, p.Err)
+	}
+	for _, k := range keys {
+		want, err := src.GetFullIndex(k)
+		require.NoError(t, err)
+		got, err := dst.GetFullIndex(k)
+		require.NoError(t, err)
+		wd, err := indexDigest(want)
+		require.NoError(t, err)
+		gd, err := indexDigest(got)
+		require.NoError(t, err)
+		require.Equal(t, wd, gd)
+	}
+
+	// resuming skips the indices already migrated, and copies again those
+	// that don't match.
+	require.NoError(t, dst.AddFullIndex(keys[0], newIndex(3)))
+	res, err = Migrate(ctx, src, dst, MigrateOpts{})
+	require.NoError(t, err)
+	require.Equal(t, 1, res.Copied)
+	require.Equal(t, 4, res.Skipped)
+
+	// a cancelled context stops the migration.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = Migrate(cctx, src, NewMemoryRepo(), MigrateOpts{})
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestMigrateBlooms(t *testing.T) {
+	src, err := NewFSRepo(t.TempDir())
+	require.NoError(t, err)
+	dst := NewMemoryRepo()
+
+	idx, err := carindex.New(multicodec.CarMultihashIndexSorted)
+	require.NoError(t, err)
+	gen := blocksutil.NewBlockGenerator()
+	c := gen.Next().Cid()
+	require.NoError(t, idx.Load([]carindex.Record{{Cid: c, Offset: 1}}))
+
+	k := shard.KeyFromString("foo")
+	require.NoError(t, src.AddFullIndex(k, idx))
+	b := NewBloom(1, 0.01)
+	b.Add(c.Hash())
+	require.NoError(t, src.PutBloom(b, []shard.Key{k}))
+
+	res, err := Migrate(context.Background(), src, dst, MigrateOpts{})
+	require.NoError(t, err)
+	require.Equal(t, 1, res.Copied)
+	got, keys, err := dst.GetBloom()
+	require.NoError(t, err)
+	require.True(t, got.Has(c.Hash()))
+	require.Equal(t, []shard.Key{k}, keys)
+}
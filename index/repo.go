@@ -1,8 +1,10 @@
 package index
 
 import (
+	"context"
 	"errors"
 
+	"github.com/filecoin-project/dagstore/directio"
 	"github.com/filecoin-project/dagstore/shard"
 	"github.com/ipld/go-car/v2/index"
 )
@@ -51,6 +53,23 @@ type FullIndexRepo interface {
 	Size() (uint64, error)
 }
 
+// Compactor is implemented by index repos that can reclaim space wasted by
+// their storage, e.g. by files left behind by interrupted operations.
+type Compactor interface {
+	// Compact reclaims wasted space, and returns the number of bytes
+	// reclaimed. Indices of shards are never removed.
+	Compact(ctx context.Context) (reclaimed uint64, err error)
+}
+
+// DirectIORepo is implemented by index repos that can write indices with
+// direct IO (see package directio), so that building them doesn't pollute the
+// page cache.
+type DirectIORepo interface {
+	// SetDirectIO writes indices with direct IO with the supplied options
+	// from now on, or with buffered IO if nil.
+	SetDirectIO(opts *directio.Options)
+}
+
 // TODO unimplemented.
 type ManifestRepo interface {
 	// ListManifests returns the available manifests for a given shard,
@@ -0,0 +1,192 @@
+package index
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/filecoin-project/dagstore/directio"
+	"github.com/filecoin-project/dagstore/shard"
+	carindex "github.com/ipld/go-car/v2/index"
+	"golang.org/x/sync/singleflight"
+)
+
+// CachedIndexRepo wraps a FullIndexRepo with an LRU cache of parsed indices,
+// so that acquirers of hot shards share an index instead of reading and
+// parsing it on every acquire. Concurrent loads of the same index are
+// deduplicated. Cached indices are invalidated when they are replaced or
+// dropped through the cache.
+type CachedIndexRepo struct {
+	FullIndexRepo
+
+	max    int
+	flight singleflight.Group
+
+	lk      sync.Mutex
+	entries map[shard.Key]*list.Element // of *cachedIndex
+	lru     *list.List                  // most recently used first.
+	gen     uint64                      // incremented on every invalidation.
+	hits    uint64
+	misses  uint64
+}
+
+type cachedIndex struct {
+	key shard.Key
+	idx carindex.Index
+}
+
+// CacheStats are statistics about a CachedIndexRepo.
+type CacheStats struct {
+	// Hits and Misses are the number of lookups that found and didn't find
+	// the requested index in the cache, respectively.
+	Hits, Misses uint64
+	// Entries is the number of cached indices.
+	Entries int
+}
+
+var (
+	_ FullIndexRepo = (*CachedIndexRepo)(nil)
+	_ Compactor     = (*CachedIndexRepo)(nil)
+	_ BloomRepo     = (*CachedIndexRepo)(nil)
+	_ DirectIORepo  = (*CachedIndexRepo)(nil)
+)
+
+// NewCachedRepo wraps a FullIndexRepo with a cache of up to maxEntries
+// parsed indices.
+func NewCachedRepo(repo FullIndexRepo, maxEntries int) *CachedIndexRepo {
+	return &CachedIndexRepo{
+		FullIndexRepo: repo,
+		max:           maxEntries,
+		entries:       make(map[shard.Key]*list.Element),
+		lru:           list.New(),
+	}
+}
+
+// Compact compacts the wrapped repo, if it's a Compactor, and is a no-op
+// otherwise.
+func (c *CachedIndexRepo) Compact(ctx context.Context) (uint64, error) {
+	if cp, ok := c.FullIndexRepo.(Compactor); ok {
+		return cp.Compact(ctx)
+	}
+	return 0, nil
+}
+
+// SetDirectIO sets the direct IO options of the wrapped repo, if it's a
+// DirectIORepo, and is a no-op otherwise.
+func (c *CachedIndexRepo) SetDirectIO(opts *directio.Options) {
+	if dr, ok := c.FullIndexRepo.(DirectIORepo); ok {
+		dr.SetDirectIO(opts)
+	}
+}
+
+// GetBloom gets the bloom filter from the wrapped repo, if it's a BloomRepo,
+// and fails with ErrNotFound otherwise. The filter isn't cached.
+func (c *CachedIndexRepo) GetBloom() (*Bloom, []shard.Key, error) {
+	if br, ok := c.FullIndexRepo.(BloomRepo); ok {
+		return br.GetBloom()
+	}
+	return nil, nil, ErrNotFound
+}
+
+// PutBloom persists the bloom filter in the wrapped repo, if it's a
+// BloomRepo, and is a no-op otherwise.
+func (c *CachedIndexRepo) PutBloom(b *Bloom, keys []shard.Key) error {
+	if br, ok := c.FullIndexRepo.(BloomRepo); ok {
+		return br.PutBloom(b, keys)
+	}
+	return nil
+}
+
+// DropBloom drops the bloom filter from the wrapped repo, if it's a
+// BloomRepo, and is a no-op otherwise.
+func (c *CachedIndexRepo) DropBloom() error {
+	if br, ok := c.FullIndexRepo.(BloomRepo); ok {
+		return br.DropBloom()
+	}
+	return nil
+}
+
+func (c *CachedIndexRepo) GetFullIndex(key shard.Key) (carindex.Index, error) {
+	c.lk.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		c.hits++
+		c.lk.Unlock()
+		return e.Value.(*cachedIndex).idx, nil
+	}
+	c.misses++
+	gen := c.gen
+	c.lk.Unlock()
+
+	// key loads by generation, so that loads started before an invalidation
+	// aren't shared with callers that came after it.
+	v, err, _ := c.flight.Do(fmt.Sprintf("%s/%d", key.String(), gen), func() (interface{}, error) {
+		return c.FullIndexRepo.GetFullIndex(key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	idx := v.(carindex.Index)
+
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	// don't cache an index that may have been replaced or dropped while we
+	// were loading it.
+	if c.gen == gen {
+		c.add(key, idx)
+	}
+	return idx, nil
+}
+
+// add caches an index, evicting the least recently used one if full. It must
+// be called with the lock held.
+func (c *CachedIndexRepo) add(key shard.Key, idx carindex.Index) {
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*cachedIndex).idx = idx
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cachedIndex{key: key, idx: idx})
+	if c.lru.Len() > c.max {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedIndex).key)
+	}
+}
+
+func (c *CachedIndexRepo) AddFullIndex(key shard.Key, index carindex.Index) error {
+	c.invalidate(key)
+	defer c.invalidate(key)
+	return c.FullIndexRepo.AddFullIndex(key, index)
+}
+
+func (c *CachedIndexRepo) DropFullIndex(key shard.Key) (dropped bool, err error) {
+	c.invalidate(key)
+	defer c.invalidate(key)
+	return c.FullIndexRepo.DropFullIndex(key)
+}
+
+// invalidate evicts the index of a shard from the cache, and prevents loads
+// in flight from caching stale indices. It's called both before and after
+// the index is replaced or dropped, so that loads racing with the change
+// aren't cached either.
+func (c *CachedIndexRepo) invalidate(key shard.Key) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	c.gen++
+	if e, ok := c.entries[key]; ok {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+	}
+}
+
+// CacheStats returns statistics about the cache.
+func (c *CachedIndexRepo) CacheStats() CacheStats {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	return CacheStats{Hits: c.hits, Misses: c.misses, Entries: c.lru.Len()}
+}
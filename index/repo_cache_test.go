@@ -0,0 +1,75 @@
+package index
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/dagstore/shard"
+	"github.com/ipfs/go-cid"
+	carindex "github.com/ipld/go-car/v2/index"
+	"github.com/multiformats/go-multicodec"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestCachedIndexRepo(t *testing.T) {
+	repo, err := NewFSRepo(t.TempDir())
+	require.NoError(t, err)
+
+	suite.Run(t, &fullIndexRepoSuite{impl: NewCachedRepo(repo, 2)})
+}
+
+func TestCachedIndexRepoCaching(t *testing.T) {
+	repo, err := NewFSRepo(t.TempDir())
+	require.NoError(t, err)
+	c := NewCachedRepo(repo, 2)
+
+	cid1, err := cid.Parse("bafykbzaceaeqhm77anl5mv2wjkmh4ofyf6s6eww3ujfmhtsfab65vi3rlccaq")
+	require.NoError(t, err)
+	newIndex := func(offset uint64) carindex.Index {
+		idx, err := carindex.New(multicodec.CarIndexSorted)
+		require.NoError(t, err)
+		err = idx.Load([]carindex.Record{{Cid: cid1, Offset: offset}})
+		require.NoError(t, err)
+		return idx
+	}
+
+	k1, k2, k3 := shard.KeyFromString("1"), shard.KeyFromString("2"), shard.KeyFromString("3")
+	for _, k := range []shard.Key{k1, k2, k3} {
+		require.NoError(t, c.AddFullIndex(k, newIndex(10)))
+	}
+
+	// the second get of an index is served from the cache.
+	idx1, err := c.GetFullIndex(k1)
+	require.NoError(t, err)
+	idx, err := c.GetFullIndex(k1)
+	require.NoError(t, err)
+	require.True(t, idx == idx1)
+	require.Equal(t, CacheStats{Hits: 1, Misses: 1, Entries: 1}, c.CacheStats())
+
+	// the least recently used index is evicted.
+	_, err = c.GetFullIndex(k2)
+	require.NoError(t, err)
+	_, err = c.GetFullIndex(k3)
+	require.NoError(t, err)
+	require.Equal(t, CacheStats{Hits: 1, Misses: 3, Entries: 2}, c.CacheStats())
+	idx, err = c.GetFullIndex(k1)
+	require.NoError(t, err)
+	require.False(t, idx == idx1)
+	require.EqualValues(t, 4, c.CacheStats().Misses)
+
+	// replacing an index invalidates it.
+	require.NoError(t, c.AddFullIndex(k1, newIndex(20)))
+	idx, err = c.GetFullIndex(k1)
+	require.NoError(t, err)
+	err = idx.GetAll(cid1, func(offset uint64) bool {
+		require.EqualValues(t, 20, offset)
+		return false
+	})
+	require.NoError(t, err)
+
+	// dropping an index invalidates it.
+	_, err = c.DropFullIndex(k1)
+	require.NoError(t, err)
+	_, err = c.GetFullIndex(k1)
+	require.Error(t, err)
+}
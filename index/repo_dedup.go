@@ -0,0 +1,349 @@
+package index
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/filecoin-project/dagstore/shard"
+	carindex "github.com/ipld/go-car/v2/index"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	dedupRepoVersion = "dedup-1"
+	dedupBlobsDir    = "blobs"
+	dedupRefSuffix   = ".ref"
+)
+
+// DedupFSIndexRepo implements FullIndexRepo using the local file system,
+// deduplicating identical indices across shards. This saves space when the
+// same data is stored in several shards, e.g. for replicated deals.
+//
+// Indices are stored once in content-addressed files, named after the SHA-256
+// of their serialized form. Each shard holds a small reference file pointing
+// to its index. Reference counts are tracked in memory, rebuilt from the
+// reference files on start, and an index file is deleted when its last
+// reference is dropped.
+type DedupFSIndexRepo struct {
+	baseDir string
+
+	lk   sync.RWMutex
+	refs map[string]int // index hash => number of shards referencing it.
+}
+
+var (
+	_ FullIndexRepo = (*DedupFSIndexRepo)(nil)
+	_ Compactor     = (*DedupFSIndexRepo)(nil)
+)
+
+// NewDedupFSRepo creates a new deduplicating index repo that stores indices on
+// the local filesystem with the given base directory as the root. The
+// directory can't be shared with a repo created with NewFSRepo.
+func NewDedupFSRepo(baseDir string) (*DedupFSIndexRepo, error) {
+	l := &DedupFSIndexRepo{baseDir: baseDir, refs: make(map[string]int)}
+
+	err := os.MkdirAll(l.blobsDir(), os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create index repo dir: %w", err)
+	}
+
+	// Get the repo version
+	bs, err := os.ReadFile(l.versionPath())
+	switch {
+	case os.IsNotExist(err):
+		err = os.WriteFile(l.versionPath(), []byte(dedupRepoVersion), 0666)
+		if err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	case string(bs) != dedupRepoVersion:
+		return nil, xerrors.Errorf("cannot read existing repo with version %s", bs)
+	}
+
+	if err := l.loadRefs(); err != nil {
+		return nil, fmt.Errorf("failed to load index references: %w", err)
+	}
+	return l, nil
+}
+
+// loadRefs rebuilds the reference counts from the reference files, and deletes
+// index files that are no longer referenced, e.g. after a crash midway through
+// a drop.
+func (l *DedupFSIndexRepo) loadRefs() error {
+	err := l.eachRefFile(func(name string) error {
+		hash, err := os.ReadFile(filepath.Join(l.baseDir, name))
+		if err != nil {
+			return err
+		}
+		l.refs[string(hash)]++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	_, err = l.removeUnreferenced(context.Background(), true)
+	return err
+}
+
+// Compact deletes index files that are no longer referenced, e.g. after a
+// failure midway through a drop. Temporary files of interrupted writes are
+// only deleted on start, as they can't be told apart from those of writes
+// in progress.
+func (l *DedupFSIndexRepo) Compact(ctx context.Context) (uint64, error) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	return l.removeUnreferenced(ctx, false)
+}
+
+// removeUnreferenced deletes the index files that aren't referenced, as well
+// as temporary files if temps is set, and returns the bytes reclaimed. It
+// must be called with the lock held, or before the repo is used.
+func (l *DedupFSIndexRepo) removeUnreferenced(ctx context.Context, temps bool) (uint64, error) {
+	entries, err := os.ReadDir(l.blobsDir())
+	if err != nil {
+		return 0, err
+	}
+	var reclaimed uint64
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return reclaimed, err
+		}
+		name := e.Name()
+		if strings.HasSuffix(name, indexSuffix) {
+			if l.refs[strings.TrimSuffix(name, indexSuffix)] > 0 {
+				continue
+			}
+		} else if !temps {
+			continue
+		}
+		// unreferenced, or leftover temporary file from an interrupted write.
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if err := os.Remove(filepath.Join(l.blobsDir(), name)); err == nil {
+			reclaimed += uint64(info.Size())
+		}
+	}
+	return reclaimed, nil
+}
+
+func (l *DedupFSIndexRepo) GetFullIndex(key shard.Key) (carindex.Index, error) {
+	l.lk.RLock()
+	defer l.lk.RUnlock()
+
+	hash, err := l.readRef(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(l.blobPath(hash))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return carindex.ReadFrom(f)
+}
+
+func (l *DedupFSIndexRepo) AddFullIndex(key shard.Key, index carindex.Index) error {
+	// Write the index to a temporary file, hashing it on the way
+	f, err := os.CreateTemp(l.blobsDir(), "add-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) //nolint:errcheck
+
+	h := sha256.New()
+	_, err = carindex.WriteTo(index, io.MultiWriter(f, h))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	// Replace the existing index of the shard, if any
+	if prev, err := l.readRef(key); err == nil {
+		if prev == hash {
+			return nil
+		}
+		if err := l.unref(key, prev); err != nil {
+			return err
+		}
+	}
+
+	// Keep the existing index file if another shard has the same index
+	if l.refs[hash] == 0 {
+		if err := os.Rename(f.Name(), l.blobPath(hash)); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(l.refPath(key), []byte(hash), 0666); err != nil {
+		if l.refs[hash] == 0 {
+			_ = os.Remove(l.blobPath(hash))
+		}
+		return err
+	}
+	l.refs[hash]++
+	return nil
+}
+
+func (l *DedupFSIndexRepo) DropFullIndex(key shard.Key) (dropped bool, err error) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	hash, err := l.readRef(key)
+	if err != nil {
+		return false, err
+	}
+	return true, l.unref(key, hash)
+}
+
+// unref removes the reference of a shard to an index, deleting the index file
+// if it was the last reference. It must be called with the lock held.
+func (l *DedupFSIndexRepo) unref(key shard.Key, hash string) error {
+	if err := os.Remove(l.refPath(key)); err != nil {
+		return err
+	}
+	if l.refs[hash]--; l.refs[hash] > 0 {
+		return nil
+	}
+	delete(l.refs, hash)
+	return os.Remove(l.blobPath(hash))
+}
+
+func (l *DedupFSIndexRepo) StatFullIndex(key shard.Key) (Stat, error) {
+	l.lk.RLock()
+	defer l.lk.RUnlock()
+
+	hash, err := l.readRef(key)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Stat{Exists: false}, nil
+		}
+		return Stat{}, err
+	}
+
+	info, err := os.Stat(l.blobPath(hash))
+	if err != nil {
+		return Stat{}, err
+	}
+	return Stat{
+		Exists: true,
+		Size:   uint64(info.Size()),
+	}, nil
+}
+
+// Refs returns the number of shards sharing the index of the specified shard,
+// including itself.
+func (l *DedupFSIndexRepo) Refs(key shard.Key) (int, error) {
+	l.lk.RLock()
+	defer l.lk.RUnlock()
+
+	hash, err := l.readRef(key)
+	if err != nil {
+		return 0, err
+	}
+	return l.refs[hash], nil
+}
+
+// ForEach iterates over each reference file to extract the key
+func (l *DedupFSIndexRepo) ForEach(f func(shard.Key) (bool, error)) error {
+	err := l.eachRefFile(func(name string) error {
+		k := shard.KeyFromString(strings.TrimSuffix(name, dedupRefSuffix))
+		ok, err := f(k)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return stopWalk
+		}
+		return nil
+	})
+	if err == stopWalk {
+		return nil
+	}
+	return err
+}
+
+// Len counts all shards with an index, whether shared or not
+func (l *DedupFSIndexRepo) Len() (int, error) {
+	ret := 0
+	err := l.eachRefFile(func(string) error {
+		ret++
+		return nil
+	})
+	return ret, err
+}
+
+// Size sums the size of all index files, counting shared indices once
+func (l *DedupFSIndexRepo) Size() (uint64, error) {
+	l.lk.RLock()
+	defer l.lk.RUnlock()
+
+	var size uint64
+	for hash := range l.refs {
+		info, err := os.Stat(l.blobPath(hash))
+		if err != nil {
+			return 0, err
+		}
+		size += uint64(info.Size())
+	}
+	return size, nil
+}
+
+// eachRefFile calls the callback with the name of each reference file
+func (l *DedupFSIndexRepo) eachRefFile(f func(name string) error) error {
+	entries, err := os.ReadDir(l.baseDir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), dedupRefSuffix) {
+			continue
+		}
+		if err := f(e.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *DedupFSIndexRepo) readRef(key shard.Key) (string, error) {
+	hash, err := os.ReadFile(l.refPath(key))
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (l *DedupFSIndexRepo) refPath(key shard.Key) string {
+	return filepath.Join(l.baseDir, key.String()+dedupRefSuffix)
+}
+
+func (l *DedupFSIndexRepo) blobPath(hash string) string {
+	return filepath.Join(l.blobsDir(), hash+indexSuffix)
+}
+
+func (l *DedupFSIndexRepo) blobsDir() string {
+	return filepath.Join(l.baseDir, dedupBlobsDir)
+}
+
+func (l *DedupFSIndexRepo) versionPath() string {
+	return filepath.Join(l.baseDir, ".version")
+}
@@ -0,0 +1,176 @@
+package index
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/filecoin-project/dagstore/shard"
+	"github.com/ipfs/go-cid"
+	carindex "github.com/ipld/go-car/v2/index"
+	"github.com/multiformats/go-multicodec"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestDedupFSRepo(t *testing.T) {
+	basePath := t.TempDir()
+	repo, err := NewDedupFSRepo(basePath)
+	require.NoError(t, err)
+
+	suite.Run(t, &fullIndexRepoSuite{impl: repo})
+}
+
+func TestDedupFSRepoVersions(t *testing.T) {
+	basePath := t.TempDir()
+	_, err := NewDedupFSRepo(basePath)
+	require.NoError(t, err)
+
+	// Verify we can create a new repo at the same path
+	_, err = NewDedupFSRepo(basePath)
+	require.NoError(t, err)
+
+	// Verify that the layouts can't be mixed up
+	_, err = NewFSRepo(basePath)
+	require.Error(t, err)
+
+	fsPath := t.TempDir()
+	_, err = NewFSRepo(fsPath)
+	require.NoError(t, err)
+	_, err = NewDedupFSRepo(fsPath)
+	require.Error(t, err)
+}
+
+func TestDedupFSRepoSharing(t *testing.T) {
+	basePath := t.TempDir()
+
+	cid1, err := cid.Parse("bafykbzaceaeqhm77anl5mv2wjkmh4ofyf6s6eww3ujfmhtsfab65vi3rlccaq")
+	require.NoError(t, err)
+	k1 := shard.KeyFromString("shard-key-1")
+	k2 := shard.KeyFromString("shard-key-2")
+	k3 := shard.KeyFromString("shard-key-3")
+
+	// make two distinct indices
+	idx1, err := carindex.New(multicodec.CarIndexSorted)
+	require.NoError(t, err)
+	err = idx1.Load([]carindex.Record{{Cid: cid1, Offset: 10}})
+	require.NoError(t, err)
+	idx2, err := carindex.New(multicodec.CarIndexSorted)
+	require.NoError(t, err)
+	err = idx2.Load([]carindex.Record{{Cid: cid1, Offset: 20}})
+	require.NoError(t, err)
+
+	var b bytes.Buffer
+	_, err = carindex.WriteTo(idx1, &b)
+	require.NoError(t, err)
+	idxSize := uint64(b.Len())
+
+	repo, err := NewDedupFSRepo(basePath)
+	require.NoError(t, err)
+
+	// two shards with the same index share it
+	require.NoError(t, repo.AddFullIndex(k1, idx1))
+	require.NoError(t, repo.AddFullIndex(k2, idx1))
+	require.NoError(t, repo.AddFullIndex(k3, idx2))
+
+	l, err := repo.Len()
+	require.NoError(t, err)
+	require.Equal(t, 3, l)
+
+	size, err := repo.Size()
+	require.NoError(t, err)
+	require.Equal(t, 2*idxSize, size)
+
+	refs, err := repo.Refs(k2)
+	require.NoError(t, err)
+	require.Equal(t, 2, refs)
+
+	blobs, err := os.ReadDir(repo.blobsDir())
+	require.NoError(t, err)
+	require.Len(t, blobs, 2)
+
+	// reference counts survive restarts
+	repo, err = NewDedupFSRepo(basePath)
+	require.NoError(t, err)
+	refs, err = repo.Refs(k1)
+	require.NoError(t, err)
+	require.Equal(t, 2, refs)
+
+	// dropping one shard keeps the shared index for the other
+	dropped, err := repo.DropFullIndex(k1)
+	require.NoError(t, err)
+	require.True(t, dropped)
+
+	fidx, err := repo.GetFullIndex(k2)
+	require.NoError(t, err)
+	offset, err := carindex.GetFirst(fidx, cid1)
+	require.NoError(t, err)
+	require.EqualValues(t, 10, offset)
+
+	refs, err = repo.Refs(k2)
+	require.NoError(t, err)
+	require.Equal(t, 1, refs)
+
+	// replacing the index of a shard releases the previous one
+	require.NoError(t, repo.AddFullIndex(k2, idx2))
+	refs, err = repo.Refs(k3)
+	require.NoError(t, err)
+	require.Equal(t, 2, refs)
+
+	blobs, err = os.ReadDir(repo.blobsDir())
+	require.NoError(t, err)
+	require.Len(t, blobs, 1)
+
+	// dropping the last reference deletes the index
+	_, err = repo.DropFullIndex(k2)
+	require.NoError(t, err)
+	_, err = repo.DropFullIndex(k3)
+	require.NoError(t, err)
+
+	blobs, err = os.ReadDir(repo.blobsDir())
+	require.NoError(t, err)
+	require.Empty(t, blobs)
+
+	size, err = repo.Size()
+	require.NoError(t, err)
+	require.Zero(t, size)
+}
+
+func TestDedupFSRepoCompact(t *testing.T) {
+	basePath := t.TempDir()
+	repo, err := NewDedupFSRepo(basePath)
+	require.NoError(t, err)
+
+	cid1, err := cid.Parse("bafykbzaceaeqhm77anl5mv2wjkmh4ofyf6s6eww3ujfmhtsfab65vi3rlccaq")
+	require.NoError(t, err)
+	idx, err := carindex.New(multicodec.CarIndexSorted)
+	require.NoError(t, err)
+	err = idx.Load([]carindex.Record{{Cid: cid1, Offset: 10}})
+	require.NoError(t, err)
+	k := shard.KeyFromString("shard-key-1")
+	require.NoError(t, repo.AddFullIndex(k, idx))
+
+	// an unreferenced index, as left behind by a failed drop, and a temporary
+	// file, which may belong to a write in progress.
+	require.NoError(t, os.WriteFile(repo.blobPath("deadbeef"), []byte("orphan"), 0666))
+	require.NoError(t, os.WriteFile(filepath.Join(repo.blobsDir(), "add-1"), []byte("tmp"), 0666))
+
+	reclaimed, err := repo.Compact(context.Background())
+	require.NoError(t, err)
+	require.EqualValues(t, len("orphan"), reclaimed)
+
+	_, err = os.Stat(repo.blobPath("deadbeef"))
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(repo.blobsDir(), "add-1"))
+	require.NoError(t, err)
+	_, err = repo.GetFullIndex(k)
+	require.NoError(t, err)
+
+	// temporary files are removed on start.
+	_, err = NewDedupFSRepo(basePath)
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(repo.blobsDir(), "add-1"))
+	require.True(t, os.IsNotExist(err))
+}
@@ -1,11 +1,15 @@
 package index
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 
+	"github.com/filecoin-project/dagstore/directio"
 	"github.com/filecoin-project/dagstore/shard"
 	carindex "github.com/ipld/go-car/v2/index"
 
@@ -15,25 +19,48 @@ import (
 const (
 	repoVersion = "1"
 	indexSuffix = ".full.idx"
+	bloomFile   = ".bloom"
 )
 
 // FSIndexRepo implements FullIndexRepo using the local file system to store
 // the indices
 type FSIndexRepo struct {
 	baseDir string
+	layout  shard.Layout
+
+	// dirLk is held for reading while adding indices, and for writing while
+	// compacting, so that the directory of an index isn't removed while it's
+	// being added.
+	dirLk sync.RWMutex
+
+	// directIO, if non-nil, are the options of the direct IO writes of
+	// indices; set through SetDirectIO.
+	directIO atomic.Value // *directio.Options
 }
 
-var _ FullIndexRepo = (*FSIndexRepo)(nil)
+var (
+	_ FullIndexRepo = (*FSIndexRepo)(nil)
+	_ Compactor     = (*FSIndexRepo)(nil)
+	_ BloomRepo     = (*FSIndexRepo)(nil)
+	_ DirectIORepo  = (*FSIndexRepo)(nil)
+)
 
 // NewFSRepo creates a new index repo that stores indices on the local
 // filesystem with the given base directory as the root
 func NewFSRepo(baseDir string) (*FSIndexRepo, error) {
+	return NewFSRepoWithLayout(baseDir, shard.LayoutFlat)
+}
+
+// NewFSRepoWithLayout is like NewFSRepo, but lays out indices under the base
+// directory with the given layout. Indices stored with a different layout are
+// migrated to it.
+func NewFSRepoWithLayout(baseDir string, layout shard.Layout) (*FSIndexRepo, error) {
 	err := os.MkdirAll(baseDir, os.ModePerm)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create index repo dir: %w", err)
 	}
 
-	l := &FSIndexRepo{baseDir: baseDir}
+	l := &FSIndexRepo{baseDir: baseDir, layout: layout}
 
 	// Get the repo version
 	bs, err := os.ReadFile(l.versionPath())
@@ -44,6 +71,9 @@ func NewFSRepo(baseDir string) (*FSIndexRepo, error) {
 			if err != nil {
 				return nil, err
 			}
+			if err := l.migrateLayout(); err != nil {
+				return nil, fmt.Errorf("failed to record index repo layout: %w", err)
+			}
 			return l, nil
 		}
 
@@ -56,6 +86,9 @@ func NewFSRepo(baseDir string) (*FSIndexRepo, error) {
 		return nil, xerrors.Errorf("cannot read existing repo with version %s", bs)
 	}
 
+	if err := l.migrateLayout(); err != nil {
+		return nil, fmt.Errorf("failed to migrate index repo layout: %w", err)
+	}
 	return l, nil
 }
 
@@ -73,7 +106,13 @@ func (l *FSIndexRepo) GetFullIndex(key shard.Key) (carindex.Index, error) {
 }
 
 func (l *FSIndexRepo) AddFullIndex(key shard.Key, index carindex.Index) (err error) {
+	l.dirLk.RLock()
+	defer l.dirLk.RUnlock()
+
 	// Create a file at the key path
+	if err := os.MkdirAll(l.layout.Dir(l.baseDir, key), os.ModePerm); err != nil {
+		return err
+	}
 	f, err := os.Create(l.indexPath(key))
 	if err != nil {
 		return err
@@ -81,10 +120,23 @@ func (l *FSIndexRepo) AddFullIndex(key shard.Key, index carindex.Index) (err err
 	defer f.Close()
 
 	// Write the index to the file
+	if opts, _ := l.directIO.Load().(*directio.Options); opts != nil {
+		w := directio.NewWriter(f, *opts)
+		if _, err := carindex.WriteTo(index, w); err != nil {
+			return err
+		}
+		return w.Close()
+	}
 	_, err = carindex.WriteTo(index, f)
 	return err
 }
 
+// SetDirectIO writes indices with direct IO with the supplied options from
+// now on, or with buffered IO if nil.
+func (l *FSIndexRepo) SetDirectIO(opts *directio.Options) {
+	l.directIO.Store(opts)
+}
+
 func (l *FSIndexRepo) DropFullIndex(key shard.Key) (dropped bool, err error) {
 	// Remove the file at the key path
 	return true, os.Remove(l.indexPath(key))
@@ -108,6 +160,41 @@ func (l *FSIndexRepo) StatFullIndex(key shard.Key) (Stat, error) {
 	}, nil
 }
 
+// GetBloom reads the bloom filter from its file at the root of the repo.
+func (l *FSIndexRepo) GetBloom() (*Bloom, []shard.Key, error) {
+	bs, err := os.ReadFile(l.bloomPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, fmt.Errorf("bloom filter: %w", ErrNotFound)
+		}
+		return nil, nil, err
+	}
+	return unmarshalBloomSnapshot(bs)
+}
+
+// PutBloom writes the bloom filter to its file at the root of the repo.
+func (l *FSIndexRepo) PutBloom(b *Bloom, keys []shard.Key) error {
+	bs, err := marshalBloomSnapshot(b, keys)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first, so that an interrupted write doesn't
+	// leave a truncated filter behind.
+	tmp := l.bloomPath() + ".tmp"
+	if err := os.WriteFile(tmp, bs, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.bloomPath())
+}
+
+func (l *FSIndexRepo) DropBloom() error {
+	err := os.Remove(l.bloomPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
 var stopWalk = xerrors.New("stop walk")
 
 // ForEach iterates over each index file to extract the key
@@ -156,6 +243,51 @@ func (l *FSIndexRepo) Size() (uint64, error) {
 	return size, err
 }
 
+// Compact removes the empty index files and the temporary bloom filter file
+// left behind by interrupted writes, and the directories of the layout that no
+// longer hold indices. It reports the bytes taken up by the removed files.
+func (l *FSIndexRepo) Compact(ctx context.Context) (uint64, error) {
+	l.dirLk.Lock()
+	defer l.dirLk.Unlock()
+
+	var (
+		empty, dirs []string
+		reclaimed   uint64
+	)
+	err := filepath.Walk(l.baseDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		switch {
+		case info.IsDir() && path != l.baseDir:
+			dirs = append(dirs, path)
+		case strings.HasSuffix(info.Name(), indexSuffix) && info.Size() == 0:
+			empty = append(empty, path)
+		case path == l.bloomPath()+".tmp":
+			empty = append(empty, path)
+			reclaimed += uint64(info.Size())
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, path := range empty {
+		if err := os.Remove(path); err != nil {
+			return 0, err
+		}
+	}
+	// remove the deepest directories first; removal fails on directories that
+	// aren't empty, which are kept.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		_ = os.Remove(dirs[i])
+	}
+	return reclaimed, nil
+}
+
 // eachIndexFile calls the callback for each index file
 func (l *FSIndexRepo) eachIndexFile(f func(info os.FileInfo) error) error {
 	return filepath.Walk(l.baseDir, func(path string, info os.FileInfo, err error) error {
@@ -167,9 +299,63 @@ func (l *FSIndexRepo) eachIndexFile(f func(info os.FileInfo) error) error {
 }
 
 func (l *FSIndexRepo) indexPath(key shard.Key) string {
-	return filepath.Join(l.baseDir, key.String()+indexSuffix)
+	return filepath.Join(l.layout.Dir(l.baseDir, key), key.String()+indexSuffix)
+}
+
+func (l *FSIndexRepo) bloomPath() string {
+	return filepath.Join(l.baseDir, bloomFile)
 }
 
 func (l *FSIndexRepo) versionPath() string {
 	return filepath.Join(l.baseDir, ".version")
 }
+
+func (l *FSIndexRepo) layoutPath() string {
+	return filepath.Join(l.baseDir, ".layout")
+}
+
+// migrateLayout moves the index files into the layout of the repo, if they
+// were stored with a different one. Repos without a layout file are flat.
+func (l *FSIndexRepo) migrateLayout() error {
+	bs, err := os.ReadFile(l.layoutPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	prev := shard.LayoutFlat.String()
+	if err == nil {
+		prev = string(bs)
+	}
+	if prev == l.layout.String() {
+		return nil
+	}
+
+	var paths []string
+	err = filepath.Walk(l.baseDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(info.Name(), indexSuffix) {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		name := filepath.Base(path)
+		key := shard.KeyFromString(name[:len(name)-len(indexSuffix)])
+		if dst := l.indexPath(key); dst != path {
+			if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+				return err
+			}
+			if err := os.Rename(path, dst); err != nil {
+				return err
+			}
+		}
+	}
+
+	// record the layout once all indices have been moved, so that an
+	// interrupted migration is resumed.
+	return os.WriteFile(l.layoutPath(), []byte(l.layout.String()), 0666)
+}
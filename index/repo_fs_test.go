@@ -1,7 +1,9 @@
 package index
 
 import (
+	"context"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/filecoin-project/dagstore/shard"
@@ -74,3 +76,142 @@ func TestFSRepoLoadFromDisk(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, offset1, offset)
 }
+
+func TestFSRepoShardedLayout(t *testing.T) {
+	basePath := t.TempDir()
+
+	// suite against the sharded layout.
+	repo, err := NewFSRepoWithLayout(t.TempDir(), shard.LayoutSharded)
+	require.NoError(t, err)
+	suite.Run(t, &fullIndexRepoSuite{impl: repo})
+
+	// add indices to a flat repo.
+	cid1, err := cid.Parse("bafykbzaceaeqhm77anl5mv2wjkmh4ofyf6s6eww3ujfmhtsfab65vi3rlccaq")
+	require.NoError(t, err)
+	idx, err := carindex.New(multicodec.CarIndexSorted)
+	require.NoError(t, err)
+	err = idx.Load([]carindex.Record{{Cid: cid1, Offset: 10}})
+	require.NoError(t, err)
+
+	flat, err := NewFSRepo(basePath)
+	require.NoError(t, err)
+	keys := []shard.Key{shard.KeyFromString("shard-key-1"), shard.KeyFromString("shard-key-2")}
+	for _, k := range keys {
+		require.NoError(t, flat.AddFullIndex(k, idx))
+	}
+
+	// reopening it sharded migrates the indices into subdirectories.
+	sharded, err := NewFSRepoWithLayout(basePath, shard.LayoutSharded)
+	require.NoError(t, err)
+	for _, k := range keys {
+		_, err := os.Stat(flat.indexPath(k))
+		require.True(t, os.IsNotExist(err))
+
+		path := sharded.indexPath(k)
+		require.Equal(t, shard.LayoutSharded.Dir(basePath, k), filepath.Dir(path))
+		_, err = os.Stat(path)
+		require.NoError(t, err)
+
+		_, err = sharded.GetFullIndex(k)
+		require.NoError(t, err)
+	}
+	n, err := sharded.Len()
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	// and reopening it flat migrates them back.
+	flat, err = NewFSRepo(basePath)
+	require.NoError(t, err)
+	for _, k := range keys {
+		_, err := flat.GetFullIndex(k)
+		require.NoError(t, err)
+	}
+}
+
+func TestFSRepoCompact(t *testing.T) {
+	basePath := t.TempDir()
+	repo, err := NewFSRepoWithLayout(basePath, shard.LayoutSharded)
+	require.NoError(t, err)
+
+	cid1, err := cid.Parse("bafykbzaceaeqhm77anl5mv2wjkmh4ofyf6s6eww3ujfmhtsfab65vi3rlccaq")
+	require.NoError(t, err)
+	idx, err := carindex.New(multicodec.CarIndexSorted)
+	require.NoError(t, err)
+	err = idx.Load([]carindex.Record{{Cid: cid1, Offset: 10}})
+	require.NoError(t, err)
+
+	kept, dropped, empty := shard.KeyFromString("kept"), shard.KeyFromString("dropped"), shard.KeyFromString("empty")
+	require.NoError(t, repo.AddFullIndex(kept, idx))
+	require.NoError(t, repo.AddFullIndex(dropped, idx))
+	_, err = repo.DropFullIndex(dropped)
+	require.NoError(t, err)
+
+	// an empty index file, as left behind by an interrupted write.
+	require.NoError(t, os.MkdirAll(filepath.Dir(repo.indexPath(empty)), os.ModePerm))
+	require.NoError(t, os.WriteFile(repo.indexPath(empty), nil, 0666))
+
+	reclaimed, err := repo.Compact(context.Background())
+	require.NoError(t, err)
+	require.Zero(t, reclaimed)
+
+	// the empty file and the directories left without indices are removed.
+	for _, k := range []shard.Key{dropped, empty} {
+		_, err := os.Stat(shard.LayoutSharded.Dir(basePath, k))
+		require.True(t, os.IsNotExist(err))
+	}
+	_, err = repo.GetFullIndex(kept)
+	require.NoError(t, err)
+	n, err := repo.Len()
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+}
+
+func TestFSRepoBloom(t *testing.T) {
+	basePath := t.TempDir()
+	repo, err := NewFSRepoWithLayout(basePath, shard.LayoutSharded)
+	require.NoError(t, err)
+
+	_, _, err = repo.GetBloom()
+	require.ErrorIs(t, err, ErrNotFound)
+
+	b := NewBloom(10, 0.01)
+	for _, h := range testMultihashes(t, "added", 10) {
+		b.Add(h)
+	}
+	keys := []shard.Key{shard.KeyFromString("shard-key-1"), shard.KeyFromString("shard/key 2")}
+	require.NoError(t, repo.PutBloom(b, keys))
+
+	// the filter is stored at the root of the repo, but isn't an index.
+	got, gotKeys, err := repo.GetBloom()
+	require.NoError(t, err)
+	require.Equal(t, b, got)
+	require.Equal(t, keys, gotKeys)
+	n, err := repo.Len()
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	// it's left in place by layout migrations.
+	flat, err := NewFSRepo(basePath)
+	require.NoError(t, err)
+	got, _, err = flat.GetBloom()
+	require.NoError(t, err)
+	require.Equal(t, b, got)
+
+	// temporary files left behind by interrupted writes are compacted.
+	require.NoError(t, os.WriteFile(flat.bloomPath()+".tmp", []byte("partial"), 0666))
+	reclaimed, err := flat.Compact(context.Background())
+	require.NoError(t, err)
+	require.EqualValues(t, len("partial"), reclaimed)
+	_, err = os.Stat(flat.bloomPath() + ".tmp")
+	require.True(t, os.IsNotExist(err))
+
+	// corrupted filters are rejected.
+	require.NoError(t, os.WriteFile(flat.bloomPath(), []byte{1}, 0666))
+	_, _, err = flat.GetBloom()
+	require.Error(t, err)
+
+	require.NoError(t, flat.DropBloom())
+	require.NoError(t, flat.DropBloom())
+	_, _, err = flat.GetBloom()
+	require.ErrorIs(t, err, ErrNotFound)
+}
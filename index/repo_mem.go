@@ -10,8 +10,9 @@ import (
 
 // MemIndexRepo implements FullIndexRepo with an in-memory map.
 type MemIndexRepo struct {
-	lk   sync.RWMutex
-	idxs map[shard.Key]index.Index
+	lk    sync.RWMutex
+	idxs  map[shard.Key]index.Index
+	bloom []byte // snapshot of the bloom filter, if any.
 }
 
 func NewMemoryRepo() *MemIndexRepo {
@@ -128,4 +129,40 @@ func (m *MemIndexRepo) indexSize(k shard.Key) (uint64, error) {
 	return uint64(buff.Len()), nil
 }
 
-var _ FullIndexRepo = (*MemIndexRepo)(nil)
+func (m *MemIndexRepo) GetBloom() (*Bloom, []shard.Key, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	if m.bloom == nil {
+		return nil, nil, ErrNotFound
+	}
+	return unmarshalBloomSnapshot(m.bloom)
+}
+
+// PutBloom stores a snapshot of the bloom filter, which the caller may keep
+// adding to.
+func (m *MemIndexRepo) PutBloom(b *Bloom, keys []shard.Key) error {
+	bs, err := marshalBloomSnapshot(b, keys)
+	if err != nil {
+		return err
+	}
+
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	m.bloom = bs
+	return nil
+}
+
+func (m *MemIndexRepo) DropBloom() error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	m.bloom = nil
+	return nil
+}
+
+var (
+	_ FullIndexRepo = (*MemIndexRepo)(nil)
+	_ BloomRepo     = (*MemIndexRepo)(nil)
+)
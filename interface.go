@@ -3,6 +3,7 @@ package dagstore
 import (
 	"context"
 
+	"github.com/ipfs/go-cid"
 	carindex "github.com/ipld/go-car/v2/index"
 	mh "github.com/multiformats/go-multihash"
 
@@ -16,12 +17,20 @@ type Interface interface {
 	Start(ctx context.Context) error
 	RegisterShard(ctx context.Context, key shard.Key, mnt mount.Mount, out chan ShardResult, opts RegisterOpts) error
 	DestroyShard(ctx context.Context, key shard.Key, out chan ShardResult, _ DestroyOpts) error
-	AcquireShard(ctx context.Context, key shard.Key, out chan ShardResult, _ AcquireOpts) error
+	AcquireShard(ctx context.Context, key shard.Key, out chan ShardResult, opts AcquireOpts) error
 	RecoverShard(ctx context.Context, key shard.Key, out chan ShardResult, _ RecoverOpts) error
 	GetShardInfo(k shard.Key) (ShardInfo, error)
 	GetIterableIndex(key shard.Key) (carindex.IterableIndex, error)
 	AllShardsInfo() AllShardsInfo
 	ShardsContainingMultihash(ctx context.Context, h mh.Multihash) ([]shard.Key, error)
+	ShardsContainingCid(ctx context.Context, c cid.Cid) ([]shard.Key, error)
 	GC(ctx context.Context) (*GCResult, error)
+	GCDryRun(ctx context.Context) (*GCResult, error)
+	GCToTarget(ctx context.Context, targetBytes int64) (*GCResult, error)
+	Pause(ctx context.Context) error
+	Resume(ctx context.Context) error
+	LocalityReport(ctx context.Context) (*LocalityReport, error)
+	VerifyIndex(ctx context.Context, key shard.Key, opts VerifyIndexOpts) (*IndexVerifyResult, error)
+	VerifyAll(ctx context.Context, concurrency int, opts VerifyIndexOpts) (map[shard.Key]*IndexVerifyResult, error)
 	Close() error
 }
@@ -0,0 +1,175 @@
+package migrate
+
+import (
+	"context"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+
+	"github.com/filecoin-project/dagstore"
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// BlockSource is a source of blocks to import into a shard. Blockstores from
+// go-ipfs-blockstore, including those backed by badger or flatfs datastores,
+// satisfy it.
+type BlockSource interface {
+	AllKeysChan(ctx context.Context) (<-chan cid.Cid, error)
+	Get(ctx context.Context, c cid.Cid) (blocks.Block, error)
+}
+
+// ImportOpts configures an import.
+type ImportOpts struct {
+	// Roots are the roots of the CAR of the shard. At least one is required.
+	Roots []cid.Cid
+
+	// RegisterOpts are the options the shard is registered with.
+	RegisterOpts dagstore.RegisterOpts
+}
+
+// ImportResult is the outcome of an import.
+type ImportResult struct {
+	// Blocks is the number of blocks imported.
+	Blocks int
+	// Bytes is the total size of the imported blocks.
+	Bytes int64
+	// Skipped lists the files of a block directory that were not recognized
+	// as blocks, and were ignored.
+	Skipped []string
+}
+
+// ImportBlockstore packs all the blocks of src into a new CARv2 shard under
+// key, indexes it, and registers it with the DAG store as available. It is
+// meant to bridge data held in legacy blockstores into the DAG store, one
+// shard per blockstore.
+//
+// The DAG store must have Config.WrittenShardsDir set and the "file" mount
+// scheme registered; see DAGStore.NewShardWriter. Blocks are verified against
+// their CIDs, and the import is aborted and its data discarded on the first
+// failure.
+func ImportBlockstore(ctx context.Context, d *dagstore.DAGStore, key shard.Key, src BlockSource, opts ImportOpts) (*ImportResult, error) {
+	keys, err := src.AllKeysChan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blocks: %w", err)
+	}
+	return importBlocks(ctx, d, key, opts, func(put func(blocks.Block) error) error {
+		for c := range keys {
+			blk, err := src.Get(ctx, c)
+			if err != nil {
+				return fmt.Errorf("failed to get block %s: %w", c, err)
+			}
+			if err := put(blk); err != nil {
+				return err
+			}
+		}
+		return ctx.Err()
+	})
+}
+
+// ImportBlockDir is like ImportBlockstore, but imports a directory of raw
+// blocks, one block per file, searched recursively. Files are named after the
+// CID of their block, or after the multihash of their block in the
+// upper-case unpadded base32 encoding used by flatfs, optionally followed by
+// a ".data" extension. Blocks named after their multihash are imported with
+// CIDv1 raw CIDs. Other files are skipped and reported in the result.
+func ImportBlockDir(ctx context.Context, d *dagstore.DAGStore, key shard.Key, dir string, opts ImportOpts) (*ImportResult, error) {
+	var skipped []string
+	res, err := importBlocks(ctx, d, key, opts, func(put func(blocks.Block) error) error {
+		return filepath.WalkDir(dir, func(path string, de fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if de.IsDir() {
+				return nil
+			}
+			c, ok := blockFileCid(de.Name())
+			if !ok {
+				log.Debugw("skipping file not named after a block", "path", path)
+				skipped = append(skipped, path)
+				return nil
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("failed to read block %s: %w", c, err)
+			}
+			blk, err := blocks.NewBlockWithCid(data, c)
+			if err != nil {
+				return fmt.Errorf("failed to read block %s: %w", c, err)
+			}
+			return put(blk)
+		})
+	})
+	if res != nil {
+		res.Skipped = skipped
+	}
+	return res, err
+}
+
+// blockFileCid parses the CID of a block from the name of its file.
+func blockFileCid(name string) (cid.Cid, bool) {
+	name = strings.TrimSuffix(name, ".data")
+	if c, err := cid.Decode(name); err == nil {
+		return c, true
+	}
+	b, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(name)
+	if err != nil {
+		return cid.Undef, false
+	}
+	mh, err := multihash.Cast(b)
+	if err != nil {
+		return cid.Undef, false
+	}
+	return cid.NewCidV1(cid.Raw, mh), true
+}
+
+// importBlocks writes the blocks produced by each into a new shard, verifying
+// them, and commits the shard if all blocks were written successfully.
+func importBlocks(ctx context.Context, d *dagstore.DAGStore, key shard.Key, opts ImportOpts, each func(put func(blocks.Block) error) error) (*ImportResult, error) {
+	w, err := d.NewShardWriter(key, dagstore.ShardWriterOpts{Roots: opts.Roots, RegisterOpts: opts.RegisterOpts})
+	if err != nil {
+		return nil, err
+	}
+
+	res := new(ImportResult)
+	err = each(func(blk blocks.Block) error {
+		c, err := blk.Cid().Prefix().Sum(blk.RawData())
+		if err != nil {
+			return fmt.Errorf("failed to hash block %s: %w", blk.Cid(), err)
+		}
+		if !c.Equals(blk.Cid()) {
+			return fmt.Errorf("block %s hashes to %s", blk.Cid(), c)
+		}
+		if err := w.Put(ctx, blk); err != nil {
+			return fmt.Errorf("failed to write block %s: %w", blk.Cid(), err)
+		}
+		res.Blocks++
+		res.Bytes += int64(len(blk.RawData()))
+		return nil
+	})
+	if err == nil && res.Blocks == 0 {
+		err = errors.New("no blocks to import")
+	}
+	if err != nil {
+		if derr := w.Discard(); derr != nil {
+			log.Warnw("failed to discard aborted import", "shard", key, "error", derr)
+		}
+		return nil, err
+	}
+
+	if err := w.Commit(ctx); err != nil {
+		return nil, err
+	}
+	log.Infow("imported shard", "shard", key, "blocks", res.Blocks, "bytes", res.Bytes)
+	return res, nil
+}
@@ -0,0 +1,102 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"encoding/base32"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipld/go-car/v2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/dagstore"
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/shard"
+	"github.com/filecoin-project/dagstore/testdata"
+)
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+
+	var blks []blocks.Block
+	br, err := car.NewBlockReader(bytes.NewReader(testdata.CarV2))
+	require.NoError(t, err)
+	for {
+		blk, err := br.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		blks = append(blks, blk)
+	}
+
+	registry := mount.NewRegistry()
+	require.NoError(t, registry.Register("file", new(mount.FileMount)))
+	dagst, err := dagstore.NewDAGStore(dagstore.Config{
+		MountRegistry:    registry,
+		TransientsDir:    t.TempDir(),
+		WrittenShardsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+	defer dagst.Close()
+
+	hasAll := func(k shard.Key) {
+		ch := make(chan dagstore.ShardResult, 1)
+		require.NoError(t, dagst.AcquireShard(ctx, k, ch, dagstore.AcquireOpts{}))
+		res := <-ch
+		require.NoError(t, res.Error)
+		defer res.Accessor.Close()
+		sbs, err := res.Accessor.Blockstore()
+		require.NoError(t, err)
+		for _, blk := range blks {
+			ok, err := sbs.Has(ctx, blk.Cid())
+			require.NoError(t, err)
+			require.True(t, ok, blk.Cid())
+		}
+	}
+	opts := ImportOpts{Roots: []cid.Cid{testdata.RootCID}}
+
+	// from a blockstore.
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, bs.PutMany(ctx, blks))
+	res, err := ImportBlockstore(ctx, dagst, shard.KeyFromString("bs"), bs, opts)
+	require.NoError(t, err)
+	require.Equal(t, len(blks), res.Blocks)
+	hasAll(shard.KeyFromString("bs"))
+
+	// from a directory of blocks, named after CIDs or flatfs-style.
+	dir := t.TempDir()
+	for i, blk := range blks {
+		name := blk.Cid().String()
+		if i%2 == 0 {
+			name = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(blk.Cid().Hash()) + ".data"
+		}
+		sub := filepath.Join(dir, name[len(name)-8:len(name)-6])
+		require.NoError(t, os.MkdirAll(sub, 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(sub, name), blk.RawData(), 0644))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "SHARDING"), []byte("/repo/flatfs/shard/v1/next-to-last/2"), 0644))
+	res, err = ImportBlockDir(ctx, dagst, shard.KeyFromString("dir"), dir, opts)
+	require.NoError(t, err)
+	require.Equal(t, len(blks), res.Blocks)
+	require.Equal(t, []string{filepath.Join(dir, "SHARDING")}, res.Skipped)
+	hasAll(shard.KeyFromString("dir"))
+
+	// corrupted blocks abort the import.
+	corrupt := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(corrupt, blks[0].Cid().String()), []byte("junk"), 0644))
+	_, err = ImportBlockDir(ctx, dagst, shard.KeyFromString("corrupt"), corrupt, opts)
+	require.Error(t, err)
+	_, err = dagst.GetShardInfo(shard.KeyFromString("corrupt"))
+	require.ErrorIs(t, err, dagstore.ErrShardUnknown)
+}
@@ -0,0 +1,83 @@
+package migrate
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+)
+
+// ManifestEntry maps the root of a DAG stored in the legacy blockstore to the
+// deal it belongs to. Each entry results in one shard, keyed by the deal.
+type ManifestEntry struct {
+	Root cid.Cid `json:"root"`
+	Deal string  `json:"deal"`
+}
+
+// ParseManifestCSV parses a deal manifest in CSV format, with one root,deal
+// pair per line. A leading header line (root,deal) is skipped if present.
+func ParseManifestCSV(r io.Reader) ([]ManifestEntry, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 2
+	cr.TrimLeadingSpace = true
+
+	var ret []ManifestEntry
+	for line := 1; ; line++ {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return ret, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read manifest: %w", err)
+		}
+		if line == 1 && strings.EqualFold(rec[0], "root") && strings.EqualFold(rec[1], "deal") {
+			continue // header.
+		}
+		e, err := newEntry(rec[0], rec[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid manifest entry on line %d: %w", line, err)
+		}
+		ret = append(ret, e)
+	}
+}
+
+// ParseManifestJSON parses a deal manifest in JSON format, consisting of an
+// array of {"root": "<cid>", "deal": "<deal>"} objects.
+func ParseManifestJSON(r io.Reader) ([]ManifestEntry, error) {
+	var raw []struct {
+		Root string `json:"root"`
+		Deal string `json:"deal"`
+	}
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+
+	ret := make([]ManifestEntry, 0, len(raw))
+	for i, e := range raw {
+		entry, err := newEntry(e.Root, e.Deal)
+		if err != nil {
+			return nil, fmt.Errorf("invalid manifest entry at index %d: %w", i, err)
+		}
+		ret = append(ret, entry)
+	}
+	return ret, nil
+}
+
+func newEntry(root, deal string) (ManifestEntry, error) {
+	c, err := cid.Parse(strings.TrimSpace(root))
+	if err != nil {
+		return ManifestEntry{}, fmt.Errorf("failed to parse root %q: %w", root, err)
+	}
+	deal = strings.TrimSpace(deal)
+	if deal == "" {
+		return ManifestEntry{}, fmt.Errorf("empty deal for root %s", c)
+	}
+	if strings.ContainsAny(deal, `/\`) {
+		return ManifestEntry{}, fmt.Errorf("deal %q contains path separators", deal)
+	}
+	return ManifestEntry{Root: c, Deal: deal}, nil
+}
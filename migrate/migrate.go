@@ -0,0 +1,275 @@
+// Package migrate consolidates data held in a legacy monolithic IPFS
+// blockstore (the "wrapped blockstore" setup) into the DAG store model, by
+// generating one CAR shard per deal and registering it with the DAG store.
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipld/go-car/v2"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	_ "github.com/ipld/go-ipld-prime/codec/dagcbor" // register the dag-cbor codec for traversals.
+	_ "github.com/ipld/go-ipld-prime/codec/raw"     // register the raw codec for traversals.
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+
+	"github.com/filecoin-project/dagstore"
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+var log = logging.Logger("dagstore/migrate")
+
+// StateNamespace is the namespace under which migration progress is
+// persisted, to allow resuming interrupted migrations.
+var StateNamespace = ds.NewKey("migrate")
+
+// Config configures a Migrator.
+type Config struct {
+	// Blockstore is the legacy monolithic blockstore to migrate from. It is
+	// only read from.
+	Blockstore blockstore.Blockstore
+
+	// DAGStore is the DAG store the generated shards are registered with.
+	// Shards are registered with a mount.FileMount, so the "file" scheme
+	// must be registered in its mount registry.
+	DAGStore dagstore.Interface
+
+	// OutputDir is the directory where the generated CAR files are written.
+	OutputDir string
+
+	// Datastore is where migration progress is tracked, so that an
+	// interrupted migration can be resumed. If nil, progress is kept in
+	// memory and doesn't survive restarts.
+	Datastore ds.Datastore
+
+	// Verify, if true, verifies the generated CAR files after writing them,
+	// by checking that all blocks hash to their CIDs and that the root is
+	// present.
+	Verify bool
+
+	// ProgressCb, if non-nil, is called after each manifest entry has been
+	// processed.
+	ProgressCb func(Progress)
+}
+
+// Progress reports the progress of a migration.
+type Progress struct {
+	// Total is the number of entries in the manifest.
+	Total int
+	// Migrated, Skipped and Failed count the entries processed so far.
+	// Skipped entries are those that were migrated by a previous run.
+	Migrated int
+	Skipped  int
+	Failed   int
+
+	// Entry is the entry that was just processed, and Error is the error
+	// migrating it, if any.
+	Entry ManifestEntry
+	Error error
+}
+
+// Result is the outcome of a migration.
+type Result struct {
+	Migrated int
+	Skipped  int
+
+	// Failures maps the deals that failed to migrate to their errors.
+	Failures map[string]error
+}
+
+// Migrator generates and registers shards from a legacy blockstore.
+type Migrator struct {
+	cfg   Config
+	store ds.Datastore
+	lsys  ipld.LinkSystem
+}
+
+// NewMigrator creates a new Migrator with the supplied configuration.
+func NewMigrator(cfg Config) (*Migrator, error) {
+	if cfg.Blockstore == nil {
+		return nil, errors.New("missing legacy blockstore")
+	}
+	if cfg.DAGStore == nil {
+		return nil, errors.New("missing DAG store")
+	}
+	if cfg.OutputDir == "" {
+		return nil, errors.New("missing output directory")
+	}
+	if err := os.MkdirAll(cfg.OutputDir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create output dir: %w", err)
+	}
+
+	store := cfg.Datastore
+	if store == nil {
+		log.Warnf("no datastore provided; migration progress will not survive restarts")
+		store = dssync.MutexWrap(ds.NewMapDatastore())
+	}
+
+	m := &Migrator{
+		cfg:   cfg,
+		store: namespace.Wrap(store, StateNamespace),
+		lsys:  cidlink.DefaultLinkSystem(),
+	}
+	m.lsys.TrustedStorage = true
+	m.lsys.StorageReadOpener = func(lctx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		cl, ok := lnk.(cidlink.Link)
+		if !ok {
+			return nil, fmt.Errorf("unsupported link type %T", lnk)
+		}
+		blk, err := cfg.Blockstore.Get(lctx.Ctx, cl.Cid)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get block %s from legacy blockstore: %w", cl.Cid, err)
+		}
+		return bytes.NewReader(blk.RawData()), nil
+	}
+	return m, nil
+}
+
+// Migrate migrates all the entries in the manifest, sequentially. Entries
+// migrated by a previous run are skipped. A failure to migrate an entry does
+// not abort the migration; failures are reported in the Result.
+//
+// Migrate only returns an error if the context is cancelled, or if progress
+// can't be tracked.
+func (m *Migrator) Migrate(ctx context.Context, entries []ManifestEntry) (*Result, error) {
+	res := &Result{Failures: make(map[string]error)}
+	progress := Progress{Total: len(entries)}
+
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+
+		done, err := m.store.Has(ctx, ds.NewKey(e.Deal))
+		if err != nil {
+			return res, fmt.Errorf("failed to check migration state of deal %s: %w", e.Deal, err)
+		}
+
+		var merr error
+		if done {
+			log.Debugw("deal already migrated; skipping", "deal", e.Deal, "root", e.Root)
+			res.Skipped++
+			progress.Skipped++
+		} else if merr = m.migrateOne(ctx, e); merr != nil {
+			log.Warnw("failed to migrate deal", "deal", e.Deal, "root", e.Root, "error", merr)
+			res.Failures[e.Deal] = merr
+			progress.Failed++
+		} else {
+			if err := m.store.Put(ctx, ds.NewKey(e.Deal), e.Root.Bytes()); err != nil {
+				return res, fmt.Errorf("failed to record migration of deal %s: %w", e.Deal, err)
+			}
+			if err := m.store.Sync(ctx, ds.Key{}); err != nil {
+				return res, fmt.Errorf("failed to sync migration state: %w", err)
+			}
+			log.Infow("migrated deal", "deal", e.Deal, "root", e.Root)
+			res.Migrated++
+			progress.Migrated++
+		}
+
+		if m.cfg.ProgressCb != nil {
+			progress.Entry, progress.Error = e, merr
+			m.cfg.ProgressCb(progress)
+		}
+	}
+	return res, nil
+}
+
+// migrateOne generates the CAR for a single entry, verifies it if requested,
+// and registers it as a shard.
+func (m *Migrator) migrateOne(ctx context.Context, e ManifestEntry) error {
+	path := filepath.Join(m.cfg.OutputDir, e.Deal+".car")
+
+	// a partial CAR left behind by an interrupted run is overwritten.
+	err := car.TraverseToFile(ctx, &m.lsys, e.Root, selectorparse.CommonSelector_ExploreAllRecursively, path,
+		car.WithTraversalPrototypeChooser(dagpb.AddSupportToChooser(basicnode.Chooser)))
+	if err != nil {
+		_ = os.Remove(path)
+		return fmt.Errorf("failed to generate CAR: %w", err)
+	}
+
+	if m.cfg.Verify {
+		if err := VerifyCAR(path, e.Root); err != nil {
+			return fmt.Errorf("failed to verify CAR: %w", err)
+		}
+	}
+
+	ch := make(chan dagstore.ShardResult, 1)
+	k := shard.KeyFromString(e.Deal)
+	err = m.cfg.DAGStore.RegisterShard(ctx, k, &mount.FileMount{Path: path}, ch, dagstore.RegisterOpts{})
+	if errors.Is(err, dagstore.ErrShardExists) {
+		log.Infow("shard already registered; assuming migrated", "deal", e.Deal)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to register shard: %w", err)
+	}
+
+	select {
+	case res := <-ch:
+		if res.Error != nil {
+			return fmt.Errorf("failed to register shard: %w", res.Error)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// VerifyCAR verifies that the CAR at path contains the supplied root, and that
+// all its blocks hash to their CIDs.
+func VerifyCAR(path string, root cid.Cid) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br, err := car.NewBlockReader(f)
+	if err != nil {
+		return fmt.Errorf("failed to read CAR: %w", err)
+	}
+
+	var foundRoot bool
+	for _, r := range br.Roots {
+		foundRoot = foundRoot || r.Equals(root)
+	}
+	if !foundRoot {
+		return fmt.Errorf("root %s not found in CAR header", root)
+	}
+
+	var n int
+	for {
+		blk, err := br.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read block %d: %w", n, err)
+		}
+		c, err := blk.Cid().Prefix().Sum(blk.RawData())
+		if err != nil {
+			return fmt.Errorf("failed to hash block %s: %w", blk.Cid(), err)
+		}
+		if !c.Equals(blk.Cid()) {
+			return fmt.Errorf("block %s hashes to %s", blk.Cid(), c)
+		}
+		n++
+	}
+	if n == 0 {
+		return errors.New("CAR contains no blocks")
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipld/go-car/v2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/dagstore"
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/shard"
+	"github.com/filecoin-project/dagstore/testdata"
+)
+
+const missingRoot = "bafykbzaceaeqhm77anl5mv2wjkmh4ofyf6s6eww3ujfmhtsfab65vi3rlccaq"
+
+func TestParseManifest(t *testing.T) {
+	csvManifest := fmt.Sprintf("root,deal\n%s,1\n%s, 2\n", testdata.RootCID, missingRoot)
+	entries, err := ParseManifestCSV(strings.NewReader(csvManifest))
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, testdata.RootCID, entries[0].Root)
+	require.Equal(t, "1", entries[0].Deal)
+	require.Equal(t, "2", entries[1].Deal)
+
+	jsonManifest := fmt.Sprintf(`[{"root": "%s", "deal": "1"}, {"root": "%s", "deal": "2"}]`, testdata.RootCID, missingRoot)
+	entries2, err := ParseManifestJSON(strings.NewReader(jsonManifest))
+	require.NoError(t, err)
+	require.Equal(t, entries, entries2)
+
+	_, err = ParseManifestCSV(strings.NewReader("notacid,1\n"))
+	require.Error(t, err)
+	_, err = ParseManifestCSV(strings.NewReader(fmt.Sprintf("%s,../1\n", testdata.RootCID)))
+	require.Error(t, err)
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+
+	// load the sample DAG into a legacy blockstore.
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	br, err := car.NewBlockReader(bytes.NewReader(testdata.CarV2))
+	require.NoError(t, err)
+	for {
+		blk, err := br.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, bs.Put(ctx, blk))
+	}
+
+	registry := mount.NewRegistry()
+	require.NoError(t, registry.Register("file", new(mount.FileMount)))
+	dagst, err := dagstore.NewDAGStore(dagstore.Config{
+		MountRegistry: registry,
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+	defer dagst.Close()
+
+	entries, err := ParseManifestCSV(strings.NewReader(fmt.Sprintf("%s,1\n%s,2\n", testdata.RootCID, missingRoot)))
+	require.NoError(t, err)
+
+	var progress []Progress
+	state := dssync.MutexWrap(ds.NewMapDatastore())
+	cfg := Config{
+		Blockstore: bs,
+		DAGStore:   dagst,
+		OutputDir:  t.TempDir(),
+		Datastore:  state,
+		Verify:     true,
+		ProgressCb: func(p Progress) { progress = append(progress, p) },
+	}
+	m, err := NewMigrator(cfg)
+	require.NoError(t, err)
+
+	// the first deal is migrated; the second fails because its DAG is missing.
+	res, err := m.Migrate(ctx, entries)
+	require.NoError(t, err)
+	require.Equal(t, 1, res.Migrated)
+	require.Len(t, res.Failures, 1)
+	require.Contains(t, res.Failures, "2")
+	require.Len(t, progress, 2)
+	require.Equal(t, 1, progress[1].Migrated)
+	require.Equal(t, 1, progress[1].Failed)
+
+	// the shard is registered and serves the DAG.
+	ch := make(chan dagstore.ShardResult, 1)
+	require.NoError(t, dagst.AcquireShard(ctx, shard.KeyFromString("1"), ch, dagstore.AcquireOpts{}))
+	sres := <-ch
+	require.NoError(t, sres.Error)
+	sbs, err := sres.Accessor.Blockstore()
+	require.NoError(t, err)
+	ok, err := sbs.Has(ctx, testdata.RootCID)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NoError(t, sres.Accessor.Close())
+
+	// a resumed migration skips the migrated deal.
+	m, err = NewMigrator(cfg)
+	require.NoError(t, err)
+	res, err = m.Migrate(ctx, entries)
+	require.NoError(t, err)
+	require.Zero(t, res.Migrated)
+	require.Equal(t, 1, res.Skipped)
+	require.Len(t, res.Failures, 1)
+}
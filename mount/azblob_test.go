@@ -0,0 +1,103 @@
+package mount
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAzureBlobMount(t *testing.T) {
+	content := bytes.Repeat([]byte("abcdefghij"), 1000)
+	key := base64.StdEncoding.EncodeToString([]byte("secret"))
+
+	signer := &AzureBlobMount{Account: "acct", AccountKey: key}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch auth := r.Header.Get("Authorization"); {
+		case auth != "":
+			// verify the Shared Key signature.
+			sig, err := signer.sign(r, signer.AccountKey)
+			if err != nil || auth != "SharedKey acct:"+sig {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		case r.URL.Query().Get("sig") != "s1gn4ture":
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.Header.Get("x-ms-version") == "" || r.URL.Path != "/container/dir/shard.car" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if rng := r.Header.Get("x-ms-range"); rng != "" {
+			r.Header.Set("Range", rng)
+		}
+		http.ServeContent(w, r, "shard.car", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse("azblob://acct/container/dir/shard.car")
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name     string
+		template *AzureBlobMount
+	}{
+		{name: "shared key", template: &AzureBlobMount{Endpoint: srv.URL, AccountKey: key}},
+		{name: "sas", template: &AzureBlobMount{Endpoint: srv.URL, SASToken: "?sv=2020-04-08&sig=s1gn4ture"}},
+		{name: "credentials provider", template: &AzureBlobMount{Endpoint: srv.URL, AccountKey: "stale",
+			Credentials: CredentialsFunc(func(_ context.Context, u *url.URL) (Credentials, error) {
+				require.Equal(t, "azblob://acct/container/dir/shard.car", u.String())
+				return Credentials{Key: key}, nil
+			})}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := NewRegistry()
+			require.NoError(t, r.Register(AzureBlobScheme, tc.template))
+
+			mnt, err := r.Instantiate(u)
+			require.NoError(t, err)
+			require.Equal(t, "container", mnt.(*AzureBlobMount).Container)
+			require.Equal(t, "dir/shard.car", mnt.(*AzureBlobMount).Blob)
+
+			u2, err := r.Represent(mnt)
+			require.NoError(t, err)
+			require.Equal(t, u.String(), u2.String())
+
+			stat, err := mnt.Stat(context.Background())
+			require.NoError(t, err)
+			require.True(t, stat.Exists)
+			require.EqualValues(t, len(content), stat.Size)
+
+			rd, err := mnt.Fetch(context.Background())
+			require.NoError(t, err)
+			defer rd.Close()
+
+			all, err := ioutil.ReadAll(rd)
+			require.NoError(t, err)
+			require.Equal(t, content, all)
+
+			buf := make([]byte, 20)
+			_, err = rd.ReadAt(buf, 4321)
+			require.NoError(t, err)
+			require.Equal(t, content[4321:4341], buf)
+		})
+	}
+
+	// wrong credentials are rejected.
+	bad := &AzureBlobMount{Endpoint: srv.URL, AccountKey: base64.StdEncoding.EncodeToString([]byte("wrong")), Account: "acct", Container: "container", Blob: "dir/shard.car"}
+	_, err = bad.Stat(context.Background())
+	require.Error(t, err)
+	require.True(t, strings.Contains(err.Error(), "403"))
+
+	// malformed URLs.
+	require.Error(t, new(AzureBlobMount).Deserialize(&url.URL{Host: "acct", Path: "/container"}))
+}
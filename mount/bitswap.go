@@ -0,0 +1,145 @@
+package mount
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+
+	"github.com/ipfs/go-cid"
+	exchange "github.com/ipfs/go-ipfs-exchange-interface"
+	"github.com/ipld/go-car/v2"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	_ "github.com/ipld/go-ipld-prime/codec/dagcbor" // register the dag-cbor codec for traversals.
+	_ "github.com/ipld/go-ipld-prime/codec/raw"     // register the raw codec for traversals.
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// BitswapMount is a mount that materializes the DAG under a root CID by
+// fetching its blocks from the network, through an exchange such as Bitswap.
+// Fetch traverses the entire DAG and produces a CARv2 (with an index) rooted
+// at Root. This enables using the DAG store as a cache for remote DAGs.
+//
+// The mount only supports sequential access, so that the Upgrader persists
+// the fetched CAR as a transient, and the DAG isn't fetched again from the
+// network on every acquire.
+type BitswapMount struct {
+	// Root is the root CID of the DAG.
+	Root cid.Cid
+
+	// Fetcher is the exchange used to fetch blocks, e.g. a Bitswap instance.
+	// It is environmental configuration, carried over from the template
+	// registered in the mount registry. If it supports sessions, a session is
+	// used for every fetch.
+	Fetcher exchange.Fetcher
+
+	// TempDir is the directory where the CAR is materialized before being
+	// handed over to the reader. If empty, the OS' temp dir is used.
+	TempDir string
+}
+
+var _ Mount = (*BitswapMount)(nil)
+
+func (b *BitswapMount) Fetch(ctx context.Context) (Reader, error) {
+	if b.Fetcher == nil {
+		return nil, fmt.Errorf("no exchange configured")
+	}
+
+	fetcher := b.Fetcher
+	if sx, ok := fetcher.(exchange.SessionExchange); ok {
+		fetcher = sx.NewSession(ctx)
+	}
+
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.TrustedStorage = true
+	lsys.StorageReadOpener = func(lctx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		cl, ok := lnk.(cidlink.Link)
+		if !ok {
+			return nil, fmt.Errorf("unsupported link type %T", lnk)
+		}
+		// identity CIDs carry their data inline.
+		if dmh, err := mh.Decode(cl.Cid.Hash()); err == nil && dmh.Code == mh.IDENTITY {
+			return bytes.NewReader(dmh.Digest), nil
+		}
+		blk, err := fetcher.GetBlock(lctx.Ctx, cl.Cid)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch block %s: %w", cl.Cid, err)
+		}
+		return bytes.NewReader(blk.RawData()), nil
+	}
+
+	f, err := os.CreateTemp(b.TempDir, "bitswap-*.car")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	path := f.Name()
+	_ = f.Close()
+
+	err = car.TraverseToFile(ctx, &lsys, b.Root, selectorparse.CommonSelector_ExploreAllRecursively, path,
+		car.WithTraversalPrototypeChooser(dagpb.AddSupportToChooser(basicnode.Chooser)))
+	if err != nil {
+		_ = os.Remove(path)
+		return nil, fmt.Errorf("failed to fetch DAG %s: %w", b.Root, err)
+	}
+
+	f, err = os.Open(path)
+	if err != nil {
+		_ = os.Remove(path)
+		return nil, err
+	}
+	return &tempFileReader{File: f}, nil
+}
+
+func (b *BitswapMount) Info() Info {
+	return Info{
+		Kind:             KindRemote,
+		AccessSequential: true,
+	}
+}
+
+func (b *BitswapMount) Stat(_ context.Context) (Stat, error) {
+	// the size of the DAG is unknown until it's fetched, and fetching is never
+	// immediate.
+	return Stat{
+		Exists: true,
+		Ready:  false,
+	}, nil
+}
+
+func (b *BitswapMount) Serialize() *url.URL {
+	return &url.URL{
+		Host: b.Root.String(),
+	}
+}
+
+func (b *BitswapMount) Deserialize(u *url.URL) error {
+	c, err := cid.Decode(u.Host)
+	if err != nil {
+		return fmt.Errorf("failed to parse root CID from host %q: %w", u.Host, err)
+	}
+	b.Root = c
+	return nil
+}
+
+func (b *BitswapMount) Close() error {
+	return nil
+}
+
+// tempFileReader is a file that is removed when closed.
+type tempFileReader struct {
+	*os.File
+}
+
+func (t *tempFileReader) Close() error {
+	err := t.File.Close()
+	if rerr := os.Remove(t.File.Name()); rerr != nil && err == nil {
+		err = rerr
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+package mount
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipld/go-car/v2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/dagstore/testdata"
+	"github.com/filecoin-project/dagstore/throttle"
+)
+
+// loadBlockstore loads all the blocks in the test CAR into a new blockstore.
+func loadBlockstore(t *testing.T) blockstore.Blockstore {
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	br, err := car.NewBlockReader(bytes.NewReader(testdata.CarV2))
+	require.NoError(t, err)
+	for {
+		blk, err := br.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, bs.Put(context.Background(), blk))
+	}
+	return bs
+}
+
+func TestBitswapMount(t *testing.T) {
+	ctx := context.Background()
+	bs := loadBlockstore(t)
+	tmp := t.TempDir()
+
+	mnt := &BitswapMount{Root: testdata.RootCID, Fetcher: offline.Exchange(bs), TempDir: tmp}
+
+	rd, err := mnt.Fetch(ctx)
+	require.NoError(t, err)
+	bz, err := io.ReadAll(rd)
+	require.NoError(t, err)
+	require.NoError(t, rd.Close())
+
+	// the temporary CAR is removed once closed.
+	entries, err := os.ReadDir(tmp)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	// the result is an indexed CARv2 rooted at the requested CID, with all
+	// the blocks of the DAG.
+	cr, err := car.NewReader(bytes.NewReader(bz))
+	require.NoError(t, err)
+	require.EqualValues(t, 2, cr.Version)
+	require.True(t, cr.Header.HasIndex())
+	roots, err := cr.Roots()
+	require.NoError(t, err)
+	require.Equal(t, testdata.RootCID, roots[0])
+
+	dr, err := cr.DataReader()
+	require.NoError(t, err)
+	br, err := car.NewBlockReader(dr)
+	require.NoError(t, err)
+	var n int
+	for {
+		blk, err := br.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		has, err := bs.Has(ctx, blk.Cid())
+		require.NoError(t, err)
+		require.True(t, has)
+		n++
+	}
+	require.NotZero(t, n)
+
+	// a missing root fails the fetch.
+	empty := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	mnt2 := &BitswapMount{Root: testdata.RootCID, Fetcher: offline.Exchange(empty), TempDir: tmp}
+	_, err = mnt2.Fetch(ctx)
+	require.Error(t, err)
+	entries, err = os.ReadDir(tmp)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestBitswapMountUpgrade(t *testing.T) {
+	ctx := context.Background()
+	rootDir := t.TempDir()
+
+	underlying := &Counting{Mount: &BitswapMount{Root: testdata.RootCID, Fetcher: offline.Exchange(loadBlockstore(t))}}
+	u, err := Upgrade(underlying, throttle.Noop(), rootDir, "foo", "")
+	require.NoError(t, err)
+
+	// the fetched CAR is persisted as a transient, and reused.
+	for i := 0; i < 2; i++ {
+		rd, err := u.Fetch(ctx)
+		require.NoError(t, err)
+		cr, err := car.NewReader(rd)
+		require.NoError(t, err)
+		require.EqualValues(t, 2, cr.Version)
+		require.NoError(t, rd.Close())
+	}
+	require.Equal(t, 1, underlying.Count())
+	require.NotEmpty(t, u.TransientPath())
+
+	// the mount round-trips through its URL representation.
+	r := NewRegistry()
+	require.NoError(t, r.Register("bitswap", &BitswapMount{Fetcher: offline.Exchange(loadBlockstore(t))}))
+	uu, err := r.Represent(&BitswapMount{Root: testdata.RootCID})
+	require.NoError(t, err)
+	require.Equal(t, "bitswap", uu.Scheme)
+
+	parsed, err := url.Parse(uu.String())
+	require.NoError(t, err)
+	m, err := r.Instantiate(parsed)
+	require.NoError(t, err)
+	require.Equal(t, testdata.RootCID, m.(*BitswapMount).Root)
+	require.NotNil(t, m.(*BitswapMount).Fetcher)
+}
@@ -8,7 +8,8 @@ import (
 )
 
 // BytesMount encloses a byte slice. It is mainly used for testing. The
-// Upgrader passes through it.
+// Upgrader passes through it. MemMount is an alternative that holds the bytes
+// in a bounded store, and is represented by a short URL.
 type BytesMount struct {
 	Bytes []byte
 }
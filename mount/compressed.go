@@ -0,0 +1,331 @@
+package mount
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressed transients are stored as a sequence of independent zstd frames,
+// each holding compressedFrameSize bytes of uncompressed data (the last one
+// possibly less), followed by a seek table in a zstd skippable frame, so that
+// the file remains a valid zstd stream:
+//
+//	frame 0 | ... | frame N-1 | skippable frame header (8 bytes)
+//	  | end offset of each frame (N x uint64)
+//	  | uncompressed size (uint64) | frame size (uint32) | N (uint32)
+//	  | magic (8 bytes)
+//
+// All integers are little endian. The seek table allows random access by only
+// decompressing the frames that cover the requested range.
+const (
+	compressedFrameSize = 1 << 20 // 1MiB
+
+	// skippableFrameMagic is the magic number of zstd skippable frames.
+	skippableFrameMagic = 0x184D2A5E
+	// compressedTrailerLen is the length of the fixed-size tail of the seek
+	// table.
+	compressedTrailerLen = 8 + 4 + 4 + 8
+)
+
+var compressedMagic = []byte("dagszst1")
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// zstdCodec returns the encoder and decoder shared by all compressed
+// transients; they are safe for concurrent use with EncodeAll and DecodeAll.
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+// compressedWriter compresses the data written to it into frames, and writes
+// the seek table on Close. It doesn't close the underlying writer.
+type compressedWriter struct {
+	w       io.Writer
+	enc     *zstd.Encoder
+	buf     []byte
+	offsets []uint64 // end offset of each frame written.
+	written uint64   // compressed bytes written.
+	size    uint64   // uncompressed bytes written.
+}
+
+func newCompressedWriter(w io.Writer) (*compressedWriter, error) {
+	enc, _, err := zstdCodec()
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize zstd: %w", err)
+	}
+	return &compressedWriter{w: w, enc: enc, buf: make([]byte, 0, compressedFrameSize)}, nil
+}
+
+func (c *compressedWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		l := copy(c.buf[len(c.buf):cap(c.buf)], p)
+		c.buf = c.buf[:len(c.buf)+l]
+		p = p[l:]
+		n += l
+		if len(c.buf) == cap(c.buf) {
+			if err := c.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush compresses the buffered data into a frame.
+func (c *compressedWriter) flush() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+	frame := c.enc.EncodeAll(c.buf, nil)
+	if _, err := c.w.Write(frame); err != nil {
+		return err
+	}
+	c.written += uint64(len(frame))
+	c.size += uint64(len(c.buf))
+	c.offsets = append(c.offsets, c.written)
+	c.buf = c.buf[:0]
+	return nil
+}
+
+// Close flushes the last frame and writes the seek table.
+func (c *compressedWriter) Close() error {
+	if err := c.flush(); err != nil {
+		return err
+	}
+
+	table := 8*len(c.offsets) + compressedTrailerLen
+	b := make([]byte, 8, 8+table)
+	binary.LittleEndian.PutUint32(b[0:], skippableFrameMagic)
+	binary.LittleEndian.PutUint32(b[4:], uint32(table))
+	for _, off := range c.offsets {
+		b = appendUint64(b, off)
+	}
+	b = appendUint64(b, c.size)
+	b = appendUint32(b, compressedFrameSize)
+	b = appendUint32(b, uint32(len(c.offsets)))
+	b = append(b, compressedMagic...)
+
+	_, err := c.w.Write(b)
+	return err
+}
+
+// compressedReader provides random access to a compressed transient. The
+// last decompressed frame is cached, so that sequential reads decompress
+// every frame once.
+type compressedReader struct {
+	f         *os.File
+	dec       *zstd.Decoder
+	offsets   []uint64
+	size      int64
+	frameSize int64
+
+	pos int64 // position of Read and Seek.
+
+	lk     sync.Mutex
+	cached int // index of the cached frame, or -1.
+	frame  []byte
+}
+
+var _ Reader = (*compressedReader)(nil)
+
+func (r *compressedReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *compressedReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	var n int
+	for n < len(p) && off < r.size {
+		i := int(off / r.frameSize)
+		if err := r.load(i); err != nil {
+			return n, err
+		}
+		rel := off - int64(i)*r.frameSize
+		if rel >= int64(len(r.frame)) {
+			return n, fmt.Errorf("corrupted compressed transient: frame %d is too short", i)
+		}
+		l := copy(p[n:], r.frame[rel:])
+		n += l
+		off += int64(l)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// load decompresses the i-th frame into the cache. It must be called with
+// the lock held.
+func (r *compressedReader) load(i int) error {
+	if r.cached == i {
+		return nil
+	}
+	var start uint64
+	if i > 0 {
+		start = r.offsets[i-1]
+	}
+	compressed := make([]byte, r.offsets[i]-start)
+	if _, err := r.f.ReadAt(compressed, int64(start)); err != nil {
+		return fmt.Errorf("failed to read compressed frame %d: %w", i, err)
+	}
+	frame, err := r.dec.DecodeAll(compressed, r.frame[:0])
+	if err != nil {
+		r.cached = -1
+		return fmt.Errorf("failed to decompress frame %d: %w", i, err)
+	}
+	r.frame, r.cached = frame, i
+	return nil
+}
+
+func (r *compressedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *compressedReader) Close() error {
+	return r.f.Close()
+}
+
+// openTransient opens a transient, decompressing it if it's compressed. The
+// format of the transient is known from its metadata, rather than sniffed
+// from its contents, so that uncompressed transients are always read as is.
+func openTransient(path string, compressed bool) (Reader, error) {
+	f, err := os.Open(path)
+	if err != nil || !compressed {
+		return f, err
+	}
+	r, err := openCompressed(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// transientSize returns the size of the data of a transient, which is the
+// uncompressed size if it's compressed.
+func transientSize(path string, compressed bool) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if compressed {
+		r, err := openCompressed(f)
+		if err != nil {
+			return 0, err
+		}
+		return r.size, nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// openCompressed reads the seek table of a compressed transient.
+func openCompressed(f *os.File) (*compressedReader, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() < 8+compressedTrailerLen {
+		return nil, fmt.Errorf("corrupted compressed transient: too short")
+	}
+
+	trailer := make([]byte, compressedTrailerLen)
+	if _, err := f.ReadAt(trailer, fi.Size()-compressedTrailerLen); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(trailer[16:], compressedMagic) {
+		return nil, fmt.Errorf("corrupted compressed transient: missing seek table")
+	}
+	size := binary.LittleEndian.Uint64(trailer[0:])
+	frameSize := binary.LittleEndian.Uint32(trailer[8:])
+	count := int64(binary.LittleEndian.Uint32(trailer[12:]))
+
+	tableStart := fi.Size() - compressedTrailerLen - 8*count
+	if frameSize == 0 || tableStart < 8 || size > uint64(count)*uint64(frameSize) {
+		return nil, fmt.Errorf("corrupted compressed transient: invalid seek table")
+	}
+	table := make([]byte, 8*count)
+	if _, err := f.ReadAt(table, tableStart); err != nil {
+		return nil, err
+	}
+	offsets := make([]uint64, count)
+	for i := range offsets {
+		offsets[i] = binary.LittleEndian.Uint64(table[8*i:])
+		if (i > 0 && offsets[i] < offsets[i-1]) || offsets[i] > uint64(tableStart-8) {
+			return nil, fmt.Errorf("corrupted compressed transient: invalid frame offset")
+		}
+	}
+
+	_, dec, err := zstdCodec()
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize zstd: %w", err)
+	}
+	return &compressedReader{
+		f:         f,
+		dec:       dec,
+		offsets:   offsets,
+		size:      int64(size),
+		frameSize: int64(frameSize),
+		cached:    -1,
+	}, nil
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
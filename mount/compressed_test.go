@@ -0,0 +1,132 @@
+package mount
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/filecoin-project/dagstore/testdata"
+	"github.com/filecoin-project/dagstore/throttle"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressedTransient(t *testing.T) {
+	// compressible data spanning several frames, with a partial last frame.
+	data := make([]byte, 2*compressedFrameSize+12345)
+	rnd := rand.New(rand.NewSource(1))
+	for i := range data {
+		data[i] = byte(rnd.Intn(16))
+	}
+
+	path := filepath.Join(t.TempDir(), "transient")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	cw, err := newCompressedWriter(f)
+	require.NoError(t, err)
+	_, err = io.Copy(cw, bytes.NewReader(data))
+	require.NoError(t, err)
+	require.NoError(t, cw.Close())
+	require.NoError(t, f.Close())
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Less(t, fi.Size(), int64(len(data)))
+
+	size, err := transientSize(path, true)
+	require.NoError(t, err)
+	require.EqualValues(t, len(data), size)
+
+	rd, err := openTransient(path, true)
+	require.NoError(t, err)
+	defer rd.Close()
+
+	// sequential read.
+	bz, err := ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.Equal(t, data, bz)
+
+	// random reads, across frame boundaries.
+	for i := 0; i < 100; i++ {
+		off := rnd.Int63n(int64(len(data)))
+		buf := make([]byte, rnd.Intn(3*compressedFrameSize/2))
+		n, err := rd.ReadAt(buf, off)
+		if off+int64(len(buf)) > int64(len(data)) {
+			require.ErrorIs(t, err, io.EOF)
+		} else {
+			require.NoError(t, err)
+		}
+		require.Equal(t, data[off:off+int64(n)], buf[:n])
+	}
+
+	// seek and read.
+	_, err = rd.Seek(-10, io.SeekEnd)
+	require.NoError(t, err)
+	bz, err = ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.Equal(t, data[len(data)-10:], bz)
+
+	// uncompressed files are read as is, even if they end like compressed
+	// ones.
+	plainData := append(append([]byte{}, testdata.CarV2...), make([]byte, compressedTrailerLen)...)
+	copy(plainData[len(plainData)-len(compressedMagic):], compressedMagic)
+	plain := filepath.Join(t.TempDir(), "plain")
+	require.NoError(t, os.WriteFile(plain, plainData, 0644))
+	rd, err = openTransient(plain, false)
+	require.NoError(t, err)
+	defer rd.Close()
+	bz, err = ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.Equal(t, plainData, bz)
+	size, err = transientSize(plain, false)
+	require.NoError(t, err)
+	require.EqualValues(t, len(plainData), size)
+
+	// files that should be compressed but aren't are rejected.
+	_, err = openTransient(plain, true)
+	require.Error(t, err)
+}
+
+func TestUpgraderCompression(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	mnt := &Counting{Mount: &FSMount{testdata.FS, testdata.FSPathCarV2}}
+	u, err := Upgrade(mnt, throttle.Noop(), dir, "foo", "")
+	require.NoError(t, err)
+	u.SetCompression(true)
+
+	rd, err := u.Fetch(ctx)
+	require.NoError(t, err)
+	bz, err := ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.NoError(t, rd.Close())
+	require.Equal(t, testdata.CarV2, bz)
+
+	// the transient is compressed, but reports the size of its data.
+	fi, err := os.Stat(u.TransientPath())
+	require.NoError(t, err)
+	require.Less(t, fi.Size(), int64(len(testdata.CarV2)))
+	stat, err := u.Stat(ctx)
+	require.NoError(t, err)
+	require.EqualValues(t, len(testdata.CarV2), stat.Size)
+
+	// a new upgrader reuses and verifies the compressed transient, regardless
+	// of its own setting.
+	require.True(t, u.TransientCompressed())
+	u2, err := UpgradeWithOpts(mnt, throttle.Noop(), dir, "foo", u.TransientPath(), UpgradeOpts{InitialCompressed: true})
+	require.NoError(t, err)
+	u2.VerifyInitial()
+	rd, err = u2.Fetch(ctx)
+	require.NoError(t, err)
+	defer rd.Close()
+	buf := make([]byte, 100)
+	_, err = rd.ReadAt(buf, 1000)
+	require.NoError(t, err)
+	require.Equal(t, testdata.CarV2[1000:1100], buf)
+	require.Equal(t, 1, mnt.Count())
+}
@@ -0,0 +1,121 @@
+package mount
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Credentials authenticate the requests of a mount to a remote store. Which
+// fields are used depends on the mount; see the docs of its Credentials field.
+type Credentials struct {
+	// Token is a bearer token, e.g. an OAuth2 access token, or a shared access
+	// signature.
+	Token string
+	// Key is a secret key used to sign requests, e.g. a storage account key.
+	Key string
+	// Expiry, if non-zero, is the time the credentials expire at. It's used by
+	// CachingCredentials to decide when to refresh them.
+	Expiry time.Time
+}
+
+// CredentialsProvider supplies the credentials of authenticated mounts. Mounts
+// consult it on every request they issue, so credentials can rotate at
+// runtime, and are never persisted as part of mount URLs.
+//
+// Providers are set on the mount templates registered in the Registry, and
+// are shared by all mounts instantiated from them, so they must be safe for
+// concurrent use.
+type CredentialsProvider interface {
+	// Credentials returns the current credentials for the mount with the
+	// given URL, as returned by Serialize, with the conventional scheme of the
+	// mount type set (e.g. GCSScheme).
+	Credentials(ctx context.Context, u *url.URL) (Credentials, error)
+}
+
+// CredentialsFunc adapts a function to a CredentialsProvider.
+type CredentialsFunc func(ctx context.Context, u *url.URL) (Credentials, error)
+
+var _ CredentialsProvider = CredentialsFunc(nil)
+
+// Credentials implements CredentialsProvider.
+func (f CredentialsFunc) Credentials(ctx context.Context, u *url.URL) (Credentials, error) {
+	return f(ctx, u)
+}
+
+// CachingCredentials wraps a CredentialsProvider, caching the credentials it
+// returns per mount URL until margin before they expire. Credentials without
+// an expiry are not cached. Expired credentials are evicted as the cache
+// grows, so that it only holds about as many entries as there are mounts in
+// use.
+func CachingCredentials(p CredentialsProvider, margin time.Duration) CredentialsProvider {
+	return &cachingCredentials{
+		provider: p,
+		margin:   margin,
+		cache:    make(map[string]Credentials),
+		sweepAt:  minCredentialsSweep,
+	}
+}
+
+// minCredentialsSweep is the size of the credentials cache below which
+// expired entries aren't swept.
+const minCredentialsSweep = 64
+
+type cachingCredentials struct {
+	provider CredentialsProvider
+	margin   time.Duration
+
+	lk    sync.Mutex
+	cache map[string]Credentials
+	// sweepAt is the size of the cache that triggers the next sweep of
+	// expired entries; it's twice the size left by the last sweep.
+	sweepAt int
+}
+
+// fresh returns whether creds are valid for longer than the margin.
+func (c *cachingCredentials) fresh(creds Credentials, now time.Time) bool {
+	return now.Add(c.margin).Before(creds.Expiry)
+}
+
+func (c *cachingCredentials) Credentials(ctx context.Context, u *url.URL) (Credentials, error) {
+	key := u.String()
+
+	c.lk.Lock()
+	creds, ok := c.cache[key]
+	if ok && c.fresh(creds, time.Now()) {
+		c.lk.Unlock()
+		return creds, nil
+	}
+	delete(c.cache, key)
+	c.lk.Unlock()
+
+	creds, err := c.provider.Credentials(ctx, u)
+	if err != nil {
+		return Credentials{}, err
+	}
+	// credentials already within the margin would never be served.
+	if now := time.Now(); !creds.Expiry.IsZero() && c.fresh(creds, now) {
+		c.lk.Lock()
+		c.cache[key] = creds
+		if len(c.cache) >= c.sweepAt {
+			c.sweep(now)
+		}
+		c.lk.Unlock()
+	}
+	return creds, nil
+}
+
+// sweep evicts the credentials that are no longer served from the cache. It
+// must be called with the lock held.
+func (c *cachingCredentials) sweep(now time.Time) {
+	for key, creds := range c.cache {
+		if !c.fresh(creds, now) {
+			delete(c.cache, key)
+		}
+	}
+	c.sweepAt = 2 * len(c.cache)
+	if c.sweepAt < minCredentialsSweep {
+		c.sweepAt = minCredentialsSweep
+	}
+}
@@ -0,0 +1,123 @@
+package mount
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCredentialsRotation(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 100)
+
+	// the server only accepts the current token.
+	var current int32 = 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token-"+strconv.Itoa(int(atomic.LoadInt32(&current))) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.ServeContent(w, r, "shard.car", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	var calls int32
+	provider := CredentialsFunc(func(_ context.Context, u *url.URL) (Credentials, error) {
+		atomic.AddInt32(&calls, 1)
+		require.Equal(t, "gs://bucket/shard.car", u.String())
+		return Credentials{Token: "token-" + strconv.Itoa(int(atomic.LoadInt32(&current)))}, nil
+	})
+
+	r := NewRegistry()
+	require.NoError(t, r.Register(GCSScheme, &GCSMount{Endpoint: srv.URL, Credentials: provider}))
+	u, err := url.Parse("gs://bucket/shard.car")
+	require.NoError(t, err)
+	mnt, err := r.Instantiate(u)
+	require.NoError(t, err)
+
+	rd, err := mnt.Fetch(context.Background())
+	require.NoError(t, err)
+	defer rd.Close()
+	all, err := ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.Equal(t, content, all)
+
+	// rotate the credentials; the open reader and the mount pick up the new
+	// ones without being instantiated again.
+	atomic.StoreInt32(&current, 2)
+	buf := make([]byte, 10)
+	_, err = rd.ReadAt(buf, 100)
+	require.NoError(t, err)
+	require.Equal(t, content[100:110], buf)
+
+	stat, err := mnt.Stat(context.Background())
+	require.NoError(t, err)
+	require.EqualValues(t, len(content), stat.Size)
+
+	// credentials are not part of the mount URL.
+	u2, err := r.Represent(mnt)
+	require.NoError(t, err)
+	require.Equal(t, u.String(), u2.String())
+	require.Greater(t, atomic.LoadInt32(&calls), int32(2))
+}
+
+func TestCachingCredentials(t *testing.T) {
+	var calls int
+	var expiry time.Time
+	p := CachingCredentials(CredentialsFunc(func(context.Context, *url.URL) (Credentials, error) {
+		calls++
+		return Credentials{Token: "token", Expiry: expiry}, nil
+	}), time.Minute)
+
+	ctx := context.Background()
+	u1 := &url.URL{Scheme: GCSScheme, Host: "bucket", Path: "/a"}
+	u2 := &url.URL{Scheme: GCSScheme, Host: "bucket", Path: "/b"}
+
+	// credentials without expiry aren't cached.
+	_, err := p.Credentials(ctx, u1)
+	require.NoError(t, err)
+	_, err = p.Credentials(ctx, u1)
+	require.NoError(t, err)
+	require.Equal(t, 2, calls)
+
+	// credentials are cached per mount until the margin before they expire.
+	expiry = time.Now().Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		_, err = p.Credentials(ctx, u1)
+		require.NoError(t, err)
+		_, err = p.Credentials(ctx, u2)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 4, calls)
+
+	// credentials within the margin of their expiry are refreshed.
+	expiry = time.Now().Add(30 * time.Second)
+	u3 := &url.URL{Scheme: GCSScheme, Host: "bucket", Path: "/c"}
+	for i := 0; i < 2; i++ {
+		_, err = p.Credentials(ctx, u3)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 6, calls)
+
+	// expired credentials are evicted as the cache grows.
+	cc := p.(*cachingCredentials)
+	cc.lk.Lock()
+	for i := 0; i < minCredentialsSweep; i++ {
+		cc.cache[strconv.Itoa(i)] = Credentials{Token: "stale", Expiry: time.Now().Add(-time.Hour)}
+	}
+	cc.lk.Unlock()
+	expiry = time.Now().Add(time.Hour)
+	_, err = p.Credentials(ctx, u3)
+	require.NoError(t, err)
+	cc.lk.Lock()
+	require.Len(t, cc.cache, 3) // u1, u2 and u3.
+	cc.lk.Unlock()
+}
@@ -0,0 +1,194 @@
+package mount
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// ExecPlugin is an external program that implements a mount type, so that
+// operators can integrate storage systems with the DAG store without
+// recompiling it. Plugins are registered at runtime with
+// Registry.RegisterPlugin.
+//
+// The program is invoked once per operation, with the operation and the
+// object identifier as its last two arguments, and must exit with a zero
+// status on success. On failure, whatever it writes to stderr is reported in
+// the error. The operations are:
+//
+//	stat <object>   writes a JSON object to stdout, with the fields "exists"
+//	                (bool), "size" (int, 0 if unknown) and "ready" (bool).
+//	fetch <object>  streams the bytes of the object to stdout.
+//
+// Objects are opaque strings chosen by the application when it creates an
+// ExecMount, e.g. a bucket path or a sector ID.
+type ExecPlugin struct {
+	// Command is the path to the program.
+	Command string
+	// Args are the arguments passed to the program before the operation.
+	Args []string
+	// Env, if non-nil, is the environment of the program. See exec.Cmd.Env.
+	Env []string
+}
+
+// execStat is the output of the stat operation of an ExecPlugin.
+type execStat struct {
+	Exists bool  `json:"exists"`
+	Size   int64 `json:"size"`
+	Ready  bool  `json:"ready"`
+}
+
+// command prepares an invocation of the plugin.
+func (p *ExecPlugin) command(ctx context.Context, op, object string) (*exec.Cmd, *bytes.Buffer) {
+	args := append(append([]string(nil), p.Args...), op, object)
+	cmd := exec.CommandContext(ctx, p.Command, args...)
+	cmd.Env = p.Env
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	return cmd, stderr
+}
+
+// ExecMount is a mount backed by an ExecPlugin. Instances are created by the
+// registry, or by the application with the plugin it registered.
+//
+// The mount only supports sequential access, so that the Upgrader persists
+// the fetched object as a transient, and the plugin isn't invoked again on
+// every acquire.
+type ExecMount struct {
+	// Plugin is the plugin implementing the mount. It is environmental
+	// configuration, carried over from the template registered in the mount
+	// registry.
+	Plugin *ExecPlugin
+
+	// Object identifies the object to the plugin.
+	Object string
+}
+
+var _ Mount = (*ExecMount)(nil)
+
+func (e *ExecMount) Fetch(ctx context.Context) (Reader, error) {
+	if e.Plugin == nil {
+		return nil, fmt.Errorf("no plugin configured")
+	}
+	cmd, stderr := e.Plugin.command(ctx, "fetch", e.Object)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start plugin %s: %w", e.Plugin.Command, err)
+	}
+	return &execReader{cmd: cmd, stdout: stdout, stderr: stderr}, nil
+}
+
+func (e *ExecMount) Info() Info {
+	return Info{
+		Kind:             KindRemote,
+		AccessSequential: true,
+	}
+}
+
+func (e *ExecMount) Stat(ctx context.Context) (Stat, error) {
+	if e.Plugin == nil {
+		return Stat{}, fmt.Errorf("no plugin configured")
+	}
+	cmd, stderr := e.Plugin.command(ctx, "stat", e.Object)
+	out, err := cmd.Output()
+	if err != nil {
+		return Stat{}, execError(e.Plugin.Command, "stat", err, stderr)
+	}
+	var st execStat
+	if err := json.Unmarshal(out, &st); err != nil {
+		return Stat{}, fmt.Errorf("failed to parse plugin stat output: %w", err)
+	}
+	return Stat{
+		Exists: st.Exists,
+		Size:   st.Size,
+		Ready:  st.Ready,
+	}, nil
+}
+
+func (e *ExecMount) Serialize() *url.URL {
+	u := new(url.URL)
+	q := u.Query()
+	q.Set("object", e.Object)
+	u.RawQuery = q.Encode()
+	return u
+}
+
+func (e *ExecMount) Deserialize(u *url.URL) error {
+	q := u.Query()
+	if _, ok := q["object"]; !ok {
+		return fmt.Errorf("missing object")
+	}
+	e.Object = q.Get("object")
+	return nil
+}
+
+func (e *ExecMount) Close() error {
+	return nil
+}
+
+// execReader streams the output of a fetch operation. Once the output is
+// exhausted, it reports the failure of the plugin, if any, instead of EOF.
+type execReader struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr *bytes.Buffer
+
+	once    sync.Once
+	waitErr error
+}
+
+var _ Reader = (*execReader)(nil)
+
+func (r *execReader) Read(p []byte) (int, error) {
+	n, err := r.stdout.Read(p)
+	if err == io.EOF {
+		if werr := r.wait(); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (r *execReader) ReadAt(_ []byte, _ int64) (int, error) {
+	return 0, ErrRandomAccessUnsupported
+}
+
+func (r *execReader) Seek(_ int64, _ int) (int64, error) {
+	return 0, ErrSeekUnsupported
+}
+
+// Close terminates the plugin if it's still running.
+func (r *execReader) Close() error {
+	r.once.Do(func() {
+		_ = r.cmd.Process.Kill()
+		_ = r.cmd.Wait()
+	})
+	return nil
+}
+
+// wait waits for the plugin to exit after its output is exhausted.
+func (r *execReader) wait() error {
+	r.once.Do(func() {
+		if err := r.cmd.Wait(); err != nil {
+			r.waitErr = execError(r.cmd.Path, "fetch", err, r.stderr)
+		}
+	})
+	return r.waitErr
+}
+
+// execError builds the error of a failed plugin operation.
+func execError(command, op string, err error, stderr *bytes.Buffer) error {
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return fmt.Errorf("plugin %s failed to %s: %w: %s", command, op, err, msg)
+	}
+	return fmt.Errorf("plugin %s failed to %s: %w", command, op, err)
+}
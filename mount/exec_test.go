@@ -0,0 +1,119 @@
+package mount
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// execPluginScript serves the files of the directory passed as its first
+// argument.
+const execPluginScript = `#!/bin/sh
+dir="$1"; op="$2"; obj="$3"
+if [ ! -f "$dir/$obj" ]; then
+	echo "no such object: $obj" >&2
+	exit 1
+fi
+case "$op" in
+stat)
+	printf '{"exists": true, "size": %d, "ready": true}' "$(wc -c < "$dir/$obj")"
+	;;
+fetch)
+	cat "$dir/$obj"
+	;;
+*)
+	echo "unknown operation: $op" >&2
+	exit 2
+	;;
+esac
+`
+
+func newExecPlugin(t *testing.T) (*ExecPlugin, string) {
+	if runtime.GOOS == "windows" {
+		t.Skip("exec plugins are tested with shell scripts")
+	}
+	dir := t.TempDir()
+	cmd := filepath.Join(t.TempDir(), "plugin.sh")
+	err := os.WriteFile(cmd, []byte(execPluginScript), 0755)
+	require.NoError(t, err)
+	return &ExecPlugin{Command: cmd, Args: []string{dir}}, dir
+}
+
+func TestExecMount(t *testing.T) {
+	plugin, dir := newExecPlugin(t)
+	err := os.WriteFile(filepath.Join(dir, "foo"), []byte("hello world"), 0644)
+	require.NoError(t, err)
+
+	m := &ExecMount{Plugin: plugin, Object: "foo"}
+	stat, err := m.Stat(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, Stat{Exists: true, Size: 11, Ready: true}, stat)
+
+	rd, err := m.Fetch(context.Background())
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(b))
+	require.NoError(t, rd.Close())
+
+	_, err = rd.ReadAt(make([]byte, 1), 0)
+	require.ErrorIs(t, err, ErrRandomAccessUnsupported)
+
+	// plugin failures are reported with their stderr.
+	m = &ExecMount{Plugin: plugin, Object: "bar"}
+	_, err = m.Stat(context.Background())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no such object: bar")
+
+	rd, err = m.Fetch(context.Background())
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(rd)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no such object: bar")
+	require.NoError(t, rd.Close())
+}
+
+func TestExecMountRegistry(t *testing.T) {
+	plugin1, dir := newExecPlugin(t)
+	plugin2, _ := newExecPlugin(t)
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "a"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a/b"), []byte("nested"), 0644))
+
+	r := NewRegistry()
+	require.NoError(t, r.RegisterPlugin("one", plugin1))
+	require.NoError(t, r.RegisterPlugin("two", plugin2))
+	require.Error(t, r.RegisterPlugin("one", plugin2))
+	require.Error(t, r.RegisterPlugin("three", plugin1))
+
+	// each plugin's mounts are represented with its scheme.
+	u, err := r.Represent(&ExecMount{Plugin: plugin1, Object: "a/b"})
+	require.NoError(t, err)
+	require.Equal(t, "one", u.Scheme)
+	u2, err := r.Represent(&ExecMount{Plugin: plugin2, Object: "a/b"})
+	require.NoError(t, err)
+	require.Equal(t, "two", u2.Scheme)
+
+	_, err = r.Represent(&ExecMount{Plugin: &ExecPlugin{}, Object: "a/b"})
+	require.ErrorIs(t, err, ErrUnrecognizedType)
+
+	// mounts are revived with their plugin.
+	u, err = url.Parse(u.String())
+	require.NoError(t, err)
+	m, err := r.Instantiate(u)
+	require.NoError(t, err)
+	require.Same(t, plugin1, m.(*ExecMount).Plugin)
+	require.Equal(t, "a/b", m.(*ExecMount).Object)
+
+	rd, err := m.Fetch(context.Background())
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.Equal(t, "nested", string(b))
+	require.NoError(t, rd.Close())
+}
@@ -0,0 +1,139 @@
+package mount
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGCSMount(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+
+	var failures, truncations int32 = 2, 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/bucket/dir/shard.car" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		// fail the first requests, to exercise retries.
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		// break the first full stream halfway, to exercise resumption.
+		if r.Method == http.MethodGet && r.Header.Get("Range") == "" && atomic.AddInt32(&truncations, -1) >= 0 {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			_, _ = w.Write(content[:len(content)/2])
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "shard.car", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	r := NewRegistry()
+	err := r.Register(GCSScheme, &GCSMount{
+		Endpoint:    srv.URL,
+		TokenSource: func(context.Context) (string, error) { return "token", nil },
+		Retry:       RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond},
+	})
+	require.NoError(t, err)
+
+	u, err := url.Parse("gs://bucket/dir/shard.car")
+	require.NoError(t, err)
+	mnt, err := r.Instantiate(u)
+	require.NoError(t, err)
+
+	// the URL round-trips, and carries no credentials.
+	u2, err := r.Represent(mnt)
+	require.NoError(t, err)
+	require.Equal(t, u.String(), u2.String())
+
+	stat, err := mnt.Stat(context.Background())
+	require.NoError(t, err)
+	require.True(t, stat.Exists)
+	require.EqualValues(t, len(content), stat.Size)
+	require.Equal(t, `"v1"`, stat.Version)
+
+	rd, err := mnt.Fetch(context.Background())
+	require.NoError(t, err)
+	defer rd.Close()
+
+	// sequential reads survive the broken stream.
+	all, err := ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.Equal(t, content, all)
+
+	// ranged reads.
+	buf := make([]byte, 15)
+	n, err := rd.ReadAt(buf, 995)
+	require.NoError(t, err)
+	require.Equal(t, 15, n)
+	require.Equal(t, content[995:1010], buf)
+
+	n, err = rd.ReadAt(buf, int64(len(content)-5))
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, 5, n)
+
+	_, err = rd.Seek(-10, io.SeekEnd)
+	require.NoError(t, err)
+	tail, err := ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.Equal(t, content[len(content)-10:], tail)
+
+	// progress is reported as the object is received.
+	var transferred, total int64
+	rd2, err := FetchWithProgress(context.Background(), mnt, 0, func(n, t int64) { transferred, total = n, t })
+	require.NoError(t, err)
+	defer rd2.Close()
+	_, err = io.Copy(io.Discard, rd2)
+	require.NoError(t, err)
+	require.EqualValues(t, len(content), transferred)
+	require.EqualValues(t, len(content), total)
+
+	// missing objects.
+	missing := &GCSMount{Endpoint: srv.URL, TokenSource: func(context.Context) (string, error) { return "token", nil }, Bucket: "bucket", Object: "nope"}
+	stat, err = missing.Stat(context.Background())
+	require.NoError(t, err)
+	require.False(t, stat.Exists)
+	_, err = missing.Fetch(context.Background())
+	require.Error(t, err)
+
+	// unauthorized requests aren't retried.
+	anon := &GCSMount{Endpoint: srv.URL, Bucket: "bucket", Object: "dir/shard.car"}
+	_, err = anon.Stat(context.Background())
+	require.Error(t, err)
+}
+
+func TestGCSMountRetriesExhausted(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	mnt := &GCSMount{
+		Endpoint: srv.URL,
+		Retry:    RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond},
+		Bucket:   "bucket",
+		Object:   "shard.car",
+	}
+	_, err := mnt.Stat(context.Background())
+	require.Error(t, err)
+	require.EqualValues(t, 3, atomic.LoadInt32(&calls))
+}
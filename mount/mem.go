@@ -0,0 +1,221 @@
+package mount
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemScheme is the URL scheme under which applications conventionally
+// register MemMount templates, e.g. mem:///name.
+const MemScheme = "mem"
+
+var (
+	// ErrMemEntryNotFound is returned when fetching a MemMount whose entry
+	// doesn't exist in its store, or was evicted.
+	ErrMemEntryNotFound = errors.New("in-memory entry not found")
+
+	// ErrMemStoreFull is returned by MemStore.Put when the data doesn't fit
+	// in the store, even after evicting all other entries.
+	ErrMemStoreFull = errors.New("in-memory store full")
+)
+
+// MemStore holds CARs in memory, for MemMounts to serve them, e.g. in tests,
+// or to cache short-lived shards without touching disk.
+//
+// The store is bounded in size: storing an entry that exceeds the limit
+// evicts the least recently accessed entries. Entries not accessed for the
+// TTL expire, and are evicted as they're accessed, or as entries are stored.
+type MemStore struct {
+	maxBytes int64
+	ttl      time.Duration
+
+	lk      sync.Mutex
+	entries map[string]*memEntry
+	size    int64
+}
+
+type memEntry struct {
+	data     []byte
+	accessed time.Time
+}
+
+// NewMemStore creates a MemStore holding up to maxBytes bytes, whose entries
+// expire if not accessed for ttl. Zero or negative values disable the
+// respective limit.
+func NewMemStore(maxBytes int64, ttl time.Duration) *MemStore {
+	return &MemStore{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		entries:  make(map[string]*memEntry),
+	}
+}
+
+// Put stores the data under the given name, replacing the existing entry if
+// any, and returns a mount of it. The data must not be modified afterwards.
+func (s *MemStore) Put(name string, data []byte) (*MemMount, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if s.maxBytes > 0 && int64(len(data)) > s.maxBytes {
+		return nil, fmt.Errorf("%s: %d bytes: %w", name, len(data), ErrMemStoreFull)
+	}
+	s.remove(name)
+	s.evictExpired(time.Now())
+	for s.maxBytes > 0 && s.size+int64(len(data)) > s.maxBytes {
+		s.evictOldest()
+	}
+	s.entries[name] = &memEntry{data: data, accessed: time.Now()}
+	s.size += int64(len(data))
+	return &MemMount{Store: s, Name: name}, nil
+}
+
+// Delete removes the entry with the given name, if it exists.
+func (s *MemStore) Delete(name string) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	s.remove(name)
+}
+
+// Size returns the number of bytes held by the store, including expired
+// entries that haven't been evicted yet.
+func (s *MemStore) Size() int64 {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	return s.size
+}
+
+// get returns the data of an entry, evicting it if it expired. If touch is
+// set, it records the access, extending the lifetime of the entry.
+func (s *MemStore) get(name string, touch bool) ([]byte, bool) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	e, ok := s.entries[name]
+	if !ok {
+		return nil, false
+	}
+	now := time.Now()
+	if s.expired(e, now) {
+		s.remove(name)
+		return nil, false
+	}
+	if touch {
+		e.accessed = now
+	}
+	return e.data, true
+}
+
+func (s *MemStore) expired(e *memEntry, now time.Time) bool {
+	return s.ttl > 0 && now.Sub(e.accessed) >= s.ttl
+}
+
+// evictExpired evicts all expired entries. It must be called with the lock
+// held.
+func (s *MemStore) evictExpired(now time.Time) {
+	for name, e := range s.entries {
+		if s.expired(e, now) {
+			s.remove(name)
+		}
+	}
+}
+
+// evictOldest evicts the least recently accessed entry. It must be called
+// with the lock held.
+func (s *MemStore) evictOldest() {
+	var oldest string
+	var at time.Time
+	for name, e := range s.entries {
+		if at.IsZero() || e.accessed.Before(at) {
+			oldest, at = name, e.accessed
+		}
+	}
+	log.Debugw("evicting in-memory entry to make room", "name", oldest)
+	s.remove(oldest)
+}
+
+// remove removes an entry. It must be called with the lock held.
+func (s *MemStore) remove(name string) {
+	if e, ok := s.entries[name]; ok {
+		s.size -= int64(len(e.data))
+		delete(s.entries, name)
+	}
+}
+
+// MemMount is a mount of a CAR held in a MemStore. The Upgrader passes
+// through it.
+//
+// Applications register a template carrying the store in the mount registry
+// (typically under MemScheme), and instances take the name of the entry from
+// the mount URL.
+type MemMount struct {
+	// Store is the store holding the entry.
+	Store *MemStore
+	// Name is the name of the entry.
+	Name string
+}
+
+var _ Mount = (*MemMount)(nil)
+
+func (m *MemMount) Fetch(_ context.Context) (Reader, error) {
+	data, ok := m.Store.get(m.Name, true)
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", m.Name, ErrMemEntryNotFound)
+	}
+	r := bytes.NewReader(data)
+	return &NopCloser{
+		Reader:   r,
+		ReaderAt: r,
+		Seeker:   r,
+	}, nil
+}
+
+func (m *MemMount) Info() Info {
+	return Info{
+		Kind:             KindLocal,
+		AccessSequential: true,
+		AccessSeek:       true,
+		AccessRandom:     true,
+	}
+}
+
+func (m *MemMount) Stat(_ context.Context) (Stat, error) {
+	data, ok := m.Store.get(m.Name, false)
+	if !ok {
+		return Stat{}, nil
+	}
+	return Stat{
+		Exists: true,
+		Size:   int64(len(data)),
+		Ready:  true,
+	}, nil
+}
+
+func (m *MemMount) Serialize() *url.URL {
+	return &url.URL{
+		Path: "/" + m.Name,
+	}
+}
+
+func (m *MemMount) Deserialize(u *url.URL) error {
+	name := strings.TrimPrefix(u.Path, "/")
+	if name == "" {
+		return fmt.Errorf("missing name")
+	}
+	if m.Store == nil {
+		return fmt.Errorf("mount template has no store")
+	}
+	m.Name = name
+	return nil
+}
+
+func (m *MemMount) Close() error {
+	return nil
+}
@@ -0,0 +1,84 @@
+package mount
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemMount(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStore(10, 0)
+
+	m, err := store.Put("foo/bar", []byte("hello"))
+	require.NoError(t, err)
+
+	// the mount survives a round trip through its URL.
+	r := NewRegistry()
+	require.NoError(t, r.Register(MemScheme, &MemMount{Store: store}))
+	u, err := r.Represent(m)
+	require.NoError(t, err)
+	u, err = url.Parse(u.String())
+	require.NoError(t, err)
+	mnt, err := r.Instantiate(u)
+	require.NoError(t, err)
+
+	st, err := mnt.Stat(ctx)
+	require.NoError(t, err)
+	require.Equal(t, Stat{Exists: true, Size: 5, Ready: true}, st)
+
+	rd, err := mnt.Fetch(ctx)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello"), data)
+	require.NoError(t, rd.Close())
+
+	// storing beyond the limit evicts the least recently accessed entries.
+	_, err = store.Put("baz", []byte("abc"))
+	require.NoError(t, err)
+	_, err = mnt.Fetch(ctx) // access foo/bar.
+	require.NoError(t, err)
+	_, err = store.Put("qux", []byte("defg"))
+	require.NoError(t, err)
+	require.EqualValues(t, 9, store.Size())
+	st, err = (&MemMount{Store: store, Name: "baz"}).Stat(ctx)
+	require.NoError(t, err)
+	require.False(t, st.Exists)
+	_, err = (&MemMount{Store: store, Name: "baz"}).Fetch(ctx)
+	require.ErrorIs(t, err, ErrMemEntryNotFound)
+
+	// entries larger than the store are rejected.
+	_, err = store.Put("big", make([]byte, 11))
+	require.ErrorIs(t, err, ErrMemStoreFull)
+
+	store.Delete("qux")
+	require.EqualValues(t, 5, store.Size())
+}
+
+func TestMemMountTTL(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStore(0, 100*time.Millisecond)
+
+	m, err := store.Put("foo", []byte("hello"))
+	require.NoError(t, err)
+
+	// fetches extend the lifetime of entries.
+	for i := 0; i < 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		_, err = m.Fetch(ctx)
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool {
+		st, err := m.Stat(ctx)
+		return err == nil && !st.Exists
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err = m.Fetch(ctx)
+	require.ErrorIs(t, err, ErrMemEntryNotFound)
+	require.Zero(t, store.Size())
+}
@@ -0,0 +1,294 @@
+package mount
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Middleware wraps a mount to add behavior to it, e.g. logging, metrics or
+// retries, without defining a new mount type. Middlewares can be applied to
+// mounts directly, or to all mounts of a scheme through Registry.Use.
+//
+// The mounts returned by middlewares must implement Wrapper, so that the
+// registry represents them as the mounts they wrap. Optional interfaces of the
+// wrapped mounts, such as FetcherWithProgress, are hidden by the middlewares
+// of this package.
+type Middleware func(Mount) Mount
+
+// Wrapper is implemented by mounts that wrap another mount, such as those
+// returned by middlewares.
+type Wrapper interface {
+	Mount
+
+	// Unwrap returns the wrapped mount.
+	Unwrap() Mount
+}
+
+// Chain wraps the mount with the supplied middlewares. The first middleware
+// is the outermost, i.e. it sees calls first.
+func Chain(m Mount, mws ...Middleware) Mount {
+	for i := len(mws) - 1; i >= 0; i-- {
+		m = mws[i](m)
+	}
+	return m
+}
+
+// Unwrap returns the innermost mount wrapped by m, or m itself if it's not a
+// Wrapper.
+func Unwrap(m Mount) Mount {
+	for {
+		w, ok := m.(Wrapper)
+		if !ok {
+			return m
+		}
+		m = w.Unwrap()
+	}
+}
+
+// WithLogging logs the fetches and stats of mounts, with their duration and
+// errors, and the bytes read through their readers once closed. Successful
+// calls are logged at debug level, and failed ones as warnings.
+func WithLogging() Middleware {
+	return func(m Mount) Mount {
+		return &loggingMount{Mount: m}
+	}
+}
+
+type loggingMount struct {
+	Mount
+}
+
+func (l *loggingMount) Unwrap() Mount {
+	return l.Mount
+}
+
+func (l *loggingMount) Fetch(ctx context.Context) (Reader, error) {
+	start := time.Now()
+	rd, err := l.Mount.Fetch(ctx)
+	if err != nil {
+		log.Warnw("mount fetch failed", "mount", l.describe(), "took", time.Since(start), "error", err)
+		return nil, err
+	}
+	log.Debugw("mount fetched", "mount", l.describe(), "took", time.Since(start))
+	return &loggingReader{Reader: rd, m: l, start: start}, nil
+}
+
+func (l *loggingMount) Stat(ctx context.Context) (Stat, error) {
+	start := time.Now()
+	st, err := l.Mount.Stat(ctx)
+	if err != nil {
+		log.Warnw("mount stat failed", "mount", l.describe(), "took", time.Since(start), "error", err)
+		return st, err
+	}
+	log.Debugw("mount stat", "mount", l.describe(), "took", time.Since(start), "exists", st.Exists, "size", st.Size)
+	return st, nil
+}
+
+// describe returns the type and URL of the wrapped mount for logging.
+func (l *loggingMount) describe() string {
+	inner := Unwrap(l.Mount)
+	return fmt.Sprintf("%T(%s)", inner, inner.Serialize())
+}
+
+type loggingReader struct {
+	Reader
+	m     *loggingMount
+	start time.Time
+	read  int64 // accessed atomically.
+}
+
+func (r *loggingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	atomic.AddInt64(&r.read, int64(n))
+	return n, err
+}
+
+func (r *loggingReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.Reader.ReadAt(p, off)
+	atomic.AddInt64(&r.read, int64(n))
+	return n, err
+}
+
+func (r *loggingReader) Close() error {
+	err := r.Reader.Close()
+	log.Debugw("mount reader closed", "mount", r.m.describe(), "read", atomic.LoadInt64(&r.read), "open_for", time.Since(r.start), "error", err)
+	return err
+}
+
+// Metrics accumulates metrics about the mounts wrapped by WithMetrics. A
+// single Metrics is typically shared by all mounts of a scheme, to aggregate
+// them. It's safe for concurrent use.
+type Metrics struct {
+	fetches     uint64
+	fetchErrors uint64
+	fetchTime   int64 // in nanoseconds.
+	stats       uint64
+	statErrors  uint64
+	bytesRead   uint64
+	readErrors  uint64
+	open        int64
+}
+
+// MetricsSnapshot is a snapshot of Metrics.
+type MetricsSnapshot struct {
+	// Fetches and FetchErrors are the number of calls to Fetch, and the
+	// number of those that failed.
+	Fetches, FetchErrors uint64
+	// FetchTime is the total time spent in calls to Fetch.
+	FetchTime time.Duration
+	// Stats and StatErrors are the number of calls to Stat, and the number
+	// of those that failed.
+	Stats, StatErrors uint64
+	// BytesRead is the number of bytes read through fetched readers, and
+	// ReadErrors the number of reads that failed, other than with io.EOF.
+	BytesRead, ReadErrors uint64
+	// OpenReaders is the number of fetched readers not closed yet.
+	OpenReaders int64
+}
+
+// Snapshot returns the current values of the metrics.
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	return MetricsSnapshot{
+		Fetches:     atomic.LoadUint64(&m.fetches),
+		FetchErrors: atomic.LoadUint64(&m.fetchErrors),
+		FetchTime:   time.Duration(atomic.LoadInt64(&m.fetchTime)),
+		Stats:       atomic.LoadUint64(&m.stats),
+		StatErrors:  atomic.LoadUint64(&m.statErrors),
+		BytesRead:   atomic.LoadUint64(&m.bytesRead),
+		ReadErrors:  atomic.LoadUint64(&m.readErrors),
+		OpenReaders: atomic.LoadInt64(&m.open),
+	}
+}
+
+// WithMetrics records metrics about the fetches, stats and reads of mounts
+// into the supplied Metrics.
+func WithMetrics(metrics *Metrics) Middleware {
+	return func(m Mount) Mount {
+		return &metricsMount{Mount: m, metrics: metrics}
+	}
+}
+
+type metricsMount struct {
+	Mount
+	metrics *Metrics
+}
+
+func (m *metricsMount) Unwrap() Mount {
+	return m.Mount
+}
+
+func (m *metricsMount) Fetch(ctx context.Context) (Reader, error) {
+	start := time.Now()
+	rd, err := m.Mount.Fetch(ctx)
+	atomic.AddUint64(&m.metrics.fetches, 1)
+	atomic.AddInt64(&m.metrics.fetchTime, int64(time.Since(start)))
+	if err != nil {
+		atomic.AddUint64(&m.metrics.fetchErrors, 1)
+		return nil, err
+	}
+	atomic.AddInt64(&m.metrics.open, 1)
+	return &metricsReader{Reader: rd, metrics: m.metrics}, nil
+}
+
+func (m *metricsMount) Stat(ctx context.Context) (Stat, error) {
+	st, err := m.Mount.Stat(ctx)
+	atomic.AddUint64(&m.metrics.stats, 1)
+	if err != nil {
+		atomic.AddUint64(&m.metrics.statErrors, 1)
+	}
+	return st, err
+}
+
+type metricsReader struct {
+	Reader
+	metrics *Metrics
+	closed  int32 // accessed atomically.
+}
+
+func (r *metricsReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.record(n, err)
+	return n, err
+}
+
+func (r *metricsReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.Reader.ReadAt(p, off)
+	r.record(n, err)
+	return n, err
+}
+
+func (r *metricsReader) Close() error {
+	if atomic.CompareAndSwapInt32(&r.closed, 0, 1) {
+		atomic.AddInt64(&r.metrics.open, -1)
+	}
+	return r.Reader.Close()
+}
+
+func (r *metricsReader) record(n int, err error) {
+	atomic.AddUint64(&r.metrics.bytesRead, uint64(n))
+	if err != nil && !errors.Is(err, io.EOF) {
+		atomic.AddUint64(&r.metrics.readErrors, 1)
+	}
+}
+
+// WithRetry retries the fetches and stats of mounts that fail, up to attempts
+// times in total, waiting backoff before the first retry, and doubling it on
+// each retry. Errors caused by the context of the call, and errors wrapping
+// os.ErrNotExist, which retrying can't fix, are returned right away. Reads
+// aren't retried, as readers can't resume after failures in general.
+func WithRetry(attempts int, backoff time.Duration) Middleware {
+	return func(m Mount) Mount {
+		return &retryMount{Mount: m, attempts: attempts, backoff: backoff}
+	}
+}
+
+type retryMount struct {
+	Mount
+	attempts int
+	backoff  time.Duration
+}
+
+func (r *retryMount) Unwrap() Mount {
+	return r.Mount
+}
+
+func (r *retryMount) Fetch(ctx context.Context) (Reader, error) {
+	var rd Reader
+	err := r.retry(ctx, "fetch", func() (err error) {
+		rd, err = r.Mount.Fetch(ctx)
+		return err
+	})
+	return rd, err
+}
+
+func (r *retryMount) Stat(ctx context.Context) (Stat, error) {
+	var st Stat
+	err := r.retry(ctx, "stat", func() (err error) {
+		st, err = r.Mount.Stat(ctx)
+		return err
+	})
+	return st, err
+}
+
+func (r *retryMount) retry(ctx context.Context, op string, fn func() error) error {
+	backoff := r.backoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= r.attempts || ctx.Err() != nil || errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		log.Debugw("mount call failed; retrying", "op", op, "attempt", attempt, "backoff", backoff, "error", err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
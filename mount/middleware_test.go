@@ -0,0 +1,176 @@
+package mount
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// flakyMount is a mount whose fetches and stats fail with err a given number
+// of times before succeeding.
+type flakyMount struct {
+	BytesMount
+	failures int
+	err      error
+	calls    int
+}
+
+func (f *flakyMount) Fetch(ctx context.Context) (Reader, error) {
+	if f.calls++; f.calls <= f.failures {
+		return nil, f.err
+	}
+	return f.BytesMount.Fetch(ctx)
+}
+
+func (f *flakyMount) Stat(ctx context.Context) (Stat, error) {
+	if f.calls++; f.calls <= f.failures {
+		return Stat{}, f.err
+	}
+	return f.BytesMount.Stat(ctx)
+}
+
+// tagMiddleware records the order in which wrapped mounts are fetched.
+func tagMiddleware(tag string, order *[]string) Middleware {
+	return func(m Mount) Mount {
+		return &tagMount{Mount: m, tag: tag, order: order}
+	}
+}
+
+type tagMount struct {
+	Mount
+	tag   string
+	order *[]string
+}
+
+func (t *tagMount) Unwrap() Mount {
+	return t.Mount
+}
+
+func (t *tagMount) Fetch(ctx context.Context) (Reader, error) {
+	*t.order = append(*t.order, t.tag)
+	return t.Mount.Fetch(ctx)
+}
+
+func TestChain(t *testing.T) {
+	inner := &BytesMount{Bytes: []byte("foo")}
+	var order []string
+	m := Chain(inner, tagMiddleware("a", &order), tagMiddleware("b", &order), WithLogging())
+	require.Same(t, inner, Unwrap(m))
+	require.Same(t, inner, Unwrap(inner))
+
+	rd, err := m.Fetch(context.Background())
+	require.NoError(t, err)
+	bz, err := ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.Equal(t, "foo", string(bz))
+	require.NoError(t, rd.Close())
+	require.Equal(t, []string{"a", "b"}, order)
+}
+
+func TestWithMetrics(t *testing.T) {
+	ctx := context.Background()
+	metrics := new(Metrics)
+	ok := WithMetrics(metrics)(&BytesMount{Bytes: []byte("foobar")})
+	failing := WithMetrics(metrics)(&flakyMount{failures: 2, err: errors.New("boom")})
+
+	rd, err := ok.Fetch(ctx)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, metrics.Snapshot().OpenReaders)
+	bz, err := ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.Len(t, bz, 6)
+	_, err = rd.ReadAt(make([]byte, 3), 0)
+	require.NoError(t, err)
+	require.NoError(t, rd.Close())
+
+	_, err = failing.Fetch(ctx)
+	require.Error(t, err)
+	_, err = failing.Stat(ctx)
+	require.Error(t, err)
+	_, err = ok.Stat(ctx)
+	require.NoError(t, err)
+
+	snap := metrics.Snapshot()
+	require.EqualValues(t, 2, snap.Fetches)
+	require.EqualValues(t, 1, snap.FetchErrors)
+	require.EqualValues(t, 2, snap.Stats)
+	require.EqualValues(t, 1, snap.StatErrors)
+	require.EqualValues(t, 9, snap.BytesRead)
+	require.Zero(t, snap.ReadErrors)
+	require.Zero(t, snap.OpenReaders)
+}
+
+func TestWithRetry(t *testing.T) {
+	ctx := context.Background()
+
+	// transient failures are retried.
+	flaky := &flakyMount{BytesMount: BytesMount{Bytes: []byte("foo")}, failures: 2, err: io.ErrUnexpectedEOF}
+	rd, err := WithRetry(3, time.Millisecond)(flaky).Fetch(ctx)
+	require.NoError(t, err)
+	require.NoError(t, rd.Close())
+	require.Equal(t, 3, flaky.calls)
+
+	// up to the number of attempts.
+	flaky = &flakyMount{failures: 5, err: io.ErrUnexpectedEOF}
+	_, err = WithRetry(3, time.Millisecond)(flaky).Stat(ctx)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	require.Equal(t, 3, flaky.calls)
+
+	// missing assets aren't.
+	flaky = &flakyMount{failures: 5, err: os.ErrNotExist}
+	_, err = WithRetry(3, time.Millisecond)(flaky).Stat(ctx)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.Equal(t, 1, flaky.calls)
+
+	// nor are failures once the context is done.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	flaky = &flakyMount{failures: 5, err: io.ErrUnexpectedEOF}
+	_, err = WithRetry(3, time.Hour)(flaky).Fetch(cctx)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	require.Equal(t, 1, flaky.calls)
+}
+
+func TestRegistryUse(t *testing.T) {
+	r := NewRegistry()
+	require.NoError(t, r.Register("bytes", new(BytesMount)))
+	require.ErrorIs(t, r.Use("unknown", WithLogging()), ErrUnrecognizedScheme)
+
+	metrics := new(Metrics)
+	require.NoError(t, r.Use("bytes", WithMetrics(metrics)))
+	require.NoError(t, r.Use("bytes", WithLogging()))
+
+	// mounts passed to Apply are wrapped, once.
+	m := r.Apply(&BytesMount{Bytes: []byte("foo")})
+	require.IsType(t, &metricsMount{}, m)
+	require.Same(t, m, r.Apply(m))
+	_, err := m.Stat(context.Background())
+	require.NoError(t, err)
+	require.EqualValues(t, 1, metrics.Snapshot().Stats)
+
+	// wrapped mounts are represented as the mounts they wrap, and
+	// instantiated wrapped.
+	u, err := r.Represent(m)
+	require.NoError(t, err)
+	require.Equal(t, "bytes", u.Scheme)
+	m2, err := r.Instantiate(u)
+	require.NoError(t, err)
+	require.IsType(t, &metricsMount{}, m2)
+	require.Equal(t, []byte("foo"), Unwrap(m2).(*BytesMount).Bytes)
+
+	// mounts of other schemes are left alone.
+	require.NoError(t, r.Register("file", new(FileMount)))
+	fm := &FileMount{Path: "/tmp/foo"}
+	require.Same(t, Mount(fm), r.Apply(fm))
+	u, err = r.Represent(fm)
+	require.NoError(t, err)
+	m3, err := r.Instantiate(u)
+	require.NoError(t, err)
+	require.IsType(t, &FileMount{}, m3)
+}
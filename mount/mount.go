@@ -5,6 +5,9 @@ import (
 	"errors"
 	"io"
 	"net/url"
+	"time"
+
+	"github.com/multiformats/go-multihash"
 )
 
 var (
@@ -15,6 +18,10 @@ var (
 	// ErrRandomAccessUnsupported is returned when ReadAt is called on a mount
 	// that does not support random access.
 	ErrRandomAccessUnsupported = errors.New("mount does not support random access")
+
+	// ErrChecksumMismatch is returned when the data fetched from a mount
+	// doesn't match its expected checksum.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
 )
 
 // Kind is an enum describing the source of a Mount.
@@ -103,6 +110,14 @@ type Info struct {
 	AccessSequential bool
 	AccessSeek       bool
 	AccessRandom     bool
+
+	// AccessLatency is a hint of the latency of random reads from mounts
+	// that support random access natively, e.g. a few hundred microseconds
+	// for NVMe-oF, or tens of milliseconds for a remote HTTP server. Zero
+	// means reads are about as fast as reads of local files. Upgraders read
+	// mounts directly only if their latency is within their threshold, and
+	// copy slower ones to transients (see UpgradeOpts).
+	AccessLatency time.Duration
 }
 
 // Stat
@@ -114,6 +129,13 @@ type Stat struct {
 	// Ready indicates whether the mount can serve the resource immediately, or
 	// if it needs to do work prior to serving it.
 	Ready bool
+	// Checksum, if non-nil, is the expected multihash of the asset's bytes.
+	// The Upgrader verifies transients against it after fetching.
+	Checksum multihash.Multihash
+	// Version, if non-empty, identifies the current version of the asset,
+	// e.g. its ETag; it changes whenever the asset's bytes do. Shared
+	// transients of different versions are kept apart.
+	Version string
 }
 
 type NopCloser struct {
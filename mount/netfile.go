@@ -0,0 +1,336 @@
+package mount
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// NetFileScheme is the URL scheme under which applications conventionally
+// register NetFileMount templates, e.g. netfile:///mnt/nfs/piece.car.
+const NetFileScheme = "netfile"
+
+var (
+	// ErrStale is returned when the data of a mount can no longer be read,
+	// e.g. because the file backing a NetFileMount was replaced or its
+	// handle went stale, and retrying didn't help. The DAG store fails
+	// shards whose mounts return it, and recovers them on their next acquire.
+	ErrStale = errors.New("stale mount")
+
+	// DefaultNetFileMaxReopens is the default value of
+	// NetFileMount.MaxReopens.
+	DefaultNetFileMaxReopens = 3
+
+	// DefaultNetFileReopenBackoff is the default value of
+	// NetFileMount.ReopenBackoff.
+	DefaultNetFileReopenBackoff = 100 * time.Millisecond
+)
+
+// NetFileMount is a FileMount variant for CAR files on network filesystems,
+// such as NFS or SMB, whose file handles can go stale, e.g. when the server
+// restarts or fails over.
+//
+// Reads failing with ESTALE are retried after reopening the file. If
+// the file was replaced in the meantime (i.e. its size or modification time
+// changed), or reopening doesn't help, reads fail with an error wrapping
+// ErrStale instead of the raw I/O error.
+//
+// Unlike FileMount, the readers it returns are never memory-mapped, as
+// accesses to a mapping whose handle goes stale crash the process.
+//
+// MaxReopens and ReopenBackoff are taken from the template registered with
+// the registry; only the path is serialized.
+type NetFileMount struct {
+	Path string
+
+	// MaxReopens is the number of times a read is retried after reopening
+	// the file. Defaults to DefaultNetFileMaxReopens.
+	MaxReopens int
+
+	// ReopenBackoff is the delay before reopening the file, which doubles on
+	// each retry of a read. Defaults to DefaultNetFileReopenBackoff.
+	ReopenBackoff time.Duration
+}
+
+var _ Mount = (*NetFileMount)(nil)
+
+// netFile is the handle of an open file, as returned by openNetFile.
+type netFile interface {
+	io.ReaderAt
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+// openNetFile opens a file backing a NetFileMount; tests override it to
+// simulate stale handles.
+var openNetFile = func(path string) (netFile, error) {
+	return os.Open(path)
+}
+
+func (f *NetFileMount) Fetch(ctx context.Context) (Reader, error) {
+	var file netFile
+	var fi os.FileInfo
+	err := f.retry(ctx, func() (err error) {
+		file, fi, err = f.open()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &netFileReader{m: f, file: file, fi: fi}, nil
+}
+
+func (f *NetFileMount) Info() Info {
+	return Info{
+		Kind:             KindLocal,
+		AccessRandom:     true,
+		AccessSeek:       true,
+		AccessSequential: true,
+	}
+}
+
+func (f *NetFileMount) Stat(ctx context.Context) (Stat, error) {
+	var fi os.FileInfo
+	err := f.retry(ctx, func() (err error) {
+		fi, err = os.Stat(f.Path)
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Stat{}, err
+		}
+		return Stat{Exists: true}, err
+	}
+	return Stat{Exists: true, Size: fi.Size()}, nil
+}
+
+func (f *NetFileMount) Serialize() *url.URL {
+	return &url.URL{
+		Path: f.Path,
+	}
+}
+
+func (f *NetFileMount) Deserialize(u *url.URL) error {
+	path := u.Path
+	if path == "" {
+		path = u.Opaque
+	}
+	if path == "" {
+		return fmt.Errorf("missing path")
+	}
+	f.Path = path
+	return nil
+}
+
+func (f *NetFileMount) Close() error {
+	return nil
+}
+
+// open opens the file, returning its info, so that replacements can be
+// detected when reopening it.
+func (f *NetFileMount) open() (netFile, os.FileInfo, error) {
+	file, err := openNetFile(f.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, nil, err
+	}
+	return file, fi, nil
+}
+
+// retry runs fn, retrying it with backoff while it fails with stale handle
+// errors, up to MaxReopens times. Errors that persist are wrapped with
+// ErrStale.
+func (f *NetFileMount) retry(ctx context.Context, fn func() error) error {
+	backoff := f.ReopenBackoff
+	if backoff <= 0 {
+		backoff = DefaultNetFileReopenBackoff
+	}
+	max := f.MaxReopens
+	if max <= 0 {
+		max = DefaultNetFileMaxReopens
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !isStaleHandle(err) {
+			return err
+		}
+		if attempt >= max {
+			return &staleError{msg: fmt.Sprintf("%s: %s after %d reopens", f.Path, ErrStale, attempt), err: err}
+		}
+		log.Debugw("stale file handle; retrying", "path", f.Path, "attempt", attempt+1, "error", err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// isStaleHandle returns whether err is an error that network filesystems
+// return for file handles that went stale. EIO is not, as it's also returned
+// for e.g. media errors, which reopening doesn't fix.
+func isStaleHandle(err error) bool {
+	return errors.Is(err, syscall.ESTALE)
+}
+
+// staleError is an error that wraps ErrStale, and the error that caused the
+// mount to go stale.
+type staleError struct {
+	msg string
+	err error
+}
+
+func (e *staleError) Error() string {
+	return e.msg + ": " + e.err.Error()
+}
+
+func (e *staleError) Is(target error) bool {
+	return target == ErrStale
+}
+
+func (e *staleError) Unwrap() error {
+	return e.err
+}
+
+// netFileReader reads a NetFileMount, reopening the file when its handle goes
+// stale. Sequential reads are served from the tracked offset, so that they
+// resume where they left off after reopening.
+type netFileReader struct {
+	m *NetFileMount
+
+	lk     sync.RWMutex
+	file   netFile     // guarded by lk; replaced on reopen.
+	fi     os.FileInfo // info of the file first opened.
+	gen    int         // guarded by lk; incremented on reopen.
+	closed bool        // guarded by lk.
+
+	offLk  sync.Mutex
+	offset int64 // guarded by offLk; offset of sequential reads.
+}
+
+var _ Reader = (*netFileReader)(nil)
+
+func (r *netFileReader) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+	stale := -1 // generation of the handle that went stale, if any.
+	err := r.m.retry(context.Background(), func() error {
+		if stale >= 0 {
+			if err := r.reopen(stale); err != nil {
+				return r.reopenError(err)
+			}
+		}
+
+		r.lk.RLock()
+		file, gen, closed := r.file, r.gen, r.closed
+		if closed {
+			r.lk.RUnlock()
+			return os.ErrClosed
+		}
+		var err error
+		n, err = file.ReadAt(p, off)
+		r.lk.RUnlock()
+
+		if err != nil && isStaleHandle(err) {
+			stale = gen
+		}
+		return err
+	})
+	return n, err
+}
+
+func (r *netFileReader) Read(p []byte) (int, error) {
+	r.offLk.Lock()
+	defer r.offLk.Unlock()
+
+	n, err := r.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if errors.Is(err, io.EOF) && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *netFileReader) Seek(offset int64, whence int) (int64, error) {
+	r.offLk.Lock()
+	defer r.offLk.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.fi.Size()
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset: %d", offset)
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *netFileReader) Close() error {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	if r.closed {
+		return os.ErrClosed
+	}
+	r.closed = true
+	return r.file.Close()
+}
+
+// reopenError maps an error reopening the file to the error of the read:
+// stale handle errors are retried, whereas other errors, e.g. if the file was
+// removed, mean that the mount went stale.
+func (r *netFileReader) reopenError(err error) error {
+	if isStaleHandle(err) || errors.Is(err, ErrStale) || errors.Is(err, os.ErrClosed) {
+		return err
+	}
+	return &staleError{msg: fmt.Sprintf("%s: %s: failed to reopen", r.m.Path, ErrStale), err: err}
+}
+
+// reopen replaces the file handle of generation gen with a new one, unless a
+// concurrent read reopened it already. It fails with ErrStale if the file was
+// replaced, as its contents can no longer be trusted to match the shard.
+func (r *netFileReader) reopen(gen int) error {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	if r.closed {
+		return os.ErrClosed
+	}
+	if r.gen != gen {
+		return nil
+	}
+
+	file, fi, err := r.m.open()
+	if err != nil {
+		// keep the stale handle; the read is retried, reopening again.
+		return err
+	}
+	if fi.Size() != r.fi.Size() || !fi.ModTime().Equal(r.fi.ModTime()) {
+		_ = file.Close()
+		return fmt.Errorf("%s: %w: file changed since it was opened", r.m.Path, ErrStale)
+	}
+
+	_ = r.file.Close()
+	r.file = file
+	r.gen++
+	log.Infow("reopened stale file", "path", r.m.Path)
+	return nil
+}
@@ -0,0 +1,169 @@
+package mount
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// staleFile fails reads with errno while the shared failures counter is
+// positive, decrementing it.
+type staleFile struct {
+	*os.File
+	failures *int32
+	errno    syscall.Errno
+}
+
+func (f *staleFile) ReadAt(p []byte, off int64) (int, error) {
+	if atomic.AddInt32(f.failures, -1) >= 0 {
+		return 0, &os.PathError{Op: "read", Path: f.Name(), Err: f.errno}
+	}
+	return f.File.ReadAt(p, off)
+}
+
+// staleFiles makes the files opened by NetFileMounts fail the given number of
+// reads with ESTALE, returning the number of opens.
+func staleFiles(t *testing.T, failures int32) *int32 {
+	return failingFiles(t, failures, syscall.ESTALE)
+}
+
+// failingFiles makes the files opened by NetFileMounts fail the given number
+// of reads with errno, returning the number of opens.
+func failingFiles(t *testing.T, failures int32, errno syscall.Errno) *int32 {
+	var opens int32
+	prev := openNetFile
+	openNetFile = func(path string) (netFile, error) {
+		atomic.AddInt32(&opens, 1)
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		return &staleFile{File: f, failures: &failures, errno: errno}, nil
+	}
+	t.Cleanup(func() { openNetFile = prev })
+	return &opens
+}
+
+func writeRandomFile(t *testing.T, size int) (string, []byte) {
+	b := make([]byte, size)
+	_, err := rand.Read(b)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "data.car")
+	require.NoError(t, ioutil.WriteFile(path, b, 0644))
+	return path, b
+}
+
+func TestNetFileMount(t *testing.T) {
+	ctx := context.Background()
+	path, b := writeRandomFile(t, 1024)
+
+	mnt := &NetFileMount{Path: path}
+	stat, err := mnt.Stat(ctx)
+	require.NoError(t, err)
+	require.True(t, stat.Exists)
+	require.EqualValues(t, len(b), stat.Size)
+
+	rd, err := mnt.Fetch(ctx)
+	require.NoError(t, err)
+	defer rd.Close()
+
+	// sequential reads.
+	read, err := ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.Equal(t, b, read)
+
+	// random access.
+	buf := make([]byte, 100)
+	n, err := rd.ReadAt(buf, 500)
+	require.NoError(t, err)
+	require.Equal(t, 100, n)
+	require.Equal(t, b[500:600], buf)
+
+	// seeks.
+	off, err := rd.Seek(-24, io.SeekEnd)
+	require.NoError(t, err)
+	require.EqualValues(t, 1000, off)
+	read, err = ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.Equal(t, b[1000:], read)
+
+	// the URL round-trips.
+	var mnt2 NetFileMount
+	require.NoError(t, mnt2.Deserialize(mnt.Serialize()))
+	require.Equal(t, path, mnt2.Path)
+
+	// missing files don't exist.
+	stat, err = (&NetFileMount{Path: path + ".missing"}).Stat(ctx)
+	require.Error(t, err)
+	require.False(t, stat.Exists)
+}
+
+func TestNetFileMountStale(t *testing.T) {
+	ctx := context.Background()
+	path, b := writeRandomFile(t, 1024)
+	mnt := &NetFileMount{Path: path, MaxReopens: 3, ReopenBackoff: time.Millisecond}
+
+	t.Run("reopen", func(t *testing.T) {
+		opens := staleFiles(t, 2)
+		rd, err := mnt.Fetch(ctx)
+		require.NoError(t, err)
+		defer rd.Close()
+
+		// the read succeeds after reopening the file twice.
+		buf := make([]byte, 100)
+		_, err = rd.ReadAt(buf, 100)
+		require.NoError(t, err)
+		require.Equal(t, b[100:200], buf)
+		require.EqualValues(t, 3, atomic.LoadInt32(opens))
+	})
+
+	t.Run("persistent", func(t *testing.T) {
+		opens := staleFiles(t, 100)
+		rd, err := mnt.Fetch(ctx)
+		require.NoError(t, err)
+		defer rd.Close()
+
+		// the read fails with ErrStale once reopens are exhausted, wrapping
+		// the stale handle error.
+		_, err = rd.ReadAt(make([]byte, 100), 0)
+		require.ErrorIs(t, err, ErrStale)
+		require.ErrorIs(t, err, syscall.ESTALE)
+		require.EqualValues(t, 4, atomic.LoadInt32(opens))
+	})
+
+	t.Run("io error", func(t *testing.T) {
+		opens := failingFiles(t, 1, syscall.EIO)
+		rd, err := mnt.Fetch(ctx)
+		require.NoError(t, err)
+		defer rd.Close()
+
+		// I/O errors are returned as is, without reopening the file.
+		_, err = rd.ReadAt(make([]byte, 100), 0)
+		require.ErrorIs(t, err, syscall.EIO)
+		require.False(t, errors.Is(err, ErrStale))
+		require.EqualValues(t, 1, atomic.LoadInt32(opens))
+	})
+
+	t.Run("replaced", func(t *testing.T) {
+		staleFiles(t, 1)
+		rd, err := mnt.Fetch(ctx)
+		require.NoError(t, err)
+		defer rd.Close()
+
+		// the file is replaced with different contents while open.
+		require.NoError(t, ioutil.WriteFile(path, b[:512], 0644))
+
+		_, err = rd.ReadAt(make([]byte, 100), 0)
+		require.ErrorIs(t, err, ErrStale)
+	})
+}
@@ -0,0 +1,342 @@
+package mount
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RetryPolicy configures how requests to a remote object store are retried.
+// Requests are retried on network errors, on 429 (Too Many Requests) and on
+// 5xx responses, with exponential backoff between attempts.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts per request, including the
+	// first one. Zero or negative values mean a single attempt.
+	MaxAttempts int
+	// MinBackoff is the delay before the first retry. It doubles on every
+	// subsequent retry.
+	MinBackoff time.Duration
+	// MaxBackoff caps the delay between retries.
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy used by object store mounts that
+// don't configure one.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	MinBackoff:  200 * time.Millisecond,
+	MaxBackoff:  10 * time.Second,
+}
+
+// backoff returns the delay before the given retry, counting from 1.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.MinBackoff
+	for i := 1; i < retry && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+// errObjectNotFound is returned by objectClient when the object doesn't exist.
+var errObjectNotFound = errors.New("object not found")
+
+// objectClient performs retried HTTP requests against a single object in a
+// remote object store. Mounts supply a function that builds authenticated
+// requests.
+type objectClient struct {
+	client *http.Client
+	retry  RetryPolicy
+	// newRequest builds a request with the given method and, if non-empty, the
+	// given Range header.
+	newRequest func(ctx context.Context, method, rng string) (*http.Request, error)
+}
+
+func newObjectClient(client *http.Client, retry RetryPolicy, newRequest func(ctx context.Context, method, rng string) (*http.Request, error)) *objectClient {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if retry == (RetryPolicy{}) {
+		retry = DefaultRetryPolicy
+	}
+	return &objectClient{client: client, retry: retry, newRequest: newRequest}
+}
+
+// do performs a request, retrying it according to the retry policy. It
+// returns the response of the first successful attempt, errObjectNotFound on
+// 404, or the error of the last attempt.
+func (c *objectClient) do(ctx context.Context, method, rng string) (*http.Response, error) {
+	attempts := c.retry.MaxAttempts
+	if attempts <= 0 {
+		attempts = 1
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		var resp *http.Response
+		var retryAfter time.Duration
+		resp, retryAfter, err = c.attempt(ctx, method, rng)
+		if err == nil || attempt >= attempts || !isRetryable(err) {
+			return resp, err
+		}
+
+		wait := c.retry.backoff(attempt)
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		log.Debugw("retrying object store request", "method", method, "attempt", attempt, "wait", wait, "error", err)
+
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// statusError is an unexpected HTTP status returned by the object store.
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	if e.msg == "" {
+		return fmt.Sprintf("unexpected status %d", e.code)
+	}
+	return fmt.Sprintf("unexpected status %d: %s", e.code, e.msg)
+}
+
+// retryableError marks a transient failure that is worth retrying.
+type retryableError struct{ error }
+
+func (e retryableError) Unwrap() error { return e.error }
+
+func isRetryable(err error) bool {
+	var r retryableError
+	return errors.As(err, &r)
+}
+
+func (c *objectClient) attempt(ctx context.Context, method, rng string) (*http.Response, time.Duration, error) {
+	req, err := c.newRequest(ctx, method, rng)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		}
+		return nil, 0, retryableError{err}
+	}
+
+	switch code := resp.StatusCode; {
+	case code == http.StatusOK || code == http.StatusPartialContent:
+		return resp, 0, nil
+	case code == http.StatusNotFound:
+		resp.Body.Close()
+		return nil, 0, errObjectNotFound
+	default:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		err := &statusError{code: code, msg: string(msg)}
+		if code == http.StatusTooManyRequests || code >= 500 {
+			var after time.Duration
+			if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+				after = time.Duration(secs) * time.Second
+			}
+			return nil, after, retryableError{err}
+		}
+		return nil, 0, err
+	}
+}
+
+// stat issues a HEAD request for the object.
+func (c *objectClient) stat(ctx context.Context) (Stat, error) {
+	resp, err := c.do(ctx, http.MethodHead, "")
+	if errors.Is(err, errObjectNotFound) {
+		return Stat{}, nil
+	}
+	if err != nil {
+		return Stat{}, err
+	}
+	resp.Body.Close()
+	return Stat{
+		Exists:  true,
+		Size:    resp.ContentLength,
+		Ready:   true,
+		Version: resp.Header.Get("ETag"),
+	}, nil
+}
+
+// get fetches the bytes of the object from offset off, up to and including
+// offset end, or until the end of the object if end is negative.
+func (c *objectClient) get(ctx context.Context, off, end int64) (io.ReadCloser, error) {
+	var rng string
+	switch {
+	case end >= 0:
+		rng = fmt.Sprintf("bytes=%d-%d", off, end)
+	case off > 0:
+		rng = fmt.Sprintf("bytes=%d-", off)
+	}
+	resp, err := c.do(ctx, http.MethodGet, rng)
+	if err != nil {
+		return nil, err
+	}
+	if rng != "" && resp.StatusCode == http.StatusOK {
+		// the store ignored the range; skip to the requested offset.
+		if _, err := io.CopyN(io.Discard, resp.Body, off); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		if end >= 0 {
+			return struct {
+				io.Reader
+				io.Closer
+			}{io.LimitReader(resp.Body, end-off+1), resp.Body}, nil
+		}
+	}
+	return resp.Body, nil
+}
+
+// objectReader is a Reader over a remote object. Sequential reads stream the
+// object from the current offset, and resume with a ranged request if the
+// stream breaks. ReadAt issues a ranged request per call.
+type objectReader struct {
+	ctx    context.Context
+	client *objectClient
+	size   int64
+
+	// progress, if non-nil, is called with the bytes received by sequential
+	// reads.
+	progress    ProgressFunc
+	transferred int64 // guarded by lk
+
+	lk   sync.Mutex
+	off  int64
+	body io.ReadCloser
+}
+
+var _ Reader = (*objectReader)(nil)
+
+func newObjectReader(ctx context.Context, client *objectClient, progress ProgressFunc) (*objectReader, error) {
+	st, err := client.stat(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !st.Exists {
+		return nil, errObjectNotFound
+	}
+	return &objectReader{ctx: ctx, client: client, size: st.Size, progress: progress}, nil
+}
+
+func (r *objectReader) Read(p []byte) (int, error) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	attempts := r.client.retry.MaxAttempts
+	for attempt := 1; ; attempt++ {
+		if r.body == nil {
+			body, err := r.client.get(r.ctx, r.off, -1)
+			if err != nil {
+				return 0, err
+			}
+			r.body = body
+		}
+		n, err := r.body.Read(p)
+		r.off += int64(n)
+		if n > 0 && r.progress != nil {
+			r.transferred += int64(n)
+			r.progress(r.transferred, r.size)
+		}
+		if err == nil || (err == io.EOF && r.off >= r.size) {
+			return n, err
+		}
+
+		// the stream broke before the end of the object; resume it from the
+		// current offset.
+		r.body.Close()
+		r.body = nil
+		if n > 0 {
+			return n, nil
+		}
+		if attempt >= attempts || r.ctx.Err() != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		log.Debugw("resuming object stream", "offset", r.off, "error", err)
+	}
+}
+
+func (r *objectReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p)) - 1
+	if end >= r.size {
+		end = r.size - 1
+	}
+	body, err := r.client.get(r.ctx, off, end)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	n, err := io.ReadFull(body, p[:end-off+1])
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *objectReader) Seek(offset int64, whence int) (int64, error) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	var off int64
+	switch whence {
+	case io.SeekStart:
+		off = offset
+	case io.SeekCurrent:
+		off = r.off + offset
+	case io.SeekEnd:
+		off = r.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %d", off)
+	}
+	if off != r.off && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.off = off
+	return off, nil
+}
+
+func (r *objectReader) Close() error {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
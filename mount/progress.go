@@ -0,0 +1,65 @@
+package mount
+
+import (
+	"context"
+)
+
+// ProgressFunc is called as the bytes of a mount are transferred, with the
+// number of bytes transferred so far, and the total size of the asset, or 0 if
+// it's unknown.
+type ProgressFunc func(transferred, total int64)
+
+// FetcherWithProgress is an optional interface of mounts that report the
+// progress of their own transfers, e.g. the bytes received from a remote
+// store. Progress is reported as the returned Reader is read sequentially.
+//
+// Mounts that don't implement it are wrapped by FetchWithProgress, which
+// reports the bytes read from their readers instead.
+type FetcherWithProgress interface {
+	FetchWithProgress(ctx context.Context, progress ProgressFunc) (Reader, error)
+}
+
+// FetchWithProgress fetches the asset of a mount, calling progress, if
+// non-nil, as it's read sequentially. total is the size of the asset reported
+// to progress by mounts that don't implement FetcherWithProgress.
+//
+// Sequential reads of the returned Reader fail with the error of the context
+// once it's done, so that copies of the asset are interrupted promptly even
+// if the mount doesn't honour the context itself.
+func FetchWithProgress(ctx context.Context, mnt Mount, total int64, progress ProgressFunc) (Reader, error) {
+	if f, ok := mnt.(FetcherWithProgress); ok && progress != nil {
+		rd, err := f.FetchWithProgress(ctx, progress)
+		if err != nil {
+			return nil, err
+		}
+		return &progressReader{Reader: rd, ctx: ctx}, nil
+	}
+	rd, err := mnt.Fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &progressReader{Reader: rd, ctx: ctx, total: total, progress: progress}, nil
+}
+
+// progressReader is a Reader that reports the bytes read sequentially to a
+// ProgressFunc, if any, and stops reading once its context is done.
+type progressReader struct {
+	Reader
+	ctx context.Context
+
+	total       int64
+	transferred int64
+	progress    ProgressFunc
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	if err := p.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := p.Reader.Read(b)
+	if n > 0 && p.progress != nil {
+		p.transferred += int64(n)
+		p.progress(p.transferred, p.total)
+	}
+	return n, err
+}
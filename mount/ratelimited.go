@@ -0,0 +1,146 @@
+package mount
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// RateLimitedMount is a mount that proxies to another mount, throttling the
+// bytes read through Fetch readers with a token bucket. All readers fetched
+// from the same RateLimitedMount share the bucket.
+//
+// It can be used to keep background operations, such as initializations,
+// from saturating the network or a shared storage backend.
+type RateLimitedMount struct {
+	Mount
+
+	// BytesPerSec is the sustained rate at which bytes can be read. Zero or
+	// negative values disable throttling.
+	BytesPerSec int64
+	// Burst is the maximum number of bytes that can be read at once. It
+	// defaults to BytesPerSec.
+	Burst int64
+
+	once   sync.Once
+	bucket *tokenBucket
+}
+
+var _ Mount = (*RateLimitedMount)(nil)
+
+// RateLimited wraps the inner mount so that reads are limited to bytesPerSec,
+// with bursts of up to burst bytes.
+func RateLimited(inner Mount, bytesPerSec, burst int64) *RateLimitedMount {
+	return &RateLimitedMount{
+		Mount:       inner,
+		BytesPerSec: bytesPerSec,
+		Burst:       burst,
+	}
+}
+
+func (r *RateLimitedMount) Fetch(ctx context.Context) (Reader, error) {
+	rd, err := r.Mount.Fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if r.BytesPerSec <= 0 {
+		return rd, nil
+	}
+	r.once.Do(func() {
+		burst := r.Burst
+		if burst <= 0 {
+			burst = r.BytesPerSec
+		}
+		r.bucket = newTokenBucket(r.BytesPerSec, burst)
+	})
+	return &rateLimitedReader{Reader: rd, bucket: r.bucket}, nil
+}
+
+// Deserialize deserializes the inner mount. The inner mount is cloned first,
+// as the receiver may have been cloned from a registry template that shares
+// it.
+func (r *RateLimitedMount) Deserialize(u *url.URL) error {
+	r.Mount = clone(r.Mount)
+	return r.Mount.Deserialize(u)
+}
+
+// rateLimitedReader is a Reader that takes tokens from a bucket before every
+// read, splitting reads larger than the burst.
+type rateLimitedReader struct {
+	Reader
+	bucket *tokenBucket
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if max := r.bucket.burst; int64(len(p)) > max {
+		p = p[:max]
+	}
+	r.bucket.wait(int64(len(p)))
+	return r.Reader.Read(p)
+}
+
+func (r *rateLimitedReader) ReadAt(p []byte, off int64) (int, error) {
+	var total int
+	for len(p) > 0 {
+		chunk := p
+		if max := r.bucket.burst; int64(len(chunk)) > max {
+			chunk = chunk[:max]
+		}
+		r.bucket.wait(int64(len(chunk)))
+		n, err := r.Reader.ReadAt(chunk, off)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		p, off = p[n:], off+int64(n)
+	}
+	return total, nil
+}
+
+// tokenBucket is a token bucket holding up to burst tokens, refilled at rate
+// tokens per second.
+type tokenBucket struct {
+	rate  int64
+	burst int64
+
+	lk     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst int64) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n tokens from the bucket, allowing it to go into debt, and
+// returns how long the caller must wait until the debt is repaid.
+func (b *tokenBucket) reserve(n int64) time.Duration {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+	if b.tokens > float64(b.burst) {
+		b.tokens = float64(b.burst)
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+}
+
+// wait takes n tokens from the bucket, blocking until they're available.
+func (b *tokenBucket) wait(n int64) {
+	if d := b.reserve(n); d > 0 {
+		time.Sleep(d)
+	}
+}
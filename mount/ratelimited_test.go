@@ -0,0 +1,84 @@
+package mount
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimited(t *testing.T) {
+	data := make([]byte, 64<<10)
+	rand.Read(data)
+
+	// 256KiB/s with a 16KiB burst; reading 64KiB takes at least 3/16s.
+	const minElapsed = 150 * time.Millisecond
+	m := RateLimited(&BytesMount{Bytes: data}, 256<<10, 16<<10)
+
+	t.Run("read", func(t *testing.T) {
+		rd, err := m.Fetch(context.Background())
+		require.NoError(t, err)
+		defer rd.Close()
+
+		start := time.Now()
+		read, err := ioutil.ReadAll(rd)
+		require.NoError(t, err)
+		require.Equal(t, data, read)
+		require.GreaterOrEqual(t, int64(time.Since(start)), int64(minElapsed))
+	})
+
+	t.Run("read at", func(t *testing.T) {
+		rd, err := m.Fetch(context.Background())
+		require.NoError(t, err)
+		defer rd.Close()
+
+		start := time.Now()
+		read := make([]byte, len(data))
+		n, err := rd.ReadAt(read, 0)
+		require.NoError(t, err)
+		require.Equal(t, len(data), n)
+		require.Equal(t, data, read)
+		require.GreaterOrEqual(t, int64(time.Since(start)), int64(minElapsed))
+
+		// reads past the end still report EOF.
+		_, err = rd.ReadAt(make([]byte, 16), int64(len(data)-8))
+		require.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("unlimited", func(t *testing.T) {
+		rd, err := RateLimited(&BytesMount{Bytes: data}, 0, 0).Fetch(context.Background())
+		require.NoError(t, err)
+		defer rd.Close()
+
+		start := time.Now()
+		read, err := ioutil.ReadAll(rd)
+		require.NoError(t, err)
+		require.Equal(t, data, read)
+		require.Less(t, int64(time.Since(start)), int64(minElapsed))
+	})
+}
+
+func TestRateLimitedRegistry(t *testing.T) {
+	r := NewRegistry()
+	err := r.Register("ratelimited", RateLimited(&BytesMount{}, 1<<20, 0))
+	require.NoError(t, err)
+
+	u, err := r.Represent(RateLimited(&BytesMount{Bytes: []byte("hello")}, 1<<20, 0))
+	require.NoError(t, err)
+	require.Equal(t, "ratelimited", u.Scheme)
+
+	m, err := r.Instantiate(u)
+	require.NoError(t, err)
+	require.IsType(t, (*RateLimitedMount)(nil), m)
+	require.Equal(t, int64(1<<20), m.(*RateLimitedMount).BytesPerSec)
+	require.Equal(t, []byte("hello"), m.(*RateLimitedMount).Mount.(*BytesMount).Bytes)
+
+	// instantiating must not have altered the template.
+	m2, err := r.Instantiate(u)
+	require.NoError(t, err)
+	require.NotSame(t, m.(*RateLimitedMount).Mount, m2.(*RateLimitedMount).Mount)
+}
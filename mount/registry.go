@@ -18,16 +18,29 @@ var (
 	ErrUnrecognizedType = errors.New("unrecognized mount type")
 )
 
+// ConfigureFunc configures a mount instantiated by the Registry, after it's
+// deserialized from its URL. See Registry.Configure.
+type ConfigureFunc func(m Mount) error
+
 // Registry is a registry of Mount factories known to the DAG store.
 type Registry struct {
-	lk       sync.RWMutex
-	byScheme map[string]Mount
-	byType   map[reflect.Type]string
+	lk          sync.RWMutex
+	byScheme    map[string]Mount
+	byType      map[reflect.Type]string
+	byPlugin    map[*ExecPlugin]string
+	configurers map[string]ConfigureFunc
+	middlewares map[string][]Middleware
 }
 
 // NewRegistry constructs a blank registry.
 func NewRegistry() *Registry {
-	return &Registry{byScheme: map[string]Mount{}, byType: map[reflect.Type]string{}}
+	return &Registry{
+		byScheme:    map[string]Mount{},
+		byType:      map[reflect.Type]string{},
+		byPlugin:    map[*ExecPlugin]string{},
+		configurers: map[string]ConfigureFunc{},
+		middlewares: map[string][]Middleware{},
+	}
 }
 
 // Register adds a new mount type to the registry under the specified scheme.
@@ -53,19 +66,110 @@ func (r *Registry) Register(scheme string, template Mount) error {
 	return nil
 }
 
+// RegisterPlugin adds a new mount type implemented by an external program to
+// the registry under the specified scheme. Unlike Register, it can be called
+// for several plugins, as ExecMounts are told apart by their plugin.
+//
+// Mounts are instantiated as ExecMounts backed by the plugin; the application
+// creates new ones with the same plugin pointer.
+func (r *Registry) RegisterPlugin(scheme string, plugin *ExecPlugin) error {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	if _, ok := r.byScheme[scheme]; ok {
+		return fmt.Errorf("mount already registered for scheme: %s", scheme)
+	}
+
+	if _, ok := r.byPlugin[plugin]; ok {
+		return fmt.Errorf("plugin already registered: %s", plugin.Command)
+	}
+
+	r.byScheme[scheme] = &ExecMount{Plugin: plugin}
+	r.byPlugin[plugin] = scheme
+	return nil
+}
+
+// Configure sets the function that configures every mount instantiated for
+// the specified scheme, replacing the previous one, if any. Passing nil
+// removes it.
+//
+// Unlike the environmental configuration carried over from templates, which
+// is fixed at registration, the function runs for each instance, after
+// it's deserialized. It's meant to inject configuration that's only known at
+// runtime or changes over time, such as live credentials, tuned HTTP clients,
+// throttling rates or temporary directories, into mounts instantiated from
+// persisted URLs, e.g. when the DAG store restarts.
+func (r *Registry) Configure(scheme string, fn ConfigureFunc) error {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	if _, ok := r.byScheme[scheme]; !ok {
+		return fmt.Errorf("%w: %s", ErrUnrecognizedScheme, scheme)
+	}
+	if fn == nil {
+		delete(r.configurers, scheme)
+		return nil
+	}
+	r.configurers[scheme] = fn
+	return nil
+}
+
+// Use appends middlewares to those that wrap every mount of the specified
+// scheme, whether instantiated by the registry, or passed to Apply, e.g. by
+// the DAG store when registering shards. The first middleware is the
+// outermost, as in Chain.
+//
+// Wrapped mounts are represented as the mounts they wrap, so middlewares can
+// be added or removed across restarts.
+func (r *Registry) Use(scheme string, mws ...Middleware) error {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	if _, ok := r.byScheme[scheme]; !ok {
+		return fmt.Errorf("%w: %s", ErrUnrecognizedScheme, scheme)
+	}
+	r.middlewares[scheme] = append(r.middlewares[scheme], mws...)
+	return nil
+}
+
+// Apply wraps a mount with the middlewares of its scheme (see Use). Mounts
+// whose type isn't registered, and mounts already wrapped, are returned as
+// they are.
+func (r *Registry) Apply(mount Mount) Mount {
+	if _, ok := mount.(Wrapper); ok {
+		return mount
+	}
+
+	r.lk.RLock()
+	var scheme string
+	if em, isExec := mount.(*ExecMount); isExec {
+		scheme = r.byPlugin[em.Plugin]
+	} else {
+		scheme = r.byType[reflect.TypeOf(mount)]
+	}
+	mws := r.middlewares[scheme]
+	r.lk.RUnlock()
+
+	return Chain(mount, mws...)
+}
+
 // Instantiate instantiates a new Mount from a URL.
 //
 // It looks up the Mount template in the registry based on the URL scheme,
 // creates a copy, and calls Deserialize() on it with the supplied URL before
-// returning.
+// returning. If a ConfigureFunc was set for the scheme, it's then called on
+// the new instance, which is finally wrapped with the middlewares of the
+// scheme, if any.
 //
-// It propagates any error returned by the Mount#Deserialize method.
-// If the scheme is not recognized, it returns ErrUnrecognizedScheme.
+// It propagates any error returned by the Mount#Deserialize method or the
+// ConfigureFunc. If the scheme is not recognized, it returns
+// ErrUnrecognizedScheme.
 func (r *Registry) Instantiate(u *url.URL) (Mount, error) {
 	r.lk.RLock()
-	defer r.lk.RUnlock()
-
 	template, ok := r.byScheme[u.Scheme]
+	configure := r.configurers[u.Scheme]
+	r.lk.RUnlock()
+
 	if !ok {
 		return nil, fmt.Errorf("%w: %s", ErrUnrecognizedScheme, u.Scheme)
 	}
@@ -74,7 +178,13 @@ func (r *Registry) Instantiate(u *url.URL) (Mount, error) {
 	if err := instance.Deserialize(u); err != nil {
 		return nil, fmt.Errorf("failed to instantiate mount with url %s into type %T: %w", u.String(), template, err)
 	}
-	return instance, nil
+	if configure != nil {
+		// called outside the lock, as it's application code.
+		if err := configure(instance); err != nil {
+			return nil, fmt.Errorf("failed to configure mount with url %s: %w", u.String(), err)
+		}
+	}
+	return r.Apply(instance), nil
 }
 
 // Represent returns the URL representation of a Mount, using the scheme that
@@ -83,12 +193,19 @@ func (r *Registry) Represent(mount Mount) (*url.URL, error) {
 	r.lk.RLock()
 	defer r.lk.RUnlock()
 
-	// special-case the upgrader, as it's transparent.
+	// special-case the upgrader, as it's transparent, and so are wrappers.
 	if up, ok := mount.(*Upgrader); ok {
 		mount = up.underlying
 	}
-
-	scheme, ok := r.byType[reflect.TypeOf(mount)]
+	mount = Unwrap(mount)
+
+	var scheme string
+	var ok bool
+	if em, isExec := mount.(*ExecMount); isExec {
+		scheme, ok = r.byPlugin[em.Plugin]
+	} else {
+		scheme, ok = r.byType[reflect.TypeOf(mount)]
+	}
 	if !ok {
 		return nil, fmt.Errorf("failed to represent mount with type %T: %w", mount, ErrUnrecognizedType)
 	}
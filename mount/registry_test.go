@@ -135,6 +135,43 @@ func TestRegistryHonoursTemplate(t *testing.T) {
 	require.Equal(t, "give me proof", m.(*MockMount).Templated)
 }
 
+func TestRegistryConfigure(t *testing.T) {
+	r := NewRegistry()
+	require.NoError(t, r.Register("foo", &MockMount{Templated: "template"}))
+	require.ErrorIs(t, r.Configure("bar", func(Mount) error { return nil }), ErrUnrecognizedScheme)
+
+	u, err := url.Parse("foo://bang?size=100&timestwo=false")
+	require.NoError(t, err)
+
+	// the configurer runs on every instance, after deserialization, picking
+	// up the current configuration.
+	live := "creds-1"
+	require.NoError(t, r.Configure("foo", func(m Mount) error {
+		mm := m.(*MockMount)
+		mm.Templated = live + "@" + mm.Val
+		return nil
+	}))
+	m, err := r.Instantiate(u)
+	require.NoError(t, err)
+	require.Equal(t, "creds-1@bang", m.(*MockMount).Templated)
+
+	live = "creds-2"
+	m, err = r.Instantiate(u)
+	require.NoError(t, err)
+	require.Equal(t, "creds-2@bang", m.(*MockMount).Templated)
+
+	// errors are propagated.
+	require.NoError(t, r.Configure("foo", func(Mount) error { return fmt.Errorf("no creds") }))
+	_, err = r.Instantiate(u)
+	require.ErrorContains(t, err, "no creds")
+
+	// removing the configurer restores the template.
+	require.NoError(t, r.Configure("foo", nil))
+	m, err = r.Instantiate(u)
+	require.NoError(t, err)
+	require.Equal(t, "template", m.(*MockMount).Templated)
+}
+
 func TestRegistryRecognizedType(t *testing.T) {
 	type (
 		MockMount1 struct{ MockMount }
@@ -0,0 +1,255 @@
+package mount
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// SharedTransients deduplicates transient copies across Upgraders whose
+// underlying mounts refer to the same object (i.e. same mount type and URL
+// representation), even if they belong to shards with different keys. If the
+// mounts report the version of the object (see Stat.Version), different
+// versions of it get different transients.
+//
+// Each shared transient is refcounted: every Upgrader holding it counts as a
+// reference, and the file is only removed from disk when the last reference
+// is released. Concurrent fetches of the same object are coalesced into a
+// single fetch of the underlying mount.
+type SharedTransients struct {
+	rootdir string
+
+	lk      sync.Mutex
+	entries map[sharedKey]*sharedTransient // guarded by lk
+}
+
+// sharedKey identifies a shared transient.
+type sharedKey struct {
+	// object identifies the object behind the mount; see sharedID.
+	object string
+	// version is the digest of the version of the object, if known; see
+	// versionDigest.
+	version string
+}
+
+// name returns the name of the transient file for the key, without suffix.
+func (k sharedKey) name() string {
+	h := sha256.Sum256([]byte(k.object))
+	name := "transient-shared-" + hex.EncodeToString(h[:])
+	if k.version != "" {
+		name += "-" + k.version
+	}
+	return name
+}
+
+type sharedTransient struct {
+	pathComplete string
+	pathPartial  string
+
+	refs  int
+	ready bool
+	fetch *sharedFetch // non-nil while a fetch is in progress.
+}
+
+// sharedFetch tracks an in-progress fetch; err is written before done is
+// closed, and only read after.
+type sharedFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// NewSharedTransients creates a new SharedTransients that places shared
+// transient files under rootdir.
+func NewSharedTransients(rootdir string) *SharedTransients {
+	if rootdir == "" {
+		rootdir = os.TempDir() // use the OS' default temp dir.
+	}
+	return &SharedTransients{rootdir: rootdir, entries: make(map[sharedKey]*sharedTransient)}
+}
+
+// sharedID derives the identity of the object behind a mount, used to key
+// shared transients.
+func sharedID(m Mount) string {
+	m = Unwrap(m)
+	u := m.Serialize()
+	return fmt.Sprintf("%T|%s", m, u.String())
+}
+
+// versionDigest derives the version component of a sharedKey from the
+// version of an object reported by its mount (e.g. an ETag), so that it can
+// be part of a file name.
+func versionDigest(version string) string {
+	if version == "" {
+		return ""
+	}
+	h := sha256.Sum256([]byte(version))
+	return hex.EncodeToString(h[:8])
+}
+
+// entry returns the entry for the given key, creating it if necessary. It
+// must be called with the lock held.
+func (s *SharedTransients) entry(k sharedKey) *sharedTransient {
+	e, ok := s.entries[k]
+	if !ok {
+		name := k.name()
+		e = &sharedTransient{
+			pathComplete: filepath.Join(s.rootdir, name+".complete"),
+			pathPartial:  filepath.Join(s.rootdir, name+".partial"),
+		}
+		s.entries[k] = e
+	}
+	return e
+}
+
+// adopt registers an existing transient at path as held by a new reference
+// to a version of object, and returns its key. It returns false if path is
+// not a shared transient for object (e.g. it's a transient provided by the
+// user).
+func (s *SharedTransients) adopt(object string, path string) (sharedKey, bool) {
+	k := sharedKey{object: object}
+	if filepath.Dir(path) != filepath.Clean(s.rootdir) {
+		return k, false
+	}
+	// the version digest, if any, is recovered from the file name.
+	name := strings.TrimSuffix(filepath.Base(path), ".complete")
+	switch rest := strings.TrimPrefix(name, k.name()); {
+	case rest == "":
+	case strings.HasPrefix(rest, "-") && len(rest) > 1:
+		k.version = rest[1:]
+	default:
+		return sharedKey{object: object}, false
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	e := s.entry(k)
+	if e.pathComplete != path {
+		if e.refs == 0 && e.fetch == nil {
+			delete(s.entries, k)
+		}
+		return sharedKey{object: object}, false
+	}
+	e.ready = true
+	e.refs++
+	return k, true
+}
+
+// acquire returns the path of the shared transient for k, adding a
+// reference to it. If the transient doesn't exist yet, it is fetched through
+// the supplied function; concurrent callers wait for the same fetch to
+// complete.
+func (s *SharedTransients) acquire(ctx context.Context, k sharedKey, fetch func(ctx context.Context, into *os.File) error) (string, error) {
+	for {
+		s.lk.Lock()
+		e := s.entry(k)
+		if e.ready {
+			if _, err := os.Stat(e.pathComplete); err == nil {
+				e.refs++
+				s.lk.Unlock()
+				return e.pathComplete, nil
+			}
+			// the shared transient is gone; refetch it.
+			e.ready = false
+		}
+
+		f := e.fetch
+		leader := f == nil
+		if leader {
+			f = &sharedFetch{done: make(chan struct{})}
+			e.fetch = f
+		}
+		s.lk.Unlock()
+
+		if leader {
+			f.err = s.doFetch(ctx, e, fetch)
+			s.lk.Lock()
+			e.fetch = nil
+			e.ready = f.err == nil
+			if f.err != nil && e.refs == 0 {
+				delete(s.entries, k)
+			}
+			s.lk.Unlock()
+			close(f.done)
+		} else {
+			select {
+			case <-f.done:
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		}
+
+		if f.err != nil {
+			return "", f.err
+		}
+		// loop around to take the reference under the lock, verifying that
+		// the transient is still alive.
+	}
+}
+
+func (s *SharedTransients) doFetch(ctx context.Context, e *sharedTransient, fetch func(ctx context.Context, into *os.File) error) error {
+	partial, err := os.Create(e.pathPartial)
+	if err != nil {
+		return err
+	}
+	defer partial.Close()
+
+	if err := fetch(ctx, partial); err != nil {
+		if err := os.Remove(e.pathPartial); err != nil {
+			log.Warnw("failed to remove partial shared transient", "path", e.pathPartial, "error", err)
+		}
+		return err
+	}
+	if err := os.Rename(e.pathPartial, e.pathComplete); err != nil {
+		return fmt.Errorf("failed to rename partial shared transient: %w", err)
+	}
+	return nil
+}
+
+// release drops a reference to the shared transient for k, removing the file
+// when the last reference is gone.
+func (s *SharedTransients) release(k sharedKey) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	e, ok := s.entries[k]
+	if !ok || e.refs == 0 {
+		return nil
+	}
+	e.refs--
+	if e.refs > 0 {
+		log.Debugw("shared transient still referenced; not removing", "path", e.pathComplete, "refs", e.refs)
+		return nil
+	}
+
+	e.ready = false
+	if e.fetch == nil {
+		delete(s.entries, k)
+	}
+	return os.Remove(e.pathComplete)
+}
+
+// Refs returns the number of references to the shared transients for the
+// object behind the supplied mount, across all its versions.
+func (s *SharedTransients) Refs(m Mount) int {
+	if u, ok := m.(*Upgrader); ok {
+		m = u.underlying
+	}
+	object := sharedID(m)
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	var refs int
+	for k, e := range s.entries {
+		if k.object == object {
+			refs += e.refs
+		}
+	}
+	return refs
+}
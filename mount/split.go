@@ -0,0 +1,354 @@
+package mount
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// SplitScheme is the URL scheme under which applications conventionally
+// register SplitMount templates.
+const SplitScheme = "split"
+
+// maxManifestSize caps the size of the manifests read by SplitMount.
+const maxManifestSize = 16 << 20
+
+// SplitManifest lists the parts that a CAR is split into, in order. It's
+// stored as JSON, alongside the parts.
+type SplitManifest struct {
+	Parts []SplitPart `json:"parts"`
+}
+
+// SplitPart is a part of a split CAR.
+type SplitPart struct {
+	// URL is the URL of the mount of the part.
+	URL string `json:"url"`
+	// Size is the size of the part.
+	Size int64 `json:"size"`
+}
+
+// SplitMount is a mount that reassembles a CAR from the parts listed in a
+// manifest (see SplitManifest), e.g. to store very large shards in object
+// stores that limit the size of objects. Both the manifest and the parts are
+// mounts themselves, instantiated from their URLs through the registry.
+//
+// Parts are fetched lazily, as reads reach them. Reads that span part
+// boundaries are split across parts, so readers support random access if the
+// readers of the parts do. Like object store mounts, the mount only reports
+// sequential and seekable access, so that the Upgrader persists the
+// reassembled CAR as a transient.
+//
+// Applications register a template carrying the registry (typically under
+// SplitScheme), and instances take the manifest URL from the mount URL.
+//
+// Manifests may come from remote storage, so the parts they list are confined
+// to the scheme of the manifest, unless PartSchemes says otherwise; a manifest
+// can't point the mount at e.g. local files.
+type SplitMount struct {
+	// Registry instantiates the mounts of the manifest and the parts.
+	Registry *Registry
+
+	// PartSchemes, if set, lists the URL schemes that parts may have. If
+	// empty, parts must have the scheme of the manifest.
+	PartSchemes []string
+
+	// Manifest is the URL of the mount of the manifest.
+	Manifest *url.URL
+}
+
+var _ Mount = (*SplitMount)(nil)
+
+func (s *SplitMount) Fetch(ctx context.Context) (Reader, error) {
+	m, err := s.manifest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r := &splitReader{ctx: ctx, parts: make([]*splitPart, 0, len(m.Parts))}
+	for i, p := range m.Parts {
+		u, err := url.Parse(p.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL of part %d: %w", i, err)
+		}
+		if !s.partScheme(u.Scheme) {
+			return nil, fmt.Errorf("scheme of part %d not allowed: %q", i, u.Scheme)
+		}
+		mnt, err := s.Registry.Instantiate(u)
+		if err != nil {
+			return nil, fmt.Errorf("failed to instantiate mount of part %d: %w", i, err)
+		}
+		r.parts = append(r.parts, &splitPart{mnt: mnt, start: r.size, size: p.Size})
+		r.size += p.Size
+	}
+	return r, nil
+}
+
+// partScheme returns whether parts may have the given scheme.
+func (s *SplitMount) partScheme(scheme string) bool {
+	if len(s.PartSchemes) == 0 {
+		return scheme == s.Manifest.Scheme
+	}
+	for _, allowed := range s.PartSchemes {
+		if scheme == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// manifest fetches and validates the manifest.
+func (s *SplitMount) manifest(ctx context.Context) (*SplitManifest, error) {
+	if s.Manifest == nil {
+		return nil, fmt.Errorf("missing manifest")
+	}
+	mnt, err := s.Registry.Instantiate(s.Manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to instantiate mount of manifest: %w", err)
+	}
+	defer mnt.Close()
+
+	rd, err := mnt.Fetch(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+	defer rd.Close()
+
+	bz, err := io.ReadAll(io.LimitReader(rd, maxManifestSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if len(bz) > maxManifestSize {
+		return nil, fmt.Errorf("manifest exceeds %d bytes", maxManifestSize)
+	}
+	var m SplitManifest
+	if err := json.Unmarshal(bz, &m); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	if len(m.Parts) == 0 {
+		return nil, fmt.Errorf("manifest lists no parts")
+	}
+	for i, p := range m.Parts {
+		if p.Size <= 0 {
+			return nil, fmt.Errorf("invalid size of part %d: %d", i, p.Size)
+		}
+	}
+	return &m, nil
+}
+
+func (s *SplitMount) Info() Info {
+	return Info{
+		Kind:             KindRemote,
+		AccessSequential: true,
+		AccessSeek:       true,
+	}
+}
+
+func (s *SplitMount) Stat(ctx context.Context) (Stat, error) {
+	if s.Manifest == nil {
+		return Stat{}, fmt.Errorf("missing manifest")
+	}
+	mnt, err := s.Registry.Instantiate(s.Manifest)
+	if err != nil {
+		return Stat{}, fmt.Errorf("failed to instantiate mount of manifest: %w", err)
+	}
+	st, err := mnt.Stat(ctx)
+	_ = mnt.Close()
+	if err != nil || !st.Exists {
+		return Stat{}, err
+	}
+
+	m, err := s.manifest(ctx)
+	if err != nil {
+		return Stat{}, err
+	}
+	var size int64
+	for _, p := range m.Parts {
+		size += p.Size
+	}
+	return Stat{
+		Exists: true,
+		Size:   size,
+		Ready:  true,
+	}, nil
+}
+
+func (s *SplitMount) Serialize() *url.URL {
+	u := new(url.URL)
+	if s.Manifest != nil {
+		q := u.Query()
+		q.Set("manifest", s.Manifest.String())
+		u.RawQuery = q.Encode()
+	}
+	return u
+}
+
+func (s *SplitMount) Deserialize(u *url.URL) error {
+	m := u.Query().Get("manifest")
+	if m == "" {
+		return fmt.Errorf("missing manifest")
+	}
+	mu, err := url.Parse(m)
+	if err != nil {
+		return fmt.Errorf("invalid manifest URL: %w", err)
+	}
+	s.Manifest = mu
+	return nil
+}
+
+func (s *SplitMount) Close() error {
+	return nil
+}
+
+// splitPart is a part of a splitReader, fetched on first access.
+type splitPart struct {
+	mnt   Mount
+	start int64 // offset of the part within the CAR.
+	size  int64
+
+	lk sync.Mutex
+	rd Reader // guarded by lk.
+}
+
+// reader returns the reader of the part, fetching it if necessary.
+func (p *splitPart) reader(ctx context.Context) (Reader, error) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	if p.rd == nil {
+		rd, err := p.mnt.Fetch(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch part at offset %d: %w", p.start, err)
+		}
+		p.rd = rd
+	}
+	return p.rd, nil
+}
+
+// splitReader is a Reader over the concatenation of parts.
+type splitReader struct {
+	ctx   context.Context
+	parts []*splitPart
+	size  int64
+
+	lk  sync.Mutex
+	off int64 // guarded by lk; offset of sequential reads.
+}
+
+var _ Reader = (*splitReader)(nil)
+
+// part returns the index of the part holding the byte at offset off, which
+// must be lower than the size.
+func (r *splitReader) part(off int64) int {
+	return sort.Search(len(r.parts), func(i int) bool {
+		return r.parts[i].start+r.parts[i].size > off
+	})
+}
+
+func (r *splitReader) Read(p []byte) (int, error) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	part := r.parts[r.part(r.off)]
+	rel := r.off - part.start
+	if rem := part.size - rel; int64(len(p)) > rem {
+		p = p[:rem]
+	}
+	rd, err := part.reader(r.ctx)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := rd.Seek(rel, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("failed to seek part at offset %d: %w", part.start, err)
+	}
+	n, err := rd.Read(p)
+	r.off += int64(n)
+	if err == io.EOF {
+		// more parts may follow; a part shorter than listed in the
+		// manifest is an error.
+		err = nil
+		if n == 0 {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
+
+func (r *splitReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %d", off)
+	}
+	var total int
+	for len(p) > 0 {
+		if off >= r.size {
+			return total, io.EOF
+		}
+		part := r.parts[r.part(off)]
+		rel := off - part.start
+		chunk := p
+		if rem := part.size - rel; int64(len(chunk)) > rem {
+			chunk = chunk[:rem]
+		}
+		rd, err := part.reader(r.ctx)
+		if err != nil {
+			return total, err
+		}
+		n, err := rd.ReadAt(chunk, rel)
+		total += n
+		if err != nil && !(errors.Is(err, io.EOF) && n == len(chunk)) {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return total, err
+		}
+		p, off = p[n:], off+int64(n)
+	}
+	return total, nil
+}
+
+func (r *splitReader) Seek(offset int64, whence int) (int64, error) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	var off int64
+	switch whence {
+	case io.SeekStart:
+		off = offset
+	case io.SeekCurrent:
+		off = r.off + offset
+	case io.SeekEnd:
+		off = r.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %d", off)
+	}
+	r.off = off
+	return off, nil
+}
+
+// Close closes the readers of the parts fetched, as well as their mounts.
+func (r *splitReader) Close() error {
+	var err error
+	for _, p := range r.parts {
+		p.lk.Lock()
+		if p.rd != nil {
+			if cerr := p.rd.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+			p.rd = nil
+		}
+		p.lk.Unlock()
+		if cerr := p.mnt.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
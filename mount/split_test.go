@@ -0,0 +1,131 @@
+package mount
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/url"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitMount(t *testing.T) {
+	ctx := context.Background()
+	data := make([]byte, 10<<10)
+	rand.Read(data)
+
+	// split the data into parts of 3KiB, and list them in a manifest.
+	fsys := fstest.MapFS{}
+	var m SplitManifest
+	for i, off := 0, 0; off < len(data); i, off = i+1, off+3<<10 {
+		end := off + 3<<10
+		if end > len(data) {
+			end = len(data)
+		}
+		name := fmt.Sprintf("part%d", i)
+		fsys[name] = &fstest.MapFile{Data: data[off:end]}
+		m.Parts = append(m.Parts, SplitPart{URL: "fs://" + name + "?path=" + name, Size: int64(end - off)})
+	}
+	bz, err := json.Marshal(m)
+	require.NoError(t, err)
+	fsys["manifest.json"] = &fstest.MapFile{Data: bz}
+
+	r := NewRegistry()
+	require.NoError(t, r.Register("fs", &FSMount{FS: fsys}))
+	require.NoError(t, r.Register(SplitScheme, &SplitMount{Registry: r}))
+
+	u, err := url.Parse("split://?manifest=" + url.QueryEscape("fs://manifest.json?path=manifest.json"))
+	require.NoError(t, err)
+	mnt, err := r.Instantiate(u)
+	require.NoError(t, err)
+
+	// the mount survives a round trip through its URL.
+	u2, err := r.Represent(mnt)
+	require.NoError(t, err)
+	mnt, err = r.Instantiate(u2)
+	require.NoError(t, err)
+
+	st, err := mnt.Stat(ctx)
+	require.NoError(t, err)
+	require.True(t, st.Exists)
+	require.EqualValues(t, len(data), st.Size)
+
+	rd, err := mnt.Fetch(ctx)
+	require.NoError(t, err)
+	defer rd.Close()
+
+	read, err := ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.Equal(t, data, read)
+
+	// ranged reads across part boundaries.
+	buf := make([]byte, 7<<10)
+	n, err := rd.ReadAt(buf, 2<<10)
+	require.NoError(t, err)
+	require.Equal(t, len(buf), n)
+	require.Equal(t, data[2<<10:9<<10], buf)
+
+	n, err = rd.ReadAt(buf, 5<<10)
+	require.ErrorIs(t, err, io.EOF)
+	require.Equal(t, 5<<10, n)
+	require.Equal(t, data[5<<10:], buf[:n])
+
+	// sequential reads after seeking.
+	off, err := rd.Seek(-4<<10, io.SeekEnd)
+	require.NoError(t, err)
+	require.EqualValues(t, 6<<10, off)
+	read, err = ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.Equal(t, data[6<<10:], read)
+
+	t.Run("short part", func(t *testing.T) {
+		short := m
+		short.Parts = append([]SplitPart(nil), m.Parts...)
+		short.Parts[0].Size++
+		bz, err := json.Marshal(short)
+		require.NoError(t, err)
+		fsys["short.json"] = &fstest.MapFile{Data: bz}
+
+		rd, err := (&SplitMount{Registry: r, Manifest: &url.URL{Scheme: "fs", Host: "short.json", RawQuery: "path=short.json"}}).Fetch(ctx)
+		require.NoError(t, err)
+		defer rd.Close()
+
+		_, err = ioutil.ReadAll(rd)
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		_, err = rd.ReadAt(make([]byte, 4<<10), 0)
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+
+	t.Run("part schemes", func(t *testing.T) {
+		foreign := m
+		foreign.Parts = append([]SplitPart(nil), m.Parts...)
+		foreign.Parts[1].URL = "file://part1?path=/etc/passwd"
+		bz, err := json.Marshal(foreign)
+		require.NoError(t, err)
+		fsys["foreign.json"] = &fstest.MapFile{Data: bz}
+		manifest := &url.URL{Scheme: "fs", Host: "foreign.json", RawQuery: "path=foreign.json"}
+
+		// parts are confined to the scheme of the manifest by default.
+		_, err = (&SplitMount{Registry: r, Manifest: manifest}).Fetch(ctx)
+		require.ErrorContains(t, err, "scheme of part 1 not allowed")
+
+		// or to the schemes allowed explicitly.
+		_, err = (&SplitMount{Registry: r, PartSchemes: []string{"fs"}, Manifest: manifest}).Fetch(ctx)
+		require.ErrorContains(t, err, "scheme of part 1 not allowed")
+		_, err = (&SplitMount{Registry: r, PartSchemes: []string{"s3"}, Manifest: &url.URL{Scheme: "fs", Host: "manifest.json", RawQuery: "path=manifest.json"}}).Fetch(ctx)
+		require.ErrorContains(t, err, "scheme of part 0 not allowed")
+	})
+
+	t.Run("missing manifest", func(t *testing.T) {
+		mnt := &SplitMount{Registry: r, Manifest: &url.URL{Scheme: "fs", Host: "missing.json", RawQuery: "path=missing.json"}}
+		st, _ := mnt.Stat(ctx)
+		require.False(t, st.Exists)
+		_, err := mnt.Fetch(ctx)
+		require.Error(t, err)
+	})
+}
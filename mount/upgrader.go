@@ -1,17 +1,22 @@
 package mount
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"hash"
 	"io"
 	"net/url"
 	"os"
 	"path/filepath"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/filecoin-project/dagstore/directio"
 	"github.com/filecoin-project/dagstore/throttle"
 	logging "github.com/ipfs/go-log/v2"
+	"github.com/multiformats/go-multihash"
 )
 
 var log = logging.Logger("dagstore/upgrader")
@@ -36,16 +41,51 @@ type Upgrader struct {
 	pathComplete string
 	pathPartial  string
 
+	// shared, if non-nil, deduplicates transients across Upgraders whose
+	// underlying mounts refer to the same object; sharedKey identifies the
+	// object, and the version of it that's held, if known (guarded by lk).
+	// holdsShared is true while this Upgrader holds a reference to the shared
+	// transient (guarded by lk).
+	shared      *SharedTransients
+	sharedKey   sharedKey
+	holdsShared bool
+
 	lk    sync.Mutex
 	path  string // guarded by lk
 	ready bool   // guarded by lk
-	// once guards deduplicates concurrent refetch requests; the caller that
-	// gets to run stores the result in onceErr, for other concurrent callers to
-	// consume it.
-	once    *sync.Once // guarded by lk
-	onceErr error      // NOT guarded by lk; access coordinated by sync.Once
+	// compressed is true if the transient at path is compressed; guarded by
+	// lk. It's tracked apart from compress, as transients provided by the
+	// user or fetched before the setting changed may differ.
+	compressed bool
+	// unverified is true while the initial transient must be validated
+	// against the underlying mount before use; guarded by lk.
+	unverified bool
+	// validating is closed once the validation of the transient in progress,
+	// if any, completes; guarded by lk.
+	validating chan struct{}
+	// inflight is the refetch of the transient in progress, if any, which
+	// concurrent fetches join instead of refetching; guarded by lk.
+	inflight *inflightFetch
 
 	fetches int32 // guarded by atomic
+	joins   int32 // guarded by atomic
+
+	// checksum is the expected multihash of the transient, if supplied
+	// through SetChecksum; it takes precedence over the one reported by the
+	// underlying mount. Set before use.
+	checksum multihash.Multihash
+
+	// compress is true if transients are stored compressed; from
+	// UpgradeOpts.Compress, or set through SetCompression before use.
+	compress bool
+
+	// progress, if non-nil, is called as transients are fetched from the
+	// underlying mount; set through SetProgress before use.
+	progress ProgressFunc
+
+	// directIO, if non-nil, are the options of the direct IO writes of
+	// transients; from UpgradeOpts.DirectIO.
+	directIO *directio.Options
 }
 
 var _ Mount = (*Upgrader)(nil)
@@ -54,14 +94,62 @@ var _ Mount = (*Upgrader)(nil)
 // will reuse the file in path `initial` as the initial transient copy. Whenever
 // a new transient copy has to be created, it will be created under `rootdir`.
 func Upgrade(underlying Mount, throttler throttle.Throttler, rootdir, key string, initial string) (*Upgrader, error) {
+	return UpgradeWithOpts(underlying, throttler, rootdir, key, initial, UpgradeOpts{})
+}
+
+// UpgradeShared is like Upgrade, but deduplicates transient copies through
+// the supplied SharedTransients, if non-nil. Upgraders whose underlying mounts
+// refer to the same object will share a single transient.
+func UpgradeShared(underlying Mount, throttler throttle.Throttler, rootdir, key string, initial string, shared *SharedTransients) (*Upgrader, error) {
+	return UpgradeWithOpts(underlying, throttler, rootdir, key, initial, UpgradeOpts{Shared: shared})
+}
+
+// DefaultMaxPassthroughLatency is the default value of
+// UpgradeOpts.MaxPassthroughLatency.
+var DefaultMaxPassthroughLatency = 10 * time.Millisecond
+
+// UpgradeOpts are options of UpgradeWithOpts.
+type UpgradeOpts struct {
+	// Shared, if non-nil, deduplicates transient copies; see UpgradeShared.
+	Shared *SharedTransients
+
+	// MaxPassthroughLatency is the highest Info.AccessLatency of underlying
+	// mounts supporting random access that are read directly. Slower mounts
+	// are copied to transients like mounts without random access. Defaults
+	// to DefaultMaxPassthroughLatency.
+	MaxPassthroughLatency time.Duration
+
+	// DirectIO, if non-nil, writes transients with direct IO where supported
+	// (see package directio), so that fetching them doesn't pollute the page
+	// cache.
+	DirectIO *directio.Options
+
+	// Compress stores the transients fetched by the Upgrader compressed (see
+	// Upgrader.SetCompression). Shared transients are only shared among
+	// Upgraders with the same setting.
+	Compress bool
+
+	// InitialCompressed is true if the initial transient is compressed, as
+	// recorded when it was fetched. Initial transients that are shared
+	// transients are known to be compressed if Compress is set.
+	InitialCompressed bool
+}
+
+// UpgradeWithOpts is like Upgrade, with the supplied options.
+func UpgradeWithOpts(underlying Mount, throttler throttle.Throttler, rootdir, key string, initial string, opts UpgradeOpts) (*Upgrader, error) {
+	if opts.MaxPassthroughLatency <= 0 {
+		opts.MaxPassthroughLatency = DefaultMaxPassthroughLatency
+	}
+	shared := opts.Shared
 	ret := &Upgrader{
 		underlying:   underlying,
 		key:          key,
 		rootdir:      rootdir,
-		once:         new(sync.Once),
 		throttler:    throttler,
 		pathComplete: filepath.Join(rootdir, "transient-"+key+".complete"),
 		pathPartial:  filepath.Join(rootdir, "transient-"+key+".partial"),
+		directIO:     opts.DirectIO,
+		compress:     opts.Compress,
 	}
 	if ret.rootdir == "" {
 		ret.rootdir = os.TempDir() // use the OS' default temp dir.
@@ -70,9 +158,16 @@ func Upgrade(underlying Mount, throttler throttle.Throttler, rootdir, key string
 	switch info := underlying.Info(); {
 	case !info.AccessSequential:
 		return nil, fmt.Errorf("underlying mount must support sequential access")
-	case info.AccessSeek && info.AccessRandom:
+	case info.AccessSeek && info.AccessRandom && info.AccessLatency <= opts.MaxPassthroughLatency:
 		ret.passthrough = true
 		return ret, nil
+	case info.AccessSeek && info.AccessRandom:
+		log.Debugw("mount supports random access, but is too slow to read directly; will use a transient", "shard", key, "latency", info.AccessLatency)
+	}
+
+	if shared != nil {
+		ret.shared = shared
+		ret.sharedKey = sharedKey{object: ret.sharedIDFor(opts.Compress)}
 	}
 
 	if initial != "" {
@@ -80,6 +175,13 @@ func Upgrade(underlying Mount, throttler throttle.Throttler, rootdir, key string
 			log.Debugw("initialized with existing transient that's alive", "shard", key, "path", initial)
 			ret.path = initial
 			ret.ready = true
+			ret.compressed = opts.InitialCompressed
+			if shared != nil {
+				ret.sharedKey, ret.holdsShared = shared.adopt(ret.sharedKey.object, initial)
+			}
+			if ret.holdsShared {
+				ret.compressed = ret.compress
+			}
 			return ret, nil
 		}
 	}
@@ -97,12 +199,23 @@ func (u *Upgrader) Fetch(ctx context.Context) (Reader, error) {
 	// if not, delete it, get the current sync.Once and trigger a refresh.
 	// after it's done, open the resulting transient.
 	u.lk.Lock()
+	if u.ready && u.unverified {
+		// the initial transient may be stale or truncated, e.g. if we crashed
+		// while writing it; validate it before serving it for the first time.
+		if err := u.revalidate(ctx, true); err != nil {
+			if ctx.Err() != nil {
+				u.lk.Unlock()
+				return nil, fmt.Errorf("mount fetch failed: %w", ctx.Err())
+			}
+			log.Warnw("existing transient failed validation; removing and refetching", "shard", u.key, "error", err)
+		}
+	}
 	if u.ready {
 		log.Debugw("transient local copy exists; check liveness", "shard", u.key, "path", u.path)
 		if _, err := os.Stat(u.path); err == nil {
 			log.Debugw("transient copy alive; not refetching", "shard", u.key, "path", u.path)
 			defer u.lk.Unlock()
-			return os.Open(u.path)
+			return openTransient(u.path, u.compressed)
 		} else {
 			u.ready = false
 			log.Debugw("transient copy dead; removing and refetching", "shard", u.key, "path", u.path, "error", err)
@@ -112,63 +225,272 @@ func (u *Upgrader) Fetch(ctx context.Context) (Reader, error) {
 		}
 		// TODO add size check.
 	}
-	// transient appears to be dead, refetch.
-	// get the current sync under the lock, use it to deduplicate concurrent fetches.
-	once := u.once
+
+	if u.shared != nil {
+		return u.fetchShared(ctx)
+	}
+
+	// transient appears to be dead; join the refetch in flight, if any.
+	if f := u.inflight; f != nil {
+		u.lk.Unlock()
+		return u.join(ctx, f)
+	}
+
+	// otherwise refetch, deduplicating concurrent fetches.
+	f := &inflightFetch{done: make(chan struct{}), path: u.pathComplete, compressed: u.compress}
+	u.inflight = f
 	u.lk.Unlock()
 
-	once.Do(func() {
-		// Create a new file in the partial location.
-		// os.Create truncates existing files.
-		var partial *os.File
-		partial, u.onceErr = os.Create(u.pathPartial)
-		if u.onceErr != nil {
-			return
-		}
-		defer partial.Close()
-
-		// do the refetch; abort and remove/reset the partial if it fails.
-		// perform outside the lock as this is a long-running operation.
-		// u.onceErr is only written by the goroutine that gets to run sync.Once
-		// and it's only read after it finishes.
-
-		u.onceErr = u.refetch(ctx, partial)
-		if u.onceErr != nil {
-			log.Warnw("failed to refetch", "shard", u.key, "error", u.onceErr)
-			if err := os.Remove(u.pathPartial); err != nil {
-				log.Warnw("failed to remove partial transient", "shard", u.key, "path", u.pathPartial, "error", err)
-			}
-			return
+	// perform outside the lock as this is a long-running operation.
+	f.err = u.fetchTransient(ctx)
+	f.aborted = f.err != nil && ctx.Err() != nil
+
+	u.lk.Lock()
+	if f.err == nil {
+		u.path = f.path
+		u.compressed = f.compressed
+		u.ready = true
+	}
+	u.inflight = nil
+	u.lk.Unlock()
+	close(f.done)
+
+	if f.err != nil {
+		return nil, fmt.Errorf("mount fetch failed: %w", f.err)
+	}
+	log.Debugw("refetched successfully", "shard", u.key, "path", f.path)
+	return openTransient(f.path, f.compressed)
+}
+
+// inflightFetch is a refetch of the transient of an Upgrader. Its result is
+// set before done is closed, and must only be read after.
+type inflightFetch struct {
+	done       chan struct{}
+	path       string // path of the transient being fetched.
+	compressed bool   // whether the transient is compressed.
+	err        error
+	// aborted is true if the fetch failed because the context of the caller
+	// that started it was done.
+	aborted bool
+}
+
+// join waits for a refetch in flight to complete, and opens the transient it
+// produced, or returns its error. If the refetch was aborted because the
+// caller that started it went away, it's retried on behalf of this caller.
+func (u *Upgrader) join(ctx context.Context, f *inflightFetch) (Reader, error) {
+	atomic.AddInt32(&u.joins, 1)
+	log.Debugw("joining transient refetch in flight", "shard", u.key)
+
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("mount fetch failed: %w", ctx.Err())
+	}
+	if f.aborted && ctx.Err() == nil {
+		log.Debugw("joined refetch was aborted; retrying", "shard", u.key)
+		return u.Fetch(ctx)
+	}
+	if f.err != nil {
+		return nil, fmt.Errorf("mount fetch failed: %w", f.err)
+	}
+	return openTransient(f.path, f.compressed)
+}
+
+// fetchTransient refetches the transient from the underlying mount into the
+// partial path, and renames it to the complete path once done. The partial
+// transient is removed if the refetch fails.
+func (u *Upgrader) fetchTransient(ctx context.Context) error {
+	if err := os.MkdirAll(filepath.Dir(u.pathPartial), 0755); err != nil {
+		return err
+	}
+	// os.Create truncates existing files.
+	partial, err := os.Create(u.pathPartial)
+	if err != nil {
+		return err
+	}
+	defer partial.Close()
+
+	if err := u.refetch(ctx, partial); err != nil {
+		log.Warnw("failed to refetch", "shard", u.key, "error", err)
+		if err := os.Remove(u.pathPartial); err != nil {
+			log.Warnw("failed to remove partial transient", "shard", u.key, "path", u.pathPartial, "error", err)
 		}
+		return err
+	}
 
-		// rename the partial file to a non-partial file.
-		// set the new transient path under a lock, and recycle the sync.Once.
-		// if the target file exists, os.Rename replaces it.
-		if err := os.Rename(u.pathPartial, u.pathComplete); err != nil {
-			log.Warnw("failed to rename partial transient", "shard", u.key, "from_path", u.pathPartial, "to_path", u.pathComplete, "error", err)
+	// if the target file exists, os.Rename replaces it.
+	if err := os.Rename(u.pathPartial, u.pathComplete); err != nil {
+		return fmt.Errorf("failed to rename partial transient: %w", err)
+	}
+	log.Debugw("transient path updated after refetching", "shard", u.key, "new_path", u.pathComplete)
+	return nil
+}
+
+// ValidateTransient validates the transient, if any, against the size and
+// checksum of the underlying mount, if known, like the validation of initial
+// transients (see VerifyInitial). A transient failing validation is removed,
+// so that it's refetched on the next fetch, and the validation error is
+// returned. Fetches wait for the validation to complete.
+func (u *Upgrader) ValidateTransient(ctx context.Context) error {
+	if u.passthrough {
+		return nil
+	}
+	u.lk.Lock()
+	defer u.lk.Unlock()
+
+	if err := u.revalidate(ctx, false); err != nil {
+		if ctx.Err() == nil {
+			log.Warnw("transient failed validation; removing it", "shard", u.key, "error", err)
 		}
+		return err
+	}
+	return nil
+}
 
-		u.lk.Lock()
-		u.path = u.pathComplete
-		u.ready = true
-		u.once = new(sync.Once)
+// revalidate validates the current transient, if any, discarding it if it
+// fails validation. If initial is set, it only validates an initial transient
+// that wasn't validated yet. It must be called with the lock held, which is
+// released while the transient is validated, so that hashing a large
+// transient doesn't stall the other users of the Upgrader; fetches wait for
+// the validation in the meantime. The transient is left in place if the
+// validation is interrupted by the context.
+func (u *Upgrader) revalidate(ctx context.Context, initial bool) error {
+	for u.validating != nil {
+		done := u.validating
 		u.lk.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			u.lk.Lock()
+			return ctx.Err()
+		}
+		u.lk.Lock()
+	}
+	if !u.ready || (initial && !u.unverified) {
+		return nil
+	}
 
-		log.Debugw("transient path updated after refetching", "shard", u.key, "new_path", u.pathComplete)
-	})
+	path, compressed, done := u.path, u.compressed, make(chan struct{})
+	u.validating = done
+	u.lk.Unlock()
+
+	err := u.validateTransient(ctx, path, compressed)
+
+	u.lk.Lock()
+	u.validating = nil
+	close(done)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if !u.ready || u.path != path {
+		// the transient was replaced in the meantime.
+		return nil
+	}
+	u.unverified = false
+	if err != nil {
+		u.discardInvalid()
+		return fmt.Errorf("transient %s: %w", path, err)
+	}
+	return nil
+}
+
+// discardInvalid discards a transient that failed validation, removing it
+// unless it's not owned by us, or shared. It must be called with the lock
+// held.
+func (u *Upgrader) discardInvalid() {
+	u.ready = false
+	if _, rerr := filepath.Rel(u.rootdir, u.path); rerr == nil && !u.holdsShared {
+		if err := os.Remove(u.path); err != nil {
+			log.Warnw("failed to remove invalid transient; garbage left behind", "shard", u.key, "path", u.path, "error", err)
+		}
+	}
+}
+
+// validateTransient validates the transient at path against the size and
+// checksum of the underlying mount, if known. If the underlying mount can't be
+// stat'ed (e.g. it's temporarily unavailable), the transient is trusted.
+func (u *Upgrader) validateTransient(ctx context.Context, path string, compressed bool) error {
+	size, err := transientSize(path, compressed)
+	if err != nil {
+		return err
+	}
+	stat, err := u.underlying.Stat(ctx)
+	if err != nil {
+		log.Debugw("failed to stat underlying mount; trusting existing transient", "shard", u.key, "error", err)
+		return nil
+	}
+	if stat.Size > 0 && size != stat.Size {
+		return fmt.Errorf("size mismatch: expected %d bytes, got %d", stat.Size, size)
+	}
+
+	expected := u.checksum
+	if expected == nil {
+		expected = stat.Checksum
+	}
+	verifier, err := newChecksumVerifier(expected)
+	if err != nil || verifier == nil {
+		return err
+	}
+	f, err := openTransient(path, compressed)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(verifier, f); err != nil {
+		return err
+	}
+	return verifier.verify()
+}
 
-	// There's a tiny, tiny possibility of a race here if a new refetch with
-	// the recycled sync.Once comes in an updates onceErr before the waiters
-	// have read it. Not worth making perfect now, but we should revisit
-	// this recipe. Can probably use a sync.Cond with atomic counters.
-	// TODO revisit this.
-	err := u.onceErr
+// fetchShared fetches the transient through the SharedTransients,
+// deduplicating it with other Upgraders referring to the same object. It must
+// be called with the lock held, and it releases it.
+func (u *Upgrader) fetchShared(ctx context.Context) (Reader, error) {
+	// if our reference points to a dead transient, drop it before refetching.
+	dead := u.holdsShared
+	u.holdsShared = false
+	key := u.sharedKey
+	u.lk.Unlock()
+
+	if dead {
+		if err := u.shared.release(key); err != nil {
+			log.Debugw("failed to release dead shared transient", "shard", u.key, "error", err)
+		}
+	}
+
+	// fetch the current version of the object, so that we don't share a
+	// transient of an older one.
+	key.version = ""
+	if stat, err := u.underlying.Stat(ctx); err != nil {
+		log.Debugw("failed to stat underlying mount; sharing transient regardless of version", "shard", u.key, "error", err)
+	} else {
+		key.version = versionDigest(stat.Version)
+	}
+
+	// perform outside the lock as this is a long-running operation.
+	path, err := u.shared.acquire(ctx, key, u.refetch)
 	if err != nil {
 		return nil, fmt.Errorf("mount fetch failed: %w", err)
 	}
 
-	log.Debugw("refetched successfully", "shard", u.key, "path", u.pathComplete)
-	return os.Open(u.pathComplete)
+	u.lk.Lock()
+	extra := u.holdsShared // a concurrent fetch of this Upgrader took a reference already.
+	prev := u.sharedKey
+	u.sharedKey = key
+	u.path = path
+	u.compressed = u.compress // shared transients are shared by format.
+	u.ready = true
+	u.holdsShared = true
+	u.lk.Unlock()
+
+	if extra {
+		if err := u.shared.release(prev); err != nil {
+			log.Warnw("failed to release duplicate shared transient reference", "shard", u.key, "error", err)
+		}
+	}
+
+	log.Debugw("using shared transient", "shard", u.key, "path", path)
+	return openTransient(path, u.compress)
 }
 
 func (u *Upgrader) Info() Info {
@@ -182,8 +504,8 @@ func (u *Upgrader) Info() Info {
 
 func (u *Upgrader) Stat(ctx context.Context) (Stat, error) {
 	if u.path != "" {
-		if stat, err := os.Stat(u.path); err == nil {
-			ret := Stat{Exists: true, Size: stat.Size()}
+		if size, err := transientSize(u.path, u.compressed); err == nil {
+			ret := Stat{Exists: true, Size: size}
 			return ret, nil
 		}
 	}
@@ -198,12 +520,101 @@ func (u *Upgrader) TransientPath() string {
 	return u.path
 }
 
+// Shared returns whether the transient is shared with other Upgraders.
+func (u *Upgrader) Shared() bool {
+	u.lk.Lock()
+	defer u.lk.Unlock()
+
+	return u.holdsShared
+}
+
 // TimesFetched returns the number of times that the underlying has
 // been fetched.
 func (u *Upgrader) TimesFetched() int {
 	return int(atomic.LoadInt32(&u.fetches))
 }
 
+// TimesJoined returns the number of fetches that joined a refetch of the
+// transient already in flight, instead of fetching the underlying again.
+func (u *Upgrader) TimesJoined() int {
+	return int(atomic.LoadInt32(&u.joins))
+}
+
+// Passthrough returns whether the underlying mount is fully capable and fast
+// enough, in which case it is accessed directly and no transient is ever
+// created.
+func (u *Upgrader) Passthrough() bool {
+	return u.passthrough
+}
+
+// SetChecksum sets the expected multihash of the data of the underlying mount,
+// which transients are verified against after fetching. It overrides the
+// checksum reported by the underlying mount's Stat, if any. It must be called
+// before the Upgrader is used.
+func (u *Upgrader) SetChecksum(mh multihash.Multihash) {
+	u.checksum = mh
+}
+
+// Checksum returns the expected checksum set through SetChecksum, if any.
+func (u *Upgrader) Checksum() multihash.Multihash {
+	return u.checksum
+}
+
+// SetCompression sets whether transients fetched from now on are stored
+// zstd-compressed, trading CPU for disk space. Compressed transients still
+// support random access. The existing transient, if any, is read in the
+// format it was stored in (see UpgradeOpts.InitialCompressed). It must be
+// called before the Upgrader is used; Upgraders sharing transients should set
+// it through UpgradeOpts.Compress instead.
+func (u *Upgrader) SetCompression(compress bool) {
+	u.compress = compress
+	if u.shared != nil && !u.holdsShared {
+		u.sharedKey = sharedKey{object: u.sharedIDFor(compress)}
+	}
+}
+
+// sharedIDFor returns the ID of the shared transient of the Upgrader, which
+// tells transients stored in different formats apart.
+func (u *Upgrader) sharedIDFor(compress bool) string {
+	id := sharedID(u.underlying)
+	if compress {
+		id += "|zstd"
+	}
+	return id
+}
+
+// SetProgress sets a function to be called with the progress of the fetches
+// of transients from the underlying mount. If several fetches are
+// deduplicated, only the one actually transferring the data reports
+// progress. It must be called before the Upgrader is used.
+func (u *Upgrader) SetProgress(progress ProgressFunc) {
+	u.progress = progress
+}
+
+// Compression returns whether transients are stored compressed.
+func (u *Upgrader) Compression() bool {
+	return u.compress
+}
+
+// TransientCompressed returns whether the current transient, if any, is
+// compressed.
+func (u *Upgrader) TransientCompressed() bool {
+	u.lk.Lock()
+	defer u.lk.Unlock()
+	return u.compressed
+}
+
+// VerifyInitial makes the Upgrader validate the initial transient it was
+// constructed with against the size and checksum of the underlying mount
+// before first serving it, refetching it if the validation fails. It's meant
+// for transients of unknown integrity, such as those reused after a restart,
+// which may be stale or truncated. Call it before use.
+func (u *Upgrader) VerifyInitial() {
+	u.lk.Lock()
+	u.unverified = u.ready
+	u.lk.Unlock()
+}
+
 // Underlying returns the underlying mount.
 func (u *Upgrader) Underlying() Mount {
 	return u.underlying
@@ -225,6 +636,7 @@ func (u *Upgrader) Close() error {
 
 func (u *Upgrader) refetch(ctx context.Context, into *os.File) error {
 	log.Debugw("actually refetching", "shard", u.key, "path", into.Name())
+	atomic.AddInt32(&u.fetches, 1)
 
 	// sanity check on underlying mount.
 	stat, err := u.underlying.Stat(ctx)
@@ -244,25 +656,327 @@ func (u *Upgrader) refetch(ctx context.Context, into *os.File) error {
 		log.Debugw("underlying mount is ready; will throttle fetch and copy", "shard", u.key)
 	}
 
+	expected := u.checksum
+	if expected == nil {
+		expected = stat.Checksum
+	}
+	verifier, err := newChecksumVerifier(expected)
+	if err != nil {
+		return err
+	}
+
 	err = t.Do(ctx, func(ctx context.Context) error {
 		// fetch from underlying and copy.
-		from, err := u.underlying.Fetch(ctx)
+		from, err := FetchWithProgress(ctx, u.underlying, stat.Size, u.progress)
 		if err != nil {
 			return fmt.Errorf("failed to fetch from underlying mount: %w", err)
 		}
 		defer from.Close()
 
-		_, err = io.Copy(into, from)
-		return err
+		return u.writeTransient(into, from, verifier)
 	})
 
 	if err != nil {
 		return fmt.Errorf("failed to fetch and copy underlying mount to transient file: %w", err)
 	}
 
+	if verifier != nil {
+		if err := verifier.verify(); err != nil {
+			return err
+		}
+		log.Debugw("transient checksum verified", "shard", u.key)
+	}
+
+	return nil
+}
+
+// writeTransient copies the data read from r into a transient file,
+// compressing it if enabled, and feeding it to verifier, if non-nil.
+func (u *Upgrader) writeTransient(into *os.File, from io.Reader, verifier *checksumVerifier) error {
+	w := io.Writer(into)
+	var dw *directio.Writer
+	if u.directIO != nil {
+		dw = directio.NewWriter(into, *u.directIO)
+		w = dw
+	}
+	var cw *compressedWriter
+	if u.compress {
+		var err error
+		if cw, err = newCompressedWriter(w); err != nil {
+			return err
+		}
+		w = cw
+	}
+	if verifier != nil {
+		w = io.MultiWriter(w, verifier)
+	}
+	if _, err := io.Copy(w, from); err != nil {
+		return err
+	}
+	if cw != nil {
+		if err := cw.Close(); err != nil {
+			return err
+		}
+	}
+	if dw != nil {
+		return dw.Close()
+	}
+	return nil
+}
+
+// RestoreTransient replaces the transient with the data read from r, e.g. a
+// copy of the data of the underlying mount kept in an archive, so that it
+// doesn't need to be fetched from the underlying mount. The data is verified
+// against the checksum set through SetChecksum, if any. It fails for
+// passthrough mounts, which don't use transients, and while a fetch is in
+// flight.
+func (u *Upgrader) RestoreTransient(r io.Reader) error {
+	tr, err := u.StageRestoreTransient(r)
+	if err != nil {
+		return err
+	}
+	return tr.Commit()
+}
+
+// TransientRestore is a restore of the transient of an Upgrader, staged by
+// StageRestoreTransient. The Upgrader keeps using its current transient, if
+// any, until the restore is committed.
+type TransientRestore struct {
+	u      *Upgrader
+	staged string
+}
+
+// StageRestoreTransient stages the restore of the transient with the data
+// read from r (see RestoreTransient): the data is written and verified next
+// to the transient, without holding the lock of the Upgrader. The restore
+// must then be committed or aborted.
+func (u *Upgrader) StageRestoreTransient(r io.Reader) (*TransientRestore, error) {
+	if u.passthrough {
+		return nil, fmt.Errorf("passthrough mounts have no transient")
+	}
+
+	dir := filepath.Dir(u.pathComplete)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(dir, filepath.Base(u.pathComplete)+".restore-*")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	verifier, err := newChecksumVerifier(u.checksum)
+	if err == nil {
+		err = u.writeTransient(f, r, verifier)
+	}
+	if err == nil && verifier != nil {
+		err = verifier.verify()
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return nil, fmt.Errorf("failed to restore transient: %w", err)
+	}
+	return &TransientRestore{u: u, staged: f.Name()}, nil
+}
+
+// Commit switches the Upgrader to the restored transient, replacing the
+// current one. It fails while a fetch is in flight, in which case the restore
+// is aborted.
+func (tr *TransientRestore) Commit() error {
+	u := tr.u
+	u.lk.Lock()
+	defer u.lk.Unlock()
+
+	if u.inflight != nil {
+		tr.Abort()
+		return fmt.Errorf("failed to restore transient: fetch in flight")
+	}
+	if err := os.Rename(tr.staged, u.pathComplete); err != nil {
+		tr.Abort()
+		return fmt.Errorf("failed to restore transient: %w", err)
+	}
+	switch {
+	case u.holdsShared:
+		if err := u.shared.release(u.sharedKey); err != nil {
+			log.Warnw("failed to release shared transient replaced by restored one", "shard", u.key, "error", err)
+		}
+		u.holdsShared = false
+	case u.path != "" && u.path != u.pathComplete:
+		if _, err := filepath.Rel(u.rootdir, u.path); err == nil {
+			if err := os.Remove(u.path); err != nil && !os.IsNotExist(err) {
+				log.Warnw("failed to remove transient replaced by restored one; garbage left behind", "shard", u.key, "path", u.path, "error", err)
+			}
+		}
+	}
+	u.path = u.pathComplete
+	u.compressed = u.compress
+	u.ready = true
+	u.unverified = false
+	log.Debugw("restored transient", "shard", u.key, "path", u.path)
+	return nil
+}
+
+// Abort discards a staged restore, leaving the current transient in place.
+func (tr *TransientRestore) Abort() {
+	_ = os.Remove(tr.staged)
+}
+
+// checksumVerifier hashes the data written to it, and verifies it against an
+// expected multihash.
+type checksumVerifier struct {
+	hash.Hash
+	expected *multihash.DecodedMultihash
+}
+
+// newChecksumVerifier returns a verifier for the expected multihash, or nil
+// if no checksum is expected.
+func newChecksumVerifier(expected multihash.Multihash) (*checksumVerifier, error) {
+	if len(expected) == 0 {
+		return nil, nil
+	}
+	dmh, err := multihash.Decode(expected)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expected checksum: %w", err)
+	}
+	h, err := multihash.GetHasher(dmh.Code)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported checksum function %s: %w", dmh.Name, err)
+	}
+	return &checksumVerifier{Hash: h, expected: dmh}, nil
+}
+
+func (c *checksumVerifier) verify() error {
+	sum := c.Sum(nil)
+	if len(sum) > c.expected.Length {
+		sum = sum[:c.expected.Length]
+	}
+	if !bytes.Equal(sum, c.expected.Digest) {
+		return fmt.Errorf("%w: expected %x, got %x", ErrChecksumMismatch, c.expected.Digest, sum)
+	}
 	return nil
 }
 
+// MoveTransient moves the transient associated with this Upgrader into dir,
+// which may be on a different filesystem, and returns its new path. Readers
+// opened on the previous transient remain valid on platforms that support
+// unlinking open files.
+//
+// Shared transients can't be moved, as they're referenced by other Upgraders.
+func (u *Upgrader) MoveTransient(dir string) (string, error) {
+	m, err := u.StageTransientMove(dir)
+	if err != nil {
+		return "", err
+	}
+	return m.Commit()
+}
+
+// TransientMove is a move of the transient of an Upgrader into another
+// directory, staged by StageTransientMove. The Upgrader keeps using the
+// transient at its current path until the move is committed.
+type TransientMove struct {
+	u   *Upgrader
+	src string
+	dst string
+	// staged is the path of the staged copy of the transient, next to dst;
+	// empty if src is already at dst.
+	staged string
+}
+
+// StageTransientMove stages the move of the transient associated with this
+// Upgrader into dir, which may be on a different filesystem: the transient is
+// linked or, across filesystems, copied next to its destination. This is the
+// long-running part of a move, and it's done without holding the lock of the
+// Upgrader. The move must then be committed or aborted.
+//
+// Shared transients can't be moved, as they're referenced by other Upgraders.
+func (u *Upgrader) StageTransientMove(dir string) (*TransientMove, error) {
+	u.lk.Lock()
+	src := u.path
+	switch {
+	case src == "" || !u.ready:
+		u.lk.Unlock()
+		return nil, fmt.Errorf("no transient to move")
+	case u.holdsShared:
+		u.lk.Unlock()
+		return nil, fmt.Errorf("shared transient can't be moved")
+	}
+	u.lk.Unlock()
+
+	m := &TransientMove{u: u, src: src, dst: filepath.Join(dir, filepath.Base(src))}
+	if m.dst == src {
+		return m, nil // nothing to do.
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create transient dir: %w", err)
+	}
+
+	// link first, which is cheap if dir is on the same filesystem. Otherwise,
+	// copy into a partial file, so that a crash never leaves a truncated
+	// transient behind under the final path.
+	m.staged = m.dst + ".partial"
+	_ = os.Remove(m.staged)
+	if err := os.Link(src, m.staged); err != nil {
+		if err := copyFile(src, m.staged); err != nil {
+			_ = os.Remove(m.staged)
+			return nil, fmt.Errorf("failed to copy transient: %w", err)
+		}
+	}
+	return m, nil
+}
+
+// Commit switches the Upgrader to the moved transient, and removes the
+// transient at its previous path. It fails if the transient was deleted or
+// replaced since the move was staged, in which case the move is aborted.
+func (m *TransientMove) Commit() (string, error) {
+	if m.staged == "" {
+		return m.dst, nil
+	}
+	u := m.u
+	u.lk.Lock()
+	defer u.lk.Unlock()
+
+	if u.path != m.src {
+		m.Abort()
+		return "", fmt.Errorf("transient changed while moving it")
+	}
+	if err := os.Rename(m.staged, m.dst); err != nil {
+		m.Abort()
+		return "", fmt.Errorf("failed to rename moved transient: %w", err)
+	}
+
+	u.path = m.dst
+	if err := os.Remove(m.src); err != nil {
+		log.Warnw("failed to remove transient after moving it; garbage left behind", "shard", u.key, "path", m.src, "error", err)
+	}
+	log.Debugw("moved transient", "shard", u.key, "from_path", m.src, "to_path", m.dst)
+	return m.dst, nil
+}
+
+// Abort discards a staged move, leaving the transient in place.
+func (m *TransientMove) Abort() {
+	if m.staged != "" {
+		_ = os.Remove(m.staged)
+	}
+}
+
+func copyFile(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		_ = dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
 // DeleteTransient deletes the transient associated with this Upgrader, if
 // one exists. It is the caller's responsibility to ensure the transient is
 // not in use. If the tracked transient is gone, this will reset the internal
@@ -283,6 +997,17 @@ func (u *Upgrader) DeleteTransient() error {
 		return nil
 	}
 
+	// release our reference to a shared transient; it'll only be removed from
+	// disk once all Upgraders sharing it have released it.
+	if u.holdsShared {
+		err := u.shared.release(u.sharedKey)
+		u.holdsShared = false
+		u.path = ""
+		u.ready = false
+		log.Debugw("released shared transient", "shard", u.key, "error", err)
+		return err
+	}
+
 	// remove the transient and clear it always, even if os.Remove
 	// returns an error. This allows us to recover from errors like the user
 	// deleting the transient we're currently tracking.
@@ -11,6 +11,7 @@ import (
 	"math/rand"
 	"net/url"
 	"os"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -18,6 +19,7 @@ import (
 
 	"github.com/filecoin-project/dagstore/testdata"
 	"github.com/filecoin-project/dagstore/throttle"
+	"github.com/multiformats/go-multihash"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/sync/errgroup"
 )
@@ -361,3 +363,530 @@ func (b *blockingReaderMount) Serialize() *url.URL {
 func (b *blockingReaderMount) Deserialize(url *url.URL) error {
 	panic("implement me")
 }
+
+func TestUpgraderSharedTransients(t *testing.T) {
+	ctx := context.Background()
+	rootDir := t.TempDir()
+	shared := NewSharedTransients(rootDir)
+
+	// both upgraders refer to the same underlying object.
+	underlying := &Counting{Mount: &FSMount{testdata.FS, testdata.FSPathCarV2}}
+	u1, err := UpgradeShared(underlying, throttle.Noop(), rootDir, "foo", "", shared)
+	require.NoError(t, err)
+	u2, err := UpgradeShared(underlying, throttle.Noop(), rootDir, "bar", "", shared)
+	require.NoError(t, err)
+
+	// fetch concurrently; only one fetch hits the underlying mount.
+	grp, _ := errgroup.WithContext(ctx)
+	for _, u := range []*Upgrader{u1, u2, u1, u2} {
+		u := u
+		grp.Go(func() error {
+			rd, err := u.Fetch(ctx)
+			if err != nil {
+				return err
+			}
+			bz, err := io.ReadAll(rd)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(testdata.CarV2, bz) {
+				return errors.New("contents mismatch")
+			}
+			return rd.Close()
+		})
+	}
+	require.NoError(t, grp.Wait())
+	require.Equal(t, 1, underlying.Count())
+
+	require.Equal(t, u1.TransientPath(), u2.TransientPath())
+	require.Equal(t, 2, shared.Refs(u1))
+	entries, err := os.ReadDir(rootDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	// releasing the first reference keeps the transient for the other upgrader.
+	path := u1.TransientPath()
+	require.NoError(t, u1.DeleteTransient())
+	require.Empty(t, u1.TransientPath())
+	_, err = os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, 1, shared.Refs(u2))
+
+	// releasing the last reference removes it.
+	require.NoError(t, u2.DeleteTransient())
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+	require.Zero(t, shared.Refs(u2))
+
+	// a new upgrader over the same object can be revived from the shared
+	// transient after a restart.
+	rd, err := u1.Fetch(ctx)
+	require.NoError(t, err)
+	require.NoError(t, rd.Close())
+	require.Equal(t, 2, underlying.Count())
+
+	shared2 := NewSharedTransients(rootDir)
+	u3, err := UpgradeShared(underlying, throttle.Noop(), rootDir, "foo", u1.TransientPath(), shared2)
+	require.NoError(t, err)
+	require.Equal(t, 1, shared2.Refs(u3))
+}
+
+// versionedMount is a mount that reports a version in its Stat.
+type versionedMount struct {
+	Mount
+	version atomic.Value // string
+}
+
+func (v *versionedMount) Stat(ctx context.Context) (Stat, error) {
+	stat, err := v.Mount.Stat(ctx)
+	stat.Version, _ = v.version.Load().(string)
+	return stat, err
+}
+
+func TestUpgraderSharedTransientsVersioned(t *testing.T) {
+	ctx := context.Background()
+	rootDir := t.TempDir()
+	shared := NewSharedTransients(rootDir)
+
+	counting := &Counting{Mount: &FSMount{testdata.FS, testdata.FSPathCarV2}}
+	underlying := &versionedMount{Mount: counting}
+	underlying.version.Store(`"v1"`)
+	u1, err := UpgradeShared(underlying, throttle.Noop(), rootDir, "foo", "", shared)
+	require.NoError(t, err)
+	u2, err := UpgradeShared(underlying, throttle.Noop(), rootDir, "bar", "", shared)
+	require.NoError(t, err)
+
+	rd, err := u1.Fetch(ctx)
+	require.NoError(t, err)
+	require.NoError(t, rd.Close())
+
+	// a new version of the object gets a transient of its own.
+	underlying.version.Store(`"v2"`)
+	rd, err = u2.Fetch(ctx)
+	require.NoError(t, err)
+	require.NoError(t, rd.Close())
+	require.Equal(t, 2, counting.Count())
+	require.NotEqual(t, u1.TransientPath(), u2.TransientPath())
+	require.Equal(t, 2, shared.Refs(u1))
+
+	// the version is recovered from the transient after a restart.
+	shared2 := NewSharedTransients(rootDir)
+	u3, err := UpgradeShared(underlying, throttle.Noop(), rootDir, "bar", u2.TransientPath(), shared2)
+	require.NoError(t, err)
+	require.Equal(t, 1, shared2.Refs(u3))
+
+	u4, err := UpgradeShared(underlying, throttle.Noop(), rootDir, "baz", "", shared2)
+	require.NoError(t, err)
+	rd, err = u4.Fetch(ctx)
+	require.NoError(t, err)
+	require.NoError(t, rd.Close())
+	require.Equal(t, 2, counting.Count())
+	require.Equal(t, u3.TransientPath(), u4.TransientPath())
+	require.Equal(t, 2, shared2.Refs(u4))
+}
+
+func TestUpgraderMoveTransient(t *testing.T) {
+	ctx := context.Background()
+	rootDir := t.TempDir()
+	otherDir := t.TempDir()
+
+	underlying := &Counting{Mount: &FSMount{testdata.FS, testdata.FSPathCarV2}}
+	u, err := Upgrade(underlying, throttle.Noop(), rootDir, "foo", "")
+	require.NoError(t, err)
+
+	// nothing to move before fetching.
+	_, err = u.MoveTransient(otherDir)
+	require.Error(t, err)
+
+	rd, err := u.Fetch(ctx)
+	require.NoError(t, err)
+	require.NoError(t, rd.Close())
+	prev := u.TransientPath()
+
+	path, err := u.MoveTransient(otherDir)
+	require.NoError(t, err)
+	require.Equal(t, otherDir, filepath.Dir(path))
+	require.Equal(t, path, u.TransientPath())
+	_, err = os.Stat(prev)
+	require.True(t, os.IsNotExist(err))
+
+	// the moved transient is used without refetching.
+	rd, err = u.Fetch(ctx)
+	require.NoError(t, err)
+	bz, err := io.ReadAll(rd)
+	require.NoError(t, err)
+	require.NoError(t, rd.Close())
+	require.Equal(t, testdata.CarV2, bz)
+	require.Equal(t, 1, underlying.Count())
+
+	// moving it back to the root dir.
+	path, err = u.MoveTransient(rootDir)
+	require.NoError(t, err)
+	require.Equal(t, prev, path)
+
+	// deleting it removes it from its current location.
+	require.NoError(t, u.DeleteTransient())
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+}
+
+// checksumMount is a mount that reports a checksum in its Stat.
+type checksumMount struct {
+	Mount
+	checksum multihash.Multihash
+}
+
+func (c *checksumMount) Stat(ctx context.Context) (Stat, error) {
+	stat, err := c.Mount.Stat(ctx)
+	stat.Checksum = c.checksum
+	return stat, err
+}
+
+func TestUpgraderChecksum(t *testing.T) {
+	ctx := context.Background()
+	good, err := multihash.Sum(testdata.CarV2, multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	bad, err := multihash.Sum([]byte("junk"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+
+	fetch := func(u *Upgrader) error {
+		rd, err := u.Fetch(ctx)
+		if err != nil {
+			return err
+		}
+		return rd.Close()
+	}
+
+	// a matching checksum supplied to the upgrader.
+	u, err := Upgrade(&FSMount{testdata.FS, testdata.FSPathCarV2}, throttle.Noop(), t.TempDir(), "foo", "")
+	require.NoError(t, err)
+	u.SetChecksum(good)
+	require.NoError(t, fetch(u))
+	require.NotEmpty(t, u.TransientPath())
+
+	// a mismatching checksum fails the fetch, and leaves no transient behind.
+	dir := t.TempDir()
+	u, err = Upgrade(&FSMount{testdata.FS, testdata.FSPathCarV2}, throttle.Noop(), dir, "foo", "")
+	require.NoError(t, err)
+	u.SetChecksum(bad)
+	require.ErrorIs(t, fetch(u), ErrChecksumMismatch)
+	require.Empty(t, u.TransientPath())
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	// checksums reported by the mount are verified too, unless overridden.
+	mnt := &checksumMount{Mount: &FSMount{testdata.FS, testdata.FSPathCarV2}, checksum: bad}
+	u, err = Upgrade(mnt, throttle.Noop(), t.TempDir(), "foo", "")
+	require.NoError(t, err)
+	require.ErrorIs(t, fetch(u), ErrChecksumMismatch)
+
+	u, err = Upgrade(mnt, throttle.Noop(), t.TempDir(), "foo", "")
+	require.NoError(t, err)
+	u.SetChecksum(good)
+	require.NoError(t, fetch(u))
+}
+
+func TestUpgraderVerifyInitial(t *testing.T) {
+	ctx := context.Background()
+	good, err := multihash.Sum(testdata.CarV2, multihash.SHA2_256, -1)
+	require.NoError(t, err)
+
+	// fetch upgrades a mount with an initial transient holding the supplied
+	// bytes, and returns the bytes served and the number of refetches.
+	fetch := func(t *testing.T, initial []byte, checksum multihash.Multihash) ([]byte, int) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "transient-foo.complete")
+		require.NoError(t, os.WriteFile(path, initial, 0644))
+
+		mnt := &Counting{Mount: &FSMount{testdata.FS, testdata.FSPathCarV2}}
+		u, err := Upgrade(mnt, throttle.Noop(), dir, "foo", path)
+		require.NoError(t, err)
+		u.SetChecksum(checksum)
+		u.VerifyInitial()
+
+		rd, err := u.Fetch(ctx)
+		require.NoError(t, err)
+		defer rd.Close()
+		bz, err := ioutil.ReadAll(rd)
+		require.NoError(t, err)
+		return bz, mnt.Count()
+	}
+
+	// a valid transient is reused.
+	bz, n := fetch(t, testdata.CarV2, good)
+	require.Equal(t, testdata.CarV2, bz)
+	require.Zero(t, n)
+
+	// a truncated transient is refetched.
+	bz, n = fetch(t, testdata.CarV2[:len(testdata.CarV2)/2], nil)
+	require.Equal(t, testdata.CarV2, bz)
+	require.Equal(t, 1, n)
+
+	// a corrupted transient of the right size is refetched, if the checksum
+	// is known.
+	corrupted := append([]byte(nil), testdata.CarV2...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	bz, n = fetch(t, corrupted, good)
+	require.Equal(t, testdata.CarV2, bz)
+	require.Equal(t, 1, n)
+
+	bz, n = fetch(t, corrupted, nil)
+	require.Equal(t, corrupted, bz)
+	require.Zero(t, n)
+}
+
+// statGatedMount is a mount whose stats block until released.
+type statGatedMount struct {
+	Mount
+	stating chan struct{}
+	release chan struct{}
+}
+
+func (g *statGatedMount) Stat(ctx context.Context) (Stat, error) {
+	g.stating <- struct{}{}
+	<-g.release
+	return g.Mount.Stat(ctx)
+}
+
+func TestUpgraderValidateUnlocked(t *testing.T) {
+	good, err := multihash.Sum(testdata.CarV2, multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "transient-foo.complete")
+	require.NoError(t, os.WriteFile(path, testdata.CarV2, 0644))
+
+	mnt := &statGatedMount{
+		Mount:   &FSMount{testdata.FS, testdata.FSPathCarV2},
+		stating: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	u, err := Upgrade(mnt, throttle.Noop(), dir, "foo", path)
+	require.NoError(t, err)
+	u.SetChecksum(good)
+	u.VerifyInitial()
+
+	errCh := make(chan error, 1)
+	go func() {
+		rd, err := u.Fetch(context.Background())
+		if err == nil {
+			err = rd.Close()
+		}
+		errCh <- err
+	}()
+
+	// the transient is validated without holding the lock of the upgrader.
+	<-mnt.stating
+	require.Equal(t, path, u.TransientPath())
+	close(mnt.release)
+	require.NoError(t, <-errCh)
+
+	// explicit validations too.
+	mnt.release = make(chan struct{})
+	go func() { errCh <- u.ValidateTransient(context.Background()) }()
+	<-mnt.stating
+	require.Equal(t, path, u.TransientPath())
+	close(mnt.release)
+	require.NoError(t, <-errCh)
+}
+
+func TestUpgraderProgress(t *testing.T) {
+	var (
+		calls int
+		last  [2]int64
+	)
+	u, err := Upgrade(&FSMount{testdata.FS, testdata.FSPathCarV2}, throttle.Noop(), t.TempDir(), "foo", "")
+	require.NoError(t, err)
+	u.SetProgress(func(transferred, total int64) {
+		require.Greater(t, transferred, last[0])
+		calls++
+		last = [2]int64{transferred, total}
+	})
+	rd, err := u.Fetch(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, rd.Close())
+	require.Greater(t, calls, 1)
+	require.EqualValues(t, len(testdata.CarV2), last[0])
+	require.EqualValues(t, len(testdata.CarV2), last[1])
+
+	// cancelling the context mid-fetch aborts the fetch, and leaves no partial
+	// transient behind.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir := t.TempDir()
+	u, err = Upgrade(&FSMount{testdata.FS, testdata.FSPathCarV2}, throttle.Noop(), dir, "foo", "")
+	require.NoError(t, err)
+	u.SetProgress(func(transferred, total int64) { cancel() })
+	_, err = u.Fetch(ctx)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Empty(t, u.TransientPath())
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+// gatedMount is a mount whose fetches block until released, failing with the
+// error they're released with, if any.
+type gatedMount struct {
+	Mount
+	release chan error
+}
+
+func (g *gatedMount) Fetch(ctx context.Context) (Reader, error) {
+	select {
+	case err := <-g.release:
+		if err != nil {
+			return nil, err
+		}
+		return g.Mount.Fetch(ctx)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestUpgraderFetchCoalescing(t *testing.T) {
+	const joiners = 5
+	mnt := &gatedMount{Mount: &FSMount{testdata.FS, testdata.FSPathCarV2}, release: make(chan error)}
+	u, err := Upgrade(mnt, throttle.Noop(), t.TempDir(), "foo", "")
+	require.NoError(t, err)
+
+	// fetch runs a leader and joiners concurrently, waiting for the joiners to
+	// join before releasing the fetch with the given error.
+	fetch := func(leaderCtx context.Context, release func()) []error {
+		errs := make([]error, joiners+1)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rd, err := u.Fetch(leaderCtx)
+			if err == nil {
+				err = rd.Close()
+			}
+			errs[0] = err
+		}()
+		require.Eventually(t, func() bool {
+			u.lk.Lock()
+			defer u.lk.Unlock()
+			return u.inflight != nil
+		}, 5*time.Second, time.Millisecond)
+
+		joined := u.TimesJoined()
+		for i := 1; i <= joiners; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				rd, err := u.Fetch(context.Background())
+				if err == nil {
+					err = rd.Close()
+				}
+				errs[i] = err
+			}(i)
+		}
+		require.Eventually(t, func() bool {
+			return u.TimesJoined() == joined+joiners
+		}, 5*time.Second, time.Millisecond)
+		release()
+		wg.Wait()
+		return errs
+	}
+
+	// errors are propagated to all joiners.
+	boom := errors.New("boom")
+	for _, err := range fetch(context.Background(), func() { mnt.release <- boom }) {
+		require.ErrorIs(t, err, boom)
+	}
+	require.Equal(t, 1, u.TimesFetched())
+	require.Empty(t, u.TransientPath())
+
+	// if the leader goes away, a joiner retries the fetch, and the others join
+	// it.
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := fetch(ctx, func() {
+		cancel()
+		// release the retried fetch.
+		require.Eventually(t, func() bool {
+			return u.TimesFetched() == 3
+		}, 5*time.Second, time.Millisecond)
+		mnt.release <- nil
+	})
+	require.ErrorIs(t, errs[0], context.Canceled)
+	for _, err := range errs[1:] {
+		require.NoError(t, err)
+	}
+	require.Equal(t, 3, u.TimesFetched())
+	require.NotEmpty(t, u.TransientPath())
+}
+
+func TestUpgraderRestoreTransient(t *testing.T) {
+	mnt := &Counting{Mount: &FSMount{testdata.FS, testdata.FSPathCarV2}}
+	u, err := Upgrade(mnt, throttle.Noop(), t.TempDir(), "foo", "")
+	require.NoError(t, err)
+
+	// the restored data is verified against the checksum.
+	sum, err := multihash.Sum(testdata.CarV2, multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	u.SetChecksum(sum)
+	err = u.RestoreTransient(bytes.NewReader(testdata.CarV1))
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+	require.Empty(t, u.TransientPath())
+
+	require.NoError(t, u.RestoreTransient(bytes.NewReader(testdata.CarV2)))
+	require.NotEmpty(t, u.TransientPath())
+	rd, err := u.Fetch(context.Background())
+	require.NoError(t, err)
+	bz, err := ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	require.NoError(t, rd.Close())
+	require.Equal(t, testdata.CarV2, bz)
+	require.Zero(t, mnt.Count())
+}
+
+// latencyMount is a mount supporting random access, with a latency hint.
+type latencyMount struct {
+	Mount
+	latency time.Duration
+}
+
+func (l *latencyMount) Info() Info {
+	info := l.Mount.Info()
+	info.AccessLatency = l.latency
+	return info
+}
+
+func TestUpgraderPassthroughLatency(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		latency     time.Duration
+		max         time.Duration
+		passthrough bool
+	}{
+		{"local", 0, 0, true},
+		{"fast network", 500 * time.Microsecond, 0, true},
+		{"slow network", 50 * time.Millisecond, 0, false},
+		{"slow network with higher threshold", 50 * time.Millisecond, 100 * time.Millisecond, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mnt := &Counting{Mount: &latencyMount{Mount: &BytesMount{Bytes: testdata.CarV2}, latency: tc.latency}}
+			u, err := UpgradeWithOpts(mnt, throttle.Noop(), t.TempDir(), "foo", "", UpgradeOpts{MaxPassthroughLatency: tc.max})
+			require.NoError(t, err)
+			require.Equal(t, tc.passthrough, u.Passthrough())
+
+			// slow mounts are fetched once, into a transient.
+			for i := 0; i < 2; i++ {
+				rd, err := u.Fetch(context.Background())
+				require.NoError(t, err)
+				bz, err := ioutil.ReadAll(rd)
+				require.NoError(t, err)
+				require.NoError(t, rd.Close())
+				require.Equal(t, testdata.CarV2, bz)
+			}
+			if tc.passthrough {
+				require.Empty(t, u.TransientPath())
+				require.Equal(t, 2, mnt.Count())
+			} else {
+				require.NotEmpty(t, u.TransientPath())
+				require.Equal(t, 1, mnt.Count())
+			}
+		})
+	}
+}
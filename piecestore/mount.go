@@ -0,0 +1,110 @@
+package piecestore
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/dagstore/mount"
+)
+
+// MountScheme is the URL scheme under which PieceMount is registered.
+const MountScheme = "piece"
+
+// PieceAccessor is the subset of the storage provider API needed to serve
+// pieces out of sealed or unsealed sectors. Markets nodes implement it on top
+// of their sector accessor.
+type PieceAccessor interface {
+	// FetchUnsealedPiece returns a reader over the CAR payload of the unsealed
+	// piece identified by pieceCid, unsealing it if necessary.
+	FetchUnsealedPiece(ctx context.Context, pieceCid cid.Cid) (mount.Reader, error)
+
+	// GetUnpaddedCARSize returns the size of the CAR payload contained in
+	// the piece identified by pieceCid.
+	GetUnpaddedCARSize(ctx context.Context, pieceCid cid.Cid) (uint64, error)
+
+	// IsUnsealed returns whether an unsealed copy of the piece identified by
+	// pieceCid is readily available.
+	IsUnsealed(ctx context.Context, pieceCid cid.Cid) (bool, error)
+}
+
+// PieceMount is a mount that fetches the CAR payload of a piece through a
+// PieceAccessor.
+type PieceMount struct {
+	// PieceCid is the piece CID of the piece this mount represents.
+	PieceCid cid.Cid
+
+	// Accessor is the PieceAccessor used to fetch the piece. It is
+	// environmental configuration, carried over from the template registered
+	// in the mount registry to the mounts instantiated after a restart.
+	Accessor PieceAccessor
+}
+
+var _ mount.Mount = (*PieceMount)(nil)
+
+// NewPieceMountTemplate returns a PieceMount template to be registered in the
+// DAG store's mount registry under MountScheme.
+func NewPieceMountTemplate(accessor PieceAccessor) *PieceMount {
+	return &PieceMount{Accessor: accessor}
+}
+
+// NewPieceMount returns a PieceMount for the supplied piece.
+func NewPieceMount(pieceCid cid.Cid, accessor PieceAccessor) (*PieceMount, error) {
+	if !pieceCid.Defined() {
+		return nil, fmt.Errorf("undefined piece CID")
+	}
+	if accessor == nil {
+		return nil, fmt.Errorf("missing piece accessor")
+	}
+	return &PieceMount{PieceCid: pieceCid, Accessor: accessor}, nil
+}
+
+func (p *PieceMount) Fetch(ctx context.Context) (mount.Reader, error) {
+	return p.Accessor.FetchUnsealedPiece(ctx, p.PieceCid)
+}
+
+func (p *PieceMount) Info() mount.Info {
+	return mount.Info{
+		Kind:             mount.KindRemote,
+		AccessSequential: true,
+		AccessSeek:       true,
+		AccessRandom:     true,
+	}
+}
+
+func (p *PieceMount) Stat(ctx context.Context) (mount.Stat, error) {
+	size, err := p.Accessor.GetUnpaddedCARSize(ctx, p.PieceCid)
+	if err != nil {
+		return mount.Stat{}, fmt.Errorf("failed to get size of piece %s: %w", p.PieceCid, err)
+	}
+	ready, err := p.Accessor.IsUnsealed(ctx, p.PieceCid)
+	if err != nil {
+		return mount.Stat{}, fmt.Errorf("failed to check unsealed status of piece %s: %w", p.PieceCid, err)
+	}
+	return mount.Stat{
+		Exists: true,
+		Size:   int64(size),
+		Ready:  ready,
+	}, nil
+}
+
+func (p *PieceMount) Serialize() *url.URL {
+	return &url.URL{
+		Host: p.PieceCid.String(),
+	}
+}
+
+func (p *PieceMount) Deserialize(u *url.URL) error {
+	c, err := cid.Decode(u.Host)
+	if err != nil {
+		return fmt.Errorf("failed to parse piece CID from host %q: %w", u.Host, err)
+	}
+	p.PieceCid = c
+	return nil
+}
+
+func (p *PieceMount) Close() error {
+	return nil
+}
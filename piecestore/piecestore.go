@@ -0,0 +1,180 @@
+// Package piecestore bridges the DAG store with Filecoin markets nodes (e.g.
+// Lotus, Boost). It maps piece CIDs to shard keys, mounts pieces through the
+// node's sector accessor, acquires shards on retrieval and releases them when
+// the retrieval is done, so that integrations don't each reimplement this glue.
+package piecestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log/v2"
+
+	"github.com/filecoin-project/dagstore"
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+var log = logging.Logger("dagstore/piecestore")
+
+// ClosableBlockstore is a read-only blockstore over the contents of a piece.
+// Close must be called when the caller is done with it, to release the
+// underlying shard.
+type ClosableBlockstore interface {
+	dagstore.ReadBlockstore
+	Close() error
+}
+
+// Wrapper exposes the DAG store in terms of piece CIDs.
+type Wrapper struct {
+	dagst    dagstore.Interface
+	accessor PieceAccessor
+}
+
+// RegisterMount registers the PieceMount template for the supplied accessor
+// in the mount registry, under MountScheme. It must be called before the DAG
+// store is started, so that persisted piece shards can be restored.
+func RegisterMount(r *mount.Registry, accessor PieceAccessor) error {
+	return r.Register(MountScheme, NewPieceMountTemplate(accessor))
+}
+
+// NewWrapper creates a new Wrapper over the supplied DAG store, fetching
+// pieces through the supplied accessor.
+func NewWrapper(dagst dagstore.Interface, accessor PieceAccessor) (*Wrapper, error) {
+	if dagst == nil {
+		return nil, errors.New("missing DAG store")
+	}
+	if accessor == nil {
+		return nil, errors.New("missing piece accessor")
+	}
+	return &Wrapper{dagst: dagst, accessor: accessor}, nil
+}
+
+// ShardKey returns the shard key for the supplied piece CID.
+func ShardKey(pieceCid cid.Cid) shard.Key {
+	return shard.KeyFromCID(pieceCid)
+}
+
+// PieceCid returns the piece CID represented by the supplied shard key.
+func PieceCid(k shard.Key) (cid.Cid, error) {
+	return cid.Decode(k.String())
+}
+
+// RegisterShard registers the piece with the DAG store. If carPath is not
+// empty, it is used as an existing transient copy of the piece's CAR payload.
+// If eagerInit is false, the piece is only fetched and indexed when it's first
+// acquired.
+//
+// The result of the registration is delivered on resch.
+func (w *Wrapper) RegisterShard(ctx context.Context, pieceCid cid.Cid, carPath string, eagerInit bool, resch chan dagstore.ShardResult) error {
+	mnt, err := NewPieceMount(pieceCid, w.accessor)
+	if err != nil {
+		return err
+	}
+	opts := dagstore.RegisterOpts{
+		ExistingTransient:  carPath,
+		LazyInitialization: !eagerInit,
+	}
+	if err := w.dagst.RegisterShard(ctx, ShardKey(pieceCid), mnt, resch, opts); err != nil {
+		return fmt.Errorf("failed to register shard for piece %s: %w", pieceCid, err)
+	}
+	return nil
+}
+
+// LoadShard acquires the shard for the supplied piece, and returns a
+// blockstore over its contents. If the piece is not known to the DAG store,
+// it is registered with lazy initialization first.
+//
+// The returned blockstore must be closed when done, to release the shard.
+func (w *Wrapper) LoadShard(ctx context.Context, pieceCid cid.Cid) (ClosableBlockstore, error) {
+	key := ShardKey(pieceCid)
+	resch := make(chan dagstore.ShardResult, 1)
+
+	err := w.dagst.AcquireShard(ctx, key, resch, dagstore.AcquireOpts{})
+	if errors.Is(err, dagstore.ErrShardUnknown) {
+		log.Debugw("piece not registered; registering with lazy initialization", "piece", pieceCid)
+		regch := make(chan dagstore.ShardResult, 1)
+		err = w.RegisterShard(ctx, pieceCid, "", false, regch)
+		if err != nil && !errors.Is(err, dagstore.ErrShardExists) {
+			return nil, err
+		}
+		if err == nil {
+			if err := waitResult(ctx, regch); err != nil {
+				return nil, fmt.Errorf("failed to register shard for piece %s: %w", pieceCid, err)
+			}
+		}
+		err = w.dagst.AcquireShard(ctx, key, resch, dagstore.AcquireOpts{})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to schedule acquire shard for piece %s: %w", pieceCid, err)
+	}
+
+	var res dagstore.ShardResult
+	select {
+	case res = <-resch:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if res.Error != nil {
+		return nil, fmt.Errorf("failed to acquire shard for piece %s: %w", pieceCid, res.Error)
+	}
+
+	bs, err := res.Accessor.Blockstore()
+	if err != nil {
+		_ = res.Accessor.Close()
+		return nil, fmt.Errorf("failed to open blockstore for piece %s: %w", pieceCid, err)
+	}
+	return &closableBlockstore{ReadBlockstore: bs, sa: res.Accessor}, nil
+}
+
+// DestroyShard destroys the shard for the supplied piece. The result is
+// delivered on resch.
+func (w *Wrapper) DestroyShard(ctx context.Context, pieceCid cid.Cid, resch chan dagstore.ShardResult) error {
+	if err := w.dagst.DestroyShard(ctx, ShardKey(pieceCid), resch, dagstore.DestroyOpts{}); err != nil {
+		return fmt.Errorf("failed to schedule destroy shard for piece %s: %w", pieceCid, err)
+	}
+	return nil
+}
+
+// GetPiecesContainingBlock returns the CIDs of all pieces that contain the
+// supplied block.
+func (w *Wrapper) GetPiecesContainingBlock(ctx context.Context, blockCid cid.Cid) ([]cid.Cid, error) {
+	keys, err := w.dagst.ShardsContainingMultihash(ctx, blockCid.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get shards containing block %s: %w", blockCid, err)
+	}
+
+	pieces := make([]cid.Cid, 0, len(keys))
+	for _, k := range keys {
+		c, err := PieceCid(k)
+		if err != nil {
+			// not a piece shard; it may have been registered by another
+			// component sharing the DAG store.
+			log.Debugw("skipping shard with non-CID key", "shard", k, "error", err)
+			continue
+		}
+		pieces = append(pieces, c)
+	}
+	return pieces, nil
+}
+
+// closableBlockstore releases the shard accessor when closed.
+type closableBlockstore struct {
+	dagstore.ReadBlockstore
+	sa *dagstore.ShardAccessor
+}
+
+func (c *closableBlockstore) Close() error {
+	return c.sa.Close()
+}
+
+func waitResult(ctx context.Context, ch chan dagstore.ShardResult) error {
+	select {
+	case res := <-ch:
+		return res.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
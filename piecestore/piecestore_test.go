@@ -0,0 +1,147 @@
+package piecestore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/dagstore"
+	"github.com/filecoin-project/dagstore/index"
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/testdata"
+)
+
+type mockAccessor struct {
+	pieces map[cid.Cid][]byte
+}
+
+func (m *mockAccessor) FetchUnsealedPiece(_ context.Context, pieceCid cid.Cid) (mount.Reader, error) {
+	data, ok := m.pieces[pieceCid]
+	if !ok {
+		return nil, errors.New("piece not found")
+	}
+	r := bytes.NewReader(data)
+	return &mount.NopCloser{Reader: r, ReaderAt: r, Seeker: r}, nil
+}
+
+func (m *mockAccessor) GetUnpaddedCARSize(_ context.Context, pieceCid cid.Cid) (uint64, error) {
+	data, ok := m.pieces[pieceCid]
+	if !ok {
+		return 0, errors.New("piece not found")
+	}
+	return uint64(len(data)), nil
+}
+
+func (m *mockAccessor) IsUnsealed(_ context.Context, pieceCid cid.Cid) (bool, error) {
+	_, ok := m.pieces[pieceCid]
+	return ok, nil
+}
+
+func pieceCid(t *testing.T, seed string) cid.Cid {
+	h, err := multihash.Sum([]byte(seed), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	return cid.NewCidV1(cid.FilCommitmentUnsealed, h)
+}
+
+func newDAGStore(t *testing.T, accessor PieceAccessor, store datastore.Batching, indices index.FullIndexRepo) *dagstore.DAGStore {
+	r := mount.NewRegistry()
+	require.NoError(t, RegisterMount(r, accessor))
+
+	dagst, err := dagstore.NewDAGStore(dagstore.Config{
+		MountRegistry: r,
+		TransientsDir: t.TempDir(),
+		Datastore:     store,
+		IndexRepo:     indices,
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(context.Background()))
+	t.Cleanup(func() { _ = dagst.Close() })
+	return dagst
+}
+
+func TestLoadShard(t *testing.T) {
+	ctx := context.Background()
+	piece := pieceCid(t, "piece")
+	accessor := &mockAccessor{pieces: map[cid.Cid][]byte{piece: testdata.CarV2}}
+	dagst := newDAGStore(t, accessor, dssync.MutexWrap(datastore.NewMapDatastore()), index.NewMemoryRepo())
+
+	w, err := NewWrapper(dagst, accessor)
+	require.NoError(t, err)
+
+	// the piece is not registered; loading it registers it lazily.
+	bs, err := w.LoadShard(ctx, piece)
+	require.NoError(t, err)
+
+	has, err := bs.Has(ctx, testdata.RootCID)
+	require.NoError(t, err)
+	require.True(t, has)
+
+	gc, err := dagst.GCDryRun(ctx)
+	require.NoError(t, err)
+	require.Equal(t, dagstore.GCSkipActiveRefs, gc.Report[ShardKey(piece)].SkipReason)
+
+	// closing the blockstore releases the shard.
+	require.NoError(t, bs.Close())
+	gc, err = dagst.GCDryRun(ctx)
+	require.NoError(t, err)
+	require.True(t, gc.Report[ShardKey(piece)].Reclaimable)
+
+	// loading it again does not register it again.
+	bs, err = w.LoadShard(ctx, piece)
+	require.NoError(t, err)
+	require.NoError(t, bs.Close())
+	require.Len(t, dagst.AllShardsInfo(), 1)
+
+	pieces, err := w.GetPiecesContainingBlock(ctx, testdata.RootCID)
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{piece}, pieces)
+
+	// an unknown piece fails to load.
+	_, err = w.LoadShard(ctx, pieceCid(t, "unknown"))
+	require.Error(t, err)
+
+	resch := make(chan dagstore.ShardResult, 1)
+	require.NoError(t, w.DestroyShard(ctx, piece, resch))
+	res := <-resch
+	require.NoError(t, res.Error)
+
+	_, err = dagst.GetShardInfo(ShardKey(piece))
+	require.ErrorIs(t, err, dagstore.ErrShardUnknown)
+}
+
+func TestPieceMountRestoredAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	piece := pieceCid(t, "piece")
+	accessor := &mockAccessor{pieces: map[cid.Cid][]byte{piece: testdata.CarV2}}
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	indices := index.NewMemoryRepo()
+
+	dagst := newDAGStore(t, accessor, store, indices)
+	w, err := NewWrapper(dagst, accessor)
+	require.NoError(t, err)
+
+	resch := make(chan dagstore.ShardResult, 1)
+	require.NoError(t, w.RegisterShard(ctx, piece, "", true, resch))
+	res := <-resch
+	require.NoError(t, res.Error)
+	require.NoError(t, dagst.Close())
+
+	// the restored mount picks up the accessor from the registered template.
+	dagst = newDAGStore(t, accessor, store, indices)
+	w, err = NewWrapper(dagst, accessor)
+	require.NoError(t, err)
+
+	bs, err := w.LoadShard(ctx, piece)
+	require.NoError(t, err)
+	has, err := bs.Has(ctx, testdata.RootCID)
+	require.NoError(t, err)
+	require.True(t, has)
+	require.NoError(t, bs.Close())
+}
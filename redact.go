@@ -0,0 +1,72 @@
+package dagstore
+
+import (
+	"net/url"
+	"regexp"
+)
+
+// ErrorRedactor transforms an error before it leaves the DAG store, i.e.
+// before it is persisted, traced, logged, or delivered to the application
+// through result and failure channels. It can be used to strip sensitive
+// information, such as credentials or presigned URLs, from error messages.
+//
+// Implementations must be safe for concurrent use, and should return an error
+// that unwraps to the original one if callers rely on errors.Is/As.
+type ErrorRedactor func(err error) error
+
+// urlRegexp matches absolute URLs embedded in error messages.
+var urlRegexp = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.\-]*://[^\s"'<>]+`)
+
+// RedactURLs is an ErrorRedactor that strips user credentials, query strings
+// and fragments from all URLs embedded in the error message. This covers
+// presigned URLs and credentials embedded in mount URLs.
+//
+// The returned error unwraps to the original error.
+func RedactURLs(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	redacted := urlRegexp.ReplaceAllStringFunc(msg, func(s string) string {
+		u, perr := url.Parse(s)
+		if perr != nil {
+			return "[REDACTED URL]"
+		}
+		if u.User != nil {
+			u.User = url.User("REDACTED")
+		}
+		if u.RawQuery != "" {
+			u.RawQuery = "REDACTED"
+		}
+		u.Fragment = ""
+		u.RawFragment = ""
+		return u.String()
+	})
+	if redacted == msg {
+		return err
+	}
+	return &redactedError{msg: redacted, err: err}
+}
+
+// redactedError is an error whose message has been redacted, but which still
+// unwraps to the original error.
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// redact applies the configured ErrorRedactor, if any, to err.
+func (d *DAGStore) redact(err error) error {
+	if err == nil || d.config.ErrorRedactor == nil {
+		return err
+	}
+	return d.config.ErrorRedactor(err)
+}
@@ -0,0 +1,117 @@
+package dagstore
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// RefEntry describes an outstanding reference to a shard, as tracked when
+// Config.RefcountAccounting is enabled.
+type RefEntry struct {
+	// ID uniquely identifies the reference within this DAG store instance.
+	ID uint64
+	// Provenance is the call site that acquired the reference.
+	Provenance string
+	// AcquiredAt is the time the reference was taken.
+	AcquiredAt time.Time
+}
+
+// callerProvenance returns the file:line of the caller of the function
+// calling callerProvenance.
+func callerProvenance() string {
+	_, file, line, ok := runtime.Caller(2)
+	if !ok {
+		return "unknown"
+	}
+	return fmt.Sprintf("%s:%d", file, line)
+}
+
+// refAcquired increments the refcount of the shard on behalf of the supplied
+// acquire waiter, recording the reference in the ledger if accounting is
+// enabled. It must be called from the event loop.
+func (d *DAGStore) refAcquired(s *Shard, w *waiter) {
+	s.refs++
+	s.stopIdleTimer()
+	if !d.config.RefcountAccounting {
+		return
+	}
+	w.refID = atomic.AddUint64(&d.lastRefID, 1)
+	if s.ledger == nil {
+		s.ledger = make(map[uint64]RefEntry)
+	}
+	s.ledger[w.refID] = RefEntry{ID: w.refID, Provenance: w.provenance, AcquiredAt: time.Now()}
+}
+
+// refReleased checks a release against the ledger, if accounting is enabled,
+// and removes the reference from it. It returns false if the release must be
+// ignored because it doesn't match an outstanding reference. It must be called
+// from the event loop.
+func (d *DAGStore) refReleased(s *Shard, tsk *task) bool {
+	if !d.config.RefcountAccounting {
+		return true
+	}
+	if _, ok := s.ledger[tsk.ref]; !ok {
+		d.refViolation(s, "release of unknown or already released reference %d from %s", tsk.ref, tsk.caller)
+		return false
+	}
+	delete(s.ledger, tsk.ref)
+	return true
+}
+
+// checkRefInvariants validates the refcount invariants of a shard after a
+// state transition, if accounting is enabled. It must be called from the
+// event loop.
+func (d *DAGStore) checkRefInvariants(s *Shard, op OpType) {
+	if !d.config.RefcountAccounting || op == OpShardDestroy {
+		return
+	}
+	switch {
+	case uint32(len(s.ledger)) != s.refs:
+		d.refViolation(s, "refcount is %d, but %d references are outstanding after %s", s.refs, len(s.ledger), op)
+	case s.state == ShardStateServing && s.refs == 0:
+		d.refViolation(s, "shard is serving with no references after %s", op)
+	case s.state == ShardStateAvailable && s.refs > 0:
+		d.refViolation(s, "shard is available with %d references after %s", s.refs, op)
+	}
+}
+
+// refViolation reports a refcount invariant violation through the failure
+// channel, if one was provided, without altering the state of the shard.
+func (d *DAGStore) refViolation(s *Shard, format string, args ...interface{}) {
+	err := fmt.Errorf("%w: %s", ErrRefcountViolation, fmt.Sprintf(format, args...))
+	log.Errorw("refcount accounting violation", "shard", s.key, "error", err)
+
+	d.notifyFailure(&ShardResult{Key: s.key, Error: err})
+}
+
+// ShardRefs returns the outstanding references to a shard, ordered by
+// acquisition, along with their provenance. It is useful to diagnose leaked
+// references that block GC and destroy. It requires Config.RefcountAccounting
+// to be enabled.
+func (d *DAGStore) ShardRefs(key shard.Key) ([]RefEntry, error) {
+	if !d.config.RefcountAccounting {
+		return nil, fmt.Errorf("refcount accounting is not enabled")
+	}
+
+	d.lk.RLock()
+	s, ok := d.shards[key]
+	d.lk.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", key.String(), ErrShardUnknown)
+	}
+
+	s.lk.RLock()
+	ret := make([]RefEntry, 0, len(s.ledger))
+	for _, e := range s.ledger {
+		ret = append(ret, e)
+	}
+	s.lk.RUnlock()
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return ret, nil
+}
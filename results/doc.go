@@ -0,0 +1,4 @@
+// Package results provides a Mux, which fans in the results of many
+// concurrent DAG store operations, such as registrations and acquires, and
+// matches them to the requests they answer.
+package results
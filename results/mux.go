@@ -0,0 +1,164 @@
+package results
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/filecoin-project/dagstore"
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("dagstore/results")
+
+// ErrMuxClosed is returned when starting an operation through a closed Mux.
+var ErrMuxClosed = errors.New("results mux closed")
+
+// ID identifies an operation started through a Mux.
+type ID uint64
+
+// Result is the result of an operation started through a Mux.
+type Result struct {
+	// ID is the ID of the operation.
+	ID ID
+	// Tag is the value supplied when starting the operation, e.g. to tell
+	// registrations from acquires.
+	Tag interface{}
+
+	dagstore.ShardResult
+}
+
+// Mux fans in the results of concurrent DAG store operations into a single
+// channel, matching each result to the operation it answers. Every operation
+// gets an out channel of its own, owned by the Mux, so that results never get
+// mixed up, and an operation can be abandoned through its context.
+//
+// Results must be consumed from Results. Accessors delivered after the
+// context of their operation is done are closed by the Mux while it's open,
+// and so are the accessors of unconsumed results when it's closed, so that
+// they don't leak shard references. Operations still in flight when the Mux
+// is closed should be abandoned through the contexts passed to the DAG store:
+// the out channels are unbuffered, so their results are never parked in them,
+// and the DAG store releases the accessors it fails to deliver.
+type Mux struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	lk     sync.Mutex
+	lastID ID
+	closed bool
+
+	resCh chan Result
+}
+
+// New creates a Mux, buffering up to buffer results that haven't been
+// consumed yet.
+func New(buffer int) *Mux {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Mux{ctx: ctx, cancel: cancel, resCh: make(chan Result, buffer)}
+}
+
+// Go starts an operation, calling fn with the out channel the operation must
+// deliver its result to, and returns its ID. fn typically calls a method of
+// the DAG store, e.g.:
+//
+//	id, err := mux.Go(ctx, key, func(out chan dagstore.ShardResult) error {
+//		return dagst.AcquireShard(ctx, key, out, dagstore.AcquireOpts{})
+//	})
+//
+// If fn fails, the error is returned and no result is delivered. Otherwise,
+// the result is delivered on Results, or, if ctx is done first, a result
+// carrying the error of ctx is.
+func (m *Mux) Go(ctx context.Context, tag interface{}, fn func(out chan dagstore.ShardResult) error) (ID, error) {
+	m.lk.Lock()
+	if m.closed {
+		m.lk.Unlock()
+		return 0, ErrMuxClosed
+	}
+	m.lastID++
+	id := m.lastID
+	m.wg.Add(1)
+	m.lk.Unlock()
+
+	// unbuffered, so that a result nobody receives any longer is handed back
+	// to the DAG store instead of being parked, leaking its accessor.
+	out := make(chan dagstore.ShardResult)
+	if err := fn(out); err != nil {
+		m.wg.Done()
+		return 0, err
+	}
+	go m.await(ctx, id, tag, out)
+	return id, nil
+}
+
+// await waits for the result of an operation, and delivers it.
+func (m *Mux) await(ctx context.Context, id ID, tag interface{}, out chan dagstore.ShardResult) {
+	defer m.wg.Done()
+
+	res := Result{ID: id, Tag: tag}
+	select {
+	case res.ShardResult = <-out:
+	case <-ctx.Done():
+		res.Error = ctx.Err()
+		// the operation may still complete; reclaim its accessor, if any.
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			m.drain(out)
+		}()
+	case <-m.ctx.Done():
+		m.drain(out)
+		return
+	}
+
+	select {
+	case m.resCh <- res:
+	case <-m.ctx.Done():
+		closeAccessor(res.ShardResult)
+	}
+}
+
+// drain waits for the result of an abandoned operation until the Mux is
+// closed, closing its accessor, if any.
+func (m *Mux) drain(out chan dagstore.ShardResult) {
+	select {
+	case res := <-out:
+		closeAccessor(res)
+	case <-m.ctx.Done():
+	}
+}
+
+func closeAccessor(res dagstore.ShardResult) {
+	if res.Accessor == nil {
+		return
+	}
+	if err := res.Accessor.Close(); err != nil {
+		log.Warnw("failed to close abandoned accessor", "shard", res.Key, "error", err)
+	}
+}
+
+// Results returns the channel on which the results of operations are
+// delivered, in completion order. It's closed once the Mux is closed.
+func (m *Mux) Results() <-chan Result {
+	return m.resCh
+}
+
+// Close abandons the operations in flight, and closes the Results channel.
+// Results that weren't consumed are discarded, and their accessors closed.
+func (m *Mux) Close() {
+	m.lk.Lock()
+	if m.closed {
+		m.lk.Unlock()
+		return
+	}
+	m.closed = true
+	m.lk.Unlock()
+
+	m.cancel()
+	m.wg.Wait()
+	close(m.resCh)
+	for res := range m.resCh {
+		closeAccessor(res.ShardResult)
+	}
+}
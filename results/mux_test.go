@@ -0,0 +1,124 @@
+package results
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/dagstore"
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/shard"
+	"github.com/filecoin-project/dagstore/testdata"
+)
+
+func TestMux(t *testing.T) {
+	ctx := context.Background()
+	dagst, err := dagstore.NewDAGStore(dagstore.Config{
+		MountRegistry: mount.NewRegistry(),
+		TransientsDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+	require.NoError(t, dagst.Start(ctx))
+	defer dagst.Close()
+
+	mux := New(16)
+	defer mux.Close()
+
+	// register and acquire shards concurrently.
+	keys := []shard.Key{shard.KeyFromString("foo"), shard.KeyFromString("bar"), shard.KeyFromString("baz")}
+	ids := make(map[ID]shard.Key)
+	for _, k := range keys {
+		k := k
+		id, err := mux.Go(ctx, "register", func(out chan dagstore.ShardResult) error {
+			return dagst.RegisterShard(ctx, k, &mount.BytesMount{Bytes: testdata.CarV2}, out, dagstore.RegisterOpts{})
+		})
+		require.NoError(t, err)
+		ids[id] = k
+	}
+	// acquire every shard once it's registered.
+	for acquired := 0; acquired < len(keys); {
+		res := <-mux.Results()
+		require.NoError(t, res.Error)
+		require.Equal(t, ids[res.ID], res.Key)
+		switch res.Tag {
+		case "register":
+			id, err := mux.Go(ctx, "acquire", func(out chan dagstore.ShardResult) error {
+				return dagst.AcquireShard(ctx, res.Key, out, dagstore.AcquireOpts{})
+			})
+			require.NoError(t, err)
+			ids[id] = res.Key
+		case "acquire":
+			require.NoError(t, res.Accessor.Close())
+			acquired++
+		}
+	}
+
+	// operations failing synchronously deliver no result.
+	_, err = mux.Go(ctx, nil, func(out chan dagstore.ShardResult) error {
+		return dagst.AcquireShard(ctx, shard.KeyFromString("unknown"), out, dagstore.AcquireOpts{})
+	})
+	require.ErrorIs(t, err, dagstore.ErrShardUnknown)
+
+	// abandoned operations deliver the error of their context, and the
+	// accessors they deliver late are closed.
+	late := make(chan chan dagstore.ShardResult, 1)
+	cctx, cancel := context.WithCancel(ctx)
+	id, err := mux.Go(cctx, nil, func(out chan dagstore.ShardResult) error {
+		late <- out
+		return nil
+	})
+	require.NoError(t, err)
+	cancel()
+	res := <-mux.Results()
+	require.Equal(t, id, res.ID)
+	require.ErrorIs(t, res.Error, context.Canceled)
+
+	ach := make(chan dagstore.ShardResult, 1)
+	require.NoError(t, dagst.AcquireShard(ctx, keys[0], ach, dagstore.AcquireOpts{}))
+	(<-late) <- <-ach
+	require.Eventually(t, func() bool {
+		info, err := dagst.GetShardInfo(keys[0])
+		return err == nil && info.ShardState == dagstore.ShardStateAvailable
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// closing the mux closes unconsumed accessors.
+	_, err = mux.Go(ctx, nil, func(out chan dagstore.ShardResult) error {
+		return dagst.AcquireShard(ctx, keys[1], out, dagstore.AcquireOpts{})
+	})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return len(mux.Results()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	mux.Close()
+	_, ok := <-mux.Results()
+	require.False(t, ok)
+	require.Eventually(t, func() bool {
+		info, err := dagst.GetShardInfo(keys[1])
+		return err == nil && info.ShardState == dagstore.ShardStateAvailable
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, err = mux.Go(ctx, nil, func(out chan dagstore.ShardResult) error { return nil })
+	require.ErrorIs(t, err, ErrMuxClosed)
+
+	// operations in flight when the mux is closed release their accessors
+	// once abandoned through their context.
+	mux = New(16)
+	require.NoError(t, dagst.Pause(ctx))
+	cctx, cancel = context.WithCancel(ctx)
+	defer cancel()
+	_, err = mux.Go(cctx, nil, func(out chan dagstore.ShardResult) error {
+		return dagst.AcquireShard(cctx, keys[2], out, dagstore.AcquireOpts{})
+	})
+	require.NoError(t, err)
+	mux.Close()
+	require.NoError(t, dagst.Resume(ctx))
+	require.Eventually(t, func() bool {
+		info, err := dagst.GetShardInfo(keys[2])
+		return err == nil && info.ShardState == dagstore.ShardStateServing
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	require.Eventually(t, func() bool {
+		info, err := dagst.GetShardInfo(keys[2])
+		return err == nil && info.ShardState == dagstore.ShardStateAvailable
+	}, 5*time.Second, 10*time.Millisecond)
+}
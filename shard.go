@@ -3,6 +3,9 @@ package dagstore
 import (
 	"context"
 	"sync"
+	"time"
+
+	carindex "github.com/ipld/go-car/v2/index"
 
 	"github.com/filecoin-project/dagstore/mount"
 	"github.com/filecoin-project/dagstore/shard"
@@ -14,23 +17,60 @@ type waiter struct {
 	ctx        context.Context    // governs the op if it's external
 	outCh      chan<- ShardResult // to send back the result
 	notifyDead func()             // called when the context expired and we weren't able to deliver the result
+
+	acquireOpts AcquireOpts // options of the acquire operation, if this is an acquire waiter
+	destroyOpts DestroyOpts // options of the destroy operation, if this is a destroy waiter
+
+	// populated only with Config.RefcountAccounting, for acquire waiters.
+	provenance string // call site of the acquire
+	refID      uint64 // id of the reference taken for this acquire
+
+	// set on acquire waiters that failed to open a replica of a recovering
+	// shard, so that they wait for the recovery instead.
+	noReplica bool
+
+	// populated only with Config.MaxAcquireQueueWait, for queued acquire waiters.
+	expiry *time.Timer // fires when the acquirer has waited for too long
+
+	// set on acquire waiters that took an opening slot of the shard (see
+	// Config.MaxConcurrentAcquiresPerShard), which they must release.
+	slot bool
 }
 
-func (w waiter) deliver(res *ShardResult) {
+// stopExpiry disarms the queue wait timer of an acquire waiter, if any.
+func (w *waiter) stopExpiry() {
+	if w.expiry != nil {
+		w.expiry.Stop()
+	}
+}
+
+// deliver sends the result to the waiter, and returns whether it was
+// delivered before the context of the waiter was done.
+func (w waiter) deliver(res *ShardResult) bool {
 	if w.outCh == nil {
-		return
+		return false
 	}
 	select {
 	case w.outCh <- *res:
+		return true
 	case <-w.ctx.Done():
 		if w.notifyDead != nil {
 			w.notifyDead()
 		}
+		return false
 	}
 }
 
 // Shard encapsulates the state of a shard within the DAG store.
 type Shard struct {
+	// bytesServed is accessed atomically, and kept first for 64-bit
+	// alignment; persisted in PersistedShard.BytesServed.
+	bytesServed uint64
+	// indexedBlocks is the number of blocks in the index of the shard, or zero
+	// if unknown; accessed atomically, and persisted in
+	// PersistedShard.IndexedBlocks.
+	indexedBlocks uint64
+
 	lk sync.RWMutex
 
 	// Immutable fields.
@@ -40,11 +80,27 @@ type Shard struct {
 	mount *mount.Upgrader // persisted in PersistedShard.URL (underlying)
 	lazy  bool            // persisted in PersistedShard.Lazy; whether this shard has lazy indexing
 
+	skipTopLevel bool // persisted in PersistedShard.SkipTopLevelIndex; whether the shard is kept out of the top-level index.
+
+	registeredAt time.Time // persisted in PersistedShard.RegisteredAt
+	expiresAt    time.Time // persisted in PersistedShard.ExpiresAt; zero if the shard doesn't expire
+
+	regOpts RegisterOpts // persisted in PersistedShard.RegisterOpts; the options the shard was registered with, without the detached index.
+
 	// Mutable fields.
 	// Cannot read/write outside event loop.
 	state ShardState // persisted in PersistedShard.State
 	err   error      // persisted in PersistedShard.Error; populated if shard state is errored.
 
+	failures []ShardFailure // persisted in PersistedShard.Failures; most recent failures, oldest first.
+
+	acquireCount   uint64    // persisted in PersistedShard.AcquireCount; number of acquires dispatched.
+	lastAcquiredAt time.Time // persisted in PersistedShard.LastAcquiredAt
+
+	callers callerStats // not persisted; statistics per AcquireOpts.Caller.
+
+	detachedIndex carindex.IterableIndex // index supplied at registration; used by the first initialization, then dropped.
+
 	recoverOnNextAcquire bool // a shard marked in error state during initialization can be recovered on its first acquire.
 
 	// Waiters.
@@ -53,5 +109,27 @@ type Shard struct {
 	wAcquire  []*waiter // waiters for acquiring the shard.
 	wDestroy  *waiter   // waiter for shard destruction.
 
+	destroyDeadline *time.Timer // fires when a tombstoned shard must be destroyed regardless of its references.
+	destroyed       bool        // set once the shard has been destroyed; tasks still in flight for it are ignored.
+	destroyDeferred bool        // set if the destroy was finalized while an initialization was in flight; it's finalized once the initialization completes.
+	initRunning     bool        // set while an initialization goroutine is in flight, until its completion task is processed; lazy init workers set it under the shard lock.
+	txnTombstone    bool        // set while the tombstone persisted by a transaction waits for the event loop; the shard is persisted as tombstoned meanwhile.
+	idleTimer       *time.Timer // fires when the shard has been idle for Config.IdleReclaimTimeout.
+
 	refs uint32 // number of DAG accessors currently open
+
+	// populated only with Config.MaxConcurrentAcquiresPerShard.
+	opening   int       // number of acquirers currently opening the shard.
+	wDispatch []*waiter // acquirers holding a reference, waiting for an opening slot.
+
+	ledger map[uint64]RefEntry // outstanding references; only with Config.RefcountAccounting.
+
+	traceSeq uint64 // sequence number of the last trace emitted for this shard.
+
+	history []ShardEvent // most recent transitions; only with Config.HistorySize.
+
+	// offsets caches the sorted section offsets of the last index the shard
+	// was served with; only with Config.IndexedGetSize.
+	offsetsLk sync.Mutex
+	offsets   *sectionOffsets
 }
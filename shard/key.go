@@ -1,14 +1,19 @@
 package shard
 
 import (
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
 
 	"github.com/ipfs/go-cid"
 	"github.com/mr-tron/base58"
 )
 
 // Key represents a shard key. It can be instantiated from a string, a byte
-// slice, or a CID.
+// slice, a CID, or one of the typed values listed in KeyType.
 type Key struct {
 	// str stores a string or an arbitrary byte slice in base58 form. We cannot
 	// store the raw byte slice because this struct needs to be comparable.
@@ -30,6 +35,73 @@ func KeyFromCID(cid cid.Cid) Key {
 	return Key{str: cid.String()}
 }
 
+// ErrNotPieceCID is returned by KeyFromPieceCID when the CID is not a piece
+// CID, i.e. a commitment of unsealed data.
+var ErrNotPieceCID = errors.New("not a piece CID")
+
+// KeyFromPieceCID returns the key of the shard for the piece with the given
+// piece CID (CommP). Equal pieces always map to the same key.
+func KeyFromPieceCID(c cid.Cid) (Key, error) {
+	if !c.Defined() || c.Type() != cid.FilCommitmentUnsealed {
+		return Key{}, fmt.Errorf("%s: %w", c, ErrNotPieceCID)
+	}
+	return KeyFromCID(cid.NewCidV1(c.Type(), c.Hash())), nil
+}
+
+// KeyFromPath returns a key derived from a file path, e.g. of a CAR file to
+// register with a file mount. The path is cleaned before deriving the key, so
+// that equivalent spellings of a path map to the same key; it's not resolved
+// against the working directory or symlinks, as the key must not depend on
+// the environment. The key is the base58-encoded SHA-256 digest of the
+// cleaned path, so it's safe to use in file names.
+func KeyFromPath(path string) Key {
+	digest := sha256.Sum256([]byte(filepath.ToSlash(filepath.Clean(path))))
+	return KeyFromBytes(digest[:])
+}
+
+// NamespaceSeparator separates the namespace from the rest of a namespaced
+// key. Namespaced keys are only recognized by this separator following a
+// valid namespace (see KeyInNamespace), so that keys that merely contain a
+// colon, like URLs or Windows paths, are not mistaken for namespaced ones.
+const NamespaceSeparator = "::"
+
+// KeyInNamespace returns a key scoped to namespace ns, so that a DAG store can
+// serve multiple tenants without their keys colliding. Namespaces consist of
+// ASCII letters, digits, '.', '_' and '-'. An empty or invalid namespace
+// returns the key unaltered.
+func KeyInNamespace(ns string, k Key) Key {
+	if !validNamespace(ns) {
+		return k
+	}
+	return Key{str: ns + NamespaceSeparator + k.str}
+}
+
+// Namespace returns the namespace of this key, or the empty string if the key
+// is not namespaced.
+func (k Key) Namespace() string {
+	i := strings.Index(k.str, NamespaceSeparator)
+	if i <= 0 || !validNamespace(k.str[:i]) {
+		return ""
+	}
+	return k.str[:i]
+}
+
+// validNamespace returns whether ns is a non-empty, valid namespace.
+func validNamespace(ns string) bool {
+	if ns == "" {
+		return false
+	}
+	for _, r := range ns {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '.', r == '_', r == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 // String returns the string representation for this key.
 func (k Key) String() string {
 	return k.str
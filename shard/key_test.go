@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"testing"
 
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
 	"github.com/stretchr/testify/require"
 )
 
@@ -18,3 +20,130 @@ func TestKeyMarshalJSON(t *testing.T) {
 
 	require.Equal(t, k.str, k2.str)
 }
+
+func TestKeyNamespace(t *testing.T) {
+	k := KeyFromString("abc")
+	require.Equal(t, "", k.Namespace())
+
+	nk := KeyInNamespace("tenant", k)
+	require.Equal(t, "tenant::abc", nk.String())
+	require.Equal(t, "tenant", nk.Namespace())
+	require.NotEqual(t, k, nk)
+
+	// the empty namespace leaves the key untouched.
+	require.Equal(t, k, KeyInNamespace("", k))
+
+	// a leading separator doesn't denote a namespace.
+	require.Equal(t, "", KeyFromString("::abc").Namespace())
+
+	// neither do colons in keys that aren't namespaced.
+	for _, str := range []string{"http://example.com/a.car", `C:\data\a.car`, "http://[::1]/a.car", "a:b"} {
+		require.Equal(t, "", KeyFromString(str).Namespace(), str)
+	}
+	require.Equal(t, "", KeyFromPath("/data/a:b.car").Namespace())
+
+	// invalid namespaces are ignored.
+	require.Equal(t, k, KeyInNamespace("ten ant", k))
+}
+
+func TestLayoutDir(t *testing.T) {
+	k := KeyFromString("abc")
+	require.Equal(t, "/root", LayoutFlat.Dir("/root", k))
+
+	dir := LayoutSharded.Dir("/root", k)
+	require.Equal(t, "/root/ba", dir) // sha256("abc") starts with 0xba.
+	require.Equal(t, dir, LayoutSharded.Dir("/root", KeyFromString("abc")))
+}
+
+func TestKeyFromPieceCID(t *testing.T) {
+	mh, err := multihash.Encode(make([]byte, 32), multihash.SHA2_256_TRUNC254_PADDED)
+	require.NoError(t, err)
+	piece := cid.NewCidV1(cid.FilCommitmentUnsealed, mh)
+
+	k, err := KeyFromPieceCID(piece)
+	require.NoError(t, err)
+	require.Equal(t, KeyFromCID(piece), k)
+
+	// other CIDs are rejected.
+	_, err = KeyFromPieceCID(cid.NewCidV1(cid.Raw, mh))
+	require.ErrorIs(t, err, ErrNotPieceCID)
+	_, err = KeyFromPieceCID(cid.Undef)
+	require.ErrorIs(t, err, ErrNotPieceCID)
+}
+
+func TestKeyFromPath(t *testing.T) {
+	k := KeyFromPath("/data/pieces/a.car")
+	require.Equal(t, k, KeyFromPath("/data/pieces/a.car"))
+	require.Equal(t, k, KeyFromPath("/data//pieces/../pieces/./a.car"))
+	require.NotEqual(t, k, KeyFromPath("/data/pieces/b.car"))
+	require.NotContains(t, k.String(), "/")
+}
+
+func TestTypedKeys(t *testing.T) {
+	uuid := [16]byte{0x12, 0x3e, 0x45, 0x67, 0xe8, 0x9b, 0x12, 0xd3, 0xa4, 0x56, 0x42, 0x66, 0x14, 0x17, 0x40, 0x00}
+	k := KeyFromUUID(uuid)
+	require.Equal(t, "123e4567-e89b-12d3-a456-426614174000", k.String())
+	require.Equal(t, KeyTypeUUID, k.Type())
+	require.NoError(t, k.Validate())
+	for _, s := range []string{"123E4567-E89B-12D3-A456-426614174000", "123e4567e89b12d3a456426614174000"} {
+		pk, err := ParseUUIDKey(s)
+		require.NoError(t, err)
+		require.Equal(t, k, pk)
+	}
+	_, err := ParseUUIDKey("not-a-uuid")
+	require.ErrorIs(t, err, ErrInvalidKey)
+
+	mh, err := multihash.Sum([]byte("payload"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	mk, err := KeyFromMultihash(mh)
+	require.NoError(t, err)
+	require.Equal(t, KeyTypeMultihash, mk.Type())
+	require.NoError(t, mk.Validate())
+	_, err = KeyFromMultihash(multihash.Multihash("junk"))
+	require.ErrorIs(t, err, ErrInvalidKey)
+
+	// the multihash and CID keys of the same digest don't collide.
+	ck := KeyFromCID(cid.NewCidV0(mh))
+	require.NotEqual(t, mk, ck)
+	require.Equal(t, KeyTypeCID, ck.Type())
+	require.NoError(t, ck.Validate())
+
+	commp, err := multihash.Encode(make([]byte, 32), multihash.SHA2_256_TRUNC254_PADDED)
+	require.NoError(t, err)
+	pk, err := KeyFromPieceCID(cid.NewCidV1(cid.FilCommitmentUnsealed, commp))
+	require.NoError(t, err)
+	require.Equal(t, KeyTypePieceCID, pk.Type())
+
+	// namespaced keys are typed by the key within the namespace.
+	require.Equal(t, KeyTypeUUID, KeyInNamespace("tenant", k).Type())
+	require.Equal(t, KeyTypeString, KeyFromString("foo").Type())
+}
+
+func TestKeyValidate(t *testing.T) {
+	mh, err := multihash.Sum([]byte("data"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	v1 := cid.NewCidV1(cid.Raw, mh)
+	for _, valid := range []Key{
+		KeyFromString("foo"),
+		KeyFromString("bar/baz"),
+		KeyFromString("123e4567e89b12d3a456426614174000"),
+		KeyFromCID(v1),
+		KeyInNamespace("tenant", KeyFromCID(v1)),
+		KeyFromPath("/data/a.car"),
+	} {
+		require.NoError(t, valid.Validate(), valid.String())
+	}
+
+	b58, err := v1.StringOfBase('z')
+	require.NoError(t, err)
+	for _, invalid := range []Key{
+		KeyFromString(""),
+		KeyFromString("foo\nbar"),
+		KeyFromString("\xff"),
+		KeyFromString("123E4567-E89B-12D3-A456-426614174000"),
+		KeyFromString(b58),
+		KeyInNamespace("tenant", KeyFromString(b58)),
+	} {
+		require.ErrorIs(t, invalid.Validate(), ErrInvalidKey, invalid.String())
+	}
+}
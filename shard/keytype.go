@@ -0,0 +1,174 @@
+package shard
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ipfs/go-cid"
+	"github.com/mr-tron/base58"
+	"github.com/multiformats/go-multihash"
+)
+
+// ErrInvalidKey is returned when a key is not valid for registration, e.g.
+// because it's empty, or it spells a typed key in a non-canonical form that
+// would not match the key obtained from the typed constructor.
+var ErrInvalidKey = errors.New("invalid shard key")
+
+// KeyType is the type of value a key was derived from, as inferred from its
+// canonical string encoding.
+type KeyType int
+
+const (
+	// KeyTypeString is a key from an arbitrary string, or from a byte slice.
+	KeyTypeString KeyType = iota
+	// KeyTypeCID is a key from a CID, in its canonical string form.
+	KeyTypeCID
+	// KeyTypePieceCID is a key from a piece CID; see KeyFromPieceCID.
+	KeyTypePieceCID
+	// KeyTypeUUID is a key from a UUID; see KeyFromUUID.
+	KeyTypeUUID
+	// KeyTypeMultihash is a key from a multihash; see KeyFromMultihash.
+	KeyTypeMultihash
+)
+
+func (t KeyType) String() string {
+	switch t {
+	case KeyTypeString:
+		return "string"
+	case KeyTypeCID:
+		return "cid"
+	case KeyTypePieceCID:
+		return "piece-cid"
+	case KeyTypeUUID:
+		return "uuid"
+	case KeyTypeMultihash:
+		return "multihash"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(t))
+	}
+}
+
+// multihashPrefix prefixes the base58btc encoding of multihash keys, as a
+// multibase string. It sets them apart from CID keys of the same digest, as
+// CIDs are encoded in base58btc without prefix (v0) or in base32 (v1).
+const multihashPrefix = "z"
+
+// KeyFromUUID returns the key for a UUID, in its canonical form: lowercase
+// hex digits, hyphenated 8-4-4-4-12.
+func KeyFromUUID(uuid [16]byte) Key {
+	var buf [36]byte
+	hex.Encode(buf[0:8], uuid[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], uuid[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], uuid[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], uuid[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], uuid[10:])
+	return Key{str: string(buf[:])}
+}
+
+// ParseUUIDKey returns the key for a UUID in its textual form, hyphenated or
+// not, in any case. Spellings of the same UUID map to the same key.
+func ParseUUIDKey(s string) (Key, error) {
+	uuid, ok := parseUUID(s)
+	if !ok {
+		return Key{}, fmt.Errorf("%w: %q is not a UUID", ErrInvalidKey, s)
+	}
+	return KeyFromUUID(uuid), nil
+}
+
+// KeyFromMultihash returns the key for a multihash, e.g. of the payload of a
+// CAR. It fails if mh is not a valid multihash.
+func KeyFromMultihash(mh multihash.Multihash) (Key, error) {
+	if _, err := multihash.Decode(mh); err != nil {
+		return Key{}, fmt.Errorf("%w: invalid multihash: %s", ErrInvalidKey, err)
+	}
+	return Key{str: multihashPrefix + base58.Encode(mh)}, nil
+}
+
+// Type returns the type of value the key was derived from, inferred from its
+// string form. Keys from strings that happen to spell a typed key in its
+// canonical form are of that type.
+func (k Key) Type() KeyType {
+	t, _ := k.parse()
+	return t
+}
+
+// Validate checks that the key can be registered. Keys must be non-empty,
+// valid UTF-8, and free of control characters. Keys that spell a CID or a
+// hyphenated UUID must do so in canonical form, so that a key from a string
+// can't silently differ from the key of the same value obtained from a typed
+// constructor.
+//
+// The namespace of namespaced keys is validated as a string.
+func (k Key) Validate() error {
+	if k.str == "" {
+		return fmt.Errorf("%w: empty key", ErrInvalidKey)
+	}
+	if !utf8.ValidString(k.str) {
+		return fmt.Errorf("%w: not valid UTF-8", ErrInvalidKey)
+	}
+	if i := strings.IndexFunc(k.str, unicode.IsControl); i >= 0 {
+		return fmt.Errorf("%w: control character at position %d", ErrInvalidKey, i)
+	}
+	if _, canonical := k.parse(); !canonical {
+		return fmt.Errorf("%w: %s is not in canonical form", ErrInvalidKey, k.str)
+	}
+	return nil
+}
+
+// parse infers the type of the key, and returns whether its string form is
+// canonical for that type.
+func (k Key) parse() (KeyType, bool) {
+	s := k.str
+	if ns := k.Namespace(); ns != "" {
+		s = s[len(ns)+len(NamespaceSeparator):]
+	}
+
+	// unhyphenated UUIDs aren't told apart from other hex strings.
+	if len(s) == 36 {
+		if uuid, ok := parseUUID(s); ok {
+			return KeyTypeUUID, KeyFromUUID(uuid).str == s
+		}
+	}
+	if strings.HasPrefix(s, multihashPrefix) {
+		if b, err := base58.Decode(s[len(multihashPrefix):]); err == nil {
+			if _, err := multihash.Decode(b); err == nil {
+				return KeyTypeMultihash, true
+			}
+		}
+	}
+	c, err := cid.Decode(s)
+	if err != nil {
+		return KeyTypeString, true
+	}
+	if c.Type() == cid.FilCommitmentUnsealed && c.Version() == 1 {
+		return KeyTypePieceCID, c.String() == s
+	}
+	return KeyTypeCID, c.String() == s
+}
+
+// parseUUID parses a UUID, hyphenated 8-4-4-4-12 or not, in any case.
+func parseUUID(s string) ([16]byte, bool) {
+	var uuid [16]byte
+	switch len(s) {
+	case 32:
+	case 36:
+		if s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+			return uuid, false
+		}
+		s = s[0:8] + s[9:13] + s[14:18] + s[19:23] + s[24:]
+	default:
+		return uuid, false
+	}
+	if _, err := hex.Decode(uuid[:], []byte(s)); err != nil {
+		return uuid, false
+	}
+	return uuid, true
+}
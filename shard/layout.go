@@ -0,0 +1,37 @@
+package shard
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+)
+
+// Layout specifies how files named after shard keys, e.g. transients and
+// indices, are laid out under a root directory.
+type Layout int
+
+const (
+	// LayoutFlat stores all files directly under the root directory.
+	LayoutFlat Layout = iota
+
+	// LayoutSharded fans files out across 256 subdirectories of the root
+	// directory, named after the first byte of the SHA-256 hash of the shard
+	// key in hex, so that no single directory grows too large.
+	LayoutSharded
+)
+
+func (l Layout) String() string {
+	return [...]string{
+		"LayoutFlat",
+		"LayoutSharded"}[l]
+}
+
+// Dir returns the directory under root where the files of the shard with
+// the supplied key are stored with this layout.
+func (l Layout) Dir(root string, k Key) string {
+	if l != LayoutSharded {
+		return root
+	}
+	h := sha256.Sum256([]byte(k.String()))
+	return filepath.Join(root, hex.EncodeToString(h[:1]))
+}
@@ -6,10 +6,12 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"sync/atomic"
+	"time"
 
-	"github.com/filecoin-project/dagstore/mount"
 	"github.com/filecoin-project/dagstore/shard"
 	ds "github.com/ipfs/go-datastore"
+	mh "github.com/multiformats/go-multihash"
 )
 
 // PersistedShard is the persistent representation of the Shard.
@@ -20,6 +22,57 @@ type PersistedShard struct {
 	State         ShardState `json:"s"`
 	Lazy          bool       `json:"l"`
 	Error         string     `json:"e"`
+	Checksum      []byte     `json:"c,omitempty"`
+	RegisteredAt  int64      `json:"ra,omitempty"` // unix nanoseconds
+	ExpiresAt     int64      `json:"ea,omitempty"` // unix nanoseconds
+	Compressed    bool       `json:"z,omitempty"`
+	// TransientCompressed records whether the transient is compressed; it's
+	// nil for shards persisted by versions that didn't record it, whose
+	// transients follow Compressed.
+	TransientCompressed *bool `json:"tz,omitempty"`
+
+	SkipTopLevelIndex bool `json:"sti,omitempty"`
+
+	AcquireCount   uint64 `json:"ac,omitempty"`
+	LastAcquiredAt int64  `json:"la,omitempty"` // unix nanoseconds
+	BytesServed    uint64 `json:"bs,omitempty"`
+	IndexedBlocks  uint64 `json:"ib,omitempty"`
+
+	Failures []ShardFailure `json:"f,omitempty"`
+
+	// RegisterOpts is nil for shards persisted by versions that didn't
+	// record their registration options.
+	RegisterOpts *PersistedRegisterOpts `json:"ro,omitempty"`
+}
+
+// PersistedRegisterOpts is the persistent representation of the RegisterOpts
+// a shard was registered with. The detached index isn't persisted.
+type PersistedRegisterOpts struct {
+	ExistingTransient string               `json:"et,omitempty"`
+	Lazy              bool                 `json:"l,omitempty"`
+	Checksum          []byte               `json:"c,omitempty"`
+	TTL               int64                `json:"ttl,omitempty"` // nanoseconds
+	Compression       TransientCompression `json:"z,omitempty"`
+	DetachedIndexPath string               `json:"dip,omitempty"`
+	SkipTopLevelIndex bool                 `json:"sti,omitempty"`
+	Labels            map[string]string    `json:"lb,omitempty"`
+}
+
+// registrationOpts returns a copy of the supplied options, as recorded for a
+// shard: without the detached index, and sharing no memory with them.
+func registrationOpts(opts RegisterOpts) RegisterOpts {
+	opts.DetachedIndex = nil
+	if opts.Checksum != nil {
+		opts.Checksum = append(mh.Multihash(nil), opts.Checksum...)
+	}
+	if opts.Labels != nil {
+		labels := make(map[string]string, len(opts.Labels))
+		for k, v := range opts.Labels {
+			labels[k] = v
+		}
+		opts.Labels = labels
+	}
+	return opts
 }
 
 // MarshalJSON returns a serialized representation of the state. It must be
@@ -30,16 +83,53 @@ func (s *Shard) MarshalJSON() ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to encode mount: %w", err)
 	}
+	transientCompressed := s.mount.TransientCompressed()
 	ps := PersistedShard{
 		Key:           s.key.String(),
 		URL:           u.String(),
 		State:         s.state,
 		Lazy:          s.lazy,
 		TransientPath: s.mount.TransientPath(),
+		Checksum:      s.mount.Checksum(),
+		Compressed:    s.mount.Compression(),
+
+		TransientCompressed: &transientCompressed,
+		SkipTopLevelIndex:   s.skipTopLevel,
+
+		AcquireCount: s.acquireCount,
+		BytesServed:  atomic.LoadUint64(&s.bytesServed),
+
+		IndexedBlocks: atomic.LoadUint64(&s.indexedBlocks),
+
+		Failures: s.failures,
+
+		RegisterOpts: &PersistedRegisterOpts{
+			ExistingTransient: s.regOpts.ExistingTransient,
+			Lazy:              s.regOpts.LazyInitialization,
+			Checksum:          s.regOpts.Checksum,
+			TTL:               int64(s.regOpts.TTL),
+			Compression:       s.regOpts.Compression,
+			DetachedIndexPath: s.regOpts.DetachedIndexPath,
+			SkipTopLevelIndex: s.regOpts.SkipTopLevelIndex,
+			Labels:            s.regOpts.Labels,
+		},
+	}
+	if !s.registeredAt.IsZero() {
+		ps.RegisteredAt = s.registeredAt.UnixNano()
+	}
+	if !s.expiresAt.IsZero() {
+		ps.ExpiresAt = s.expiresAt.UnixNano()
+	}
+	if !s.lastAcquiredAt.IsZero() {
+		ps.LastAcquiredAt = s.lastAcquiredAt.UnixNano()
 	}
 	if s.err != nil {
 		ps.Error = s.err.Error()
 	}
+	if s.txnTombstone {
+		// don't undo the tombstone persisted by a transaction.
+		ps.State = ShardStateTombstoned
+	}
 
 	return json.Marshal(ps)
 	// TODO maybe switch to CBOR, as it's probably faster.
@@ -60,9 +150,41 @@ func (s *Shard) UnmarshalJSON(b []byte) error {
 	s.key = shard.KeyFromString(ps.Key)
 	s.state = ps.State
 	s.lazy = ps.Lazy
+	s.skipTopLevel = ps.SkipTopLevelIndex
 	if ps.Error != "" {
 		s.err = errors.New(ps.Error)
 	}
+	if ps.RegisteredAt != 0 {
+		s.registeredAt = time.Unix(0, ps.RegisteredAt)
+	}
+	if ps.ExpiresAt != 0 {
+		s.expiresAt = time.Unix(0, ps.ExpiresAt)
+	}
+	s.acquireCount = ps.AcquireCount
+	if ps.LastAcquiredAt != 0 {
+		s.lastAcquiredAt = time.Unix(0, ps.LastAcquiredAt)
+	}
+	atomic.StoreUint64(&s.bytesServed, ps.BytesServed)
+	atomic.StoreUint64(&s.indexedBlocks, ps.IndexedBlocks)
+	s.failures = ps.Failures
+	if ro := ps.RegisterOpts; ro != nil {
+		s.regOpts = RegisterOpts{
+			ExistingTransient:  ro.ExistingTransient,
+			LazyInitialization: ro.Lazy,
+			Checksum:           ro.Checksum,
+			TTL:                time.Duration(ro.TTL),
+			Compression:        ro.Compression,
+			DetachedIndexPath:  ro.DetachedIndexPath,
+			SkipTopLevelIndex:  ro.SkipTopLevelIndex,
+			Labels:             ro.Labels,
+		}
+	} else {
+		// best effort for shards persisted without their options.
+		s.regOpts = RegisterOpts{LazyInitialization: ps.Lazy, SkipTopLevelIndex: ps.SkipTopLevelIndex}
+		if ps.ExpiresAt != 0 && ps.RegisteredAt != 0 {
+			s.regOpts.TTL = time.Duration(ps.ExpiresAt - ps.RegisteredAt)
+		}
+	}
 
 	// restore mount.
 	u, err := url.Parse(ps.URL)
@@ -73,10 +195,18 @@ func (s *Shard) UnmarshalJSON(b []byte) error {
 	if err != nil {
 		return fmt.Errorf("failed to instantiate mount from URL: %w", err)
 	}
-	s.mount, err = mount.Upgrade(mnt, s.d.throttleReaadyFetch, s.d.config.TransientsDir, s.key.String(), ps.TransientPath)
+	transientCompressed := ps.Compressed
+	if ps.TransientCompressed != nil {
+		transientCompressed = *ps.TransientCompressed
+	}
+	s.mount, err = s.d.upgrade(mnt, s.key, ps.TransientPath, ps.Compressed, transientCompressed)
 	if err != nil {
 		return fmt.Errorf("failed to apply mount upgrader: %w", err)
 	}
+	s.mount.SetChecksum(ps.Checksum)
+
+	// the transient may have been left stale or truncated by a crash.
+	s.mount.VerifyInitial()
 
 	return nil
 }
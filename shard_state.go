@@ -24,6 +24,17 @@ const (
 	// DAGStore.RecoverShard().
 	ShardStateRecovering ShardState = 0x80
 
+	// ShardStateArchived indicates that the shard's data and index have been
+	// moved to cold storage (see DAGStore.ArchiveShard). It can't be acquired
+	// until it's restored through DAGStore.UnarchiveShard.
+	ShardStateArchived ShardState = 0xd0
+
+	// ShardStateTombstoned indicates that the shard is being destroyed. New
+	// acquires are rejected, and its data is deleted once its active
+	// references drain, or the destroy deadline passes. The tombstone is
+	// persisted, so that the destroy is resumed if interrupted.
+	ShardStateTombstoned ShardState = 0xe0
+
 	// ShardStateErrored indicates that an unexpected error was encountered
 	// during a shard operation, and therefore the shard needs to be recovered.
 	ShardStateErrored ShardState = 0xf0
@@ -40,6 +51,8 @@ func (ss ShardState) String() string {
 		ShardStateAvailable:    "ShardStateAvailable",
 		ShardStateServing:      "ShardStateServing",
 		ShardStateRecovering:   "ShardStateRecovering",
+		ShardStateArchived:     "ShardStateArchived",
+		ShardStateTombstoned:   "ShardStateTombstoned",
 		ShardStateErrored:      "ShardStateErrored",
 		ShardStateUnknown:      "ShardStateUnknown",
 	}
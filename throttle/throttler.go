@@ -1,6 +1,9 @@
 package throttle
 
-import "context"
+import (
+	"context"
+	"sync"
+)
 
 // Throttler is a component to perform throttling of concurrent requests.
 type Throttler interface {
@@ -48,3 +51,71 @@ type noopThrottler struct{}
 func (noopThrottler) Do(ctx context.Context, fn func(ctx context.Context) error) error {
 	return fn(ctx)
 }
+
+// Adjustable is a throttler whose maximum concurrency can be changed while
+// it's in use.
+type Adjustable struct {
+	lk     sync.Mutex
+	max    int
+	active int
+	// freed is closed and replaced whenever a spot is released or the
+	// maximum changes, to wake up parked callers.
+	freed chan struct{}
+}
+
+var _ Throttler = (*Adjustable)(nil)
+
+// NewAdjustable creates a new throttler that allows the specified concurrency
+// at most, or unlimited concurrency if it's zero or negative.
+func NewAdjustable(maxConcurrency int) *Adjustable {
+	return &Adjustable{max: maxConcurrency, freed: make(chan struct{})}
+}
+
+// SetMax changes the maximum concurrency; zero or negative removes the limit.
+// Actions in flight are unaffected; lowering the maximum below the number of
+// actions in flight only parks new callers until enough of them finish.
+func (t *Adjustable) SetMax(maxConcurrency int) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	t.max = maxConcurrency
+	t.broadcast()
+}
+
+// Max returns the current maximum concurrency.
+func (t *Adjustable) Max() int {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	return t.max
+}
+
+func (t *Adjustable) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	t.lk.Lock()
+	for t.max > 0 && t.active >= t.max {
+		freed := t.freed
+		t.lk.Unlock()
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		t.lk.Lock()
+	}
+	t.active++
+	t.lk.Unlock()
+
+	defer func() {
+		t.lk.Lock()
+		t.active--
+		t.broadcast()
+		t.lk.Unlock()
+	}()
+	return fn(ctx)
+}
+
+// broadcast wakes up parked callers. It must be called with the lock held.
+func (t *Adjustable) broadcast() {
+	close(t.freed)
+	t.freed = make(chan struct{})
+}
@@ -76,3 +76,55 @@ func TestThrottler(t *testing.T) {
 		require.ErrorIs(t, <-errCh, context.Canceled)
 	}
 }
+
+func TestAdjustable(t *testing.T) {
+	tt := NewAdjustable(2)
+
+	var cnt int32
+	ch := make(chan struct{}, 16)
+	fn := func(ctx context.Context) error {
+		atomic.AddInt32(&cnt, 1)
+		<-ch
+		return nil
+	}
+
+	// spawn 6 processes; 2 of them will start and block consuming from ch.
+	grp, _ := errgroup.WithContext(context.Background())
+	for i := 0; i < 6; i++ {
+		grp.Go(func() error {
+			return tt.Do(context.Background(), fn)
+		})
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	require.EqualValues(t, 2, atomic.LoadInt32(&cnt))
+
+	// raising the limit lets parked processes start.
+	tt.SetMax(4)
+	time.Sleep(100 * time.Millisecond)
+	require.EqualValues(t, 4, atomic.LoadInt32(&cnt))
+
+	// lowering the limit doesn't affect processes in flight, but parks the
+	// rest until enough of them finish.
+	tt.SetMax(1)
+	for i := 0; i < 3; i++ {
+		ch <- struct{}{}
+	}
+	time.Sleep(100 * time.Millisecond)
+	require.EqualValues(t, 4, atomic.LoadInt32(&cnt))
+
+	ch <- struct{}{}
+	time.Sleep(100 * time.Millisecond)
+	require.EqualValues(t, 5, atomic.LoadInt32(&cnt))
+
+	// removing the limit lets the rest start.
+	tt.SetMax(0)
+	time.Sleep(100 * time.Millisecond)
+	require.EqualValues(t, 6, atomic.LoadInt32(&cnt))
+
+	for i := 0; i < 2; i++ {
+		ch <- struct{}{}
+	}
+	require.NoError(t, grp.Wait())
+	require.Zero(t, tt.Max())
+}